@@ -363,6 +363,18 @@ func (m *ServiceInstanceMetrics) MarshalToSizedBufferVT(dAtA []byte) (int, error
 		i -= len(m.unknownFields)
 		copy(dAtA[i:], m.unknownFields)
 	}
+	if len(m.SpanDestinationMetrics) > 0 {
+		for iNdEx := len(m.SpanDestinationMetrics) - 1; iNdEx >= 0; iNdEx-- {
+			size, err := m.SpanDestinationMetrics[iNdEx].MarshalToSizedBufferVT(dAtA[:i])
+			if err != nil {
+				return 0, err
+			}
+			i -= size
+			i = encodeVarint(dAtA, i, uint64(size))
+			i--
+			dAtA[i] = 0x22
+		}
+	}
 	if len(m.SpanMetrics) > 0 {
 		for iNdEx := len(m.SpanMetrics) - 1; iNdEx >= 0; iNdEx-- {
 			size, err := m.SpanMetrics[iNdEx].MarshalToSizedBufferVT(dAtA[:i])
@@ -803,6 +815,12 @@ func (m *TransactionMetrics) MarshalToSizedBufferVT(dAtA []byte) (int, error) {
 		i -= len(m.unknownFields)
 		copy(dAtA[i:], m.unknownFields)
 	}
+	if m.DroppedSpansCount != 0 {
+		i -= 8
+		binary.LittleEndian.PutUint64(dAtA[i:], uint64(math.Float64bits(float64(m.DroppedSpansCount))))
+		i--
+		dAtA[i] = 0x11
+	}
 	if m.Histogram != nil {
 		size, err := m.Histogram.MarshalToSizedBufferVT(dAtA[:i])
 		if err != nil {
@@ -1130,6 +1148,99 @@ func (m *SpanMetrics) MarshalToSizedBufferVT(dAtA []byte) (int, error) {
 	return len(dAtA) - i, nil
 }
 
+func (m *KeyedSpanDestinationMetrics) MarshalVT() (dAtA []byte, err error) {
+	if m == nil {
+		return nil, nil
+	}
+	size := m.SizeVT()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBufferVT(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *KeyedSpanDestinationMetrics) MarshalToVT(dAtA []byte) (int, error) {
+	size := m.SizeVT()
+	return m.MarshalToSizedBufferVT(dAtA[:size])
+}
+
+func (m *KeyedSpanDestinationMetrics) MarshalToSizedBufferVT(dAtA []byte) (int, error) {
+	if m == nil {
+		return 0, nil
+	}
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if m.unknownFields != nil {
+		i -= len(m.unknownFields)
+		copy(dAtA[i:], m.unknownFields)
+	}
+	if m.Metrics != nil {
+		size, err := m.Metrics.MarshalToSizedBufferVT(dAtA[:i])
+		if err != nil {
+			return 0, err
+		}
+		i -= size
+		i = encodeVarint(dAtA, i, uint64(size))
+		i--
+		dAtA[i] = 0x12
+	}
+	if m.Key != nil {
+		size, err := m.Key.MarshalToSizedBufferVT(dAtA[:i])
+		if err != nil {
+			return 0, err
+		}
+		i -= size
+		i = encodeVarint(dAtA, i, uint64(size))
+		i--
+		dAtA[i] = 0xa
+	}
+	return len(dAtA) - i, nil
+}
+
+func (m *SpanDestinationAggregationKey) MarshalVT() (dAtA []byte, err error) {
+	if m == nil {
+		return nil, nil
+	}
+	size := m.SizeVT()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBufferVT(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *SpanDestinationAggregationKey) MarshalToVT(dAtA []byte) (int, error) {
+	size := m.SizeVT()
+	return m.MarshalToSizedBufferVT(dAtA[:size])
+}
+
+func (m *SpanDestinationAggregationKey) MarshalToSizedBufferVT(dAtA []byte) (int, error) {
+	if m == nil {
+		return 0, nil
+	}
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if m.unknownFields != nil {
+		i -= len(m.unknownFields)
+		copy(dAtA[i:], m.unknownFields)
+	}
+	if len(m.Resource) > 0 {
+		i -= len(m.Resource)
+		copy(dAtA[i:], m.Resource)
+		i = encodeVarint(dAtA, i, uint64(len(m.Resource)))
+		i--
+		dAtA[i] = 0xa
+	}
+	return len(dAtA) - i, nil
+}
+
 func (m *CountValue) MarshalVT() (dAtA []byte, err error) {
 	if m == nil {
 		return nil, nil
@@ -1293,6 +1404,23 @@ func (m *Overflow) MarshalToSizedBufferVT(dAtA []byte) (int, error) {
 		i -= len(m.unknownFields)
 		copy(dAtA[i:], m.unknownFields)
 	}
+	if len(m.OverflowSpanDestinationsEstimator) > 0 {
+		i -= len(m.OverflowSpanDestinationsEstimator)
+		copy(dAtA[i:], m.OverflowSpanDestinationsEstimator)
+		i = encodeVarint(dAtA, i, uint64(len(m.OverflowSpanDestinationsEstimator)))
+		i--
+		dAtA[i] = 0x42
+	}
+	if m.OverflowSpanDestinations != nil {
+		size, err := m.OverflowSpanDestinations.MarshalToSizedBufferVT(dAtA[:i])
+		if err != nil {
+			return 0, err
+		}
+		i -= size
+		i = encodeVarint(dAtA, i, uint64(size))
+		i--
+		dAtA[i] = 0x3a
+	}
 	if len(m.OverflowSpansEstimator) > 0 {
 		i -= len(m.OverflowSpansEstimator)
 		copy(dAtA[i:], m.OverflowSpansEstimator)
@@ -1486,6 +1614,9 @@ func (m *ServiceInstanceMetrics) ResetVT() {
 	for _, mm := range m.SpanMetrics {
 		mm.ResetVT()
 	}
+	for _, mm := range m.SpanDestinationMetrics {
+		mm.ResetVT()
+	}
 	m.Reset()
 }
 func (m *ServiceInstanceMetrics) ReturnToVTPool() {
@@ -1698,6 +1829,46 @@ func SpanMetricsFromVTPool() *SpanMetrics {
 	return vtprotoPool_SpanMetrics.Get().(*SpanMetrics)
 }
 
+var vtprotoPool_KeyedSpanDestinationMetrics = sync.Pool{
+	New: func() interface{} {
+		return &KeyedSpanDestinationMetrics{}
+	},
+}
+
+func (m *KeyedSpanDestinationMetrics) ResetVT() {
+	m.Key.ReturnToVTPool()
+	m.Metrics.ReturnToVTPool()
+	m.Reset()
+}
+func (m *KeyedSpanDestinationMetrics) ReturnToVTPool() {
+	if m != nil {
+		m.ResetVT()
+		vtprotoPool_KeyedSpanDestinationMetrics.Put(m)
+	}
+}
+func KeyedSpanDestinationMetricsFromVTPool() *KeyedSpanDestinationMetrics {
+	return vtprotoPool_KeyedSpanDestinationMetrics.Get().(*KeyedSpanDestinationMetrics)
+}
+
+var vtprotoPool_SpanDestinationAggregationKey = sync.Pool{
+	New: func() interface{} {
+		return &SpanDestinationAggregationKey{}
+	},
+}
+
+func (m *SpanDestinationAggregationKey) ResetVT() {
+	m.Reset()
+}
+func (m *SpanDestinationAggregationKey) ReturnToVTPool() {
+	if m != nil {
+		m.ResetVT()
+		vtprotoPool_SpanDestinationAggregationKey.Put(m)
+	}
+}
+func SpanDestinationAggregationKeyFromVTPool() *SpanDestinationAggregationKey {
+	return vtprotoPool_SpanDestinationAggregationKey.Get().(*SpanDestinationAggregationKey)
+}
+
 var vtprotoPool_CountValue = sync.Pool{
 	New: func() interface{} {
 		return &CountValue{}
@@ -1753,10 +1924,13 @@ func (m *Overflow) ResetVT() {
 	f0 := m.OverflowTransactionsEstimator[:0]
 	f1 := m.OverflowServiceTransactionsEstimator[:0]
 	f2 := m.OverflowSpansEstimator[:0]
+	m.OverflowSpanDestinations.ReturnToVTPool()
+	f3 := m.OverflowSpanDestinationsEstimator[:0]
 	m.Reset()
 	m.OverflowTransactionsEstimator = f0
 	m.OverflowServiceTransactionsEstimator = f1
 	m.OverflowSpansEstimator = f2
+	m.OverflowSpanDestinationsEstimator = f3
 }
 func (m *Overflow) ReturnToVTPool() {
 	if m != nil {
@@ -1910,6 +2084,12 @@ func (m *ServiceInstanceMetrics) SizeVT() (n int) {
 			n += 1 + l + sov(uint64(l))
 		}
 	}
+	if len(m.SpanDestinationMetrics) > 0 {
+		for _, e := range m.SpanDestinationMetrics {
+			l = e.SizeVT()
+			n += 1 + l + sov(uint64(l))
+		}
+	}
 	n += len(m.unknownFields)
 	return n
 }
@@ -2084,6 +2264,9 @@ func (m *TransactionMetrics) SizeVT() (n int) {
 		l = m.Histogram.SizeVT()
 		n += 1 + l + sov(uint64(l))
 	}
+	if m.DroppedSpansCount != 0 {
+		n += 9
+	}
 	n += len(m.unknownFields)
 	return n
 }
@@ -2204,6 +2387,38 @@ func (m *SpanMetrics) SizeVT() (n int) {
 	return n
 }
 
+func (m *KeyedSpanDestinationMetrics) SizeVT() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if m.Key != nil {
+		l = m.Key.SizeVT()
+		n += 1 + l + sov(uint64(l))
+	}
+	if m.Metrics != nil {
+		l = m.Metrics.SizeVT()
+		n += 1 + l + sov(uint64(l))
+	}
+	n += len(m.unknownFields)
+	return n
+}
+
+func (m *SpanDestinationAggregationKey) SizeVT() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	l = len(m.Resource)
+	if l > 0 {
+		n += 1 + l + sov(uint64(l))
+	}
+	n += len(m.unknownFields)
+	return n
+}
+
 func (m *CountValue) SizeVT() (n int) {
 	if m == nil {
 		return 0
@@ -2283,6 +2498,14 @@ func (m *Overflow) SizeVT() (n int) {
 	if l > 0 {
 		n += 1 + l + sov(uint64(l))
 	}
+	if m.OverflowSpanDestinations != nil {
+		l = m.OverflowSpanDestinations.SizeVT()
+		n += 1 + l + sov(uint64(l))
+	}
+	l = len(m.OverflowSpanDestinationsEstimator)
+	if l > 0 {
+		n += 1 + l + sov(uint64(l))
+	}
 	n += len(m.unknownFields)
 	return n
 }
@@ -3219,6 +3442,47 @@ func (m *ServiceInstanceMetrics) UnmarshalVT(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 4:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SpanDestinationMetrics", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflow
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLength
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLength
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if len(m.SpanDestinationMetrics) == cap(m.SpanDestinationMetrics) {
+				m.SpanDestinationMetrics = append(m.SpanDestinationMetrics, &KeyedSpanDestinationMetrics{})
+			} else {
+				m.SpanDestinationMetrics = m.SpanDestinationMetrics[:len(m.SpanDestinationMetrics)+1]
+				if m.SpanDestinationMetrics[len(m.SpanDestinationMetrics)-1] == nil {
+					m.SpanDestinationMetrics[len(m.SpanDestinationMetrics)-1] = &KeyedSpanDestinationMetrics{}
+				}
+			}
+			if err := m.SpanDestinationMetrics[len(m.SpanDestinationMetrics)-1].UnmarshalVT(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skip(dAtA[iNdEx:])
@@ -4506,6 +4770,17 @@ func (m *TransactionMetrics) UnmarshalVT(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 2:
+			if wireType != 1 {
+				return fmt.Errorf("proto: wrong wireType = %d for field DroppedSpansCount", wireType)
+			}
+			var v uint64
+			if (iNdEx + 8) > l {
+				return io.ErrUnexpectedEOF
+			}
+			v = uint64(binary.LittleEndian.Uint64(dAtA[iNdEx:]))
+			iNdEx += 8
+			m.DroppedSpansCount = float64(math.Float64frombits(v))
 		default:
 			iNdEx = preIndex
 			skippy, err := skip(dAtA[iNdEx:])
@@ -5250,6 +5525,212 @@ func (m *SpanMetrics) UnmarshalVT(dAtA []byte) error {
 	}
 	return nil
 }
+func (m *KeyedSpanDestinationMetrics) UnmarshalVT(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflow
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: KeyedSpanDestinationMetrics: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: KeyedSpanDestinationMetrics: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Key", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflow
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLength
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLength
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.Key == nil {
+				m.Key = SpanDestinationAggregationKeyFromVTPool()
+			}
+			if err := m.Key.UnmarshalVT(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Metrics", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflow
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLength
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLength
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.Metrics == nil {
+				m.Metrics = SpanMetricsFromVTPool()
+			}
+			if err := m.Metrics.UnmarshalVT(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skip(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLength
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.unknownFields = append(m.unknownFields, dAtA[iNdEx:iNdEx+skippy]...)
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *SpanDestinationAggregationKey) UnmarshalVT(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflow
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: SpanDestinationAggregationKey: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: SpanDestinationAggregationKey: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Resource", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflow
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLength
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLength
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Resource = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skip(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLength
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.unknownFields = append(m.unknownFields, dAtA[iNdEx:iNdEx+skippy]...)
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
 func (m *CountValue) UnmarshalVT(dAtA []byte) error {
 	l := len(dAtA)
 	iNdEx := 0
@@ -5838,6 +6319,76 @@ func (m *Overflow) UnmarshalVT(dAtA []byte) error {
 				m.OverflowSpansEstimator = []byte{}
 			}
 			iNdEx = postIndex
+		case 7:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field OverflowSpanDestinations", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflow
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLength
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLength
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.OverflowSpanDestinations == nil {
+				m.OverflowSpanDestinations = SpanMetricsFromVTPool()
+			}
+			if err := m.OverflowSpanDestinations.UnmarshalVT(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 8:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field OverflowSpanDestinationsEstimator", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflow
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLength
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLength
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.OverflowSpanDestinationsEstimator = append(m.OverflowSpanDestinationsEstimator[:0], dAtA[iNdEx:postIndex]...)
+			if m.OverflowSpanDestinationsEstimator == nil {
+				m.OverflowSpanDestinationsEstimator = []byte{}
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skip(dAtA[iNdEx:])
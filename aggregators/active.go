@@ -0,0 +1,204 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"sync"
+	"time"
+)
+
+// activeCombinedMetrics tracks the distinct combined metrics keys which
+// are aggregated but not yet harvested per aggregation interval.
+//
+// The keys are tracked in memory instead of counting the keys in pebble
+// on every collection of the telemetry. Counting the keys in pebble would
+// require iterating over all the buffered keys, and merging the values
+// for each of the keys, with the cost of collection growing with the
+// cardinality that the telemetry is meant to expose. Tracking the keys
+// in memory costs a map entry per key and a lock per aggregation instead.
+//
+// For each key, the estimated memory held by the latency histograms and
+// the number of overflow buckets of the aggregated metrics are tracked as
+// well. They are updated when the aggregated metrics of the key are fully
+// merged by the database, for example, when the key is read or compacted,
+// thus, they lag behind the aggregations.
+type activeCombinedMetrics struct {
+	mu sync.Mutex
+	// keys maps the active keys to the state of their aggregated metrics.
+	keys map[time.Duration]map[activeKey]activeState
+}
+
+// activeState is the state of the aggregated metrics of an active key as
+// of their last full merge.
+type activeState struct {
+	// histogramsMemory is the estimated memory, in bytes, held by the
+	// latency histograms.
+	histogramsMemory int64
+	// overflowBuckets is the number of non-empty overflow buckets.
+	overflowBuckets int64
+}
+
+type activeKey struct {
+	processingTime int64
+	id             string
+}
+
+func newActiveCombinedMetrics() *activeCombinedMetrics {
+	return &activeCombinedMetrics{
+		keys: make(map[time.Duration]map[activeKey]activeState),
+	}
+}
+
+// add tracks the given combined metrics key as active.
+func (a *activeCombinedMetrics) add(cmk CombinedMetricsKey) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	keys, ok := a.keys[cmk.Interval]
+	if !ok {
+		keys = make(map[activeKey]activeState)
+		a.keys[cmk.Interval] = keys
+	}
+	k := activeKey{processingTime: cmk.ProcessingTime.UnixNano(), id: cmk.ID}
+	if _, ok := keys[k]; !ok {
+		keys[k] = activeState{}
+	}
+}
+
+// merged updates the estimated memory held by the latency histograms and
+// the number of overflow buckets of the given fully merged combined
+// metrics. Keys which are not active, for example, merged by compactions
+// after being harvested, are ignored.
+func (a *activeCombinedMetrics) merged(cmk CombinedMetricsKey, cm *CombinedMetrics) {
+	state := activeState{
+		histogramsMemory: histogramsMemoryEstimate(cm),
+		overflowBuckets:  overflowBucketsCount(cm),
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	k := activeKey{processingTime: cmk.ProcessingTime.UnixNano(), id: cmk.ID}
+	if _, ok := a.keys[cmk.Interval][k]; ok {
+		a.keys[cmk.Interval][k] = state
+	}
+}
+
+// harvested stops tracking all the keys for the given interval with
+// processing time before the given end time.
+func (a *activeCombinedMetrics) harvested(ivl time.Duration, end time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	endNanos := end.UnixNano()
+	for k := range a.keys[ivl] {
+		if k.processingTime < endNanos {
+			delete(a.keys[ivl], k)
+		}
+	}
+}
+
+// remove stops tracking the given keys.
+func (a *activeCombinedMetrics) remove(cmks []CombinedMetricsKey) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, cmk := range cmks {
+		k := activeKey{processingTime: cmk.ProcessingTime.UnixNano(), id: cmk.ID}
+		delete(a.keys[cmk.Interval], k)
+	}
+}
+
+// reset stops tracking all the keys of all the aggregation intervals.
+func (a *activeCombinedMetrics) reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.keys = make(map[time.Duration]map[activeKey]activeState)
+}
+
+// counts returns the number of active keys per aggregation interval.
+func (a *activeCombinedMetrics) counts() map[time.Duration]int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	counts := make(map[time.Duration]int64, len(a.keys))
+	for ivl, keys := range a.keys {
+		counts[ivl] = int64(len(keys))
+	}
+	return counts
+}
+
+// histogramsMemory returns the estimated memory, in bytes, held by the
+// latency histograms of the active keys per aggregation interval.
+func (a *activeCombinedMetrics) histogramsMemory() map[time.Duration]int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	memory := make(map[time.Duration]int64, len(a.keys))
+	for ivl, keys := range a.keys {
+		var total int64
+		for _, state := range keys {
+			total += state.histogramsMemory
+		}
+		memory[ivl] = total
+	}
+	return memory
+}
+
+// overflowBuckets returns the number of overflow buckets of the active
+// keys per aggregation interval.
+func (a *activeCombinedMetrics) overflowBuckets() map[time.Duration]int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	buckets := make(map[time.Duration]int64, len(a.keys))
+	for ivl, keys := range a.keys {
+		var total int64
+		for _, state := range keys {
+			total += state.overflowBuckets
+		}
+		buckets[ivl] = total
+	}
+	return buckets
+}
+
+// histogramsMemoryEstimate returns the estimated memory, in bytes, held by
+// the latency histograms of the combined metrics, including overflows.
+func histogramsMemoryEstimate(cm *CombinedMetrics) int64 {
+	overflowMemory := func(o *Overflow) int64 {
+		return o.OverflowTransaction.Metrics.Histogram.MemoryEstimate() +
+			o.OverflowServiceTransaction.Metrics.Histogram.MemoryEstimate()
+	}
+	memory := overflowMemory(&cm.OverflowServices)
+	for _, sm := range cm.Services {
+		memory += overflowMemory(&sm.OverflowGroups)
+		for _, sim := range sm.ServiceInstanceGroups {
+			for _, tm := range sim.TransactionGroups {
+				memory += tm.Histogram.MemoryEstimate()
+			}
+			for _, stm := range sim.ServiceTransactionGroups {
+				memory += stm.Histogram.MemoryEstimate()
+			}
+		}
+	}
+	return memory
+}
+
+// overflowBucketsCount returns the number of non-empty overflow buckets of
+// the combined metrics: the buckets of the overflowed services and the
+// buckets of every service for each overflow type.
+func overflowBucketsCount(cm *CombinedMetrics) int64 {
+	count := func(o *Overflow) int64 {
+		var n int64
+		for _, empty := range []bool{
+			o.OverflowTransaction.Empty(),
+			o.OverflowServiceTransaction.Empty(),
+			o.OverflowSpan.Empty(),
+			o.OverflowSpanDestination.Empty(),
+		} {
+			if !empty {
+				n++
+			}
+		}
+		return n
+	}
+	buckets := count(&cm.OverflowServices)
+	for _, sm := range cm.Services {
+		buckets += count(&sm.OverflowGroups)
+	}
+	return buckets
+}
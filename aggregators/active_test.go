@@ -0,0 +1,121 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-aggregation/aggregators/internal/hdrhistogram"
+)
+
+func TestActiveCombinedMetrics(t *testing.T) {
+	ts := time.Unix(0, 0).UTC()
+	active := newActiveCombinedMetrics()
+	assert.Empty(t, active.counts())
+
+	for _, cmk := range []CombinedMetricsKey{
+		{Interval: time.Minute, ProcessingTime: ts, ID: "1"},
+		{Interval: time.Minute, ProcessingTime: ts, ID: "1"},
+		{Interval: time.Minute, ProcessingTime: ts, ID: "2"},
+		{Interval: time.Minute, ProcessingTime: ts.Add(time.Minute), ID: "1"},
+		{Interval: time.Hour, ProcessingTime: ts, ID: "1"},
+	} {
+		active.add(cmk)
+	}
+	assert.Equal(t, map[time.Duration]int64{
+		time.Minute: 3,
+		time.Hour:   1,
+	}, active.counts())
+
+	active.harvested(time.Minute, ts.Add(time.Minute))
+	assert.Equal(t, map[time.Duration]int64{
+		time.Minute: 1,
+		time.Hour:   1,
+	}, active.counts())
+
+	active.harvested(time.Hour, ts.Add(time.Hour))
+	assert.Equal(t, map[time.Duration]int64{
+		time.Minute: 1,
+		time.Hour:   0,
+	}, active.counts())
+
+	active.add(CombinedMetricsKey{Interval: time.Minute, ProcessingTime: ts, ID: "1"})
+	active.remove([]CombinedMetricsKey{
+		{Interval: time.Minute, ProcessingTime: ts, ID: "1"},
+		{Interval: time.Hour, ProcessingTime: ts, ID: "1"},
+	})
+	assert.Equal(t, map[time.Duration]int64{
+		time.Minute: 1,
+		time.Hour:   0,
+	}, active.counts())
+}
+
+func TestActiveCombinedMetricsHistogramsMemory(t *testing.T) {
+	ts := time.Unix(0, 0).UTC()
+	active := newActiveCombinedMetrics()
+	assert.Empty(t, active.histogramsMemory())
+
+	hist := hdrhistogram.New()
+	require.NoError(t, hist.RecordDuration(time.Second, 1))
+	cm := (*CombinedMetrics)(createTestCombinedMetrics(3).
+		addTransaction(ts, "svc1", "", testTransaction{txnName: "txn1", txnType: "type1", count: 1}).
+		addTransaction(ts, "svc1", "", testTransaction{txnName: "txn2", txnType: "type1", count: 1}).
+		addServiceTransaction(ts, "svc1", "", testServiceTransaction{txnType: "type1", count: 2}))
+	// Two transaction groups and one service transaction group.
+	expected := 3 * hist.MemoryEstimate()
+	assert.Equal(t, expected, histogramsMemoryEstimate(cm))
+
+	cmk := CombinedMetricsKey{Interval: time.Minute, ProcessingTime: ts, ID: "1"}
+	active.merged(cmk, cm)
+	assert.Empty(t, active.histogramsMemory(), "inactive keys are ignored")
+
+	active.add(cmk)
+	active.add(CombinedMetricsKey{Interval: time.Minute, ProcessingTime: ts, ID: "2"})
+	active.merged(cmk, cm)
+	assert.Equal(t, map[time.Duration]int64{time.Minute: expected}, active.histogramsMemory())
+	// Adding an active key does not reset its estimate.
+	active.add(cmk)
+	assert.Equal(t, map[time.Duration]int64{time.Minute: expected}, active.histogramsMemory())
+
+	active.harvested(time.Minute, ts.Add(time.Minute))
+	assert.Equal(t, map[time.Duration]int64{time.Minute: 0}, active.histogramsMemory())
+}
+
+func TestActiveCombinedMetricsOverflowBuckets(t *testing.T) {
+	ts := time.Unix(0, 0).UTC()
+	active := newActiveCombinedMetrics()
+	assert.Empty(t, active.overflowBuckets())
+
+	txn := testTransaction{txnName: "txn1", txnType: "type1", count: 1}
+	cm := (*CombinedMetrics)(createTestCombinedMetrics(6).
+		addTransaction(ts, "svc1", "", txn).
+		addPerServiceOverflowTransaction(ts, "svc1", "", testTransaction{txnName: "txn2", txnType: "type1", count: 1}).
+		addPerServiceOverflowSpan(ts, "svc1", "", testSpan{spanName: "span1", count: 1}).
+		addPerServiceOverflowTransaction(ts, "svc2", "", testTransaction{txnName: "txn2", txnType: "type1", count: 1}).
+		addGlobalServiceOverflowTransaction(ts, "svc3", "", txn).
+		addGlobalServiceOverflowServiceTransaction(ts, "svc3", "", testServiceTransaction{txnType: "type1", count: 1}))
+	// The transaction and span buckets of svc1, the transaction bucket of
+	// svc2, and the transaction and service transaction buckets of the
+	// overflowed services.
+	assert.Equal(t, int64(5), overflowBucketsCount(cm))
+	assert.Zero(t, overflowBucketsCount((*CombinedMetrics)(createTestCombinedMetrics(1).
+		addTransaction(ts, "svc1", "", txn))))
+
+	cmk := CombinedMetricsKey{Interval: time.Minute, ProcessingTime: ts, ID: "1"}
+	active.merged(cmk, cm)
+	assert.Empty(t, active.overflowBuckets(), "inactive keys are ignored")
+
+	active.add(cmk)
+	active.add(CombinedMetricsKey{Interval: time.Minute, ProcessingTime: ts, ID: "2"})
+	active.merged(cmk, cm)
+	assert.Equal(t, map[time.Duration]int64{time.Minute: 5}, active.overflowBuckets())
+
+	active.harvested(time.Minute, ts.Add(time.Minute))
+	assert.Equal(t, map[time.Duration]int64{time.Minute: 0}, active.overflowBuckets())
+}
@@ -6,28 +6,55 @@
 package aggregators
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
 	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
 
+	"github.com/elastic/apm-aggregation/aggregationpb"
+	"github.com/elastic/apm-aggregation/aggregators/internal/hdrhistogram"
 	"github.com/elastic/apm-aggregation/aggregators/internal/telemetry"
 	"github.com/elastic/apm-data/model/modelpb"
 )
 
 const (
 	dbCommitThresholdBytes = 10 * 1024 * 1024 // commit every 10MB
-	aggregationIvlKey      = "aggregation_interval"
+	maxMemtableSize        = 4 << 30          // pebble's limit on 64-bit platforms
+)
+
+// Overflow types used as the value of the telemetry.OverflowTypeKey
+// attribute for recording the events aggregated into overflow buckets.
+const (
+	overflowTypeService            = "service"
+	overflowTypeTransaction        = "transaction"
+	overflowTypeServiceTransaction = "service_transaction"
+	overflowTypeSpan               = "span"
+	overflowTypeSpanDestination    = "span_destination"
+)
+
+// Reasons for rejecting events from aggregation used as the value of the
+// telemetry.RejectReasonKey attribute.
+const (
+	rejectReasonMissingEvent               = "missing_event"
+	rejectReasonMissingRequiredField       = "missing_required_field"
+	rejectReasonInvalidRepresentativeCount = "invalid_representative_count"
 )
 
 var (
@@ -37,9 +64,84 @@ var (
 	// ErrAggregatorAlreadyRunning means that aggregator Run method is
 	// called while the aggregator is already running.
 	ErrAggregatorAlreadyRunning = errors.New("aggregator is already running")
+	// ErrRetryable marks errors for which the failed operation can be
+	// retried later, it is wrapped by the retryable errors returned by
+	// the aggregator and can be checked using errors.Is.
+	ErrRetryable = errors.New("retryable")
+	// ErrWriteStalled means that the aggregation was rejected as the
+	// aggregator's database is overloaded, see WriteStallThreshold and
+	// MemtableSizeThreshold. The aggregation can be retried later.
+	ErrWriteStalled = fmt.Errorf("aggregator writes are stalled: %w", ErrRetryable)
+	// ErrDiskFull means that the aggregation was rejected as the disk
+	// space used by the aggregator's database exceeds the configured
+	// DiskUsageLimit. The aggregation can be retried later, once harvests
+	// have freed enough disk space.
+	ErrDiskFull = fmt.Errorf("aggregator disk usage limit exceeded: %w", ErrRetryable)
+	// ErrHarvestInProgress means that the operation cannot be performed
+	// while the aggregator is harvesting. The operation can be retried
+	// later.
+	ErrHarvestInProgress = fmt.Errorf("aggregator is harvesting: %w", ErrRetryable)
+	// ErrCompactRangeRateLimited means that CompactRange was called
+	// before CompactRangeInterval elapsed since the previous manual
+	// compaction. The compaction can be retried later.
+	ErrCompactRangeRateLimited = fmt.Errorf("aggregator manual compaction is rate limited: %w", ErrRetryable)
+	// ErrIntervalUnavailable means that the combined metrics were
+	// rejected as the pebble database of their aggregation interval
+	// failed to open, see ContinueOnIntervalOpenError.
+	ErrIntervalUnavailable = errors.New("aggregation interval is unavailable")
+	// ErrBatchTooLarge means that the batch was rejected as it has more
+	// events than MaxBatchSize.
+	ErrBatchTooLarge = errors.New("batch exceeds the maximum batch size")
 )
 
+// HarvestIncompleteError is returned by Stop if the final harvest was
+// aborted, due to the context being done, before harvesting all of the
+// aggregation intervals.
+type HarvestIncompleteError struct {
+	// Intervals holds the aggregation intervals which were not harvested.
+	Intervals []time.Duration
+	// Err holds the error of the context which aborted the harvest.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *HarvestIncompleteError) Error() string {
+	ivls := make([]string, len(e.Intervals))
+	for i, ivl := range e.Intervals {
+		ivls[i] = formatDuration(ivl)
+	}
+	return fmt.Sprintf(
+		"harvest incomplete for aggregation intervals [%s]: %v",
+		strings.Join(ivls, ", "), e.Err,
+	)
+}
+
+// Unwrap returns the error of the context which aborted the harvest.
+func (e *HarvestIncompleteError) Unwrap() error {
+	return e.Err
+}
+
 // Processor defines handling of the aggregated metrics post harvest.
+//
+// The harvested combined metrics are processed in a deterministic order:
+// by ascending aggregation interval and, within an aggregation interval,
+// by ascending processing time and combined metrics ID, compared as
+// bytes. The order follows from the encoding of CombinedMetricsKey, which
+// the database iterates in bytewise order, and does not depend on the
+// version of the database. The combined metrics exceeding the max
+// processor payload size are processed chunk by chunk in the same order.
+// The same order applies to PayloadProcessor.
+//
+// If AggregatorConfig.HarvestConcurrency is greater than 1, the combined
+// metrics of an aggregation interval are dispatched in the same order but
+// processed concurrently, thus, they may be processed in any order. The
+// aggregation intervals are still harvested one after the other, and the
+// chunks of the same combined metrics are still processed in order.
+//
+// The combined metrics for which the processor returns an error are
+// retried by the next harvests of the aggregation interval, up to
+// AggregatorConfig.MaxHarvestRetries times. Of the combined metrics split
+// into chunks, only the chunks which failed to be processed are retried.
 type Processor func(
 	ctx context.Context,
 	cmk CombinedMetricsKey,
@@ -47,6 +149,18 @@ type Processor func(
 	aggregationIvl time.Duration,
 ) error
 
+// PayloadProcessor defines handling of the aggregated metrics post harvest
+// as encoded payloads. The payload is the binary protobuf representation
+// of the combined metrics compressed using the given codec, and can be
+// decoded using DecodeCompressedCombinedMetrics.
+type PayloadProcessor func(
+	ctx context.Context,
+	cmk CombinedMetricsKey,
+	payload []byte,
+	codec Codec,
+	aggregationIvl time.Duration,
+) error
+
 // Aggregator represents a LSM based aggregator instance to generate
 // aggregated metrics. The metrics aggregated by the aggregator are
 // harvested based on the aggregation interval and processed by the
@@ -56,42 +170,193 @@ type Processor func(
 // same processing time bucket and thereafter the processing time
 // bucket is advanced in factors of aggregation interval.
 type Aggregator struct {
-	db        *pebble.DB
-	limits    Limits
+	// stores hold the aggregated metrics of the aggregation intervals,
+	// ordered by their lowest aggregation interval, see storeFor.
+	stores []*store
+	// closed is true once stores are closed by Stop.
+	closed bool
+	// unavailableIntervals holds the error opening the database of the
+	// aggregation intervals without a store, see
+	// ContinueOnIntervalOpenError.
+	unavailableIntervals map[time.Duration]error
+
+	cache *pebble.Cache
+	// staleKeyTTL, if positive, is the age after which the aggregated
+	// metrics which were never harvested are dropped.
+	staleKeyTTL time.Duration
+	// histogramSignificantFigures is the number of significant figures
+	// of the transaction duration histograms.
+	histogramSignificantFigures int64
+	// compactMu serializes the manual compactions by CompactRange and
+	// prevents closing the databases while compacting, or while reading
+	// the debug state, it must be acquired before mu.
+	compactMu sync.Mutex
+	// lastCompactRange is the time of the last manual compaction and
+	// compactRangeInterval the minimum interval between them.
+	lastCompactRange     time.Time
+	compactRangeInterval time.Duration
+	// limits holds the limits used by the aggregations and the merges,
+	// it is shared with the pebble merger and swapped by SetLimits.
+	limits    *atomic.Pointer[limitsConfig]
 	processor Processor
+	// payloadProcessor, if set, is used instead of processor.
+	payloadProcessor   PayloadProcessor
+	harvestCompression Codec
+	// maxProcessorPayloadBytes, if positive, is the maximum encoded size
+	// of the combined metrics passed to the processor.
+	maxProcessorPayloadBytes int
+	// harvestConcurrency, if greater than 1, is the maximum number of
+	// combined metrics processed concurrently on harvest.
+	harvestConcurrency int
+	// maxHarvestRetries is the maximum number of harvests retrying the
+	// combined metrics which failed to be processed.
+	maxHarvestRetries int
+	// harvestObserver, if set, is called with the summary of every
+	// harvest of every aggregation interval.
+	harvestObserver func(HarvestSummary)
+	// percentiles are the percentiles of the transaction durations set
+	// on the harvested transaction metrics, if any.
+	percentiles []float64
+	// harvestLabels are the labels set on the harvested combined
+	// metrics, if any.
+	harvestLabels map[string]string
+	// deduplicationWindow, if positive, is the retention of the
+	// idempotency tokens, see AggregateCombinedMetricsIdempotent.
+	deduplicationWindow time.Duration
 
 	aggregationIntervals []time.Duration
 	harvestDelay         time.Duration
+	harvestJitter        harvestJitter
 
+	// harvestMu prevents concurrent harvests by the harvest loop and
+	// Flush, it must be acquired before mu.
+	harvestMu      sync.Mutex
 	mu             sync.Mutex
 	processingTime time.Time
-	batch          *pebble.Batch
-	cachedStats    map[time.Duration]map[string]stats
+	clock          clock
+	// eventFilter, if set, drops the events it returns false for.
+	eventFilter func(*modelpb.APMEvent) bool
+	// routeByEventTimestamp aggregates the events into the processing
+	// time of their timestamp, see eventProcessingTime.
+	routeByEventTimestamp bool
+	// maxBatchSize, if positive, is the maximum number of events of the
+	// batches aggregated at once, see MaxBatchSize.
+	maxBatchSize      int
+	chunkLargeBatches bool
+	// mergeBatch, if set, coalesces the aggregations before they are
+	// written to the pending batches, flushed early once
+	// mergeBatchMaxBytes, if positive, are buffered.
+	mergeBatch         *mergeBatch
+	mergeBatchMaxBytes int64
+	overflowSalt       func([]byte) uint64
+	overflowLogger     *overflowLogger
+	// overflowEstimatorPrecision is the precision of the cardinality
+	// estimators of the overflow buckets, zero for the default.
+	overflowEstimatorPrecision uint8
+	cachedStats                map[time.Duration]map[string]stats
+	// idempotencyTokens caches the expiry of the idempotency tokens
+	// aggregated within the deduplication window.
+	idempotencyTokens map[string]time.Time
+
+	// lastHarvests records the time of the last successful harvest of
+	// each aggregation interval, see Health.
+	lastHarvests *lastHarvests
 
 	stopping   chan struct{}
 	runStarted atomic.Bool
 	runStopped chan struct{}
 
-	metrics *telemetry.Metrics
-	tracer  trace.Tracer
-	logger  *zap.Logger
+	writeStallThreshold   time.Duration
+	memtableSizeThreshold uint64
+	diskUsageLimit        uint64
+	// storeUsage caches the pebble metrics checked against the
+	// memtableSizeThreshold and the diskUsageLimit.
+	storeUsage storeUsage
+
+	active *activeCombinedMetrics
+	// overflowCardinality holds the estimated cardinality of the
+	// overflow buckets harvested by the last harvests.
+	overflowCardinality *overflowCardinality
+	metrics             *telemetry.Metrics
+	tracer              trace.Tracer
+	logger              *zap.Logger
 
 	combinedMetricsIDToKVs func(string) []attribute.KeyValue
+	// combinedMetricsIDAttrs maps the combined metrics IDs to the
+	// attributes of the recorded telemetry metrics.
+	combinedMetricsIDAttrs *combinedMetricsIDAttrs
+	// requestIDKey, if set, is the context key of the request IDs of
+	// the aggregation requests.
+	requestIDKey any
 }
 
 // AggregatorConfig contains the required config for running the
 // aggregator.
 type AggregatorConfig struct {
+	// DataDir is the directory of the pebble database. DataDir is
+	// required unless InMemory is set or all the aggregation intervals
+	// have a directory in DataDirPerInterval.
 	DataDir string
-	Limits  Limits
+	// DataDirPerInterval overrides DataDir for the given aggregation
+	// intervals, each directory holding a separate pebble database, for
+	// example, to keep the long aggregation intervals on a different
+	// disk. Aggregation intervals sharing a directory share the pebble
+	// database, the aggregation intervals without a directory in
+	// DataDirPerInterval use DataDir. The pebble metrics of each database
+	// are identified by its aggregation intervals. The idempotency tokens,
+	// see DeduplicationWindow, are kept in the database of the aggregation
+	// interval of their combined metrics. All the aggregation intervals in
+	// DataDirPerInterval must be configured in AggregationIntervals.
+	DataDirPerInterval map[time.Duration]string
+	// InMemory keeps the aggregated metrics in memory instead of
+	// persisting them to DataDir, for example, to validate the limits
+	// configuration against a recorded event stream. The aggregated
+	// metrics are lost when the aggregator is stopped. Defaults to false.
+	InMemory bool
+	// NewStore, if set, creates the stores of the aggregated metrics
+	// instead of pebble databases, for example, NewMapStore for small
+	// deployments. NewStore is called once per data directory, see
+	// DataDirPerInterval, with the directory, possibly empty, and its
+	// aggregation intervals. The store must merge the values written by
+	// Store.Merge using the given MergeFunc, which applies the configured
+	// limits. The pebble specific options, such as the pebble cache size
+	// or StrictChecksums, and the pebble metrics do not apply to custom
+	// stores. DataDir is not required with a custom store. Defaults to
+	// nil, which uses pebble.
+	NewStore func(dataDir string, intervals []time.Duration, merge MergeFunc) (Store, error)
+	Limits   Limits
+	// LimitsPerInterval overrides Limits for the given aggregation
+	// intervals, for example, to allow higher cardinality for longer
+	// aggregation intervals. The aggregation intervals without limits
+	// in LimitsPerInterval use Limits. All the aggregation intervals in
+	// LimitsPerInterval must be configured in AggregationIntervals.
+	LimitsPerInterval map[time.Duration]Limits
 	// Processor defines handling of the aggregated metrics post
 	// harvest. Processor is called for each decoded combined metrics
 	// after they are harvested.
 	Processor Processor
+	// PayloadProcessor defines handling of the aggregated metrics post
+	// harvest as encoded payloads, for example, for processors which
+	// forward the aggregated metrics over the network. PayloadProcessor
+	// is called for each combined metrics after they are harvested.
+	// Only one of Processor and PayloadProcessor can be configured.
+	PayloadProcessor PayloadProcessor
+	// HarvestCompression is the codec used to compress the payloads
+	// passed to PayloadProcessor. Defaults to CodecNone.
+	HarvestCompression Codec
 	// AggregationIntervals defines the intervals that aggregator
 	// will aggregate for. Note that the aggregation intervals
 	// used for second level aggregation must be equal to the
 	// aggregation intervals used for first level aggregations.
+	//
+	// The aggregation periods are aligned to the wall clock rather than
+	// to the start of the aggregator: the periods of an interval start at
+	// multiples of the interval, see time.Time.Truncate, which fall on
+	// UTC clock boundaries for intervals dividing a day, for example :00,
+	// :10, :20 for a 10m interval. The first harvest of an interval fires
+	// at the end of the period the aggregator was started in, thus,
+	// aggregators restarted or running as replicas harvest the same
+	// periods at the same times, offset by the harvest delay and jitter.
 	AggregationIntervals []time.Duration
 	// HarvestDelay delays the harvest by the configured duration.
 	// This means that harvest for a specific processing time
@@ -112,16 +377,346 @@ type AggregatorConfig struct {
 	// metrics are aggregated. This is because AggregateBatch API is
 	// not used by the l2 aggregator.
 	HarvestDelay time.Duration
+	// HarvestJitter delays each harvest, in addition to HarvestDelay,
+	// by a pseudo-random duration in [0, HarvestJitter) to spread the
+	// harvests of multiple aggregators, and thus the load on the
+	// processor, over time. The jitter is derived from the harvest time
+	// and HarvestJitterSeed. The harvest performed on Stop is not
+	// jittered. HarvestJitter must be less than the lowest aggregation
+	// interval. Defaults to 0, which disables jitter.
+	HarvestJitter time.Duration
+	// HarvestJitterSeed seeds the jitter of the harvests. Aggregators
+	// using the same seed use the same jitter for the same harvest,
+	// also across restarts. Defaults to 0, which uses a random seed.
+	HarvestJitterSeed int64
 	// A custom tracer which will be used by the aggregator.
 	// Defaults to a tracer retrieved from the global TracerProvider.
 	Tracer trace.Tracer
 	// A custom meter provider which will be used by the telemetry.
 	// Defaults to the global MeterProvider.
 	MeterProvider metric.MeterProvider
+	// MetricPrefix is prepended, as is, to the names of all the
+	// telemetry metrics, for example, to distinguish the metrics of
+	// multiple aggregators sharing a meter provider. Defaults to no
+	// prefix.
+	MetricPrefix string
+	// ServiceAttributionTopN enables reporting the number of events
+	// requested for aggregation using AggregateBatch per service for
+	// the top N services since the last collection of the telemetry.
+	// The events of the remaining services are reported under a single
+	// "_other" service. Defaults to 0, which disables service
+	// attribution.
+	ServiceAttributionTopN int
+	// ServiceOverflowTopN enables reporting the number of events
+	// aggregated into the per service overflow buckets, due to the per
+	// service limits, per service for the top N services with the most
+	// overflowed events of each harvested combined metrics. The events
+	// of the remaining services are reported under a single "_other"
+	// service. Defaults to 0, which disables service overflow
+	// attribution.
+	ServiceOverflowTopN int
+	// PebbleCompactionHistograms enables recording the bytes read and
+	// written per pebble compaction into histograms, in addition to the
+	// cumulative counters. The histograms are computed by diffing the
+	// cumulative pebble metrics on every collection of the telemetry,
+	// thus, the recorded values are averages of the compactions
+	// completed between collections and the telemetry should be
+	// collected by a single reader. Defaults to false.
+	PebbleCompactionHistograms bool
+	// MaxProcessorPayloadBytes is the maximum encoded size, in bytes, of
+	// the combined metrics passed to the processor. The harvested combined
+	// metrics exceeding it are split by service, and by service instance
+	// if required, into multiple chunks which are processed separately.
+	// The overflow buckets are part of the first chunk only. A single
+	// service instance exceeding the limit cannot be split any further and
+	// is processed on its own. Defaults to 0, which disables splitting.
+	MaxProcessorPayloadBytes int
+	// HarvestConcurrency is the maximum number of harvested combined
+	// metrics processed concurrently by the processor, or the payload
+	// processor, within the harvest of an aggregation interval. If
+	// greater than 1, the processor must be safe for concurrent use and
+	// the combined metrics are no longer processed in the order
+	// described by Processor. Defaults to 0, which processes the
+	// combined metrics one at a time.
+	HarvestConcurrency int
+	// MaxHarvestRetries is the maximum number of harvests retrying the
+	// combined metrics which failed to be processed at the same
+	// processing time. The combined metrics still failing once the
+	// retries are exhausted are dropped, logged, and recorded by the
+	// aggregator.harvest.dropped metric, so that a processor failing
+	// permanently does not retain them indefinitely. Defaults to 0,
+	// which uses 3 retries.
+	MaxHarvestRetries int
+	// StaleKeyTTL is the age of the processing time after which the
+	// aggregated metrics which were never harvested are dropped on
+	// harvest, for example, the metrics aggregated before the aggregator
+	// was restarted. The dropped metrics are logged and recorded by the
+	// aggregator.stale.dropped metric. StaleKeyTTL must not be less than
+	// the largest aggregation interval. Defaults to 0, which retains the
+	// metrics which were never harvested indefinitely.
+	StaleKeyTTL time.Duration
+	// OverflowLogSampleSize is the maximum number of aggregation keys
+	// merged into the overflow buckets, identified by the service name
+	// and the name of the aggregation group, which are logged at debug
+	// level per overflow type for identifying the entities causing the
+	// overflows. Defaults to 0, which disables logging the overflowed
+	// aggregation keys.
+	OverflowLogSampleSize int
+	// OverflowLogInterval is the minimum interval between the logged
+	// samples of overflowed aggregation keys for each overflow type.
+	// Defaults to 0, which uses an interval of 1 minute.
+	OverflowLogInterval time.Duration
+	// CompactRangeInterval is the minimum interval between the manual
+	// compactions triggered by CompactRange, protecting the database
+	// from excessive compactions. Defaults to 0, which uses an interval
+	// of 1 minute.
+	CompactRangeInterval time.Duration
+	// HistogramSignificantFigures is the number of significant figures,
+	// between 1 and 5, of the histograms recording the transaction
+	// durations. Fewer significant figures reduce the memory used by
+	// each transaction group at the expense of the precision of the
+	// recorded durations. Defaults to 0, which uses 2 significant figures.
+	HistogramSignificantFigures int
+	// PebbleCacheSize is the size, in bytes, of the pebble block cache.
+	// Defaults to 0, which uses the pebble default cache size.
+	PebbleCacheSize int64
+	// WarmCache populates the pebble block cache when the aggregator is
+	// created by reading the aggregated metrics persisted by a previous
+	// aggregator, in the order they are harvested, until the capacity of
+	// the cache is read. The first harvests after a restart then read
+	// the aggregated metrics from the cache rather than from disk. New
+	// blocks until the cache is warmed, which reads and merges the
+	// aggregated metrics as a harvest does. Failures to warm the cache
+	// are logged and do not fail New. The stores created by NewStore
+	// are not warmed. Defaults to false.
+	WarmCache bool
+	// MaxConcurrentCompactions is the maximum number of concurrent pebble
+	// compactions, for example, to limit the disk I/O used by background
+	// compactions. Defaults to 0, which uses the pebble default.
+	MaxConcurrentCompactions int
+	// L0CompactionThreshold is the number of pebble L0 read-amplification
+	// at which compactions of L0 are triggered. Higher values delay the
+	// compactions at the expense of read performance. Defaults to 0, which
+	// uses the pebble default.
+	L0CompactionThreshold int
+	// MemtableSize is the size, in bytes, of each pebble memtable, which
+	// must be less than 4GiB. Larger memtables reduce the frequency of
+	// the flushes, and the number of sstables written, at the expense
+	// of memory. Defaults to 0, which uses the pebble default of 4MiB.
+	MemtableSize int
+	// MemtableStopWritesThreshold is the maximum number of pebble
+	// memtables, including the one being written to, queued for flushing
+	// before writes are stalled. Defaults to 0, which uses the pebble
+	// default of 2.
+	MemtableStopWritesThreshold int
+	// DisableWAL disables the pebble write-ahead log. Without the
+	// write-ahead log the aggregated metrics which are not yet flushed
+	// from the pebble memtables are lost if the process crashes, or is
+	// stopped without a graceful Stop. This avoids the cost of writing,
+	// and syncing, the write-ahead log for aggregators which tolerate
+	// losing the metrics which are not yet harvested, for example, when
+	// the aggregator is ephemeral. Defaults to false.
+	DisableWAL bool
+	// StrictChecksums verifies the integrity of the pebble database when
+	// the aggregator is created by reading all of the sstables, verifying
+	// their block checksums, and checking the consistency of the levels.
+	// New returns an error wrapping pebble.ErrCorruption, instead of
+	// serving the corrupted metrics, if corruption is detected. Without
+	// StrictChecksums the checksums are only verified as blocks are read,
+	// i.e. when the metrics are harvested. Verifying the database on open
+	// reads the whole database which can be slow for large databases.
+	// Defaults to false.
+	StrictChecksums bool
+	// SSTableCompression is the block compression of the sstables of
+	// the pebble databases, for example, SSTableCompressionNone for
+	// aggregators bound by CPU or SSTableCompressionZstd for aggregators
+	// bound by disk space or I/O. The sstables written before changing
+	// the compression keep their compression until they are compacted.
+	// Defaults to SSTableCompressionSnappy.
+	SSTableCompression SSTableCompression
+	// ContinueOnIntervalOpenError, if true, creates the aggregator with
+	// the remaining aggregation intervals if the pebble database of some
+	// of the aggregation intervals, see DataDirPerInterval, fails to
+	// open, for example, because it is corrupted, instead of failing New.
+	// The failure is logged, the aggregation intervals of the failed
+	// database are reported unavailable by Health and the combined
+	// metrics aggregated for them are rejected with
+	// ErrIntervalUnavailable. The failed database is left untouched for
+	// inspection. New fails if none of the databases open. Defaults to
+	// false.
+	ContinueOnIntervalOpenError bool
+	// WriteStallThreshold, if positive, rejects aggregations with
+	// ErrWriteStalled while pebble has been stalling writes for longer
+	// than the threshold, allowing callers to shed load instead of
+	// buffering the aggregations in memory. Defaults to 0, which
+	// disables the check.
+	WriteStallThreshold time.Duration
+	// MemtableSizeThreshold, if positive, rejects aggregations with
+	// ErrWriteStalled while the size of the pebble memtables exceeds the
+	// threshold in bytes. The memtable size is read from the pebble
+	// metrics at most once per second by the aggregation requests.
+	// Defaults to 0, which disables the check.
+	MemtableSizeThreshold uint64
+	// DiskUsageLimit, if positive, rejects aggregations with ErrDiskFull
+	// while the disk space used by the pebble database, as reported by
+	// the pebble metrics at most once per second, exceeds the limit in
+	// bytes. Harvests are not affected, allowing the database to be
+	// drained and the disk space to be reclaimed before pebble writes
+	// fail due to a full disk. The limit should leave enough headroom
+	// for the compactions deleting the harvested metrics. Defaults to 0,
+	// which disables the check.
+	DiskUsageLimit uint64
+	// OverflowEstimatorSalt, if set, salts the hashes of the aggregation
+	// keys, for example services or transactions, inserted into the
+	// cardinality estimators of the overflow buckets. It is called with
+	// the combined metrics ID and the result seeds the xxhash digest of
+	// the aggregation keys of the combined metrics ID, for example, to
+	// salt the hashes per tenant. The salt only affects the overflow
+	// estimates, neither the aggregation keys nor the pebble keys, which
+	// are always scoped by the combined metrics ID, are derived from it.
+	// Defaults to the unseeded xxhash digest of the aggregation keys.
+	OverflowEstimatorSalt func(id []byte) uint64
+	// OverflowEstimatorPrecision is the precision of the HyperLogLog
+	// sketches estimating the cardinality of the overflowed aggregation
+	// keys, either 14 or 16. Higher precision reduces the standard error
+	// of the estimates, from 0.81% to 0.41%, at the cost of 4 times the
+	// memory and encoded size of the overflow buckets. Sketches with
+	// different precisions can not be merged, thus, changing the
+	// precision of an aggregator with aggregated metrics in its database
+	// loses the estimates of the aggregated overflows. Defaults to 14.
+	OverflowEstimatorPrecision int
+	// EventFilter, if set, is called for every valid event aggregated by
+	// AggregateBatch and its variants, the events for which it returns
+	// false are dropped without being aggregated, for example, to drop
+	// synthetic or health check transactions before they consume the
+	// aggregation limits. The dropped events are counted by the
+	// aggregator.events.filtered metric. EventFilter is called on the
+	// hot path with the aggregator's lock held, thus, it must be cheap
+	// to call, should not allocate, and must not block or call the
+	// aggregator. EventFilter must not modify the event. Defaults to nil,
+	// which aggregates all the events.
+	EventFilter func(*modelpb.APMEvent) bool
+	// RouteByEventTimestamp aggregates the events passed to
+	// AggregateBatch and its variants into the processing time of their
+	// timestamp, instead of the current processing time, as long as the
+	// processing time is not yet harvested. For example, events arriving
+	// during the HarvestDelay with a timestamp in the next aggregation
+	// period are aggregated into the next processing time, while late
+	// events with a timestamp in the processing time being delayed are
+	// still aggregated into it. The events with a timestamp preceding the
+	// oldest processing time not yet harvested are dropped for the
+	// aggregation interval and counted by the aggregator.events.too-late
+	// metric. The timestamps in the future of the aggregator's clock are
+	// capped to the current time, and the events without a timestamp
+	// are aggregated into the current processing time. Defaults to false.
+	RouteByEventTimestamp bool
+	// WrapMerge, if set, is called once on creation of the aggregator
+	// with the function creating the pebble value mergers of the combined
+	// metrics, and the returned function is used instead, for example, to
+	// instrument the merges or to test merge edge cases. The returned
+	// function is registered under the name of the default merger, as
+	// pebble refuses to open a database written with a differently named
+	// merger, thus, it must remain compatible with the default merger's
+	// encoding. Defaults to nil, which uses the default merger.
+	WrapMerge func(pebble.Merge) pebble.Merge
+	// MergeBatchWindow, if positive, coalesces the aggregations for the
+	// same combined metrics key in memory, for up to the window, before
+	// writing them to pebble as a single merge operation. Coalescing
+	// reduces the pebble write amplification at high event rates at the
+	// cost of holding the coalesced aggregations in memory. The coalesced
+	// aggregations are written to the pending batch once the window
+	// elapses, either by the next aggregation or, while Run is running,
+	// by a timer, and are committed with the other pending aggregations.
+	// Without Run, the window only bounds the delay while aggregations
+	// keep being added. Coalesced aggregations are always written before
+	// harvesting, including on Stop and Flush, and before Snapshot. The combined metrics
+	// aggregated with an idempotency token are never coalesced, see
+	// AggregateCombinedMetricsIdempotent. Defaults to 0, which writes
+	// every aggregation to pebble.
+	MergeBatchWindow time.Duration
+	// MergeBatchMaxBytes, if positive, limits the encoded size of the
+	// aggregations coalesced by the merge batch, see MergeBatchWindow.
+	// The merge batch is flushed before the window elapses once the
+	// encoded size of the aggregations added to it exceeds the limit,
+	// bounding the memory held by the merge batch at high event rates.
+	// Defaults to 0, which only flushes the merge batch once the window
+	// elapses.
+	MergeBatchMaxBytes int
+	// HarvestObserver, if set, is called with the summary of every
+	// harvest of every aggregation interval, including the harvests
+	// which failed, once the harvest of the aggregation interval
+	// completes, for example, for custom logging or metrics. It is
+	// called synchronously by the harvest, which may hold the
+	// aggregator's lock, for example, on Flush and Stop, thus, it must
+	// not block or call the aggregator. Defaults to nil.
+	HarvestObserver func(HarvestSummary)
+	// Percentiles, if set, are the percentiles, between 0 and 100, of
+	// the transaction durations computed from the histograms of the
+	// harvested transaction metrics, including the overflow buckets,
+	// and set as their Percentiles, for example, [50, 90, 95, 99] for
+	// processors which can not consume the histograms. The histograms
+	// are kept. Percentiles are only supported with Processor as they
+	// are not encoded. Defaults to nil, which computes no percentiles.
+	Percentiles []float64
+	// HarvestLabels, if set, are static labels, for example, the
+	// cluster or region of the aggregator, set as the Labels of every
+	// combined metrics passed to the processor on harvest. The labels
+	// are not part of any aggregation key and do not affect the
+	// aggregation. HarvestLabels are only supported with Processor as
+	// they are not encoded. Defaults to nil.
+	HarvestLabels map[string]string
+	// DeduplicationWindow, if positive, is the duration for which the
+	// idempotency tokens of the combined metrics aggregated by
+	// AggregateCombinedMetricsIdempotent are retained, the combined
+	// metrics with a token aggregated within the window are ignored.
+	// The tokens are held in memory and in the database for the window,
+	// thus, the window should be as short as the retries of the callers
+	// allow. Defaults to 0, which disables the deduplication.
+	DeduplicationWindow time.Duration
 
 	// Optional. A function that converts a combined metrics ID
 	// to zero or more attribute.KeyValue for telemetry.
 	CombinedMetricsIDToKVs func(string) []attribute.KeyValue
+	// MaxCombinedMetricsIDAttributeSets limits the number of distinct
+	// attribute sets returned by CombinedMetricsIDToKVs which are used
+	// to attribute the telemetry metrics, for example, the events total
+	// and processed, bounding the cardinality of the metrics when the
+	// attributes identify tenants. Once the limit is reached, the
+	// metrics for the combined metrics IDs mapped to new attribute sets
+	// are recorded with the telemetry.AttributesOverflowKey attribute
+	// instead, for the lifetime of the aggregator. Traces are always
+	// attributed with the attributes returned by CombinedMetricsIDToKVs.
+	// Defaults to 0, which does not limit the attribute sets.
+	MaxCombinedMetricsIDAttributeSets int
+	// RequestIDKey, if set, is the key of the request IDs in the contexts
+	// passed to the aggregation methods, for example, the ID of the
+	// incoming request or trace set by the caller with context.WithValue.
+	// Request IDs are non-empty string or fmt.Stringer values. The request
+	// ID is logged with the failures of the aggregation requests counted
+	// by RequestsFailed and set as an attribute of their trace spans,
+	// which the request durations are recorded with, correlating failed
+	// requests with their logs and traces. The key must be comparable.
+	// Defaults to nil, which does not extract request IDs.
+	RequestIDKey any
+	// MaxBatchSize, if positive, is the maximum number of events of the
+	// batches aggregated by AggregateBatch, AggregateBatchWeighted and
+	// AggregateBatchWithResult, bounding the time the aggregator's lock
+	// is held and the memory used by the aggregation of a single batch.
+	// The batches with more events are rejected with ErrBatchTooLarge,
+	// unless ChunkLargeBatches is set. Defaults to 0, which does not
+	// limit the batch size.
+	MaxBatchSize int
+	// ChunkLargeBatches aggregates the batches with more events than
+	// MaxBatchSize in chunks of MaxBatchSize events, releasing the
+	// aggregator's lock between the chunks, rather than rejecting them.
+	// If a chunk fails to be aggregated, the preceding chunks remain
+	// aggregated. Defaults to false.
+	ChunkLargeBatches bool
+
+	// clock is used to get the current processing time and to schedule
+	// the harvests, allowing tests to control the passage of time.
+	// Defaults to the real clock.
+	clock clock
 }
 
 // stats is used to cache request based stats accepted by the
@@ -131,41 +726,240 @@ type AggregatorConfig struct {
 // harvest time metrics.
 type stats struct {
 	eventsTotal int64
+	// weightedEventsTotal is the total of the representative counts of
+	// the events, scaled by their weight.
+	weightedEventsTotal float64
 }
 
 func (s *stats) merge(from stats) {
 	s.eventsTotal += from.eventsTotal
+	s.weightedEventsTotal += from.weightedEventsTotal
 }
 
-// New returns a new aggregator instance.
+// New returns a new aggregator instance. New returns an error describing
+// the first invalid or missing option, for example, if none of DataDir,
+// InMemory or NewStore is set, if no Processor or PayloadProcessor is
+// configured, or if no aggregation interval is configured. Logs are
+// discarded if the logger is nil.
 func New(cfg AggregatorConfig, logger *zap.Logger) (*Aggregator, error) {
 	if err := validateCfg(cfg); err != nil {
 		return nil, err
 	}
+	if logger == nil {
+		logger = zap.NewNop()
+	}
 
-	pb, err := pebble.Open(cfg.DataDir, &pebble.Options{
-		Merger: &pebble.Merger{
-			Name: "combined_metrics_merger",
-			Merge: func(_, value []byte) (pebble.ValueMerger, error) {
-				merger := combinedMetricsMerger{
-					limits: cfg.Limits,
-				}
-				if err := merger.metrics.UnmarshalBinary(value); err != nil {
-					return nil, err
-				}
-				return &merger, nil
+	var cache *pebble.Cache
+	if cfg.PebbleCacheSize > 0 {
+		cache = pebble.NewCache(cfg.PebbleCacheSize)
+		// The database holds its own reference to the cache.
+		defer cache.Unref()
+	}
+	clk := cfg.clock
+	if clk == nil {
+		clk = realClock{}
+	}
+	overflowLogInterval := cfg.OverflowLogInterval
+	if overflowLogInterval == 0 {
+		overflowLogInterval = time.Minute
+	}
+	compactRangeInterval := cfg.CompactRangeInterval
+	if compactRangeInterval == 0 {
+		compactRangeInterval = time.Minute
+	}
+	overflowLog := newOverflowLogger(logger, cfg.OverflowLogSampleSize, overflowLogInterval)
+	overflowEstimatorPrecision := uint8(cfg.OverflowEstimatorPrecision)
+	var fs vfs.FS
+	if cfg.InMemory {
+		fs = vfs.NewMem()
+	}
+	active := newActiveCombinedMetrics()
+	ovfCardinality := newOverflowCardinality()
+	harvests := &lastHarvests{}
+	created := clk.Now()
+	limits := &atomic.Pointer[limitsConfig]{}
+	limits.Store(newLimitsConfig(cfg.Limits, cfg.LimitsPerInterval))
+	// newMerge returns the merge operator of the aggregated metrics of the
+	// store, recording the merges of the store.
+	newMerge := func(s *store) func(key, value []byte) (pebble.ValueMerger, error) {
+		merges := s.merges
+		merge := func(key, value []byte) (pebble.ValueMerger, error) {
+			var cmk CombinedMetricsKey
+			if err := cmk.UnmarshalBinary(key); err != nil {
+				return nil, err
+			}
+			merger := combinedMetricsMerger{
+				limits:         limits.Load().forInterval(cmk.Interval),
+				overflowLogger: overflowLog,
+				active:         active,
+				merges:         merges,
+				key:            cmk,
+			}
+			merger.hasher = newHasher(cfg.OverflowEstimatorSalt, cmk.ID, overflowEstimatorPrecision)
+			if err := merger.metrics.UnmarshalBinary(value); err != nil {
+				// The base value failing to be decoded fails the merge.
+				return nil, merges.Record(fmt.Errorf("failed to unmarshal combined metrics to merge: %w", err))
+			}
+			return &merger, nil
+		}
+		if cfg.WrapMerge != nil {
+			merge = cfg.WrapMerge(merge)
+		}
+		return withMergeKeyErrors(merge)
+	}
+	// newPebbleOptions returns the options of the pebble database of the
+	// store, recording the telemetry of the store's database.
+	newPebbleOptions := func(s *store) *pebble.Options {
+		eventListener := pebble.TeeEventListener(
+			*s.writeStalls.EventListener(),
+			*s.corruptions.EventListener(),
+		)
+		recordBackgroundError := eventListener.BackgroundError
+		eventListener.BackgroundError = func(err error) {
+			logger.Warn("pebble background error", zap.String("data_dir", s.dataDir), zap.Error(err))
+			recordBackgroundError(err)
+		}
+		pebbleOpts := &pebble.Options{
+			FS:                          fs,
+			Cache:                       cache,
+			DisableWAL:                  cfg.DisableWAL,
+			L0CompactionThreshold:       cfg.L0CompactionThreshold,
+			MemTableSize:                cfg.MemtableSize,
+			MemTableStopWritesThreshold: cfg.MemtableStopWritesThreshold,
+			EventListener:               &eventListener,
+			Comparer:                    comparer,
+			// The options of the first level are used for all the levels.
+			Levels: []pebble.LevelOptions{{
+				Compression:  cfg.SSTableCompression.pebbleCompression(),
+				FilterPolicy: bloomFilterPolicy,
+				FilterType:   pebble.TableFilter,
+			}},
+			Merger: &pebble.Merger{
+				Name:  "combined_metrics_merger",
+				Merge: newMerge(s),
 			},
-		},
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to create pebble db: %w", err)
+		}
+		if cfg.MaxConcurrentCompactions > 0 {
+			maxConcurrentCompactions := cfg.MaxConcurrentCompactions
+			pebbleOpts.MaxConcurrentCompactions = func() int {
+				return maxConcurrentCompactions
+			}
+		}
+		return pebbleOpts
+	}
+	// Syncing is not supported by pebble when the write-ahead log
+	// is disabled as there is nothing to sync.
+	writeOptions := pebble.Sync
+	if cfg.DisableWAL {
+		writeOptions = pebble.NoSync
+	}
+	dirs, dirIntervals := storeDirs(cfg.DataDir, cfg.DataDirPerInterval, cfg.AggregationIntervals)
+	stores := make([]*store, 0, len(dirs))
+	closeStores := func() {
+		for _, s := range stores {
+			s.kv.Close()
+		}
+	}
+	var openErrs []error
+	unavailable := make(map[time.Duration]error)
+	warmCacheBudget := cfg.PebbleCacheSize
+	for i, dir := range dirs {
+		var s *store
+		var migrated int
+		var err error
+		if cfg.NewStore != nil {
+			s, err = openCustomStore(dir, dirIntervals[i], cfg.NewStore, func(s *store) MergeFunc {
+				return newMergeFunc(newMerge(s))
+			})
+		} else {
+			s, migrated, err = openStore(dir, dirIntervals[i], newPebbleOptions, cfg.StrictChecksums, writeOptions)
+		}
+		if err != nil {
+			if !cfg.ContinueOnIntervalOpenError {
+				closeStores()
+				return nil, err
+			}
+			logger.Error("skipping aggregation intervals as their pebble db failed to open",
+				zap.String("data_dir", dir), zap.Durations("aggregation_intervals", dirIntervals[i]), zap.Error(err))
+			for _, ivl := range dirIntervals[i] {
+				unavailable[ivl] = err
+			}
+			openErrs = append(openErrs, err)
+			continue
+		}
+		if len(dirs) > 1 {
+			s.name = storeName(s.intervals)
+		}
+		if cfg.WarmCache && s.db != nil {
+			// The configured cache is shared by the databases, otherwise
+			// every database has a cache of the default size.
+			maxBytes := int64(defaultPebbleCacheSize)
+			if cfg.PebbleCacheSize > 0 {
+				maxBytes = warmCacheBudget
+			}
+			start := time.Now()
+			keys, bytes, err := s.warmCache(maxBytes)
+			if err != nil {
+				logger.Warn("failed to warm pebble block cache", zap.String("data_dir", dir), zap.Error(err))
+			}
+			if cfg.PebbleCacheSize > 0 {
+				warmCacheBudget -= bytes
+			}
+			logger.Info("warmed pebble block cache",
+				zap.String("data_dir", dir),
+				zap.Int("keys", keys),
+				zap.Int64("bytes", bytes),
+				zap.Duration("duration", time.Since(start)),
+			)
+		}
+		if migrated > 0 {
+			logger.Info("migrated legacy combined metrics keys",
+				zap.String("data_dir", dir), zap.Int("count", migrated))
+		}
+		stores = append(stores, s)
+	}
+	if len(stores) == 0 {
+		return nil, errors.Join(openErrs...)
+	}
+	// The unavailable aggregation intervals are never aggregated or
+	// harvested.
+	aggregationIntervals := make([]time.Duration, 0, len(cfg.AggregationIntervals))
+	for _, ivl := range cfg.AggregationIntervals {
+		if _, ok := unavailable[ivl]; !ok {
+			aggregationIntervals = append(aggregationIntervals, ivl)
+		}
+	}
+	pebbleDBs := make([]telemetry.PebbleDB, 0, len(stores))
+	for _, s := range stores {
+		if s.db != nil {
+			pebbleDBs = append(pebbleDBs, s.telemetryDB())
+		}
 	}
 
+	var mb *mergeBatch
+	var mergeBatchSize func() (int64, int64)
+	if cfg.MergeBatchWindow > 0 {
+		mb = newMergeBatch(cfg.MergeBatchWindow)
+		mergeBatchSize = mb.size
+	}
 	metrics, err := telemetry.NewMetrics(
-		func() *pebble.Metrics { return pb.Metrics() },
+		pebbleDBs,
 		telemetry.WithMeterProvider(cfg.MeterProvider),
+		telemetry.WithMetricPrefix(cfg.MetricPrefix),
+		telemetry.WithServiceAttribution(cfg.ServiceAttributionTopN),
+		telemetry.WithServiceOverflowAttribution(cfg.ServiceOverflowTopN),
+		telemetry.WithPebbleCompactionHistograms(cfg.PebbleCompactionHistograms),
+		telemetry.WithActiveCombinedMetrics(active.counts),
+		telemetry.WithHistogramsMemory(active.histogramsMemory),
+		telemetry.WithOverflowActiveBuckets(active.overflowBuckets),
+		telemetry.WithOverflowEstimatedCardinality(ovfCardinality.get),
+		telemetry.WithMergeBatch(mergeBatchSize),
+		telemetry.WithSecondsSinceLastHarvest(func() map[time.Duration]int64 {
+			return harvests.secondsSince(clk.Now(), created, cfg.AggregationIntervals)
+		}),
 	)
 	if err != nil {
+		closeStores()
 		return nil, fmt.Errorf("failed to create metrics: %w", err)
 	}
 	tracer := cfg.Tracer
@@ -178,30 +972,113 @@ func New(cfg AggregatorConfig, logger *zap.Logger) (*Aggregator, error) {
 		combinedMetricsIDToKVs = func(_ string) []attribute.KeyValue { return nil }
 	}
 
+	jitter := harvestJitter{max: cfg.HarvestJitter, seed: cfg.HarvestJitterSeed}
+	if jitter.seed == 0 {
+		jitter.seed = rand.Int63()
+	}
+
+	histogramSignificantFigures := int64(hdrhistogram.DefaultSignificantFigures)
+	if cfg.HistogramSignificantFigures > 0 {
+		histogramSignificantFigures = int64(cfg.HistogramSignificantFigures)
+	}
+	maxHarvestRetries := cfg.MaxHarvestRetries
+	if maxHarvestRetries == 0 {
+		maxHarvestRetries = 3
+	}
 	return &Aggregator{
-		db:                     pb,
-		limits:                 cfg.Limits,
-		processor:              cfg.Processor,
-		harvestDelay:           cfg.HarvestDelay,
-		aggregationIntervals:   cfg.AggregationIntervals,
-		processingTime:         time.Now().Truncate(cfg.AggregationIntervals[0]),
-		cachedStats:            newCachedStats(cfg.AggregationIntervals),
-		stopping:               make(chan struct{}),
-		runStopped:             make(chan struct{}),
-		metrics:                metrics,
-		logger:                 logger,
-		tracer:                 tracer,
-		combinedMetricsIDToKVs: combinedMetricsIDToKVs,
+		stores:                      stores,
+		limits:                      limits,
+		processor:                   cfg.Processor,
+		payloadProcessor:            cfg.PayloadProcessor,
+		harvestCompression:          cfg.HarvestCompression,
+		maxProcessorPayloadBytes:    cfg.MaxProcessorPayloadBytes,
+		harvestConcurrency:          cfg.HarvestConcurrency,
+		maxHarvestRetries:           maxHarvestRetries,
+		harvestObserver:             cfg.HarvestObserver,
+		percentiles:                 append([]float64(nil), cfg.Percentiles...),
+		harvestLabels:               copyLabels(cfg.HarvestLabels),
+		deduplicationWindow:         cfg.DeduplicationWindow,
+		idempotencyTokens:           make(map[string]time.Time),
+		harvestDelay:                cfg.HarvestDelay,
+		harvestJitter:               jitter,
+		cache:                       cache,
+		staleKeyTTL:                 cfg.StaleKeyTTL,
+		mergeBatch:                  mb,
+		mergeBatchMaxBytes:          int64(cfg.MergeBatchMaxBytes),
+		eventFilter:                 cfg.EventFilter,
+		routeByEventTimestamp:       cfg.RouteByEventTimestamp,
+		maxBatchSize:                cfg.MaxBatchSize,
+		chunkLargeBatches:           cfg.ChunkLargeBatches,
+		overflowSalt:                cfg.OverflowEstimatorSalt,
+		overflowEstimatorPrecision:  overflowEstimatorPrecision,
+		overflowLogger:              overflowLog,
+		compactRangeInterval:        compactRangeInterval,
+		histogramSignificantFigures: histogramSignificantFigures,
+		writeStallThreshold:         cfg.WriteStallThreshold,
+		memtableSizeThreshold:       cfg.MemtableSizeThreshold,
+		diskUsageLimit:              cfg.DiskUsageLimit,
+		aggregationIntervals:        aggregationIntervals,
+		unavailableIntervals:        unavailable,
+		processingTime:              clk.Now().Truncate(aggregationIntervals[0]),
+		clock:                       clk,
+		cachedStats:                 newCachedStats(aggregationIntervals),
+		stopping:                    make(chan struct{}),
+		runStopped:                  make(chan struct{}),
+		active:                      active,
+		overflowCardinality:         ovfCardinality,
+		lastHarvests:                harvests,
+		metrics:                     metrics,
+		logger:                      logger,
+		tracer:                      tracer,
+		combinedMetricsIDToKVs:      combinedMetricsIDToKVs,
+		combinedMetricsIDAttrs:      newCombinedMetricsIDAttrs(combinedMetricsIDToKVs, cfg.MaxCombinedMetricsIDAttributeSets),
+		requestIDKey:                cfg.RequestIDKey,
 	}, nil
 }
 
 func validateCfg(cfg AggregatorConfig) error {
-	if cfg.DataDir == "" {
-		return errors.New("data directory is required")
+	if cfg.DataDir == "" && !cfg.InMemory && cfg.NewStore == nil {
+		// DataDir is not used if all the aggregation intervals have
+		// their own directory.
+		required := len(cfg.DataDirPerInterval) == 0
+		for _, ivl := range cfg.AggregationIntervals {
+			if _, ok := cfg.DataDirPerInterval[ivl]; !ok {
+				required = true
+			}
+		}
+		if required {
+			return errors.New("data directory is required unless in memory")
+		}
 	}
-	if cfg.Processor == nil {
+	if cfg.Processor == nil && cfg.PayloadProcessor == nil {
 		return errors.New("processor is required")
 	}
+	if cfg.Processor != nil && cfg.PayloadProcessor != nil {
+		return errors.New("only one of processor and payload processor can be configured")
+	}
+	if len(cfg.Percentiles) > 0 && cfg.PayloadProcessor != nil {
+		return errors.New("percentiles are not supported with a payload processor")
+	}
+	if len(cfg.HarvestLabels) > 0 && cfg.PayloadProcessor != nil {
+		return errors.New("harvest labels are not supported with a payload processor")
+	}
+	for _, p := range cfg.Percentiles {
+		if !(p > 0 && p <= 100) {
+			return fmt.Errorf("percentiles must be greater than 0 and at most 100, got %v", p)
+		}
+	}
+	if cfg.HarvestCompression != CodecNone && cfg.PayloadProcessor == nil {
+		return errors.New("harvest compression requires a payload processor")
+	}
+	if cfg.HarvestCompression > CodecZstd {
+		return fmt.Errorf("unsupported harvest compression codec %s", cfg.HarvestCompression)
+	}
+	if cfg.RequestIDKey != nil && !reflect.TypeOf(cfg.RequestIDKey).Comparable() {
+		return errors.New("request ID key must be comparable")
+	}
+	if cfg.SSTableCompression > SSTableCompressionZstd {
+		return fmt.Errorf("unsupported sstable compression %s", cfg.SSTableCompression)
+	}
 	if len(cfg.AggregationIntervals) == 0 {
 		return errors.New("at least one aggregation interval is required")
 	}
@@ -214,8 +1091,14 @@ func validateCfg(cfg AggregatorConfig) error {
 	highest := cfg.AggregationIntervals[len(cfg.AggregationIntervals)-1]
 	for i := 1; i < len(cfg.AggregationIntervals); i++ {
 		ivl := cfg.AggregationIntervals[i]
+		if ivl == cfg.AggregationIntervals[i-1] {
+			return fmt.Errorf("duplicate aggregation interval %s", ivl)
+		}
 		if ivl%lowest != 0 {
-			return errors.New("aggregation intervals must be a factor of lowest interval")
+			return fmt.Errorf(
+				"aggregation interval %s must be a multiple of the lowest interval %s",
+				ivl, lowest,
+			)
 		}
 	}
 	// For encoding/decoding the processing time for combined metrics we only consider
@@ -228,6 +1111,109 @@ func validateCfg(cfg AggregatorConfig) error {
 	if highest > 18*time.Hour {
 		return errors.New("aggregation interval greater than 18 hours is not supported")
 	}
+	if sf := cfg.HistogramSignificantFigures; sf != 0 &&
+		(sf < hdrhistogram.MinSignificantFigures || sf > hdrhistogram.MaxSignificantFigures) {
+		return fmt.Errorf(
+			"histogram significant figures must be between %d and %d",
+			hdrhistogram.MinSignificantFigures, hdrhistogram.MaxSignificantFigures,
+		)
+	}
+	if cfg.PebbleCacheSize < 0 {
+		return errors.New("pebble cache size must not be negative")
+	}
+	if cfg.StaleKeyTTL < 0 {
+		return errors.New("stale key TTL must not be negative")
+	}
+	if maxIvl := cfg.AggregationIntervals[len(cfg.AggregationIntervals)-1]; cfg.StaleKeyTTL > 0 && cfg.StaleKeyTTL < maxIvl {
+		return fmt.Errorf("stale key TTL must not be less than the largest aggregation interval %s", maxIvl)
+	}
+	if cfg.MaxConcurrentCompactions < 0 {
+		return errors.New("max concurrent compactions must not be negative")
+	}
+	if cfg.L0CompactionThreshold < 0 {
+		return errors.New("L0 compaction threshold must not be negative")
+	}
+	if cfg.MemtableSize < 0 || uint64(cfg.MemtableSize) >= maxMemtableSize {
+		return fmt.Errorf("memtable size must be non-negative and less than %d bytes", uint64(maxMemtableSize))
+	}
+	if cfg.MemtableStopWritesThreshold < 0 {
+		return errors.New("memtable stop writes threshold must not be negative")
+	}
+	if cfg.HarvestConcurrency < 0 {
+		return errors.New("harvest concurrency must not be negative")
+	}
+	if cfg.MaxHarvestRetries < 0 {
+		return errors.New("max harvest retries must not be negative")
+	}
+	if cfg.MaxProcessorPayloadBytes < 0 {
+		return errors.New("max processor payload bytes must not be negative")
+	}
+	if cfg.MaxBatchSize < 0 {
+		return errors.New("max batch size must not be negative")
+	}
+	if cfg.ChunkLargeBatches && cfg.MaxBatchSize == 0 {
+		return errors.New("chunking large batches requires a max batch size")
+	}
+	if cfg.OverflowLogSampleSize < 0 || cfg.OverflowLogInterval < 0 {
+		return errors.New("overflow log sample size and interval must not be negative")
+	}
+	if cfg.DeduplicationWindow < 0 {
+		return errors.New("deduplication window must not be negative")
+	}
+	if cfg.MergeBatchWindow < 0 {
+		return errors.New("merge batch window must not be negative")
+	}
+	if cfg.MergeBatchMaxBytes < 0 {
+		return errors.New("merge batch max bytes must not be negative")
+	}
+	if p := cfg.OverflowEstimatorPrecision; p != 0 && p != 14 && p != 16 {
+		return fmt.Errorf("overflow estimator precision must be 14 or 16, got %d", p)
+	}
+	if err := validateLimits(cfg.Limits); err != nil {
+		return err
+	}
+	for ivl, limits := range cfg.LimitsPerInterval {
+		if err := validateLimits(limits); err != nil {
+			return fmt.Errorf("aggregation interval %s: %w", ivl, err)
+		}
+		idx := sort.Search(len(cfg.AggregationIntervals), func(i int) bool {
+			return cfg.AggregationIntervals[i] >= ivl
+		})
+		if idx == len(cfg.AggregationIntervals) || cfg.AggregationIntervals[idx] != ivl {
+			return fmt.Errorf("limits configured for unknown aggregation interval %s", ivl)
+		}
+	}
+	for ivl, dir := range cfg.DataDirPerInterval {
+		if dir == "" {
+			return fmt.Errorf("aggregation interval %s: data directory must not be empty", ivl)
+		}
+		idx := sort.Search(len(cfg.AggregationIntervals), func(i int) bool {
+			return cfg.AggregationIntervals[i] >= ivl
+		})
+		if idx == len(cfg.AggregationIntervals) || cfg.AggregationIntervals[idx] != ivl {
+			return fmt.Errorf("data directory configured for unknown aggregation interval %s", ivl)
+		}
+	}
+	if cfg.HarvestJitter < 0 || cfg.HarvestJitter >= lowest {
+		return fmt.Errorf(
+			"harvest jitter must be non-negative and less than the lowest aggregation interval %s", lowest,
+		)
+	}
+	return nil
+}
+
+func validateLimits(limits Limits) error {
+	if limits.MaxServices < 0 ||
+		limits.MaxServiceInstanceGroupsPerService < 0 ||
+		limits.MaxSpanGroups < 0 ||
+		limits.MaxSpanGroupsPerService < 0 ||
+		limits.MaxSpanDestinationsPerService < 0 ||
+		limits.MaxTransactionGroups < 0 ||
+		limits.MaxTransactionGroupsPerService < 0 ||
+		limits.MaxServiceTransactionGroups < 0 ||
+		limits.MaxServiceTransactionGroupsPerService < 0 {
+		return errors.New("limits must not be negative")
+	}
 	return nil
 }
 
@@ -239,17 +1225,207 @@ func newCachedStats(ivls []time.Duration) map[time.Duration]map[string]stats {
 	return m
 }
 
+// EventStatus describes the result of aggregating an event.
+type EventStatus uint8
+
+const (
+	// EventAccepted means that the event was aggregated.
+	EventAccepted EventStatus = iota
+	// EventRejected means that the event failed aggregation for at
+	// least one of the aggregation intervals.
+	EventRejected
+	// EventFiltered means that the event was dropped by the configured
+	// EventFilter and was not aggregated.
+	EventFiltered
+	// EventOverflowed means that the event was aggregated but, due to
+	// the limits, into overflow buckets for at least one of the
+	// aggregation intervals.
+	EventOverflowed
+)
+
+// AggregateBatchResult holds the per event results of aggregating a batch.
+type AggregateBatchResult struct {
+	// Statuses holds the status of each event in the batch, in the same
+	// order as the events in the batch.
+	Statuses []EventStatus
+	// Errors holds the error of each event in the batch, in the same
+	// order as the events in the batch. The error is nil for accepted
+	// events.
+	Errors []error
+}
+
+// Rejected returns the number of rejected events.
+func (r AggregateBatchResult) Rejected() int {
+	var n int
+	for _, status := range r.Statuses {
+		if status == EventRejected {
+			n++
+		}
+	}
+	return n
+}
+
 // AggregateBatch aggregates all events in the batch. This function will return
 // an error if the aggregator's Run loop has errored or has been explicitly stopped.
 // However, it doesn't require aggregator to be running to perform aggregation.
+// ErrWriteStalled is returned, without aggregating any of the events, if the
+// aggregator is overloaded, or ErrDiskFull if its disk usage limit is exceeded.
 func (a *Aggregator) AggregateBatch(
 	ctx context.Context,
 	id string,
 	b *modelpb.Batch,
 ) error {
-	cmIDAttrs := a.combinedMetricsIDToKVs(id)
-	ctx, span := a.tracer.Start(ctx, "AggregateBatch", trace.WithAttributes(cmIDAttrs...))
+	return a.AggregateBatchWeighted(ctx, id, b, 1)
+}
+
+// AggregateBatchWeighted aggregates all events in the batch similar to
+// AggregateBatch with the representative counts of the events scaled by
+// the given weight, for example, a weight of 10 for events sampled at
+// 10% by the caller. The weight must be positive.
+func (a *Aggregator) AggregateBatchWeighted(
+	ctx context.Context,
+	id string,
+	b *modelpb.Batch,
+	weight float64,
+) error {
+	var errs []error
+	if err := a.aggregateBatch(ctx, id, b, weight, func(_ int, err error) {
+		errs = append(errs, err)
+	}, func(int) {}, nil); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed batch aggregation:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// AggregateBatchWithResult aggregates all events in the batch similar to
+// AggregateBatch and returns the result of aggregating each event. The
+// returned error is only non-nil if the batch could not be aggregated,
+// for example, if the aggregator has been stopped, in which case the
+// result is empty.
+//
+// As the limits are only enforced when the aggregated metrics are merged
+// by the store, reporting the overflowed events requires reading the
+// aggregated metrics of the batch's combined metrics keys and committing
+// the pending aggregations beforehand, making AggregateBatchWithResult
+// more expensive than AggregateBatch.
+func (a *Aggregator) AggregateBatchWithResult(
+	ctx context.Context,
+	id string,
+	b *modelpb.Batch,
+) (AggregateBatchResult, error) {
+	result := AggregateBatchResult{
+		Statuses: make([]EventStatus, len(*b)),
+		Errors:   make([]error, len(*b)),
+	}
+	if err := a.aggregateBatch(ctx, id, b, 1, func(i int, err error) {
+		result.Statuses[i] = EventRejected
+		result.Errors[i] = errors.Join(result.Errors[i], err)
+	}, func(i int) {
+		result.Statuses[i] = EventFiltered
+	}, func(i int) {
+		// Rejections take precedence over overflows.
+		if result.Statuses[i] == EventAccepted {
+			result.Statuses[i] = EventOverflowed
+		}
+	}); err != nil {
+		return AggregateBatchResult{}, err
+	}
+	return result, nil
+}
+
+// aggregateBatch aggregates all events in the batch for all the aggregation
+// intervals, scaling the representative count of the events by the given
+// weight. The errors for individual events are passed to onEventError
+// along with the index of the event in the batch and the aggregation
+// continues with the remaining events. The indexes of the events dropped
+// by the event filter are passed to onEventFiltered. If onEventOverflowed
+// is non-nil, the indexes of the events aggregated into overflow buckets
+// are passed to it, see overflowTracker. The returned error is non-nil
+// only if the batch could not be aggregated. The batches exceeding
+// maxBatchSize are rejected, or aggregated in chunks, see MaxBatchSize.
+// The duration of the aggregated batches, from the start of the request
+// until all the chunks are aggregated, is recorded once per request.
+func (a *Aggregator) aggregateBatch(
+	ctx context.Context,
+	id string,
+	b *modelpb.Batch,
+	weight float64,
+	onEventError func(int, error),
+	onEventFiltered func(int),
+	onEventOverflowed func(int),
+) error {
+	start := time.Now()
+	if err := a.aggregateBatchChunks(ctx, id, b, weight, onEventError, onEventFiltered, onEventOverflowed); err != nil {
+		return err
+	}
+	a.metrics.RequestDuration.Record(ctx, time.Since(start).Seconds(),
+		metric.WithAttributeSet(attribute.NewSet(a.combinedMetricsIDAttrs.kvs(id)...)),
+	)
+	return nil
+}
+
+// aggregateBatchChunks aggregates the batch, in chunks if it exceeds
+// maxBatchSize, see aggregateBatch.
+func (a *Aggregator) aggregateBatchChunks(
+	ctx context.Context,
+	id string,
+	b *modelpb.Batch,
+	weight float64,
+	onEventError func(int, error),
+	onEventFiltered func(int),
+	onEventOverflowed func(int),
+) error {
+	if a.maxBatchSize <= 0 || len(*b) <= a.maxBatchSize {
+		return a.aggregateBatchChunk(ctx, id, b, weight, onEventError, onEventFiltered, onEventOverflowed)
+	}
+	if !a.chunkLargeBatches {
+		return fmt.Errorf("%w: batch has %d events, the maximum is %d", ErrBatchTooLarge, len(*b), a.maxBatchSize)
+	}
+	for offset := 0; offset < len(*b); offset += a.maxBatchSize {
+		end := offset + a.maxBatchSize
+		if end > len(*b) {
+			end = len(*b)
+		}
+		chunk := (*b)[offset:end]
+		chunkOffset := offset
+		var onChunkEventOverflowed func(int)
+		if onEventOverflowed != nil {
+			onChunkEventOverflowed = func(i int) {
+				onEventOverflowed(chunkOffset + i)
+			}
+		}
+		if err := a.aggregateBatchChunk(ctx, id, &chunk, weight, func(i int, err error) {
+			onEventError(chunkOffset+i, err)
+		}, func(i int) {
+			onEventFiltered(chunkOffset + i)
+		}, onChunkEventOverflowed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// aggregateBatchChunk aggregates all events in the batch, or in a chunk of
+// a larger batch, under the aggregator's lock, see aggregateBatch.
+func (a *Aggregator) aggregateBatchChunk(
+	ctx context.Context,
+	id string,
+	b *modelpb.Batch,
+	weight float64,
+	onEventError func(int, error),
+	onEventFiltered func(int),
+	onEventOverflowed func(int),
+) error {
+	if !(weight > 0) || math.IsInf(weight, 1) {
+		return fmt.Errorf("invalid weight %v, weight must be positive", weight)
+	}
+	cmIDAttrs := a.combinedMetricsIDAttrs.kvs(id)
+	ctx, span := a.tracer.Start(ctx, "AggregateBatch", trace.WithAttributes(a.combinedMetricsIDToKVs(id)...))
 	defer span.End()
+	a.traceRequestID(ctx, span)
 
 	a.mu.Lock()
 	defer a.mu.Unlock()
@@ -261,83 +1437,553 @@ func (a *Aggregator) AggregateBatch(
 		return ErrAggregatorStopped
 	default:
 	}
+	if err := a.checkWrites(ctx); err != nil {
+		span.RecordError(err)
+		return err
+	}
+	var tracker *overflowTracker
+	if onEventOverflowed != nil {
+		// The aggregated metrics read by the tracker must include all
+		// the previous aggregations.
+		if err := a.flushMergeBatch(); err != nil {
+			span.RecordError(err)
+			return err
+		}
+		if err := a.commitBatches(); err != nil {
+			span.RecordError(err)
+			return err
+		}
+		tracker = newOverflowTracker(a)
+	}
+
+	var weightedEventsTotal float64
+	var filteredTotal int64
+	rejectReasons := make([]string, len(*b))
+	filtered := make([]bool, len(*b))
+	for i, e := range *b {
+		reason, err := validateEvent(e)
+		if err != nil {
+			span.RecordError(err)
+			onEventError(i, err)
+			rejectReasons[i] = reason
+			continue
+		}
+		if a.eventFilter != nil && !a.eventFilter(e) {
+			onEventFiltered(i)
+			filtered[i] = true
+			filteredTotal++
+			continue
+		}
+		weightedEventsTotal += representativeCount(e) * weight
+	}
 
-	var errs []error
 	var totalBytesIn int64
+	bytesInByType := make(map[string]int64)
 	cmk := CombinedMetricsKey{ID: id}
+	now := a.clock.Now()
 	for _, ivl := range a.aggregationIntervals {
 		cmk.ProcessingTime = a.processingTime.Truncate(ivl)
 		cmk.Interval = ivl
-		for _, e := range *b {
-			bytesIn, err := a.aggregateAPMEvent(ctx, cmk, e)
+		ivlAttrSet := telemetry.AggregationIntervalAttrSet(ivl, cmIDAttrs...)
+		var failedEvents int
+		var failure error
+		var tooLate int64
+		for i, e := range *b {
+			if rejectReasons[i] != "" {
+				a.recordRejected(ctx, ivlAttrSet, rejectReasons[i])
+				continue
+			}
+			if filtered[i] {
+				continue
+			}
+			eventKey := cmk
+			if a.routeByEventTimestamp {
+				var ok bool
+				if eventKey.ProcessingTime, ok = a.eventProcessingTime(e, ivl, now); !ok {
+					tooLate++
+					continue
+				}
+			}
+			bytesIn, overflowed, err := a.aggregateAPMEvent(ctx, eventKey, e, weight, tracker)
 			if err != nil {
 				span.RecordError(err)
-				errs = append(errs, err)
+				onEventError(i, err)
+				if failedEvents == 0 {
+					failure = err
+				}
+				failedEvents++
+			} else if overflowed {
+				onEventOverflowed(i)
 			}
 			totalBytesIn += int64(bytesIn)
+			bytesInByType[eventType(e)] += int64(bytesIn)
 		}
 		cmStats := a.cachedStats[ivl][id]
 		cmStats.eventsTotal += int64(len(*b))
+		cmStats.weightedEventsTotal += weightedEventsTotal
 		a.cachedStats[ivl][id] = cmStats
+
+		if filteredTotal > 0 {
+			a.metrics.EventsFiltered.Add(ctx, filteredTotal, metric.WithAttributeSet(ivlAttrSet))
+		}
+		if tooLate > 0 {
+			a.metrics.EventsTooLate.Add(ctx, tooLate, metric.WithAttributeSet(ivlAttrSet))
+		}
+		a.metrics.RequestsTotal.Add(ctx, 1, metric.WithAttributeSet(ivlAttrSet))
+		if failedEvents > 0 {
+			a.metrics.RequestsFailed.Add(ctx, 1, metric.WithAttributeSet(ivlAttrSet))
+			a.logRequestFailed(ctx, "failed to aggregate batch", failure,
+				zap.String("combined_metrics_id", id),
+				zap.Duration("aggregation_interval_ns", ivl),
+				zap.Int("failed_events", failedEvents),
+			)
+		}
+	}
+
+	for _, e := range *b {
+		a.metrics.AddServiceEvents(e.GetService().GetName(), 1)
 	}
 
 	span.SetAttributes(attribute.Int64("total_bytes_ingested", totalBytesIn))
-	cmIDAttrSet := attribute.NewSet(cmIDAttrs...)
-	a.metrics.RequestsTotal.Add(ctx, 1, metric.WithAttributeSet(cmIDAttrSet))
-	a.metrics.BytesIngested.Add(ctx, totalBytesIn, metric.WithAttributeSet(cmIDAttrSet))
-	if len(errs) > 0 {
-		a.metrics.RequestsFailed.Add(ctx, 1, metric.WithAttributeSet(cmIDAttrSet))
-		return fmt.Errorf("failed batch aggregation:\n%w", errors.Join(errs...))
+	for typ, bytesIn := range bytesInByType {
+		a.metrics.BytesIngested.Add(ctx, bytesIn,
+			metric.WithAttributeSet(attribute.NewSet(cmIDAttrs...)),
+			metric.WithAttributes(attribute.String(telemetry.EventTypeKey, typ)),
+		)
 	}
 	return nil
 }
 
-// AggregateCombinedMetrics aggregates partial metrics into a bigger aggregate.
-// This function will return an error if the aggregator's Run loop has errored
-// or has been explicitly stopped. However, it doesn't require aggregator to be
-// running to perform aggregation.
-func (a *Aggregator) AggregateCombinedMetrics(
-	ctx context.Context,
-	cmk CombinedMetricsKey,
-	cm CombinedMetrics,
-) error {
-	cmIDAttrs := a.combinedMetricsIDToKVs(cmk.ID)
-	traceAttrs := append(append([]attribute.KeyValue{}, cmIDAttrs...),
-		attribute.String(aggregationIvlKey, formatDuration(cmk.Interval)),
-		attribute.String("processing_time", cmk.ProcessingTime.String()))
-	ctx, span := a.tracer.Start(ctx, "AggregateCombinedMetrics", trace.WithAttributes(traceAttrs...))
-	defer span.End()
+// eventProcessingTime returns the processing time of the aggregation
+// interval the event is aggregated into by its timestamp, capped to now,
+// see RouteByEventTimestamp. It returns false if the processing time of
+// the timestamp precedes the current processing time, as it is already
+// harvested. The caller must hold the aggregator's lock.
+func (a *Aggregator) eventProcessingTime(e *modelpb.APMEvent, ivl time.Duration, now time.Time) (time.Time, bool) {
+	current := a.processingTime.Truncate(ivl)
+	if e.GetTimestamp() == nil {
+		return current, true
+	}
+	ts := e.GetTimestamp().AsTime()
+	if ts.After(now) {
+		ts = now
+	}
+	pt := ts.Truncate(ivl)
+	if pt.Before(current) {
+		return time.Time{}, false
+	}
+	return pt, true
+}
 
-	a.mu.Lock()
-	defer a.mu.Unlock()
+// eventType returns the type of the event, as identified by its processor,
+// for example "transaction" or "span", or "unknown" if not set.
+func eventType(e *modelpb.APMEvent) string {
+	if typ := e.GetProcessor().GetEvent(); typ != "" {
+		return typ
+	}
+	return "unknown"
+}
 
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case <-a.stopping:
-		return ErrAggregatorStopped
-	default:
+// validateEvent returns the reason and an error for rejecting the event
+// from aggregation, or a nil error if the event is valid.
+func validateEvent(e *modelpb.APMEvent) (string, error) {
+	if e == nil {
+		return rejectReasonMissingEvent, errors.New("event is missing")
+	}
+	processor := e.GetProcessor()
+	switch {
+	case processor.IsTransaction() && e.GetTransaction() == nil:
+		return rejectReasonMissingRequiredField, errors.New("transaction event is missing the transaction field")
+	case processor.IsSpan() && e.GetSpan() == nil:
+		return rejectReasonMissingRequiredField, errors.New("span event is missing the span field")
 	}
+	if rc := representativeCount(e); math.IsNaN(rc) || math.IsInf(rc, 0) || rc < 0 {
+		return rejectReasonInvalidRepresentativeCount, fmt.Errorf("invalid representative count %v", rc)
+	}
+	return "", nil
+}
 
-	bytesIn, err := a.aggregate(ctx, cmk, cm)
+// recordRejected records an event rejected from aggregation for the
+// given reason.
+func (a *Aggregator) recordRejected(ctx context.Context, ivlAttrSet attribute.Set, reason string) {
+	a.metrics.EventsRejected.Add(ctx, 1, metric.WithAttributeSet(ivlAttrSet),
+		metric.WithAttributes(attribute.String(telemetry.RejectReasonKey, reason)))
+}
 
-	if _, ok := a.cachedStats[cmk.Interval]; !ok {
-		// Protection for stats collected from a different instance
-		// of aggregator as aggregators can be chained.
-		a.cachedStats[cmk.Interval] = make(map[string]stats)
+// checkWrites returns ErrWriteStalled if the ongoing pebble write stall
+// or the memtable size of any of the databases exceed the configured
+// thresholds, or ErrDiskFull if the disk usage of all the databases
+// exceeds the configured limit. The memtable size and the disk usage are
+// sampled at most once per storeUsageSampleInterval, see storeUsage.
+func (a *Aggregator) checkWrites(ctx context.Context) error {
+	if a.writeStallThreshold > 0 {
+		if d := a.writeStall(); d > a.writeStallThreshold {
+			return fmt.Errorf("%w: writes stalled for %s", ErrWriteStalled, d)
+		}
 	}
-	cmStats := a.cachedStats[cmk.Interval][cmk.ID]
-	cmStats.eventsTotal += cm.eventsTotal
-	a.cachedStats[cmk.Interval][cmk.ID] = cmStats
-
-	span.SetAttributes(attribute.Int("bytes_ingested", bytesIn))
-	cmIDAttrSet := attribute.NewSet(cmIDAttrs...)
-	a.metrics.RequestsTotal.Add(ctx, 1, metric.WithAttributeSet(cmIDAttrSet))
-	a.metrics.BytesIngested.Add(ctx, int64(bytesIn), metric.WithAttributeSet(cmIDAttrSet))
-	if err != nil {
-		a.metrics.RequestsFailed.Add(ctx, 1, metric.WithAttributeSet(cmIDAttrSet))
+	if a.memtableSizeThreshold == 0 && a.diskUsageLimit == 0 {
+		return nil
 	}
-	return err
+	memtableSize, usage := a.storeUsage.get(a.clock.Now(), a.stores)
+	if a.memtableSizeThreshold > 0 && memtableSize > a.memtableSizeThreshold {
+		return fmt.Errorf("%w: memtable size of %d bytes", ErrWriteStalled, memtableSize)
+	}
+	if a.diskUsageLimit > 0 && usage > a.diskUsageLimit {
+		a.metrics.RequestsDiskFull.Add(ctx, 1)
+		return fmt.Errorf("%w: disk usage of %d bytes", ErrDiskFull, usage)
+	}
+	return nil
+}
+
+// storeUsageSampleInterval is the minimum interval between the samples
+// of the pebble metrics of the databases checked by checkWrites.
+const storeUsageSampleInterval = time.Second
+
+// storeUsage caches the memtable size and the disk space usage of the
+// pebble databases, sampled from the pebble metrics at most once per
+// storeUsageSampleInterval, so that the aggregation requests do not
+// compute the pebble metrics of all the databases on every request.
+type storeUsage struct {
+	sampledAt    atomic.Int64 // unix nanoseconds, zero if never sampled
+	memtableSize atomic.Uint64
+	diskUsage    atomic.Uint64
+}
+
+// get returns the largest memtable size and the total disk space usage
+// of the databases, sampling them if the cached values are older than
+// storeUsageSampleInterval. Only one of the concurrent callers samples
+// the databases, the others get the cached values.
+func (u *storeUsage) get(now time.Time, stores []*store) (memtableSize, diskUsage uint64) {
+	last := u.sampledAt.Load()
+	if (last == 0 || now.Sub(time.Unix(0, last)) >= storeUsageSampleInterval) &&
+		u.sampledAt.CompareAndSwap(last, now.UnixNano()) {
+		memtableSize, diskUsage = 0, 0
+		for _, s := range stores {
+			pm := s.metrics()
+			if pm == nil {
+				continue
+			}
+			if pm.MemTable.Size > memtableSize {
+				memtableSize = pm.MemTable.Size
+			}
+			diskUsage += pm.DiskSpaceUsage()
+		}
+		u.memtableSize.Store(memtableSize)
+		u.diskUsage.Store(diskUsage)
+		return memtableSize, diskUsage
+	}
+	return u.memtableSize.Load(), u.diskUsage.Load()
+}
+
+// writeStall returns the longest ongoing pebble write stall of the
+// databases, or zero if writes are not stalled.
+func (a *Aggregator) writeStall() time.Duration {
+	var stall time.Duration
+	for _, s := range a.stores {
+		if d := s.writeStalls.Current(); d > stall {
+			stall = d
+		}
+	}
+	return stall
+}
+
+// KeyedCombinedMetrics holds partial combined metrics along with their
+// key, see AggregateCombinedMetricsBatch.
+type KeyedCombinedMetrics struct {
+	Key     CombinedMetricsKey
+	Metrics CombinedMetrics
+}
+
+// AggregateCombinedMetricsBatch aggregates the partial combined metrics
+// with the same result as calling AggregateCombinedMetrics for each of
+// them in order, but with the per call overhead amortized over the batch:
+// the aggregator's lock is acquired, the writes are checked, and the
+// request telemetry is recorded once per batch. The request telemetry is
+// recorded as one request per distinct aggregation interval and combined
+// metrics ID attributes in the batch, except for the duration which is
+// recorded once for the whole batch.
+//
+// The combined metrics which fail to be aggregated do not prevent the
+// remaining combined metrics from being aggregated, the returned error
+// joins the errors of all the failed combined metrics. An error is
+// returned without aggregating any of the combined metrics if the
+// aggregator has been stopped, ErrWriteStalled if it is overloaded, or
+// ErrDiskFull if its disk usage limit is exceeded.
+func (a *Aggregator) AggregateCombinedMetricsBatch(
+	ctx context.Context,
+	kcms []KeyedCombinedMetrics,
+) error {
+	start := time.Now()
+	ctx, span := a.tracer.Start(ctx, "AggregateCombinedMetricsBatch",
+		trace.WithAttributes(attribute.Int("batch_size", len(kcms))))
+	defer span.End()
+	a.traceRequestID(ctx, span)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-a.stopping:
+		return ErrAggregatorStopped
+	default:
+	}
+	if err := a.checkWrites(ctx); err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	var errs []error
+	var totalBytesIn int64
+	// requestsFailed holds whether any of the requests per aggregation
+	// interval and combined metrics ID attributes failed.
+	requestsFailed := make(map[attribute.Set]bool)
+	bytesInByIDAttrs := make(map[attribute.Set]int64)
+	for i := range kcms {
+		cmk, cm := kcms[i].Key, kcms[i].Metrics
+		cmIDAttrs := a.combinedMetricsIDAttrs.kvs(cmk.ID)
+		bytesIn, err := a.aggregate(ctx, cmk, cm)
+		a.addEventsTotal(cmk, cm.eventsTotal)
+
+		ivlAttrSet := telemetry.AggregationIntervalAttrSet(cmk.Interval, cmIDAttrs...)
+		failed := requestsFailed[ivlAttrSet]
+		if err != nil {
+			span.RecordError(err)
+			errs = append(errs, fmt.Errorf("failed to aggregate combined metrics ID %s: %w", cmk.ID, err))
+			failed = true
+		}
+		requestsFailed[ivlAttrSet] = failed
+		bytesInByIDAttrs[attribute.NewSet(cmIDAttrs...)] += int64(bytesIn)
+		totalBytesIn += int64(bytesIn)
+	}
+
+	for ivlAttrSet, failed := range requestsFailed {
+		a.metrics.RequestsTotal.Add(ctx, 1, metric.WithAttributeSet(ivlAttrSet))
+		if failed {
+			a.metrics.RequestsFailed.Add(ctx, 1, metric.WithAttributeSet(ivlAttrSet))
+		}
+	}
+	// The duration of the batch is recorded once, with the combined
+	// metrics ID attributes only if all the batch shares them.
+	var durationAttrSet attribute.Set
+	for idAttrSet, bytesIn := range bytesInByIDAttrs {
+		a.metrics.BytesIngested.Add(ctx, bytesIn,
+			metric.WithAttributeSet(idAttrSet),
+			metric.WithAttributes(attribute.String(telemetry.EventTypeKey, "combined_metrics")),
+		)
+		if len(bytesInByIDAttrs) == 1 {
+			durationAttrSet = idAttrSet
+		}
+	}
+	a.metrics.RequestDuration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributeSet(durationAttrSet))
+	span.SetAttributes(attribute.Int64("total_bytes_ingested", totalBytesIn))
+	if len(errs) > 0 {
+		err := errors.Join(errs...)
+		a.logRequestFailed(ctx, "failed to aggregate combined metrics batch", err,
+			zap.Int("failed_combined_metrics", len(errs)),
+		)
+		return err
+	}
+	return nil
+}
+
+// addEventsTotal adds the events total of the aggregated partial combined
+// metrics to the cached stats published on harvest.
+func (a *Aggregator) addEventsTotal(cmk CombinedMetricsKey, eventsTotal int64) {
+	if _, ok := a.cachedStats[cmk.Interval]; !ok {
+		// Protection for stats collected from a different instance
+		// of aggregator as aggregators can be chained.
+		a.cachedStats[cmk.Interval] = make(map[string]stats)
+	}
+	cmStats := a.cachedStats[cmk.Interval][cmk.ID]
+	cmStats.eventsTotal += eventsTotal
+	a.cachedStats[cmk.Interval][cmk.ID] = cmStats
+}
+
+// AggregateCombinedMetrics aggregates partial metrics into a bigger aggregate.
+// This function will return an error if the aggregator's Run loop has errored
+// or has been explicitly stopped. However, it doesn't require aggregator to be
+// running to perform aggregation. ErrWriteStalled is returned if the aggregator
+// is overloaded, or ErrDiskFull if its disk usage limit is exceeded.
+func (a *Aggregator) AggregateCombinedMetrics(
+	ctx context.Context,
+	cmk CombinedMetricsKey,
+	cm CombinedMetrics,
+) error {
+	return a.aggregateCombinedMetrics(ctx, cmk, cm, "")
+}
+
+// AggregateCombinedMetricsIdempotent is like AggregateCombinedMetrics but
+// ignores the combined metrics if the same idempotency token was already
+// aggregated successfully within the DeduplicationWindow, for example, when
+// the caller retries sending the same combined metrics. The ignored requests
+// are counted by the aggregator.requests.deduplicated metric and nil is
+// returned for them. The tokens are committed atomically with the
+// aggregated metrics, thus, they are deduplicated across restarts, and
+// a failed request is never deduplicated, nor partially aggregated. The
+// combined metrics with a token are never coalesced by the merge batch,
+// see MergeBatchWindow. If the token is empty or the DeduplicationWindow
+// is not configured then the combined metrics are always aggregated.
+func (a *Aggregator) AggregateCombinedMetricsIdempotent(
+	ctx context.Context,
+	cmk CombinedMetricsKey,
+	cm CombinedMetrics,
+	token string,
+) error {
+	return a.aggregateCombinedMetrics(ctx, cmk, cm, token)
+}
+
+func (a *Aggregator) aggregateCombinedMetrics(
+	ctx context.Context,
+	cmk CombinedMetricsKey,
+	cm CombinedMetrics,
+	token string,
+) error {
+	start := time.Now()
+	cmIDAttrs := a.combinedMetricsIDAttrs.kvs(cmk.ID)
+	traceAttrs := append(append([]attribute.KeyValue{}, a.combinedMetricsIDToKVs(cmk.ID)...),
+		telemetry.AggregationIntervalAttr(cmk.Interval),
+		attribute.String("processing_time", cmk.ProcessingTime.String()))
+	ctx, span := a.tracer.Start(ctx, "AggregateCombinedMetrics", trace.WithAttributes(traceAttrs...))
+	defer span.End()
+	a.traceRequestID(ctx, span)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-a.stopping:
+		return ErrAggregatorStopped
+	default:
+	}
+	if err := a.checkWrites(ctx); err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	ivlAttrSet := telemetry.AggregationIntervalAttrSet(cmk.Interval, cmIDAttrs...)
+	deduplicate := token != "" && a.deduplicationWindow > 0
+	now := a.clock.Now()
+	if deduplicate {
+		duplicate, err := a.isDuplicate(token, cmk.Interval, now)
+		if err != nil {
+			span.RecordError(err)
+			a.metrics.RequestsTotal.Add(ctx, 1, metric.WithAttributeSet(ivlAttrSet))
+			a.metrics.RequestsFailed.Add(ctx, 1, metric.WithAttributeSet(ivlAttrSet))
+			a.logRequestFailed(ctx, "failed to aggregate combined metrics", err,
+				zap.String("combined_metrics_id", cmk.ID),
+				zap.Duration("aggregation_interval_ns", cmk.Interval),
+			)
+			return err
+		}
+		if duplicate {
+			span.SetAttributes(attribute.Bool("deduplicated", true))
+			a.metrics.RequestsTotal.Add(ctx, 1, metric.WithAttributeSet(ivlAttrSet))
+			a.metrics.RequestsDeduplicated.Add(ctx, 1, metric.WithAttributeSet(ivlAttrSet))
+			return nil
+		}
+	}
+	var bytesIn int
+	var err error
+	if deduplicate {
+		bytesIn, err = a.aggregateIdempotent(cmk, cm, token, now)
+	} else {
+		bytesIn, err = a.aggregate(ctx, cmk, cm)
+	}
+	a.addEventsTotal(cmk, cm.eventsTotal)
+
+	span.SetAttributes(attribute.Int("bytes_ingested", bytesIn))
+	a.metrics.RequestsTotal.Add(ctx, 1, metric.WithAttributeSet(ivlAttrSet))
+	a.metrics.BytesIngested.Add(ctx, int64(bytesIn),
+		metric.WithAttributeSet(attribute.NewSet(cmIDAttrs...)),
+		metric.WithAttributes(attribute.String(telemetry.EventTypeKey, "combined_metrics")),
+	)
+	a.metrics.RequestDuration.Record(ctx, time.Since(start).Seconds(),
+		metric.WithAttributeSet(attribute.NewSet(cmIDAttrs...)),
+	)
+	if err != nil {
+		a.metrics.RequestsFailed.Add(ctx, 1, metric.WithAttributeSet(ivlAttrSet))
+		a.logRequestFailed(ctx, "failed to aggregate combined metrics", err,
+			zap.String("combined_metrics_id", cmk.ID),
+			zap.Duration("aggregation_interval_ns", cmk.Interval),
+		)
+	}
+	return err
+}
+
+// Snapshot returns the current, not yet harvested, aggregated metrics for
+// the given aggregation interval across all processing times and combined
+// metrics IDs. Snapshot does not harvest or reset any of the aggregated
+// metrics and can be called while the aggregator is running, for example,
+// for debugging the in-flight aggregation state.
+//
+// Any pending aggregations are committed to the database before reading
+// the aggregated metrics from a consistent database snapshot. Snapshot
+// blocks aggregation until all the aggregated metrics for the interval are
+// decoded and holds all of them in memory, thus, it can be expensive for
+// aggregators with a large aggregation state.
+func (a *Aggregator) Snapshot(
+	ctx context.Context,
+	ivl time.Duration,
+) ([]*aggregationpb.CombinedMetrics, error) {
+	ctx, span := a.tracer.Start(ctx, "Snapshot", trace.WithAttributes(
+		telemetry.AggregationIntervalAttr(ivl),
+	))
+	defer span.End()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	if a.closed {
+		return nil, ErrAggregatorStopped
+	}
+
+	if err := a.flushMergeBatch(); err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	s := a.storeFor(ivl)
+	if err := s.commitBatch(); err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to prepare snapshot: %w", err)
+	}
+
+	snap := s.kv.NewSnapshot()
+	defer snap.Close()
+
+	// All the keys for an interval are prefixed by the encoded interval.
+	lb := intervalKeyPrefix(ivl)
+	ub := intervalKeyPrefix(ivl + time.Second)
+	var result []*aggregationpb.CombinedMetrics
+	var decodeErr error
+	if err := snap.RangeScan(lb, ub, func(_, value []byte) error {
+		if err := ctx.Err(); err != nil {
+			decodeErr = err
+			return err
+		}
+		cm, err := DecodeCombinedMetrics(value)
+		if err != nil {
+			decodeErr = fmt.Errorf("failed to unmarshal metrics: %w", err)
+			return decodeErr
+		}
+		result = append(result, cm)
+		return nil
+	}); err != nil {
+		if decodeErr == nil {
+			err = fmt.Errorf("failed to iterate aggregated metrics: %w", err)
+		}
+		span.RecordError(err)
+		return nil, err
+	}
+	return result, nil
 }
 
 // Run harvests the aggregated results periodically. For an aggregator,
@@ -350,8 +1996,17 @@ func (a *Aggregator) Run(ctx context.Context) error {
 	}
 	defer close(a.runStopped)
 
+	// The merge batch is flushed once its window elapses even if no
+	// further aggregations are added to it.
+	var mergeBatchTimer timer
+	var mergeBatchDue <-chan time.Time
+	if a.mergeBatch != nil {
+		mergeBatchTimer = a.clock.NewTimer(a.mergeBatch.window)
+		defer mergeBatchTimer.Stop()
+		mergeBatchDue = mergeBatchTimer.C()
+	}
 	to := a.processingTime.Add(a.aggregationIntervals[0])
-	timer := time.NewTimer(time.Until(to.Add(a.harvestDelay)))
+	timer := a.clock.NewTimer(a.untilHarvest(to))
 	harvestStats := newCachedStats(a.aggregationIntervals)
 	defer timer.Stop()
 	for {
@@ -360,13 +2015,28 @@ func (a *Aggregator) Run(ctx context.Context) error {
 			return ctx.Err()
 		case <-a.stopping:
 			return ErrAggregatorStopped
-		case <-timer.C:
+		case <-mergeBatchDue:
+			mergeBatchTimer.Reset(a.flushDueMergeBatch())
+			continue
+		case <-timer.C():
 		}
 
+		// harvestMu is held from taking the pending batch until the
+		// harvest is complete, see Reset.
+		a.harvestMu.Lock()
 		a.mu.Lock()
-		batch := a.batch
-		a.batch = nil
+		if err := a.flushMergeBatch(); err != nil {
+			a.logger.Warn("failed to flush merge batch before harvest", zap.Error(err))
+		}
+		batches := make([]StoreBatch, 0, len(a.stores))
+		for _, s := range a.stores {
+			if s.batch != nil {
+				batches = append(batches, s.batch)
+				s.batch = nil
+			}
+		}
 		a.processingTime = to
+		a.pruneIdempotencyTokens(a.clock.Now())
 		for ivl, statsm := range a.cachedStats {
 			if _, ok := harvestStats[ivl]; !ok {
 				// Protection for stats collected from a different instance
@@ -382,17 +2052,88 @@ func (a *Aggregator) Run(ctx context.Context) error {
 		}
 		a.mu.Unlock()
 
-		if err := a.commitAndHarvest(ctx, batch, to, harvestStats); err != nil {
+		if err := a.commitAndHarvest(ctx, batches, to, harvestStats); err != nil {
 			a.logger.Warn("failed to commit and harvest metrics", zap.Error(err))
 		}
+		a.harvestMu.Unlock()
 		to = to.Add(a.aggregationIntervals[0])
-		timer.Reset(time.Until(to.Add(a.harvestDelay)))
+		timer.Reset(a.untilHarvest(to))
 	}
 }
 
+// NextHarvest returns the time at which the metrics for the given
+// aggregation interval are scheduled to be harvested next by Run,
+// including the configured harvest delay and jitter. While a harvest is in
+// progress, NextHarvest returns the time of the harvest following it.
+func (a *Aggregator) NextHarvest(ivl time.Duration) (time.Time, error) {
+	idx := sort.Search(len(a.aggregationIntervals), func(i int) bool {
+		return a.aggregationIntervals[i] >= ivl
+	})
+	if idx == len(a.aggregationIntervals) || a.aggregationIntervals[idx] != ivl {
+		return time.Time{}, fmt.Errorf("unknown aggregation interval %s", ivl)
+	}
+
+	a.mu.Lock()
+	processingTime := a.processingTime
+	a.mu.Unlock()
+	// The processing time is always aligned to the lowest aggregation
+	// interval, which all the other aggregation intervals are multiples of.
+	return a.harvestTime(processingTime.Truncate(ivl).Add(ivl)), nil
+}
+
+// Limits returns the limits used for the aggregation intervals which
+// are not overridden by LimitsPerInterval.
+func (a *Aggregator) Limits() Limits {
+	return a.limits.Load().limits
+}
+
+// LimitsPerInterval returns a copy of the limits overriding Limits for
+// the given aggregation intervals, or nil if none are configured.
+func (a *Aggregator) LimitsPerInterval() map[time.Duration]Limits {
+	// The limits config copies the limits per interval when created.
+	return newLimitsConfig(Limits{}, a.limits.Load().perInterval).perInterval
+}
+
+// SetLimits replaces the limits used for the aggregation intervals which
+// are not overridden by LimitsPerInterval, without restarting the
+// aggregator. The new limits are used by the aggregations and the merges
+// of the aggregated metrics after SetLimits returns, the aggregated
+// metrics which already overflowed remain in the overflow buckets. The
+// aggregations which were not yet merged by the database, for example,
+// the aggregations in the memtable, may be merged using the new limits.
+// SetLimits returns an error if any of the limits is negative.
+func (a *Aggregator) SetLimits(limits Limits) error {
+	if err := validateLimits(limits); err != nil {
+		return err
+	}
+	// The limits per interval are never modified, thus, concurrent calls
+	// can not lose each other's updates.
+	a.limits.Store(newLimitsConfig(limits, a.limits.Load().perInterval))
+	return nil
+}
+
+// untilHarvest returns the duration until the metrics aggregated before
+// the given time are harvested.
+func (a *Aggregator) untilHarvest(to time.Time) time.Duration {
+	return a.harvestTime(to).Sub(a.clock.Now())
+}
+
+// harvestTime returns the time to harvest the metrics aggregated before
+// the given time.
+func (a *Aggregator) harvestTime(to time.Time) time.Time {
+	return to.Add(a.harvestDelay + a.harvestJitter.offset(to))
+}
+
 // Stop stops the aggregator. Aggregations performed after calling Stop
 // will return an error. Stop can be called multiple times but concurrent
 // calls to stop will block.
+//
+// Before closing the database, Stop harvests the metrics aggregated for
+// the current processing time of all the aggregation intervals. If the
+// context is done before all the aggregation intervals are harvested, a
+// *HarvestIncompleteError identifying the aggregation intervals which
+// were not harvested is returned, and the database is left open so that
+// Stop can be retried.
 func (a *Aggregator) Stop(ctx context.Context) error {
 	ctx, span := a.tracer.Start(ctx, "Aggregator.Stop")
 	defer span.End()
@@ -413,78 +2154,319 @@ func (a *Aggregator) Stop(ctx context.Context) error {
 	}
 
 	a.logger.Info("stopping aggregator")
+	// Wait for any manual compaction to complete before closing the
+	// databases.
+	a.compactMu.Lock()
+	defer a.compactMu.Unlock()
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	if a.db != nil {
+	if !a.closed {
 		a.logger.Info("running final aggregation")
-		if a.batch != nil {
-			if err := a.batch.Commit(pebble.Sync); err != nil {
-				span.RecordError(err)
-				return fmt.Errorf("failed to commit batch: %w", err)
+		if err := a.harvestCurrent(ctx); err != nil {
+			span.RecordError(err)
+			return fmt.Errorf("failed while running final harvest: %w", err)
+		}
+		var errs []error
+		for _, s := range a.stores {
+			if err := s.kv.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("failed to close store in %s: %w", s.dataDir, err))
 			}
-			if err := a.batch.Close(); err != nil {
+		}
+		// All future operations are invalid after the stores are closed,
+		// closing is not retried as pebble may not be reopened.
+		a.closed = true
+		if err := errors.Join(errs...); err != nil {
+			span.RecordError(err)
+			return err
+		}
+	}
+	if err := a.metrics.CleanUp(); err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to cleanup instrumentation: %w", err)
+	}
+	return nil
+}
+
+// Flush harvests the metrics aggregated so far for all the aggregation
+// intervals without waiting for the harvest schedule, for example, for
+// tests or controlled shutdowns. The harvested metrics are processed by
+// the configured processor and removed from the aggregator. Aggregations
+// are blocked until the flush is complete. Metrics aggregated after the
+// flush for the same processing time are harvested separately by the
+// next harvest. Flush returns an error if the aggregator has been
+// stopped.
+func (a *Aggregator) Flush(ctx context.Context) error {
+	ctx, span := a.tracer.Start(ctx, "Aggregator.Flush")
+	defer span.End()
+
+	// Prevent harvesting concurrently with the harvest loop.
+	a.harvestMu.Lock()
+	defer a.harvestMu.Unlock()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	if a.closed {
+		return ErrAggregatorStopped
+	}
+	if err := a.harvestCurrent(ctx); err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to flush: %w", err)
+	}
+	return nil
+}
+
+// Reset deletes all the aggregated metrics, including the pending
+// aggregations, for all the aggregation intervals without harvesting them,
+// for example, for tests or cutovers to a different deployment. The
+// database is compacted after deleting the aggregated metrics to reclaim
+// the disk space. Aggregations are blocked until the reset is complete.
+// Reset returns ErrHarvestInProgress if the aggregator is harvesting and
+// an error if the aggregator has been stopped.
+func (a *Aggregator) Reset(ctx context.Context) error {
+	ctx, span := a.tracer.Start(ctx, "Aggregator.Reset")
+	defer span.End()
+
+	if !a.harvestMu.TryLock() {
+		return ErrHarvestInProgress
+	}
+	defer a.harvestMu.Unlock()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	if a.closed {
+		return ErrAggregatorStopped
+	}
+
+	if a.mergeBatch != nil {
+		a.mergeBatch.reset()
+	}
+	// All the combined metrics keys are prefixed by the versioned key
+	// marker followed by the version, which is less than 0xff, and the
+	// reserved keys are prefixed by 0x0000.
+	start, end := []byte{0x00, 0x00}, []byte{versionedKeyMarker, 0xff}
+	for _, s := range a.stores {
+		if s.batch != nil {
+			if err := s.batch.Close(); err != nil {
 				span.RecordError(err)
 				return fmt.Errorf("failed to close batch: %w", err)
 			}
-			a.batch = nil
+			s.batch = nil
 		}
-		var errs []error
-		for _, ivl := range a.aggregationIntervals {
-			// At any particular time there will be 1 harvest candidate for
-			// each aggregation interval. We will align the end time and
-			// process each of these.
-			//
-			// TODO (lahsivjar): It is possible to harvest the same
-			// time multiple times, not an issue but can be optimized.
-			to := a.processingTime.Truncate(ivl).Add(ivl)
-			if err := a.harvest(ctx, to, a.cachedStats); err != nil {
-				span.RecordError(err)
-				errs = append(errs, fmt.Errorf(
-					"failed to harvest metrics for interval %s: %w", formatDuration(ivl), err),
-				)
-			}
+		if err := s.kv.RangeDelete(start, end); err != nil {
+			span.RecordError(err)
+			return fmt.Errorf("failed to delete aggregated metrics: %w", err)
 		}
-		if len(errs) > 0 {
-			return fmt.Errorf("failed while running final harvest: %w", errors.Join(errs...))
+		if s.db == nil {
+			continue
 		}
-		if err := a.db.Close(); err != nil {
+		if err := s.db.Compact(start, end, true); err != nil {
 			span.RecordError(err)
-			return fmt.Errorf("failed to close pebble: %w", err)
+			return fmt.Errorf("failed to compact after reset: %w", err)
 		}
-		// All future operations are invalid after db is closed
-		a.db = nil
 	}
-	if err := a.metrics.CleanUp(); err != nil {
+	a.cachedStats = newCachedStats(a.aggregationIntervals)
+	a.idempotencyTokens = make(map[string]time.Time)
+	a.active.reset()
+	a.overflowCardinality.reset()
+	return nil
+}
+
+// CompactRange compacts the keys of the given aggregation interval,
+// reclaiming the disk space used by deleted or overwritten aggregated
+// metrics without waiting for the background compactions, for example,
+// after a large number of overflowed aggregated metrics are harvested.
+// CompactRange does not block aggregations or harvests and can be called
+// while the aggregator is running. Manual compactions are serialized and
+// rate limited to one per CompactRangeInterval, ErrCompactRangeRateLimited
+// is returned if the previous manual compaction is too recent.
+// CompactRange returns an error if the aggregator has been stopped.
+func (a *Aggregator) CompactRange(ctx context.Context, ivl time.Duration) error {
+	ctx, span := a.tracer.Start(ctx, "Aggregator.CompactRange", trace.WithAttributes(
+		telemetry.AggregationIntervalAttr(ivl),
+	))
+	defer span.End()
+
+	idx := sort.Search(len(a.aggregationIntervals), func(i int) bool {
+		return a.aggregationIntervals[i] >= ivl
+	})
+	if idx == len(a.aggregationIntervals) || a.aggregationIntervals[idx] != ivl {
+		return fmt.Errorf("unknown aggregation interval %s", ivl)
+	}
+
+	a.compactMu.Lock()
+	defer a.compactMu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	now := a.clock.Now()
+	if !a.lastCompactRange.IsZero() && now.Sub(a.lastCompactRange) < a.compactRangeInterval {
+		return ErrCompactRangeRateLimited
+	}
+	// Stop closes the databases only after acquiring compactMu, thus,
+	// they remain open until the compaction is complete.
+	a.mu.Lock()
+	closed := a.closed
+	a.mu.Unlock()
+	if closed {
+		return ErrAggregatorStopped
+	}
+	db := a.storeFor(ivl).db
+	if db == nil {
+		// Only the pebble databases are compacted.
+		return nil
+	}
+
+	a.lastCompactRange = now
+	// All the keys for an interval are prefixed by the encoded interval.
+	start := intervalKeyPrefix(ivl)
+	end := intervalKeyPrefix(ivl + time.Second)
+	if err := db.Compact(start, end, true); err != nil {
 		span.RecordError(err)
-		return fmt.Errorf("failed to cleanup instrumentation: %w", err)
+		return fmt.Errorf("failed to compact aggregated metrics: %w", err)
 	}
 	return nil
 }
 
+// harvestCurrent commits the pending batch and harvests the current
+// processing time for all the aggregation intervals. The caller must
+// hold the aggregator's lock to prevent concurrent aggregations to the
+// harvested processing time.
+func (a *Aggregator) harvestCurrent(ctx context.Context) error {
+	if err := a.flushMergeBatch(); err != nil {
+		return err
+	}
+	if err := a.commitBatches(); err != nil {
+		return err
+	}
+	snaps := a.snapshots()
+	defer closeSnapshots(snaps)
+
+	var errs []error
+	var unharvested []time.Duration
+	for _, ivl := range a.aggregationIntervals {
+		if ctx.Err() != nil {
+			unharvested = append(unharvested, ivl)
+			continue
+		}
+		// At any particular time there will be 1 harvest candidate for
+		// each aggregation interval. We will align the end time and
+		// process each of these.
+		end := a.processingTime.Truncate(ivl).Add(ivl)
+		if err := a.harvestInterval(ctx, snaps[a.storeFor(ivl)], ivl, end, a.cachedStats[ivl]); err != nil {
+			errs = append(errs, err)
+		}
+		if a.routeByEventTimestamp {
+			// The events may have been routed to the processing times
+			// following the current one, up to the current time.
+			last := a.clock.Now().Truncate(ivl).Add(ivl)
+			for end = end.Add(ivl); !end.After(last); end = end.Add(ivl) {
+				if err := a.harvestInterval(ctx, snaps[a.storeFor(ivl)], ivl, end, nil); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	if len(unharvested) > 0 {
+		errs = append(errs, &HarvestIncompleteError{
+			Intervals: unharvested,
+			Err:       ctx.Err(),
+		})
+	}
+	return errors.Join(errs...)
+}
+
+// aggregateAPMEvent aggregates the event for the combined metrics key and
+// returns the number of bytes ingested. If the tracker is non-nil, the
+// returned bool reports whether the event was aggregated into overflow
+// buckets.
 func (a *Aggregator) aggregateAPMEvent(
 	ctx context.Context,
 	cmk CombinedMetricsKey,
 	e *modelpb.APMEvent,
-) (int, error) {
+	weight float64,
+	tracker *overflowTracker,
+) (int, bool, error) {
 	traceAttrs := append(append([]attribute.KeyValue{}, a.combinedMetricsIDToKVs(cmk.ID)...),
-		attribute.String(aggregationIvlKey, formatDuration(cmk.Interval)),
+		telemetry.AggregationIntervalAttr(cmk.Interval),
 		attribute.String("processing_time", cmk.ProcessingTime.String()))
 	ctx, span := a.tracer.Start(ctx, "aggregateAPMEvent", trace.WithAttributes(traceAttrs...))
 	defer span.End()
 
-	cm, err := EventToCombinedMetrics(e, cmk.Interval)
+	// Span destinations are only aggregated if enabled by the limits.
+	spanDestinations := a.intervalLimits(cmk.Interval).MaxSpanDestinationsPerService > 0
+	cm, err := eventToCombinedMetrics(
+		e, cmk.Interval, weight, a.histogramSignificantFigures, spanDestinations,
+	)
 	if err != nil {
 		span.RecordError(err)
-		return 0, fmt.Errorf("failed to convert event to combined metrics: %w", err)
+		return 0, false, fmt.Errorf("failed to convert event to combined metrics: %w", err)
 	}
 	bytesIn, err := a.aggregate(ctx, cmk, cm)
 	span.SetAttributes(attribute.Int("bytes_ingested", bytesIn))
 	if err != nil {
 		span.RecordError(err)
-		return bytesIn, fmt.Errorf("failed to aggregate combined metrics: %w", err)
+		return bytesIn, false, fmt.Errorf("failed to aggregate combined metrics: %w", err)
+	}
+	if tracker == nil {
+		return bytesIn, false, nil
+	}
+	overflowed, err := tracker.track(cmk, &cm)
+	if err != nil {
+		// The event was aggregated, only its overflow is unknown.
+		span.RecordError(err)
+		a.logger.Warn(
+			"failed to track overflowed events",
+			zap.String("combined_metrics_id", cmk.ID),
+			zap.Error(err),
+		)
 	}
-	return bytesIn, nil
+	return bytesIn, overflowed, nil
+}
+
+// intervalLimits returns the limits configured for the aggregation interval.
+func (a *Aggregator) intervalLimits(ivl time.Duration) Limits {
+	return a.limits.Load().forInterval(ivl)
+}
+
+// limitsConfig holds the limits and the limits overridden for the given
+// aggregation intervals. A limitsConfig is never modified once created,
+// allowing it to be swapped atomically.
+type limitsConfig struct {
+	limits      Limits
+	perInterval map[time.Duration]Limits
+}
+
+func newLimitsConfig(limits Limits, perInterval map[time.Duration]Limits) *limitsConfig {
+	c := &limitsConfig{limits: limits}
+	if len(perInterval) > 0 {
+		c.perInterval = make(map[time.Duration]Limits, len(perInterval))
+		for ivl, l := range perInterval {
+			c.perInterval[ivl] = l
+		}
+	}
+	return c
+}
+
+// forInterval returns the limits for the aggregation interval.
+func (c *limitsConfig) forInterval(ivl time.Duration) Limits {
+	if limits, ok := c.perInterval[ivl]; ok {
+		return limits
+	}
+	return c.limits
 }
 
 // aggregate aggregates combined metrics for a given key and returns
@@ -494,42 +2476,142 @@ func (a *Aggregator) aggregate(
 	cmk CombinedMetricsKey,
 	cm CombinedMetrics,
 ) (int, error) {
+	if err, ok := a.unavailableIntervals[cmk.Interval]; ok {
+		return 0, fmt.Errorf("%w %s: %v", ErrIntervalUnavailable, cmk.Interval, err)
+	}
 	cmproto := cm.ToProto()
 	defer cmproto.ReturnToVTPool()
 
-	if a.batch == nil {
-		// Batch is backed by a sync pool. After each commit we will release the batch
-		// back to the pool by calling Batch#Close and subsequently acquire a new batch.
-		a.batch = a.db.NewBatch()
+	if a.mergeBatch != nil {
+		now := a.clock.Now()
+		if err := a.mergeBatch.add(
+			now, cmk, cmproto,
+			a.intervalLimits(cmk.Interval), newHasher(a.overflowSalt, cmk.ID, a.overflowEstimatorPrecision), a.overflowLogger,
+		); err != nil {
+			return 0, fmt.Errorf("failed to marshal combined metrics key: %w", err)
+		}
+		a.active.add(cmk)
+		bytesIn := cmproto.SizeVT()
+		if a.mergeBatch.due(now) {
+			return bytesIn, a.flushMergeBatch()
+		}
+		if _, buffered := a.mergeBatch.size(); a.mergeBatchMaxBytes > 0 && buffered > a.mergeBatchMaxBytes {
+			a.metrics.MergeBatchForcedFlushes.Add(ctx, 1)
+			return bytesIn, a.flushMergeBatch()
+		}
+		return bytesIn, nil
+	}
+	if err := a.writeMerge(cmk, cmproto); err != nil {
+		return 0, err
+	}
+	a.active.add(cmk)
+	return cmproto.SizeVT(), a.commitBatchIfFull(cmk.Interval)
+}
+
+// writeMerge writes the merge operation for the combined metrics key to
+// the pending batch of the store of the key's aggregation interval.
+func (a *Aggregator) writeMerge(cmk CombinedMetricsKey, cmproto *aggregationpb.CombinedMetrics) error {
+	s := a.storeFor(cmk.Interval)
+	if s.batch == nil {
+		s.batch = s.kv.NewBatch()
+	}
+	return writeMergeTo(s.batch, cmk, cmproto)
+}
+
+// writeMergeTo writes the merge operation for the combined metrics key to
+// the batch.
+func writeMergeTo(batch StoreBatch, cmk CombinedMetricsKey, cmproto *aggregationpb.CombinedMetrics) error {
+	if b, ok := batch.(*pebbleBatch); ok {
+		// The key and value are marshaled directly into the pebble batch.
+		op := b.mergeDeferred(cmk.SizeBinary(), cmproto.SizeVT())
+		if err := cmk.MarshalBinaryToSizedBuffer(op.Key); err != nil {
+			return fmt.Errorf("failed to marshal combined metrics key: %w", err)
+		}
+		if _, err := cmproto.MarshalToSizedBufferVT(op.Value); err != nil {
+			return fmt.Errorf("failed to marshal combined metrics: %w", err)
+		}
+		if err := op.Finish(); err != nil {
+			return fmt.Errorf("failed to finalize merge operation: %w", err)
+		}
+		return nil
+	}
+	key := make([]byte, cmk.SizeBinary())
+	if err := cmk.MarshalBinaryToSizedBuffer(key); err != nil {
+		return fmt.Errorf("failed to marshal combined metrics key: %w", err)
+	}
+	value, err := cmproto.MarshalVT()
+	if err != nil {
+		return fmt.Errorf("failed to marshal combined metrics: %w", err)
+	}
+	if err := batch.Merge(key, value); err != nil {
+		return fmt.Errorf("failed to write merge operation: %w", err)
 	}
+	return nil
+}
 
-	op := a.batch.MergeDeferred(cmk.SizeBinary(), cmproto.SizeVT())
-	if err := cmk.MarshalBinaryToSizedBuffer(op.Key); err != nil {
-		return 0, fmt.Errorf("failed to marshal combined metrics key: %w", err)
+// commitBatchIfFull commits the pending batch of the store of the
+// aggregation interval once it exceeds the commit threshold.
+func (a *Aggregator) commitBatchIfFull(ivl time.Duration) error {
+	s := a.storeFor(ivl)
+	if s.batch == nil || s.batch.Len() < dbCommitThresholdBytes {
+		return nil
 	}
-	if _, err := cmproto.MarshalToSizedBufferVT(op.Value); err != nil {
-		return 0, fmt.Errorf("failed to marshal combined metrics: %w", err)
+	if err := s.commitBatch(); err != nil {
+		return fmt.Errorf("failed to commit full batch: %w", err)
 	}
-	if err := op.Finish(); err != nil {
-		return 0, fmt.Errorf("failed to finalize merge operation: %w", err)
+	return nil
+}
+
+// flushDueMergeBatch flushes the merge batch if its window elapsed and
+// returns the duration until the merge batch must be checked again.
+func (a *Aggregator) flushDueMergeBatch() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.clock.Now()
+	if a.mergeBatch.due(now) {
+		if err := a.flushMergeBatch(); err != nil {
+			a.logger.Warn("failed to flush merge batch", zap.Error(err))
+		}
 	}
+	return a.mergeBatch.untilDue(now)
+}
 
-	bytesIn := cmproto.SizeVT()
-	if a.batch.Len() >= dbCommitThresholdBytes {
-		if err := a.batch.Commit(pebble.Sync); err != nil {
-			return bytesIn, fmt.Errorf("failed to commit pebble batch: %w", err)
+// flushMergeBatch writes the aggregations coalesced by the merge batch, if
+// any, to the pending batches. If writing them fails, the aggregations not
+// yet written are kept and written by the next flush. The caller must hold
+// the aggregator's lock.
+func (a *Aggregator) flushMergeBatch() error {
+	if a.mergeBatch == nil {
+		return nil
+	}
+	// The full batches are committed before writing the next aggregation,
+	// rather than after, so that the aggregations are only drained from
+	// the merge batch once written and the aggregations failing to be
+	// written are kept for the next flush.
+	if err := a.mergeBatch.drain(func(cmk CombinedMetricsKey, cm *CombinedMetrics) error {
+		if err := a.commitBatchIfFull(cmk.Interval); err != nil {
+			return err
 		}
-		if err := a.batch.Close(); err != nil {
-			return bytesIn, fmt.Errorf("failed to close pebble batch: %w", err)
+		cmproto := cm.ToProto()
+		defer cmproto.ReturnToVTPool()
+		return a.writeMerge(cmk, cmproto)
+	}); err != nil {
+		return fmt.Errorf("failed to flush merge batch: %w", err)
+	}
+	for _, s := range a.stores {
+		if s.batch == nil || s.batch.Len() < dbCommitThresholdBytes {
+			continue
+		}
+		if err := s.commitBatch(); err != nil {
+			return fmt.Errorf("failed to commit full batch: %w", err)
 		}
-		a.batch = nil
 	}
-	return bytesIn, nil
+	return nil
 }
 
 func (a *Aggregator) commitAndHarvest(
 	ctx context.Context,
-	batch *pebble.Batch,
+	batches []StoreBatch,
 	to time.Time,
 	harvestStats map[time.Duration]map[string]stats,
 ) error {
@@ -537,8 +2619,8 @@ func (a *Aggregator) commitAndHarvest(
 	defer span.End()
 
 	var errs []error
-	if batch != nil {
-		if err := batch.Commit(pebble.Sync); err != nil {
+	for _, batch := range batches {
+		if err := batch.Commit(); err != nil {
 			span.RecordError(err)
 			errs = append(errs, fmt.Errorf("failed to commit batch before harvest: %w", err))
 		}
@@ -560,51 +2642,159 @@ func (a *Aggregator) commitAndHarvest(
 // harvest collects the mature metrics for all aggregation intervals and
 // deletes the entries in db once the metrics are fully harvested. Harvest
 // takes an end time denoting the exclusive upper bound for harvesting.
+// The expired idempotency tokens are deleted as well.
 func (a *Aggregator) harvest(
 	ctx context.Context,
 	end time.Time,
 	harvestStats map[time.Duration]map[string]stats,
 ) error {
-	snap := a.db.NewSnapshot()
-	defer snap.Close()
+	snaps := a.snapshots()
+	defer closeSnapshots(snaps)
 
 	var errs []error
 	for _, ivl := range a.aggregationIntervals {
 		// Check if the given aggregation interval needs to be harvested now
 		if end.Truncate(ivl).Equal(end) {
-			start := end.Add(-ivl)
-			cmCount, err := a.harvestForInterval(
-				ctx, snap, start, end, ivl, harvestStats[ivl],
-			)
-			if err != nil {
-				errs = append(errs, fmt.Errorf(
-					"failed to harvest aggregated metrics for interval %s: %w",
-					ivl, err,
-				))
-			}
-			a.logger.Debug(
-				"Finished harvesting aggregated metrics",
-				zap.Int("combined_metrics_successfully_harvested", cmCount),
-				zap.Duration("aggregation_interval_ns", ivl),
-				zap.Time("harvested_till(exclusive)", end),
-				zap.Error(err),
-			)
+			if err := a.harvestInterval(ctx, snaps[a.storeFor(ivl)], ivl, end, harvestStats[ivl]); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if a.deduplicationWindow > 0 {
+		for _, s := range a.stores {
+			if err := a.dropExpiredIdempotencyTokens(s, snaps[s], a.clock.Now()); err != nil {
+				errs = append(errs, err)
+			}
 		}
 	}
 	return errors.Join(errs...)
 }
 
+// harvestInterval harvests the aggregated metrics of the given aggregation
+// interval for the interval ending at end, and drops the stale aggregated
+// metrics of the aggregation interval.
+func (a *Aggregator) harvestInterval(
+	ctx context.Context,
+	snap StoreSnapshot,
+	ivl time.Duration,
+	end time.Time,
+	cmStats map[string]stats,
+) error {
+	var errs []error
+	lag := a.clock.Now().Sub(end)
+	if lag < 0 {
+		// The harvest of the current interval, for example, on Stop,
+		// starts before the interval ends.
+		lag = 0
+	}
+	a.metrics.HarvestLag.Record(ctx, lag.Seconds(), metric.WithAttributeSet(telemetry.AggregationIntervalAttrSet(ivl)))
+	start := time.Now()
+	summary, err := a.harvestForInterval(ctx, snap, end.Add(-ivl), end, ivl, cmStats)
+	if a.harvestObserver != nil {
+		summary.Duration = time.Since(start)
+		summary.Err = err
+		a.harvestObserver(summary)
+	}
+	if err != nil {
+		errs = append(errs, fmt.Errorf(
+			"failed to harvest aggregated metrics for interval %s: %w",
+			ivl, err,
+		))
+	} else {
+		a.lastHarvests.record(ivl, a.clock.Now())
+	}
+	a.logger.Debug(
+		"Finished harvesting aggregated metrics",
+		zap.Int("combined_metrics_successfully_harvested", summary.Harvested),
+		zap.Duration("aggregation_interval_ns", ivl),
+		zap.Time("harvested_till(exclusive)", end),
+		zap.Error(err),
+	)
+	if err := a.dropStale(ctx, snap, ivl, end); err != nil {
+		errs = append(errs, fmt.Errorf(
+			"failed to drop stale aggregated metrics for interval %s: %w",
+			ivl, err,
+		))
+	}
+	return errors.Join(errs...)
+}
+
+// dropStale deletes the aggregated metrics for the aggregation interval
+// with a processing time older than the stale key TTL relative to end.
+// These metrics were never harvested, for example, because they were
+// aggregated before the aggregator was restarted, and would otherwise be
+// retained indefinitely.
+func (a *Aggregator) dropStale(
+	ctx context.Context,
+	snap StoreSnapshot,
+	ivl time.Duration,
+	end time.Time,
+) error {
+	if a.staleKeyTTL <= 0 {
+		return nil
+	}
+	olderThan := end.Add(-a.staleKeyTTL)
+	to := CombinedMetricsKey{
+		Interval:       ivl,
+		ProcessingTime: olderThan,
+	}
+	lb := intervalKeyPrefix(ivl)
+	ub := make([]byte, to.SizeBinary())
+	to.MarshalBinaryToSizedBuffer(ub)
+
+	var dropped int64
+	if err := snap.RangeScan(lb, ub, func(_, _ []byte) error {
+		dropped++
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to iterate stale aggregated metrics: %w", err)
+	}
+	if dropped == 0 {
+		return nil
+	}
+	if err := a.storeFor(ivl).kv.RangeDelete(lb, ub); err != nil {
+		return fmt.Errorf("failed to delete stale aggregated metrics: %w", err)
+	}
+	a.metrics.StaleDropped.Add(ctx, dropped, metric.WithAttributeSet(
+		telemetry.AggregationIntervalAttrSet(ivl),
+	))
+	a.logger.Warn(
+		"dropped stale aggregated metrics which were never harvested",
+		zap.Int64("combined_metrics_dropped", dropped),
+		zap.Duration("aggregation_interval_ns", ivl),
+		zap.Time("older_than", olderThan),
+	)
+	return nil
+}
+
 // harvestForInterval harvests aggregated metrics for a given interval.
-// Returns the number of combined metrics successfully harvested and an
-// error. It is possible to have non nil error and greater than 0
-// combined metrics if some of the combined metrics failed harvest.
+// Returns the summary of the harvest, without its duration and error,
+// and an error. It is possible to have non nil error and greater than 0
+// combined metrics harvested if some of the combined metrics failed
+// harvest.
+//
+// The combined metrics which fail to be processed are kept and retried
+// by the next harvests of the interval, as recorded by the harvest
+// checkpoint of the interval, up to the max harvest retries, while the
+// successfully processed combined metrics are deleted and never processed
+// again. Of the combined metrics split into chunks, only the chunks which
+// failed to be processed are retried. The combined metrics are processed
+// at least once: if the aggregator stops after processing and before
+// deleting them, they are processed again. The keys whose values can not
+// be merged would fail every harvest, thus, they are skipped and dropped.
 func (a *Aggregator) harvestForInterval(
 	ctx context.Context,
-	snap *pebble.Snapshot,
+	snap StoreSnapshot,
 	start, end time.Time,
 	ivl time.Duration,
 	cmStats map[string]stats,
-) (int, error) {
+) (HarvestSummary, error) {
+	// Resume the harvest from the processing time of the combined metrics
+	// which failed to be processed by a previous harvest, if any.
+	checkpoint, checkpointErr := readHarvestCheckpoint(snap, ivl)
+	if checkpointErr == nil && !checkpoint.IsZero() && checkpoint.processingTime.Before(start) {
+		start = checkpoint.processingTime
+	}
 	from := CombinedMetricsKey{
 		Interval:       ivl,
 		ProcessingTime: start,
@@ -623,72 +2813,440 @@ func (a *Aggregator) harvestForInterval(
 	// aggregation interval. This gap can be introduced if L1 aggregators are
 	// stopped when the L2 aggregator is waiting for harvest delay leading to
 	// premature harvest as part of the graceful shutdown process.
-	ivlAttr := attribute.String(aggregationIvlKey, formatDuration(ivl))
 	for cmID, stats := range cmStats {
-		attrs := append([]attribute.KeyValue{ivlAttr}, a.combinedMetricsIDToKVs(cmID)...)
-		a.metrics.EventsTotal.Add(
-			ctx, stats.eventsTotal,
-			metric.WithAttributeSet(
-				attribute.NewSet(attrs...),
-			),
+		attrs := metric.WithAttributeSet(
+			telemetry.AggregationIntervalAttrSet(ivl, a.combinedMetricsIDAttrs.kvs(cmID)...),
 		)
+		a.metrics.EventsTotal.Add(ctx, stats.eventsTotal, attrs)
+		if stats.weightedEventsTotal > 0 {
+			a.metrics.EventsWeighted.Add(ctx, stats.weightedEventsTotal, attrs)
+		}
 		delete(cmStats, cmID)
 	}
 
-	iter := snap.NewIter(&pebble.IterOptions{
-		LowerBound: lb,
-		UpperBound: ub,
-		KeyTypes:   pebble.IterKeyTypePointsOnly,
-	})
-	defer iter.Close()
-
+	// mu protects the harvest results below when the combined metrics
+	// are processed concurrently.
+	var mu sync.Mutex
 	var errs []error
-	var cmCount int
-	for iter.First(); iter.Valid(); iter.Next() {
-		var cmk CombinedMetricsKey
-		if err := cmk.UnmarshalBinary(iter.Key()); err != nil {
-			errs = append(errs, fmt.Errorf("failed to unmarshal key: %w", err))
-			continue
-		}
-		eventsProcessed, err := a.processHarvest(ctx, cmk, iter.Value(), ivl)
+	summary := HarvestSummary{Interval: ivl, End: end}
+	// done holds the keys which were processed, or can never be, and
+	// failed the combined metrics which failed to be processed and can be
+	// retried by the next harvest. doneKeys holds the decoded done keys,
+	// which stop being tracked as active once deleted.
+	var done [][]byte
+	var doneKeys []CombinedMetricsKey
+	var failed []harvestFailure
+	cardinality := newOverflowCardinalities()
+	harvest := func(key []byte, cmk CombinedMetricsKey, value []byte) {
+		cm, remaining, retry, err := a.processHarvest(ctx, cmk, value, ivl)
+		mu.Lock()
+		defer mu.Unlock()
 		if err != nil {
 			errs = append(errs, err)
-			continue
+			if retry {
+				failed = append(failed, harvestFailure{key: key, cmk: cmk, remaining: remaining})
+			} else {
+				done = append(done, key)
+				doneKeys = append(doneKeys, cmk)
+			}
+			return
+		}
+		done = append(done, key)
+		doneKeys = append(doneKeys, cmk)
+		summary.Harvested++
+		summary.Bytes += int64(len(value))
+		if a.harvestObserver != nil {
+			summary.addOverflowedEvents(cm)
 		}
-		cmCount++
-		attrs := append([]attribute.KeyValue{ivlAttr}, a.combinedMetricsIDToKVs(cmk.ID)...)
+		addOverflowCardinalities(cardinality, cm)
 		a.metrics.EventsProcessed.Add(
-			ctx, eventsProcessed,
+			ctx, cm.eventsTotal,
 			metric.WithAttributeSet(
-				attribute.NewSet(attrs...),
+				telemetry.AggregationIntervalAttrSet(ivl, a.combinedMetricsIDAttrs.kvs(cmk.ID)...),
 			),
 		)
 	}
-	err := a.db.DeleteRange(lb, ub, pebble.Sync)
+	// workers bounds the number of combined metrics processed
+	// concurrently, if configured. The key and value are copied as they
+	// are only valid until the next key is scanned.
+	var workers errgroup.Group
+	workers.SetLimit(a.harvestConcurrency)
+	scan := func(k, v []byte) error {
+		key := append([]byte(nil), k...)
+		var cmk CombinedMetricsKey
+		if err := cmk.UnmarshalBinary(key); err != nil {
+			mu.Lock()
+			errs = append(errs, fmt.Errorf("failed to unmarshal key: %w", err))
+			done = append(done, key)
+			mu.Unlock()
+			return nil
+		}
+		if a.harvestConcurrency <= 1 {
+			harvest(key, cmk, v)
+			return nil
+		}
+		value := append([]byte(nil), v...)
+		workers.Go(func() error {
+			harvest(key, cmk, value)
+			return nil
+		})
+		return nil
+	}
+	// unmerged is the number of keys skipped as their values can not be
+	// merged, for example, as one of them is corrupt.
+	var unmerged int64
+	var scanErr error
+	for scanFrom := lb; ; {
+		scanErr = snap.RangeScan(scanFrom, ub, scan)
+		var mergeErr *mergeKeyError
+		if !errors.As(scanErr, &mergeErr) || bytes.Compare(mergeErr.key, scanFrom) < 0 {
+			break
+		}
+		// The key would stop every harvest of the interval at the same
+		// key, it is dropped and the iteration resumes right after it.
+		mu.Lock()
+		errs = append(errs, fmt.Errorf("failed to merge harvested metrics: %w", scanErr))
+		done = append(done, mergeErr.key)
+		var cmk CombinedMetricsKey
+		if err := cmk.UnmarshalBinary(mergeErr.key); err == nil {
+			doneKeys = append(doneKeys, cmk)
+		}
+		mu.Unlock()
+		unmerged++
+		scanFrom = append(mergeErr.key[:len(mergeErr.key):len(mergeErr.key)], 0)
+	}
+	workers.Wait()
+	// retryFrom is the processing time of the first combined metrics to be
+	// retried by the next harvest, if any.
+	var retryFrom time.Time
+	if scanErr != nil {
+		// The iteration stops on other errors, thus, the combined metrics
+		// not yet iterated are kept and retried by the next harvest rather
+		// than deleted without being processed.
+		errs = append(errs, fmt.Errorf("failed to iterate harvested metrics: %w", scanErr))
+		retryFrom = start
+	}
+	for _, f := range failed {
+		if retryFrom.IsZero() || f.cmk.ProcessingTime.Before(retryFrom) {
+			retryFrom = f.cmk.ProcessingTime
+		}
+	}
+	next := harvestCheckpoint{processingTime: retryFrom}
+	var exhausted int64
+	if !retryFrom.IsZero() && retryFrom.Equal(checkpoint.processingTime) {
+		// The combined metrics at the checkpoint failed again.
+		next.retries = checkpoint.retries + 1
+	}
+	if !next.IsZero() && next.retries >= a.maxHarvestRetries {
+		// The combined metrics failing at the checkpoint exhausted their
+		// retries and are dropped. If the iteration failed, the combined
+		// metrics not yet iterated can not be told apart, thus, all of the
+		// combined metrics of the harvest are dropped.
+		var retained []harvestFailure
+		for _, f := range failed {
+			if scanErr == nil && f.cmk.ProcessingTime.After(retryFrom) {
+				retained = append(retained, f)
+				continue
+			}
+			done = append(done, f.key)
+			doneKeys = append(doneKeys, f.cmk)
+			exhausted++
+		}
+		failed = retained
+		next = harvestCheckpoint{}
+		for _, f := range failed {
+			if next.IsZero() || f.cmk.ProcessingTime.Before(next.processingTime) {
+				next.processingTime = f.cmk.ProcessingTime
+			}
+		}
+	}
+	ivlAttrs := metric.WithAttributeSet(telemetry.AggregationIntervalAttrSet(ivl))
+	if dropped := unmerged + exhausted; dropped > 0 {
+		a.metrics.HarvestDropped.Add(ctx, dropped, ivlAttrs)
+		a.logger.Warn(
+			"dropped combined metrics which can not be merged or exhausted their harvest retries",
+			zap.Int64("combined_metrics_unmerged", unmerged),
+			zap.Int64("combined_metrics_exhausted", exhausted),
+			zap.Duration("aggregation_interval_ns", ivl),
+		)
+	}
+	if len(errs) == 0 {
+		// Only count the harvests which successfully processed all
+		// the harvested combined metrics.
+		a.metrics.HarvestsTotal.Add(ctx, 1, ivlAttrs)
+	}
+	a.metrics.HarvestBytes.Add(ctx, summary.Bytes, ivlAttrs)
+	a.overflowCardinality.harvested(ivl, cardinality)
+
+	err := errors.Join(checkpointErr, a.deleteHarvested(ivl, lb, ub, done, failed, next))
+	if next.IsZero() {
+		a.active.harvested(ivl, end)
+	} else {
+		// The combined metrics to be retried are kept, and remain active.
+		a.active.remove(doneKeys)
+	}
 	if len(errs) > 0 {
+		summary.Failed = len(errs)
 		err = errors.Join(err, fmt.Errorf(
 			"failed to process %d out of %d metrics:\n%w",
-			len(errs), cmCount, errors.Join(errs...),
+			len(errs), len(errs)+summary.Harvested, errors.Join(errs...),
 		))
 	}
-	return cmCount, err
+	return summary, err
 }
 
+// harvestFailure is a harvested combined metrics which failed to be
+// processed and can be retried.
+type harvestFailure struct {
+	key []byte
+	cmk CombinedMetricsKey
+	// remaining, if set, is the encoded part of the combined metrics
+	// which failed to be processed, replacing the combined metrics to be
+	// retried as the rest of them was processed, see Aggregator.process.
+	remaining []byte
+}
+
+// processHarvest processes the harvested combined metrics and returns
+// them decoded. If the combined metrics fail to be processed, the returned
+// bool reports whether processing them can be retried and the returned
+// bytes, if any, are the encoded chunks of the combined metrics which
+// failed to be processed, if the other chunks were processed, see
+// Aggregator.process. processHarvest is safe for concurrent use.
 func (a *Aggregator) processHarvest(
 	ctx context.Context,
 	cmk CombinedMetricsKey,
 	cmb []byte,
 	aggIvl time.Duration,
-) (int64, error) {
+) (*CombinedMetrics, []byte, bool, error) {
 	var cm CombinedMetrics
 	if err := cm.UnmarshalBinary(cmb); err != nil {
-		return 0, fmt.Errorf("failed to unmarshal metrics: %w", err)
+		return nil, nil, false, fmt.Errorf("failed to unmarshal metrics: %w", err)
+	}
+	setPercentiles(&cm, a.percentiles)
+	processed, unprocessed, err := a.process(ctx, cmk, &cm, cmb, aggIvl)
+	if err != nil {
+		attrs := metric.WithAttributeSet(
+			telemetry.AggregationIntervalAttrSet(aggIvl, a.combinedMetricsIDAttrs.kvs(cmk.ID)...),
+		)
+		a.metrics.HarvestErrors.Add(ctx, 1, attrs)
+		err = fmt.Errorf("failed to process combined metrics ID %s: %w", cmk.ID, err)
+		if len(processed) == 0 {
+			return nil, nil, true, err
+		}
+		// Only the chunks which failed to be processed are retried, so
+		// that the processed chunks are not processed twice.
+		remaining := joinChunks(unprocessed)
+		remainingb, merr := remaining.MarshalBinary()
+		if merr != nil {
+			return nil, nil, true, errors.Join(err, fmt.Errorf("failed to marshal unprocessed chunks: %w", merr))
+		}
+		var eventsProcessed int64
+		for i := range processed {
+			eventsProcessed += processed[i].eventsTotal
+			a.recordOverflows(ctx, cmk, &processed[i])
+		}
+		a.metrics.EventsProcessed.Add(ctx, eventsProcessed, attrs)
+		return nil, remainingb, true, err
+	}
+	a.recordOverflows(ctx, cmk, &cm)
+	return &cm, nil, false, nil
+}
+
+// deleteHarvested deletes the harvested combined metrics of the aggregation
+// interval between the lower and upper bound keys. If the next harvest
+// checkpoint is zero, all the combined metrics were harvested, or
+// dropped, and are deleted along with the harvest checkpoint of the
+// aggregation interval. Otherwise, only the given done keys are deleted,
+// the failed combined metrics are replaced by their remaining part, if
+// any, and the harvest checkpoint is set to next, so that the next harvest
+// of the aggregation interval retries the failed combined metrics without
+// processing the done keys again.
+func (a *Aggregator) deleteHarvested(
+	ivl time.Duration,
+	lb, ub []byte,
+	done [][]byte,
+	failed []harvestFailure,
+	next harvestCheckpoint,
+) error {
+	batch := a.storeFor(ivl).kv.NewBatch()
+	defer batch.Close()
+	if next.IsZero() {
+		if err := batch.RangeDelete(lb, ub); err != nil {
+			return fmt.Errorf("failed to delete harvested metrics: %w", err)
+		}
+		if err := batch.Delete(harvestCheckpointKey(ivl)); err != nil {
+			return fmt.Errorf("failed to delete harvest checkpoint: %w", err)
+		}
+	} else {
+		for _, k := range done {
+			if err := batch.Delete(k); err != nil {
+				return fmt.Errorf("failed to delete harvested metrics: %w", err)
+			}
+		}
+		for _, f := range failed {
+			if f.remaining == nil {
+				continue
+			}
+			if err := batch.Set(f.key, f.remaining); err != nil {
+				return fmt.Errorf("failed to set unprocessed metrics: %w", err)
+			}
+		}
+		if err := batch.Set(harvestCheckpointKey(ivl), harvestCheckpointValue(next)); err != nil {
+			return fmt.Errorf("failed to set harvest checkpoint: %w", err)
+		}
+	}
+	return batch.Commit()
+}
+
+// process processes the harvested combined metrics using the configured
+// processor, cmb is the binary representation of the combined metrics.
+// The combined metrics exceeding the max processor payload size are split
+// into multiple chunks, each processed separately. If any of the chunks
+// fail to be processed, the chunks which were processed and the ones
+// which failed are returned along with the error.
+func (a *Aggregator) process(
+	ctx context.Context,
+	cmk CombinedMetricsKey,
+	cm *CombinedMetrics,
+	cmb []byte,
+	aggIvl time.Duration,
+) (processed, failed []CombinedMetrics, err error) {
+	if a.maxProcessorPayloadBytes <= 0 || len(cmb) <= a.maxProcessorPayloadBytes {
+		return nil, nil, a.processChunk(ctx, cmk, cm, cmb, aggIvl)
+	}
+	chunks := chunkCombinedMetrics(*cm, a.maxProcessorPayloadBytes)
+	var errs []error
+	for i := range chunks {
+		var chunkb []byte
+		if a.payloadProcessor != nil {
+			var err error
+			if chunkb, err = chunks[i].MarshalBinary(); err != nil {
+				errs = append(errs, fmt.Errorf("failed to marshal metrics: %w", err))
+				failed = append(failed, chunks[i])
+				continue
+			}
+		}
+		if err := a.processChunk(ctx, cmk, &chunks[i], chunkb, aggIvl); err != nil {
+			errs = append(errs, err)
+			failed = append(failed, chunks[i])
+			continue
+		}
+		processed = append(processed, chunks[i])
+	}
+	if len(errs) > 0 {
+		return processed, failed, fmt.Errorf(
+			"failed to process %d out of %d chunks: %w",
+			len(errs), len(chunks), errors.Join(errs...),
+		)
+	}
+	return nil, nil, nil
+}
+
+// processChunk processes the combined metrics, or a chunk of them, using
+// the configured processor.
+func (a *Aggregator) processChunk(
+	ctx context.Context,
+	cmk CombinedMetricsKey,
+	cm *CombinedMetrics,
+	cmb []byte,
+	aggIvl time.Duration,
+) error {
+	if a.payloadProcessor == nil {
+		// The processor owns the labels of the combined metrics.
+		cm.Labels = copyLabels(a.harvestLabels)
+		return a.processor(ctx, cmk, *cm, aggIvl)
+	}
+	payload, err := a.harvestCompression.Compress(cmb)
+	if err != nil {
+		return fmt.Errorf("failed to compress metrics: %w", err)
 	}
-	if err := a.processor(ctx, cmk, cm, aggIvl); err != nil {
-		return 0, fmt.Errorf(
-			"failed to process combined metrics ID %s: %w",
-			cmk.ID, err,
+	return a.payloadProcessor(ctx, cmk, payload, a.harvestCompression, aggIvl)
+}
+
+// copyLabels returns a copy of the labels, or nil if there are none.
+func copyLabels(labels map[string]string) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+	c := make(map[string]string, len(labels))
+	for k, v := range labels {
+		c[k] = v
+	}
+	return c
+}
+
+// recordOverflows records the number of events aggregated into the
+// overflow buckets of the harvested combined metrics. Overflows are
+// recorded on harvest as the limits are enforced when merging the
+// combined metrics, which pebble may do more than once for the same
+// data.
+func (a *Aggregator) recordOverflows(ctx context.Context, cmk CombinedMetricsKey, cm *CombinedMetrics) {
+	cmIDAttrs := a.combinedMetricsIDAttrs.kvs(cmk.ID)
+	for typ, count := range overflowEventCounts(cm) {
+		if count <= 0 {
+			continue
+		}
+		attrs := make([]attribute.KeyValue, 0, len(cmIDAttrs)+1)
+		attrs = append(attrs, cmIDAttrs...)
+		attrs = append(attrs, attribute.String(telemetry.OverflowTypeKey, typ))
+		a.metrics.EventsOverflowed.Add(
+			ctx, int64(math.Round(count)),
+			metric.WithAttributeSet(telemetry.AggregationIntervalAttrSet(cmk.Interval, attrs...)),
+		)
+	}
+	for typ, counts := range serviceOverflowEventCounts(cm) {
+		attrs := make([]attribute.KeyValue, 0, len(cmIDAttrs)+2)
+		attrs = append(attrs, cmIDAttrs...)
+		attrs = append(attrs,
+			telemetry.AggregationIntervalAttr(cmk.Interval),
+			attribute.String(telemetry.OverflowTypeKey, typ),
 		)
+		a.metrics.AddServiceOverflows(ctx, counts, attrs...)
+	}
+}
+
+// serviceOverflowEventCounts returns the representative count of the
+// events aggregated into the per service overflow buckets of the combined
+// metrics by the type of the overflowed aggregation group and service name.
+func serviceOverflowEventCounts(cm *CombinedMetrics) map[string]map[string]int64 {
+	counts := map[string]map[string]int64{
+		overflowTypeTransaction:        make(map[string]int64),
+		overflowTypeServiceTransaction: make(map[string]int64),
+		overflowTypeSpan:               make(map[string]int64),
+		overflowTypeSpanDestination:    make(map[string]int64),
+	}
+	for sk, sm := range cm.Services {
+		o := &sm.OverflowGroups
+		counts[overflowTypeTransaction][sk.ServiceName] += int64(math.Round(
+			o.OverflowTransaction.Metrics.Histogram.TotalCount(),
+		))
+		counts[overflowTypeServiceTransaction][sk.ServiceName] += int64(math.Round(
+			o.OverflowServiceTransaction.Metrics.Histogram.TotalCount(),
+		))
+		counts[overflowTypeSpan][sk.ServiceName] += int64(math.Round(o.OverflowSpan.Metrics.Count))
+		counts[overflowTypeSpanDestination][sk.ServiceName] += int64(math.Round(
+			o.OverflowSpanDestination.Metrics.Count,
+		))
+	}
+	return counts
+}
+
+// overflowEventCounts returns the representative count of the events
+// aggregated into the overflow buckets of the combined metrics by the
+// type of the breached limit. Events overflowed due to the max services
+// limit are counted as the service overflow type, other overflows are
+// counted by the type of the overflowed aggregation group.
+func overflowEventCounts(cm *CombinedMetrics) map[string]float64 {
+	counts := map[string]float64{
+		overflowTypeService: cm.OverflowServices.OverflowTransaction.Metrics.Histogram.TotalCount() +
+			cm.OverflowServices.OverflowSpan.Metrics.Count,
+	}
+	for _, sm := range cm.Services {
+		o := &sm.OverflowGroups
+		counts[overflowTypeTransaction] += o.OverflowTransaction.Metrics.Histogram.TotalCount()
+		counts[overflowTypeServiceTransaction] += o.OverflowServiceTransaction.Metrics.Histogram.TotalCount()
+		counts[overflowTypeSpan] += o.OverflowSpan.Metrics.Count
+		counts[overflowTypeSpanDestination] += o.OverflowSpanDestination.Metrics.Count
 	}
-	return cm.eventsTotal, nil
+	return counts
 }
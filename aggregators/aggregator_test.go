@@ -6,16 +6,24 @@ package aggregators
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
 	"math/rand"
 	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
 	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/sstable"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/stretchr/testify/assert"
@@ -26,14 +34,20 @@ import (
 	apmmodel "go.elastic.co/apm/v2/model"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/protobuf/testing/protocmp"
 	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
+	"github.com/elastic/apm-aggregation/aggregationpb"
+	"github.com/elastic/apm-aggregation/aggregators/internal/hdrhistogram"
+	"github.com/elastic/apm-aggregation/aggregators/internal/telemetry"
 	"github.com/elastic/apm-data/model/modelpb"
 )
 
@@ -46,7 +60,53 @@ func TestNew(t *testing.T) {
 		{
 			name:             "no_data_dir",
 			cfg:              AggregatorConfig{},
-			expectedErrorMsg: "data directory is required",
+			expectedErrorMsg: "data directory is required unless in memory",
+		},
+		{
+			name: "data_dir_per_interval_without_data_dir",
+			cfg: AggregatorConfig{
+				DataDirPerInterval:   map[time.Duration]string{time.Minute: "/tmp/minute"},
+				Processor:            noOpProcessor(),
+				AggregationIntervals: []time.Duration{time.Minute, time.Hour},
+			},
+			expectedErrorMsg: "data directory is required unless in memory",
+		},
+		{
+			name: "data_dir_per_unknown_interval",
+			cfg: AggregatorConfig{
+				DataDir:              "/tmp",
+				DataDirPerInterval:   map[time.Duration]string{time.Hour: "/tmp/hour"},
+				Processor:            noOpProcessor(),
+				AggregationIntervals: []time.Duration{time.Minute},
+			},
+			expectedErrorMsg: "data directory configured for unknown aggregation interval 1h0m0s",
+		},
+		{
+			name: "empty_data_dir_per_interval",
+			cfg: AggregatorConfig{
+				DataDir:              "/tmp",
+				DataDirPerInterval:   map[time.Duration]string{time.Minute: ""},
+				Processor:            noOpProcessor(),
+				AggregationIntervals: []time.Duration{time.Minute},
+			},
+			expectedErrorMsg: "aggregation interval 1m0s: data directory must not be empty",
+		},
+		{
+			name: "in_memory_without_data_dir",
+			cfg: AggregatorConfig{
+				InMemory:             true,
+				Processor:            noOpProcessor(),
+				AggregationIntervals: []time.Duration{time.Minute},
+			},
+			expectedErrorMsg: "",
+		},
+		{
+			name: "no_processor_in_memory",
+			cfg: AggregatorConfig{
+				InMemory:             true,
+				AggregationIntervals: []time.Duration{time.Minute},
+			},
+			expectedErrorMsg: "processor is required",
 		},
 		{
 			name: "no_processor",
@@ -55,6 +115,252 @@ func TestNew(t *testing.T) {
 			},
 			expectedErrorMsg: "processor is required",
 		},
+		{
+			name: "negative_max_processor_payload_bytes",
+			cfg: AggregatorConfig{
+				DataDir:                  t.TempDir(),
+				Processor:                noOpProcessor(),
+				AggregationIntervals:     []time.Duration{time.Minute},
+				MaxProcessorPayloadBytes: -1,
+			},
+			expectedErrorMsg: "max processor payload bytes must not be negative",
+		},
+		{
+			name: "negative_max_batch_size",
+			cfg: AggregatorConfig{
+				DataDir:              t.TempDir(),
+				Processor:            noOpProcessor(),
+				AggregationIntervals: []time.Duration{time.Minute},
+				MaxBatchSize:         -1,
+			},
+			expectedErrorMsg: "max batch size must not be negative",
+		},
+		{
+			name: "non_comparable_request_id_key",
+			cfg: AggregatorConfig{
+				DataDir:              t.TempDir(),
+				Processor:            noOpProcessor(),
+				AggregationIntervals: []time.Duration{time.Minute},
+				RequestIDKey:         []string{"request_id"},
+			},
+			expectedErrorMsg: "request ID key must be comparable",
+		},
+		{
+			name: "chunk_large_batches_without_max_batch_size",
+			cfg: AggregatorConfig{
+				DataDir:              t.TempDir(),
+				Processor:            noOpProcessor(),
+				AggregationIntervals: []time.Duration{time.Minute},
+				ChunkLargeBatches:    true,
+			},
+			expectedErrorMsg: "chunking large batches requires a max batch size",
+		},
+		{
+			name: "negative_harvest_concurrency",
+			cfg: AggregatorConfig{
+				DataDir:              t.TempDir(),
+				Processor:            noOpProcessor(),
+				AggregationIntervals: []time.Duration{time.Minute},
+				HarvestConcurrency:   -1,
+			},
+			expectedErrorMsg: "harvest concurrency must not be negative",
+		},
+		{
+			name: "negative_max_harvest_retries",
+			cfg: AggregatorConfig{
+				DataDir:              t.TempDir(),
+				Processor:            noOpProcessor(),
+				AggregationIntervals: []time.Duration{time.Minute},
+				MaxHarvestRetries:    -1,
+			},
+			expectedErrorMsg: "max harvest retries must not be negative",
+		},
+		{
+			name: "negative_max_concurrent_compactions",
+			cfg: AggregatorConfig{
+				DataDir:                  t.TempDir(),
+				Processor:                noOpProcessor(),
+				AggregationIntervals:     []time.Duration{time.Minute},
+				MaxConcurrentCompactions: -1,
+			},
+			expectedErrorMsg: "max concurrent compactions must not be negative",
+		},
+		{
+			name: "negative_l0_compaction_threshold",
+			cfg: AggregatorConfig{
+				DataDir:               t.TempDir(),
+				Processor:             noOpProcessor(),
+				AggregationIntervals:  []time.Duration{time.Minute},
+				L0CompactionThreshold: -1,
+			},
+			expectedErrorMsg: "L0 compaction threshold must not be negative",
+		},
+		{
+			name: "invalid_percentile",
+			cfg: AggregatorConfig{
+				DataDir:              t.TempDir(),
+				Processor:            noOpProcessor(),
+				AggregationIntervals: []time.Duration{time.Minute},
+				Percentiles:          []float64{50, 100.5},
+			},
+			expectedErrorMsg: "percentiles must be greater than 0 and at most 100, got 100.5",
+		},
+		{
+			name: "percentiles_with_payload_processor",
+			cfg: AggregatorConfig{
+				DataDir:              t.TempDir(),
+				PayloadProcessor:     noOpPayloadProcessor(),
+				AggregationIntervals: []time.Duration{time.Minute},
+				Percentiles:          []float64{50},
+			},
+			expectedErrorMsg: "percentiles are not supported with a payload processor",
+		},
+		{
+			name: "harvest_labels_with_payload_processor",
+			cfg: AggregatorConfig{
+				DataDir:              t.TempDir(),
+				PayloadProcessor:     noOpPayloadProcessor(),
+				AggregationIntervals: []time.Duration{time.Minute},
+				HarvestLabels:        map[string]string{"region": "eu-west-1"},
+			},
+			expectedErrorMsg: "harvest labels are not supported with a payload processor",
+		},
+		{
+			name: "negative_deduplication_window",
+			cfg: AggregatorConfig{
+				DataDir:              t.TempDir(),
+				Processor:            noOpProcessor(),
+				AggregationIntervals: []time.Duration{time.Minute},
+				DeduplicationWindow:  -time.Second,
+			},
+			expectedErrorMsg: "deduplication window must not be negative",
+		},
+		{
+			name: "negative_memtable_size",
+			cfg: AggregatorConfig{
+				DataDir:              t.TempDir(),
+				Processor:            noOpProcessor(),
+				AggregationIntervals: []time.Duration{time.Minute},
+				MemtableSize:         -1,
+			},
+			expectedErrorMsg: "memtable size must be non-negative and less than 4294967296 bytes",
+		},
+		{
+			name: "memtable_size_too_large",
+			cfg: AggregatorConfig{
+				DataDir:              t.TempDir(),
+				Processor:            noOpProcessor(),
+				AggregationIntervals: []time.Duration{time.Minute},
+				MemtableSize:         4 << 30,
+			},
+			expectedErrorMsg: "memtable size must be non-negative and less than 4294967296 bytes",
+		},
+		{
+			name: "negative_memtable_stop_writes_threshold",
+			cfg: AggregatorConfig{
+				DataDir:                     t.TempDir(),
+				Processor:                   noOpProcessor(),
+				AggregationIntervals:        []time.Duration{time.Minute},
+				MemtableStopWritesThreshold: -1,
+			},
+			expectedErrorMsg: "memtable stop writes threshold must not be negative",
+		},
+		{
+			name: "negative_limits",
+			cfg: AggregatorConfig{
+				DataDir:              t.TempDir(),
+				Processor:            noOpProcessor(),
+				AggregationIntervals: []time.Duration{time.Minute},
+				Limits:               Limits{MaxServices: -1},
+			},
+			expectedErrorMsg: "limits must not be negative",
+		},
+		{
+			name: "negative_limits_per_interval",
+			cfg: AggregatorConfig{
+				DataDir:              t.TempDir(),
+				Processor:            noOpProcessor(),
+				AggregationIntervals: []time.Duration{time.Minute},
+				LimitsPerInterval:    map[time.Duration]Limits{time.Minute: {MaxSpanGroups: -1}},
+			},
+			expectedErrorMsg: "aggregation interval 1m0s: limits must not be negative",
+		},
+		{
+			name: "invalid_overflow_estimator_precision",
+			cfg: AggregatorConfig{
+				DataDir:                    t.TempDir(),
+				Processor:                  noOpProcessor(),
+				AggregationIntervals:       []time.Duration{time.Minute},
+				OverflowEstimatorPrecision: 15,
+			},
+			expectedErrorMsg: "overflow estimator precision must be 14 or 16, got 15",
+		},
+		{
+			name: "invalid_histogram_significant_figures",
+			cfg: AggregatorConfig{
+				DataDir:                     t.TempDir(),
+				Processor:                   noOpProcessor(),
+				AggregationIntervals:        []time.Duration{time.Minute},
+				HistogramSignificantFigures: 6,
+			},
+			expectedErrorMsg: "histogram significant figures must be between 1 and 5",
+		},
+		{
+			name: "stale_key_ttl_less_than_aggregation_interval",
+			cfg: AggregatorConfig{
+				DataDir:              t.TempDir(),
+				Processor:            noOpProcessor(),
+				AggregationIntervals: []time.Duration{time.Second, time.Minute},
+				StaleKeyTTL:          30 * time.Second,
+			},
+			expectedErrorMsg: "stale key TTL must not be less than the largest aggregation interval 1m0s",
+		},
+		{
+			name: "processor_and_payload_processor",
+			cfg: AggregatorConfig{
+				DataDir:          t.TempDir(),
+				Processor:        noOpProcessor(),
+				PayloadProcessor: noOpPayloadProcessor(),
+			},
+			expectedErrorMsg: "only one of processor and payload processor can be configured",
+		},
+		{
+			name: "harvest_compression_without_payload_processor",
+			cfg: AggregatorConfig{
+				DataDir:            t.TempDir(),
+				Processor:          noOpProcessor(),
+				HarvestCompression: CodecGzip,
+			},
+			expectedErrorMsg: "harvest compression requires a payload processor",
+		},
+		{
+			name: "unsupported_harvest_compression",
+			cfg: AggregatorConfig{
+				DataDir:            t.TempDir(),
+				PayloadProcessor:   noOpPayloadProcessor(),
+				HarvestCompression: Codec(100),
+			},
+			expectedErrorMsg: "unsupported harvest compression codec unknown(100)",
+		},
+		{
+			name: "unsupported_sstable_compression",
+			cfg: AggregatorConfig{
+				DataDir:            t.TempDir(),
+				Processor:          noOpProcessor(),
+				SSTableCompression: SSTableCompression(100),
+			},
+			expectedErrorMsg: "unsupported sstable compression unknown(100)",
+		},
+		{
+			name: "negative_merge_batch_max_bytes",
+			cfg: AggregatorConfig{
+				DataDir:              t.TempDir(),
+				Processor:            noOpProcessor(),
+				AggregationIntervals: []time.Duration{time.Minute},
+				MergeBatchMaxBytes:   -1,
+			},
+			expectedErrorMsg: "merge batch max bytes must not be negative",
+		},
 		{
 			name: "no_aggregation_interval",
 			cfg: AggregatorConfig{
@@ -79,7 +385,25 @@ func TestNew(t *testing.T) {
 				Processor:            noOpProcessor(),
 				AggregationIntervals: []time.Duration{10 * time.Second, 15 * time.Second},
 			},
-			expectedErrorMsg: "aggregation intervals must be a factor of lowest interval",
+			expectedErrorMsg: "aggregation interval 15s must be a multiple of the lowest interval 10s",
+		},
+		{
+			name: "invalid_aggregation_intervals_2",
+			cfg: AggregatorConfig{
+				DataDir:              t.TempDir(),
+				Processor:            noOpProcessor(),
+				AggregationIntervals: []time.Duration{time.Minute, 10 * time.Minute, 20*time.Minute + 30*time.Second},
+			},
+			expectedErrorMsg: "aggregation interval 20m30s must be a multiple of the lowest interval 1m0s",
+		},
+		{
+			name: "duplicate_aggregation_intervals",
+			cfg: AggregatorConfig{
+				DataDir:              t.TempDir(),
+				Processor:            noOpProcessor(),
+				AggregationIntervals: []time.Duration{time.Minute, 10 * time.Minute, 10 * time.Minute},
+			},
+			expectedErrorMsg: "duplicate aggregation interval 10m0s",
 		},
 		{
 			name: "out_of_range_aggregation_interval_1",
@@ -99,6 +423,36 @@ func TestNew(t *testing.T) {
 			},
 			expectedErrorMsg: "aggregation interval greater than 18 hours is not supported",
 		},
+		{
+			name: "limits_for_unknown_interval",
+			cfg: AggregatorConfig{
+				DataDir:              t.TempDir(),
+				Processor:            noOpProcessor(),
+				AggregationIntervals: []time.Duration{time.Minute, time.Hour},
+				LimitsPerInterval:    map[time.Duration]Limits{10 * time.Minute: {}},
+			},
+			expectedErrorMsg: "limits configured for unknown aggregation interval 10m0s",
+		},
+		{
+			name: "negative_pebble_cache_size",
+			cfg: AggregatorConfig{
+				DataDir:              t.TempDir(),
+				Processor:            noOpProcessor(),
+				AggregationIntervals: []time.Duration{time.Minute},
+				PebbleCacheSize:      -1,
+			},
+			expectedErrorMsg: "pebble cache size must not be negative",
+		},
+		{
+			name: "invalid_harvest_jitter",
+			cfg: AggregatorConfig{
+				DataDir:              t.TempDir(),
+				Processor:            noOpProcessor(),
+				AggregationIntervals: []time.Duration{time.Minute, time.Hour},
+				HarvestJitter:        time.Minute,
+			},
+			expectedErrorMsg: "harvest jitter must be non-negative and less than the lowest aggregation interval 1m0s",
+		},
 		{
 			name: "no_error",
 			cfg: AggregatorConfig{
@@ -114,14 +468,21 @@ func TestNew(t *testing.T) {
 			if tc.expectedErrorMsg != "" {
 				assert.EqualError(t, err, tc.expectedErrorMsg)
 			} else {
-				assert.NoError(t, err)
-				assert.NotNil(t, agg)
+				require.NoError(t, err)
+				require.NotNil(t, agg)
+				// The aggregator must be usable with a nil logger.
+				assert.NoError(t, agg.Flush(context.Background()))
+				assert.NoError(t, agg.Stop(context.Background()))
 			}
 		})
 	}
 }
 
 func TestAggregateBatch(t *testing.T) {
+	forEachStore(t, testAggregateBatch)
+}
+
+func testAggregateBatch(t *testing.T, newStore newStoreFunc) {
 	exp := tracetest.NewInMemoryExporter()
 	tp := sdktrace.NewTracerProvider(
 		sdktrace.WithSyncer(exp),
@@ -179,7 +540,8 @@ func TestAggregateBatch(t *testing.T) {
 	out := make(chan CombinedMetrics, 1)
 	aggIvl := time.Minute
 	agg, err := New(AggregatorConfig{
-		DataDir: t.TempDir(),
+		NewStore: newStore,
+		DataDir:  t.TempDir(),
 		Limits: Limits{
 			MaxSpanGroups:                         1000,
 			MaxSpanGroupsPerService:               100,
@@ -228,23 +590,43 @@ func TestAggregateBatch(t *testing.T) {
 	expectedMeasurements := []apmmodel.Metrics{
 		{
 			Samples: map[string]apmmodel.Metric{
-				"aggregator.requests.total": {Value: 1},
-				"aggregator.bytes.ingested": {Value: 134750},
+				"aggregator.bytes.ingested": {Value: 99300},
+			},
+			Labels: apmmodel.StringMap{
+				apmmodel.StringMapItem{Key: telemetry.EventTypeKey, Value: "transaction"},
+				apmmodel.StringMapItem{Key: "id_key", Value: cmID},
+			},
+		},
+		{
+			Samples: map[string]apmmodel.Metric{
+				"aggregator.bytes.ingested": {Value: 35450},
 			},
 			Labels: apmmodel.StringMap{
+				apmmodel.StringMapItem{Key: telemetry.EventTypeKey, Value: "span"},
 				apmmodel.StringMapItem{Key: "id_key", Value: cmID},
 			},
 		},
 		{
 			Samples: map[string]apmmodel.Metric{
+				"aggregator.requests.total":   {Value: 1},
 				"aggregator.events.total":     {Value: float64(len(batch))},
+				"aggregator.events.weighted":  {Value: float64(len(batch))},
 				"aggregator.events.processed": {Value: float64(len(batch))},
 			},
 			Labels: apmmodel.StringMap{
-				apmmodel.StringMapItem{Key: aggregationIvlKey, Value: formatDuration(aggIvl)},
+				apmmodel.StringMapItem{Key: telemetry.AggregationIntervalKey, Value: formatDuration(aggIvl)},
 				apmmodel.StringMapItem{Key: "id_key", Value: cmID},
 			},
 		},
+		{
+			Samples: map[string]apmmodel.Metric{
+				"aggregator.harvests.total": {Value: 1},
+				"aggregator.harvest.bytes":  {Value: 19281},
+			},
+			Labels: apmmodel.StringMap{
+				apmmodel.StringMapItem{Key: telemetry.AggregationIntervalKey, Value: formatDuration(aggIvl)},
+			},
+		},
 	}
 	sik := ServiceInstanceAggregationKey{GlobalLabelsStr: ""}
 	for i := 0; i < uniqueEventCount*repCount; i++ {
@@ -306,799 +688,4217 @@ func TestAggregateBatch(t *testing.T) {
 		cmp.AllowUnexported(CombinedMetrics{}),
 	))
 	assert.Empty(t, cmp.Diff(
-		expectedMeasurements, gatherMetrics(gatherer, "pebble."),
+		expectedMeasurements, gatherMetrics(
+			gatherer,
+			"pebble.",
+			// Request durations are not deterministic
+			"aggregator.requests.duration",
+			// Harvest lags are covered by TestHarvestLag
+			"aggregator.harvest.lag",
+		),
 		cmpopts.IgnoreUnexported(apmmodel.Time{}),
+		sortMetricsByLabels(),
 	))
 }
 
-func TestAggregateSpanMetrics(t *testing.T) {
-	type input struct {
-		serviceName         string
-		agentName           string
-		destination         string
-		targetType          string
-		targetName          string
-		outcome             string
-		representativeCount float64
+func TestAggregateBatchWithResult(t *testing.T) {
+	forEachStore(t, testAggregateBatchWithResult)
+}
+
+func testAggregateBatchWithResult(t *testing.T, newStore newStoreFunc) {
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore:             newStore,
+		AggregationIntervals: []time.Duration{time.Second, time.Minute},
+	})
+
+	batch := modelpb.Batch{
+		makeSpan(time.Now(), "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+		makeSpan(time.Now(), "svc2", "java", "dest2", "", "", "failure", time.Second, 1, nil, nil),
 	}
+	result, err := agg.AggregateBatchWithResult(context.Background(), "testid", &batch)
+	require.NoError(t, err)
+	assert.Equal(t, AggregateBatchResult{
+		Statuses: []EventStatus{EventAccepted, EventAccepted},
+		Errors:   []error{nil, nil},
+	}, result)
+	assert.Equal(t, 0, result.Rejected())
 
-	destinationX := "destination-X"
-	destinationZ := "destination-Z"
-	trgTypeX := "trg-type-X"
-	trgNameX := "trg-name-X"
-	trgTypeZ := "trg-type-Z"
-	trgNameZ := "trg-name-Z"
-	defaultLabels := modelpb.Labels{
-		"department_name": &modelpb.LabelValue{Global: true, Value: "apm"},
-		"organization":    &modelpb.LabelValue{Global: true, Value: "observability"},
-		"company":         &modelpb.LabelValue{Global: true, Value: "elastic"},
+	require.NoError(t, agg.Stop(context.Background()))
+	result, err = agg.AggregateBatchWithResult(context.Background(), "testid", &batch)
+	assert.ErrorIs(t, err, ErrAggregatorStopped)
+	assert.Equal(t, AggregateBatchResult{}, result)
+}
+
+func TestAggregateBatchWithResultOverflowed(t *testing.T) {
+	forEachStore(t, testAggregateBatchWithResultOverflowed)
+}
+
+func testAggregateBatchWithResultOverflowed(t *testing.T, newStore newStoreFunc) {
+	for _, mergeBatchWindow := range []time.Duration{0, time.Hour} {
+		t.Run(fmt.Sprintf("merge_batch_window=%s", mergeBatchWindow), func(t *testing.T) {
+			limits := testLimits()
+			limits.MaxServices = 1
+			agg := newTestAggregator(t, AggregatorConfig{
+				NewStore:             newStore,
+				Limits:               limits,
+				AggregationIntervals: []time.Duration{time.Second, time.Minute},
+				MergeBatchWindow:     mergeBatchWindow,
+			})
+
+			now := time.Now()
+			batch := modelpb.Batch{
+				makeSpan(now, "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+				makeSpan(now, "svc2", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+				makeSpan(now, "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+			}
+			result, err := agg.AggregateBatchWithResult(context.Background(), "testid", &batch)
+			require.NoError(t, err)
+			assert.Equal(t, []EventStatus{EventAccepted, EventOverflowed, EventAccepted}, result.Statuses)
+			assert.Equal(t, 0, result.Rejected())
+
+			// The aggregations of previous batches are considered.
+			batch = modelpb.Batch{
+				makeSpan(now, "svc3", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+				makeSpan(now, "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+			}
+			result, err = agg.AggregateBatchWithResult(context.Background(), "testid", &batch)
+			require.NoError(t, err)
+			assert.Equal(t, []EventStatus{EventOverflowed, EventAccepted}, result.Statuses)
+
+			// The overflowed events are aggregated.
+			snap, err := agg.Snapshot(context.Background(), time.Minute)
+			require.NoError(t, err)
+			require.Len(t, snap, 1)
+			var cm CombinedMetrics
+			cm.FromProto(snap[0])
+			assert.Positive(t, overflowEventCounts(&cm)[overflowTypeService])
+		})
 	}
-	defaultNumericLabels := modelpb.NumericLabels{
-		"user_id":     &modelpb.NumericLabelValue{Global: true, Value: 100},
-		"cost_center": &modelpb.NumericLabelValue{Global: true, Value: 10},
+}
+
+func TestAggregateBatchResultRejected(t *testing.T) {
+	result := AggregateBatchResult{
+		Statuses: []EventStatus{EventRejected, EventAccepted, EventRejected},
+		Errors:   []error{errors.New("1"), nil, errors.New("2")},
 	}
+	assert.Equal(t, 2, result.Rejected())
+}
 
-	for _, tt := range []struct {
-		name              string
-		inputs            []input
-		getExpectedEvents func(time.Time, time.Duration, time.Duration, int) []*modelpb.APMEvent
-	}{
-		{
-			name: "with destination and service targets",
-			inputs: []input{
-				{serviceName: "service-A", agentName: "java", destination: destinationZ, targetType: trgTypeZ, targetName: trgNameZ, outcome: "success", representativeCount: 2},
-				{serviceName: "service-A", agentName: "java", destination: destinationX, targetType: trgTypeX, targetName: trgNameX, outcome: "success", representativeCount: 1},
+func TestMaxBatchSize(t *testing.T) {
+	forEachStore(t, testMaxBatchSize)
+}
+
+func testMaxBatchSize(t *testing.T, newStore newStoreFunc) {
+	newAggregator := func(chunk bool) *Aggregator {
+		return newTestAggregator(t, AggregatorConfig{
+			NewStore:             newStore,
+			AggregationIntervals: []time.Duration{time.Minute},
+			MaxBatchSize:         2,
+			ChunkLargeBatches:    chunk,
+		})
+	}
+	newBatch := func(n int) modelpb.Batch {
+		batch := make(modelpb.Batch, n)
+		for i := range batch {
+			batch[i] = makeSpan(time.Now(), fmt.Sprintf("svc%d", i), "java", "dest", "", "", "success", time.Second, 1, nil, nil)
+		}
+		return batch
+	}
+	services := func(agg *Aggregator) int {
+		snapshot, err := agg.Snapshot(context.Background(), time.Minute)
+		require.NoError(t, err)
+		var n int
+		for _, cm := range snapshot {
+			n += len(cm.ServiceMetrics)
+		}
+		return n
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		agg := newAggregator(false)
+		batch := newBatch(2)
+		require.NoError(t, agg.AggregateBatch(context.Background(), "testid", &batch))
+		batch = newBatch(3)
+		err := agg.AggregateBatch(context.Background(), "testid", &batch)
+		assert.ErrorIs(t, err, ErrBatchTooLarge)
+		assert.EqualError(t, err, "batch exceeds the maximum batch size: batch has 3 events, the maximum is 2")
+		_, err = agg.AggregateBatchWithResult(context.Background(), "testid", &batch)
+		assert.ErrorIs(t, err, ErrBatchTooLarge)
+		// None of the events of the rejected batches are aggregated.
+		assert.Equal(t, 2, services(agg))
+	})
+	t.Run("chunk", func(t *testing.T) {
+		agg := newAggregator(true)
+		batch := newBatch(5)
+		batch[3] = nil
+		result, err := agg.AggregateBatchWithResult(context.Background(), "testid", &batch)
+		require.NoError(t, err)
+		// The results of the events are indexed by their position in the
+		// whole batch.
+		assert.Equal(t, []EventStatus{EventAccepted, EventAccepted, EventAccepted, EventRejected, EventAccepted}, result.Statuses)
+		require.Error(t, result.Errors[3])
+		assert.Equal(t, 4, services(agg))
+	})
+}
+
+func TestRequestDuration(t *testing.T) {
+	rdr := metric.NewManualReader()
+	agg := newTestAggregator(t, AggregatorConfig{
+		AggregationIntervals: []time.Duration{time.Second, time.Minute},
+		MaxBatchSize:         1,
+		ChunkLargeBatches:    true,
+		MeterProvider:        metric.NewMeterProvider(metric.WithReader(rdr)),
+		CombinedMetricsIDToKVs: func(id string) []attribute.KeyValue {
+			return []attribute.KeyValue{attribute.String("id_key", id)}
+		},
+	})
+
+	// The duration of a request is recorded once, regardless of the
+	// aggregation intervals and chunks of the batch.
+	batch := modelpb.Batch{
+		makeSpan(time.Now(), "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+		makeSpan(time.Now(), "svc2", "java", "dest2", "", "", "success", time.Second, 1, nil, nil),
+	}
+	require.NoError(t, agg.AggregateBatch(context.Background(), "testid", &batch))
+	cm := CombinedMetrics{Services: map[ServiceAggregationKey]ServiceMetrics{}}
+	require.NoError(t, agg.AggregateCombinedMetrics(context.Background(), CombinedMetricsKey{
+		Interval:       time.Minute,
+		ProcessingTime: time.Now().Truncate(time.Minute),
+		ID:             "testid",
+	}, cm))
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, rdr.Collect(context.Background(), &rm))
+	var dps []metricdata.HistogramDataPoint[float64]
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name == "aggregator.requests.duration" {
+				dps = m.Data.(metricdata.Histogram[float64]).DataPoints
+			}
+		}
+	}
+	require.Len(t, dps, 1)
+	assert.Equal(t, attribute.NewSet(attribute.String("id_key", "testid")), dps[0].Attributes)
+	assert.Equal(t, uint64(2), dps[0].Count)
+}
+
+func TestSnapshot(t *testing.T) {
+	forEachStore(t, testSnapshot)
+}
+
+func testSnapshot(t *testing.T, newStore newStoreFunc) {
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	var harvested []CombinedMetrics
+	agg, err := New(testConfig(t, AggregatorConfig{
+		NewStore: newStore,
+		Processor: func(_ context.Context, _ CombinedMetricsKey, cm CombinedMetrics, _ time.Duration) error {
+			harvested = append(harvested, cm)
+			return nil
+		},
+		AggregationIntervals: []time.Duration{time.Second, time.Minute},
+	}), logger)
+	require.NoError(t, err)
+
+	batch := modelpb.Batch{
+		makeSpan(time.Now(), "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+		makeSpan(time.Now(), "svc2", "java", "dest2", "", "", "success", time.Second, 1, nil, nil),
+	}
+	require.NoError(t, agg.AggregateBatch(context.Background(), "id1", &batch))
+	single := batch[:1]
+	require.NoError(t, agg.AggregateBatch(context.Background(), "id2", &single))
+	require.NoError(t, agg.AggregateBatch(context.Background(), "id2", &batch))
+
+	for _, ivl := range []time.Duration{time.Second, time.Minute} {
+		snapshot, err := agg.Snapshot(context.Background(), ivl)
+		require.NoError(t, err)
+		require.Len(t, snapshot, 2)
+		assert.Equal(t, int64(2), snapshot[0].EventsTotal)
+		assert.Len(t, snapshot[0].ServiceMetrics, 2)
+		assert.Equal(t, int64(3), snapshot[1].EventsTotal)
+		assert.Len(t, snapshot[1].ServiceMetrics, 2)
+	}
+	snapshot, err := agg.Snapshot(context.Background(), time.Hour)
+	require.NoError(t, err)
+	assert.Empty(t, snapshot)
+
+	// Snapshot must not harvest or reset the aggregated metrics.
+	assert.Empty(t, harvested)
+	require.NoError(t, agg.Stop(context.Background()))
+	assert.Len(t, harvested, 4)
+
+	_, err = agg.Snapshot(context.Background(), time.Second)
+	assert.ErrorIs(t, err, ErrAggregatorStopped)
+}
+
+func TestInMemory(t *testing.T) {
+	limits := testLimits()
+	limits.MaxServices = 1
+	agg := newTestAggregator(t, AggregatorConfig{
+		InMemory:             true,
+		Limits:               limits,
+		AggregationIntervals: []time.Duration{time.Second},
+	})
+
+	batch := modelpb.Batch{
+		makeSpan(time.Now(), "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+		makeSpan(time.Now(), "svc2", "java", "dest2", "", "", "success", time.Second, 1, nil, nil),
+	}
+	require.NoError(t, agg.AggregateBatch(context.Background(), "id", &batch))
+
+	snapshot, err := agg.Snapshot(context.Background(), time.Second)
+	require.NoError(t, err)
+	require.Len(t, snapshot, 1)
+	assert.Equal(t, int64(2), snapshot[0].EventsTotal)
+	assert.Len(t, snapshot[0].ServiceMetrics, 1)
+	require.NotNil(t, snapshot[0].OverflowServices)
+	assert.NotNil(t, snapshot[0].OverflowServices.OverflowSpans)
+}
+
+func TestDisableWAL(t *testing.T) {
+	for _, disableWAL := range []bool{false, true} {
+		t.Run(fmt.Sprintf("disable_wal=%t", disableWAL), func(t *testing.T) {
+			agg := newTestAggregator(t, AggregatorConfig{
+				AggregationIntervals: []time.Duration{time.Second},
+				DisableWAL:           disableWAL,
+			})
+
+			batch := modelpb.Batch{
+				makeSpan(time.Now(), "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+			}
+			require.NoError(t, agg.AggregateBatch(context.Background(), "testid", &batch))
+			snapshot, err := agg.Snapshot(context.Background(), time.Second)
+			require.NoError(t, err)
+			require.Len(t, snapshot, 1)
+			assert.Equal(t, int64(1), snapshot[0].EventsTotal)
+		})
+	}
+}
+
+func TestStrictChecksums(t *testing.T) {
+	cfg := testConfig(t, AggregatorConfig{
+		AggregationIntervals: []time.Duration{time.Second},
+		StrictChecksums:      true,
+	})
+	agg, err := New(cfg, zap.NewNop())
+	require.NoError(t, err)
+	batch := modelpb.Batch{
+		makeSpan(time.Now(), "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+	}
+	require.NoError(t, agg.AggregateBatch(context.Background(), "testid", &batch))
+	// Snapshot commits the pending batch, which is then flushed to an
+	// sstable. The database is closed without harvesting, leaving the
+	// metrics in the sstable.
+	_, err = agg.Snapshot(context.Background(), time.Second)
+	require.NoError(t, err)
+	require.NoError(t, agg.stores[0].db.Flush())
+	require.NoError(t, agg.stores[0].db.Close())
+
+	// Uncorrupted databases are opened with strict checksums.
+	agg, err = New(cfg, zap.NewNop())
+	require.NoError(t, err)
+	require.NoError(t, agg.stores[0].db.Close())
+
+	ssts, err := filepath.Glob(filepath.Join(cfg.DataDir, "*.sst"))
+	require.NoError(t, err)
+	require.Len(t, ssts, 1)
+	data, err := os.ReadFile(ssts[0])
+	require.NoError(t, err)
+	// Corrupt the first data block of the sstable.
+	for i := 0; i < 8; i++ {
+		data[i] ^= 0xff
+	}
+	require.NoError(t, os.WriteFile(ssts[0], data, 0644))
+
+	_, err = New(cfg, zap.NewNop())
+	assert.ErrorIs(t, err, pebble.ErrCorruption)
+	assert.ErrorContains(t, err, "failed to verify pebble db")
+
+	// Without strict checksums the corruption goes undetected on open.
+	cfg.StrictChecksums = false
+	agg, err = New(cfg, zap.NewNop())
+	require.NoError(t, err)
+	require.NoError(t, agg.stores[0].db.Close())
+}
+
+func TestLimitsPerInterval(t *testing.T) {
+	forEachStore(t, testLimitsPerInterval)
+}
+
+func testLimitsPerInterval(t *testing.T, newStore newStoreFunc) {
+	limits := func(maxServices int) Limits {
+		limits := testLimits()
+		limits.MaxServices = maxServices
+		return limits
+	}
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore:             newStore,
+		Limits:               limits(1),
+		LimitsPerInterval:    map[time.Duration]Limits{time.Minute: limits(2)},
+		AggregationIntervals: []time.Duration{time.Second, time.Minute, time.Hour},
+	})
+
+	for _, svc := range []string{"svc1", "svc2", "svc3"} {
+		require.NoError(t, agg.AggregateBatch(context.Background(), "testid", &modelpb.Batch{
+			makeSpan(time.Now(), svc, "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+		}))
+	}
+
+	for _, tc := range []struct {
+		ivl              time.Duration
+		expectedServices int
+	}{
+		{ivl: time.Second, expectedServices: 1},
+		{ivl: time.Minute, expectedServices: 2},
+		{ivl: time.Hour, expectedServices: 1},
+	} {
+		t.Run(tc.ivl.String(), func(t *testing.T) {
+			snapshot, err := agg.Snapshot(context.Background(), tc.ivl)
+			require.NoError(t, err)
+			require.Len(t, snapshot, 1)
+			assert.Len(t, snapshot[0].ServiceMetrics, tc.expectedServices)
+		})
+	}
+}
+
+func TestLimits(t *testing.T) {
+	forEachStore(t, testLimitsAccessors)
+}
+
+func testLimitsAccessors(t *testing.T, newStore newStoreFunc) {
+	limits := testLimits()
+	minuteLimits := limits
+	minuteLimits.MaxServices = 20
+	newAggregator := func(t *testing.T, limitsPerInterval map[time.Duration]Limits) *Aggregator {
+		return newTestAggregator(t, AggregatorConfig{
+			NewStore:             newStore,
+			Limits:               limits,
+			LimitsPerInterval:    limitsPerInterval,
+			AggregationIntervals: []time.Duration{time.Second, time.Minute},
+		})
+	}
+
+	t.Run("limits", func(t *testing.T) {
+		agg := newAggregator(t, nil)
+		assert.Equal(t, limits, agg.Limits())
+		assert.Nil(t, agg.LimitsPerInterval())
+	})
+	t.Run("limits_per_interval", func(t *testing.T) {
+		agg := newAggregator(t, map[time.Duration]Limits{time.Minute: minuteLimits})
+		assert.Equal(t, limits, agg.Limits())
+		limitsPerInterval := agg.LimitsPerInterval()
+		assert.Equal(t, map[time.Duration]Limits{time.Minute: minuteLimits}, limitsPerInterval)
+
+		// The returned limits are a copy.
+		limitsPerInterval[time.Second] = minuteLimits
+		assert.Equal(t, map[time.Duration]Limits{time.Minute: minuteLimits}, agg.LimitsPerInterval())
+	})
+}
+
+func TestSetLimits(t *testing.T) {
+	forEachStore(t, testSetLimits)
+}
+
+func testSetLimits(t *testing.T, newStore newStoreFunc) {
+	limits := testLimits()
+	limits.MaxServices = 1
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore:             newStore,
+		Limits:               limits,
+		AggregationIntervals: []time.Duration{time.Minute},
+	})
+
+	aggregate := func(svcs ...string) {
+		for _, svc := range svcs {
+			require.NoError(t, agg.AggregateBatch(context.Background(), "testid", &modelpb.Batch{
+				makeSpan(time.Now(), svc, "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+			}))
+		}
+	}
+	snapshot := func() *aggregationpb.CombinedMetrics {
+		snapshot, err := agg.Snapshot(context.Background(), time.Minute)
+		require.NoError(t, err)
+		require.Len(t, snapshot, 1)
+		return snapshot[0]
+	}
+
+	aggregate("svc1", "svc2")
+	cm := snapshot()
+	assert.Len(t, cm.ServiceMetrics, 1)
+	assert.NotNil(t, cm.OverflowServices)
+	// Flushing the database merges the aggregations with the current
+	// limits, leaving svc2 in the overflow buckets. Custom stores merge
+	// the aggregations when written.
+	if db := agg.stores[0].db; db != nil {
+		require.NoError(t, db.Flush())
+	}
+
+	assert.EqualError(t, agg.SetLimits(Limits{MaxServices: -1}), "limits must not be negative")
+	assert.Equal(t, limits, agg.Limits())
+	limits.MaxServices = 3
+	require.NoError(t, agg.SetLimits(limits))
+	assert.Equal(t, limits, agg.Limits())
+
+	aggregate("svc3", "svc4", "svc5")
+	cm = snapshot()
+	assert.Len(t, cm.ServiceMetrics, 3)
+	assert.NotNil(t, cm.OverflowServices)
+	assert.Equal(t, int64(5), cm.EventsTotal)
+}
+
+func TestWriteStalled(t *testing.T) {
+	newAggregator := func(t *testing.T, cfg AggregatorConfig) *Aggregator {
+		cfg.AggregationIntervals = []time.Duration{time.Second}
+		return newTestAggregator(t, cfg)
+	}
+	batch := modelpb.Batch{
+		makeSpan(time.Now(), "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+	}
+	aggregate := func(agg *Aggregator) error {
+		return agg.AggregateBatch(context.Background(), "testid", &batch)
+	}
+
+	t.Run("write_stall", func(t *testing.T) {
+		agg := newAggregator(t, AggregatorConfig{WriteStallThreshold: time.Millisecond})
+		listener := agg.stores[0].writeStalls.EventListener()
+		assert.NoError(t, aggregate(agg))
+
+		listener.WriteStallBegin(pebble.WriteStallBeginInfo{})
+		time.Sleep(5 * time.Millisecond)
+		err := aggregate(agg)
+		assert.ErrorIs(t, err, ErrWriteStalled)
+		assert.ErrorIs(t, err, ErrRetryable)
+		assert.ErrorIs(t, agg.AggregateCombinedMetrics(
+			context.Background(),
+			CombinedMetricsKey{Interval: time.Second, ProcessingTime: time.Now(), ID: "testid"},
+			CombinedMetrics(*createTestCombinedMetrics(1)),
+		), ErrWriteStalled)
+		assert.ErrorIs(t, agg.AggregateCombinedMetricsBatch(context.Background(), []KeyedCombinedMetrics{{
+			Key:     CombinedMetricsKey{Interval: time.Second, ProcessingTime: time.Now(), ID: "testid"},
+			Metrics: CombinedMetrics(*createTestCombinedMetrics(1)),
+		}}), ErrWriteStalled)
+
+		listener.WriteStallEnd()
+		assert.NoError(t, aggregate(agg))
+	})
+	t.Run("write_stall_disabled", func(t *testing.T) {
+		agg := newAggregator(t, AggregatorConfig{})
+		agg.stores[0].writeStalls.EventListener().WriteStallBegin(pebble.WriteStallBeginInfo{})
+		time.Sleep(5 * time.Millisecond)
+		assert.NoError(t, aggregate(agg))
+	})
+	t.Run("memtable_size", func(t *testing.T) {
+		clk := newFakeClock(time.Now())
+		agg := newAggregator(t, AggregatorConfig{MemtableSizeThreshold: 1024, clock: clk})
+		var memtableSize atomic.Uint64
+		var sampled atomic.Int64
+		agg.stores[0].metrics = func() *pebble.Metrics {
+			sampled.Add(1)
+			var pm pebble.Metrics
+			pm.MemTable.Size = memtableSize.Load()
+			return &pm
+		}
+		memtableSize.Store(1024)
+		assert.NoError(t, aggregate(agg))
+		// The memtable size is sampled at most once per sample interval.
+		memtableSize.Store(1025)
+		assert.NoError(t, aggregate(agg))
+		assert.Equal(t, int64(1), sampled.Load())
+		clk.Advance(storeUsageSampleInterval)
+		assert.ErrorIs(t, aggregate(agg), ErrWriteStalled)
+		assert.Equal(t, int64(2), sampled.Load())
+		memtableSize.Store(0)
+		clk.Advance(storeUsageSampleInterval)
+		assert.NoError(t, aggregate(agg))
+	})
+	t.Run("disk_usage", func(t *testing.T) {
+		rdr := metric.NewManualReader()
+		clk := newFakeClock(time.Now())
+		agg := newAggregator(t, AggregatorConfig{
+			DiskUsageLimit: 1 << 20,
+			MeterProvider:  metric.NewMeterProvider(metric.WithReader(rdr)),
+			clock:          clk,
+		})
+		var diskUsage atomic.Int64
+		agg.stores[0].metrics = func() *pebble.Metrics {
+			var pm pebble.Metrics
+			pm.Levels[0].Size = diskUsage.Load()
+			return &pm
+		}
+		assert.NoError(t, aggregate(agg))
+		diskUsage.Store(1<<20 + 1)
+		clk.Advance(storeUsageSampleInterval)
+		err := aggregate(agg)
+		assert.ErrorIs(t, err, ErrDiskFull)
+		assert.ErrorIs(t, err, ErrRetryable)
+		assert.ErrorIs(t, agg.AggregateCombinedMetrics(
+			context.Background(),
+			CombinedMetricsKey{Interval: time.Second, ProcessingTime: time.Now(), ID: "testid"},
+			CombinedMetrics(*createTestCombinedMetrics(1)),
+		), ErrDiskFull)
+
+		var rm metricdata.ResourceMetrics
+		require.NoError(t, rdr.Collect(context.Background(), &rm))
+		var diskFull int64
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				if m.Name == "aggregator.requests.disk-full" {
+					diskFull = m.Data.(metricdata.Sum[int64]).DataPoints[0].Value
+				}
+			}
+		}
+		assert.Equal(t, int64(2), diskFull)
+
+		// Harvests are still allowed to drain the aggregated metrics.
+		cms, err := agg.Snapshot(context.Background(), time.Second)
+		require.NoError(t, err)
+		assert.Len(t, cms, 1)
+		require.NoError(t, agg.Flush(context.Background()))
+		cms, err = agg.Snapshot(context.Background(), time.Second)
+		require.NoError(t, err)
+		assert.Empty(t, cms)
+		diskUsage.Store(0)
+		clk.Advance(storeUsageSampleInterval)
+		assert.NoError(t, aggregate(agg))
+	})
+}
+
+func TestWrapMerge(t *testing.T) {
+	forEachStore(t, testWrapMerge)
+}
+
+func testWrapMerge(t *testing.T, newStore newStoreFunc) {
+	var merges, mergedValues atomic.Int64
+	var harvested []CombinedMetrics
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore: newStore,
+		Processor: func(_ context.Context, _ CombinedMetricsKey, cm CombinedMetrics, _ time.Duration) error {
+			harvested = append(harvested, cm)
+			return nil
+		},
+		AggregationIntervals: []time.Duration{time.Minute},
+		WrapMerge: func(merge pebble.Merge) pebble.Merge {
+			return func(key, value []byte) (pebble.ValueMerger, error) {
+				merges.Add(1)
+				m, err := merge(key, value)
+				if err != nil {
+					return nil, err
+				}
+				return countingValueMerger{ValueMerger: m, merged: &mergedValues}, nil
+			}
+		},
+	})
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, agg.AggregateCombinedMetrics(
+			context.Background(),
+			CombinedMetricsKey{
+				Interval:       time.Minute,
+				ProcessingTime: time.Now().Truncate(time.Minute),
+				ID:             "testid",
+			},
+			CombinedMetrics(*createTestCombinedMetrics(1).
+				addTransaction(time.Now(), "svc", "", testTransaction{txnName: "txn", txnType: "type", count: 1})),
+		))
+	}
+	require.NoError(t, agg.Flush(context.Background()))
+
+	// The wrapped merge is invoked to merge the values written for the
+	// same key, and the wrapped default merger merges them as usual.
+	assert.Greater(t, merges.Load(), int64(0))
+	assert.Equal(t, int64(2), mergedValues.Load())
+	require.Len(t, harvested, 1)
+	assert.Equal(t, int64(3), harvested[0].eventsTotal)
+}
+
+type countingValueMerger struct {
+	pebble.ValueMerger
+	merged *atomic.Int64
+}
+
+func (m countingValueMerger) MergeNewer(value []byte) error {
+	m.merged.Add(1)
+	return m.ValueMerger.MergeNewer(value)
+}
+
+func (m countingValueMerger) MergeOlder(value []byte) error {
+	m.merged.Add(1)
+	return m.ValueMerger.MergeOlder(value)
+}
+
+func TestMergeFailures(t *testing.T) {
+	rdr := metric.NewManualReader()
+	var harvested []CombinedMetricsKey
+	agg := newTestAggregator(t, AggregatorConfig{
+		Processor: func(_ context.Context, cmk CombinedMetricsKey, _ CombinedMetrics, _ time.Duration) error {
+			harvested = append(harvested, cmk)
+			return nil
+		},
+		AggregationIntervals: []time.Duration{time.Minute},
+		MeterProvider:        metric.NewMeterProvider(metric.WithReader(rdr)),
+	})
+
+	collectMerges := func() map[string]int64 {
+		var rm metricdata.ResourceMetrics
+		require.NoError(t, rdr.Collect(context.Background(), &rm))
+		merges := make(map[string]int64)
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				switch m.Name {
+				case "aggregator.merges.total", "aggregator.merges.failed", "aggregator.harvest.dropped":
+				default:
+					continue
+				}
+				for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+					merges[m.Name] += dp.Value
+				}
+			}
+		}
+		return merges
+	}
+
+	cmk := CombinedMetricsKey{
+		Interval:       time.Minute,
+		ProcessingTime: time.Now().Truncate(time.Minute),
+		ID:             "testid",
+	}
+	cm := CombinedMetrics(*createTestCombinedMetrics(1).
+		addTransaction(time.Now(), "svc", "", testTransaction{txnName: "txn", txnType: "type", count: 1}))
+	require.NoError(t, agg.AggregateCombinedMetrics(context.Background(), cmk, cm))
+	require.NoError(t, agg.AggregateCombinedMetrics(context.Background(), cmk, cm))
+	_, err := agg.Snapshot(context.Background(), cmk.Interval)
+	require.NoError(t, err)
+	merges := collectMerges()
+	assert.Greater(t, merges["aggregator.merges.total"], int64(0))
+	assert.Zero(t, merges["aggregator.merges.failed"])
+
+	// Merge a malformed value, which fails to be decoded by the merger,
+	// followed by healthy keys.
+	key := make([]byte, cmk.SizeBinary())
+	cmk.MarshalBinaryToSizedBuffer(key)
+	require.NoError(t, agg.stores[0].db.Merge(key, []byte("malformed"), pebble.Sync))
+	healthy := []CombinedMetricsKey{
+		{Interval: cmk.Interval, ProcessingTime: cmk.ProcessingTime, ID: "testid2"},
+		{Interval: cmk.Interval, ProcessingTime: cmk.ProcessingTime, ID: "testid3"},
+	}
+	for _, k := range healthy {
+		require.NoError(t, agg.AggregateCombinedMetrics(context.Background(), k, cm))
+	}
+
+	// The merge failure is surfaced by the harvest, while the key which
+	// can not be merged is skipped and dropped rather than stopping the
+	// harvest of the keys after it.
+	err = agg.Flush(context.Background())
+	assert.ErrorContains(t, err, "failed to unmarshal combined metrics to merge")
+	assert.ElementsMatch(t, healthy, harvested)
+	merges = collectMerges()
+	assert.Equal(t, int64(1), merges["aggregator.merges.failed"])
+	assert.Equal(t, int64(1), merges["aggregator.harvest.dropped"])
+
+	// The dropped key does not fail the next harvest.
+	harvested = nil
+	assert.NoError(t, agg.Flush(context.Background()))
+	assert.Empty(t, harvested)
+	assert.Equal(t, int64(1), collectMerges()["aggregator.merges.failed"])
+}
+
+func TestPebbleCacheSize(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		size     int64
+		expected int64
+	}{
+		{name: "default", size: 0, expected: 0},
+		{name: "custom", size: 64 << 20, expected: 64 << 20},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			agg, err := New(AggregatorConfig{
+				DataDir:              t.TempDir(),
+				Processor:            noOpProcessor(),
+				AggregationIntervals: []time.Duration{time.Second},
+				PebbleCacheSize:      tc.size,
+			}, zap.NewNop())
+			require.NoError(t, err)
+			defer agg.Stop(context.Background())
+			if tc.expected == 0 {
+				assert.Nil(t, agg.cache)
+				return
+			}
+			require.NotNil(t, agg.cache)
+			assert.Equal(t, tc.expected, agg.cache.MaxSize())
+		})
+	}
+}
+
+func TestCompactionOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name                             string
+		maxConcurrentCompactions         int
+		l0CompactionThreshold            int
+		expectedMaxConcurrentCompactions int
+		expectedL0CompactionThreshold    int
+	}{
+		{
+			name:                             "default",
+			expectedMaxConcurrentCompactions: 1,
+			expectedL0CompactionThreshold:    4,
+		},
+		{
+			name:                             "custom",
+			maxConcurrentCompactions:         3,
+			l0CompactionThreshold:            8,
+			expectedMaxConcurrentCompactions: 3,
+			expectedL0CompactionThreshold:    8,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			agg, err := New(AggregatorConfig{
+				DataDir:                  t.TempDir(),
+				Processor:                noOpProcessor(),
+				AggregationIntervals:     []time.Duration{time.Second},
+				MaxConcurrentCompactions: tc.maxConcurrentCompactions,
+				L0CompactionThreshold:    tc.l0CompactionThreshold,
+			}, zap.NewNop())
+			require.NoError(t, err)
+			defer agg.Stop(context.Background())
+
+			// pebble applies the defaults to a copy of the options.
+			opts := agg.stores[0].opts.Clone().EnsureDefaults()
+			assert.Equal(t, tc.expectedMaxConcurrentCompactions, opts.MaxConcurrentCompactions())
+			assert.Equal(t, tc.expectedL0CompactionThreshold, opts.L0CompactionThreshold)
+		})
+	}
+}
+
+func TestSSTableCompression(t *testing.T) {
+	for _, tc := range []struct {
+		compression SSTableCompression
+		expected    pebble.Compression
+	}{
+		{compression: SSTableCompressionSnappy, expected: pebble.SnappyCompression},
+		{compression: SSTableCompressionNone, expected: pebble.NoCompression},
+		{compression: SSTableCompressionZstd, expected: pebble.ZstdCompression},
+	} {
+		t.Run(tc.compression.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			agg, err := New(AggregatorConfig{
+				DataDir:              dir,
+				Processor:            noOpProcessor(),
+				AggregationIntervals: []time.Duration{time.Second},
+				HarvestDelay:         time.Hour, // disable auto harvest
+				SSTableCompression:   tc.compression,
+			}, zap.NewNop())
+			require.NoError(t, err)
+			defer agg.Stop(context.Background())
+
+			// pebble applies the defaults to a copy of the options.
+			opts := agg.stores[0].opts.Clone().EnsureDefaults()
+			for level := 0; level < 7; level++ {
+				assert.Equal(t, tc.expected, opts.Level(level).Compression, level)
+			}
+
+			// The sstables flushed from the memtable use the compression.
+			batch := modelpb.Batch{
+				makeSpan(time.Now(), "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+			}
+			require.NoError(t, agg.AggregateBatch(context.Background(), "testid", &batch))
+			_, err = agg.Snapshot(context.Background(), time.Second)
+			require.NoError(t, err)
+			require.NoError(t, agg.stores[0].db.Flush())
+			ssts, err := filepath.Glob(filepath.Join(dir, "*.sst"))
+			require.NoError(t, err)
+			require.Len(t, ssts, 1)
+			f, err := os.Open(ssts[0])
+			require.NoError(t, err)
+			readable, err := sstable.NewSimpleReadable(f)
+			require.NoError(t, err)
+			r, err := sstable.NewReader(readable, sstable.ReaderOptions{}, sstable.Mergers{
+				opts.Merger.Name: opts.Merger,
+			})
+			require.NoError(t, err)
+			defer r.Close()
+			assert.Equal(t, tc.expected.String(), r.Properties.CompressionName)
+		})
+	}
+}
+
+func TestMemtableOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name                                string
+		memtableSize                        int
+		memtableStopWritesThreshold         int
+		expectedMemtableSize                int
+		expectedMemtableStopWritesThreshold int
+	}{
+		{
+			name:                                "default",
+			expectedMemtableSize:                4 << 20,
+			expectedMemtableStopWritesThreshold: 2,
+		},
+		{
+			name:                                "custom",
+			memtableSize:                        64 << 20,
+			memtableStopWritesThreshold:         4,
+			expectedMemtableSize:                64 << 20,
+			expectedMemtableStopWritesThreshold: 4,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			agg, err := New(AggregatorConfig{
+				DataDir:                     t.TempDir(),
+				Processor:                   noOpProcessor(),
+				AggregationIntervals:        []time.Duration{time.Second},
+				MemtableSize:                tc.memtableSize,
+				MemtableStopWritesThreshold: tc.memtableStopWritesThreshold,
+			}, zap.NewNop())
+			require.NoError(t, err)
+			defer agg.Stop(context.Background())
+
+			// pebble applies the defaults to a copy of the options.
+			opts := agg.stores[0].opts.Clone().EnsureDefaults()
+			assert.Equal(t, tc.expectedMemtableSize, opts.MemTableSize)
+			assert.Equal(t, tc.expectedMemtableStopWritesThreshold, opts.MemTableStopWritesThreshold)
+		})
+	}
+
+	// Smaller memtables are flushed more frequently.
+	flushes := func(memtableSize int) int64 {
+		agg := newTestAggregator(t, AggregatorConfig{
+			Limits: Limits{
+				MaxSpanGroups:                         10000,
+				MaxSpanGroupsPerService:               10000,
+				MaxTransactionGroups:                  10000,
+				MaxTransactionGroupsPerService:        10000,
+				MaxServiceTransactionGroups:           10000,
+				MaxServiceTransactionGroupsPerService: 10000,
+				MaxServices:                           10000,
+				MaxServiceInstanceGroupsPerService:    10000,
+			},
+			AggregationIntervals: []time.Duration{time.Minute},
+			MemtableSize:         memtableSize,
+		})
+
+		ts := time.Unix(1686000000, 0)
+		for i := 0; i < 100; i++ {
+			batch := make(modelpb.Batch, 0, 100)
+			for j := 0; j < 100; j++ {
+				batch = append(batch, &modelpb.APMEvent{
+					Processor: modelpb.TransactionProcessor(),
+					Timestamp: timestamppb.New(ts),
+					Service:   &modelpb.Service{Name: fmt.Sprintf("svc%d", j)},
+					Event:     &modelpb.Event{Duration: durationpb.New(time.Duration(i+1) * time.Millisecond)},
+					Transaction: &modelpb.Transaction{
+						RepresentativeCount: 1,
+						Name:                fmt.Sprintf("txn%d", i),
+						Type:                "type",
+					},
+				})
+			}
+			require.NoError(t, agg.AggregateBatch(context.Background(), fmt.Sprintf("id%d", i), &batch))
+		}
+		require.NoError(t, agg.Flush(context.Background()))
+		return agg.stores[0].db.Metrics().Flush.Count
+	}
+	small, large := flushes(256<<10), flushes(64<<20)
+	assert.Greater(t, small, int64(0))
+	assert.Zero(t, large)
+}
+
+func TestAggregateSpanMetrics(t *testing.T) {
+	forEachStore(t, testAggregateSpanMetrics)
+}
+
+func testAggregateSpanMetrics(t *testing.T, newStore newStoreFunc) {
+	type input struct {
+		serviceName         string
+		agentName           string
+		destination         string
+		targetType          string
+		targetName          string
+		outcome             string
+		representativeCount float64
+	}
+
+	destinationX := "destination-X"
+	destinationZ := "destination-Z"
+	trgTypeX := "trg-type-X"
+	trgNameX := "trg-name-X"
+	trgTypeZ := "trg-type-Z"
+	trgNameZ := "trg-name-Z"
+	defaultLabels := modelpb.Labels{
+		"department_name": &modelpb.LabelValue{Global: true, Value: "apm"},
+		"organization":    &modelpb.LabelValue{Global: true, Value: "observability"},
+		"company":         &modelpb.LabelValue{Global: true, Value: "elastic"},
+	}
+	defaultNumericLabels := modelpb.NumericLabels{
+		"user_id":     &modelpb.NumericLabelValue{Global: true, Value: 100},
+		"cost_center": &modelpb.NumericLabelValue{Global: true, Value: 10},
+	}
+
+	for _, tt := range []struct {
+		name              string
+		inputs            []input
+		getExpectedEvents func(time.Time, time.Duration, time.Duration, int) []*modelpb.APMEvent
+	}{
+		{
+			name: "with destination and service targets",
+			inputs: []input{
+				{serviceName: "service-A", agentName: "java", destination: destinationZ, targetType: trgTypeZ, targetName: trgNameZ, outcome: "success", representativeCount: 2},
+				{serviceName: "service-A", agentName: "java", destination: destinationX, targetType: trgTypeX, targetName: trgNameX, outcome: "success", representativeCount: 1},
 				{serviceName: "service-B", agentName: "python", destination: destinationZ, targetType: trgTypeZ, targetName: trgNameZ, outcome: "success", representativeCount: 1},
 				{serviceName: "service-A", agentName: "java", destination: destinationZ, targetType: trgTypeZ, targetName: trgNameZ, outcome: "success", representativeCount: 1},
 				{serviceName: "service-A", agentName: "java", destination: destinationZ, targetType: trgTypeZ, targetName: trgNameZ, outcome: "success", representativeCount: 0},
 				{serviceName: "service-A", agentName: "java", destination: destinationZ, targetType: trgTypeZ, targetName: trgNameZ, outcome: "failure", representativeCount: 1},
 			},
-			getExpectedEvents: func(ts time.Time, duration, ivl time.Duration, count int) []*modelpb.APMEvent {
-				return []*modelpb.APMEvent{
-					{
-						Timestamp: timestamppb.New(ts.Truncate(ivl)),
-						Agent:     &modelpb.Agent{Name: "java"},
-						Service: &modelpb.Service{
-							Name: "service-A",
-						},
-						Processor: modelpb.MetricsetProcessor(),
-						Metricset: &modelpb.Metricset{
-							Name:     "service_summary",
-							Interval: formatDuration(ivl),
-						},
-						Labels:        defaultLabels,
-						NumericLabels: defaultNumericLabels,
-					}, {
-						Timestamp: timestamppb.New(ts.Truncate(ivl)),
-						Agent:     &modelpb.Agent{Name: "python"},
-						Service: &modelpb.Service{
-							Name: "service-B",
-						},
-						Processor: modelpb.MetricsetProcessor(),
-						Metricset: &modelpb.Metricset{
-							Name:     "service_summary",
-							Interval: formatDuration(ivl),
-						},
-						Labels:        defaultLabels,
-						NumericLabels: defaultNumericLabels,
-					}, {
-						Timestamp: timestamppb.New(ts.Truncate(ivl)),
-						Agent:     &modelpb.Agent{Name: "java"},
-						Service: &modelpb.Service{
-							Name: "service-A",
-							Target: &modelpb.ServiceTarget{
-								Type: trgTypeX,
-								Name: trgNameX,
-							},
-						},
-						Event:     &modelpb.Event{Outcome: "success"},
-						Processor: modelpb.MetricsetProcessor(),
-						Metricset: &modelpb.Metricset{
-							Name:     "service_destination",
-							Interval: formatDuration(ivl),
-							DocCount: int64(count),
-						},
-						Span: &modelpb.Span{
-							Name: "service-A:" + destinationX,
-							DestinationService: &modelpb.DestinationService{
-								Resource: destinationX,
-								ResponseTime: &modelpb.AggregatedDuration{
-									Count: int64(count),
-									Sum:   durationpb.New(time.Duration(count) * duration),
-								},
-							},
-						},
-						Labels:        defaultLabels,
-						NumericLabels: defaultNumericLabels,
-					}, {
-						Timestamp: timestamppb.New(ts.Truncate(ivl)),
-						Agent:     &modelpb.Agent{Name: "java"},
-						Service: &modelpb.Service{
-							Name: "service-A",
-							Target: &modelpb.ServiceTarget{
-								Type: trgTypeZ,
-								Name: trgNameZ,
-							},
-						},
-						Event:     &modelpb.Event{Outcome: "failure"},
-						Processor: modelpb.MetricsetProcessor(),
-						Metricset: &modelpb.Metricset{
-							Name:     "service_destination",
-							Interval: formatDuration(ivl),
-							DocCount: int64(count),
-						},
-						Span: &modelpb.Span{
-							Name: "service-A:" + destinationZ,
-							DestinationService: &modelpb.DestinationService{
-								Resource: destinationZ,
-								ResponseTime: &modelpb.AggregatedDuration{
-									Count: int64(count),
-									Sum:   durationpb.New(time.Duration(count) * duration),
-								},
-							},
-						},
-						Labels:        defaultLabels,
-						NumericLabels: defaultNumericLabels,
-					}, {
-						Timestamp: timestamppb.New(ts.Truncate(ivl)),
-						Agent:     &modelpb.Agent{Name: "java"},
-						Service: &modelpb.Service{
-							Name: "service-A",
-							Target: &modelpb.ServiceTarget{
-								Type: trgTypeZ,
-								Name: trgNameZ,
-							},
-						},
-						Event:     &modelpb.Event{Outcome: "success"},
-						Processor: modelpb.MetricsetProcessor(),
-						Metricset: &modelpb.Metricset{
-							Name:     "service_destination",
-							Interval: formatDuration(ivl),
-							DocCount: int64(3 * count),
-						},
-						Span: &modelpb.Span{
-							Name: "service-A:" + destinationZ,
-							DestinationService: &modelpb.DestinationService{
-								Resource: destinationZ,
-								ResponseTime: &modelpb.AggregatedDuration{
-									Count: int64(3 * count),
-									Sum:   durationpb.New(time.Duration(3*count) * duration),
-								},
-							},
-						},
-						Labels:        defaultLabels,
-						NumericLabels: defaultNumericLabels,
-					}, {
-						Timestamp: timestamppb.New(ts.Truncate(ivl)),
-						Agent:     &modelpb.Agent{Name: "python"},
-						Service: &modelpb.Service{
-							Name: "service-B",
-							Target: &modelpb.ServiceTarget{
-								Type: trgTypeZ,
-								Name: trgNameZ,
-							},
-						},
-						Event:     &modelpb.Event{Outcome: "success"},
-						Processor: modelpb.MetricsetProcessor(),
-						Metricset: &modelpb.Metricset{
-							Name:     "service_destination",
-							Interval: formatDuration(ivl),
-							DocCount: int64(count),
-						},
-						Span: &modelpb.Span{
-							Name: "service-B:" + destinationZ,
-							DestinationService: &modelpb.DestinationService{
-								Resource: destinationZ,
-								ResponseTime: &modelpb.AggregatedDuration{
-									Count: int64(count),
-									Sum:   durationpb.New(time.Duration(count) * duration),
-								},
-							},
-						},
-						Labels:        defaultLabels,
-						NumericLabels: defaultNumericLabels,
+			getExpectedEvents: func(ts time.Time, duration, ivl time.Duration, count int) []*modelpb.APMEvent {
+				return []*modelpb.APMEvent{
+					{
+						Timestamp: timestamppb.New(ts.Truncate(ivl)),
+						Agent:     &modelpb.Agent{Name: "java"},
+						Service: &modelpb.Service{
+							Name: "service-A",
+						},
+						Processor: modelpb.MetricsetProcessor(),
+						Metricset: &modelpb.Metricset{
+							Name:     "service_summary",
+							Interval: formatDuration(ivl),
+						},
+						Labels:        defaultLabels,
+						NumericLabels: defaultNumericLabels,
+					}, {
+						Timestamp: timestamppb.New(ts.Truncate(ivl)),
+						Agent:     &modelpb.Agent{Name: "python"},
+						Service: &modelpb.Service{
+							Name: "service-B",
+						},
+						Processor: modelpb.MetricsetProcessor(),
+						Metricset: &modelpb.Metricset{
+							Name:     "service_summary",
+							Interval: formatDuration(ivl),
+						},
+						Labels:        defaultLabels,
+						NumericLabels: defaultNumericLabels,
+					}, {
+						Timestamp: timestamppb.New(ts.Truncate(ivl)),
+						Agent:     &modelpb.Agent{Name: "java"},
+						Service: &modelpb.Service{
+							Name: "service-A",
+							Target: &modelpb.ServiceTarget{
+								Type: trgTypeX,
+								Name: trgNameX,
+							},
+						},
+						Event:     &modelpb.Event{Outcome: "success"},
+						Processor: modelpb.MetricsetProcessor(),
+						Metricset: &modelpb.Metricset{
+							Name:     "service_destination",
+							Interval: formatDuration(ivl),
+							DocCount: int64(count),
+						},
+						Span: &modelpb.Span{
+							Name: "service-A:" + destinationX,
+							DestinationService: &modelpb.DestinationService{
+								Resource: destinationX,
+								ResponseTime: &modelpb.AggregatedDuration{
+									Count: int64(count),
+									Sum:   durationpb.New(time.Duration(count) * duration),
+								},
+							},
+						},
+						Labels:        defaultLabels,
+						NumericLabels: defaultNumericLabels,
+					}, {
+						Timestamp: timestamppb.New(ts.Truncate(ivl)),
+						Agent:     &modelpb.Agent{Name: "java"},
+						Service: &modelpb.Service{
+							Name: "service-A",
+							Target: &modelpb.ServiceTarget{
+								Type: trgTypeZ,
+								Name: trgNameZ,
+							},
+						},
+						Event:     &modelpb.Event{Outcome: "failure"},
+						Processor: modelpb.MetricsetProcessor(),
+						Metricset: &modelpb.Metricset{
+							Name:     "service_destination",
+							Interval: formatDuration(ivl),
+							DocCount: int64(count),
+						},
+						Span: &modelpb.Span{
+							Name: "service-A:" + destinationZ,
+							DestinationService: &modelpb.DestinationService{
+								Resource: destinationZ,
+								ResponseTime: &modelpb.AggregatedDuration{
+									Count: int64(count),
+									Sum:   durationpb.New(time.Duration(count) * duration),
+								},
+							},
+						},
+						Labels:        defaultLabels,
+						NumericLabels: defaultNumericLabels,
+					}, {
+						Timestamp: timestamppb.New(ts.Truncate(ivl)),
+						Agent:     &modelpb.Agent{Name: "java"},
+						Service: &modelpb.Service{
+							Name: "service-A",
+							Target: &modelpb.ServiceTarget{
+								Type: trgTypeZ,
+								Name: trgNameZ,
+							},
+						},
+						Event:     &modelpb.Event{Outcome: "success"},
+						Processor: modelpb.MetricsetProcessor(),
+						Metricset: &modelpb.Metricset{
+							Name:     "service_destination",
+							Interval: formatDuration(ivl),
+							DocCount: int64(3 * count),
+						},
+						Span: &modelpb.Span{
+							Name: "service-A:" + destinationZ,
+							DestinationService: &modelpb.DestinationService{
+								Resource: destinationZ,
+								ResponseTime: &modelpb.AggregatedDuration{
+									Count: int64(3 * count),
+									Sum:   durationpb.New(time.Duration(3*count) * duration),
+								},
+							},
+						},
+						Labels:        defaultLabels,
+						NumericLabels: defaultNumericLabels,
+					}, {
+						Timestamp: timestamppb.New(ts.Truncate(ivl)),
+						Agent:     &modelpb.Agent{Name: "python"},
+						Service: &modelpb.Service{
+							Name: "service-B",
+							Target: &modelpb.ServiceTarget{
+								Type: trgTypeZ,
+								Name: trgNameZ,
+							},
+						},
+						Event:     &modelpb.Event{Outcome: "success"},
+						Processor: modelpb.MetricsetProcessor(),
+						Metricset: &modelpb.Metricset{
+							Name:     "service_destination",
+							Interval: formatDuration(ivl),
+							DocCount: int64(count),
+						},
+						Span: &modelpb.Span{
+							Name: "service-B:" + destinationZ,
+							DestinationService: &modelpb.DestinationService{
+								Resource: destinationZ,
+								ResponseTime: &modelpb.AggregatedDuration{
+									Count: int64(count),
+									Sum:   durationpb.New(time.Duration(count) * duration),
+								},
+							},
+						},
+						Labels:        defaultLabels,
+						NumericLabels: defaultNumericLabels,
+					},
+				}
+			},
+		}, {
+			name: "with_no_destination_and_no_service_target",
+			inputs: []input{
+				{serviceName: "service-A", agentName: "java", outcome: "success", representativeCount: 1},
+			},
+			getExpectedEvents: func(_ time.Time, _, _ time.Duration, _ int) []*modelpb.APMEvent {
+				return nil
+			},
+		}, {
+			name: "with no destination and a service target",
+			inputs: []input{
+				{serviceName: "service-A", agentName: "java", targetType: trgTypeZ, targetName: trgNameZ, outcome: "success", representativeCount: 1},
+			},
+			getExpectedEvents: func(ts time.Time, duration, ivl time.Duration, count int) []*modelpb.APMEvent {
+				return []*modelpb.APMEvent{
+					{
+						Timestamp: timestamppb.New(ts.Truncate(ivl)),
+						Agent:     &modelpb.Agent{Name: "java"},
+						Service: &modelpb.Service{
+							Name: "service-A",
+						},
+						Processor: modelpb.MetricsetProcessor(),
+						Metricset: &modelpb.Metricset{
+							Name:     "service_summary",
+							Interval: formatDuration(ivl),
+						},
+						Labels:        defaultLabels,
+						NumericLabels: defaultNumericLabels,
+					}, {
+						Timestamp: timestamppb.New(ts.Truncate(ivl)),
+						Agent:     &modelpb.Agent{Name: "java"},
+						Service: &modelpb.Service{
+							Name: "service-A",
+							Target: &modelpb.ServiceTarget{
+								Type: trgTypeZ,
+								Name: trgNameZ,
+							},
+						},
+						Event:     &modelpb.Event{Outcome: "success"},
+						Processor: modelpb.MetricsetProcessor(),
+						Metricset: &modelpb.Metricset{
+							Name:     "service_destination",
+							Interval: formatDuration(ivl),
+							DocCount: int64(count),
+						},
+						Span: &modelpb.Span{
+							Name: "service-A:",
+							DestinationService: &modelpb.DestinationService{
+								ResponseTime: &modelpb.AggregatedDuration{
+									Count: int64(count),
+									Sum:   durationpb.New(time.Duration(count) * duration),
+								},
+							},
+						},
+						Labels:        defaultLabels,
+						NumericLabels: defaultNumericLabels,
+					},
+				}
+			},
+		}, {
+			name: "with a destination and no service target",
+			inputs: []input{
+				{serviceName: "service-A", agentName: "java", destination: destinationZ, outcome: "success", representativeCount: 1},
+			},
+			getExpectedEvents: func(ts time.Time, duration, ivl time.Duration, count int) []*modelpb.APMEvent {
+				return []*modelpb.APMEvent{
+					{
+						Timestamp: timestamppb.New(ts.Truncate(ivl)),
+						Agent:     &modelpb.Agent{Name: "java"},
+						Service: &modelpb.Service{
+							Name: "service-A",
+						},
+						Processor: modelpb.MetricsetProcessor(),
+						Metricset: &modelpb.Metricset{
+							Name:     "service_summary",
+							Interval: formatDuration(ivl),
+						},
+						Labels:        defaultLabels,
+						NumericLabels: defaultNumericLabels,
+					}, {
+						Timestamp: timestamppb.New(ts.Truncate(ivl)),
+						Agent:     &modelpb.Agent{Name: "java"},
+						Service: &modelpb.Service{
+							Name: "service-A",
+						},
+						Event:     &modelpb.Event{Outcome: "success"},
+						Processor: modelpb.MetricsetProcessor(),
+						Metricset: &modelpb.Metricset{
+							Name:     "service_destination",
+							Interval: formatDuration(ivl),
+							DocCount: int64(count),
+						},
+						Span: &modelpb.Span{
+							Name: "service-A:" + destinationZ,
+							DestinationService: &modelpb.DestinationService{
+								Resource: destinationZ,
+								ResponseTime: &modelpb.AggregatedDuration{
+									Count: int64(count),
+									Sum:   durationpb.New(time.Duration(count) * duration),
+								},
+							},
+						},
+						Labels:        defaultLabels,
+						NumericLabels: defaultNumericLabels,
+					},
+				}
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var actualEvents []*modelpb.APMEvent
+			logger, err := zap.NewDevelopment()
+			require.NoError(t, err)
+			aggregationIvls := []time.Duration{time.Minute, 10 * time.Minute, time.Hour}
+			agg, err := New(AggregatorConfig{
+				NewStore: newStore,
+				DataDir:  t.TempDir(),
+				Limits: Limits{
+					MaxSpanGroups:                         1000,
+					MaxSpanGroupsPerService:               100,
+					MaxTransactionGroups:                  100,
+					MaxTransactionGroupsPerService:        10,
+					MaxServiceTransactionGroups:           100,
+					MaxServiceTransactionGroupsPerService: 10,
+					MaxServices:                           10,
+					MaxServiceInstanceGroupsPerService:    10,
+				},
+				Processor:            sliceProcessor(&actualEvents),
+				AggregationIntervals: aggregationIvls,
+			}, logger)
+			require.NoError(t, err)
+
+			count := 100
+			now := time.Now()
+			duration := 100 * time.Millisecond
+			for _, in := range tt.inputs {
+				span := makeSpan(
+					now,
+					in.serviceName,
+					in.agentName,
+					in.destination,
+					in.targetType,
+					in.targetName,
+					in.outcome,
+					duration,
+					in.representativeCount,
+					defaultLabels,
+					defaultNumericLabels,
+				)
+				for i := 0; i < count; i++ {
+					err := agg.AggregateBatch(context.Background(), "testid", &modelpb.Batch{span})
+					require.NoError(t, err)
+				}
+			}
+			require.NoError(t, agg.Stop(context.Background()))
+			var expectedEvents []*modelpb.APMEvent
+			for _, ivl := range aggregationIvls {
+				expectedEvents = append(expectedEvents, tt.getExpectedEvents(now, duration, ivl, count)...)
+			}
+			sortKey := func(e *modelpb.APMEvent) string {
+				var sb strings.Builder
+				sb.WriteString(e.GetService().GetName())
+				sb.WriteString(e.GetAgent().GetName())
+				sb.WriteString(e.GetMetricset().GetName())
+				sb.WriteString(e.GetMetricset().GetInterval())
+				destSvc := e.GetSpan().GetDestinationService()
+				if destSvc != nil {
+					sb.WriteString(destSvc.GetResource())
+				}
+				target := e.GetService().GetTarget()
+				if target != nil {
+					sb.WriteString(target.GetName())
+					sb.WriteString(target.GetType())
+				}
+				sb.WriteString(e.GetEvent().GetOutcome())
+				return sb.String()
+			}
+			sort.Slice(expectedEvents, func(i, j int) bool {
+				return sortKey(expectedEvents[i]) < sortKey(expectedEvents[j])
+			})
+			sort.Slice(actualEvents, func(i, j int) bool {
+				return sortKey(actualEvents[i]) < sortKey(actualEvents[j])
+			})
+			assert.Empty(t, cmp.Diff(
+				expectedEvents, actualEvents,
+				cmpopts.EquateEmpty(),
+				cmpopts.IgnoreTypes(netip.Addr{}),
+				protocmp.Transform(),
+			))
+		})
+	}
+}
+
+func TestAggregateSpanDestinations(t *testing.T) {
+	forEachStore(t, testAggregateSpanDestinations)
+}
+
+func testAggregateSpanDestinations(t *testing.T, newStore newStoreFunc) {
+	var harvested []CombinedMetrics
+	limits := testLimits()
+	limits.MaxSpanDestinationsPerService = 2
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore: newStore,
+		Limits:   limits,
+		Processor: func(_ context.Context, _ CombinedMetricsKey, cm CombinedMetrics, _ time.Duration) error {
+			harvested = append(harvested, cm)
+			return nil
+		},
+		AggregationIntervals: []time.Duration{time.Minute},
+	})
+
+	ts := time.Unix(0, 0).UTC()
+	batch := modelpb.Batch{
+		makeSpan(ts, "svc1", "java", "dest1", "db", "postgres", "success", time.Second, 1, nil, nil),
+		makeSpan(ts, "svc1", "java", "dest1", "db", "postgres", "failure", time.Second, 1, nil, nil),
+		makeSpan(ts, "svc1", "java", "dest2", "db", "mysql", "success", time.Second, 1, nil, nil),
+		makeSpan(ts, "svc1", "java", "dest3", "db", "redis", "success", time.Second, 1, nil, nil),
+		makeSpan(ts, "svc2", "java", "dest1", "db", "postgres", "success", time.Second, 1, nil, nil),
+	}
+	require.NoError(t, agg.AggregateBatch(context.Background(), "testid", &batch))
+	require.NoError(t, agg.Stop(context.Background()))
+
+	require.Len(t, harvested, 1)
+	cm := harvested[0]
+	require.Len(t, cm.Services, 2)
+	for sk, sm := range cm.Services {
+		require.Len(t, sm.ServiceInstanceGroups, 1)
+		var count float64
+		for _, sim := range sm.ServiceInstanceGroups {
+			// The span groups are not affected by the span destination limit.
+			for _, spm := range sim.SpanGroups {
+				count += spm.Count
+			}
+		}
+		switch sk.ServiceName {
+		case "svc1":
+			assert.Equal(t, float64(4), count)
+			for _, sim := range sm.ServiceInstanceGroups {
+				// One of the destinations overflows due to the limit.
+				require.Len(t, sim.SpanDestinationGroups, 2)
+				for sdk, sdm := range sim.SpanDestinationGroups {
+					count -= sdm.Count
+					assert.Equal(t, sdm.Count*float64(time.Second), sdm.Sum, sdk.Resource)
+				}
+			}
+			overflow := sm.OverflowGroups.OverflowSpanDestination
+			require.False(t, overflow.Empty())
+			assert.Equal(t, uint64(1), overflow.Estimator.Estimate())
+			assert.Equal(t, count, overflow.Metrics.Count)
+		case "svc2":
+			assert.Equal(t, float64(1), count)
+			for _, sim := range sm.ServiceInstanceGroups {
+				assert.Equal(t, map[SpanDestinationAggregationKey]SpanMetrics{
+					{Resource: "dest1"}: {Count: 1, Sum: float64(time.Second)},
+				}, sim.SpanDestinationGroups)
+			}
+			assert.True(t, sm.OverflowGroups.OverflowSpanDestination.Empty())
+		}
+		assert.True(t, sm.OverflowGroups.OverflowSpan.Empty())
+	}
+}
+
+func TestCombinedMetricsKeyOrdered(t *testing.T) {
+	// To Allow for retrieving combined metrics by time range, the metrics should
+	// be ordered by processing time.
+	ts := time.Now().Add(-time.Hour)
+	ivl := time.Minute
+
+	before := CombinedMetricsKey{
+		ProcessingTime: ts.Truncate(time.Minute),
+		Interval:       ivl,
+		ID:             "cm01",
+	}
+	marshaledBufferSize := before.SizeBinary()
+	beforeBytes := make([]byte, marshaledBufferSize)
+	afterBytes := make([]byte, marshaledBufferSize)
+
+	for i := 0; i < 10; i++ {
+		ts = ts.Add(time.Minute)
+		after := CombinedMetricsKey{
+			ProcessingTime: ts.Truncate(time.Minute),
+			Interval:       ivl,
+			// combined metrics ID shouldn't matter. Keep length to be
+			// 5 to ensure it is within expected bounds of the
+			// sized buffer.
+			ID: fmt.Sprintf("cm%02d", rand.Intn(100)),
+		}
+		require.NoError(t, after.MarshalBinaryToSizedBuffer(afterBytes))
+		require.NoError(t, before.MarshalBinaryToSizedBuffer(beforeBytes))
+
+		// before should always come first
+		assert.Equal(t, -1, pebble.DefaultComparer.Compare(beforeBytes, afterBytes))
+
+		before = after
+	}
+}
+
+func TestHarvest(t *testing.T) {
+	forEachStore(t, testHarvest)
+}
+
+func testHarvest(t *testing.T, newStore newStoreFunc) {
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	cmCount := 5
+	ivls := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}
+	m := make(map[time.Duration]map[string]bool)
+	processorDone := make(chan struct{})
+	processor := func(
+		_ context.Context,
+		cmk CombinedMetricsKey,
+		cm CombinedMetrics,
+		ivl time.Duration,
+	) error {
+		cmMap, ok := m[ivl]
+		if !ok {
+			m[ivl] = make(map[string]bool)
+			cmMap = m[ivl]
+		}
+		// For each unique interval, we should only have a single combined metrics ID
+		if _, ok := cmMap[cmk.ID]; ok {
+			assert.FailNow(t, "duplicate combined metrics ID found")
+		}
+		cmMap[cmk.ID] = true
+		// For successful harvest, all combined metrics IDs foreach interval should be
+		// harvested
+		if len(m) == len(ivls) {
+			var remaining bool
+			for k := range m {
+				if len(m[k]) != cmCount {
+					remaining = true
+				}
+			}
+			if !remaining {
+				close(processorDone)
+			}
+		}
+		return nil
+	}
+	gatherer, err := apmotel.NewGatherer()
+	require.NoError(t, err)
+
+	agg, err := New(AggregatorConfig{
+		NewStore: newStore,
+		DataDir:  t.TempDir(),
+		Limits: Limits{
+			MaxSpanGroups:                         1000,
+			MaxTransactionGroups:                  100,
+			MaxTransactionGroupsPerService:        10,
+			MaxServiceTransactionGroups:           100,
+			MaxServiceTransactionGroupsPerService: 10,
+			MaxServices:                           10,
+			MaxServiceInstanceGroupsPerService:    10,
+		},
+		Processor:            processor,
+		AggregationIntervals: ivls,
+
+		MeterProvider: metric.NewMeterProvider(metric.WithReader(gatherer)),
+
+		CombinedMetricsIDToKVs: func(id string) []attribute.KeyValue {
+			return []attribute.KeyValue{attribute.String("id_key", id)}
+		},
+	}, logger)
+	require.NoError(t, err)
+	go func() {
+		agg.Run(context.Background())
+	}()
+	t.Cleanup(func() {
+		agg.Stop(context.Background())
+	})
+
+	var batch modelpb.Batch
+	batch = append(batch, &modelpb.APMEvent{
+		Processor: modelpb.TransactionProcessor(),
+		Transaction: &modelpb.Transaction{
+			Name:                "txn",
+			RepresentativeCount: 1,
+		},
+	})
+	expectedMeasurements := make([]apmmodel.Metrics, 0, cmCount+(cmCount*len(ivls)))
+	for i := 0; i < cmCount; i++ {
+		cmID := fmt.Sprintf("testid%d", i)
+		require.NoError(t, agg.AggregateBatch(context.Background(), cmID, &batch))
+		expectedMeasurements = append(expectedMeasurements, apmmodel.Metrics{
+			Samples: map[string]apmmodel.Metric{
+				"aggregator.bytes.ingested": {Value: 267},
+			},
+			Labels: apmmodel.StringMap{
+				apmmodel.StringMapItem{Key: telemetry.EventTypeKey, Value: "transaction"},
+				apmmodel.StringMapItem{Key: "id_key", Value: cmID},
+			},
+		})
+		for _, ivl := range ivls {
+			expectedMeasurements = append(expectedMeasurements, apmmodel.Metrics{
+				Samples: map[string]apmmodel.Metric{
+					"aggregator.requests.total":   {Value: 1},
+					"aggregator.events.total":     {Value: float64(len(batch))},
+					"aggregator.events.weighted":  {Value: float64(len(batch))},
+					"aggregator.events.processed": {Value: float64(len(batch))},
+				},
+				Labels: apmmodel.StringMap{
+					apmmodel.StringMapItem{Key: telemetry.AggregationIntervalKey, Value: formatDuration(ivl)},
+					apmmodel.StringMapItem{Key: "id_key", Value: cmID},
+				},
+			})
+		}
+	}
+
+	// The test is designed to timeout if it fails. The test asserts most of the
+	// logic in processor. If all expected metrics are harvested then the
+	// processor broadcasts this by closing the processorDone channel and we call
+	// it a success. If the harvest hasn't finished then the test times out and
+	// we call it a failure. Due to the nature of how the aggregator works, it is
+	// possible that this test becomes flaky if there is a bug.
+	select {
+	case <-processorDone:
+	case <-time.After(8 * time.Second):
+		t.Fatal("harvest didn't finish within expected time")
+	}
+	assert.Empty(t, cmp.Diff(
+		expectedMeasurements, gatherMetrics(
+			gatherer,
+			"pebble.",
+			// Request durations are not deterministic
+			"aggregator.requests.duration",
+			// Number of harvests depends on the timing of the test
+			"aggregator.harvest",
+			// Active combined metrics depend on the progress of the harvest
+			"aggregator.combined-metrics.active",
+			"aggregator.histograms.memory",
+			"aggregator.overflow.active-buckets",
+			// Reported only for the aggregation intervals harvested so far
+			"aggregator.overflow.estimated-cardinality",
+		),
+		cmpopts.IgnoreUnexported(apmmodel.Time{}),
+		sortMetricsByLabels(),
+	))
+}
+
+func TestAggregateAndHarvest(t *testing.T) {
+	forEachStore(t, testAggregateAndHarvest)
+}
+
+func testAggregateAndHarvest(t *testing.T, newStore newStoreFunc) {
+	txnDuration := 100 * time.Millisecond
+	batch := modelpb.Batch{
+		{
+			Processor: modelpb.TransactionProcessor(),
+			Event: &modelpb.Event{
+				Outcome:  "success",
+				Duration: durationpb.New(txnDuration),
+			},
+			Transaction: &modelpb.Transaction{
+				Name:                "foo",
+				Type:                "txtype",
+				RepresentativeCount: 1,
+			},
+			Service: &modelpb.Service{Name: "svc"},
+			Labels: modelpb.Labels{
+				"department_name": &modelpb.LabelValue{Global: true, Value: "apm"},
+				"organization":    &modelpb.LabelValue{Global: true, Value: "observability"},
+				"company":         &modelpb.LabelValue{Global: true, Value: "elastic"},
+				"mylabel":         &modelpb.LabelValue{Global: false, Value: "myvalue"},
+			},
+			NumericLabels: modelpb.NumericLabels{
+				"user_id":        &modelpb.NumericLabelValue{Global: true, Value: 100},
+				"cost_center":    &modelpb.NumericLabelValue{Global: true, Value: 10},
+				"mynumericlabel": &modelpb.NumericLabelValue{Global: false, Value: 1},
+			},
+		},
+	}
+	var events []*modelpb.APMEvent
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	agg, err := New(AggregatorConfig{
+		NewStore: newStore,
+		DataDir:  t.TempDir(),
+		Limits: Limits{
+			MaxSpanGroups:                         1000,
+			MaxSpanGroupsPerService:               100,
+			MaxTransactionGroups:                  100,
+			MaxTransactionGroupsPerService:        10,
+			MaxServiceTransactionGroups:           100,
+			MaxServiceTransactionGroupsPerService: 10,
+			MaxServices:                           10,
+			MaxServiceInstanceGroupsPerService:    10,
+		},
+		Processor:            sliceProcessor(&events),
+		AggregationIntervals: []time.Duration{time.Second},
+	}, logger)
+	require.NoError(t, err)
+	require.NoError(t, agg.AggregateBatch(context.Background(), "test", &batch))
+	require.NoError(t, agg.Stop(context.Background()))
+
+	expected := []*modelpb.APMEvent{
+		{
+			Timestamp: timestamppb.New(time.Unix(0, 0).UTC()),
+			Processor: modelpb.MetricsetProcessor(),
+			Event: &modelpb.Event{
+				SuccessCount: &modelpb.SummaryMetric{
+					Count: 1,
+					Sum:   1,
+				},
+				Outcome: "success",
+			},
+			Transaction: &modelpb.Transaction{
+				Name: "foo",
+				Type: "txtype",
+				Root: true,
+				DurationSummary: &modelpb.SummaryMetric{
+					Count: 1,
+					Sum:   100351, // Estimate from histogram
+				},
+				DurationHistogram: &modelpb.Histogram{
+					Values: []float64{100351},
+					Counts: []int64{1},
+				},
+			},
+			Service: &modelpb.Service{
+				Name: "svc",
+			},
+			Labels: modelpb.Labels{
+				"department_name": &modelpb.LabelValue{Global: true, Value: "apm"},
+				"organization":    &modelpb.LabelValue{Global: true, Value: "observability"},
+				"company":         &modelpb.LabelValue{Global: true, Value: "elastic"},
+			},
+			NumericLabels: modelpb.NumericLabels{
+				"user_id":     &modelpb.NumericLabelValue{Global: true, Value: 100},
+				"cost_center": &modelpb.NumericLabelValue{Global: true, Value: 10},
+			},
+			Metricset: &modelpb.Metricset{
+				Name:     "transaction",
+				DocCount: 1,
+				Interval: "1s",
+			},
+		},
+		{
+			Timestamp: timestamppb.New(time.Unix(0, 0).UTC()),
+			Processor: modelpb.MetricsetProcessor(),
+			Service: &modelpb.Service{
+				Name: "svc",
+			},
+			Labels: modelpb.Labels{
+				"department_name": &modelpb.LabelValue{Global: true, Value: "apm"},
+				"organization":    &modelpb.LabelValue{Global: true, Value: "observability"},
+				"company":         &modelpb.LabelValue{Global: true, Value: "elastic"},
+			},
+			NumericLabels: modelpb.NumericLabels{
+				"user_id":     &modelpb.NumericLabelValue{Global: true, Value: 100},
+				"cost_center": &modelpb.NumericLabelValue{Global: true, Value: 10},
+			},
+			Metricset: &modelpb.Metricset{
+				Name:     "service_summary",
+				Interval: "1s",
+			},
+		},
+		{
+			Timestamp: timestamppb.New(time.Unix(0, 0).UTC()),
+			Processor: modelpb.MetricsetProcessor(),
+			Event: &modelpb.Event{
+				SuccessCount: &modelpb.SummaryMetric{
+					Count: 1,
+					Sum:   1,
+				},
+			},
+			Transaction: &modelpb.Transaction{
+				Type: "txtype",
+				DurationSummary: &modelpb.SummaryMetric{
+					Count: 1,
+					Sum:   100351, // Estimate from histogram
+				},
+				DurationHistogram: &modelpb.Histogram{
+					Values: []float64{100351},
+					Counts: []int64{1},
+				},
+			},
+			Service: &modelpb.Service{
+				Name: "svc",
+			},
+			Labels: modelpb.Labels{
+				"department_name": &modelpb.LabelValue{Global: true, Value: "apm"},
+				"organization":    &modelpb.LabelValue{Global: true, Value: "observability"},
+				"company":         &modelpb.LabelValue{Global: true, Value: "elastic"},
+			},
+			NumericLabels: modelpb.NumericLabels{
+				"user_id":     &modelpb.NumericLabelValue{Global: true, Value: 100},
+				"cost_center": &modelpb.NumericLabelValue{Global: true, Value: 10},
+			},
+			Metricset: &modelpb.Metricset{
+				Name:     "service_transaction",
+				DocCount: 1,
+				Interval: "1s",
+			},
+		},
+	}
+	assert.Empty(t, cmp.Diff(
+		expected,
+		events,
+		cmpopts.IgnoreTypes(netip.Addr{}),
+		cmpopts.SortSlices(func(a, b *modelpb.APMEvent) bool {
+			return a.Metricset.Name < b.Metricset.Name
+		}),
+		protocmp.Transform(),
+	))
+}
+
+func TestOverflowEventCounts(t *testing.T) {
+	svcOverflowTxn := newTransactionMetrics()
+	svcOverflowTxn.Histogram.RecordDuration(time.Second, 3)
+	txn := newTransactionMetrics()
+	txn.Histogram.RecordDuration(time.Second, 2)
+	// Service transactions with an unknown outcome are neither counted
+	// as successes nor as failures but are overflowed.
+	svcTxn := newServiceTransactionMetrics()
+	svcTxn.Histogram.RecordDuration(time.Second, 6)
+	svcTxn.SuccessCount = 4
+	svcTxn.FailureCount = 1
+
+	svc1 := newServiceMetrics()
+	svc1.OverflowGroups.OverflowTransaction.Merge(&txn, Hasher{})
+	svc1.OverflowGroups.OverflowServiceTransaction.Merge(&svcTxn, Hasher{})
+	svc2 := newServiceMetrics()
+	svc2.OverflowGroups.OverflowSpan.Merge(&SpanMetrics{Count: 7, Sum: 100}, Hasher{})
+	svc2.OverflowGroups.OverflowSpanDestination.Merge(&SpanMetrics{Count: 6, Sum: 90}, Hasher{})
+	cm := CombinedMetrics{
+		Services: map[ServiceAggregationKey]ServiceMetrics{
+			{ServiceName: "svc1"}: svc1,
+			{ServiceName: "svc2"}: svc2,
+		},
+	}
+	cm.OverflowServices.OverflowTransaction.Merge(&svcOverflowTxn, Hasher{})
+	cm.OverflowServices.OverflowSpan.Merge(&SpanMetrics{Count: 1.5, Sum: 10}, Hasher{})
+
+	assert.Equal(t, map[string]float64{
+		overflowTypeService:            4.5,
+		overflowTypeTransaction:        2,
+		overflowTypeServiceTransaction: 6,
+		overflowTypeSpan:               7,
+		overflowTypeSpanDestination:    6,
+	}, overflowEventCounts(&cm))
+	assert.Equal(t, map[string]map[string]int64{
+		overflowTypeTransaction:        {"svc1": 2, "svc2": 0},
+		overflowTypeServiceTransaction: {"svc1": 6, "svc2": 0},
+		overflowTypeSpan:               {"svc1": 0, "svc2": 7},
+		overflowTypeSpanDestination:    {"svc1": 0, "svc2": 6},
+	}, serviceOverflowEventCounts(&cm))
+}
+
+func TestRunStopOrchestration(t *testing.T) {
+	forEachStore(t, testRunStopOrchestration)
+}
+
+func testRunStopOrchestration(t *testing.T, newStore newStoreFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatal("failed to create test logger", err)
+	}
+	var firstHarvestDone atomic.Bool
+	newAggregator := func() *Aggregator {
+		agg, err := New(AggregatorConfig{
+			NewStore: newStore,
+			DataDir:  t.TempDir(),
+			Processor: func(_ context.Context, _ CombinedMetricsKey, _ CombinedMetrics, _ time.Duration) error {
+				firstHarvestDone.Swap(true)
+				return nil
+			},
+			AggregationIntervals: []time.Duration{time.Second},
+		}, logger)
+		if err != nil {
+			t.Fatal("failed to create test aggregator", err)
+		}
+		return agg
+	}
+	callAggregateBatch := func(agg *Aggregator) error {
+		return agg.AggregateBatch(
+			context.Background(),
+			"testid",
+			&modelpb.Batch{
+				&modelpb.APMEvent{
+					Processor: modelpb.TransactionProcessor(),
+					Event:     &modelpb.Event{Duration: durationpb.New(time.Millisecond)},
+					Transaction: &modelpb.Transaction{
+						Name:                "T-1000",
+						RepresentativeCount: 1,
 					},
+				},
+			},
+		)
+	}
+
+	t.Run("run_before_stop", func(t *testing.T) {
+		agg := newAggregator()
+		// Should aggregate even without running
+		assert.NoError(t, callAggregateBatch(agg))
+		go func() { agg.Run(ctx) }()
+		// The first harvest runs at the end of the current aggregation
+		// interval, up to a full interval after the aggregation, thus,
+		// allow for the harvest to complete after that.
+		assert.Eventually(t, func() bool {
+			return firstHarvestDone.Load()
+		}, 2*time.Second, 10*time.Millisecond, "failed while waiting for first harvest")
+		assert.NoError(t, callAggregateBatch(agg))
+		assert.NoError(t, agg.Stop(ctx))
+		assert.ErrorIs(t, callAggregateBatch(agg), ErrAggregatorStopped)
+	})
+	t.Run("stop_before_run", func(t *testing.T) {
+		agg := newAggregator()
+		assert.NoError(t, agg.Stop(ctx))
+		assert.ErrorIs(t, callAggregateBatch(agg), ErrAggregatorStopped)
+		assert.ErrorIs(t, agg.Run(ctx), ErrAggregatorStopped)
+	})
+	t.Run("multiple_run", func(t *testing.T) {
+		agg := newAggregator()
+		defer agg.Stop(ctx)
+
+		g, ctx := errgroup.WithContext(ctx)
+		g.Go(func() error { return agg.Run(ctx) })
+		g.Go(func() error { return agg.Run(ctx) })
+		assert.ErrorIs(t, g.Wait(), ErrAggregatorAlreadyRunning)
+	})
+	t.Run("multiple_stop", func(t *testing.T) {
+		agg := newAggregator()
+		defer agg.Stop(ctx)
+		go func() { agg.Run(ctx) }()
+		time.Sleep(time.Second)
+
+		g, ctx := errgroup.WithContext(ctx)
+		g.Go(func() error { return agg.Stop(ctx) })
+		g.Go(func() error { return agg.Stop(ctx) })
+		assert.NoError(t, g.Wait())
+	})
+}
+
+func TestRunHarvestJitter(t *testing.T) {
+	forEachStore(t, testRunHarvestJitter)
+}
+
+func testRunHarvestJitter(t *testing.T, newStore newStoreFunc) {
+	type harvest struct {
+		processingTime time.Time
+		harvestedAt    time.Time
+	}
+	harvests := make(chan harvest, 1)
+	agg, err := New(AggregatorConfig{
+		NewStore: newStore,
+		DataDir:  t.TempDir(),
+		Processor: func(_ context.Context, cmk CombinedMetricsKey, _ CombinedMetrics, _ time.Duration) error {
+			select {
+			case harvests <- harvest{processingTime: cmk.ProcessingTime, harvestedAt: time.Now()}:
+			default:
+			}
+			return nil
+		},
+		AggregationIntervals: []time.Duration{time.Second},
+		HarvestJitter:        500 * time.Millisecond,
+		HarvestJitterSeed:    1,
+	}, zap.NewNop())
+	require.NoError(t, err)
+	require.NoError(t, agg.AggregateBatch(context.Background(), "testid", &modelpb.Batch{
+		makeSpan(time.Now(), "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go agg.Run(ctx)
+	defer agg.Stop(context.Background())
+
+	select {
+	case h := <-harvests:
+		end := h.processingTime.Add(time.Second)
+		expected := end.Add(agg.harvestJitter.offset(end))
+		assert.False(t, h.harvestedAt.Before(expected),
+			"harvested at %s before the jittered harvest time %s", h.harvestedAt, expected)
+		assert.WithinDuration(t, expected, h.harvestedAt, 200*time.Millisecond)
+		assert.True(t, h.harvestedAt.Before(end.Add(500*time.Millisecond+200*time.Millisecond)))
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for harvest")
+	}
+}
+
+func TestNextHarvest(t *testing.T) {
+	forEachStore(t, testNextHarvest)
+}
+
+func testNextHarvest(t *testing.T, newStore newStoreFunc) {
+	harvested := make(chan time.Time, 1)
+	agg, err := New(AggregatorConfig{
+		NewStore: newStore,
+		DataDir:  t.TempDir(),
+		Processor: func(_ context.Context, cmk CombinedMetricsKey, _ CombinedMetrics, _ time.Duration) error {
+			select {
+			case harvested <- cmk.ProcessingTime:
+			default:
+			}
+			return nil
+		},
+		AggregationIntervals: []time.Duration{time.Second, time.Minute},
+		HarvestDelay:         100 * time.Millisecond,
+		HarvestJitter:        500 * time.Millisecond,
+		HarvestJitterSeed:    1,
+	}, zap.NewNop())
+	require.NoError(t, err)
+	defer agg.Stop(context.Background())
+
+	_, err = agg.NextHarvest(time.Hour)
+	assert.EqualError(t, err, "unknown aggregation interval 1h0m0s")
+
+	nextMinute, err := agg.NextHarvest(time.Minute)
+	require.NoError(t, err)
+	end := time.Now().Truncate(time.Minute).Add(time.Minute)
+	assert.Equal(t, end.Add(100*time.Millisecond+agg.harvestJitter.offset(end)), nextMinute)
+
+	next, err := agg.NextHarvest(time.Second)
+	require.NoError(t, err)
+	require.NoError(t, agg.AggregateBatch(context.Background(), "testid", &modelpb.Batch{
+		makeSpan(time.Now(), "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go agg.Run(ctx)
+
+	select {
+	case processingTime := <-harvested:
+		end := processingTime.Add(time.Second)
+		assert.Equal(t, agg.harvestTime(end), next)
+		after, err := agg.NextHarvest(time.Second)
+		require.NoError(t, err)
+		end = end.Add(time.Second)
+		assert.Equal(t, agg.harvestTime(end), after)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for harvest")
+	}
+}
+
+func TestRunWithClock(t *testing.T) {
+	forEachStore(t, testRunWithClock)
+}
+
+func testRunWithClock(t *testing.T, newStore newStoreFunc) {
+	type harvest struct {
+		ivl            time.Duration
+		processingTime time.Time
+	}
+	harvests := make(chan harvest, 10)
+	// Start the clock at a time aligned to all the aggregation intervals.
+	start := time.Unix(1686000000, 0).Truncate(time.Minute)
+	clk := newFakeClock(start)
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore: newStore,
+		Processor: func(_ context.Context, cmk CombinedMetricsKey, _ CombinedMetrics, ivl time.Duration) error {
+			harvests <- harvest{ivl: ivl, processingTime: cmk.ProcessingTime}
+			return nil
+		},
+		AggregationIntervals: []time.Duration{time.Second, 3 * time.Second},
+		HarvestDelay:         100 * time.Millisecond,
+		clock:                clk,
+	})
+	require.NoError(t, agg.AggregateBatch(context.Background(), "testid", &modelpb.Batch{
+		makeSpan(start, "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go agg.Run(ctx)
+	defer agg.Stop(context.Background())
+
+	assertNoHarvest := func() {
+		t.Helper()
+		select {
+		case h := <-harvests:
+			t.Fatalf("unexpected harvest %+v", h)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	assertHarvest := func(expected harvest) {
+		t.Helper()
+		select {
+		case h := <-harvests:
+			assert.Equal(t, expected, h)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for harvest")
+		}
+	}
+
+	// The harvest fires exactly at the end of the interval plus the
+	// harvest delay.
+	clk.Advance(time.Second + 99*time.Millisecond)
+	assertNoHarvest()
+	clk.Advance(time.Millisecond)
+	assertHarvest(harvest{ivl: time.Second, processingTime: start})
+
+	// The next harvests of the lowest aggregation interval have nothing
+	// to harvest until the end of the larger aggregation interval.
+	clk.Advance(time.Second)
+	assertNoHarvest()
+	clk.Advance(time.Second)
+	assertHarvest(harvest{ivl: 3 * time.Second, processingTime: start})
+	assertNoHarvest()
+}
+
+func TestHarvestAlignment(t *testing.T) {
+	forEachStore(t, testHarvestAlignment)
+}
+
+func testHarvestAlignment(t *testing.T, newStore newStoreFunc) {
+	start := time.Unix(1686000000, 0).Truncate(time.Hour)
+	clk := newFakeClock(start.Add(7300 * time.Millisecond))
+	harvests := make(chan time.Time, 10)
+	newAggregator := func(t *testing.T) *Aggregator {
+		agg, err := New(AggregatorConfig{
+			NewStore: newStore,
+			DataDir:  t.TempDir(),
+			Limits:   testLimits(),
+			Processor: func(_ context.Context, cmk CombinedMetricsKey, _ CombinedMetrics, _ time.Duration) error {
+				harvests <- cmk.ProcessingTime
+				return nil
+			},
+			AggregationIntervals: []time.Duration{10 * time.Second, time.Minute},
+			clock:                clk,
+		}, zap.NewNop())
+		require.NoError(t, err)
+		t.Cleanup(func() { agg.Stop(context.Background()) })
+		return agg
+	}
+
+	// The first harvest fires at the next wall clock multiple of the
+	// interval rather than one interval after the aggregator started.
+	agg := newAggregator(t)
+	next, err := agg.NextHarvest(10 * time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, start.Add(10*time.Second), next)
+	next, err = agg.NextHarvest(time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, start.Add(time.Minute), next)
+
+	// An aggregator started later, for example after a restart or as a
+	// replica, converges on the same boundaries.
+	clk.Advance(16600 * time.Millisecond)
+	replica := newAggregator(t)
+	next, err = replica.NextHarvest(10 * time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, start.Add(30*time.Second), next)
+	next, err = replica.NextHarvest(time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, start.Add(time.Minute), next)
+
+	require.NoError(t, replica.AggregateBatch(context.Background(), "testid", &modelpb.Batch{
+		makeSpan(clk.Now(), "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go replica.Run(ctx)
+	// The replica, started 3.9s into the period starting at :20, harvests
+	// the period at :30.
+	clk.Advance(6 * time.Second)
+	select {
+	case processingTime := <-harvests:
+		t.Fatalf("unexpected harvest of processing time %s", processingTime)
+	case <-time.After(50 * time.Millisecond):
+	}
+	clk.Advance(100 * time.Millisecond)
+	select {
+	case processingTime := <-harvests:
+		assert.Equal(t, start.Add(20*time.Second), processingTime)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for harvest")
+	}
+}
+
+func TestHarvestLag(t *testing.T) {
+	forEachStore(t, testHarvestLag)
+}
+
+func testHarvestLag(t *testing.T, newStore newStoreFunc) {
+	start := time.Unix(1686000000, 0).Truncate(time.Minute)
+	clk := newFakeClock(start)
+	rdr := metric.NewManualReader()
+	harvested := make(chan HarvestSummary, 10)
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore:             newStore,
+		AggregationIntervals: []time.Duration{10 * time.Second},
+		HarvestDelay:         2 * time.Second,
+		HarvestObserver: func(summary HarvestSummary) {
+			harvested <- summary
+		},
+		MeterProvider: metric.NewMeterProvider(metric.WithReader(rdr)),
+		clock:         clk,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go agg.Run(ctx)
+
+	lag := func() metricdata.HistogramDataPoint[float64] {
+		var rm metricdata.ResourceMetrics
+		require.NoError(t, rdr.Collect(context.Background(), &rm))
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				if m.Name == "aggregator.harvest.lag" {
+					dps := m.Data.(metricdata.Histogram[float64]).DataPoints
+					require.Len(t, dps, 1)
+					return dps[0]
 				}
+			}
+		}
+		t.Fatal("harvest lag not recorded")
+		return metricdata.HistogramDataPoint[float64]{}
+	}
+
+	// The interval ending at :10 is harvested at :12 due to the harvest
+	// delay.
+	clk.Advance(12 * time.Second)
+	select {
+	case summary := <-harvested:
+		assert.Equal(t, start.Add(10*time.Second), summary.End)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for harvest")
+	}
+	dp := lag()
+	assert.Equal(t, uint64(1), dp.Count)
+	assert.Equal(t, float64(2), dp.Sum)
+	interval, _ := dp.Attributes.Value(telemetry.AggregationIntervalKey)
+	assert.Equal(t, "10s", interval.AsString())
+
+	// The harvest of the current interval on Stop has no lag.
+	require.NoError(t, agg.Stop(context.Background()))
+	dp = lag()
+	assert.Equal(t, uint64(2), dp.Count)
+	assert.Equal(t, float64(2), dp.Sum)
+}
+
+func TestHarvestLabels(t *testing.T) {
+	forEachStore(t, testHarvestLabels)
+}
+
+func testHarvestLabels(t *testing.T, newStore newStoreFunc) {
+	start := time.Unix(1686000000, 0).Truncate(time.Minute)
+	labels := map[string]string{"cluster": "prod", "region": "eu-west-1"}
+	var harvested []CombinedMetrics
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore: newStore,
+		Processor: func(_ context.Context, _ CombinedMetricsKey, cm CombinedMetrics, _ time.Duration) error {
+			harvested = append(harvested, cm)
+			return nil
+		},
+		AggregationIntervals: []time.Duration{time.Minute},
+		HarvestLabels:        labels,
+		// Split the combined metrics into a chunk per service.
+		MaxProcessorPayloadBytes: 1,
+		clock:                    newFakeClock(start),
+	})
+	// Modifying the configured labels does not affect the aggregator.
+	labels["cluster"] = "dev"
+
+	batch := modelpb.Batch{
+		makeSpan(start, "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+		makeSpan(start, "svc2", "java", "dest2", "", "", "success", time.Second, 1, nil, nil),
+	}
+	require.NoError(t, agg.AggregateBatch(context.Background(), "testid", &batch))
+
+	// The labels are not part of the aggregated metrics.
+	snapshot, err := agg.Snapshot(context.Background(), time.Minute)
+	require.NoError(t, err)
+	require.Len(t, snapshot, 1)
+	var cm CombinedMetrics
+	cm.FromProto(snapshot[0])
+	assert.Nil(t, cm.Labels)
+
+	require.NoError(t, agg.Stop(context.Background()))
+	require.Len(t, harvested, 2)
+	for _, cm := range harvested {
+		assert.Len(t, cm.Services, 1)
+		assert.Equal(t, map[string]string{"cluster": "prod", "region": "eu-west-1"}, cm.Labels)
+	}
+	// Each processed combined metrics owns its labels.
+	harvested[0].Labels["cluster"] = "dev"
+	assert.Equal(t, "prod", harvested[1].Labels["cluster"])
+}
+
+func TestAggregateCombinedMetricsBatch(t *testing.T) {
+	forEachStore(t, testAggregateCombinedMetricsBatch)
+}
+
+func testAggregateCombinedMetricsBatch(t *testing.T, newStore newStoreFunc) {
+	start := time.Unix(1686000000, 0).Truncate(time.Minute)
+	ivls := []time.Duration{time.Second, time.Minute}
+	newAggregator := func(t *testing.T, harvested map[CombinedMetricsKey]CombinedMetrics) *Aggregator {
+		return newTestAggregator(t, AggregatorConfig{
+			NewStore: newStore,
+			Processor: func(_ context.Context, cmk CombinedMetricsKey, cm CombinedMetrics, _ time.Duration) error {
+				harvested[cmk] = cm
+				return nil
 			},
-		}, {
-			name: "with_no_destination_and_no_service_target",
-			inputs: []input{
-				{serviceName: "service-A", agentName: "java", outcome: "success", representativeCount: 1},
+			AggregationIntervals: ivls,
+			clock:                newFakeClock(start),
+		})
+	}
+
+	var kcms []KeyedCombinedMetrics
+	for i := 0; i < 50; i++ {
+		for _, ivl := range ivls {
+			cm, err := EventToCombinedMetrics(&modelpb.APMEvent{
+				Processor: modelpb.TransactionProcessor(),
+				Event:     &modelpb.Event{Duration: durationpb.New(time.Duration(i+1) * time.Millisecond)},
+				Transaction: &modelpb.Transaction{
+					Name:                fmt.Sprintf("txn%d", i%15),
+					Type:                "type",
+					RepresentativeCount: 1,
+				},
+				Service: &modelpb.Service{Name: fmt.Sprintf("svc%d", i%3)},
+			}, ivl)
+			require.NoError(t, err)
+			kcms = append(kcms, KeyedCombinedMetrics{
+				Key: CombinedMetricsKey{
+					Interval:       ivl,
+					ProcessingTime: start,
+					ID:             fmt.Sprintf("id%d", i%2),
+				},
+				Metrics: cm,
+			})
+		}
+	}
+
+	single := make(map[CombinedMetricsKey]CombinedMetrics)
+	singleAgg := newAggregator(t, single)
+	for _, kcm := range kcms {
+		require.NoError(t, singleAgg.AggregateCombinedMetrics(context.Background(), kcm.Key, kcm.Metrics))
+	}
+	require.NoError(t, singleAgg.Flush(context.Background()))
+
+	batched := make(map[CombinedMetricsKey]CombinedMetrics)
+	batchAgg := newAggregator(t, batched)
+	require.NoError(t, batchAgg.AggregateCombinedMetricsBatch(context.Background(), kcms))
+	require.NoError(t, batchAgg.Flush(context.Background()))
+
+	require.Len(t, single, 4)
+	assert.Empty(t, cmp.Diff(single, batched, cmp.Exporter(func(reflect.Type) bool { return true })))
+
+	require.NoError(t, batchAgg.Stop(context.Background()))
+	assert.ErrorIs(t, batchAgg.AggregateCombinedMetricsBatch(context.Background(), kcms), ErrAggregatorStopped)
+}
+
+func TestHarvestConcurrency(t *testing.T) {
+	forEachStore(t, testHarvestConcurrency)
+}
+
+func testHarvestConcurrency(t *testing.T, newStore newStoreFunc) {
+	const concurrency = 3
+	var mu sync.Mutex
+	var inflight, maxInflight int
+	var reached bool
+	allInflight := make(chan struct{})
+	harvested := make(map[string]int)
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore: newStore,
+		Processor: func(_ context.Context, cmk CombinedMetricsKey, _ CombinedMetrics, _ time.Duration) error {
+			mu.Lock()
+			inflight++
+			if inflight > maxInflight {
+				maxInflight = inflight
+			}
+			if inflight == concurrency && !reached {
+				reached = true
+				close(allInflight)
+			}
+			harvested[cmk.ID]++
+			// Fail the first attempt to process some of the combined
+			// metrics to verify they are retried.
+			fail := harvested[cmk.ID] == 1 && strings.HasSuffix(cmk.ID, "7")
+			mu.Unlock()
+
+			// Block until the max number of concurrent processors is
+			// reached to verify the combined metrics are processed
+			// concurrently.
+			select {
+			case <-allInflight:
+			case <-time.After(5 * time.Second):
+			}
+			mu.Lock()
+			inflight--
+			mu.Unlock()
+			if fail {
+				return errors.New("failed to process")
+			}
+			return nil
+		},
+		AggregationIntervals: []time.Duration{time.Minute},
+		HarvestConcurrency:   concurrency,
+	})
+
+	processingTime := time.Now().Truncate(time.Minute)
+	for i := 0; i < 20; i++ {
+		require.NoError(t, agg.AggregateCombinedMetrics(
+			context.Background(),
+			CombinedMetricsKey{
+				Interval:       time.Minute,
+				ProcessingTime: processingTime,
+				ID:             fmt.Sprintf("id%d", i),
+			},
+			CombinedMetrics(*createTestCombinedMetrics(1).
+				addTransaction(processingTime, "svc", "", testTransaction{txnName: "txn", txnType: "type", count: 1})),
+		))
+	}
+	err := agg.Flush(context.Background())
+	assert.ErrorContains(t, err, "failed to process 2 out of 20 metrics")
+	select {
+	case <-allInflight:
+	default:
+		t.Fatal("combined metrics were not processed concurrently")
+	}
+
+	// The failed combined metrics are retried by the next harvest, and
+	// all the combined metrics are processed exactly once successfully.
+	require.NoError(t, agg.Flush(context.Background()))
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, concurrency, maxInflight)
+	require.Len(t, harvested, 20)
+	for id, n := range harvested {
+		if strings.HasSuffix(id, "7") {
+			assert.Equal(t, 2, n, id)
+		} else {
+			assert.Equal(t, 1, n, id)
+		}
+	}
+}
+
+func TestHarvestRetry(t *testing.T) {
+	forEachStore(t, testHarvestRetry)
+}
+
+func testHarvestRetry(t *testing.T, newStore newStoreFunc) {
+	type harvest struct {
+		id             string
+		processingTime time.Time
+	}
+	harvests := make(chan harvest, 10)
+	var fail atomic.Bool
+	fail.Store(true)
+	start := time.Unix(1686000000, 0).Truncate(time.Minute)
+	clk := newFakeClock(start)
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore: newStore,
+		Processor: func(_ context.Context, cmk CombinedMetricsKey, _ CombinedMetrics, _ time.Duration) error {
+			if cmk.ID == "b" && fail.Load() {
+				return errors.New("processor failure")
+			}
+			harvests <- harvest{id: cmk.ID, processingTime: cmk.ProcessingTime}
+			return nil
+		},
+		AggregationIntervals: []time.Duration{time.Second},
+		HarvestDelay:         100 * time.Millisecond,
+		clock:                clk,
+	})
+	aggregate := func(id string) {
+		t.Helper()
+		require.NoError(t, agg.AggregateBatch(context.Background(), id, &modelpb.Batch{
+			makeSpan(start, "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+		}))
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		aggregate(id)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go agg.Run(ctx)
+	defer agg.Stop(context.Background())
+
+	assertHarvests := func(expected ...harvest) {
+		t.Helper()
+		for _, h := range expected {
+			select {
+			case actual := <-harvests:
+				assert.Equal(t, h, actual)
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for harvest")
+			}
+		}
+		select {
+		case h := <-harvests:
+			t.Fatalf("unexpected harvest %+v", h)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	// The processor fails for b, which is retried by the next harvest
+	// along with the metrics aggregated for the next interval, while
+	// a and c are not processed again.
+	clk.Advance(time.Second + 100*time.Millisecond)
+	assertHarvests(harvest{id: "a", processingTime: start}, harvest{id: "c", processingTime: start})
+	// b remains active until it is processed.
+	assert.Eventually(t, func() bool {
+		return agg.active.counts()[time.Second] == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	fail.Store(false)
+	aggregate("d")
+	clk.Advance(time.Second)
+	assertHarvests(harvest{id: "b", processingTime: start}, harvest{id: "d", processingTime: start.Add(time.Second)})
+
+	// Once all the metrics are processed, nothing is retried.
+	clk.Advance(time.Second)
+	assertHarvests()
+	assert.Zero(t, agg.active.counts()[time.Second])
+}
+
+func TestHarvestRetriesExhausted(t *testing.T) {
+	forEachStore(t, testHarvestRetriesExhausted)
+}
+
+func testHarvestRetriesExhausted(t *testing.T, newStore newStoreFunc) {
+	rdr := metric.NewManualReader()
+	attempts := make(map[string]int)
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore: newStore,
+		Processor: func(_ context.Context, cmk CombinedMetricsKey, _ CombinedMetrics, _ time.Duration) error {
+			attempts[cmk.ID]++
+			if cmk.ID == "b" {
+				return errors.New("processor failure")
+			}
+			return nil
+		},
+		AggregationIntervals: []time.Duration{time.Second},
+		MaxHarvestRetries:    2,
+		MeterProvider:        metric.NewMeterProvider(metric.WithReader(rdr)),
+	})
+	for _, id := range []string{"a", "b"} {
+		require.NoError(t, agg.AggregateBatch(context.Background(), id, &modelpb.Batch{
+			makeSpan(time.Now(), "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+		}))
+	}
+
+	// b is processed once and retried twice before being dropped.
+	for i := 0; i < 3; i++ {
+		assert.ErrorContains(t, agg.Flush(context.Background()), "processor failure")
+	}
+	assert.NoError(t, agg.Flush(context.Background()))
+	assert.Equal(t, map[string]int{"a": 1, "b": 3}, attempts)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, rdr.Collect(context.Background(), &rm))
+	var dropped int64
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != "aggregator.harvest.dropped" {
+				continue
+			}
+			for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				dropped += dp.Value
+			}
+		}
+	}
+	assert.Equal(t, int64(1), dropped)
+}
+
+func TestHarvestRetryChunks(t *testing.T) {
+	forEachStore(t, testHarvestRetryChunks)
+}
+
+func testHarvestRetryChunks(t *testing.T, newStore newStoreFunc) {
+	var fail atomic.Bool
+	fail.Store(true)
+	processed := make(map[string]int)
+	var eventsTotal int64
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore: newStore,
+		Processor: func(_ context.Context, _ CombinedMetricsKey, cm CombinedMetrics, _ time.Duration) error {
+			for k := range cm.Services {
+				if k.ServiceName == "svc2" && fail.Load() {
+					return errors.New("processor failure")
+				}
+			}
+			for k := range cm.Services {
+				processed[k.ServiceName]++
+			}
+			eventsTotal += cm.eventsTotal
+			return nil
+		},
+		AggregationIntervals: []time.Duration{time.Second},
+		// Split the combined metrics into a chunk per service.
+		MaxProcessorPayloadBytes: 1,
+	})
+	var batch modelpb.Batch
+	for i := 0; i < 3; i++ {
+		batch = append(batch, makeSpan(
+			time.Now(), fmt.Sprintf("svc%d", i), "java", "dest", "", "", "success", time.Second, 1, nil, nil,
+		))
+	}
+	require.NoError(t, agg.AggregateBatch(context.Background(), "id", &batch))
+
+	// Only the chunk which failed to be processed is retried, the other
+	// chunks are not processed again.
+	assert.ErrorContains(t, agg.Flush(context.Background()), "processor failure")
+	assert.Equal(t, map[string]int{"svc0": 1, "svc1": 1}, processed)
+	fail.Store(false)
+	assert.NoError(t, agg.Flush(context.Background()))
+	assert.Equal(t, map[string]int{"svc0": 1, "svc1": 1, "svc2": 1}, processed)
+	assert.Equal(t, int64(3), eventsTotal)
+}
+
+func TestStopHarvestsRemaining(t *testing.T) {
+	forEachStore(t, testStopHarvestsRemaining)
+}
+
+func testStopHarvestsRemaining(t *testing.T, newStore newStoreFunc) {
+	harvested := make(map[time.Duration]int)
+	ivls := []time.Duration{time.Second, time.Minute}
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore: newStore,
+		Processor: func(_ context.Context, _ CombinedMetricsKey, cm CombinedMetrics, ivl time.Duration) error {
+			harvested[ivl] += len(cm.Services)
+			return nil
+		},
+		AggregationIntervals: ivls,
+	})
+	go agg.Run(context.Background())
+
+	// Aggregate right before stopping, the aggregated metrics must be
+	// harvested for all the aggregation intervals by Stop.
+	require.NoError(t, agg.AggregateBatch(context.Background(), "id", &modelpb.Batch{
+		makeSpan(time.Unix(0, 0), "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+		makeSpan(time.Unix(0, 0), "svc2", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+	}))
+	require.NoError(t, agg.Stop(context.Background()))
+	assert.Equal(t, map[time.Duration]int{time.Second: 2, time.Minute: 2}, harvested)
+}
+
+func TestStopContextDone(t *testing.T) {
+	forEachStore(t, testStopContextDone)
+}
+
+func testStopContextDone(t *testing.T, newStore newStoreFunc) {
+	var harvested []time.Duration
+	var cancel context.CancelFunc
+	ivls := []time.Duration{time.Second, time.Minute, time.Hour}
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore: newStore,
+		Processor: func(_ context.Context, _ CombinedMetricsKey, _ CombinedMetrics, ivl time.Duration) error {
+			harvested = append(harvested, ivl)
+			if cancel != nil {
+				// Simulate the deadline being exceeded while harvesting.
+				cancel()
+			}
+			return nil
+		},
+		AggregationIntervals: ivls,
+	})
+	require.NoError(t, agg.AggregateBatch(context.Background(), "id", &modelpb.Batch{
+		makeSpan(time.Unix(0, 0), "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+	}))
+
+	var ctx context.Context
+	ctx, cancel = context.WithCancel(context.Background())
+	err := agg.Stop(ctx)
+	var incomplete *HarvestIncompleteError
+	require.ErrorAs(t, err, &incomplete)
+	assert.Equal(t, []time.Duration{time.Minute, time.Hour}, incomplete.Intervals)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.EqualError(t, incomplete, "harvest incomplete for aggregation intervals [1m, 60m]: context canceled")
+	assert.Equal(t, []time.Duration{time.Second}, harvested)
+
+	// The aggregated metrics which were not harvested are retained and
+	// harvested when retrying Stop.
+	cancel = nil
+	require.NoError(t, agg.Stop(context.Background()))
+	assert.Equal(t, []time.Duration{time.Second, time.Minute, time.Hour}, harvested)
+}
+
+func TestFlush(t *testing.T) {
+	forEachStore(t, testFlush)
+}
+
+func testFlush(t *testing.T, newStore newStoreFunc) {
+	var eventsHarvested atomic.Int64
+	agg, err := New(AggregatorConfig{
+		NewStore: newStore,
+		DataDir:  t.TempDir(),
+		Limits:   testLimits(),
+		Processor: func(_ context.Context, _ CombinedMetricsKey, cm CombinedMetrics, _ time.Duration) error {
+			eventsHarvested.Add(cm.eventsTotal)
+			return nil
+		},
+		AggregationIntervals: []time.Duration{time.Second},
+	}, zap.NewNop())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go agg.Run(ctx)
+
+	const aggregations = 200
+	g, gctx := errgroup.WithContext(ctx)
+	for i := 0; i < 4; i++ {
+		g.Go(func() error {
+			for j := 0; j < aggregations/4; j++ {
+				if err := agg.AggregateBatch(gctx, "testid", &modelpb.Batch{
+					makeSpan(time.Now(), "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+				}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	g.Go(func() error {
+		for j := 0; j < 20; j++ {
+			if err := agg.Flush(gctx); err != nil {
+				return err
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return nil
+	})
+	require.NoError(t, g.Wait())
+
+	require.NoError(t, agg.Stop(context.Background()))
+	// All the events are harvested exactly once across the flushes, the
+	// harvest loop, and the final harvest.
+	assert.Equal(t, int64(aggregations), eventsHarvested.Load())
+	assert.ErrorIs(t, agg.Flush(context.Background()), ErrAggregatorStopped)
+}
+
+func TestReset(t *testing.T) {
+	forEachStore(t, testReset)
+}
+
+func testReset(t *testing.T, newStore newStoreFunc) {
+	var harvested []CombinedMetrics
+	processing := make(chan struct{})
+	unblock := make(chan struct{})
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore: newStore,
+		Processor: func(_ context.Context, _ CombinedMetricsKey, cm CombinedMetrics, _ time.Duration) error {
+			if cm.eventsTotal == 2 && len(harvested) == 0 {
+				processing <- struct{}{}
+				<-unblock
+			}
+			harvested = append(harvested, cm)
+			return nil
+		},
+		AggregationIntervals: []time.Duration{time.Second, time.Minute},
+	})
+
+	batch := modelpb.Batch{
+		makeSpan(time.Now(), "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+	}
+	require.NoError(t, agg.AggregateBatch(context.Background(), "id1", &batch))
+	require.NoError(t, agg.AggregateBatch(context.Background(), "id2", &batch))
+	snapshot, err := agg.Snapshot(context.Background(), time.Second)
+	require.NoError(t, err)
+	require.Len(t, snapshot, 2)
+	require.NoError(t, agg.AggregateBatch(context.Background(), "id3", &batch))
+	assert.Equal(t, map[time.Duration]int64{time.Second: 3, time.Minute: 3}, agg.active.counts())
+	agg.overflowCardinality.harvested(time.Second, newOverflowCardinalities())
+
+	require.NoError(t, agg.Reset(context.Background()))
+	for _, ivl := range []time.Duration{time.Second, time.Minute} {
+		snapshot, err := agg.Snapshot(context.Background(), ivl)
+		require.NoError(t, err)
+		assert.Empty(t, snapshot)
+	}
+	assert.Empty(t, harvested)
+	// The deleted keys are no longer tracked.
+	assert.Empty(t, agg.active.counts())
+	assert.Empty(t, agg.overflowCardinality.get())
+
+	// Aggregations after the reset are harvested as usual.
+	batch = append(batch, batch[0])
+	require.NoError(t, agg.AggregateBatch(context.Background(), "id1", &batch))
+	flushErr := make(chan error, 1)
+	go func() { flushErr <- agg.Flush(context.Background()) }()
+	<-processing
+	assert.ErrorIs(t, agg.Reset(context.Background()), ErrHarvestInProgress)
+	close(unblock)
+	require.NoError(t, <-flushErr)
+	// One for each aggregation interval.
+	assert.Len(t, harvested, 2)
+
+	require.NoError(t, agg.Stop(context.Background()))
+	assert.ErrorIs(t, agg.Reset(context.Background()), ErrAggregatorStopped)
+}
+
+func TestCompactRange(t *testing.T) {
+	clk := newFakeClock(time.Now())
+	agg := newTestAggregator(t, AggregatorConfig{
+		AggregationIntervals: []time.Duration{time.Second, time.Minute},
+		CompactRangeInterval: time.Minute,
+		// Avoid automatic compactions reclaiming the deleted keys
+		// before the manual compaction.
+		L0CompactionThreshold: 10,
+		clock:                 clk,
+	})
+
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, agg.AggregateBatch(context.Background(), fmt.Sprintf("testid%d", i), &modelpb.Batch{
+			makeSpan(clk.Now(), "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+		}))
+	}
+	// Snapshot commits the pending batch, which is then flushed to an
+	// sstable. The deleted keys of one of the intervals remain on disk
+	// until compacted.
+	_, err := agg.Snapshot(context.Background(), time.Second)
+	require.NoError(t, err)
+	require.NoError(t, agg.stores[0].db.Flush())
+	iter := agg.stores[0].db.NewIter(&pebble.IterOptions{
+		LowerBound: []byte{versionedKeyMarker, CombinedMetricsKeyVersion, 0x00, 0x01},
+		UpperBound: []byte{versionedKeyMarker, CombinedMetricsKeyVersion, 0x00, 0x02},
+	})
+	var deleted int
+	for iter.First(); iter.Valid(); iter.Next() {
+		require.NoError(t, agg.stores[0].db.Delete(iter.Key(), pebble.Sync))
+		deleted++
+	}
+	require.NoError(t, iter.Close())
+	require.Equal(t, 1000, deleted)
+	require.NoError(t, agg.stores[0].db.Flush())
+	before := agg.stores[0].db.Metrics().Total().Size
+	require.Greater(t, before, int64(0))
+
+	clk.Advance(time.Minute)
+	require.NoError(t, agg.CompactRange(context.Background(), time.Second))
+	assert.Less(t, agg.stores[0].db.Metrics().Total().Size, before)
+	snap, err := agg.Snapshot(context.Background(), time.Minute)
+	require.NoError(t, err)
+	assert.Len(t, snap, 1000)
+
+	// Manual compactions are rate limited.
+	clk.Advance(time.Minute - time.Second)
+	assert.ErrorIs(t, agg.CompactRange(context.Background(), time.Second), ErrCompactRangeRateLimited)
+	assert.ErrorIs(t, agg.CompactRange(context.Background(), time.Second), ErrRetryable)
+	assert.EqualError(t, agg.CompactRange(context.Background(), time.Hour), "unknown aggregation interval 1h0m0s")
+
+	require.NoError(t, agg.Stop(context.Background()))
+	clk.Advance(time.Minute)
+	assert.ErrorIs(t, agg.CompactRange(context.Background(), time.Second), ErrAggregatorStopped)
+}
+
+func TestAggregateBatchWeighted(t *testing.T) {
+	forEachStore(t, testAggregateBatchWeighted)
+}
+
+func testAggregateBatchWeighted(t *testing.T, newStore newStoreFunc) {
+	rdr := metric.NewManualReader()
+	var harvested []CombinedMetrics
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore: newStore,
+		Processor: func(_ context.Context, _ CombinedMetricsKey, cm CombinedMetrics, _ time.Duration) error {
+			harvested = append(harvested, cm)
+			return nil
+		},
+		AggregationIntervals: []time.Duration{time.Second},
+		MeterProvider:        metric.NewMeterProvider(metric.WithReader(rdr)),
+	})
+
+	txn := &modelpb.APMEvent{
+		Processor: modelpb.TransactionProcessor(),
+		Service:   &modelpb.Service{Name: "svc1"},
+		Event: &modelpb.Event{
+			Outcome:  "success",
+			Duration: durationpb.New(time.Second),
+		},
+		Transaction: &modelpb.Transaction{
+			Name:                "txn",
+			Type:                "type",
+			RepresentativeCount: 1,
+		},
+	}
+	span := makeSpan(time.Unix(0, 0), "svc1", "", "dest1", "", "", "success", time.Second, 0.5, nil, nil)
+	batch := modelpb.Batch{txn, txn, span}
+	for _, weight := range []float64{0, -1, math.NaN(), math.Inf(1)} {
+		assert.EqualError(t,
+			agg.AggregateBatchWeighted(context.Background(), "id", &batch, weight),
+			fmt.Sprintf("invalid weight %v, weight must be positive", weight),
+		)
+	}
+	require.NoError(t, agg.AggregateBatchWeighted(context.Background(), "id", &batch, 2.5))
+	require.NoError(t, agg.Stop(context.Background()))
+
+	require.Len(t, harvested, 1)
+	require.Len(t, harvested[0].Services, 1)
+	var sim ServiceInstanceMetrics
+	for _, sm := range harvested[0].Services {
+		for _, v := range sm.ServiceInstanceGroups {
+			sim = v
+		}
+	}
+	require.Len(t, sim.TransactionGroups, 1)
+	for _, tm := range sim.TransactionGroups {
+		total, _, _ := tm.Histogram.Buckets()
+		assert.Equal(t, int64(5), total)
+	}
+	require.Len(t, sim.ServiceTransactionGroups, 1)
+	for _, stm := range sim.ServiceTransactionGroups {
+		assert.Equal(t, float64(5), stm.SuccessCount)
+	}
+	require.Len(t, sim.SpanGroups, 1)
+	for _, sm := range sim.SpanGroups {
+		assert.Equal(t, 1.25, sm.Count)
+	}
+	assert.Equal(t, int64(3), harvested[0].eventsTotal)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, rdr.Collect(context.Background(), &rm))
+	var weighted []metricdata.DataPoint[float64]
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name == "aggregator.events.weighted" {
+				weighted = m.Data.(metricdata.Sum[float64]).DataPoints
+			}
+		}
+	}
+	require.Len(t, weighted, 1)
+	assert.Equal(t, 6.25, weighted[0].Value)
+}
+
+func TestAggregateTransactionOutcomes(t *testing.T) {
+	forEachStore(t, testAggregateTransactionOutcomes)
+}
+
+func testAggregateTransactionOutcomes(t *testing.T, newStore newStoreFunc) {
+	start := time.Unix(1686000000, 0).Truncate(time.Minute)
+	makeTxn := func(outcome string) *modelpb.APMEvent {
+		return &modelpb.APMEvent{
+			Timestamp: timestamppb.New(start),
+			Processor: modelpb.TransactionProcessor(),
+			Event:     &modelpb.Event{Outcome: outcome, Duration: durationpb.New(time.Second)},
+			Transaction: &modelpb.Transaction{
+				Name:                "txn",
+				Type:                "type",
+				RepresentativeCount: 1,
 			},
-			getExpectedEvents: func(_ time.Time, _, _ time.Duration, _ int) []*modelpb.APMEvent {
+			Service: &modelpb.Service{Name: "svc"},
+		}
+	}
+	// harvest aggregates the batches separately, to verify that outcome
+	// splits are preserved when merging, and returns the harvested
+	// service metrics.
+	harvest := func(t *testing.T, maxTxnGroupsPerService int, batches ...*modelpb.Batch) ServiceMetrics {
+		var harvested []CombinedMetrics
+		limits := testLimits()
+		limits.MaxTransactionGroupsPerService = maxTxnGroupsPerService
+		agg := newTestAggregator(t, AggregatorConfig{
+			NewStore: newStore,
+			Limits:   limits,
+			Processor: func(_ context.Context, _ CombinedMetricsKey, cm CombinedMetrics, _ time.Duration) error {
+				harvested = append(harvested, cm)
 				return nil
 			},
-		}, {
-			name: "with no destination and a service target",
-			inputs: []input{
-				{serviceName: "service-A", agentName: "java", targetType: trgTypeZ, targetName: trgNameZ, outcome: "success", representativeCount: 1},
-			},
-			getExpectedEvents: func(ts time.Time, duration, ivl time.Duration, count int) []*modelpb.APMEvent {
-				return []*modelpb.APMEvent{
-					{
-						Timestamp: timestamppb.New(ts.Truncate(ivl)),
-						Agent:     &modelpb.Agent{Name: "java"},
-						Service: &modelpb.Service{
-							Name: "service-A",
-						},
-						Processor: modelpb.MetricsetProcessor(),
-						Metricset: &modelpb.Metricset{
-							Name:     "service_summary",
-							Interval: formatDuration(ivl),
-						},
-						Labels:        defaultLabels,
-						NumericLabels: defaultNumericLabels,
-					}, {
-						Timestamp: timestamppb.New(ts.Truncate(ivl)),
-						Agent:     &modelpb.Agent{Name: "java"},
-						Service: &modelpb.Service{
-							Name: "service-A",
-							Target: &modelpb.ServiceTarget{
-								Type: trgTypeZ,
-								Name: trgNameZ,
-							},
-						},
-						Event:     &modelpb.Event{Outcome: "success"},
-						Processor: modelpb.MetricsetProcessor(),
-						Metricset: &modelpb.Metricset{
-							Name:     "service_destination",
-							Interval: formatDuration(ivl),
-							DocCount: int64(count),
-						},
-						Span: &modelpb.Span{
-							Name: "service-A:",
-							DestinationService: &modelpb.DestinationService{
-								ResponseTime: &modelpb.AggregatedDuration{
-									Count: int64(count),
-									Sum:   durationpb.New(time.Duration(count) * duration),
-								},
-							},
-						},
-						Labels:        defaultLabels,
-						NumericLabels: defaultNumericLabels,
-					},
-				}
+			AggregationIntervals: []time.Duration{time.Minute},
+			clock:                newFakeClock(start),
+		})
+
+		for _, batch := range batches {
+			require.NoError(t, agg.AggregateBatch(context.Background(), "testid", batch))
+		}
+		require.NoError(t, agg.Flush(context.Background()))
+		require.Len(t, harvested, 1)
+		require.Len(t, harvested[0].Services, 1)
+		for sk, sm := range harvested[0].Services {
+			assert.Equal(t, "svc", sk.ServiceName)
+			return sm
+		}
+		return ServiceMetrics{}
+	}
+	outcomeCounts := func(svc ServiceMetrics) map[string]int64 {
+		counts := make(map[string]int64)
+		for _, sim := range svc.ServiceInstanceGroups {
+			for tk, tm := range sim.TransactionGroups {
+				total, _, _ := tm.Histogram.Buckets()
+				counts[tk.EventOutcome] += total
+			}
+		}
+		return counts
+	}
+
+	t.Run("split", func(t *testing.T) {
+		svc := harvest(t, 10,
+			&modelpb.Batch{makeTxn("success"), makeTxn("success"), makeTxn("failure")},
+			&modelpb.Batch{makeTxn("success"), makeTxn("unknown")},
+		)
+		assert.Equal(t, map[string]int64{"success": 3, "failure": 1, "unknown": 1}, outcomeCounts(svc))
+		for _, sim := range svc.ServiceInstanceGroups {
+			require.Len(t, sim.ServiceTransactionGroups, 1)
+			for _, stm := range sim.ServiceTransactionGroups {
+				assert.Equal(t, 3.0, stm.SuccessCount)
+				assert.Equal(t, 1.0, stm.FailureCount)
+			}
+		}
+	})
+	t.Run("overflow", func(t *testing.T) {
+		// Each outcome is a separate transaction group, thus, one of the
+		// outcomes exceeds the per service limit and is overflowed.
+		svc := harvest(t, 2,
+			&modelpb.Batch{makeTxn("success"), makeTxn("failure"), makeTxn("unknown")},
+		)
+		assert.Len(t, outcomeCounts(svc), 2)
+		overflowTotal, _, _ := svc.OverflowGroups.OverflowTransaction.Metrics.Histogram.Buckets()
+		assert.Equal(t, int64(1), overflowTotal)
+		assert.Equal(t, int64(1), estimate(svc.OverflowGroups.OverflowTransaction.Estimator))
+	})
+}
+
+func TestAggregateServiceInstances(t *testing.T) {
+	forEachStore(t, testAggregateServiceInstances)
+}
+
+func testAggregateServiceInstances(t *testing.T, newStore newStoreFunc) {
+	start := time.Unix(1686000000, 0).Truncate(time.Minute)
+	makeTxn := func(instance string) *modelpb.APMEvent {
+		e := &modelpb.APMEvent{
+			Timestamp: timestamppb.New(start),
+			Processor: modelpb.TransactionProcessor(),
+			Event:     &modelpb.Event{Outcome: "success", Duration: durationpb.New(time.Second)},
+			Transaction: &modelpb.Transaction{
+				Name:                "txn",
+				Type:                "type",
+				RepresentativeCount: 1,
 			},
-		}, {
-			name: "with a destination and no service target",
-			inputs: []input{
-				{serviceName: "service-A", agentName: "java", destination: destinationZ, outcome: "success", representativeCount: 1},
+			Service: &modelpb.Service{Name: "svc"},
+		}
+		if instance != "" {
+			e.Labels = modelpb.Labels{"instance": {Value: instance, Global: true}}
+		}
+		return e
+	}
+	// harvest aggregates the batches separately, to verify that the
+	// service instances are preserved when merging, and returns the
+	// harvested combined metrics.
+	harvest := func(t *testing.T, maxInstancesPerService int, batches ...*modelpb.Batch) CombinedMetrics {
+		var harvested []CombinedMetrics
+		limits := testLimits()
+		limits.MaxServiceInstanceGroupsPerService = maxInstancesPerService
+		agg := newTestAggregator(t, AggregatorConfig{
+			NewStore: newStore,
+			Limits:   limits,
+			Processor: func(_ context.Context, _ CombinedMetricsKey, cm CombinedMetrics, _ time.Duration) error {
+				harvested = append(harvested, cm)
+				return nil
 			},
-			getExpectedEvents: func(ts time.Time, duration, ivl time.Duration, count int) []*modelpb.APMEvent {
-				return []*modelpb.APMEvent{
-					{
-						Timestamp: timestamppb.New(ts.Truncate(ivl)),
-						Agent:     &modelpb.Agent{Name: "java"},
-						Service: &modelpb.Service{
-							Name: "service-A",
-						},
-						Processor: modelpb.MetricsetProcessor(),
-						Metricset: &modelpb.Metricset{
-							Name:     "service_summary",
-							Interval: formatDuration(ivl),
-						},
-						Labels:        defaultLabels,
-						NumericLabels: defaultNumericLabels,
-					}, {
-						Timestamp: timestamppb.New(ts.Truncate(ivl)),
-						Agent:     &modelpb.Agent{Name: "java"},
-						Service: &modelpb.Service{
-							Name: "service-A",
-						},
-						Event:     &modelpb.Event{Outcome: "success"},
-						Processor: modelpb.MetricsetProcessor(),
-						Metricset: &modelpb.Metricset{
-							Name:     "service_destination",
-							Interval: formatDuration(ivl),
-							DocCount: int64(count),
-						},
-						Span: &modelpb.Span{
-							Name: "service-A:" + destinationZ,
-							DestinationService: &modelpb.DestinationService{
-								Resource: destinationZ,
-								ResponseTime: &modelpb.AggregatedDuration{
-									Count: int64(count),
-									Sum:   durationpb.New(time.Duration(count) * duration),
-								},
-							},
-						},
-						Labels:        defaultLabels,
-						NumericLabels: defaultNumericLabels,
-					},
+			AggregationIntervals: []time.Duration{time.Minute},
+			clock:                newFakeClock(start),
+		})
+
+		for _, batch := range batches {
+			require.NoError(t, agg.AggregateBatch(context.Background(), "testid", batch))
+		}
+		require.NoError(t, agg.Flush(context.Background()))
+		require.Len(t, harvested, 1)
+		require.Len(t, harvested[0].Services, 1)
+		return harvested[0]
+	}
+	instanceCounts := func(cm CombinedMetrics) map[string]int64 {
+		counts := make(map[string]int64)
+		for _, sm := range cm.Services {
+			for sik, sim := range sm.ServiceInstanceGroups {
+				var gl GlobalLabels
+				require.NoError(t, gl.UnmarshalString(sik.GlobalLabelsStr))
+				instance := ""
+				if l, ok := gl.Labels["instance"]; ok {
+					instance = l.Value
 				}
+				for _, tm := range sim.TransactionGroups {
+					total, _, _ := tm.Histogram.Buckets()
+					counts[instance] += total
+				}
+			}
+		}
+		return counts
+	}
+
+	t.Run("split", func(t *testing.T) {
+		// Events without an instance are aggregated into the service
+		// instance with empty global labels.
+		cm := harvest(t, 10,
+			&modelpb.Batch{makeTxn("pod-1"), makeTxn("pod-2"), makeTxn("")},
+			&modelpb.Batch{makeTxn("pod-1"), makeTxn("")},
+		)
+		assert.Equal(t, map[string]int64{"pod-1": 2, "pod-2": 1, "": 2}, instanceCounts(cm))
+		assert.Zero(t, estimate(cm.OverflowServiceInstancesEstimator))
+	})
+	t.Run("overflow", func(t *testing.T) {
+		// The service instances exceeding the per service limit are
+		// aggregated into the overflow buckets of the service. Which of
+		// the instances is kept depends on the order of the merges.
+		cm := harvest(t, 1,
+			&modelpb.Batch{makeTxn("pod-1")},
+			&modelpb.Batch{makeTxn("pod-2"), makeTxn("pod-3")},
+		)
+		counts := instanceCounts(cm)
+		require.Len(t, counts, 1)
+		for instance, count := range counts {
+			assert.Contains(t, []string{"pod-1", "pod-2", "pod-3"}, instance)
+			assert.Equal(t, int64(1), count)
+		}
+		assert.Equal(t, int64(2), estimate(cm.OverflowServiceInstancesEstimator))
+		for _, sm := range cm.Services {
+			overflowTotal, _, _ := sm.OverflowGroups.OverflowTransaction.Metrics.Histogram.Buckets()
+			assert.Equal(t, int64(2), overflowTotal)
+		}
+	})
+}
+
+func TestBytesIngestedByEventType(t *testing.T) {
+	forEachStore(t, testBytesIngestedByEventType)
+}
+
+func testBytesIngestedByEventType(t *testing.T, newStore newStoreFunc) {
+	rdr := metric.NewManualReader()
+	ivls := []time.Duration{time.Second, time.Minute}
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore:             newStore,
+		AggregationIntervals: ivls,
+		MeterProvider:        metric.NewMeterProvider(metric.WithReader(rdr)),
+	})
+
+	ts := time.Unix(0, 0)
+	batch := modelpb.Batch{
+		{
+			Timestamp: timestamppb.New(ts),
+			Processor: modelpb.TransactionProcessor(),
+			Service:   &modelpb.Service{Name: "svc1"},
+			Event:     &modelpb.Event{Outcome: "success", Duration: durationpb.New(time.Second)},
+			Transaction: &modelpb.Transaction{
+				Name:                "txn",
+				Type:                "type",
+				RepresentativeCount: 1,
 			},
 		},
-	} {
-		t.Run(tt.name, func(t *testing.T) {
-			var actualEvents []*modelpb.APMEvent
-			logger, err := zap.NewDevelopment()
-			require.NoError(t, err)
-			aggregationIvls := []time.Duration{time.Minute, 10 * time.Minute, time.Hour}
-			agg, err := New(AggregatorConfig{
-				DataDir: t.TempDir(),
-				Limits: Limits{
-					MaxSpanGroups:                         1000,
-					MaxSpanGroupsPerService:               100,
-					MaxTransactionGroups:                  100,
-					MaxTransactionGroupsPerService:        10,
-					MaxServiceTransactionGroups:           100,
-					MaxServiceTransactionGroupsPerService: 10,
-					MaxServices:                           10,
-					MaxServiceInstanceGroupsPerService:    10,
-				},
-				Processor:            sliceProcessor(&actualEvents),
-				AggregationIntervals: aggregationIvls,
-			}, logger)
+		makeSpan(ts, "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+		makeSpan(ts, "svc2", "java", "dest2", "", "", "failure", time.Second, 1, nil, nil),
+		{
+			Timestamp: timestamppb.New(ts),
+			Processor: modelpb.MetricsetProcessor(),
+			Service:   &modelpb.Service{Name: "svc3"},
+		},
+	}
+	require.NoError(t, agg.AggregateBatch(context.Background(), "id", &batch))
+
+	// The bytes ingested are the encoded sizes of the combined metrics
+	// aggregated for each event and aggregation interval.
+	expected := make(map[string]int64)
+	for _, e := range batch {
+		for _, ivl := range ivls {
+			cm, err := EventToCombinedMetrics(e, ivl)
 			require.NoError(t, err)
+			expected[eventType(e)] += int64(cm.ToProto().SizeVT())
+		}
+	}
+	require.Len(t, expected, 3)
 
-			count := 100
-			now := time.Now()
-			duration := 100 * time.Millisecond
-			for _, in := range tt.inputs {
-				span := makeSpan(
-					now,
-					in.serviceName,
-					in.agentName,
-					in.destination,
-					in.targetType,
-					in.targetName,
-					in.outcome,
-					duration,
-					in.representativeCount,
-					defaultLabels,
-					defaultNumericLabels,
-				)
-				for i := 0; i < count; i++ {
-					err := agg.AggregateBatch(context.Background(), "testid", &modelpb.Batch{span})
-					require.NoError(t, err)
-				}
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, rdr.Collect(context.Background(), &rm))
+	actual := make(map[string]int64)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != "aggregator.bytes.ingested" {
+				continue
+			}
+			for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				typ, ok := dp.Attributes.Value(telemetry.EventTypeKey)
+				require.True(t, ok)
+				actual[typ.AsString()] += dp.Value
+			}
+		}
+	}
+	assert.Equal(t, expected, actual)
+	assert.Contains(t, actual, "transaction")
+	assert.Contains(t, actual, "span")
+	assert.Contains(t, actual, "metric")
+}
+
+func TestHistogramSignificantFigures(t *testing.T) {
+	forEachStore(t, testHistogramSignificantFigures)
+}
+
+func testHistogramSignificantFigures(t *testing.T, newStore newStoreFunc) {
+	for _, tc := range []struct {
+		significantFigures int
+		expectedBuckets    int
+	}{
+		{significantFigures: 0, expectedBuckets: 16}, // default of 2
+		{significantFigures: 1, expectedBuckets: 3},
+		{significantFigures: 2, expectedBuckets: 16},
+		{significantFigures: 3, expectedBuckets: 100},
+	} {
+		t.Run(fmt.Sprintf("significant_figures_%d", tc.significantFigures), func(t *testing.T) {
+			var harvested []CombinedMetrics
+			agg := newTestAggregator(t, AggregatorConfig{
+				NewStore: newStore,
+				Processor: func(_ context.Context, _ CombinedMetricsKey, cm CombinedMetrics, _ time.Duration) error {
+					harvested = append(harvested, cm)
+					return nil
+				},
+				AggregationIntervals:        []time.Duration{time.Minute},
+				HistogramSignificantFigures: tc.significantFigures,
+			})
+
+			var batch modelpb.Batch
+			for v := 1000; v < 1100; v++ {
+				batch = append(batch, &modelpb.APMEvent{
+					Processor: modelpb.TransactionProcessor(),
+					Service:   &modelpb.Service{Name: "svc1"},
+					Event: &modelpb.Event{
+						Outcome:  "success",
+						Duration: durationpb.New(time.Duration(v) * time.Microsecond),
+					},
+					Transaction: &modelpb.Transaction{
+						Name:                "txn",
+						Type:                "type",
+						RepresentativeCount: 1,
+					},
+				})
 			}
+			require.NoError(t, agg.AggregateBatch(context.Background(), "id", &batch))
 			require.NoError(t, agg.Stop(context.Background()))
-			var expectedEvents []*modelpb.APMEvent
-			for _, ivl := range aggregationIvls {
-				expectedEvents = append(expectedEvents, tt.getExpectedEvents(now, duration, ivl, count)...)
+
+			require.Len(t, harvested, 1)
+			for _, sm := range harvested[0].Services {
+				for _, sim := range sm.ServiceInstanceGroups {
+					require.Len(t, sim.TransactionGroups, 1)
+					for _, tm := range sim.TransactionGroups {
+						total, counts, _ := tm.Histogram.Buckets()
+						assert.Equal(t, int64(100), total)
+						assert.Len(t, counts, tc.expectedBuckets)
+					}
+					require.Len(t, sim.ServiceTransactionGroups, 1)
+					for _, stm := range sim.ServiceTransactionGroups {
+						total, counts, _ := stm.Histogram.Buckets()
+						assert.Equal(t, int64(100), total)
+						assert.Len(t, counts, tc.expectedBuckets)
+					}
+				}
 			}
-			sortKey := func(e *modelpb.APMEvent) string {
-				var sb strings.Builder
-				sb.WriteString(e.GetService().GetName())
-				sb.WriteString(e.GetAgent().GetName())
-				sb.WriteString(e.GetMetricset().GetName())
-				sb.WriteString(e.GetMetricset().GetInterval())
-				destSvc := e.GetSpan().GetDestinationService()
-				if destSvc != nil {
-					sb.WriteString(destSvc.GetResource())
+		})
+	}
+}
+
+func TestEventsRejected(t *testing.T) {
+	forEachStore(t, testEventsRejected)
+}
+
+func testEventsRejected(t *testing.T, newStore newStoreFunc) {
+	rdr := metric.NewManualReader()
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore:             newStore,
+		AggregationIntervals: []time.Duration{time.Second, time.Minute},
+		MeterProvider:        metric.NewMeterProvider(metric.WithReader(rdr)),
+	})
+
+	batch := modelpb.Batch{
+		makeSpan(time.Now(), "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+		nil,
+		{Processor: modelpb.TransactionProcessor()},
+		{Processor: modelpb.SpanProcessor()},
+		makeSpan(time.Now(), "svc1", "java", "dest1", "", "", "success", time.Second, math.NaN(), nil, nil),
+		makeSpan(time.Now(), "svc1", "java", "dest1", "", "", "success", time.Second, -1, nil, nil),
+	}
+	result, err := agg.AggregateBatchWithResult(context.Background(), "id", &batch)
+	require.NoError(t, err)
+	assert.Equal(t, []EventStatus{
+		EventAccepted, EventRejected, EventRejected, EventRejected, EventRejected, EventRejected,
+	}, result.Statuses)
+	assert.EqualError(t, result.Errors[1], "event is missing")
+	assert.EqualError(t, result.Errors[2], "transaction event is missing the transaction field")
+	assert.EqualError(t, result.Errors[3], "span event is missing the span field")
+	assert.EqualError(t, result.Errors[4], "invalid representative count NaN")
+	assert.EqualError(t, result.Errors[5], "invalid representative count -1")
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, rdr.Collect(context.Background(), &rm))
+	rejected := make(map[attribute.Set]int64)
+	var requestsFailed bool
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			switch m.Name {
+			case "aggregator.events.rejected":
+				for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+					rejected[dp.Attributes] = dp.Value
 				}
-				target := e.GetService().GetTarget()
-				if target != nil {
-					sb.WriteString(target.GetName())
-					sb.WriteString(target.GetType())
+			case "aggregator.requests.failed":
+				requestsFailed = true
+			}
+		}
+	}
+	// Rejections are not failures.
+	assert.False(t, requestsFailed)
+	expected := make(map[attribute.Set]int64)
+	for _, ivl := range []time.Duration{time.Second, time.Minute} {
+		for reason, count := range map[string]int64{
+			"missing_event":                1,
+			"missing_required_field":       2,
+			"invalid_representative_count": 2,
+		} {
+			expected[telemetry.AggregationIntervalAttrSet(ivl,
+				attribute.String(telemetry.RejectReasonKey, reason),
+			)] = count
+		}
+	}
+	assert.Equal(t, expected, rejected)
+}
+
+func TestEventFilter(t *testing.T) {
+	forEachStore(t, testEventFilter)
+}
+
+func testEventFilter(t *testing.T, newStore newStoreFunc) {
+	rdr := metric.NewManualReader()
+	var harvested []CombinedMetrics
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore: newStore,
+		Processor: func(_ context.Context, _ CombinedMetricsKey, cm CombinedMetrics, _ time.Duration) error {
+			harvested = append(harvested, cm)
+			return nil
+		},
+		AggregationIntervals: []time.Duration{time.Second, time.Minute},
+		MeterProvider:        metric.NewMeterProvider(metric.WithReader(rdr)),
+		EventFilter: func(e *modelpb.APMEvent) bool {
+			return e.GetTransaction().GetName() != "healthcheck"
+		},
+	})
+
+	txn := func(name string) *modelpb.APMEvent {
+		return &modelpb.APMEvent{
+			Processor: modelpb.TransactionProcessor(),
+			Event:     &modelpb.Event{Duration: durationpb.New(time.Millisecond)},
+			Transaction: &modelpb.Transaction{
+				Name:                name,
+				Type:                "type",
+				RepresentativeCount: 1,
+			},
+			Service: &modelpb.Service{Name: "svc"},
+		}
+	}
+	batch := modelpb.Batch{txn("healthcheck"), txn("checkout"), nil, txn("healthcheck")}
+	result, err := agg.AggregateBatchWithResult(context.Background(), "id", &batch)
+	require.NoError(t, err)
+	assert.Equal(t, []EventStatus{
+		EventFiltered, EventAccepted, EventRejected, EventFiltered,
+	}, result.Statuses)
+	assert.NoError(t, result.Errors[0])
+	assert.NoError(t, result.Errors[1])
+	assert.EqualError(t, result.Errors[2], "event is missing")
+	assert.NoError(t, result.Errors[3])
+	require.NoError(t, agg.AggregateBatch(context.Background(), "id", &modelpb.Batch{txn("healthcheck")}))
+
+	require.NoError(t, agg.Flush(context.Background()))
+	require.Len(t, harvested, 2)
+	for _, cm := range harvested {
+		var txnNames []string
+		for _, sm := range cm.Services {
+			for _, sim := range sm.ServiceInstanceGroups {
+				for tk := range sim.TransactionGroups {
+					txnNames = append(txnNames, tk.TransactionName)
 				}
-				sb.WriteString(e.GetEvent().GetOutcome())
-				return sb.String()
 			}
-			sort.Slice(expectedEvents, func(i, j int) bool {
-				return sortKey(expectedEvents[i]) < sortKey(expectedEvents[j])
-			})
-			sort.Slice(actualEvents, func(i, j int) bool {
-				return sortKey(actualEvents[i]) < sortKey(actualEvents[j])
-			})
-			assert.Empty(t, cmp.Diff(
-				expectedEvents, actualEvents,
-				cmpopts.EquateEmpty(),
-				cmpopts.IgnoreTypes(netip.Addr{}),
-				protocmp.Transform(),
-			))
-		})
+		}
+		assert.Equal(t, []string{"checkout"}, txnNames)
+	}
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, rdr.Collect(context.Background(), &rm))
+	filtered := make(map[attribute.Set]int64)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != "aggregator.events.filtered" {
+				continue
+			}
+			for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				filtered[dp.Attributes] = dp.Value
+			}
+		}
 	}
+	assert.Equal(t, map[attribute.Set]int64{
+		telemetry.AggregationIntervalAttrSet(time.Second): 3,
+		telemetry.AggregationIntervalAttrSet(time.Minute): 3,
+	}, filtered)
 }
 
-func TestCombinedMetricsKeyOrdered(t *testing.T) {
-	// To Allow for retrieving combined metrics by time range, the metrics should
-	// be ordered by processing time.
-	ts := time.Now().Add(-time.Hour)
-	ivl := time.Minute
+func TestRouteByEventTimestamp(t *testing.T) {
+	forEachStore(t, testRouteByEventTimestamp)
+}
 
-	before := CombinedMetricsKey{
-		ProcessingTime: ts.Truncate(time.Minute),
-		Interval:       ivl,
-		ID:             "cm01",
+func testRouteByEventTimestamp(t *testing.T, newStore newStoreFunc) {
+	start := time.Unix(1686000000, 0).Truncate(10 * time.Minute)
+	clk := newFakeClock(start.Add(90 * time.Second))
+	rdr := metric.NewManualReader()
+	harvested := make(map[CombinedMetricsKey][]string)
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore: newStore,
+		Processor: func(_ context.Context, cmk CombinedMetricsKey, cm CombinedMetrics, _ time.Duration) error {
+			for _, sm := range cm.Services {
+				for _, sim := range sm.ServiceInstanceGroups {
+					for tk := range sim.TransactionGroups {
+						harvested[cmk] = append(harvested[cmk], tk.TransactionName)
+					}
+				}
+			}
+			sort.Strings(harvested[cmk])
+			return nil
+		},
+		AggregationIntervals:  []time.Duration{time.Minute, 10 * time.Minute},
+		MeterProvider:         metric.NewMeterProvider(metric.WithReader(rdr)),
+		RouteByEventTimestamp: true,
+		clock:                 clk,
+	})
+
+	txn := func(name string, ts time.Time) *modelpb.APMEvent {
+		return &modelpb.APMEvent{
+			Timestamp: timestamppb.New(ts),
+			Processor: modelpb.TransactionProcessor(),
+			Event:     &modelpb.Event{Duration: durationpb.New(time.Millisecond)},
+			Transaction: &modelpb.Transaction{
+				Name:                name,
+				Type:                "type",
+				RepresentativeCount: 1,
+			},
+			Service: &modelpb.Service{Name: "svc"},
+		}
 	}
-	marshaledBufferSize := before.SizeBinary()
-	beforeBytes := make([]byte, marshaledBufferSize)
-	afterBytes := make([]byte, marshaledBufferSize)
+	// The processing time of the minute interval remains start+1m, as the
+	// harvest is delayed, while the clock advances to the next minute.
+	clk.Advance(time.Minute)
+	batch := modelpb.Batch{
+		txn("next", start.Add(130*time.Second)),
+		txn("delayed", start.Add(80*time.Second)),
+		txn("future", start.Add(5*time.Minute)),
+		txn("harvested", start.Add(30*time.Second)),
+		txn("previous", start.Add(-time.Minute)),
+	}
+	require.NoError(t, agg.AggregateBatch(context.Background(), "id", &batch))
+	require.NoError(t, agg.Flush(context.Background()))
 
-	for i := 0; i < 10; i++ {
-		ts = ts.Add(time.Minute)
-		after := CombinedMetricsKey{
-			ProcessingTime: ts.Truncate(time.Minute),
-			Interval:       ivl,
-			// combined metrics ID shouldn't matter. Keep length to be
-			// 5 to ensure it is within expected bounds of the
-			// sized buffer.
-			ID: fmt.Sprintf("cm%02d", rand.Intn(100)),
+	key := func(ivl time.Duration, pt time.Time) CombinedMetricsKey {
+		return CombinedMetricsKey{Interval: ivl, ProcessingTime: pt, ID: "id"}
+	}
+	assert.Equal(t, map[CombinedMetricsKey][]string{
+		key(time.Minute, start.Add(time.Minute)):   {"delayed"},
+		key(time.Minute, start.Add(2*time.Minute)): {"future", "next"},
+		key(10*time.Minute, start):                 {"delayed", "future", "harvested", "next"},
+	}, harvested)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, rdr.Collect(context.Background(), &rm))
+	tooLate := make(map[attribute.Set]int64)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != "aggregator.events.too-late" {
+				continue
+			}
+			for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				tooLate[dp.Attributes] = dp.Value
+			}
 		}
-		require.NoError(t, after.MarshalBinaryToSizedBuffer(afterBytes))
-		require.NoError(t, before.MarshalBinaryToSizedBuffer(beforeBytes))
+	}
+	assert.Equal(t, map[attribute.Set]int64{
+		telemetry.AggregationIntervalAttrSet(time.Minute):      2,
+		telemetry.AggregationIntervalAttrSet(10 * time.Minute): 1,
+	}, tooLate)
+}
 
-		// before should always come first
-		assert.Equal(t, -1, pebble.DefaultComparer.Compare(beforeBytes, afterBytes))
+func TestHarvestOrder(t *testing.T) {
+	forEachStore(t, testHarvestOrder)
+}
 
-		before = after
+func testHarvestOrder(t *testing.T, newStore newStoreFunc) {
+	type harvest struct {
+		ivl time.Duration
+		id  string
+	}
+	var harvested []harvest
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore: newStore,
+		Processor: func(_ context.Context, cmk CombinedMetricsKey, _ CombinedMetrics, ivl time.Duration) error {
+			harvested = append(harvested, harvest{ivl: ivl, id: cmk.ID})
+			return nil
+		},
+		AggregationIntervals: []time.Duration{time.Second, time.Minute},
+	})
+
+	ids := []string{"b", "ab", "a", "c", "B", "aa"}
+	for _, id := range ids {
+		require.NoError(t, agg.AggregateBatch(context.Background(), id, &modelpb.Batch{
+			makeSpan(time.Now(), "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+		}))
 	}
+	require.NoError(t, agg.Flush(context.Background()))
+
+	var expected []harvest
+	for _, ivl := range []time.Duration{time.Second, time.Minute} {
+		for _, id := range []string{"B", "a", "aa", "ab", "b", "c"} {
+			expected = append(expected, harvest{ivl: ivl, id: id})
+		}
+	}
+	assert.Equal(t, expected, harvested)
 }
 
-func TestHarvest(t *testing.T) {
-	logger, err := zap.NewDevelopment()
-	require.NoError(t, err)
-	cmCount := 5
-	ivls := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}
-	m := make(map[time.Duration]map[string]bool)
-	processorDone := make(chan struct{})
-	processor := func(
-		_ context.Context,
-		cmk CombinedMetricsKey,
-		cm CombinedMetrics,
-		ivl time.Duration,
-	) error {
-		cmMap, ok := m[ivl]
-		if !ok {
-			m[ivl] = make(map[string]bool)
-			cmMap = m[ivl]
+func TestMergeBatchWindow(t *testing.T) {
+	forEachStore(t, testMergeBatchWindow)
+}
+
+func testMergeBatchWindow(t *testing.T, newStore newStoreFunc) {
+	newAggregator := func(t *testing.T, clk clock, window time.Duration, processor Processor) *Aggregator {
+		return newTestAggregator(t, AggregatorConfig{
+			NewStore:             newStore,
+			Processor:            processor,
+			AggregationIntervals: []time.Duration{time.Second, time.Minute},
+			MergeBatchWindow:     window,
+			clock:                clk,
+		})
+	}
+
+	t.Run("equal_to_individual_merges", func(t *testing.T) {
+		start := time.Unix(0, 0).UTC()
+		harvest := func(window time.Duration) map[CombinedMetricsKey]CombinedMetrics {
+			harvested := make(map[CombinedMetricsKey]CombinedMetrics)
+			agg := newAggregator(t, newFakeClock(start), window, func(
+				_ context.Context, cmk CombinedMetricsKey, cm CombinedMetrics, _ time.Duration,
+			) error {
+				harvested[cmk] = cm
+				return nil
+			})
+			for i := 0; i < 10; i++ {
+				for _, id := range []string{"id1", "id2"} {
+					require.NoError(t, agg.AggregateBatch(context.Background(), id, &modelpb.Batch{
+						makeSpan(start, "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+						makeSpan(start, "svc2", "java", fmt.Sprintf("dest%d", i), "", "", "failure", time.Millisecond, 1, nil, nil),
+						makeSpan(start, "svc3", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+						{
+							Processor:   modelpb.TransactionProcessor(),
+							Event:       &modelpb.Event{Duration: durationpb.New(time.Duration(i) * time.Millisecond)},
+							Transaction: &modelpb.Transaction{Name: "txn", Type: "type", RepresentativeCount: 1},
+							Service:     &modelpb.Service{Name: "svc1"},
+						},
+					}))
+				}
+			}
+			require.NoError(t, agg.Stop(context.Background()))
+			return harvested
 		}
-		// For each unique interval, we should only have a single combined metrics ID
-		if _, ok := cmMap[cmk.ID]; ok {
-			assert.FailNow(t, "duplicate combined metrics ID found")
+
+		// The overflows depend on the order of the merges, which is not
+		// defined for the merges done by pebble, thus, the limits are not
+		// reached.
+		expected := harvest(0)
+		require.Len(t, expected, 4)
+		assert.Empty(t, cmp.Diff(expected, harvest(time.Hour), cmp.Exporter(func(reflect.Type) bool { return true })))
+	})
+
+	t.Run("window_elapsed", func(t *testing.T) {
+		clk := newFakeClock(time.Now())
+		agg := newAggregator(t, clk, time.Second, noOpProcessor())
+		batch := modelpb.Batch{
+			makeSpan(clk.Now(), "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
 		}
-		cmMap[cmk.ID] = true
-		// For successful harvest, all combined metrics IDs foreach interval should be
-		// harvested
-		if len(m) == len(ivls) {
-			var remaining bool
-			for k := range m {
-				if len(m[k]) != cmCount {
-					remaining = true
+		require.NoError(t, agg.AggregateBatch(context.Background(), "testid", &batch))
+		require.NoError(t, agg.AggregateBatch(context.Background(), "testid", &batch))
+		assert.Nil(t, agg.stores[0].batch)
+		assert.Len(t, agg.mergeBatch.pending, 2) // one per aggregation interval
+
+		// The aggregation to the first interval, after the window elapsed,
+		// writes the coalesced aggregations as one merge operand per key.
+		clk.Advance(time.Second)
+		require.NoError(t, agg.AggregateBatch(context.Background(), "testid", &batch))
+		assert.NotNil(t, agg.stores[0].batch)
+		assert.Equal(t, 2, batchCount(agg.stores[0].batch))
+		assert.Len(t, agg.mergeBatch.pending, 1)
+
+		// Snapshot writes the coalesced aggregations before reading.
+		require.NoError(t, agg.AggregateBatch(context.Background(), "testid", &batch))
+		snapshot, err := agg.Snapshot(context.Background(), time.Second)
+		require.NoError(t, err)
+		require.Len(t, snapshot, 1)
+		assert.Equal(t, int64(4), snapshot[0].EventsTotal)
+	})
+
+	t.Run("window_elapsed_idle", func(t *testing.T) {
+		clk := newFakeClock(time.Now().Truncate(time.Second))
+		agg := newAggregator(t, clk, 100*time.Millisecond, noOpProcessor())
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go agg.Run(ctx)
+		// Wait for the harvest and merge batch timers of Run.
+		require.Eventually(t, func() bool {
+			clk.mu.Lock()
+			defer clk.mu.Unlock()
+			return len(clk.timers) == 2
+		}, 5*time.Second, 10*time.Millisecond)
+
+		batch := modelpb.Batch{
+			makeSpan(clk.Now(), "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+		}
+		require.NoError(t, agg.AggregateBatch(context.Background(), "testid", &batch))
+
+		// Run writes the coalesced aggregations once the window elapses,
+		// without any further aggregations.
+		clk.Advance(100 * time.Millisecond)
+		assert.Eventually(t, func() bool {
+			agg.mu.Lock()
+			defer agg.mu.Unlock()
+			return len(agg.mergeBatch.pending) == 0 && agg.stores[0].batch != nil
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestMergeBatchMaxBytes(t *testing.T) {
+	forEachStore(t, testMergeBatchMaxBytes)
+}
+
+func testMergeBatchMaxBytes(t *testing.T, newStore newStoreFunc) {
+	clk := newFakeClock(time.Now())
+	rdr := metric.NewManualReader()
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore:             newStore,
+		AggregationIntervals: []time.Duration{time.Minute},
+		MergeBatchWindow:     time.Hour,
+		MergeBatchMaxBytes:   1024,
+		MeterProvider:        metric.NewMeterProvider(metric.WithReader(rdr)),
+		clock:                clk,
+	})
+
+	collect := func() (keys, bytes, forcedFlushes int64) {
+		var rm metricdata.ResourceMetrics
+		require.NoError(t, rdr.Collect(context.Background(), &rm))
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				switch m.Name {
+				case "aggregator.merge-batch.keys":
+					keys = m.Data.(metricdata.Gauge[int64]).DataPoints[0].Value
+				case "aggregator.merge-batch.bytes":
+					bytes = m.Data.(metricdata.Gauge[int64]).DataPoints[0].Value
+				case "aggregator.merge-batch.forced-flushes":
+					forcedFlushes = m.Data.(metricdata.Sum[int64]).DataPoints[0].Value
+				}
+			}
+		}
+		return keys, bytes, forcedFlushes
+	}
+
+	// The gauges track the buffered aggregations until the buffered bytes
+	// exceed the limit, which forces the merge batch to be flushed.
+	var prevBytes int64
+	var flushed bool
+	for i := 0; i < 100 && !flushed; i++ {
+		require.NoError(t, agg.AggregateBatch(context.Background(), fmt.Sprintf("testid%d", i%2), &modelpb.Batch{
+			makeSpan(clk.Now(), "svc1", "java", fmt.Sprintf("dest%d", i), "", "", "success", time.Second, 1, nil, nil),
+		}))
+		keys, bytes, forcedFlushes := collect()
+		if forcedFlushes > 0 {
+			assert.Equal(t, int64(1), forcedFlushes)
+			assert.Zero(t, keys)
+			assert.Zero(t, bytes)
+			assert.Empty(t, agg.mergeBatch.pending)
+			assert.NotNil(t, agg.stores[0].batch)
+			flushed = true
+			continue
+		}
+		// One key per combined metrics ID.
+		assert.Equal(t, int64(len(agg.mergeBatch.pending)), keys)
+		assert.LessOrEqual(t, keys, int64(2))
+		assert.Greater(t, bytes, prevBytes)
+		assert.LessOrEqual(t, bytes, int64(1024))
+		assert.Nil(t, agg.stores[0].batch)
+		prevBytes = bytes
+	}
+	assert.True(t, flushed, "merge batch must be flushed once the limit is exceeded")
+}
+
+func TestOverflowEstimatedCardinality(t *testing.T) {
+	forEachStore(t, testOverflowEstimatedCardinality)
+}
+
+func testOverflowEstimatedCardinality(t *testing.T, newStore newStoreFunc) {
+	// The relative standard error of HyperLogLog is 1.04/sqrt(2^precision),
+	// the estimates must be within 3 standard errors.
+	for _, tc := range []struct {
+		precision int
+		maxError  float64
+	}{
+		{precision: 0, maxError: 3 * 1.04 / math.Sqrt(1<<14)},
+		{precision: 14, maxError: 3 * 1.04 / math.Sqrt(1<<14)},
+		{precision: 16, maxError: 3 * 1.04 / math.Sqrt(1<<16)},
+	} {
+		t.Run(fmt.Sprintf("precision_%d", tc.precision), func(t *testing.T) {
+			rdr := metric.NewManualReader()
+			limits := testLimits()
+			limits.MaxTransactionGroups = 10
+			agg := newTestAggregator(t, AggregatorConfig{
+				NewStore:                   newStore,
+				Limits:                     limits,
+				AggregationIntervals:       []time.Duration{time.Minute},
+				OverflowEstimatorPrecision: tc.precision,
+				MeterProvider:              metric.NewMeterProvider(metric.WithReader(rdr)),
+			})
+
+			// Each transaction group is aggregated by a separate batch so
+			// that the groups are merged, and overflowed, by pebble.
+			const txnGroups = 20000
+			const overflowed = txnGroups - 10
+			for i := 0; i < txnGroups; i++ {
+				require.NoError(t, agg.AggregateBatch(context.Background(), "testid", &modelpb.Batch{{
+					Processor: modelpb.TransactionProcessor(),
+					Event:     &modelpb.Event{Duration: durationpb.New(time.Millisecond)},
+					Transaction: &modelpb.Transaction{
+						Name:                fmt.Sprintf("txn%d", i),
+						Type:                "type",
+						RepresentativeCount: 1,
+					},
+					Service: &modelpb.Service{Name: "svc"},
+				}}))
+			}
+			require.NoError(t, agg.Flush(context.Background()))
+
+			var rm metricdata.ResourceMetrics
+			require.NoError(t, rdr.Collect(context.Background(), &rm))
+			cardinality := make(map[string]int64)
+			for _, sm := range rm.ScopeMetrics {
+				for _, m := range sm.Metrics {
+					if m.Name != "aggregator.overflow.estimated-cardinality" {
+						continue
+					}
+					for _, dp := range m.Data.(metricdata.Gauge[int64]).DataPoints {
+						typ, _ := dp.Attributes.Value(telemetry.OverflowTypeKey)
+						cardinality[typ.AsString()] = dp.Value
+					}
+				}
+			}
+			assert.InEpsilon(t, overflowed, cardinality["transaction"], tc.maxError)
+			assert.Equal(t, map[string]int64{
+				"service":             0,
+				"transaction":         cardinality["transaction"],
+				"service_transaction": 0,
+				"span":                0,
+				"span_destination":    0,
+			}, cardinality)
+		})
+	}
+}
+
+func TestOverflowEstimatorSalt(t *testing.T) {
+	salt := func(id []byte) uint64 {
+		return xxhash.Sum64String("salt-" + string(id))
+	}
+	overflowEstimators := func(t *testing.T, salt func([]byte) uint64) [][]byte {
+		limits := testLimits()
+		limits.MaxServices = 1
+		agg := newTestAggregator(t, AggregatorConfig{
+			Limits:                limits,
+			AggregationIntervals:  []time.Duration{time.Minute},
+			OverflowEstimatorSalt: salt,
+		})
+		// The tenants aggregate the same services, overflowing the
+		// second one.
+		for _, id := range []string{"tenant-1", "tenant-2"} {
+			for _, svc := range []string{"svc1", "svc2"} {
+				batch := modelpb.Batch{
+					makeSpan(time.Now(), svc, "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
 				}
+				require.NoError(t, agg.AggregateBatch(context.Background(), id, &batch))
 			}
-			if !remaining {
-				close(processorDone)
+		}
+		snap, err := agg.Snapshot(context.Background(), time.Minute)
+		require.NoError(t, err)
+		require.Len(t, snap, 2)
+		estimators := make([][]byte, len(snap))
+		for i, pb := range snap {
+			var cm CombinedMetrics
+			cm.FromProto(pb)
+			require.NotNil(t, cm.OverflowServices.OverflowSpan.Estimator)
+			estimators[i], err = cm.OverflowServices.OverflowSpan.Estimator.MarshalBinary()
+			require.NoError(t, err)
+		}
+		return estimators
+	}
+
+	t.Run("default", func(t *testing.T) {
+		estimators := overflowEstimators(t, nil)
+		assert.Equal(t, estimators[0], estimators[1])
+	})
+	t.Run("salted", func(t *testing.T) {
+		estimators := overflowEstimators(t, salt)
+		assert.NotEqual(t, estimators[0], estimators[1])
+	})
+}
+
+func TestHistogramsMemory(t *testing.T) {
+	forEachStore(t, testHistogramsMemory)
+}
+
+func testHistogramsMemory(t *testing.T, newStore newStoreFunc) {
+	rdr := metric.NewManualReader()
+	limits := testLimits()
+	limits.MaxTransactionGroupsPerService = 100
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore:             newStore,
+		Limits:               limits,
+		AggregationIntervals: []time.Duration{time.Minute},
+		MeterProvider:        metric.NewMeterProvider(metric.WithReader(rdr)),
+	})
+
+	histogramsMemory := func() int64 {
+		var rm metricdata.ResourceMetrics
+		require.NoError(t, rdr.Collect(context.Background(), &rm))
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				if m.Name != "aggregator.histograms.memory" {
+					continue
+				}
+				for _, dp := range m.Data.(metricdata.Gauge[int64]).DataPoints {
+					assert.Equal(t, telemetry.AggregationIntervalAttrSet(time.Minute), dp.Attributes)
+					return dp.Value
+				}
 			}
 		}
-		return nil
+		return 0
 	}
-	gatherer, err := apmotel.NewGatherer()
+
+	// 50 transaction groups and a service transaction group, each with
+	// two recorded durations.
+	const txnGroups = 50
+	for i := 0; i < 2; i++ {
+		var batch modelpb.Batch
+		for j := 0; j < txnGroups; j++ {
+			batch = append(batch, &modelpb.APMEvent{
+				Processor: modelpb.TransactionProcessor(),
+				Event: &modelpb.Event{
+					Outcome:  "success",
+					Duration: durationpb.New(time.Duration(i+1) * time.Second),
+				},
+				Transaction: &modelpb.Transaction{
+					Name:                fmt.Sprintf("txn%d", j),
+					Type:                "type",
+					RepresentativeCount: 1,
+				},
+				Service: &modelpb.Service{Name: "svc"},
+			})
+		}
+		require.NoError(t, agg.AggregateBatch(context.Background(), "testid", &batch))
+	}
+	// The estimate is updated once the aggregated metrics are merged.
+	_, err := agg.Snapshot(context.Background(), time.Minute)
 	require.NoError(t, err)
 
-	agg, err := New(AggregatorConfig{
-		DataDir: t.TempDir(),
-		Limits: Limits{
-			MaxSpanGroups:                         1000,
-			MaxTransactionGroups:                  100,
-			MaxTransactionGroupsPerService:        10,
-			MaxServiceTransactionGroups:           100,
-			MaxServiceTransactionGroupsPerService: 10,
-			MaxServices:                           10,
-			MaxServiceInstanceGroupsPerService:    10,
-		},
-		Processor:            processor,
-		AggregationIntervals: ivls,
+	hist := hdrhistogram.New()
+	require.NoError(t, hist.RecordDuration(time.Second, 1))
+	require.NoError(t, hist.RecordDuration(2*time.Second, 1))
+	assert.Equal(t, (txnGroups+1)*hist.MemoryEstimate(), histogramsMemory())
 
-		MeterProvider: metric.NewMeterProvider(metric.WithReader(gatherer)),
+	require.NoError(t, agg.Flush(context.Background()))
+	assert.Equal(t, int64(0), histogramsMemory())
+}
 
-		CombinedMetricsIDToKVs: func(id string) []attribute.KeyValue {
-			return []attribute.KeyValue{attribute.String("id_key", id)}
-		},
-	}, logger)
-	require.NoError(t, err)
-	go func() {
-		agg.Run(context.Background())
-	}()
-	t.Cleanup(func() {
-		agg.Stop(context.Background())
+func TestOverflowActiveBuckets(t *testing.T) {
+	forEachStore(t, testOverflowActiveBuckets)
+}
+
+func testOverflowActiveBuckets(t *testing.T, newStore newStoreFunc) {
+	rdr := metric.NewManualReader()
+	limits := testLimits()
+	limits.MaxTransactionGroupsPerService = 1
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore:             newStore,
+		Limits:               limits,
+		AggregationIntervals: []time.Duration{time.Minute, time.Hour},
+		MeterProvider:        metric.NewMeterProvider(metric.WithReader(rdr)),
 	})
 
+	activeBuckets := func() map[time.Duration]int64 {
+		var rm metricdata.ResourceMetrics
+		require.NoError(t, rdr.Collect(context.Background(), &rm))
+		buckets := make(map[time.Duration]int64)
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				if m.Name != "aggregator.overflow.active-buckets" {
+					continue
+				}
+				for _, dp := range m.Data.(metricdata.Gauge[int64]).DataPoints {
+					for _, ivl := range []time.Duration{time.Minute, time.Hour} {
+						attrs := telemetry.AggregationIntervalAttrSet(ivl)
+						if dp.Attributes.Equals(&attrs) {
+							buckets[ivl] = dp.Value
+						}
+					}
+				}
+			}
+		}
+		return buckets
+	}
+
+	// Every service overflows its transaction groups, except svc4 which
+	// has a single transaction group.
 	var batch modelpb.Batch
+	for _, svc := range []string{"svc1", "svc2", "svc3"} {
+		for i := 0; i < 3; i++ {
+			batch = append(batch, &modelpb.APMEvent{
+				Processor: modelpb.TransactionProcessor(),
+				Event: &modelpb.Event{
+					Outcome:  "success",
+					Duration: durationpb.New(time.Second),
+				},
+				Transaction: &modelpb.Transaction{
+					Name:                fmt.Sprintf("txn%d", i),
+					Type:                "type",
+					RepresentativeCount: 1,
+				},
+				Service: &modelpb.Service{Name: svc},
+			})
+		}
+	}
 	batch = append(batch, &modelpb.APMEvent{
 		Processor: modelpb.TransactionProcessor(),
+		Event: &modelpb.Event{
+			Outcome:  "success",
+			Duration: durationpb.New(time.Second),
+		},
 		Transaction: &modelpb.Transaction{
-			Name:                "txn",
+			Name:                "txn0",
+			Type:                "type",
 			RepresentativeCount: 1,
 		},
+		Service: &modelpb.Service{Name: "svc4"},
 	})
-	expectedMeasurements := make([]apmmodel.Metrics, 0, cmCount+(cmCount*len(ivls)))
-	for i := 0; i < cmCount; i++ {
-		cmID := fmt.Sprintf("testid%d", i)
-		require.NoError(t, agg.AggregateBatch(context.Background(), cmID, &batch))
-		expectedMeasurements = append(expectedMeasurements, apmmodel.Metrics{
-			Samples: map[string]apmmodel.Metric{
-				"aggregator.requests.total": {Value: 1},
-				"aggregator.bytes.ingested": {Value: 267},
-			},
-			Labels: apmmodel.StringMap{
-				apmmodel.StringMapItem{Key: "id_key", Value: cmID},
-			},
-		})
-		for _, ivl := range ivls {
-			expectedMeasurements = append(expectedMeasurements, apmmodel.Metrics{
-				Samples: map[string]apmmodel.Metric{
-					"aggregator.events.total":     {Value: float64(len(batch))},
-					"aggregator.events.processed": {Value: float64(len(batch))},
-				},
-				Labels: apmmodel.StringMap{
-					apmmodel.StringMapItem{Key: aggregationIvlKey, Value: ivl.String()},
-					apmmodel.StringMapItem{Key: "id_key", Value: cmID},
-				},
-			})
-		}
-	}
+	require.NoError(t, agg.AggregateBatch(context.Background(), "testid", &batch))
 
-	// The test is designed to timeout if it fails. The test asserts most of the
-	// logic in processor. If all expected metrics are harvested then the
-	// processor broadcasts this by closing the processorDone channel and we call
-	// it a success. If the harvest hasn't finished then the test times out and
-	// we call it a failure. Due to the nature of how the aggregator works, it is
-	// possible that this test becomes flaky if there is a bug.
-	select {
-	case <-processorDone:
-	case <-time.After(8 * time.Second):
-		t.Fatal("harvest didn't finish within expected time")
+	// The count is updated once the aggregated metrics are merged.
+	for _, ivl := range []time.Duration{time.Minute, time.Hour} {
+		_, err := agg.Snapshot(context.Background(), ivl)
+		require.NoError(t, err)
 	}
-	assert.Empty(t, cmp.Diff(
-		expectedMeasurements, gatherMetrics(gatherer, "pebble."),
-		cmpopts.IgnoreUnexported(apmmodel.Time{}),
-		cmpopts.SortSlices(func(a, b apmmodel.Metrics) bool {
-			if len(a.Labels) != len(b.Labels) {
-				return len(a.Labels) < len(b.Labels)
-			}
-			for i := 0; i < len(a.Labels); i++ {
-				// assuming keys are ordered
-				if a.Labels[i].Value != b.Labels[i].Value {
-					return a.Labels[i].Value < b.Labels[i].Value
-				}
-			}
-			return false
-		}),
-	))
+	assert.Equal(t, map[time.Duration]int64{time.Minute: 3, time.Hour: 3}, activeBuckets())
+
+	require.NoError(t, agg.Flush(context.Background()))
+	assert.Equal(t, map[time.Duration]int64{time.Minute: 0, time.Hour: 0}, activeBuckets())
 }
 
-func TestAggregateAndHarvest(t *testing.T) {
-	txnDuration := 100 * time.Millisecond
-	batch := modelpb.Batch{
-		{
+func TestIndependentGroupLimits(t *testing.T) {
+	forEachStore(t, testIndependentGroupLimits)
+}
+
+func testIndependentGroupLimits(t *testing.T, newStore newStoreFunc) {
+	start := time.Unix(1686000000, 0).Truncate(time.Minute)
+	makeTransaction := func(name string) *modelpb.APMEvent {
+		return &modelpb.APMEvent{
+			Timestamp: timestamppb.New(start),
 			Processor: modelpb.TransactionProcessor(),
 			Event: &modelpb.Event{
 				Outcome:  "success",
-				Duration: durationpb.New(txnDuration),
+				Duration: durationpb.New(time.Second),
 			},
 			Transaction: &modelpb.Transaction{
-				Name:                "foo",
-				Type:                "txtype",
+				Name:                name,
+				Type:                "type",
 				RepresentativeCount: 1,
 			},
-			Service: &modelpb.Service{Name: "svc"},
-			Labels: modelpb.Labels{
-				"department_name": &modelpb.LabelValue{Global: true, Value: "apm"},
-				"organization":    &modelpb.LabelValue{Global: true, Value: "observability"},
-				"company":         &modelpb.LabelValue{Global: true, Value: "elastic"},
-				"mylabel":         &modelpb.LabelValue{Global: false, Value: "myvalue"},
-			},
-			NumericLabels: modelpb.NumericLabels{
-				"user_id":        &modelpb.NumericLabelValue{Global: true, Value: 100},
-				"cost_center":    &modelpb.NumericLabelValue{Global: true, Value: 10},
-				"mynumericlabel": &modelpb.NumericLabelValue{Global: false, Value: 1},
-			},
-		},
+			Service: &modelpb.Service{Name: "svc1"},
+		}
 	}
-	var events []*modelpb.APMEvent
-	logger, err := zap.NewDevelopment()
-	require.NoError(t, err)
-	agg, err := New(AggregatorConfig{
-		DataDir: t.TempDir(),
-		Limits: Limits{
-			MaxSpanGroups:                         1000,
-			MaxSpanGroupsPerService:               100,
-			MaxTransactionGroups:                  100,
-			MaxTransactionGroupsPerService:        10,
-			MaxServiceTransactionGroups:           100,
-			MaxServiceTransactionGroupsPerService: 10,
-			MaxServices:                           10,
-			MaxServiceInstanceGroupsPerService:    10,
-		},
-		Processor:            sliceProcessor(&events),
-		AggregationIntervals: []time.Duration{time.Second},
-	}, logger)
-	require.NoError(t, err)
-	require.NoError(t, agg.AggregateBatch(context.Background(), "test", &batch))
-	require.NoError(t, agg.Stop(context.Background()))
-
-	expected := []*modelpb.APMEvent{
-		{
-			Timestamp: timestamppb.New(time.Unix(0, 0).UTC()),
-			Processor: modelpb.MetricsetProcessor(),
-			Event: &modelpb.Event{
-				SuccessCount: &modelpb.SummaryMetric{
-					Count: 1,
-					Sum:   1,
-				},
-				Outcome: "success",
-			},
-			Transaction: &modelpb.Transaction{
-				Name: "foo",
-				Type: "txtype",
-				Root: true,
-				DurationSummary: &modelpb.SummaryMetric{
-					Count: 1,
-					Sum:   100351, // Estimate from histogram
-				},
-				DurationHistogram: &modelpb.Histogram{
-					Values: []float64{100351},
-					Counts: []int64{1},
-				},
-			},
-			Service: &modelpb.Service{
-				Name: "svc",
-			},
-			Labels: modelpb.Labels{
-				"department_name": &modelpb.LabelValue{Global: true, Value: "apm"},
-				"organization":    &modelpb.LabelValue{Global: true, Value: "observability"},
-				"company":         &modelpb.LabelValue{Global: true, Value: "elastic"},
-			},
-			NumericLabels: modelpb.NumericLabels{
-				"user_id":     &modelpb.NumericLabelValue{Global: true, Value: 100},
-				"cost_center": &modelpb.NumericLabelValue{Global: true, Value: 10},
-			},
-			Metricset: &modelpb.Metricset{
-				Name:     "transaction",
-				DocCount: 1,
-				Interval: "1s",
-			},
-		},
-		{
-			Timestamp: timestamppb.New(time.Unix(0, 0).UTC()),
-			Processor: modelpb.MetricsetProcessor(),
-			Service: &modelpb.Service{
-				Name: "svc",
-			},
-			Labels: modelpb.Labels{
-				"department_name": &modelpb.LabelValue{Global: true, Value: "apm"},
-				"organization":    &modelpb.LabelValue{Global: true, Value: "observability"},
-				"company":         &modelpb.LabelValue{Global: true, Value: "elastic"},
-			},
-			NumericLabels: modelpb.NumericLabels{
-				"user_id":     &modelpb.NumericLabelValue{Global: true, Value: 100},
-				"cost_center": &modelpb.NumericLabelValue{Global: true, Value: 10},
-			},
-			Metricset: &modelpb.Metricset{
-				Name:     "service_summary",
-				Interval: "1s",
-			},
-		},
-		{
-			Timestamp: timestamppb.New(time.Unix(0, 0).UTC()),
-			Processor: modelpb.MetricsetProcessor(),
-			Event: &modelpb.Event{
-				SuccessCount: &modelpb.SummaryMetric{
-					Count: 1,
-					Sum:   1,
-				},
-			},
-			Transaction: &modelpb.Transaction{
-				Type: "txtype",
-				DurationSummary: &modelpb.SummaryMetric{
-					Count: 1,
-					Sum:   100351, // Estimate from histogram
-				},
-				DurationHistogram: &modelpb.Histogram{
-					Values: []float64{100351},
-					Counts: []int64{1},
-				},
-			},
-			Service: &modelpb.Service{
-				Name: "svc",
-			},
-			Labels: modelpb.Labels{
-				"department_name": &modelpb.LabelValue{Global: true, Value: "apm"},
-				"organization":    &modelpb.LabelValue{Global: true, Value: "observability"},
-				"company":         &modelpb.LabelValue{Global: true, Value: "elastic"},
-			},
-			NumericLabels: modelpb.NumericLabels{
-				"user_id":     &modelpb.NumericLabelValue{Global: true, Value: 100},
-				"cost_center": &modelpb.NumericLabelValue{Global: true, Value: 10},
-			},
-			Metricset: &modelpb.Metricset{
-				Name:     "service_transaction",
-				DocCount: 1,
-				Interval: "1s",
-			},
+	makeSpans := func(n int) (spans modelpb.Batch) {
+		for i := 0; i < n; i++ {
+			spans = append(spans, makeSpan(
+				start, "svc1", "java", fmt.Sprintf("dest%d", i), "", "", "success", time.Second, 1, nil, nil,
+			))
+		}
+		return spans
+	}
+	makeTransactions := func(n int) (txns modelpb.Batch) {
+		for i := 0; i < n; i++ {
+			txns = append(txns, makeTransaction(fmt.Sprintf("txn%d", i)))
+		}
+		return txns
+	}
+
+	for _, tc := range []struct {
+		name               string
+		batch              modelpb.Batch
+		expectedSpans      int
+		expectedTxns       int
+		expectedOverflowed map[string]int64
+	}{
+		{
+			name:               "span_flood",
+			batch:              append(makeSpans(20), makeTransactions(3)...),
+			expectedSpans:      5,
+			expectedTxns:       3,
+			expectedOverflowed: map[string]int64{"span": 15},
 		},
+		{
+			name:               "transaction_flood",
+			batch:              append(makeSpans(3), makeTransactions(20)...),
+			expectedSpans:      3,
+			expectedTxns:       5,
+			expectedOverflowed: map[string]int64{"transaction": 15},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rdr := metric.NewManualReader()
+			var harvested []CombinedMetrics
+			limits := testLimits()
+			limits.MaxSpanGroups = 5
+			limits.MaxTransactionGroups = 5
+			limits.MaxTransactionGroupsPerService = 100
+			// The span destinations, which have limits of their own, are
+			// not aggregated.
+			limits.MaxSpanDestinationsPerService = 0
+			agg := newTestAggregator(t, AggregatorConfig{
+				NewStore: newStore,
+				Limits:   limits,
+				Processor: func(_ context.Context, _ CombinedMetricsKey, cm CombinedMetrics, _ time.Duration) error {
+					harvested = append(harvested, cm)
+					return nil
+				},
+				AggregationIntervals: []time.Duration{time.Minute},
+				MeterProvider:        metric.NewMeterProvider(metric.WithReader(rdr)),
+				clock:                newFakeClock(start),
+			})
+
+			require.NoError(t, agg.AggregateBatch(context.Background(), "testid", &tc.batch))
+			require.NoError(t, agg.Stop(context.Background()))
+
+			// Exhausting the groups of one event type does not overflow
+			// the groups of the other event type.
+			require.Len(t, harvested, 1)
+			var spans, txns int
+			for _, sm := range harvested[0].Services {
+				for _, sim := range sm.ServiceInstanceGroups {
+					spans += len(sim.SpanGroups)
+					txns += len(sim.TransactionGroups)
+				}
+			}
+			assert.Equal(t, tc.expectedSpans, spans)
+			assert.Equal(t, tc.expectedTxns, txns)
+
+			// The overflowed events are counted per overflow type.
+			var rm metricdata.ResourceMetrics
+			require.NoError(t, rdr.Collect(context.Background(), &rm))
+			overflowed := make(map[string]int64)
+			for _, sm := range rm.ScopeMetrics {
+				for _, m := range sm.Metrics {
+					if m.Name != "aggregator.events.overflowed" {
+						continue
+					}
+					for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+						typ, _ := dp.Attributes.Value(telemetry.OverflowTypeKey)
+						overflowed[typ.AsString()] += dp.Value
+					}
+				}
+			}
+			assert.Equal(t, tc.expectedOverflowed, overflowed)
+		})
 	}
-	assert.Empty(t, cmp.Diff(
-		expected,
-		events,
-		cmpopts.IgnoreTypes(netip.Addr{}),
-		cmpopts.SortSlices(func(a, b *modelpb.APMEvent) bool {
-			return a.Metricset.Name < b.Metricset.Name
-		}),
-		protocmp.Transform(),
-	))
 }
 
-func TestRunStopOrchestration(t *testing.T) {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	logger, err := zap.NewDevelopment()
-	if err != nil {
-		t.Fatal("failed to create test logger", err)
+func TestCombinedMetricsIDAttributes(t *testing.T) {
+	forEachStore(t, testCombinedMetricsIDAttributes)
+}
+
+func testCombinedMetricsIDAttributes(t *testing.T, newStore newStoreFunc) {
+	rdr := metric.NewManualReader()
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore:             newStore,
+		AggregationIntervals: []time.Duration{time.Minute},
+		MeterProvider:        metric.NewMeterProvider(metric.WithReader(rdr)),
+		CombinedMetricsIDToKVs: func(id string) []attribute.KeyValue {
+			return []attribute.KeyValue{attribute.String("tenant", id)}
+		},
+		MaxCombinedMetricsIDAttributeSets: 1,
+	})
+
+	for _, id := range []string{"a", "b"} {
+		batch := modelpb.Batch{
+			makeSpan(time.Now(), "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+		}
+		require.NoError(t, agg.AggregateBatch(context.Background(), id, &batch))
 	}
-	var firstHarvestDone atomic.Bool
-	newAggregator := func() *Aggregator {
-		agg, err := New(AggregatorConfig{
-			DataDir: t.TempDir(),
-			Processor: func(_ context.Context, _ CombinedMetricsKey, _ CombinedMetrics, _ time.Duration) error {
-				firstHarvestDone.Swap(true)
-				return nil
-			},
-			AggregationIntervals: []time.Duration{time.Second},
-		}, logger)
-		if err != nil {
-			t.Fatal("failed to create test aggregator", err)
+	require.NoError(t, agg.Stop(context.Background()))
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, rdr.Collect(context.Background(), &rm))
+	actual := make(map[string]map[attribute.Set]int64)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			switch m.Name {
+			case "aggregator.events.total", "aggregator.events.processed":
+				actual[m.Name] = make(map[attribute.Set]int64)
+				for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+					actual[m.Name][dp.Attributes] = dp.Value
+				}
+			}
 		}
-		return agg
 	}
-	callAggregateBatch := func(agg *Aggregator) error {
-		return agg.AggregateBatch(
-			context.Background(),
-			"testid",
-			&modelpb.Batch{
-				&modelpb.APMEvent{
-					Processor: modelpb.TransactionProcessor(),
-					Event:     &modelpb.Event{Duration: durationpb.New(time.Millisecond)},
-					Transaction: &modelpb.Transaction{
-						Name:                "T-1000",
-						RepresentativeCount: 1,
-					},
-				},
-			},
-		)
+	// The second tenant exceeds the limit of attribute sets and is
+	// recorded with the overflow attribute.
+	expected := map[attribute.Set]int64{
+		telemetry.AggregationIntervalAttrSet(time.Minute,
+			attribute.String("tenant", "a"),
+		): 1,
+		telemetry.AggregationIntervalAttrSet(time.Minute,
+			attribute.Bool(telemetry.AttributesOverflowKey, true),
+		): 1,
 	}
+	assert.Equal(t, map[string]map[attribute.Set]int64{
+		"aggregator.events.total":     expected,
+		"aggregator.events.processed": expected,
+	}, actual)
+}
 
-	t.Run("run_before_stop", func(t *testing.T) {
-		agg := newAggregator()
-		// Should aggregate even without running
-		assert.NoError(t, callAggregateBatch(agg))
-		go func() { agg.Run(ctx) }()
-		assert.Eventually(t, func() bool {
-			return firstHarvestDone.Load()
-		}, time.Second, 10*time.Millisecond, "failed while waiting for first harvest")
-		assert.NoError(t, callAggregateBatch(agg))
-		assert.NoError(t, agg.Stop(ctx))
-		assert.ErrorIs(t, callAggregateBatch(agg), ErrAggregatorStopped)
-	})
-	t.Run("stop_before_run", func(t *testing.T) {
-		agg := newAggregator()
-		assert.NoError(t, agg.Stop(ctx))
-		assert.ErrorIs(t, callAggregateBatch(agg), ErrAggregatorStopped)
-		assert.ErrorIs(t, agg.Run(ctx), ErrAggregatorStopped)
-	})
-	t.Run("multiple_run", func(t *testing.T) {
-		agg := newAggregator()
-		defer agg.Stop(ctx)
+func TestStaleKeyTTL(t *testing.T) {
+	forEachStore(t, testStaleKeyTTL)
+}
 
-		g, ctx := errgroup.WithContext(ctx)
-		g.Go(func() error { return agg.Run(ctx) })
-		g.Go(func() error { return agg.Run(ctx) })
-		assert.ErrorIs(t, g.Wait(), ErrAggregatorAlreadyRunning)
+func testStaleKeyTTL(t *testing.T, newStore newStoreFunc) {
+	rdr := metric.NewManualReader()
+	core, logs := observer.New(zapcore.WarnLevel)
+	var harvested []string
+	agg, err := New(testConfig(t, AggregatorConfig{
+		NewStore: newStore,
+		Processor: func(_ context.Context, cmk CombinedMetricsKey, _ CombinedMetrics, _ time.Duration) error {
+			harvested = append(harvested, cmk.ID)
+			return nil
+		},
+		AggregationIntervals: []time.Duration{time.Second},
+		StaleKeyTTL:          10 * time.Second,
+		MeterProvider:        metric.NewMeterProvider(metric.WithReader(rdr)),
+	}), zap.New(core))
+	require.NoError(t, err)
+	defer agg.Stop(context.Background())
+
+	batch := modelpb.Batch{
+		makeSpan(time.Now(), "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+	}
+	// Move the processing time of the aggregator to aggregate metrics
+	// which are never harvested by the harvest of the current processing
+	// time, as if they were aggregated before a restart.
+	now := agg.processingTime
+	for id, processingTime := range map[string]time.Time{
+		"stale":  now.Add(-time.Minute),
+		"recent": now.Add(-5 * time.Second),
+	} {
+		agg.processingTime = processingTime
+		require.NoError(t, agg.AggregateBatch(context.Background(), id, &batch))
+	}
+	agg.processingTime = now
+	require.NoError(t, agg.AggregateBatch(context.Background(), "current", &batch))
+
+	require.NoError(t, agg.Flush(context.Background()))
+	assert.Equal(t, []string{"current"}, harvested)
+	snapshot, err := agg.Snapshot(context.Background(), time.Second)
+	require.NoError(t, err)
+	// The metrics which are not older than the TTL are retained.
+	assert.Len(t, snapshot, 1)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, rdr.Collect(context.Background(), &rm))
+	var dropped []metricdata.DataPoint[int64]
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name == "aggregator.stale.dropped" {
+				dropped = m.Data.(metricdata.Sum[int64]).DataPoints
+			}
+		}
+	}
+	require.Len(t, dropped, 1)
+	assert.Equal(t, int64(1), dropped[0].Value)
+	assert.Equal(t, telemetry.AggregationIntervalAttrSet(time.Second), dropped[0].Attributes)
+
+	entries := logs.FilterMessage("dropped stale aggregated metrics which were never harvested").AllUntimed()
+	require.Len(t, entries, 1)
+	assert.Equal(t, int64(1), entries[0].ContextMap()["combined_metrics_dropped"])
+}
+
+func TestHarvestProcessorErrors(t *testing.T) {
+	forEachStore(t, testHarvestProcessorErrors)
+}
+
+func testHarvestProcessorErrors(t *testing.T, newStore newStoreFunc) {
+	rdr := metric.NewManualReader()
+	var processed []string
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore: newStore,
+		Processor: func(_ context.Context, cmk CombinedMetricsKey, _ CombinedMetrics, _ time.Duration) error {
+			if cmk.ID == "id1" {
+				return errors.New("processor error")
+			}
+			processed = append(processed, cmk.ID)
+			return nil
+		},
+		AggregationIntervals: []time.Duration{time.Second},
+		MeterProvider:        metric.NewMeterProvider(metric.WithReader(rdr)),
 	})
-	t.Run("multiple_stop", func(t *testing.T) {
-		agg := newAggregator()
-		defer agg.Stop(ctx)
-		go func() { agg.Run(ctx) }()
-		time.Sleep(time.Second)
 
-		g, ctx := errgroup.WithContext(ctx)
-		g.Go(func() error { return agg.Stop(ctx) })
-		g.Go(func() error { return agg.Stop(ctx) })
-		assert.NoError(t, g.Wait())
+	batch := modelpb.Batch{
+		makeSpan(time.Now(), "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+	}
+	for _, id := range []string{"id1", "id2", "id3"} {
+		require.NoError(t, agg.AggregateBatch(context.Background(), id, &batch))
+	}
+	err := agg.Flush(context.Background())
+	assert.ErrorContains(t, err, "failed to process 1 out of 3 metrics")
+	assert.ErrorContains(t, err, "processor error")
+	// Processor errors must not abort the harvest of the other keys.
+	assert.Equal(t, []string{"id2", "id3"}, processed)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, rdr.Collect(context.Background(), &rm))
+	var harvestErrors, harvests []metricdata.DataPoint[int64]
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			switch m.Name {
+			case "aggregator.harvest.errors":
+				harvestErrors = m.Data.(metricdata.Sum[int64]).DataPoints
+			case "aggregator.harvests.total":
+				harvests = m.Data.(metricdata.Sum[int64]).DataPoints
+			}
+		}
+	}
+	require.Len(t, harvestErrors, 1)
+	assert.Equal(t, int64(1), harvestErrors[0].Value)
+	assert.Equal(t, telemetry.AggregationIntervalAttrSet(time.Second), harvestErrors[0].Attributes)
+	// Failed harvests are not counted as harvests.
+	assert.Empty(t, harvests)
+}
+
+func TestHarvestPayloadProcessor(t *testing.T) {
+	forEachStore(t, testHarvestPayloadProcessor)
+}
+
+func testHarvestPayloadProcessor(t *testing.T, newStore newStoreFunc) {
+	for _, codec := range []Codec{CodecNone, CodecGzip, CodecZstd} {
+		t.Run(codec.String(), func(t *testing.T) {
+			var payloads [][]byte
+			agg := newTestAggregator(t, AggregatorConfig{
+				NewStore: newStore,
+				PayloadProcessor: func(
+					_ context.Context,
+					_ CombinedMetricsKey,
+					payload []byte,
+					c Codec,
+					_ time.Duration,
+				) error {
+					assert.Equal(t, codec, c)
+					payloads = append(payloads, payload)
+					return nil
+				},
+				HarvestCompression:   codec,
+				AggregationIntervals: []time.Duration{time.Second},
+			})
+
+			batch := modelpb.Batch{
+				makeSpan(time.Now(), "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+			}
+			require.NoError(t, agg.AggregateBatch(context.Background(), "id", &batch))
+			require.NoError(t, agg.Stop(context.Background()))
+
+			require.Len(t, payloads, 1)
+			pb, err := DecodeCompressedCombinedMetrics(payloads[0], codec)
+			require.NoError(t, err)
+			assert.Equal(t, int64(1), pb.EventsTotal)
+			require.Len(t, pb.ServiceMetrics, 1)
+			assert.Equal(t, "svc1", pb.ServiceMetrics[0].Key.ServiceName)
+		})
+	}
+}
+
+func TestMaxProcessorPayloadBytes(t *testing.T) {
+	forEachStore(t, testMaxProcessorPayloadBytes)
+}
+
+func testMaxProcessorPayloadBytes(t *testing.T, newStore newStoreFunc) {
+	var chunks []CombinedMetrics
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore: newStore,
+		Processor: func(_ context.Context, _ CombinedMetricsKey, cm CombinedMetrics, _ time.Duration) error {
+			chunks = append(chunks, cm)
+			return nil
+		},
+		AggregationIntervals:     []time.Duration{time.Second},
+		MaxProcessorPayloadBytes: 1,
 	})
+
+	var batch modelpb.Batch
+	for i := 0; i < 5; i++ {
+		batch = append(batch, makeSpan(
+			time.Now(), fmt.Sprintf("svc%d", i), "java", "dest", "", "", "success", time.Second, 1, nil, nil,
+		))
+	}
+	require.NoError(t, agg.AggregateBatch(context.Background(), "id", &batch))
+	require.NoError(t, agg.Stop(context.Background()))
+
+	// Every service is processed in a chunk of its own.
+	require.Len(t, chunks, 5)
+	services := make(map[string]bool)
+	var eventsTotal int64
+	for _, chunk := range chunks {
+		require.Len(t, chunk.Services, 1)
+		for k := range chunk.Services {
+			services[k.ServiceName] = true
+		}
+		eventsTotal += chunk.eventsTotal
+	}
+	assert.Len(t, services, 5)
+	assert.Equal(t, int64(5), eventsTotal)
 }
 
 func BenchmarkAggregateCombinedMetrics(b *testing.B) {
@@ -1167,7 +4967,88 @@ func BenchmarkAggregateCombinedMetrics(b *testing.B) {
 	}
 }
 
+func BenchmarkAggregateCombinedMetricsBatch(b *testing.B) {
+	for _, batchSize := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("batch_size=%d", batchSize), func(b *testing.B) {
+			benchmarkAggregateCombinedMetricsBatch(b, batchSize)
+		})
+	}
+}
+
+// benchmarkAggregateCombinedMetricsBatch aggregates b.N combined metrics in
+// batches of the given size, allowing the per combined metrics cost to be
+// compared with BenchmarkAggregateCombinedMetrics.
+func benchmarkAggregateCombinedMetricsBatch(b *testing.B, batchSize int) {
+	aggIvl := time.Minute
+	agg, err := New(AggregatorConfig{
+		DataDir: b.TempDir(),
+		Limits: Limits{
+			MaxSpanGroups:                         1000,
+			MaxSpanGroupsPerService:               100,
+			MaxTransactionGroups:                  1000,
+			MaxTransactionGroupsPerService:        100,
+			MaxServiceTransactionGroups:           1000,
+			MaxServiceTransactionGroupsPerService: 100,
+			MaxServices:                           100,
+			MaxServiceInstanceGroupsPerService:    100,
+		},
+		Processor:            noOpProcessor(),
+		AggregationIntervals: []time.Duration{aggIvl},
+		MeterProvider:        metric.NewMeterProvider(),
+	}, zap.NewNop())
+	if err != nil {
+		b.Fatal(err)
+	}
+	go func() {
+		agg.Run(context.Background())
+	}()
+	b.Cleanup(func() {
+		agg.Stop(context.Background())
+	})
+	cm, err := EventToCombinedMetrics(
+		&modelpb.APMEvent{
+			Processor: modelpb.TransactionProcessor(),
+			Event:     &modelpb.Event{Duration: durationpb.New(time.Millisecond)},
+			Transaction: &modelpb.Transaction{
+				Name:                "T-1000",
+				RepresentativeCount: 1,
+			},
+		},
+		aggIvl,
+	)
+	if err != nil {
+		b.Fatal(err)
+	}
+	kcms := make([]KeyedCombinedMetrics, batchSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i += batchSize {
+		n := batchSize
+		if b.N-i < n {
+			n = b.N - i
+		}
+		key := CombinedMetricsKey{
+			Interval:       aggIvl,
+			ProcessingTime: time.Now().Truncate(aggIvl),
+			ID:             "testid",
+		}
+		for j := 0; j < n; j++ {
+			kcms[j] = KeyedCombinedMetrics{Key: key, Metrics: cm}
+		}
+		if err := agg.AggregateCombinedMetricsBatch(context.Background(), kcms[:n]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func BenchmarkAggregateBatch(b *testing.B) {
+	for _, window := range []time.Duration{0, time.Second} {
+		b.Run(fmt.Sprintf("merge_batch_window=%s", window), func(b *testing.B) {
+			benchmarkAggregateBatch(b, window)
+		})
+	}
+}
+
+func benchmarkAggregateBatch(b *testing.B, mergeBatchWindow time.Duration) {
 	logger, err := zap.NewDevelopment()
 	if err != nil {
 		b.Fatal(err)
@@ -1186,6 +5067,7 @@ func BenchmarkAggregateBatch(b *testing.B) {
 		},
 		Processor:            noOpProcessor(),
 		AggregationIntervals: []time.Duration{time.Minute},
+		MergeBatchWindow:     mergeBatchWindow,
 	}, logger)
 	if err != nil {
 		b.Fatal(err)
@@ -1211,6 +5093,93 @@ func BenchmarkAggregateBatch(b *testing.B) {
 			b.Fatal(err)
 		}
 	}
+	b.StopTimer()
+	// Report the bytes written to pebble per aggregated event, which
+	// the merge batching is meant to reduce.
+	if err := agg.Flush(context.Background()); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportMetric(float64(agg.stores[0].db.Metrics().WAL.BytesWritten)/float64(b.N), "walbytes/op")
+}
+
+// testLimits returns the limits of the aggregators created by the tests
+// which do not exercise the limits.
+func testLimits() Limits {
+	return Limits{
+		MaxSpanGroups:                         1000,
+		MaxSpanGroupsPerService:               100,
+		MaxTransactionGroups:                  100,
+		MaxTransactionGroupsPerService:        10,
+		MaxServiceTransactionGroups:           100,
+		MaxServiceTransactionGroupsPerService: 10,
+		MaxServices:                           10,
+		MaxServiceInstanceGroupsPerService:    10,
+		MaxSpanDestinationsPerService:         10,
+	}
+}
+
+// testConfig returns the config with the test defaults for the fields
+// left unset: a temporary data directory, testLimits, a processor
+// ignoring the harvested metrics and the automatic harvests disabled.
+func testConfig(tb testing.TB, cfg AggregatorConfig) AggregatorConfig {
+	if cfg.DataDir == "" && !cfg.InMemory {
+		cfg.DataDir = tb.TempDir()
+	}
+	if cfg.Limits == (Limits{}) {
+		cfg.Limits = testLimits()
+	}
+	if cfg.Processor == nil && cfg.PayloadProcessor == nil {
+		cfg.Processor = noOpProcessor()
+	}
+	if cfg.HarvestDelay == 0 {
+		cfg.HarvestDelay = time.Hour // disable auto harvest
+	}
+	return cfg
+}
+
+// newTestAggregator returns a new aggregator for the config with the test
+// defaults, see testConfig, which is stopped when the test finishes.
+func newTestAggregator(tb testing.TB, cfg AggregatorConfig) *Aggregator {
+	tb.Helper()
+	agg, err := New(testConfig(tb, cfg), zap.NewNop())
+	require.NoError(tb, err)
+	tb.Cleanup(func() { agg.Stop(context.Background()) })
+	return agg
+}
+
+// newStoreFunc creates the store of the aggregated metrics, see
+// AggregatorConfig.NewStore.
+type newStoreFunc = func(dataDir string, intervals []time.Duration, merge MergeFunc) (Store, error)
+
+// forEachStore runs the test as a subtest for each of the stores, passing
+// the NewStore config creating the store to the test, nil for pebble.
+func forEachStore(t *testing.T, test func(t *testing.T, newStore newStoreFunc)) {
+	for _, s := range []struct {
+		name     string
+		newStore newStoreFunc
+	}{
+		{name: "pebble"},
+		{name: "map", newStore: func(_ string, _ []time.Duration, merge MergeFunc) (Store, error) {
+			return NewMapStore(merge), nil
+		}},
+	} {
+		s := s
+		t.Run(s.name, func(t *testing.T) {
+			t.Parallel()
+			test(t, s.newStore)
+		})
+	}
+}
+
+// batchCount returns the number of writes of the batch.
+func batchCount(b StoreBatch) int {
+	switch b := b.(type) {
+	case *pebbleBatch:
+		return int(b.batch.Count())
+	case *mapBatch:
+		return len(b.ops)
+	}
+	panic(fmt.Sprintf("unknown batch type %T", b))
 }
 
 func noOpProcessor() Processor {
@@ -1219,6 +5188,12 @@ func noOpProcessor() Processor {
 	}
 }
 
+func noOpPayloadProcessor() PayloadProcessor {
+	return func(_ context.Context, _ CombinedMetricsKey, _ []byte, _ Codec, _ time.Duration) error {
+		return nil
+	}
+}
+
 func combinedMetricsProcessor(out chan<- CombinedMetrics) Processor {
 	return func(
 		_ context.Context,
@@ -1251,7 +5226,22 @@ func sliceProcessor(slice *[]*modelpb.APMEvent) Processor {
 	}
 }
 
-func gatherMetrics(g apm.MetricsGatherer, ignoreMetricPrefix string) []apmmodel.Metrics {
+func sortMetricsByLabels() cmp.Option {
+	return cmpopts.SortSlices(func(a, b apmmodel.Metrics) bool {
+		if len(a.Labels) != len(b.Labels) {
+			return len(a.Labels) < len(b.Labels)
+		}
+		for i := 0; i < len(a.Labels); i++ {
+			// assuming keys are ordered
+			if a.Labels[i].Value != b.Labels[i].Value {
+				return a.Labels[i].Value < b.Labels[i].Value
+			}
+		}
+		return false
+	})
+}
+
+func gatherMetrics(g apm.MetricsGatherer, ignoreMetricPrefixes ...string) []apmmodel.Metrics {
 	tracer := apmtest.NewRecordingTracer()
 	defer tracer.Close()
 	tracer.RegisterMetricsGatherer(g)
@@ -1261,22 +5251,27 @@ func gatherMetrics(g apm.MetricsGatherer, ignoreMetricPrefix string) []apmmodel.
 		metrics[i].Timestamp = apmmodel.Time{}
 	}
 
-	for i, m := range metrics {
+	filtered := metrics[:0]
+	for _, m := range metrics {
 		for k := range m.Samples {
 			// Remove internal and any metrics that has been explicitly ignored
-			if strings.HasPrefix(k, "golang.") ||
-				strings.HasPrefix(k, "system.") ||
-				strings.HasPrefix(k, ignoreMetricPrefix) {
+			if strings.HasPrefix(k, "golang.") || strings.HasPrefix(k, "system.") {
 				delete(m.Samples, k)
+				continue
+			}
+			for _, prefix := range ignoreMetricPrefixes {
+				if strings.HasPrefix(k, prefix) {
+					delete(m.Samples, k)
+					break
+				}
 			}
 		}
 
-		if len(m.Samples) == 0 {
-			metrics[i] = metrics[len(metrics)-1]
-			metrics = metrics[:len(metrics)-1]
+		if len(m.Samples) > 0 {
+			filtered = append(filtered, m)
 		}
 	}
-	return metrics
+	return filtered
 }
 
 func makeSpan(
@@ -0,0 +1,43 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// defaultPebbleCacheSize is the size of the block cache created by pebble
+// for a database if no cache is configured.
+const defaultPebbleCacheSize = 8 << 20
+
+// warmCache populates the block cache of the store's database by reading
+// the aggregated metrics of the store's aggregation intervals, in the
+// order they are harvested, until maxBytes of keys and values are read
+// or all the aggregated metrics are read. The values are merged by the
+// database on read, as on harvest, but the aggregated metrics are not
+// modified. It returns the number of keys and bytes read.
+func (s *store) warmCache(maxBytes int64) (keys int, bytes int64, err error) {
+	for _, ivl := range s.intervals {
+		iter := s.db.NewIter(&pebble.IterOptions{
+			LowerBound: intervalKeyPrefix(ivl),
+			UpperBound: intervalKeyPrefix(ivl + time.Second),
+			KeyTypes:   pebble.IterKeyTypePointsOnly,
+		})
+		for iter.First(); iter.Valid() && bytes < maxBytes; iter.Next() {
+			keys++
+			bytes += int64(len(iter.Key()) + len(iter.Value()))
+		}
+		if err := iter.Close(); err != nil {
+			return keys, bytes, fmt.Errorf("failed to read aggregated metrics for interval %s: %w", ivl, err)
+		}
+		if bytes >= maxBytes {
+			break
+		}
+	}
+	return keys, bytes, nil
+}
@@ -0,0 +1,145 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/elastic/apm-data/model/modelpb"
+)
+
+// newCacheWarmingTestConfig returns the config of an aggregator with the
+// aggregated metrics of spanGroups span groups persisted in dir, as if
+// the aggregator was restarted without harvesting them.
+func newCacheWarmingTestConfig(tb testing.TB, dir string, spanGroups int) AggregatorConfig {
+	start := time.Unix(1686000000, 0).Truncate(time.Hour)
+	limits := testLimits()
+	limits.MaxSpanGroups = 10 * spanGroups
+	limits.MaxSpanGroupsPerService = 10 * spanGroups
+	cfg := AggregatorConfig{
+		DataDir:              dir,
+		Limits:               limits,
+		Processor:            noOpProcessor(),
+		AggregationIntervals: []time.Duration{time.Minute, time.Hour},
+		HarvestDelay:         time.Hour, // disable auto harvest
+		PebbleCacheSize:      64 << 20,
+		clock:                newFakeClock(start),
+	}
+	agg, err := New(cfg, zap.NewNop())
+	require.NoError(tb, err)
+	batch := make(modelpb.Batch, spanGroups)
+	for i := range batch {
+		batch[i] = makeSpan(start, "svc1", "java", fmt.Sprintf("dest%d", i), "", "", "success", time.Second, 1, nil, nil)
+	}
+	require.NoError(tb, agg.AggregateBatch(context.Background(), "testid", &batch))
+	// Commit the aggregations and leave the aggregated metrics in
+	// sstables, which are read through the block cache.
+	for _, ivl := range cfg.AggregationIntervals {
+		_, err := agg.Snapshot(context.Background(), ivl)
+		require.NoError(tb, err)
+	}
+	closeDBs(tb, agg)
+	return cfg
+}
+
+// closeDBs closes the databases of the aggregator without harvesting
+// the aggregated metrics.
+func closeDBs(tb testing.TB, agg *Aggregator) {
+	for _, s := range agg.stores {
+		require.NoError(tb, s.db.Flush())
+		require.NoError(tb, s.db.Close())
+	}
+}
+
+func TestWarmCache(t *testing.T) {
+	dir := t.TempDir()
+	cfg := newCacheWarmingTestConfig(t, dir, 100)
+
+	snapshot := func(agg *Aggregator) map[time.Duration]CombinedMetrics {
+		snaps := make(map[time.Duration]CombinedMetrics)
+		for _, ivl := range cfg.AggregationIntervals {
+			cms, err := agg.Snapshot(context.Background(), ivl)
+			require.NoError(t, err)
+			require.Len(t, cms, 1)
+			var cm CombinedMetrics
+			cm.FromProto(cms[0])
+			snaps[ivl] = cm
+		}
+		return snaps
+	}
+	equal := cmp.Exporter(func(reflect.Type) bool { return true })
+
+	cold, err := New(cfg, zap.NewNop())
+	require.NoError(t, err)
+	coldCacheSize := cold.stores[0].db.Metrics().BlockCache.Size
+	expected := snapshot(cold)
+	closeDBs(t, cold)
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	cfg.WarmCache = true
+	warm, err := New(cfg, zap.New(core))
+	require.NoError(t, err)
+
+	// The aggregated metrics of both intervals are read into the cache.
+	warmed := logs.FilterMessage("warmed pebble block cache").AllUntimed()
+	require.Len(t, warmed, 1)
+	assert.Equal(t, dir, warmed[0].ContextMap()["data_dir"])
+	assert.Equal(t, int64(2), warmed[0].ContextMap()["keys"])
+	assert.Greater(t, warmed[0].ContextMap()["bytes"], int64(0))
+	assert.Greater(t, warm.stores[0].db.Metrics().BlockCache.Size, coldCacheSize)
+
+	// Warming does not modify the aggregated metrics, which are read
+	// from the cache.
+	misses := warm.stores[0].db.Metrics().BlockCache.Misses
+	assert.Empty(t, cmp.Diff(expected, snapshot(warm), equal))
+	assert.Equal(t, misses, warm.stores[0].db.Metrics().BlockCache.Misses)
+	closeDBs(t, warm)
+
+	// Warming stops once the capacity of the cache is read.
+	cfg.PebbleCacheSize = 1
+	logs.TakeAll()
+	warm, err = New(cfg, zap.New(core))
+	require.NoError(t, err)
+	warmed = logs.FilterMessage("warmed pebble block cache").AllUntimed()
+	require.Len(t, warmed, 1)
+	assert.Equal(t, int64(1), warmed[0].ContextMap()["keys"])
+	assert.Empty(t, cmp.Diff(expected, snapshot(warm), equal))
+	require.NoError(t, warm.Stop(context.Background()))
+}
+
+func BenchmarkFirstSnapshotAfterRestart(b *testing.B) {
+	for _, warmCache := range []bool{false, true} {
+		b.Run(fmt.Sprintf("warm_cache=%t", warmCache), func(b *testing.B) {
+			cfg := newCacheWarmingTestConfig(b, b.TempDir(), 10000)
+			cfg.WarmCache = warmCache
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				agg, err := New(cfg, zap.NewNop())
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				if _, err := agg.Snapshot(context.Background(), time.Minute); err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				closeDBs(b, agg)
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// harvestCheckpointPrefix is the reserved prefix of the keys holding the
+// harvest checkpoints. The combined metrics keys are prefixed by the
+// versioned key marker, and the legacy keys by their encoded aggregation
+// interval, which is at least one second, thus, the prefix encoding an
+// aggregation interval of zero is never used by them.
+var harvestCheckpointPrefix = []byte{0x00, 0x00, 'h', 'c'}
+
+// harvestCheckpointKey returns the key of the harvest checkpoint of the
+// aggregation interval.
+func harvestCheckpointKey(ivl time.Duration) []byte {
+	k := make([]byte, len(harvestCheckpointPrefix)+2)
+	copy(k, harvestCheckpointPrefix)
+	binary.BigEndian.PutUint16(k[len(harvestCheckpointPrefix):], uint16(ivl.Seconds()))
+	return k
+}
+
+// harvestCheckpoint is the harvest checkpoint of an aggregation interval,
+// recording the combined metrics to be retried by the next harvest.
+type harvestCheckpoint struct {
+	// processingTime is the processing time from which the next harvest
+	// must start, the zero time if there is no checkpoint.
+	processingTime time.Time
+	// retries is the number of harvests which already retried the
+	// combined metrics failing at processingTime.
+	retries int
+}
+
+// IsZero reports whether there is no harvest checkpoint.
+func (c harvestCheckpoint) IsZero() bool {
+	return c.processingTime.IsZero()
+}
+
+// harvestCheckpointValue returns the encoded harvest checkpoint.
+func harvestCheckpointValue(c harvestCheckpoint) []byte {
+	v := make([]byte, 12)
+	binary.BigEndian.PutUint64(v, uint64(c.processingTime.Unix()))
+	binary.BigEndian.PutUint32(v[8:], uint32(c.retries))
+	return v
+}
+
+// readHarvestCheckpoint returns the harvest checkpoint of the aggregation
+// interval, recording the combined metrics which failed to be processed
+// by a previous harvest, or the zero checkpoint if there is none. The
+// checkpoints without a number of retries count as not yet retried.
+func readHarvestCheckpoint(r StoreReader, ivl time.Duration) (harvestCheckpoint, error) {
+	v, err := r.Get(harvestCheckpointKey(ivl))
+	if errors.Is(err, ErrNotFound) {
+		return harvestCheckpoint{}, nil
+	}
+	if err != nil {
+		return harvestCheckpoint{}, fmt.Errorf("failed to read harvest checkpoint: %w", err)
+	}
+	if len(v) != 8 && len(v) != 12 {
+		return harvestCheckpoint{}, fmt.Errorf("invalid harvest checkpoint of %d bytes", len(v))
+	}
+	c := harvestCheckpoint{processingTime: time.Unix(int64(binary.BigEndian.Uint64(v)), 0)}
+	if len(v) == 12 {
+		c.retries = int(binary.BigEndian.Uint32(v[8:]))
+	}
+	return c, nil
+}
@@ -0,0 +1,58 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHarvestCheckpoint(t *testing.T) {
+	db, err := pebble.Open("", &pebble.Options{FS: vfs.NewMem(), Comparer: comparer})
+	require.NoError(t, err)
+	defer db.Close()
+	kv := newPebbleStore(db, pebble.Sync)
+
+	checkpoint, err := readHarvestCheckpoint(kv, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, checkpoint.IsZero())
+
+	expected := harvestCheckpoint{processingTime: time.Unix(1686000000, 0), retries: 2}
+	require.NoError(t, db.Set(harvestCheckpointKey(time.Minute), harvestCheckpointValue(expected), nil))
+	checkpoint, err = readHarvestCheckpoint(kv, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, expected, checkpoint)
+	// The checkpoints are per aggregation interval.
+	checkpoint, err = readHarvestCheckpoint(kv, time.Hour)
+	require.NoError(t, err)
+	assert.True(t, checkpoint.IsZero())
+
+	// The checkpoints without a number of retries were not yet retried.
+	require.NoError(t, db.Set(harvestCheckpointKey(time.Hour), harvestCheckpointValue(expected)[:8], nil))
+	checkpoint, err = readHarvestCheckpoint(kv, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, harvestCheckpoint{processingTime: expected.processingTime}, checkpoint)
+
+	require.NoError(t, db.Set(harvestCheckpointKey(time.Hour), []byte{1}, nil))
+	_, err = readHarvestCheckpoint(kv, time.Hour)
+	assert.EqualError(t, err, "invalid harvest checkpoint of 1 bytes")
+}
+
+func TestHarvestCheckpointKey(t *testing.T) {
+	// The checkpoint keys sort before the combined metrics keys of the
+	// lowest supported aggregation interval.
+	cmk := CombinedMetricsKey{Interval: time.Second}
+	lowest := make([]byte, cmk.SizeBinary())
+	require.NoError(t, cmk.MarshalBinaryToSizedBuffer(lowest))
+	for _, ivl := range []time.Duration{time.Second, time.Minute, 18 * time.Hour} {
+		assert.Negative(t, bytes.Compare(harvestCheckpointKey(ivl), lowest))
+	}
+}
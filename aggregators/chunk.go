@@ -0,0 +1,164 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+// serviceChunk is a part of the metrics of a service which is added to a
+// single chunk as a unit.
+type serviceChunk struct {
+	key     ServiceAggregationKey
+	metrics ServiceMetrics
+	size    int
+}
+
+// chunkCombinedMetrics splits the combined metrics into multiple combined
+// metrics, each of which has an encoded size of at most maxBytes, if
+// possible. The combined metrics are split by service and, for the services
+// exceeding maxBytes on their own, by service instance. A service instance
+// exceeding maxBytes is returned in a chunk of its own as it cannot be split
+// any further.
+//
+// The overflow buckets, the overflow estimators and the total number of
+// events are part of the first chunk only, so that merging all the chunks
+// results in the original combined metrics.
+func chunkCombinedMetrics(cm CombinedMetrics, maxBytes int) []CombinedMetrics {
+	first := CombinedMetrics{
+		Services:                          make(map[ServiceAggregationKey]ServiceMetrics),
+		OverflowServices:                  cm.OverflowServices,
+		OverflowServiceInstancesEstimator: cm.OverflowServiceInstancesEstimator,
+		eventsTotal:                       cm.eventsTotal,
+	}
+	chunks := []CombinedMetrics{first}
+	size := encodedSize(&first)
+	// The first chunk is worth sending on its own only if it has any
+	// overflow buckets.
+	nonEmpty := !cm.OverflowServices.OverflowTransaction.Empty() ||
+		!cm.OverflowServices.OverflowServiceTransaction.Empty() ||
+		!cm.OverflowServices.OverflowSpan.Empty() ||
+		!cm.OverflowServices.OverflowSpanDestination.Empty()
+	for _, sc := range splitServices(cm, maxBytes) {
+		if size+sc.size > maxBytes && nonEmpty {
+			chunks = append(chunks, CombinedMetrics{
+				Services: make(map[ServiceAggregationKey]ServiceMetrics),
+			})
+			size = 0
+		}
+		nonEmpty = true
+		current := chunks[len(chunks)-1]
+		if sm, ok := current.Services[sc.key]; ok {
+			// Parts of a service split by service instance ended up in
+			// the same chunk, the service instance groups do not overlap
+			// and the per service overflow buckets are always part of the
+			// first part of the service.
+			merged := ServiceMetrics{
+				ServiceInstanceGroups: make(
+					map[ServiceInstanceAggregationKey]ServiceInstanceMetrics,
+					len(sm.ServiceInstanceGroups)+len(sc.metrics.ServiceInstanceGroups),
+				),
+				OverflowGroups: sm.OverflowGroups,
+			}
+			for k, v := range sm.ServiceInstanceGroups {
+				merged.ServiceInstanceGroups[k] = v
+			}
+			for k, v := range sc.metrics.ServiceInstanceGroups {
+				merged.ServiceInstanceGroups[k] = v
+			}
+			current.Services[sc.key] = merged
+		} else {
+			current.Services[sc.key] = sc.metrics
+		}
+		size += sc.size
+	}
+	return chunks
+}
+
+// splitServices returns the metrics of all the services of the combined
+// metrics as service chunks. The services with an encoded size exceeding
+// maxBytes are split by service instance, with the per service overflow
+// buckets added to the first service chunk of the service.
+func splitServices(cm CombinedMetrics, maxBytes int) []serviceChunk {
+	var chunks []serviceChunk
+	for k, sm := range cm.Services {
+		size := serviceEncodedSize(k, sm)
+		if size <= maxBytes || len(sm.ServiceInstanceGroups) <= 1 {
+			chunks = append(chunks, serviceChunk{key: k, metrics: sm, size: size})
+			continue
+		}
+		overflow := sm.OverflowGroups
+		for ik, im := range sm.ServiceInstanceGroups {
+			part := ServiceMetrics{
+				ServiceInstanceGroups: map[ServiceInstanceAggregationKey]ServiceInstanceMetrics{
+					ik: im,
+				},
+				OverflowGroups: overflow,
+			}
+			overflow = Overflow{}
+			chunks = append(chunks, serviceChunk{
+				key:     k,
+				metrics: part,
+				size:    serviceEncodedSize(k, part),
+			})
+		}
+	}
+	return chunks
+}
+
+// serviceEncodedSize returns the encoded size of a combined metrics with
+// only the given service. As the encoded size includes the size of the
+// empty combined metrics fields, the sum of the sizes of multiple services
+// overestimates their combined encoded size.
+func serviceEncodedSize(k ServiceAggregationKey, sm ServiceMetrics) int {
+	return encodedSize(&CombinedMetrics{
+		Services: map[ServiceAggregationKey]ServiceMetrics{k: sm},
+	})
+}
+
+func encodedSize(cm *CombinedMetrics) int {
+	pb := cm.ToProto()
+	defer pb.ReturnToVTPool()
+	return pb.SizeVT()
+}
+
+// joinChunks merges the chunks of combined metrics split by
+// chunkCombinedMetrics, or a subset of them, back into a single combined
+// metrics. The chunks do not overlap, thus, they are merged without
+// considering the limits.
+func joinChunks(chunks []CombinedMetrics) CombinedMetrics {
+	cm := CombinedMetrics{
+		Services: make(map[ServiceAggregationKey]ServiceMetrics),
+	}
+	for i := range chunks {
+		chunk := &chunks[i]
+		cm.eventsTotal += chunk.eventsTotal
+		mergeOverflow(&cm.OverflowServices, &chunk.OverflowServices)
+		if chunk.OverflowServiceInstancesEstimator != nil {
+			mergeEstimator(&cm.OverflowServiceInstancesEstimator, chunk.OverflowServiceInstancesEstimator)
+		}
+		for k, sm := range chunk.Services {
+			existing, ok := cm.Services[k]
+			if !ok {
+				cm.Services[k] = sm
+				continue
+			}
+			// Parts of a service split by service instance, with the per
+			// service overflow buckets part of one of them only.
+			merged := ServiceMetrics{
+				ServiceInstanceGroups: make(
+					map[ServiceInstanceAggregationKey]ServiceInstanceMetrics,
+					len(existing.ServiceInstanceGroups)+len(sm.ServiceInstanceGroups),
+				),
+				OverflowGroups: existing.OverflowGroups,
+			}
+			for ik, im := range existing.ServiceInstanceGroups {
+				merged.ServiceInstanceGroups[ik] = im
+			}
+			for ik, im := range sm.ServiceInstanceGroups {
+				merged.ServiceInstanceGroups[ik] = im
+			}
+			mergeOverflow(&merged.OverflowGroups, &sm.OverflowGroups)
+			cm.Services[k] = merged
+		}
+	}
+	return cm
+}
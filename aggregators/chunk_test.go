@@ -0,0 +1,125 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunkCombinedMetrics(t *testing.T) {
+	ts := time.Unix(0, 0).UTC()
+	tcm := createTestCombinedMetrics(100).
+		addGlobalServiceOverflowTransaction(ts, "svc_overflow", "", testTransaction{txnName: "txn1", txnType: "type1", count: 5})
+	for i := 0; i < 5; i++ {
+		svc := fmt.Sprintf("svc%d", i)
+		for j := 0; j < 3; j++ {
+			labels := fmt.Sprintf("labels%d", j)
+			tcm = tcm.
+				addTransaction(ts, svc, labels, testTransaction{txnName: "txn1", txnType: "type1", count: 5}).
+				addSpan(ts, svc, labels, testSpan{spanName: "span1", count: 5})
+		}
+		tcm = tcm.addPerServiceOverflowSpan(ts, svc, "labels_overflow", testSpan{spanName: "span1", count: 1})
+	}
+	cm := CombinedMetrics(*tcm)
+	var svcKey ServiceAggregationKey
+	for k := range cm.Services {
+		svcKey = k
+		break
+	}
+	svcSize := serviceEncodedSize(svcKey, cm.Services[svcKey])
+
+	for _, tc := range []struct {
+		name      string
+		maxBytes  int
+		minChunks int
+	}{
+		{name: "no_split", maxBytes: encodedSize(&cm), minChunks: 1},
+		{name: "by_service", maxBytes: 2 * svcSize, minChunks: 3},
+		{name: "by_service_instance", maxBytes: svcSize / 2, minChunks: 6},
+		{name: "too_small", maxBytes: 1, minChunks: 15},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			chunks := chunkCombinedMetrics(cm, tc.maxBytes)
+			assert.GreaterOrEqual(t, len(chunks), tc.minChunks)
+
+			var eventsTotal int64
+			var globalOverflows int
+			sims := make(map[ServiceAggregationKey]map[ServiceInstanceAggregationKey]ServiceInstanceMetrics)
+			overflows := make(map[ServiceAggregationKey][]Overflow)
+			for _, chunk := range chunks {
+				var instances int
+				for k, sm := range chunk.Services {
+					if sims[k] == nil {
+						sims[k] = make(map[ServiceInstanceAggregationKey]ServiceInstanceMetrics)
+					}
+					for ik, im := range sm.ServiceInstanceGroups {
+						assert.NotContains(t, sims[k], ik, "service instance in multiple chunks")
+						sims[k][ik] = im
+						instances++
+					}
+					if !sm.OverflowGroups.OverflowSpan.Empty() {
+						overflows[k] = append(overflows[k], sm.OverflowGroups)
+					}
+				}
+				if instances > 1 {
+					assert.LessOrEqual(t, encodedSize(&chunk), tc.maxBytes)
+				}
+				if !chunk.OverflowServices.OverflowTransaction.Empty() {
+					globalOverflows++
+				}
+				eventsTotal += chunk.eventsTotal
+			}
+
+			assert.Equal(t, cm.eventsTotal, eventsTotal)
+			assert.Equal(t, 1, globalOverflows)
+			assert.Equal(t, cm.OverflowServices, chunks[0].OverflowServices)
+			assert.Equal(t, cm.OverflowServiceInstancesEstimator, chunks[0].OverflowServiceInstancesEstimator)
+			require.Len(t, sims, len(cm.Services))
+			for k, sm := range cm.Services {
+				assert.Empty(t, cmp.Diff(
+					sm.ServiceInstanceGroups, sims[k],
+					cmp.Exporter(func(reflect.Type) bool { return true }),
+				))
+				require.Len(t, overflows[k], 1, "per service overflow must be in exactly one chunk")
+				assert.Equal(t, sm.OverflowGroups, overflows[k][0])
+			}
+		})
+	}
+}
+
+func TestJoinChunks(t *testing.T) {
+	ts := time.Unix(0, 0).UTC()
+	tcm := createTestCombinedMetrics(100).
+		addGlobalServiceOverflowTransaction(ts, "svc_overflow", "", testTransaction{txnName: "txn1", txnType: "type1", count: 5})
+	for i := 0; i < 3; i++ {
+		svc := fmt.Sprintf("svc%d", i)
+		for j := 0; j < 3; j++ {
+			tcm = tcm.addSpan(ts, svc, fmt.Sprintf("labels%d", j), testSpan{spanName: "span1", count: 5})
+		}
+		tcm = tcm.addPerServiceOverflowSpan(ts, svc, "labels_overflow", testSpan{spanName: "span1", count: 1})
+	}
+	cm := CombinedMetrics(*tcm)
+	expected, err := cm.MarshalBinary()
+	require.NoError(t, err)
+
+	// Joining all the chunks, split by service instance, results in the
+	// original combined metrics.
+	chunks := chunkCombinedMetrics(cm, 1)
+	require.Greater(t, len(chunks), len(cm.Services))
+	joined := joinChunks(chunks)
+	assert.Equal(t, cm.eventsTotal, joined.eventsTotal)
+	assert.Equal(t, len(expected), encodedSize(&joined))
+	assert.Empty(t, cmp.Diff(
+		cm, joined,
+		cmp.Exporter(func(reflect.Type) bool { return true }),
+	))
+}
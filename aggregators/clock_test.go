@@ -0,0 +1,120 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is a clock which only advances when Advance is called.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	t.resetLocked(d)
+	return t
+}
+
+// Advance advances the clock by d, firing the timers which expire.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.timers {
+		t.fireLocked()
+	}
+}
+
+type fakeTimer struct {
+	clock    *fakeClock
+	c        chan time.Time
+	deadline time.Time
+	active   bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.active
+	t.resetLocked(d)
+	return active
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.active
+	t.active = false
+	return active
+}
+
+func (t *fakeTimer) resetLocked(d time.Duration) {
+	t.deadline = t.clock.now.Add(d)
+	t.active = true
+	t.fireLocked()
+}
+
+func (t *fakeTimer) fireLocked() {
+	if !t.active || t.clock.now.Before(t.deadline) {
+		return
+	}
+	t.active = false
+	select {
+	case t.c <- t.clock.now:
+	default:
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	now := time.Unix(0, 0)
+	clk := newFakeClock(now)
+	assert.Equal(t, now, clk.Now())
+
+	timer := clk.NewTimer(time.Second)
+	clk.Advance(999 * time.Millisecond)
+	select {
+	case <-timer.C():
+		t.Fatal("timer fired before its deadline")
+	default:
+	}
+	clk.Advance(time.Millisecond)
+	assert.Equal(t, now.Add(time.Second), <-timer.C())
+
+	assert.False(t, timer.Reset(-time.Second))
+	assert.Equal(t, now.Add(time.Second), <-timer.C())
+	timer.Reset(time.Second)
+	assert.True(t, timer.Stop())
+	clk.Advance(time.Second)
+	select {
+	case <-timer.C():
+		t.Fatal("stopped timer fired")
+	default:
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/elastic/apm-aggregation/aggregators/internal/telemetry"
+)
+
+// combinedMetricsIDAttrs maps combined metrics IDs to the attributes of
+// the telemetry recorded for the IDs, limiting the number of distinct
+// attribute sets. Once the limit is reached, the IDs mapped to attribute
+// sets which were not seen before are attributed with a single overflow
+// attribute instead, bounding the cardinality of the telemetry.
+type combinedMetricsIDAttrs struct {
+	toKVs func(string) []attribute.KeyValue
+	max   int
+
+	mu   sync.Mutex
+	seen map[attribute.Distinct]struct{}
+}
+
+func newCombinedMetricsIDAttrs(toKVs func(string) []attribute.KeyValue, max int) *combinedMetricsIDAttrs {
+	return &combinedMetricsIDAttrs{
+		toKVs: toKVs,
+		max:   max,
+		seen:  make(map[attribute.Distinct]struct{}),
+	}
+}
+
+// kvs returns the attributes for the combined metrics ID. The returned
+// slice is owned by the caller.
+func (c *combinedMetricsIDAttrs) kvs(id string) []attribute.KeyValue {
+	kvs := c.toKVs(id)
+	if c.max <= 0 || len(kvs) == 0 {
+		return kvs
+	}
+	set := attribute.NewSet(kvs...)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.seen[set.Equivalent()]; !ok {
+		if len(c.seen) >= c.max {
+			return []attribute.KeyValue{attribute.Bool(telemetry.AttributesOverflowKey, true)}
+		}
+		c.seen[set.Equivalent()] = struct{}{}
+	}
+	return kvs
+}
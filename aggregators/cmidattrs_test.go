@@ -0,0 +1,62 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/elastic/apm-aggregation/aggregators/internal/telemetry"
+)
+
+func TestCombinedMetricsIDAttrs(t *testing.T) {
+	toKVs := func(id string) []attribute.KeyValue {
+		if id == "" {
+			return nil
+		}
+		return []attribute.KeyValue{attribute.String("tenant", id)}
+	}
+	overflow := []attribute.KeyValue{attribute.Bool(telemetry.AttributesOverflowKey, true)}
+	for _, tc := range []struct {
+		name     string
+		max      int
+		ids      []string
+		expected [][]attribute.KeyValue
+	}{
+		{
+			name: "unlimited",
+			max:  0,
+			ids:  []string{"a", "b", "c"},
+			expected: [][]attribute.KeyValue{
+				toKVs("a"), toKVs("b"), toKVs("c"),
+			},
+		},
+		{
+			name: "limited",
+			max:  1,
+			ids:  []string{"a", "b", "a", "c"},
+			expected: [][]attribute.KeyValue{
+				toKVs("a"), overflow, toKVs("a"), overflow,
+			},
+		},
+		{
+			name: "empty_attributes_not_limited",
+			max:  1,
+			ids:  []string{"a", "", "b"},
+			expected: [][]attribute.KeyValue{
+				toKVs("a"), nil, overflow,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			attrs := newCombinedMetricsIDAttrs(toKVs, tc.max)
+			for i, id := range tc.ids {
+				assert.Equal(t, tc.expected[i], attrs.kvs(id), "id %q", id)
+			}
+		})
+	}
+}
@@ -10,6 +10,7 @@ package aggregators
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"sort"
 	"time"
 
@@ -22,19 +23,39 @@ import (
 	"github.com/elastic/apm-data/model/modelpb"
 )
 
+// CombinedMetricsKeyVersion is the current version of the binary
+// representation of the combined metrics keys, see
+// CombinedMetricsKey.MarshalBinaryToSizedBuffer.
+const CombinedMetricsKeyVersion = 1
+
+// versionedKeyMarker is the first byte of the versioned combined metrics
+// keys, followed by the version. The keys encoded by the previous,
+// version-less, format are prefixed by the aggregation interval, which is
+// at most 18 hours, thus, their first byte is at most 0xfd and never the
+// marker.
+const versionedKeyMarker = 0xff
+
+// ErrUnsupportedKeyVersion is returned when decoding a combined metrics
+// key encoded by an unknown version, for example, by a newer aggregator.
+var ErrUnsupportedKeyVersion = errors.New("unsupported combined metrics key version")
+
 // MarshalBinaryToSizedBuffer will marshal the combined metrics key into
 // its binary representation. The encoded byte slice will be used as a
-// key in pebbledb. To ensure efficient sorting and time range based
-// query, the first 2 bytes of the encoded slice is the aggregation
-// interval, the next 8 bytes of the encoded slice is the processing time
-// slot of the combined metrics.
+// key in pebbledb. The first 2 bytes of the encoded slice are the marker
+// byte and the version of the encoding. To ensure efficient sorting and
+// time range based query, the next 2 bytes of the encoded slice is the
+// aggregation interval, the next 8 bytes of the encoded slice is the
+// processing time slot of the combined metrics.
 func (k *CombinedMetricsKey) MarshalBinaryToSizedBuffer(data []byte) error {
 	ivlSeconds := uint16(k.Interval.Seconds())
 	if len(data) < k.SizeBinary() {
 		return errors.New("sized buffer of insufficient length")
 	}
-	binary.BigEndian.PutUint16(data, ivlSeconds)
+	data[0] = versionedKeyMarker
+	data[1] = CombinedMetricsKeyVersion
 	offset := 2
+	binary.BigEndian.PutUint16(data[offset:], ivlSeconds)
+	offset += 2
 	binary.BigEndian.PutUint64(data[offset:], uint64(k.ProcessingTime.Unix()))
 	offset += 8
 	copy(data[offset:], k.ID)
@@ -42,7 +63,28 @@ func (k *CombinedMetricsKey) MarshalBinaryToSizedBuffer(data []byte) error {
 }
 
 // UnmarshalBinary will convert the byte encoded data into CombinedMetricsKey.
+// Keys encoded by the previous, version-less, format are decoded as well to
+// allow migrating them, see migrateLegacyKeys. ErrUnsupportedKeyVersion is
+// returned if the key is encoded by an unknown version.
 func (k *CombinedMetricsKey) UnmarshalBinary(data []byte) error {
+	if !isVersionedKey(data) {
+		return k.unmarshalLegacyBinary(data)
+	}
+	if len(data) < 12 {
+		return errors.New("invalid encoded data of insufficient length")
+	}
+	if v := data[1]; v != CombinedMetricsKeyVersion {
+		return fmt.Errorf("%w: %d, expected %d", ErrUnsupportedKeyVersion, v, CombinedMetricsKeyVersion)
+	}
+	k.Interval = time.Duration(binary.BigEndian.Uint16(data[2:4])) * time.Second
+	k.ProcessingTime = time.Unix(int64(binary.BigEndian.Uint64(data[4:12])), 0)
+	k.ID = string(data[12:])
+	return nil
+}
+
+// unmarshalLegacyBinary decodes the combined metrics key encoded by the
+// previous, version-less, format prefixed by the aggregation interval.
+func (k *CombinedMetricsKey) unmarshalLegacyBinary(data []byte) error {
 	if len(data) < 10 {
 		return errors.New("invalid encoded data of insufficient length")
 	}
@@ -52,13 +94,29 @@ func (k *CombinedMetricsKey) UnmarshalBinary(data []byte) error {
 	return nil
 }
 
+// isVersionedKey reports whether the key is encoded by a versioned format,
+// regardless of the version.
+func isVersionedKey(data []byte) bool {
+	return len(data) > 0 && data[0] == versionedKeyMarker
+}
+
+// intervalKeyPrefix returns the prefix of the combined metrics keys of
+// the aggregation interval.
+func intervalKeyPrefix(ivl time.Duration) []byte {
+	prefix := []byte{versionedKeyMarker, CombinedMetricsKeyVersion, 0, 0}
+	binary.BigEndian.PutUint16(prefix[2:], uint16(ivl.Seconds()))
+	return prefix
+}
+
 // SizeBinary returns the size of the byte array required to encode
 // combined metrics key.
 func (k *CombinedMetricsKey) SizeBinary() int {
+	// 1 byte for the versioned key marker
+	// 1 byte for the version
 	// 2 bytes for interval encoding
 	// 8 bytes for timestamp encoding
 	// rest for encoding combined metrics ID
-	return 2 + 8 + len(k.ID)
+	return 1 + 1 + 2 + 8 + len(k.ID)
 }
 
 // ToProto converts CombinedMetrics to its protobuf representation.
@@ -112,6 +170,29 @@ func (m *CombinedMetrics) UnmarshalBinary(data []byte) error {
 	return nil
 }
 
+// DecodeCombinedMetricsKey decodes the binary representation of a combined
+// metrics key, as encoded by CombinedMetricsKey.MarshalBinaryToSizedBuffer.
+func DecodeCombinedMetricsKey(data []byte) (CombinedMetricsKey, error) {
+	var k CombinedMetricsKey
+	if err := k.UnmarshalBinary(data); err != nil {
+		return CombinedMetricsKey{}, err
+	}
+	return k, nil
+}
+
+// DecodeCombinedMetrics decodes the binary protobuf representation of a
+// combined metrics, as encoded by CombinedMetrics.MarshalBinary, to its
+// protobuf representation. Unlike CombinedMetrics.UnmarshalBinary, the
+// returned protobuf is not backed by the protobuf pool and is owned by
+// the caller.
+func DecodeCombinedMetrics(data []byte) (*aggregationpb.CombinedMetrics, error) {
+	pb := &aggregationpb.CombinedMetrics{}
+	if err := pb.UnmarshalVT(data); err != nil {
+		return nil, err
+	}
+	return pb, nil
+}
+
 // ToProto converts ServiceAggregationKey to its protobuf representation.
 func (k *ServiceAggregationKey) ToProto() *aggregationpb.ServiceAggregationKey {
 	pb := aggregationpb.ServiceAggregationKeyFromVTPool()
@@ -195,6 +276,13 @@ func (m *ServiceInstanceMetrics) ToProto() *aggregationpb.ServiceInstanceMetrics
 		ksm.Metrics = m.ToProto()
 		pb.SpanMetrics = append(pb.SpanMetrics, ksm)
 	}
+	pb.SpanDestinationMetrics = make([]*aggregationpb.KeyedSpanDestinationMetrics, 0, len(m.SpanDestinationGroups))
+	for k, m := range m.SpanDestinationGroups {
+		ksdm := aggregationpb.KeyedSpanDestinationMetricsFromVTPool()
+		ksdm.Key = k.ToProto()
+		ksdm.Metrics = m.ToProto()
+		pb.SpanDestinationMetrics = append(pb.SpanDestinationMetrics, ksdm)
+	}
 	return pb
 }
 
@@ -225,6 +313,14 @@ func (m *ServiceInstanceMetrics) FromProto(pb *aggregationpb.ServiceInstanceMetr
 		v.FromProto(ksm.Metrics)
 		m.SpanGroups[k] = v
 	}
+	m.SpanDestinationGroups = make(map[SpanDestinationAggregationKey]SpanMetrics, len(pb.SpanDestinationMetrics))
+	for _, ksdm := range pb.SpanDestinationMetrics {
+		var k SpanDestinationAggregationKey
+		var v SpanMetrics
+		k.FromProto(ksdm.Key)
+		v.FromProto(ksdm.Metrics)
+		m.SpanDestinationGroups[k] = v
+	}
 }
 
 // ToProto converts TransactionAggregationKey to its protobuf representation.
@@ -315,11 +411,13 @@ func (k *TransactionAggregationKey) FromProto(pb *aggregationpb.TransactionAggre
 func (m *TransactionMetrics) ToProto() *aggregationpb.TransactionMetrics {
 	pb := aggregationpb.TransactionMetricsFromVTPool()
 	pb.Histogram = HistogramToProto(m.Histogram)
+	pb.DroppedSpansCount = m.DroppedSpansCount
 	return pb
 }
 
 // FromProto converts protobuf representation to TransactionMetrics.
 func (m *TransactionMetrics) FromProto(pb *aggregationpb.TransactionMetrics) {
+	m.DroppedSpansCount = pb.DroppedSpansCount
 	if m.Histogram == nil && pb.Histogram != nil {
 		m.Histogram = hdrhistogram.New()
 	}
@@ -418,6 +516,18 @@ func (k *SpanAggregationKey) FromProto(pb *aggregationpb.SpanAggregationKey) {
 	k.Resource = pb.Resource
 }
 
+// ToProto converts SpanDestinationAggregationKey to its protobuf representation.
+func (k *SpanDestinationAggregationKey) ToProto() *aggregationpb.SpanDestinationAggregationKey {
+	pb := aggregationpb.SpanDestinationAggregationKeyFromVTPool()
+	pb.Resource = k.Resource
+	return pb
+}
+
+// FromProto converts protobuf representation to SpanDestinationAggregationKey.
+func (k *SpanDestinationAggregationKey) FromProto(pb *aggregationpb.SpanDestinationAggregationKey) {
+	k.Resource = pb.Resource
+}
+
 // ToProto converts the SpanMetrics to its protobuf representation.
 func (m *SpanMetrics) ToProto() *aggregationpb.SpanMetrics {
 	pb := aggregationpb.SpanMetricsFromVTPool()
@@ -441,6 +551,12 @@ func (o *Overflow) ToProto() *aggregationpb.Overflow {
 	pb.OverflowTransactionsEstimator = hllBytes(o.OverflowTransaction.Estimator)
 	pb.OverflowServiceTransactionsEstimator = hllBytes(o.OverflowServiceTransaction.Estimator)
 	pb.OverflowSpansEstimator = hllBytes(o.OverflowSpan.Estimator)
+	// Span destinations are only aggregated if enabled, avoid encoding
+	// the overflow metrics otherwise.
+	if !o.OverflowSpanDestination.Empty() {
+		pb.OverflowSpanDestinations = o.OverflowSpanDestination.Metrics.ToProto()
+		pb.OverflowSpanDestinationsEstimator = hllBytes(o.OverflowSpanDestination.Estimator)
+	}
 	return pb
 }
 
@@ -452,6 +568,10 @@ func (o *Overflow) FromProto(pb *aggregationpb.Overflow) {
 	o.OverflowTransaction.Estimator = hllSketch(pb.OverflowTransactionsEstimator)
 	o.OverflowServiceTransaction.Estimator = hllSketch(pb.OverflowServiceTransactionsEstimator)
 	o.OverflowSpan.Estimator = hllSketch(pb.OverflowSpansEstimator)
+	if pb.OverflowSpanDestinations != nil {
+		o.OverflowSpanDestination.Metrics.FromProto(pb.OverflowSpanDestinations)
+	}
+	o.OverflowSpanDestination.Estimator = hllSketch(pb.OverflowSpanDestinationsEstimator)
 }
 
 // ToProto converts GlobalLabels to its protobuf representation.
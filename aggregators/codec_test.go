@@ -5,13 +5,16 @@
 package aggregators
 
 import (
+	"encoding/binary"
 	"fmt"
+	"reflect"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/testing/protocmp"
 
 	"github.com/elastic/apm-aggregation/aggregators/internal/hdrhistogram"
 	"github.com/elastic/apm-data/model/modelpb"
@@ -31,6 +34,76 @@ func TestCombinedMetricsKey(t *testing.T) {
 	assert.Empty(t, cmp.Diff(expected, actual))
 }
 
+func TestDecodeCombinedMetricsKey(t *testing.T) {
+	expected := CombinedMetricsKey{
+		Interval:       time.Minute,
+		ProcessingTime: time.Now().Truncate(time.Minute),
+		ID:             "cm01",
+	}
+	data := make([]byte, expected.SizeBinary())
+	assert.NoError(t, expected.MarshalBinaryToSizedBuffer(data))
+
+	actual, err := DecodeCombinedMetricsKey(data)
+	assert.NoError(t, err)
+	assert.Empty(t, cmp.Diff(expected, actual))
+
+	_, err = DecodeCombinedMetricsKey(data[:5])
+	assert.Error(t, err)
+
+	// Keys encoded by an unknown version are rejected.
+	data[1] = CombinedMetricsKeyVersion + 1
+	_, err = DecodeCombinedMetricsKey(data)
+	assert.ErrorIs(t, err, ErrUnsupportedKeyVersion)
+}
+
+func TestDecodeLegacyCombinedMetricsKey(t *testing.T) {
+	for _, ivl := range []time.Duration{time.Second, 5 * time.Minute, 18 * time.Hour} {
+		expected := CombinedMetricsKey{
+			Interval:       ivl,
+			ProcessingTime: time.Now().Truncate(ivl),
+			ID:             "cm01",
+		}
+		actual, err := DecodeCombinedMetricsKey(legacyCombinedMetricsKey(expected))
+		assert.NoError(t, err)
+		assert.Empty(t, cmp.Diff(expected, actual))
+	}
+}
+
+// legacyCombinedMetricsKey encodes the combined metrics key by the
+// previous, version-less, format.
+func legacyCombinedMetricsKey(k CombinedMetricsKey) []byte {
+	data := make([]byte, 10+len(k.ID))
+	binary.BigEndian.PutUint16(data, uint16(k.Interval.Seconds()))
+	binary.BigEndian.PutUint64(data[2:], uint64(k.ProcessingTime.Unix()))
+	copy(data[10:], k.ID)
+	return data
+}
+
+func TestDecodeCombinedMetrics(t *testing.T) {
+	ts := time.Unix(0, 0).UTC()
+	expected := CombinedMetrics(*createTestCombinedMetrics(10).
+		addTransaction(ts, "svc1", "", testTransaction{txnName: "txn1", txnType: "type1", count: 5}).
+		addServiceTransaction(ts, "svc1", "", testServiceTransaction{txnType: "type1", count: 5}).
+		addSpan(ts, "svc1", "", testSpan{spanName: "span1", count: 5}),
+	)
+	data, err := expected.MarshalBinary()
+	assert.NoError(t, err)
+
+	pb, err := DecodeCombinedMetrics(data)
+	assert.NoError(t, err)
+	assert.Empty(t, cmp.Diff(expected.ToProto(), pb, protocmp.Transform()))
+
+	var actual CombinedMetrics
+	actual.FromProto(pb)
+	assert.Empty(t, cmp.Diff(
+		expected, actual,
+		cmp.Exporter(func(reflect.Type) bool { return true }),
+	))
+
+	_, err = DecodeCombinedMetrics([]byte("invalid"))
+	assert.Error(t, err)
+}
+
 func TestGlobalLabels(t *testing.T) {
 	expected := GlobalLabels{
 		Labels: map[string]*modelpb.LabelValue{
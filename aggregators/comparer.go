@@ -0,0 +1,47 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/bloom"
+)
+
+// bloomFilterBitsPerKey is the number of bits per key of the bloom
+// filters of the sstables, giving a false positive rate of about 1%.
+const bloomFilterBitsPerKey = 10
+
+// comparer is the pebble comparer of the aggregator's databases. It orders
+// the keys bytewise, exactly as pebble.DefaultComparer, and has the same
+// name, thus, it can open the databases created without it. Unlike
+// pebble.DefaultComparer, which has no split, its split marks the end of
+// the interval and combined metrics ID of the versioned combined metrics
+// keys, which, as the ID is the last component of the key, is the end of
+// the key. All the other keys, such as the reserved keys, are a prefix on
+// their own.
+//
+// The sstables have bloom filters of the prefixes, see
+// bloomFilterPolicy, which are consulted by the prefix seeks of the point
+// lookups of the keys, see pebbleGet, thus, the databases read by
+// pebbleGet must be opened with the comparer. The harvests, snapshots
+// and queries scan bounded key ranges instead, skipping the sstables by
+// their key bounds, as the range of a harvest may hold several
+// processing times and IDs.
+//
+// Bloom filters are built from the prefixes, thus, the split must not be
+// changed once they are configured without changing the filter policy.
+var comparer = func() *pebble.Comparer {
+	c := *pebble.DefaultComparer
+	c.Split = splitKey
+	return &c
+}()
+
+// bloomFilterPolicy is the filter policy of the sstables of all levels.
+var bloomFilterPolicy = bloom.FilterPolicy(bloomFilterBitsPerKey)
+
+// splitKey returns the length of the prefix of the key, see comparer.
+func splitKey(key []byte) int {
+	return len(key)
+}
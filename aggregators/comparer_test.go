@@ -0,0 +1,207 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-data/model/modelpb"
+)
+
+func TestSplitKey(t *testing.T) {
+	ts := time.Unix(1686000000, 0)
+	keys := [][]byte{
+		idempotencyTokenKey("token"),
+		harvestCheckpointKey(time.Minute),
+		legacyCombinedMetricsKey(CombinedMetricsKey{Interval: time.Minute, ProcessingTime: ts, ID: "a"}),
+		intervalKeyPrefix(time.Minute),
+		intervalKeyPrefix(time.Hour),
+		{versionedKeyMarker},
+	}
+	for _, ivl := range []time.Duration{time.Minute, time.Hour} {
+		for _, pt := range []time.Time{ts, ts.Add(ivl)} {
+			for _, id := range []string{"", "a", "ab", "b", "\xff"} {
+				cmk := CombinedMetricsKey{Interval: ivl, ProcessingTime: pt, ID: id}
+				key := make([]byte, cmk.SizeBinary())
+				require.NoError(t, cmk.MarshalBinaryToSizedBuffer(key))
+				assert.Equal(t, len(key), splitKey(key))
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return comparer.Compare(keys[i], keys[j]) < 0
+	})
+
+	// The properties required by pebble.Split.
+	for _, a := range keys {
+		prefix, suffix := a[:splitKey(a)], a[splitKey(a):]
+		assert.True(t, bytes.HasPrefix(a, prefix))
+		if len(suffix) > 0 {
+			assert.Negative(t, comparer.Compare(prefix, a))
+		}
+		for _, b := range keys {
+			bPrefix, bSuffix := b[:splitKey(b)], b[splitKey(b):]
+			if comparer.Compare(a, b) <= 0 {
+				assert.LessOrEqual(t, comparer.Compare(prefix, bPrefix), 0, "%x %x", a, b)
+			}
+			if comparer.Compare(prefix, bPrefix) == 0 {
+				assert.Equal(t, comparer.Compare(a, b), comparer.Compare(suffix, bSuffix), "%x %x", a, b)
+			}
+		}
+	}
+	// The keys are ordered exactly as by the default comparer.
+	assert.True(t, sort.SliceIsSorted(keys, func(i, j int) bool {
+		return pebble.DefaultComparer.Compare(keys[i], keys[j]) < 0
+	}))
+}
+
+func TestComparer(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Unix(1686000000, 0).Truncate(time.Minute)
+
+	// A database created with the default comparer can be opened.
+	db, err := pebble.Open(dir, &pebble.Options{
+		Merger: &pebble.Merger{Name: "combined_metrics_merger", Merge: pebble.DefaultMerger.Merge},
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Set(harvestCheckpointKey(time.Minute), harvestCheckpointValue(harvestCheckpoint{processingTime: start}), nil))
+	require.NoError(t, db.Close())
+
+	var harvested []CombinedMetricsKey
+	agg := newTestAggregator(t, AggregatorConfig{
+		DataDir: dir,
+		Processor: func(_ context.Context, cmk CombinedMetricsKey, _ CombinedMetrics, _ time.Duration) error {
+			harvested = append(harvested, cmk)
+			return nil
+		},
+		AggregationIntervals: []time.Duration{time.Minute},
+		clock:                newFakeClock(start),
+	})
+
+	for _, id := range []string{"id1", "id2"} {
+		batch := modelpb.Batch{
+			makeSpan(start, "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+		}
+		require.NoError(t, agg.AggregateBatch(context.Background(), id, &batch))
+	}
+	_, err = agg.Snapshot(context.Background(), time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, agg.stores[0].db.Flush())
+
+	// The combined metrics are read by their key from the sstables with
+	// bloom filters.
+	for _, id := range []string{"id1", "id2"} {
+		cmk := CombinedMetricsKey{Interval: time.Minute, ProcessingTime: start, ID: id}
+		key := make([]byte, cmk.SizeBinary())
+		require.NoError(t, cmk.MarshalBinaryToSizedBuffer(key))
+		v, err := agg.stores[0].kv.Get(key)
+		require.NoError(t, err)
+		assert.NotEmpty(t, v)
+		key = append(key[:len(key)-1], '3')
+		_, err = agg.stores[0].kv.Get(key)
+		assert.ErrorIs(t, err, ErrNotFound)
+	}
+	var filtered bool
+	levels, err := agg.stores[0].db.SSTables(pebble.WithProperties())
+	require.NoError(t, err)
+	for _, tables := range levels {
+		for _, table := range tables {
+			filtered = filtered || table.Properties.FilterPolicyName == bloomFilterPolicy.Name()
+		}
+	}
+	assert.True(t, filtered)
+
+	require.NoError(t, agg.Stop(context.Background()))
+	assert.Equal(t, []CombinedMetricsKey{
+		{Interval: time.Minute, ProcessingTime: start, ID: "id1"},
+		{Interval: time.Minute, ProcessingTime: start, ID: "id2"},
+	}, harvested)
+}
+
+// BenchmarkPrefixSeek compares reading the combined metrics by their key
+// with a prefix seek, with and without bloom filters, to reading them by
+// Get, which does not consult the bloom filters. Half of the keys read
+// are not found, as for the idempotency tokens. The sstables are held in
+// memory and their blocks are cached, thus, the reads of the blocks
+// skipped by the bloom filters are not accounted for.
+func BenchmarkPrefixSeek(b *testing.B) {
+	const (
+		tables          = 20
+		processingTimes = 2000
+		ids             = 10
+	)
+	start := time.Unix(1686000000, 0).Truncate(time.Minute)
+	key := func(i int) []byte {
+		cmk := CombinedMetricsKey{
+			Interval:       time.Minute,
+			ProcessingTime: start.Add(time.Duration(i/ids%processingTimes) * time.Minute),
+			ID:             fmt.Sprintf("id%d", i%(2*ids)),
+		}
+		key := make([]byte, cmk.SizeBinary())
+		cmk.MarshalBinaryToSizedBuffer(key)
+		return key
+	}
+	for _, tc := range []struct {
+		name string
+		opts *pebble.Options
+	}{
+		{name: "no_bloom_filter", opts: &pebble.Options{}},
+		{name: "bloom_filter", opts: &pebble.Options{
+			Levels: []pebble.LevelOptions{{
+				FilterPolicy: bloomFilterPolicy,
+				FilterType:   pebble.TableFilter,
+			}},
+		}},
+	} {
+		tc.opts.FS = vfs.NewMem()
+		tc.opts.Comparer = comparer
+		// The sstables are kept in L0, without stalling the writes.
+		tc.opts.DisableAutomaticCompactions = true
+		tc.opts.L0StopWritesThreshold = tables + 1
+		db, err := pebble.Open("", tc.opts)
+		require.NoError(b, err)
+		defer db.Close()
+		// Every sstable holds every tables-th processing time, thus,
+		// the key ranges of all the sstables overlap. Only the first
+		// half of the IDs are written.
+		for table := 0; table < tables; table++ {
+			for pt := table; pt < processingTimes; pt += tables {
+				for id := 0; id < ids; id++ {
+					require.NoError(b, db.Set(key(pt*ids+id), []byte("value"), pebble.NoSync))
+				}
+			}
+			require.NoError(b, db.Flush())
+		}
+
+		b.Run(tc.name+"/prefix_seek", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := pebbleGet(db, key(i)); err != nil && err != pebble.ErrNotFound {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(tc.name+"/get", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, closer, err := db.Get(key(i))
+				if err == nil {
+					closer.Close()
+				} else if err != pebble.ErrNotFound {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
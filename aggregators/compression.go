@@ -0,0 +1,181 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/elastic/apm-aggregation/aggregationpb"
+)
+
+// Codec is the compression codec of the harvested payloads passed to a
+// PayloadProcessor.
+type Codec uint8
+
+const (
+	// CodecNone means that the payloads are not compressed.
+	CodecNone Codec = iota
+	// CodecGzip compresses the payloads using gzip.
+	CodecGzip
+	// CodecZstd compresses the payloads using zstd.
+	CodecZstd
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// String returns the name of the codec.
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecGzip:
+		return "gzip"
+	case CodecZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(c))
+	}
+}
+
+// Compress compresses the given data using the codec. The returned slice
+// never shares memory with the given data.
+func (c Codec) Compress(data []byte) ([]byte, error) {
+	switch c {
+	case CodecNone:
+		return append([]byte(nil), data...), nil
+	case CodecGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, fmt.Errorf("failed to gzip compress: %w", err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, fmt.Errorf("failed to gzip compress: %w", err)
+		}
+		return buf.Bytes(), nil
+	case CodecZstd:
+		enc, _, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncodeAll(data, nil), nil
+	default:
+		return nil, fmt.Errorf("unsupported codec %s", c)
+	}
+}
+
+// Decompress decompresses the given data compressed using the codec.
+func (c Codec) Decompress(data []byte) ([]byte, error) {
+	switch c {
+	case CodecNone:
+		return data, nil
+	case CodecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to gzip decompress: %w", err)
+		}
+		defer r.Close()
+		out, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to gzip decompress: %w", err)
+		}
+		return out, nil
+	case CodecZstd:
+		_, dec, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		out, err := dec.DecodeAll(data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to zstd decompress: %w", err)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unsupported codec %s", c)
+	}
+}
+
+// DecodeCompressedCombinedMetrics decompresses the given payload, as passed
+// to a PayloadProcessor, using the codec and decodes it to the protobuf
+// representation of the combined metrics, see DecodeCombinedMetrics.
+func DecodeCompressedCombinedMetrics(payload []byte, codec Codec) (*aggregationpb.CombinedMetrics, error) {
+	data, err := codec.Decompress(payload)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeCombinedMetrics(data)
+}
+
+// zstdCodec returns the zstd encoder and decoder shared by all the
+// aggregators, both are safe for concurrent use with EncodeAll and
+// DecodeAll.
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			zstdErr = fmt.Errorf("failed to create zstd encoder: %w", zstdErr)
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+		if zstdErr != nil {
+			zstdErr = fmt.Errorf("failed to create zstd decoder: %w", zstdErr)
+		}
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+// SSTableCompression is the block compression of the sstables of the
+// aggregator's pebble databases, see AggregatorConfig.SSTableCompression.
+type SSTableCompression uint8
+
+const (
+	// SSTableCompressionSnappy compresses the sstable blocks using
+	// snappy, pebble's default.
+	SSTableCompressionSnappy SSTableCompression = iota
+	// SSTableCompressionNone means that the sstable blocks are not
+	// compressed.
+	SSTableCompressionNone
+	// SSTableCompressionZstd compresses the sstable blocks using zstd.
+	SSTableCompressionZstd
+)
+
+// String returns the name of the sstable compression.
+func (c SSTableCompression) String() string {
+	switch c {
+	case SSTableCompressionSnappy:
+		return "snappy"
+	case SSTableCompressionNone:
+		return "none"
+	case SSTableCompressionZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(c))
+	}
+}
+
+// pebbleCompression returns the pebble compression of the sstable
+// compression.
+func (c SSTableCompression) pebbleCompression() pebble.Compression {
+	switch c {
+	case SSTableCompressionNone:
+		return pebble.NoCompression
+	case SSTableCompressionZstd:
+		return pebble.ZstdCompression
+	default:
+		return pebble.SnappyCompression
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/testing/protocmp"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	ts := time.Unix(0, 0).UTC()
+	cm := CombinedMetrics(*createTestCombinedMetrics(10).
+		addTransaction(ts, "svc1", "", testTransaction{txnName: "txn1", txnType: "type1", count: 5}).
+		addServiceTransaction(ts, "svc1", "", testServiceTransaction{txnType: "type1", count: 5}).
+		addSpan(ts, "svc1", "", testSpan{spanName: "span1", count: 5}),
+	)
+	data, err := cm.MarshalBinary()
+	require.NoError(t, err)
+
+	for _, codec := range []Codec{CodecNone, CodecGzip, CodecZstd} {
+		t.Run(codec.String(), func(t *testing.T) {
+			payload, err := codec.Compress(data)
+			require.NoError(t, err)
+			if codec == CodecNone {
+				assert.Equal(t, data, payload)
+				assert.NotSame(t, &data[0], &payload[0])
+			}
+
+			decompressed, err := codec.Decompress(payload)
+			require.NoError(t, err)
+			assert.Equal(t, data, decompressed)
+
+			pb, err := DecodeCompressedCombinedMetrics(payload, codec)
+			require.NoError(t, err)
+			assert.Empty(t, cmp.Diff(cm.ToProto(), pb, protocmp.Transform()))
+		})
+	}
+}
+
+func TestCodecErrors(t *testing.T) {
+	for _, codec := range []Codec{CodecGzip, CodecZstd} {
+		_, err := codec.Decompress([]byte("invalid"))
+		assert.Error(t, err, codec.String())
+	}
+	_, err := Codec(100).Compress(nil)
+	assert.EqualError(t, err, "unsupported codec unknown(100)")
+	_, err = Codec(100).Decompress(nil)
+	assert.EqualError(t, err, "unsupported codec unknown(100)")
+}
+
+func BenchmarkHarvestCompression(b *testing.B) {
+	ts := time.Unix(0, 0).UTC()
+	tcm := createTestCombinedMetrics(1000)
+	for i := 0; i < 100; i++ {
+		svc := fmt.Sprintf("svc%d", i%10)
+		tcm = tcm.
+			addTransaction(ts, svc, "", testTransaction{txnName: fmt.Sprintf("txn%d", i), txnType: "type1", count: 5}).
+			addServiceTransaction(ts, svc, "", testServiceTransaction{txnType: "type1", count: 5}).
+			addSpan(ts, svc, "", testSpan{spanName: fmt.Sprintf("span%d", i), count: 5})
+	}
+	cm := CombinedMetrics(*tcm)
+	data, err := cm.MarshalBinary()
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, codec := range []Codec{CodecNone, CodecGzip, CodecZstd} {
+		b.Run(codec.String(), func(b *testing.B) {
+			var payload []byte
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				payload, err = codec.Compress(data)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(len(data)), "raw_bytes")
+			b.ReportMetric(float64(len(payload)), "payload_bytes")
+		})
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
+	"github.com/elastic/apm-aggregation/aggregators/internal/hdrhistogram"
 	"github.com/elastic/apm-data/model/modelpb"
 )
 
@@ -22,23 +23,78 @@ const (
 	svcTxnMetricsetName  = "service_transaction"
 	summaryMetricsetName = "service_summary"
 
-	overflowBucketName = "_other"
+	defaultOverflowBucketName = "_other"
 )
 
-func setMetricCountBasedOnOutcome(stm *ServiceTransactionMetrics, from *modelpb.APMEvent) {
-	txn := from.GetTransaction()
+// ConverterOption configures the conversion of CombinedMetrics to APMEvents.
+type ConverterOption func(converterConfig) converterConfig
+
+type converterConfig struct {
+	overflowBucketName string
+}
+
+// WithOverflowBucketName configures the name used for the overflow buckets
+// in the converted APMEvents: the service name of the global service
+// overflow, the transaction name of the transaction overflow, the
+// transaction type of the service transaction overflow, and the target
+// name of the span overflow. Defaults to "_other".
+func WithOverflowBucketName(name string) ConverterOption {
+	return func(cfg converterConfig) converterConfig {
+		cfg.overflowBucketName = name
+		return cfg
+	}
+}
+
+func newConverterConfig(opts ...ConverterOption) converterConfig {
+	cfg := converterConfig{overflowBucketName: defaultOverflowBucketName}
+	for _, opt := range opts {
+		cfg = opt(cfg)
+	}
+	return cfg
+}
+
+func setMetricCountBasedOnOutcome(stm *ServiceTransactionMetrics, from *modelpb.APMEvent, repCount float64) {
 	switch from.GetEvent().GetOutcome() {
 	case "failure":
-		stm.FailureCount = txn.GetRepresentativeCount()
+		stm.FailureCount = repCount
 	case "success":
-		stm.SuccessCount = txn.GetRepresentativeCount()
+		stm.SuccessCount = repCount
+	}
+}
+
+// representativeCount returns the number of events represented by the
+// given event, 1 for events other than transactions and spans.
+func representativeCount(e *modelpb.APMEvent) float64 {
+	processor := e.GetProcessor()
+	switch {
+	case processor.IsTransaction():
+		return e.GetTransaction().GetRepresentativeCount()
+	case processor.IsSpan():
+		return e.GetSpan().GetRepresentativeCount()
 	}
+	return 1
 }
 
-// EventToCombinedMetrics converts APMEvent to CombinedMetrics.
+// EventToCombinedMetrics converts APMEvent to CombinedMetrics, including
+// the span destination groups.
 func EventToCombinedMetrics(
 	e *modelpb.APMEvent,
 	aggInterval time.Duration,
+) (CombinedMetrics, error) {
+	return eventToCombinedMetrics(e, aggInterval, 1, hdrhistogram.DefaultSignificantFigures, true)
+}
+
+// eventToCombinedMetrics converts APMEvent to CombinedMetrics with the
+// representative count of the event scaled by the given weight and the
+// transaction durations recorded in histograms with the given number of
+// significant figures. Span destination groups are only created if
+// spanDestinations is true.
+func eventToCombinedMetrics(
+	e *modelpb.APMEvent,
+	aggInterval time.Duration,
+	weight float64,
+	significantFigures int64,
+	spanDestinations bool,
 ) (CombinedMetrics, error) {
 	var (
 		cm  CombinedMetrics
@@ -50,16 +106,27 @@ func EventToCombinedMetrics(
 	processor := e.GetProcessor()
 	switch {
 	case processor.IsTransaction():
-		repCount := e.GetTransaction().GetRepresentativeCount()
+		repCount := e.GetTransaction().GetRepresentativeCount() * weight
 		if repCount <= 0 {
 			return cm, nil
 		}
-		tm := newTransactionMetrics()
-		stm := newServiceTransactionMetrics()
+		tmHist, err := hdrhistogram.NewWithSignificantFigures(significantFigures)
+		if err != nil {
+			return CombinedMetrics{}, err
+		}
+		stmHist, err := hdrhistogram.NewWithSignificantFigures(significantFigures)
+		if err != nil {
+			return CombinedMetrics{}, err
+		}
+		tm := TransactionMetrics{
+			Histogram:         tmHist,
+			DroppedSpansCount: float64(e.GetTransaction().GetSpanCount().GetDropped()) * repCount,
+		}
+		stm := ServiceTransactionMetrics{Histogram: stmHist}
 		tm.Histogram.RecordDuration(e.GetEvent().GetDuration().AsDuration(), repCount)
 		stm.Histogram.RecordDuration(e.GetEvent().GetDuration().AsDuration(), repCount)
 
-		setMetricCountBasedOnOutcome(&stm, e)
+		setMetricCountBasedOnOutcome(&stm, e, repCount)
 		sim.TransactionGroups = map[TransactionAggregationKey]TransactionMetrics{
 			transactionKey(e): tm,
 		}
@@ -69,19 +136,31 @@ func EventToCombinedMetrics(
 		// Handle dropped span stats
 		dss := e.GetTransaction().GetDroppedSpansStats()
 		var spanGroups map[SpanAggregationKey]SpanMetrics
+		var spanDestGroups map[SpanDestinationAggregationKey]SpanMetrics
 		if len(dss) > 0 {
 			spanGroups = make(map[SpanAggregationKey]SpanMetrics, len(dss))
 			for _, ds := range dss {
-				spanGroups[droppedSpanStatsKey(ds)] = SpanMetrics{
+				sm := SpanMetrics{
 					Count: float64(ds.GetDuration().GetCount()) * repCount,
 					Sum:   float64(ds.GetDuration().GetSum().AsDuration()) * repCount,
 				}
+				spanGroups[droppedSpanStatsKey(ds)] = sm
+				if resource := ds.GetDestinationServiceResource(); spanDestinations && resource != "" {
+					if spanDestGroups == nil {
+						spanDestGroups = make(map[SpanDestinationAggregationKey]SpanMetrics)
+					}
+					spanDestKey := SpanDestinationAggregationKey{Resource: resource}
+					spanDest := spanDestGroups[spanDestKey]
+					mergeSpanMetrics(&spanDest, &sm)
+					spanDestGroups[spanDestKey] = spanDest
+				}
 			}
 			sim.SpanGroups = spanGroups
+			sim.SpanDestinationGroups = spanDestGroups
 		}
 	case processor.IsSpan():
 		target := e.GetService().GetTarget()
-		repCount := e.GetSpan().GetRepresentativeCount()
+		repCount := e.GetSpan().GetRepresentativeCount() * weight
 		destSvc := e.GetSpan().GetDestinationService().GetResource()
 		if repCount <= 0 || (target == nil && destSvc == "") {
 			return cm, nil
@@ -94,11 +173,17 @@ func EventToCombinedMetrics(
 			count = composite.GetCount()
 			duration = time.Duration(composite.GetSum() * float64(time.Millisecond))
 		}
+		sm := SpanMetrics{
+			Count: float64(count) * repCount,
+			Sum:   float64(duration) * repCount,
+		}
 		sim.SpanGroups = map[SpanAggregationKey]SpanMetrics{
-			spanKey(e): SpanMetrics{
-				Count: float64(count) * repCount,
-				Sum:   float64(duration) * repCount,
-			},
+			spanKey(e): sm,
+		}
+		if spanDestinations && destSvc != "" {
+			sim.SpanDestinationGroups = map[SpanDestinationAggregationKey]SpanMetrics{
+				{Resource: destSvc}: sm,
+			}
 		}
 	}
 
@@ -121,10 +206,12 @@ func CombinedMetricsToBatch(
 	cm CombinedMetrics,
 	processingTime time.Time,
 	aggInterval time.Duration,
+	opts ...ConverterOption,
 ) (*modelpb.Batch, error) {
 	if len(cm.Services) == 0 {
 		return nil, nil
 	}
+	cfg := newConverterConfig(opts...)
 
 	batchSize := 0
 	// service_summary overflow metric
@@ -201,6 +288,7 @@ func CombinedMetricsToBatch(
 				sm.OverflowGroups.OverflowTransaction,
 				event,
 				aggIntervalStr,
+				cfg.overflowBucketName,
 			)
 			b = append(b, event)
 		}
@@ -211,6 +299,7 @@ func CombinedMetricsToBatch(
 				sm.OverflowGroups.OverflowServiceTransaction,
 				event,
 				aggIntervalStr,
+				cfg.overflowBucketName,
 			)
 			b = append(b, event)
 		}
@@ -221,6 +310,7 @@ func CombinedMetricsToBatch(
 				sm.OverflowGroups.OverflowSpan,
 				event,
 				aggIntervalStr,
+				cfg.overflowBucketName,
 			)
 			b = append(b, event)
 		}
@@ -230,7 +320,7 @@ func CombinedMetricsToBatch(
 			return &modelpb.APMEvent{
 				Processor: modelpb.MetricsetProcessor(),
 				Service: &modelpb.Service{
-					Name: overflowBucketName,
+					Name: cfg.overflowBucketName,
 				},
 			}
 		}
@@ -249,6 +339,7 @@ func CombinedMetricsToBatch(
 				cm.OverflowServices.OverflowTransaction,
 				event,
 				aggIntervalStr,
+				cfg.overflowBucketName,
 			)
 			b = append(b, event)
 		}
@@ -259,6 +350,7 @@ func CombinedMetricsToBatch(
 				cm.OverflowServices.OverflowServiceTransaction,
 				event,
 				aggIntervalStr,
+				cfg.overflowBucketName,
 			)
 			b = append(b, event)
 		}
@@ -269,6 +361,7 @@ func CombinedMetricsToBatch(
 				cm.OverflowServices.OverflowSpan,
 				event,
 				aggIntervalStr,
+				cfg.overflowBucketName,
 			)
 			b = append(b, event)
 		}
@@ -553,6 +646,7 @@ func overflowTxnMetricsToAPMEvent(
 	overflow OverflowTransaction,
 	baseEvent *modelpb.APMEvent,
 	intervalStr string,
+	overflowBucketName string,
 ) {
 	// Overflow metrics use the processing time as their timestamp rather than
 	// the event time. This makes sure that they can be associated with the
@@ -580,6 +674,7 @@ func overflowSvcTxnMetricsToAPMEvent(
 	overflow OverflowServiceTransaction,
 	baseEvent *modelpb.APMEvent,
 	intervalStr string,
+	overflowBucketName string,
 ) {
 	// Overflow metrics use the processing time as their timestamp rather than
 	// the event time. This makes sure that they can be associated with the
@@ -607,6 +702,7 @@ func overflowSpanMetricsToAPMEvent(
 	overflow OverflowSpan,
 	baseEvent *modelpb.APMEvent,
 	intervalStr string,
+	overflowBucketName string,
 ) {
 	// Overflow metrics use the processing time as their timestamp rather than
 	// the event time. This makes sure that they can be associated with the
@@ -14,6 +14,7 @@ import (
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/testing/protocmp"
 	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
@@ -58,6 +59,128 @@ func TestEventToCombinedMetrics(t *testing.T) {
 	))
 }
 
+func TestEventToCombinedMetricsDroppedSpansCount(t *testing.T) {
+	ts := time.Now().UTC()
+	event := &modelpb.APMEvent{
+		Processor: modelpb.TransactionProcessor(),
+		Timestamp: timestamppb.New(ts),
+		Service:   &modelpb.Service{Name: "svc1"},
+		Event: &modelpb.Event{
+			Duration: durationpb.New(time.Second),
+			Outcome:  "success",
+		},
+		Transaction: &modelpb.Transaction{
+			RepresentativeCount: 2,
+			Name:                "testtxn",
+			Type:                "testtyp",
+			SpanCount:           &modelpb.SpanCount{Dropped: proto.Uint32(3)},
+		},
+	}
+	for _, tc := range []struct {
+		name     string
+		weight   float64
+		expected float64
+	}{
+		{name: "unweighted", weight: 1, expected: 6},
+		{name: "weighted", weight: 0.5, expected: 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cm, err := eventToCombinedMetrics(event, time.Minute, tc.weight, hdrhistogram.DefaultSignificantFigures, true)
+			require.NoError(t, err)
+			require.Len(t, cm.Services, 1)
+			for _, sm := range cm.Services {
+				require.Len(t, sm.ServiceInstanceGroups, 1)
+				for _, sim := range sm.ServiceInstanceGroups {
+					require.Len(t, sim.TransactionGroups, 1)
+					for _, tm := range sim.TransactionGroups {
+						assert.Equal(t, tc.expected, tm.DroppedSpansCount)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEventToCombinedMetricsSpanDestination(t *testing.T) {
+	ts := time.Now().UTC()
+	for _, tc := range []struct {
+		name     string
+		event    *modelpb.APMEvent
+		expected map[SpanDestinationAggregationKey]SpanMetrics
+	}{
+		{
+			name:  "span",
+			event: makeSpan(ts, "svc1", "java", "dest1", "db", "postgres", "success", time.Second, 2, nil, nil),
+			expected: map[SpanDestinationAggregationKey]SpanMetrics{
+				{Resource: "dest1"}: {Count: 2, Sum: float64(2 * time.Second)},
+			},
+		},
+		{
+			name:  "span_without_destination",
+			event: makeSpan(ts, "svc1", "java", "", "db", "postgres", "success", time.Second, 2, nil, nil),
+		},
+		{
+			name: "dropped_span_stats",
+			event: &modelpb.APMEvent{
+				Processor: modelpb.TransactionProcessor(),
+				Timestamp: timestamppb.New(ts),
+				Service:   &modelpb.Service{Name: "svc1"},
+				Event: &modelpb.Event{
+					Duration: durationpb.New(time.Second),
+					Outcome:  "success",
+				},
+				Transaction: &modelpb.Transaction{
+					RepresentativeCount: 1,
+					Name:                "testtxn",
+					Type:                "testtyp",
+					DroppedSpansStats: []*modelpb.DroppedSpanStats{
+						{
+							DestinationServiceResource: "dest1",
+							Outcome:                    "success",
+							Duration: &modelpb.AggregatedDuration{
+								Count: 3,
+								Sum:   durationpb.New(3 * time.Millisecond),
+							},
+						},
+						{
+							DestinationServiceResource: "dest1",
+							Outcome:                    "failure",
+							Duration: &modelpb.AggregatedDuration{
+								Count: 1,
+								Sum:   durationpb.New(time.Millisecond),
+							},
+						},
+					},
+				},
+			},
+			expected: map[SpanDestinationAggregationKey]SpanMetrics{
+				{Resource: "dest1"}: {Count: 4, Sum: float64(4 * time.Millisecond)},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cm, err := EventToCombinedMetrics(tc.event, time.Minute)
+			require.NoError(t, err)
+			require.Len(t, cm.Services, 1)
+			for _, sm := range cm.Services {
+				require.Len(t, sm.ServiceInstanceGroups, 1)
+				for _, sim := range sm.ServiceInstanceGroups {
+					assert.Equal(t, tc.expected, sim.SpanDestinationGroups)
+				}
+			}
+
+			// Span destinations are not aggregated if disabled.
+			cm, err = eventToCombinedMetrics(tc.event, time.Minute, 1, hdrhistogram.DefaultSignificantFigures, false)
+			require.NoError(t, err)
+			for _, sm := range cm.Services {
+				for _, sim := range sm.ServiceInstanceGroups {
+					assert.Empty(t, sim.SpanDestinationGroups)
+				}
+			}
+		})
+	}
+}
+
 func TestCombinedMetricsToBatch(t *testing.T) {
 	ts := time.Now()
 	aggIvl := time.Minute
@@ -73,11 +196,16 @@ func TestCombinedMetricsToBatch(t *testing.T) {
 		overflowTxn    = testTransaction{txnName: "_other", count: 100}
 		overflowSvcTxn = testServiceTransaction{txnType: "_other", count: 100}
 		overflowSpan   = testSpan{targetName: "_other", count: 1}
+
+		customOverflowTxn    = testTransaction{txnName: "__overflow__", count: 100}
+		customOverflowSvcTxn = testServiceTransaction{txnType: "__overflow__", count: 100}
+		customOverflowSpan   = testSpan{targetName: "__overflow__", count: 1}
 	)
 	for _, tc := range []struct {
 		name                string
 		aggregationInterval time.Duration
 		combinedMetrics     CombinedMetrics
+		opts                []ConverterOption
 		expectedEvents      modelpb.Batch
 	}{
 		{
@@ -137,6 +265,30 @@ func TestCombinedMetricsToBatch(t *testing.T) {
 				createTestServiceSummaryMetric(processingTime, aggIvl, "_other", 1),
 			},
 		},
+		{
+			name:                "overflow_custom_bucket_name",
+			aggregationInterval: aggIvl,
+			combinedMetrics: CombinedMetrics(
+				*createTestCombinedMetrics(0).
+					addPerServiceOverflowTransaction(ts, svcName, "", txn).
+					addPerServiceOverflowServiceTransaction(ts, svcName, "", svcTxn).
+					addPerServiceOverflowSpan(ts, svcName, "", span).
+					addGlobalServiceOverflowServiceInstance(ts, "overflow", "").
+					addGlobalServiceOverflowTransaction(ts, "overflow", "", txn).
+					addGlobalServiceOverflowServiceTransaction(ts, "overflow", "", svcTxn).
+					addGlobalServiceOverflowSpan(ts, "overflow", "", span),
+			),
+			opts: []ConverterOption{WithOverflowBucketName("__overflow__")},
+			expectedEvents: []*modelpb.APMEvent{
+				createTestTransactionMetric(processingTime, aggIvl, svcName, customOverflowTxn, 1),
+				createTestServiceTransactionMetric(processingTime, aggIvl, svcName, customOverflowSvcTxn, 1),
+				createTestSpanMetric(processingTime, aggIvl, svcName, customOverflowSpan, 1),
+				createTestTransactionMetric(processingTime, aggIvl, "__overflow__", customOverflowTxn, 1),
+				createTestServiceTransactionMetric(processingTime, aggIvl, "__overflow__", customOverflowSvcTxn, 1),
+				createTestSpanMetric(processingTime, aggIvl, "__overflow__", customOverflowSpan, 1),
+				createTestServiceSummaryMetric(processingTime, aggIvl, "__overflow__", 1),
+			},
+		},
 		{
 			name:                "service_instance_overflow_in_global_and_per_svc",
 			aggregationInterval: aggIvl,
@@ -157,6 +309,7 @@ func TestCombinedMetricsToBatch(t *testing.T) {
 				tc.combinedMetrics,
 				processingTime,
 				tc.aggregationInterval,
+				tc.opts...,
 			)
 			assert.NoError(t, err)
 			assert.Empty(t, cmp.Diff(
@@ -0,0 +1,161 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// debugState is the aggregation state rendered by DebugHandler.
+type debugState struct {
+	ProcessingTime    time.Time         `json:"processing_time"`
+	Limits            Limits            `json:"limits"`
+	LimitsPerInterval map[string]Limits `json:"limits_per_interval,omitempty"`
+	Intervals         []debugInterval   `json:"intervals"`
+	Pebble            []debugPebble     `json:"pebble"`
+}
+
+// debugInterval is the state of an aggregation interval.
+type debugInterval struct {
+	Interval string `json:"interval"`
+	// Keys is the number of combined metrics keys committed to the
+	// database and not yet harvested.
+	Keys        int        `json:"keys"`
+	LastHarvest *time.Time `json:"last_harvest,omitempty"`
+	NextHarvest time.Time  `json:"next_harvest"`
+	// Overflows is the estimated cardinality of the overflow buckets of
+	// the last harvest by overflow type.
+	Overflows map[string]int64 `json:"overflows,omitempty"`
+}
+
+// debugPebble holds the metrics of a pebble database.
+type debugPebble struct {
+	Name              string   `json:"name,omitempty"`
+	DataDir           string   `json:"data_dir"`
+	Intervals         []string `json:"intervals"`
+	DiskUsageBytes    uint64   `json:"disk_usage_bytes"`
+	MemtableSizeBytes uint64   `json:"memtable_size_bytes"`
+	MemtableCount     int64    `json:"memtable_count"`
+	L0Files           int64    `json:"l0_files"`
+	ReadAmplification int      `json:"read_amplification"`
+	Flushes           int64    `json:"flushes"`
+	Compactions       int64    `json:"compactions"`
+	WriteStall        string   `json:"write_stall"`
+}
+
+// DebugHandler returns an http.Handler rendering the aggregation state as
+// JSON for debugging, including the limits, the number of aggregated
+// combined metrics keys, the last and next harvest, and the overflows of
+// the last harvest of each aggregation interval, and the metrics of the
+// pebble databases. The keys are counted from a database snapshot,
+// without blocking aggregations, thus, the pending aggregations not yet
+// committed to the database are not counted. Counting the keys iterates
+// over all of them, which can be expensive for aggregators with a large
+// aggregation state. The handler responds with 503 Service Unavailable if
+// the aggregator is stopped.
+func (a *Aggregator) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		state, err := a.debugState()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(state)
+	})
+}
+
+// debugState returns the current aggregation state, see DebugHandler.
+func (a *Aggregator) debugState() (debugState, error) {
+	// Stop closes the databases only after acquiring compactMu, thus,
+	// they remain open until the keys are counted.
+	a.compactMu.Lock()
+	defer a.compactMu.Unlock()
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return debugState{}, ErrAggregatorStopped
+	}
+	processingTime := a.processingTime
+	snaps := a.snapshots()
+	a.mu.Unlock()
+	defer closeSnapshots(snaps)
+
+	state := debugState{
+		ProcessingTime: processingTime,
+		Limits:         a.Limits(),
+	}
+	for ivl, limits := range a.LimitsPerInterval() {
+		if state.LimitsPerInterval == nil {
+			state.LimitsPerInterval = make(map[string]Limits)
+		}
+		state.LimitsPerInterval[ivl.String()] = limits
+	}
+	lastHarvests := a.lastHarvests.get()
+	overflows := a.overflowCardinality.get()
+	for _, ivl := range a.aggregationIntervals {
+		keys, err := countKeys(snaps[a.storeFor(ivl)], ivl)
+		if err != nil {
+			return debugState{}, err
+		}
+		di := debugInterval{
+			Interval:    ivl.String(),
+			Keys:        keys,
+			NextHarvest: a.harvestTime(processingTime.Truncate(ivl).Add(ivl)),
+			Overflows:   overflows[ivl],
+		}
+		if t, ok := lastHarvests[ivl]; ok {
+			di.LastHarvest = &t
+		}
+		state.Intervals = append(state.Intervals, di)
+	}
+	for _, s := range a.stores {
+		pm := s.metrics()
+		if pm == nil {
+			// Custom stores have no pebble metrics.
+			continue
+		}
+		dp := debugPebble{
+			Name:              s.name,
+			DataDir:           s.dataDir,
+			DiskUsageBytes:    pm.DiskSpaceUsage(),
+			MemtableSizeBytes: pm.MemTable.Size,
+			MemtableCount:     pm.MemTable.Count,
+			L0Files:           pm.Levels[0].NumFiles,
+			ReadAmplification: pm.ReadAmp(),
+			Flushes:           pm.Flush.Count,
+			Compactions:       pm.Compact.Count,
+			WriteStall:        s.writeStalls.Current().String(),
+		}
+		for _, ivl := range s.intervals {
+			dp.Intervals = append(dp.Intervals, ivl.String())
+		}
+		state.Pebble = append(state.Pebble, dp)
+	}
+	return state, nil
+}
+
+// countKeys returns the number of combined metrics keys of the aggregation
+// interval in the snapshot.
+func countKeys(snap StoreSnapshot, ivl time.Duration) (int, error) {
+	var n int
+	if err := snap.RangeScan(intervalKeyPrefix(ivl), intervalKeyPrefix(ivl+time.Second), func(_, _ []byte) error {
+		n++
+		return nil
+	}); err != nil {
+		return 0, fmt.Errorf("failed to count keys of interval %s: %w", ivl, err)
+	}
+	return n, nil
+}
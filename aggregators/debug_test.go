@@ -0,0 +1,94 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugHandler(t *testing.T) {
+	start := time.Unix(1686000000, 0).Truncate(time.Hour).UTC()
+	limits := testLimits()
+	hourLimits := limits
+	hourLimits.MaxServices = 20
+	agg := newTestAggregator(t, AggregatorConfig{
+		Limits:               limits,
+		LimitsPerInterval:    map[time.Duration]Limits{time.Hour: hourLimits},
+		AggregationIntervals: []time.Duration{time.Minute, time.Hour},
+		clock:                newFakeClock(start),
+	})
+
+	for _, id := range []string{"id1", "id2"} {
+		require.NoError(t, agg.AggregateCombinedMetrics(
+			context.Background(),
+			CombinedMetricsKey{Interval: time.Minute, ProcessingTime: start, ID: id},
+			CombinedMetrics(*createTestCombinedMetrics(1).
+				addTransaction(start, "svc", "", testTransaction{txnName: "txn", txnType: "type", count: 1})),
+		))
+	}
+	// Commit the pending batch so that the keys are counted.
+	_, err := agg.Snapshot(context.Background(), time.Minute)
+	require.NoError(t, err)
+
+	handler := agg.DebugHandler()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var state struct {
+		ProcessingTime    time.Time                 `json:"processing_time"`
+		Limits            map[string]int            `json:"limits"`
+		LimitsPerInterval map[string]map[string]int `json:"limits_per_interval"`
+		Intervals         []map[string]any          `json:"intervals"`
+		Pebble            []map[string]any          `json:"pebble"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &state))
+	assert.True(t, start.Equal(state.ProcessingTime))
+	assert.Equal(t, 10, state.Limits["MaxServices"])
+	assert.Equal(t, 20, state.LimitsPerInterval["1h0m0s"]["MaxServices"])
+	require.Len(t, state.Intervals, 2)
+	assert.Equal(t, "1m0s", state.Intervals[0]["interval"])
+	assert.Equal(t, float64(2), state.Intervals[0]["keys"])
+	assert.Equal(t, start.Add(time.Minute+time.Hour).Format(time.RFC3339), state.Intervals[0]["next_harvest"])
+	assert.NotContains(t, state.Intervals[0], "last_harvest")
+	assert.Equal(t, "1h0m0s", state.Intervals[1]["interval"])
+	assert.Equal(t, float64(0), state.Intervals[1]["keys"])
+	require.Len(t, state.Pebble, 1)
+	for _, key := range []string{
+		"data_dir", "intervals", "disk_usage_bytes", "memtable_size_bytes", "memtable_count",
+		"l0_files", "read_amplification", "flushes", "compactions", "write_stall",
+	} {
+		assert.Contains(t, state.Pebble[0], key)
+	}
+	assert.Equal(t, []any{"1m0s", "1h0m0s"}, state.Pebble[0]["intervals"])
+
+	// The harvests and their overflows are rendered once harvested.
+	require.NoError(t, agg.Flush(context.Background()))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &state))
+	assert.Equal(t, float64(0), state.Intervals[0]["keys"])
+	assert.Equal(t, start.Format(time.RFC3339), state.Intervals[0]["last_harvest"])
+	assert.Contains(t, state.Intervals[0], "overflows")
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/debug", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	require.NoError(t, agg.Stop(context.Background()))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
@@ -0,0 +1,54 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"math"
+	"time"
+)
+
+// HarvestSummary summarizes the harvest of an aggregation interval, see
+// AggregatorConfig.HarvestObserver.
+type HarvestSummary struct {
+	// Interval is the harvested aggregation interval.
+	Interval time.Duration
+	// End is the exclusive upper bound of the processing time of the
+	// harvested combined metrics.
+	End time.Time
+	// Harvested is the number of combined metrics successfully processed.
+	Harvested int
+	// Failed is the number of combined metrics which failed to be
+	// processed, including the combined metrics which failed to be
+	// decoded.
+	Failed int
+	// Bytes is the encoded size, in bytes, of the combined metrics
+	// successfully processed.
+	Bytes int64
+	// OverflowedEvents holds the number of events aggregated into the
+	// overflow buckets of the combined metrics successfully processed,
+	// by overflow type: "service", "transaction", "service_transaction",
+	// "span" and "span_destination". Overflow types without overflowed
+	// events are absent.
+	OverflowedEvents map[string]int64
+	// Duration is the time taken to harvest the aggregation interval,
+	// excluding dropping the stale metrics.
+	Duration time.Duration
+	// Err is the error returned by the harvest of the aggregation
+	// interval, if any.
+	Err error
+}
+
+// addOverflowedEvents adds the events aggregated into the overflow buckets
+// of the combined metrics to the summary.
+func (s *HarvestSummary) addOverflowedEvents(cm *CombinedMetrics) {
+	for typ, count := range overflowEventCounts(cm) {
+		if n := int64(math.Round(count)); n > 0 {
+			if s.OverflowedEvents == nil {
+				s.OverflowedEvents = make(map[string]int64)
+			}
+			s.OverflowedEvents[typ] += n
+		}
+	}
+}
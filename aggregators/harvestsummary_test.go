@@ -0,0 +1,76 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHarvestObserver(t *testing.T) {
+	forEachStore(t, testHarvestObserver)
+}
+
+func testHarvestObserver(t *testing.T, newStore newStoreFunc) {
+	var summaries []HarvestSummary
+	var failed bool
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore: newStore,
+		Processor: func(_ context.Context, cmk CombinedMetricsKey, _ CombinedMetrics, _ time.Duration) error {
+			// Fail the first attempt to process the combined metrics of
+			// the fail ID.
+			if cmk.ID == "fail" && !failed {
+				failed = true
+				return errors.New("failed to process")
+			}
+			return nil
+		},
+		AggregationIntervals: []time.Duration{time.Minute},
+		HarvestObserver: func(s HarvestSummary) {
+			summaries = append(summaries, s)
+		},
+	})
+
+	processingTime := time.Now().Truncate(time.Minute)
+	for _, id := range []string{"ok", "fail"} {
+		require.NoError(t, agg.AggregateCombinedMetrics(
+			context.Background(),
+			CombinedMetricsKey{
+				Interval:       time.Minute,
+				ProcessingTime: processingTime,
+				ID:             id,
+			},
+			CombinedMetrics(*createTestCombinedMetrics(4).
+				addTransaction(processingTime, "svc", "", testTransaction{txnName: "txn1", txnType: "type", count: 1}).
+				addPerServiceOverflowTransaction(processingTime, "svc", "", testTransaction{txnName: "txn2", txnType: "type", count: 3})),
+		))
+	}
+	require.Error(t, agg.Flush(context.Background()))
+	require.Len(t, summaries, 1)
+	summary := summaries[0]
+	assert.Equal(t, time.Minute, summary.Interval)
+	assert.Equal(t, processingTime.Add(time.Minute), summary.End)
+	assert.Equal(t, 1, summary.Harvested)
+	assert.Equal(t, 1, summary.Failed)
+	assert.Greater(t, summary.Bytes, int64(0))
+	assert.Equal(t, map[string]int64{overflowTypeTransaction: 3}, summary.OverflowedEvents)
+	assert.Greater(t, summary.Duration, time.Duration(0))
+	assert.ErrorContains(t, summary.Err, "failed to process 1 out of 2 metrics")
+
+	// The failed combined metrics are retried by the next harvest.
+	require.NoError(t, agg.Flush(context.Background()))
+	require.Len(t, summaries, 2)
+	summary = summaries[1]
+	assert.Equal(t, 1, summary.Harvested)
+	assert.Zero(t, summary.Failed)
+	assert.Equal(t, summaries[0].Bytes, summary.Bytes)
+	assert.Equal(t, map[string]int64{overflowTypeTransaction: 3}, summary.OverflowedEvents)
+	assert.NoError(t, summary.Err)
+}
@@ -4,7 +4,11 @@
 
 package aggregators
 
-import "github.com/cespare/xxhash/v2"
+import (
+	"encoding/binary"
+
+	"github.com/cespare/xxhash/v2"
+)
 
 type Hashable interface {
 	Hash(xxhash.Digest) xxhash.Digest
@@ -12,10 +16,32 @@ type Hashable interface {
 
 type Hasher struct {
 	digest xxhash.Digest // xxhash.Digest does not contain pointers and is safe to copy
+	// precision is the precision of the cardinality estimators created
+	// for the overflow buckets the hashes are inserted into, zero for
+	// the default precision.
+	precision uint8
+}
+
+// newHasher returns a Hasher for the aggregation keys of the combined
+// metrics identified by the given ID. If salt is nil the returned Hasher
+// sums to the xxhash digest of the chained keys. Otherwise, the result of
+// salt for the combined metrics ID seeds the digest of the chained keys,
+// see AggregatorConfig.OverflowEstimatorSalt. The seed is computed once,
+// summing the chained keys does not call salt. The cardinality
+// estimators of the overflow buckets created for the hashes use the given
+// precision, or the default precision if zero.
+func newHasher(salt func([]byte) uint64, id string, precision uint8) Hasher {
+	h := Hasher{precision: precision}
+	if salt != nil {
+		var seed [8]byte
+		binary.BigEndian.PutUint64(seed[:], salt([]byte(id)))
+		h.digest.Write(seed[:])
+	}
+	return h
 }
 
 func (h Hasher) Chain(hashable Hashable) Hasher {
-	return Hasher{digest: hashable.Hash(h.digest)}
+	return Hasher{digest: hashable.Hash(h.digest), precision: h.precision}
 }
 
 func (h Hasher) Sum() uint64 {
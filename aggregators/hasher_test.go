@@ -6,6 +6,7 @@ package aggregators
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -35,3 +36,31 @@ func TestHasher(t *testing.T) {
 	c.Sum()
 	assert.Equal(t, b, c)
 }
+
+func TestNewHasher(t *testing.T) {
+	sk := ServiceAggregationKey{
+		Timestamp:   time.Unix(0, 0).UTC(),
+		ServiceName: "svc",
+	}
+	salt := func(b []byte) uint64 {
+		d := xxhash.New()
+		d.WriteString("salt")
+		d.Write(b)
+		return d.Sum64()
+	}
+
+	// Without a salt the hashes are the same as the default Hasher.
+	assert.Equal(t,
+		Hasher{}.Chain(sk).Sum(),
+		newHasher(nil, "tenant-1", 0).Chain(sk).Sum(),
+	)
+
+	tenant1 := newHasher(salt, "tenant-1", 0).Chain(sk)
+	tenant2 := newHasher(salt, "tenant-2", 0).Chain(sk)
+	assert.NotEqual(t, tenant1.Sum(), tenant2.Sum())
+	assert.NotEqual(t, Hasher{}.Chain(sk).Sum(), tenant1.Sum())
+	assert.Equal(t, tenant1.Sum(), newHasher(salt, "tenant-1", 0).Chain(sk).Sum())
+
+	// Summing the hashes does not allocate.
+	assert.Zero(t, testing.AllocsPerRun(100, func() { tenant1.Sum() }))
+}
@@ -0,0 +1,191 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// HealthStatus describes the health of the aggregator, see Health.
+type HealthStatus struct {
+	// Healthy is true if none of the problems described by Problems
+	// were found.
+	Healthy bool
+	// Problems describes the problems found, if any.
+	Problems []string
+	// Stopped is true if the aggregator is stopping or stopped.
+	Stopped bool
+	// LastHarvest holds the time at which the aggregated metrics of each
+	// aggregation interval were last harvested successfully. Aggregation
+	// intervals which were never harvested are absent.
+	LastHarvest map[time.Duration]time.Time
+	// OverdueHarvests holds the aggregation intervals whose scheduled
+	// harvest is overdue by more than the lowest aggregation interval,
+	// for example, because a harvest is blocked on the processor.
+	OverdueHarvests []time.Duration
+	// UnavailableIntervals holds the aggregation intervals whose pebble
+	// database failed to open, see ContinueOnIntervalOpenError.
+	UnavailableIntervals []time.Duration
+	// WriteStall is the duration of the ongoing pebble write stall, or
+	// zero if writes are not stalled.
+	WriteStall time.Duration
+	// DiskUsageBytes is the disk space used by the pebble databases.
+	DiskUsageBytes uint64
+	// DiskAvailableBytes is the disk space available to the pebble
+	// databases, the least available to any of them if they are in
+	// different directories, see DataDirPerInterval, or zero if unknown,
+	// for example, if InMemory is set.
+	DiskAvailableBytes uint64
+}
+
+// lastHarvests records the time of the last successful harvest of each
+// aggregation interval.
+type lastHarvests struct {
+	mu sync.Mutex
+	m  map[time.Duration]time.Time
+}
+
+func (h *lastHarvests) record(ivl time.Duration, t time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.m == nil {
+		h.m = make(map[time.Duration]time.Time)
+	}
+	h.m[ivl] = t
+}
+
+func (h *lastHarvests) get() map[time.Duration]time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	m := make(map[time.Duration]time.Time, len(h.m))
+	for ivl, t := range h.m {
+		m[ivl] = t
+	}
+	return m
+}
+
+// secondsSince returns the seconds elapsed by now since the last successful
+// harvest of each aggregation interval. Aggregation intervals which were
+// never harvested report the seconds elapsed since start.
+func (h *lastHarvests) secondsSince(now, start time.Time, ivls []time.Duration) map[time.Duration]int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	m := make(map[time.Duration]int64, len(ivls))
+	for _, ivl := range ivls {
+		t, ok := h.m[ivl]
+		if !ok {
+			t = start
+		}
+		m[ivl] = int64(now.Sub(t) / time.Second)
+	}
+	return m
+}
+
+// Health returns the health of the aggregator, for example, for readiness
+// probes. The aggregator is unhealthy if it is stopped, if a harvest is
+// overdue by more than the lowest aggregation interval, or if pebble writes
+// are stalled for longer than the WriteStallThreshold, or the lowest
+// aggregation interval if the threshold is not configured, or if the disk
+// usage exceeds the DiskUsageLimit, if configured, or if any aggregation
+// interval is unavailable, see ContinueOnIntervalOpenError.
+//
+// Harvests are only scheduled by Run, thus, harvests are reported overdue
+// if Run is not called.
+func (a *Aggregator) Health() HealthStatus {
+	status := HealthStatus{
+		LastHarvest: a.lastHarvests.get(),
+		WriteStall:  a.writeStall(),
+	}
+	select {
+	case <-a.stopping:
+		status.Stopped = true
+		status.Problems = append(status.Problems, "aggregator is stopping or stopped")
+	default:
+	}
+
+	a.mu.Lock()
+	processingTime := a.processingTime
+	closed := a.closed
+	if !closed {
+		for _, s := range a.stores {
+			if pm := s.metrics(); pm != nil {
+				status.DiskUsageBytes += pm.DiskSpaceUsage()
+			}
+		}
+	}
+	a.mu.Unlock()
+
+	if !closed {
+		var known bool
+		for _, s := range a.stores {
+			if s.opts == nil {
+				// The disk usage of custom stores is unknown.
+				continue
+			}
+			fs := s.opts.FS
+			if fs == nil {
+				fs = vfs.Default
+			}
+			usage, err := fs.GetDiskUsage(s.dataDir)
+			switch {
+			case err == nil:
+				if !known || usage.AvailBytes < status.DiskAvailableBytes {
+					status.DiskAvailableBytes = usage.AvailBytes
+					known = true
+				}
+			case !errors.Is(err, vfs.ErrUnsupported):
+				status.Problems = append(status.Problems, fmt.Sprintf("failed to get disk usage: %v", err))
+			}
+		}
+	}
+
+	grace := a.aggregationIntervals[0]
+	now := a.clock.Now()
+	if !status.Stopped {
+		for _, ivl := range a.aggregationIntervals {
+			next := a.harvestTime(processingTime.Truncate(ivl).Add(ivl))
+			if now.Sub(next) > grace {
+				status.OverdueHarvests = append(status.OverdueHarvests, ivl)
+				status.Problems = append(status.Problems, fmt.Sprintf(
+					"harvest for interval %s overdue by %s", ivl, now.Sub(next),
+				))
+			}
+		}
+	}
+
+	for ivl := range a.unavailableIntervals {
+		status.UnavailableIntervals = append(status.UnavailableIntervals, ivl)
+	}
+	sort.Slice(status.UnavailableIntervals, func(i, j int) bool {
+		return status.UnavailableIntervals[i] < status.UnavailableIntervals[j]
+	})
+	for _, ivl := range status.UnavailableIntervals {
+		status.Problems = append(status.Problems, fmt.Sprintf(
+			"aggregation interval %s is unavailable: %v", ivl, a.unavailableIntervals[ivl],
+		))
+	}
+
+	stallThreshold := a.writeStallThreshold
+	if stallThreshold <= 0 {
+		stallThreshold = grace
+	}
+	if status.WriteStall > stallThreshold {
+		status.Problems = append(status.Problems, fmt.Sprintf("writes stalled for %s", status.WriteStall))
+	}
+	if a.diskUsageLimit > 0 && status.DiskUsageBytes > a.diskUsageLimit {
+		status.Problems = append(status.Problems, fmt.Sprintf(
+			"disk usage of %d bytes exceeds the limit of %d bytes",
+			status.DiskUsageBytes, a.diskUsageLimit,
+		))
+	}
+	status.Healthy = len(status.Problems) == 0
+	return status
+}
@@ -0,0 +1,170 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model/modelpb"
+)
+
+func TestHealth(t *testing.T) {
+	start := time.Unix(1686000000, 0).Truncate(time.Minute)
+	clk := newFakeClock(start)
+	harvesting := make(chan struct{}, 1)
+	release := make(chan struct{})
+	agg := newTestAggregator(t, AggregatorConfig{
+		Processor: func(_ context.Context, _ CombinedMetricsKey, _ CombinedMetrics, _ time.Duration) error {
+			harvesting <- struct{}{}
+			<-release
+			return nil
+		},
+		AggregationIntervals: []time.Duration{time.Second},
+		HarvestDelay:         100 * time.Millisecond,
+		clock:                clk,
+	})
+
+	status := agg.Health()
+	assert.True(t, status.Healthy)
+	assert.Empty(t, status.Problems)
+	assert.False(t, status.Stopped)
+	assert.Empty(t, status.LastHarvest)
+	assert.Empty(t, status.OverdueHarvests)
+	assert.Zero(t, status.WriteStall)
+	assert.Greater(t, status.DiskUsageBytes, uint64(0))
+	assert.Greater(t, status.DiskAvailableBytes, uint64(0))
+
+	require.NoError(t, agg.AggregateBatch(context.Background(), "testid", &modelpb.Batch{
+		makeSpan(start, "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go agg.Run(ctx)
+
+	// Block the harvest on the processor and advance the clock past the
+	// next scheduled harvest to simulate a missed harvest.
+	clk.Advance(time.Second + 100*time.Millisecond)
+	select {
+	case <-harvesting:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for harvest")
+	}
+	clk.Advance(2500 * time.Millisecond)
+	status = agg.Health()
+	assert.False(t, status.Healthy)
+	assert.Equal(t, []time.Duration{time.Second}, status.OverdueHarvests)
+	assert.Equal(t, []string{"harvest for interval 1s overdue by 1.5s"}, status.Problems)
+	assert.Empty(t, status.LastHarvest)
+
+	// Once the harvest completes, the harvest loop catches up.
+	close(release)
+	assert.Eventually(t, func() bool {
+		return agg.Health().Healthy
+	}, 5*time.Second, 10*time.Millisecond)
+	status = agg.Health()
+	assert.Equal(t, map[time.Duration]time.Time{
+		time.Second: start.Add(3600 * time.Millisecond),
+	}, status.LastHarvest)
+
+	require.NoError(t, agg.Stop(context.Background()))
+	status = agg.Health()
+	assert.False(t, status.Healthy)
+	assert.True(t, status.Stopped)
+	assert.Equal(t, []string{"aggregator is stopping or stopped"}, status.Problems)
+	assert.Zero(t, status.DiskUsageBytes)
+}
+
+func TestHealthDiskUsageLimit(t *testing.T) {
+	agg, err := New(AggregatorConfig{
+		DataDir:              t.TempDir(),
+		Processor:            noOpProcessor(),
+		AggregationIntervals: []time.Duration{time.Minute},
+		HarvestDelay:         time.Hour, // disable auto harvest
+		DiskUsageLimit:       1,
+	}, zap.NewNop())
+	require.NoError(t, err)
+	defer agg.Stop(context.Background())
+
+	status := agg.Health()
+	assert.False(t, status.Healthy)
+	assert.Equal(t, []string{fmt.Sprintf(
+		"disk usage of %d bytes exceeds the limit of 1 bytes", status.DiskUsageBytes,
+	)}, status.Problems)
+}
+
+func TestHealthInMemory(t *testing.T) {
+	agg, err := New(AggregatorConfig{
+		InMemory:             true,
+		Processor:            noOpProcessor(),
+		AggregationIntervals: []time.Duration{time.Minute},
+		HarvestDelay:         time.Hour, // disable auto harvest
+	}, zap.NewNop())
+	require.NoError(t, err)
+	defer agg.Stop(context.Background())
+
+	status := agg.Health()
+	assert.True(t, status.Healthy)
+	assert.Empty(t, status.Problems)
+	// The available disk space is unknown for the in-memory database.
+	assert.Zero(t, status.DiskAvailableBytes)
+}
+
+func TestSecondsSinceLastHarvest(t *testing.T) {
+	forEachStore(t, testSecondsSinceLastHarvest)
+}
+
+func testSecondsSinceLastHarvest(t *testing.T, newStore newStoreFunc) {
+	start := time.Unix(1686000000, 0).Truncate(time.Minute)
+	clk := newFakeClock(start)
+	rdr := metric.NewManualReader()
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore:             newStore,
+		AggregationIntervals: []time.Duration{time.Minute, time.Hour},
+		MeterProvider:        metric.NewMeterProvider(metric.WithReader(rdr)),
+		clock:                clk,
+	})
+
+	secondsSince := func() map[time.Duration]int64 {
+		var rm metricdata.ResourceMetrics
+		require.NoError(t, rdr.Collect(context.Background(), &rm))
+		m := make(map[time.Duration]int64)
+		for _, sm := range rm.ScopeMetrics {
+			for _, mm := range sm.Metrics {
+				if mm.Name != "aggregator.harvest.seconds-since-last" {
+					continue
+				}
+				for _, dp := range mm.Data.(metricdata.Gauge[int64]).DataPoints {
+					v, ok := dp.Attributes.Value("aggregation_interval")
+					require.True(t, ok)
+					ivl, err := time.ParseDuration(v.AsString())
+					require.NoError(t, err)
+					m[ivl] = dp.Value
+				}
+			}
+		}
+		return m
+	}
+
+	// Intervals never harvested report the seconds since creation.
+	clk.Advance(30 * time.Second)
+	assert.Equal(t, map[time.Duration]int64{time.Minute: 30, time.Hour: 30}, secondsSince())
+
+	require.NoError(t, agg.Flush(context.Background()))
+	assert.Equal(t, map[time.Duration]int64{time.Minute: 0, time.Hour: 0}, secondsSince())
+
+	clk.Advance(45 * time.Second)
+	assert.Equal(t, map[time.Duration]int64{time.Minute: 45, time.Hour: 45}, secondsSince())
+	clk.Advance(time.Minute)
+	assert.Equal(t, map[time.Duration]int64{time.Minute: 105, time.Hour: 105}, secondsSince())
+}
@@ -0,0 +1,161 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// idempotencyTokenPrefix is the reserved prefix of the keys holding the
+// idempotency tokens of the aggregated combined metrics, see
+// harvestCheckpointPrefix. The tokens are kept in the store of the
+// aggregation interval of their combined metrics, see
+// Aggregator.aggregateIdempotent.
+// idempotencyTokenUpperBound is the exclusive upper bound of the keys
+// with the prefix.
+var (
+	idempotencyTokenPrefix     = []byte{0x00, 0x00, 'i', 't'}
+	idempotencyTokenUpperBound = []byte{0x00, 0x00, 'i', 'u'}
+)
+
+// idempotencyTokenKey returns the key of the idempotency token.
+func idempotencyTokenKey(token string) []byte {
+	k := make([]byte, len(idempotencyTokenPrefix)+len(token))
+	copy(k, idempotencyTokenPrefix)
+	copy(k[len(idempotencyTokenPrefix):], token)
+	return k
+}
+
+// idempotencyTokenValue returns the encoded expiry of an idempotency token,
+// the time until which the combined metrics with the same token are
+// deduplicated.
+func idempotencyTokenValue(expiry time.Time) []byte {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(expiry.UnixNano()))
+	return v
+}
+
+// decodeIdempotencyTokenValue decodes the expiry of an idempotency token.
+func decodeIdempotencyTokenValue(v []byte) (time.Time, error) {
+	if len(v) != 8 {
+		return time.Time{}, fmt.Errorf("invalid idempotency token expiry of %d bytes", len(v))
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(v))), nil
+}
+
+// readIdempotencyToken returns the expiry of the idempotency token, or the
+// zero time if the token was never aggregated or was deleted.
+func readIdempotencyToken(r StoreReader, token string) (time.Time, error) {
+	v, err := r.Get(idempotencyTokenKey(token))
+	if errors.Is(err, ErrNotFound) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read idempotency token: %w", err)
+	}
+	return decodeIdempotencyTokenValue(v)
+}
+
+// isDuplicate reports whether the idempotency token was aggregated within
+// the deduplication window for the aggregation interval. The tokens are
+// cached in memory so that they are only read from the store of the
+// aggregation interval once. The caller must hold the aggregator's lock.
+func (a *Aggregator) isDuplicate(token string, ivl time.Duration, now time.Time) (bool, error) {
+	expiry, ok := a.idempotencyTokens[token]
+	if !ok {
+		// The token may have been aggregated before the aggregator was
+		// restarted.
+		var err error
+		if expiry, err = readIdempotencyToken(a.storeFor(ivl).kv, token); err != nil {
+			return false, err
+		}
+	}
+	if !now.Before(expiry) {
+		delete(a.idempotencyTokens, token)
+		return false, nil
+	}
+	a.idempotencyTokens[token] = expiry
+	return true, nil
+}
+
+// aggregateIdempotent aggregates the combined metrics along with their
+// idempotency token, expiring after the deduplication window, returning
+// the number of bytes ingested. The merge operation and the token are
+// written to a batch of their own, committed atomically to the store of
+// the key's aggregation interval, so that either both or none of them
+// are applied. Thus, the aggregation is not coalesced by the merge batch.
+// The caller must hold the aggregator's lock.
+func (a *Aggregator) aggregateIdempotent(
+	cmk CombinedMetricsKey,
+	cm CombinedMetrics,
+	token string,
+	now time.Time,
+) (int, error) {
+	if err, ok := a.unavailableIntervals[cmk.Interval]; ok {
+		return 0, fmt.Errorf("%w %s: %v", ErrIntervalUnavailable, cmk.Interval, err)
+	}
+	cmproto := cm.ToProto()
+	defer cmproto.ReturnToVTPool()
+
+	batch := a.storeFor(cmk.Interval).kv.NewBatch()
+	defer batch.Close()
+	if err := writeMergeTo(batch, cmk, cmproto); err != nil {
+		return 0, err
+	}
+	expiry := now.Add(a.deduplicationWindow)
+	if err := batch.Set(idempotencyTokenKey(token), idempotencyTokenValue(expiry)); err != nil {
+		return 0, fmt.Errorf("failed to write idempotency token: %w", err)
+	}
+	if err := batch.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit idempotent aggregation: %w", err)
+	}
+	a.idempotencyTokens[token] = expiry
+	a.active.add(cmk)
+	return cmproto.SizeVT(), nil
+}
+
+// pruneIdempotencyTokens removes the idempotency tokens expired by now
+// from the in-memory cache. The caller must hold the aggregator's lock.
+func (a *Aggregator) pruneIdempotencyTokens(now time.Time) {
+	for token, expiry := range a.idempotencyTokens {
+		if !now.Before(expiry) {
+			delete(a.idempotencyTokens, token)
+		}
+	}
+}
+
+// dropExpiredIdempotencyTokens deletes the idempotency tokens expired by
+// now from the store, read from the snapshot of the store.
+func (a *Aggregator) dropExpiredIdempotencyTokens(s *store, snap StoreSnapshot, now time.Time) error {
+	batch := s.kv.NewBatch()
+	defer batch.Close()
+	var deleted int
+	var deleteErr error
+	if err := snap.RangeScan(idempotencyTokenPrefix, idempotencyTokenUpperBound, func(key, value []byte) error {
+		expiry, err := decodeIdempotencyTokenValue(value)
+		if err == nil && now.Before(expiry) {
+			return nil
+		}
+		// Tokens which can not be decoded are dropped as well.
+		if err := batch.Delete(key); err != nil {
+			deleteErr = fmt.Errorf("failed to delete expired idempotency token: %w", err)
+			return deleteErr
+		}
+		deleted++
+		return nil
+	}); err != nil {
+		if deleteErr != nil {
+			return deleteErr
+		}
+		return fmt.Errorf("failed to iterate idempotency tokens: %w", err)
+	}
+	if deleted == 0 {
+		return nil
+	}
+	return batch.Commit()
+}
@@ -0,0 +1,177 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestAggregateCombinedMetricsIdempotent(t *testing.T) {
+	start := time.Unix(1686000000, 0).Truncate(time.Minute)
+	clk := newFakeClock(start)
+	dir := t.TempDir()
+	var harvested int64
+	newAgg := func(rdr metric.Reader) *Aggregator {
+		return newTestAggregator(t, AggregatorConfig{
+			DataDir: dir,
+			Processor: func(_ context.Context, _ CombinedMetricsKey, cm CombinedMetrics, _ time.Duration) error {
+				harvested += cm.eventsTotal
+				return nil
+			},
+			AggregationIntervals: []time.Duration{time.Minute},
+			DeduplicationWindow:  10 * time.Minute,
+			MeterProvider:        metric.NewMeterProvider(metric.WithReader(rdr)),
+			clock:                clk,
+		})
+	}
+	deduplicated := func(rdr metric.Reader) int64 {
+		var rm metricdata.ResourceMetrics
+		require.NoError(t, rdr.Collect(context.Background(), &rm))
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				if m.Name == "aggregator.requests.deduplicated" {
+					return m.Data.(metricdata.Sum[int64]).DataPoints[0].Value
+				}
+			}
+		}
+		return 0
+	}
+	aggregate := func(agg *Aggregator, token string) {
+		require.NoError(t, agg.AggregateCombinedMetricsIdempotent(
+			context.Background(),
+			CombinedMetricsKey{Interval: time.Minute, ProcessingTime: start, ID: "testid"},
+			CombinedMetrics(*createTestCombinedMetrics(5).
+				addTransaction(start, "svc", "", testTransaction{txnName: "txn", txnType: "type", count: 5})),
+			token,
+		))
+	}
+
+	rdr := metric.NewManualReader()
+	agg := newAgg(rdr)
+	aggregate(agg, "token1")
+	aggregate(agg, "token1")
+	aggregate(agg, "token2")
+	// Empty tokens are never deduplicated.
+	aggregate(agg, "")
+	aggregate(agg, "")
+	require.NoError(t, agg.Flush(context.Background()))
+	assert.Equal(t, int64(20), harvested)
+	assert.Equal(t, int64(1), deduplicated(rdr))
+	require.NoError(t, agg.Stop(context.Background()))
+
+	// The tokens are deduplicated across restarts.
+	harvested = 0
+	rdr = metric.NewManualReader()
+	agg = newAgg(rdr)
+	defer agg.Stop(context.Background())
+	aggregate(agg, "token1")
+	require.NoError(t, agg.Flush(context.Background()))
+	assert.Zero(t, harvested)
+	assert.Equal(t, int64(1), deduplicated(rdr))
+
+	// The tokens expire after the deduplication window.
+	clk.Advance(10 * time.Minute)
+	aggregate(agg, "token1")
+	require.NoError(t, agg.Flush(context.Background()))
+	assert.Equal(t, int64(5), harvested)
+
+	// The expired tokens are deleted from the database.
+	agg.mu.Lock()
+	defer agg.mu.Unlock()
+	snap := agg.stores[0].kv.NewSnapshot()
+	defer snap.Close()
+	require.NoError(t, agg.dropExpiredIdempotencyTokens(agg.stores[0], snap, clk.Now()))
+	for token, expected := range map[string]time.Time{
+		"token1": clk.Now().Add(10 * time.Minute),
+		"token2": {},
+	} {
+		expiry, err := readIdempotencyToken(agg.stores[0].kv, token)
+		require.NoError(t, err)
+		assert.True(t, expected.Equal(expiry), token)
+	}
+}
+
+// failingCommitStore is a Store whose batches fail to be committed while
+// fail is set.
+type failingCommitStore struct {
+	Store
+	fail *atomic.Bool
+}
+
+func (s *failingCommitStore) NewBatch() StoreBatch {
+	return &failingCommitBatch{StoreBatch: s.Store.NewBatch(), fail: s.fail}
+}
+
+type failingCommitBatch struct {
+	StoreBatch
+	fail *atomic.Bool
+}
+
+func (b *failingCommitBatch) Commit() error {
+	if b.fail.Load() {
+		return errors.New("commit failure")
+	}
+	return b.StoreBatch.Commit()
+}
+
+func TestAggregateCombinedMetricsIdempotentAtomic(t *testing.T) {
+	start := time.Unix(1686000000, 0).Truncate(time.Hour)
+	var fail atomic.Bool
+	harvested := make(map[time.Duration]int64)
+	agg := newTestAggregator(t, AggregatorConfig{
+		DataDir: t.TempDir(),
+		DataDirPerInterval: map[time.Duration]string{
+			time.Hour: t.TempDir(),
+		},
+		NewStore: func(_ string, _ []time.Duration, merge MergeFunc) (Store, error) {
+			return &failingCommitStore{Store: NewMapStore(merge), fail: &fail}, nil
+		},
+		Processor: func(_ context.Context, cmk CombinedMetricsKey, cm CombinedMetrics, _ time.Duration) error {
+			harvested[cmk.Interval] += cm.eventsTotal
+			return nil
+		},
+		AggregationIntervals: []time.Duration{time.Minute, time.Hour},
+		DeduplicationWindow:  10 * time.Minute,
+		MergeBatchWindow:     time.Hour,
+		clock:                newFakeClock(start),
+	})
+	aggregate := func(ivl time.Duration, token string) error {
+		return agg.AggregateCombinedMetricsIdempotent(
+			context.Background(),
+			CombinedMetricsKey{Interval: ivl, ProcessingTime: start, ID: "testid"},
+			CombinedMetrics(*createTestCombinedMetrics(5).
+				addTransaction(start, "svc", "", testTransaction{txnName: "txn", txnType: "type", count: 5})),
+			token,
+		)
+	}
+
+	for _, ivl := range []time.Duration{time.Minute, time.Hour} {
+		token := ivl.String()
+		// Neither the combined metrics nor the token are applied if the
+		// aggregation fails, thus, the retry is not deduplicated.
+		fail.Store(true)
+		assert.ErrorContains(t, aggregate(ivl, token), "commit failure")
+		fail.Store(false)
+		require.NoError(t, aggregate(ivl, token))
+		// The token is committed along with the combined metrics, even
+		// though the aggregations are otherwise coalesced and the
+		// aggregation intervals are kept in different stores.
+		require.NoError(t, aggregate(ivl, token))
+		expiry, err := readIdempotencyToken(agg.storeFor(ivl).kv, token)
+		require.NoError(t, err)
+		assert.False(t, expiry.IsZero())
+	}
+	require.NoError(t, agg.Flush(context.Background()))
+	assert.Equal(t, map[time.Duration]int64{time.Minute: 5, time.Hour: 5}, harvested)
+}
@@ -17,7 +17,14 @@ import (
 const (
 	lowestTrackableValue  = 1
 	highestTrackableValue = 3.6e+9 // 1 hour in microseconds
-	significantFigures    = 2
+
+	// DefaultSignificantFigures is the number of significant figures
+	// of the histograms created by New.
+	DefaultSignificantFigures = 2
+	// MinSignificantFigures and MaxSignificantFigures are the bounds of
+	// the supported number of significant figures.
+	MinSignificantFigures = 1
+	MaxSignificantFigures = 5
 
 	// We scale transaction counts in the histogram, which only permits storing
 	// integer counts, to allow for fractional transactions due to sampling.
@@ -27,16 +34,47 @@ const (
 	// we will record a count of 5000 (2 * 2.5 * histogramCountScale). When we
 	// publish metrics, we will scale down to 5 (5000 / histogramCountScale).
 	histogramCountScale = 1000
-)
 
-var (
-	unitMagnitude               = getUnitMagnitude()
-	subBucketHalfCountMagnitude = getSubBucketHalfCountMagnitude()
-	subBucketHalfCount          = getSubBucketHalfCount()
-	subBucketMask               = getSubBucketMask()
-	countsLen                   = getCountsLen()
+	// histogramRepresentationSize, mapHeaderSize and mapEntrySize are the
+	// approximate sizes, in bytes, used for estimating the memory held by
+	// a HistogramRepresentation. Map entries are int32 keys and int64
+	// values stored in buckets of 8 entries, with a tophash byte per entry
+	// and an overflow pointer per bucket, at the average load factor of
+	// 6.5 entries per bucket.
+	histogramRepresentationSize = 32
+	mapHeaderSize               = 48
+	mapEntrySize                = 18
 )
 
+// layouts holds the bucket layout for each of the supported number of
+// significant figures, indexed by the number of significant figures.
+var layouts = func() (l [MaxSignificantFigures + 1]layout) {
+	for sf := MinSignificantFigures; sf <= MaxSignificantFigures; sf++ {
+		l[sf] = newLayout(int64(sf))
+	}
+	return l
+}()
+
+// layout holds the parameters of the HDR histogram buckets derived from
+// the trackable values and the number of significant figures.
+type layout struct {
+	unitMagnitude               int32
+	subBucketHalfCountMagnitude int32
+	subBucketHalfCount          int32
+	subBucketMask               int64
+	countsLen                   int64
+}
+
+func newLayout(significantFigures int64) layout {
+	return layout{
+		unitMagnitude:               getUnitMagnitude(),
+		subBucketHalfCountMagnitude: getSubBucketHalfCountMagnitude(significantFigures),
+		subBucketHalfCount:          getSubBucketHalfCount(significantFigures),
+		subBucketMask:               getSubBucketMask(significantFigures),
+		countsLen:                   getCountsLen(significantFigures),
+	}
+}
+
 // HistogramRepresentation is an optimization over HDR histogram mainly useful
 // for recording values clustered in some range rather than distributed over
 // the full range of the HDR histogram. It is based on the [hdrhistogram-go](https://github.com/HdrHistogram/hdrhistogram-go) package.
@@ -49,19 +87,36 @@ type HistogramRepresentation struct {
 	CountsRep             map[int32]int64
 }
 
-// New returns a new instance of HistogramRepresentation
+// New returns a new instance of HistogramRepresentation with
+// DefaultSignificantFigures.
 func New() *HistogramRepresentation {
+	h, _ := NewWithSignificantFigures(DefaultSignificantFigures)
+	return h
+}
+
+// NewWithSignificantFigures returns a new instance of HistogramRepresentation
+// with the given number of significant figures, which must be between
+// MinSignificantFigures and MaxSignificantFigures. Fewer significant figures
+// use fewer buckets, and thus less memory, at the expense of precision.
+func NewWithSignificantFigures(n int64) (*HistogramRepresentation, error) {
+	if n < MinSignificantFigures || n > MaxSignificantFigures {
+		return nil, fmt.Errorf(
+			"significant figures must be between %d and %d, got %d",
+			MinSignificantFigures, MaxSignificantFigures, n,
+		)
+	}
 	return &HistogramRepresentation{
 		LowestTrackableValue:  lowestTrackableValue,
 		HighestTrackableValue: highestTrackableValue,
-		SignificantFigures:    significantFigures,
+		SignificantFigures:    n,
 		CountsRep:             make(map[int32]int64),
-	}
+	}, nil
 }
 
 // RecordDuration records duration in the histogram representation. It
 // supports recording float64 upto 3 decimal places. This is achieved
-// by scaling the count.
+// by scaling the count. Negative durations, for example due to clock
+// skew, are recorded as zero.
 func (h *HistogramRepresentation) RecordDuration(d time.Duration, n float64) error {
 	count := int64(math.Round(n * histogramCountScale))
 	v := d.Microseconds()
@@ -70,27 +125,76 @@ func (h *HistogramRepresentation) RecordDuration(d time.Duration, n float64) err
 }
 
 // RecordValues records values in the histogram representation.
+// Negative values are recorded as zero as the histogram only tracks
+// non-negative values.
 func (h *HistogramRepresentation) RecordValues(v, n int64) error {
+	if v < 0 {
+		v = 0
+	}
 	idx := h.countsIndexFor(v)
-	if idx < 0 || int32(countsLen) <= idx {
+	if idx < 0 || int32(h.layout().countsLen) <= idx {
 		return fmt.Errorf("value %d is too large to be recorded", v)
 	}
 	h.CountsRep[idx] += n
 	return nil
 }
 
-// Merge merges the provided histogram representation.
-// TODO: Add support for migration from a histogram representation
-// with different parameters.
+// Merge merges the provided histogram representation. An empty histogram
+// adopts the parameters of the merged histogram so that histograms created
+// with New can be used to merge histograms of any precision. Otherwise, if
+// the histograms have a different number of significant figures, and thus
+// a different bucket layout, the buckets of the merged histogram are
+// re-recorded into the buckets of h, using the median value of each bucket,
+// so that h keeps its parameters. Re-recorded values beyond the range of h
+// are recorded in its last bucket, preserving the total count.
 func (h *HistogramRepresentation) Merge(from *HistogramRepresentation) {
 	if from == nil {
 		return
 	}
+	if len(h.CountsRep) == 0 {
+		h.LowestTrackableValue = from.LowestTrackableValue
+		h.HighestTrackableValue = from.HighestTrackableValue
+		h.SignificantFigures = from.SignificantFigures
+	}
+	to, fromLayout := h.layout(), from.layout()
+	if to == fromLayout {
+		for b, n := range from.CountsRep {
+			h.CountsRep[b] += n
+		}
+		return
+	}
 	for b, n := range from.CountsRep {
-		h.CountsRep[b] += n
+		idx := h.countsIndexFor(fromLayout.medianEquivalentValue(b))
+		if idx < 0 || int32(to.countsLen) <= idx {
+			idx = int32(to.countsLen) - 1
+		}
+		h.CountsRep[idx] += n
 	}
 }
 
+// TotalCount returns the total count of all the recorded values, scaled
+// down to account for fractional counts.
+func (h *HistogramRepresentation) TotalCount() float64 {
+	if h == nil {
+		return 0
+	}
+	var total int64
+	for _, n := range h.CountsRep {
+		total += n
+	}
+	return float64(total) / histogramCountScale
+}
+
+// MemoryEstimate returns an estimate of the memory, in bytes, held by the
+// histogram representation, which grows with the number of non-empty
+// buckets rather than the range of the recorded values.
+func (h *HistogramRepresentation) MemoryEstimate() int64 {
+	if h == nil {
+		return 0
+	}
+	return histogramRepresentationSize + mapHeaderSize + int64(len(h.CountsRep))*mapEntrySize
+}
+
 // Buckets converts the histogram into ordered slices of counts
 // and values per bar along with the total count.
 func (h *HistogramRepresentation) Buckets() (int64, []int64, []float64) {
@@ -113,9 +217,26 @@ func (h *HistogramRepresentation) Buckets() (int64, []int64, []float64) {
 	return totalCount, counts, values
 }
 
+// DurationsAtPercentiles returns the recorded durations at the given
+// percentiles, between 0 and 100, in the order of the percentiles. The
+// durations are the highest values equivalent to the recorded values at
+// the percentiles, within the precision of the histogram, or zero if no
+// values were recorded.
+func (h *HistogramRepresentation) DurationsAtPercentiles(percentiles []float64) []time.Duration {
+	durations := make([]time.Duration, len(percentiles))
+	if h.TotalCount() == 0 {
+		return durations
+	}
+	hist := hdrhistogram.Import(h.getHDRSnapshot())
+	for i, p := range percentiles {
+		durations[i] = time.Duration(hist.ValueAtPercentile(p)) * time.Microsecond
+	}
+	return durations
+}
+
 // getHDRSnapshot returns the official hdrhistogram.Snapshot.
 func (h *HistogramRepresentation) getHDRSnapshot() *hdrhistogram.Snapshot {
-	counts := make([]int64, countsLen)
+	counts := make([]int64, h.layout().countsLen)
 	for b, n := range h.CountsRep {
 		counts[b] += n
 	}
@@ -127,29 +248,55 @@ func (h *HistogramRepresentation) getHDRSnapshot() *hdrhistogram.Snapshot {
 	}
 }
 
+// layout returns the bucket layout for the number of significant figures
+// of the histogram, falling back to DefaultSignificantFigures for
+// unsupported values.
+func (h *HistogramRepresentation) layout() *layout {
+	sf := h.SignificantFigures
+	if sf < MinSignificantFigures || sf > MaxSignificantFigures {
+		sf = DefaultSignificantFigures
+	}
+	return &layouts[sf]
+}
+
 func (h *HistogramRepresentation) countsIndexFor(v int64) int32 {
-	bucketIdx := h.getBucketIndex(v)
-	subBucketIdx := h.getSubBucketIdx(v, bucketIdx)
-	return h.countsIndex(bucketIdx, subBucketIdx)
+	l := h.layout()
+	bucketIdx := l.getBucketIndex(v)
+	subBucketIdx := l.getSubBucketIdx(v, bucketIdx)
+	return l.countsIndex(bucketIdx, subBucketIdx)
+}
+
+func (l *layout) countsIndex(bucketIdx, subBucketIdx int32) int32 {
+	baseBucketIdx := (bucketIdx + 1) << uint(l.subBucketHalfCountMagnitude)
+	return baseBucketIdx + subBucketIdx - l.subBucketHalfCount
 }
 
-func (h *HistogramRepresentation) countsIndex(bucketIdx, subBucketIdx int32) int32 {
-	baseBucketIdx := (bucketIdx + 1) << uint(subBucketHalfCountMagnitude)
-	return baseBucketIdx + subBucketIdx - subBucketHalfCount
+func (l *layout) getBucketIndex(v int64) int32 {
+	var pow2Ceiling = int64(64 - bits.LeadingZeros64(uint64(v|l.subBucketMask)))
+	return int32(pow2Ceiling - int64(l.unitMagnitude) -
+		int64(l.subBucketHalfCountMagnitude+1))
 }
 
-func (h *HistogramRepresentation) getBucketIndex(v int64) int32 {
-	var pow2Ceiling = int64(64 - bits.LeadingZeros64(uint64(v|subBucketMask)))
-	return int32(pow2Ceiling - int64(unitMagnitude) -
-		int64(subBucketHalfCountMagnitude+1))
+func (l *layout) getSubBucketIdx(v int64, idx int32) int32 {
+	return int32(v >> uint(int64(idx)+int64(l.unitMagnitude)))
 }
 
-func (h *HistogramRepresentation) getSubBucketIdx(v int64, idx int32) int32 {
-	return int32(v >> uint(int64(idx)+int64(unitMagnitude)))
+// medianEquivalentValue returns the value in the middle of the range of
+// values equivalent to the values recorded in the bucket at idx.
+func (l *layout) medianEquivalentValue(idx int32) int64 {
+	bucketIdx := (idx >> uint(l.subBucketHalfCountMagnitude)) - 1
+	subBucketIdx := (idx & (l.subBucketHalfCount - 1)) + l.subBucketHalfCount
+	if bucketIdx < 0 {
+		subBucketIdx -= l.subBucketHalfCount
+		bucketIdx = 0
+	}
+	lowest := int64(subBucketIdx) << uint(l.unitMagnitude+bucketIdx)
+	size := int64(1) << uint(l.unitMagnitude+bucketIdx)
+	return lowest + size/2
 }
 
-func getSubBucketHalfCountMagnitude() int32 {
-	largetValueWithSingleUnitResolution := 2 * math.Pow10(significantFigures)
+func getSubBucketHalfCountMagnitude(significantFigures int64) int32 {
+	largetValueWithSingleUnitResolution := 2 * math.Pow10(int(significantFigures))
 	subBucketCountMagnitude := int32(math.Ceil(math.Log2(
 		largetValueWithSingleUnitResolution,
 	)))
@@ -169,20 +316,20 @@ func getUnitMagnitude() int32 {
 	return unitMag
 }
 
-func getSubBucketCount() int32 {
-	return int32(math.Pow(2, float64(getSubBucketHalfCountMagnitude()+1)))
+func getSubBucketCount(significantFigures int64) int32 {
+	return int32(math.Pow(2, float64(getSubBucketHalfCountMagnitude(significantFigures)+1)))
 }
 
-func getSubBucketHalfCount() int32 {
-	return getSubBucketCount() / 2
+func getSubBucketHalfCount(significantFigures int64) int32 {
+	return getSubBucketCount(significantFigures) / 2
 }
 
-func getSubBucketMask() int64 {
-	return int64(getSubBucketCount()-1) << uint(getUnitMagnitude())
+func getSubBucketMask(significantFigures int64) int64 {
+	return int64(getSubBucketCount(significantFigures)-1) << uint(getUnitMagnitude())
 }
 
-func getCountsLen() int64 {
-	smallestUntrackableValue := int64(getSubBucketCount()) << uint(getUnitMagnitude())
+func getCountsLen(significantFigures int64) int64 {
+	smallestUntrackableValue := int64(getSubBucketCount(significantFigures)) << uint(getUnitMagnitude())
 	bucketsNeeded := int32(1)
 	for smallestUntrackableValue < highestTrackableValue {
 		if smallestUntrackableValue > (math.MaxInt64 / 2) {
@@ -194,5 +341,5 @@ func getCountsLen() int64 {
 		smallestUntrackableValue <<= 1
 		bucketsNeeded++
 	}
-	return int64((bucketsNeeded + 1) * (getSubBucketCount() / 2))
+	return int64((bucketsNeeded + 1) * (getSubBucketCount(significantFigures) / 2))
 }
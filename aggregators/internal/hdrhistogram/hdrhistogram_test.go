@@ -5,8 +5,11 @@
 package hdrhistogram
 
 import (
+	"fmt"
+	"math"
 	"math/rand"
 	"testing"
+	"time"
 
 	"github.com/HdrHistogram/hdrhistogram-go"
 	"github.com/google/go-cmp/cmp"
@@ -15,7 +18,7 @@ import (
 )
 
 func TestMerge(t *testing.T) {
-	hist1, hist2 := getTestHistogram(), getTestHistogram()
+	hist1, hist2 := getTestHistogram(DefaultSignificantFigures), getTestHistogram(DefaultSignificantFigures)
 	histRep1, histRep2 := New(), New()
 
 	for i := 0; i < 1_000_000; i++ {
@@ -33,10 +36,215 @@ func TestMerge(t *testing.T) {
 	assert.Empty(t, cmp.Diff(expectedSnap, histRep1.getHDRSnapshot()))
 }
 
-func getTestHistogram() *hdrhistogram.Histogram {
+func TestMergeSignificantFigures(t *testing.T) {
+	for sf := int64(MinSignificantFigures); sf <= MaxSignificantFigures; sf++ {
+		hist1, hist2 := getTestHistogram(sf), getTestHistogram(sf)
+		histRep1, err := NewWithSignificantFigures(sf)
+		require.NoError(t, err)
+		histRep2, err := NewWithSignificantFigures(sf)
+		require.NoError(t, err)
+
+		for i := 0; i < 10_000; i++ {
+			v1, v2 := rand.Int63n(3_600_000_000), rand.Int63n(3_600_000_000)
+			hist1.RecordValues(v1, 11)
+			histRep1.RecordValues(v1, 11)
+			hist2.RecordValues(v2, 111)
+			histRep2.RecordValues(v2, 111)
+		}
+
+		require.Equal(t, int64(0), hist1.Merge(hist2))
+		histRep1.Merge(histRep2)
+		assert.Empty(t, cmp.Diff(hist1.Export(), histRep1.getHDRSnapshot()), "significant figures %d", sf)
+
+		// An empty histogram created with the default significant figures
+		// adopts the significant figures of the merged histogram.
+		histRep3 := New()
+		histRep3.Merge(histRep1)
+		assert.Empty(t, cmp.Diff(hist1.Export(), histRep3.getHDRSnapshot()), "significant figures %d", sf)
+	}
+}
+
+func TestMergeDifferentSignificantFigures(t *testing.T) {
+	percentiles := []float64{50, 90, 95, 99}
+	for _, tc := range []struct{ to, from int64 }{
+		{to: 2, from: 3},
+		{to: 3, from: 2},
+		{to: 1, from: 5},
+		{to: 5, from: 1},
+	} {
+		t.Run(fmt.Sprintf("%d_from_%d", tc.to, tc.from), func(t *testing.T) {
+			histRep1, err := NewWithSignificantFigures(tc.to)
+			require.NoError(t, err)
+			histRep2, err := NewWithSignificantFigures(tc.from)
+			require.NoError(t, err)
+			// Uniform distribution of 1ms to 1000ms in both histograms.
+			for i := 1; i <= 1000; i++ {
+				require.NoError(t, histRep1.RecordDuration(time.Duration(i)*time.Millisecond, 1))
+				require.NoError(t, histRep2.RecordDuration(time.Duration(i)*time.Millisecond, 1.5))
+			}
+
+			histRep1.Merge(histRep2)
+			assert.Equal(t, tc.to, histRep1.SignificantFigures)
+			assert.Equal(t, float64(2500), histRep1.TotalCount())
+			for b := range histRep1.CountsRep {
+				assert.Less(t, b, int32(histRep1.layout().countsLen))
+			}
+			// The merged histogram is as precise as the least precise one.
+			epsilon := math.Pow10(-int(tc.to))
+			if tc.from < tc.to {
+				epsilon = math.Pow10(-int(tc.from))
+			}
+			durations := histRep1.DurationsAtPercentiles(percentiles)
+			for i, p := range percentiles {
+				expected := float64(time.Duration(p*10) * time.Millisecond)
+				assert.InEpsilon(t, expected, float64(durations[i]), 2*epsilon, "p%v", p)
+			}
+		})
+	}
+}
+
+func TestMedianEquivalentValue(t *testing.T) {
+	for sf := int64(MinSignificantFigures); sf <= MaxSignificantFigures; sf++ {
+		histRep, err := NewWithSignificantFigures(sf)
+		require.NoError(t, err)
+		l := histRep.layout()
+		for idx := int32(0); idx < int32(l.countsLen); idx++ {
+			require.Equal(t, idx, histRep.countsIndexFor(l.medianEquivalentValue(idx)), "significant figures %d", sf)
+		}
+	}
+}
+
+func TestBucketsSignificantFigures(t *testing.T) {
+	var prevBuckets int
+	for sf := int64(MinSignificantFigures); sf <= MaxSignificantFigures; sf++ {
+		hist := getTestHistogram(sf)
+		histRep, err := NewWithSignificantFigures(sf)
+		require.NoError(t, err)
+		for v := int64(1000); v < 1100; v++ {
+			hist.RecordValue(v)
+			require.NoError(t, histRep.RecordDuration(time.Duration(v)*time.Microsecond, 1))
+		}
+
+		var expectedCounts []int64
+		var expectedValues []float64
+		for _, b := range hist.Distribution() {
+			if b.Count > 0 {
+				expectedCounts = append(expectedCounts, b.Count)
+				expectedValues = append(expectedValues, float64(b.To))
+			}
+		}
+		total, counts, values := histRep.Buckets()
+		assert.Equal(t, int64(100), total)
+		assert.Equal(t, expectedCounts, counts, "significant figures %d", sf)
+		assert.Equal(t, expectedValues, values, "significant figures %d", sf)
+		// Higher precision never uses fewer buckets, with each value
+		// in its own bucket from 3 significant figures.
+		assert.GreaterOrEqual(t, len(counts), prevBuckets, "significant figures %d", sf)
+		if sf >= 3 {
+			assert.Len(t, counts, 100, "significant figures %d", sf)
+		} else {
+			assert.Less(t, len(counts), 100, "significant figures %d", sf)
+		}
+		prevBuckets = len(counts)
+	}
+}
+
+func TestNewWithSignificantFigures(t *testing.T) {
+	for _, sf := range []int64{0, 6, -1} {
+		_, err := NewWithSignificantFigures(sf)
+		assert.EqualError(t, err, fmt.Sprintf("significant figures must be between 1 and 5, got %d", sf))
+	}
+}
+
+func TestTotalCount(t *testing.T) {
+	var nilHistRep *HistogramRepresentation
+	assert.Equal(t, float64(0), nilHistRep.TotalCount())
+
+	histRep := New()
+	histRep.RecordDuration(time.Millisecond, 2.5)
+	histRep.RecordDuration(time.Second, 1)
+	histRep.RecordDuration(time.Second, 0.5)
+	assert.Equal(t, float64(4), histRep.TotalCount())
+}
+
+func TestMemoryEstimate(t *testing.T) {
+	var nilHistRep *HistogramRepresentation
+	assert.Equal(t, int64(0), nilHistRep.MemoryEstimate())
+
+	histRep := New()
+	empty := histRep.MemoryEstimate()
+	assert.Greater(t, empty, int64(0))
+	// Recording to the same bucket does not grow the histogram.
+	require.NoError(t, histRep.RecordDuration(time.Millisecond, 1))
+	require.NoError(t, histRep.RecordDuration(time.Millisecond, 1))
+	oneBucket := histRep.MemoryEstimate()
+	assert.Greater(t, oneBucket, empty)
+	for i := 1; i <= 100; i++ {
+		require.NoError(t, histRep.RecordDuration(time.Duration(i)*time.Second, 1))
+	}
+	assert.Equal(t, empty+int64(len(histRep.CountsRep))*(oneBucket-empty), histRep.MemoryEstimate())
+}
+
+func TestRecordNegativeDuration(t *testing.T) {
+	histRep := New()
+	require.NoError(t, histRep.RecordDuration(-time.Second, 1))
+	require.NoError(t, histRep.RecordDuration(-time.Microsecond, 1))
+	require.NoError(t, histRep.RecordDuration(0, 1))
+	require.NoError(t, histRep.RecordDuration(time.Millisecond, 1))
+
+	total, counts, values := histRep.Buckets()
+	assert.Equal(t, int64(4), total)
+	assert.Equal(t, []int64{3, 1}, counts)
+	require.Len(t, values, 2)
+	assert.Equal(t, float64(0), values[0])
+
+	other := New()
+	require.NoError(t, other.RecordDuration(-time.Hour, 2))
+	histRep.Merge(other)
+	total, counts, values = histRep.Buckets()
+	assert.Equal(t, int64(6), total)
+	assert.Equal(t, []int64{5, 1}, counts)
+	require.Len(t, values, 2)
+	assert.Equal(t, float64(0), values[0])
+}
+
+func getTestHistogram(significantFigures int64) *hdrhistogram.Histogram {
 	return hdrhistogram.New(
 		lowestTrackableValue,
 		highestTrackableValue,
 		int(significantFigures),
 	)
 }
+
+func TestDurationsAtPercentiles(t *testing.T) {
+	percentiles := []float64{50, 90, 95, 99}
+	assert.Equal(t, make([]time.Duration, 4), New().DurationsAtPercentiles(percentiles))
+
+	// Uniform distribution of 1ms to 1000ms.
+	for _, sf := range []int64{2, 3} {
+		histRep, err := NewWithSignificantFigures(sf)
+		require.NoError(t, err)
+		for i := 1; i <= 1000; i++ {
+			require.NoError(t, histRep.RecordDuration(time.Duration(i)*time.Millisecond, 1))
+		}
+		durations := histRep.DurationsAtPercentiles(percentiles)
+		require.Len(t, durations, len(percentiles))
+		for i, p := range percentiles {
+			expected := float64(time.Duration(p*10) * time.Millisecond)
+			assert.InEpsilon(t, expected, float64(durations[i]), math.Pow10(-int(sf)), "p%v", p)
+		}
+	}
+
+	// Bimodal distribution with fractional counts, the durations are
+	// the highest values equivalent to the recorded ones.
+	histRep := New()
+	require.NoError(t, histRep.RecordDuration(10*time.Millisecond, 90))
+	require.NoError(t, histRep.RecordDuration(time.Second, 9.5))
+	require.NoError(t, histRep.RecordDuration(time.Second, 0.5))
+	assert.Equal(t, []time.Duration{
+		10*time.Millisecond + 47*time.Microsecond,
+		10*time.Millisecond + 47*time.Microsecond,
+		time.Second + 3519*time.Microsecond,
+		time.Second + 3519*time.Microsecond,
+	}, histRep.DurationsAtPercentiles(percentiles))
+}
@@ -0,0 +1,63 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package telemetry
+
+import (
+	"sync"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// compactionTotals are the cumulative compaction metrics of a database.
+type compactionTotals struct {
+	count        int64
+	bytesRead    uint64
+	bytesWritten uint64
+}
+
+func newCompactionTotals(pm *pebble.Metrics) compactionTotals {
+	lm := pm.Total()
+	return compactionTotals{
+		count:        pm.Compact.Count,
+		bytesRead:    lm.BytesRead,
+		bytesWritten: lm.BytesCompacted,
+	}
+}
+
+// compactionDeltas diffs the cumulative compaction metrics of successive
+// observations of each database to record them as histograms, see
+// WithPebbleCompactionHistograms. It is safe for concurrent use.
+type compactionDeltas struct {
+	mu   sync.Mutex
+	prev map[string]compactionTotals
+}
+
+func newCompactionDeltas() *compactionDeltas {
+	return &compactionDeltas{prev: make(map[string]compactionTotals)}
+}
+
+// observe records the totals of the named database and returns the
+// compactions completed since the previous observation along with the
+// bytes they read and wrote. It returns false if there is no previous
+// observation, if no compaction completed since, or if the totals
+// decreased, for example, because the database was reopened, in which
+// case the totals are the baseline of the next observation.
+func (d *compactionDeltas) observe(db string, cur compactionTotals) (compactionTotals, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	prev, ok := d.prev[db]
+	d.prev[db] = cur
+	if !ok ||
+		cur.count <= prev.count ||
+		cur.bytesRead < prev.bytesRead ||
+		cur.bytesWritten < prev.bytesWritten {
+		return compactionTotals{}, false
+	}
+	return compactionTotals{
+		count:        cur.count - prev.count,
+		bytesRead:    cur.bytesRead - prev.bytesRead,
+		bytesWritten: cur.bytesWritten - prev.bytesWritten,
+	}, true
+}
@@ -0,0 +1,39 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package telemetry
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompactionDeltas(t *testing.T) {
+	d := newCompactionDeltas()
+
+	// The first observation is the baseline.
+	_, ok := d.observe("db", compactionTotals{count: 2, bytesRead: 200, bytesWritten: 100})
+	assert.False(t, ok)
+
+	delta, ok := d.observe("db", compactionTotals{count: 5, bytesRead: 800, bytesWritten: 400})
+	assert.True(t, ok)
+	assert.Equal(t, compactionTotals{count: 3, bytesRead: 600, bytesWritten: 300}, delta)
+
+	// Databases are diffed independently.
+	_, ok = d.observe("other", compactionTotals{count: 10, bytesRead: 1000, bytesWritten: 1000})
+	assert.False(t, ok)
+
+	// No compaction completed since the previous observation.
+	_, ok = d.observe("db", compactionTotals{count: 5, bytesRead: 800, bytesWritten: 400})
+	assert.False(t, ok)
+
+	// Decreasing totals, for example, of a reopened database, reset the
+	// baseline.
+	_, ok = d.observe("db", compactionTotals{count: 1, bytesRead: 50, bytesWritten: 10})
+	assert.False(t, ok)
+	delta, ok = d.observe("db", compactionTotals{count: 2, bytesRead: 150, bytesWritten: 60})
+	assert.True(t, ok)
+	assert.Equal(t, compactionTotals{count: 1, bytesRead: 100, bytesWritten: 50}, delta)
+}
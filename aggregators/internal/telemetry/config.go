@@ -5,6 +5,8 @@
 package telemetry
 
 import (
+	"time"
+
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/metric"
 )
@@ -17,6 +19,23 @@ type config struct {
 	Meter metric.Meter
 
 	MeterProvider metric.MeterProvider
+
+	MetricPrefix string
+
+	ErrorOnNilPebbleMetrics bool
+
+	PebbleCompactionHistograms bool
+
+	ServiceAttributionTopN int
+	ServiceOverflowTopN    int
+
+	ActiveCombinedMetrics   func() map[time.Duration]int64
+	HistogramsMemory        func() map[time.Duration]int64
+	SecondsSinceLastHarvest func() map[time.Duration]int64
+	MergeBatch              func() (keys, bytes int64)
+
+	OverflowEstimatedCardinality func() map[time.Duration]map[string]int64
+	OverflowActiveBuckets        func() map[time.Duration]int64
 }
 
 // Option interface is used to configure optional config options.
@@ -52,3 +71,130 @@ func WithMeterProvider(provider metric.MeterProvider) Option {
 		}
 	})
 }
+
+// WithMetricPrefix configures a prefix prepended, as is, to the names
+// of all the instruments, for example, "hot." for "hot.pebble.flushes".
+// If empty or no prefix is passed then the names are not prefixed.
+func WithMetricPrefix(prefix string) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.MetricPrefix = prefix
+	})
+}
+
+// WithErrorOnNilPebbleMetrics configures the callback observing the pebble
+// metrics to return an error if the pebble metrics provider returns nil,
+// for example, when the database is not open. By default, the pebble
+// metrics are not observed if the provider returns nil.
+func WithErrorOnNilPebbleMetrics() Option {
+	return optionFunc(func(cfg *config) {
+		cfg.ErrorOnNilPebbleMetrics = true
+	})
+}
+
+// WithPebbleCompactionHistograms enables, if true, recording the bytes
+// read and written by the pebble compactions into histograms, in addition
+// to the cumulative counters, for percentile analysis. Pebble only exposes
+// cumulative totals, thus, the histograms are recorded when the pebble
+// metrics are observed by diffing the totals with the previous
+// observation: the average bytes of the compactions completed since the
+// previous observation are recorded once per compaction. As a result:
+//
+//   - the recorded values are averages over the collection interval and
+//     do not capture the variance between compactions completed within
+//     the same interval, shorter collection intervals are more accurate;
+//   - nothing is recorded on the first observation of each database, or
+//     when the totals decrease, for example, if the database is reopened,
+//     as the previous totals are unknown or unrelated;
+//   - every observation records the difference with the previous one,
+//     thus, the metrics should be collected by a single reader.
+//
+// The compaction histograms are disabled by default.
+func WithPebbleCompactionHistograms(enabled bool) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.PebbleCompactionHistograms = enabled
+	})
+}
+
+// WithServiceAttribution enables reporting the number of events requested
+// for aggregation per service for the top N services, by number of events,
+// since the last collection. The events of all the remaining services are
+// reported under OtherServiceName. The counts are reset on collection and
+// thus the metrics should be collected by a single reader. Service
+// attribution is disabled if N is less than or equal to zero.
+func WithServiceAttribution(topN int) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.ServiceAttributionTopN = topN
+	})
+}
+
+// WithServiceOverflowAttribution enables reporting the number of events
+// aggregated into the per service overflow buckets for the top N services,
+// by number of overflowed events, per AddServiceOverflows call. The events
+// of all the remaining services are reported under OtherServiceName. Service
+// overflow attribution is disabled if N is less than or equal to zero.
+func WithServiceOverflowAttribution(topN int) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.ServiceOverflowTopN = topN
+	})
+}
+
+// WithActiveCombinedMetrics configures a provider for the number of
+// distinct combined metrics keys, per aggregation interval, which are
+// aggregated but not yet harvested. If nil or no provider is passed then
+// the active combined metrics are not observed.
+func WithActiveCombinedMetrics(provider func() map[time.Duration]int64) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.ActiveCombinedMetrics = provider
+	})
+}
+
+// WithHistogramsMemory configures a provider for the estimated memory, in
+// bytes, held by the latency histograms of the combined metrics which are
+// aggregated but not yet harvested, per aggregation interval. If nil or
+// no provider is passed then the histograms memory is not observed.
+func WithHistogramsMemory(provider func() map[time.Duration]int64) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.HistogramsMemory = provider
+	})
+}
+
+// WithMergeBatch configures a provider for the number of combined metrics
+// keys and the bytes buffered by the in-memory merge batch coalescing the
+// aggregations before they are written to pebble. If nil or no provider
+// is passed then the merge batch is not observed.
+func WithMergeBatch(provider func() (keys, bytes int64)) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.MergeBatch = provider
+	})
+}
+
+// WithSecondsSinceLastHarvest configures a provider for the number of
+// seconds since the last successful harvest per aggregation interval. If
+// nil or no provider is passed then the seconds since the last harvest
+// are not observed.
+func WithSecondsSinceLastHarvest(provider func() map[time.Duration]int64) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.SecondsSinceLastHarvest = provider
+	})
+}
+
+// WithOverflowEstimatedCardinality configures a provider for the estimated
+// number of distinct aggregation keys folded into the overflow buckets of
+// the combined metrics harvested by the last harvest, per aggregation
+// interval and overflow type. If nil or no provider is passed then the
+// overflow estimated cardinality is not observed.
+func WithOverflowEstimatedCardinality(provider func() map[time.Duration]map[string]int64) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.OverflowEstimatedCardinality = provider
+	})
+}
+
+// WithOverflowActiveBuckets configures a provider for the number of
+// distinct overflow buckets of the combined metrics not yet harvested per
+// aggregation interval. If nil or no provider is passed then the active
+// overflow buckets are not observed.
+func WithOverflowActiveBuckets(provider func() map[time.Duration]int64) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.OverflowActiveBuckets = provider
+	})
+}
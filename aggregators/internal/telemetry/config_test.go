@@ -40,6 +40,54 @@ func TestConfig(t *testing.T) {
 				}
 			},
 		},
+		{
+			name:    "config_with_metric_prefix",
+			options: []Option{WithMetricPrefix("hot.")},
+			expected: func() *config {
+				mp := otel.GetMeterProvider()
+				return &config{
+					Meter:         mp.Meter(instrumentationName),
+					MeterProvider: mp,
+					MetricPrefix:  "hot.",
+				}
+			},
+		},
+		{
+			name:    "config_with_service_attribution",
+			options: []Option{WithServiceAttribution(10)},
+			expected: func() *config {
+				mp := otel.GetMeterProvider()
+				return &config{
+					Meter:                  mp.Meter(instrumentationName),
+					MeterProvider:          mp,
+					ServiceAttributionTopN: 10,
+				}
+			},
+		},
+		{
+			name:    "config_with_service_overflow_attribution",
+			options: []Option{WithServiceOverflowAttribution(5)},
+			expected: func() *config {
+				mp := otel.GetMeterProvider()
+				return &config{
+					Meter:               mp.Meter(instrumentationName),
+					MeterProvider:       mp,
+					ServiceOverflowTopN: 5,
+				}
+			},
+		},
+		{
+			name:    "config_with_error_on_nil_pebble_metrics",
+			options: []Option{WithErrorOnNilPebbleMetrics()},
+			expected: func() *config {
+				mp := otel.GetMeterProvider()
+				return &config{
+					Meter:                   mp.Meter(instrumentationName),
+					MeterProvider:           mp,
+					ErrorOnNilPebbleMetrics: true,
+				}
+			},
+		},
 	} {
 		t.Run(tt.name, func(t *testing.T) {
 			cfg := newConfig(tt.options...)
@@ -0,0 +1,51 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package telemetry
+
+import (
+	"sync/atomic"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/pebble"
+)
+
+// Corruptions tracks the data corruptions detected in a pebble database,
+// for example, sstable blocks failing checksum verification. Corruptions
+// detected by background operations, such as compactions, are tracked
+// using the background errors published to a pebble.EventListener.
+// Corruptions is safe for concurrent use and the zero value is ready to
+// be used.
+type Corruptions struct {
+	count atomic.Int64
+}
+
+// EventListener returns a pebble.EventListener which records corruptions
+// detected by background operations. The returned listener should be
+// configured in the pebble options used to open the database.
+func (c *Corruptions) EventListener() *pebble.EventListener {
+	return &pebble.EventListener{
+		BackgroundError: func(err error) {
+			c.Record(err)
+		},
+	}
+}
+
+// Record records the error as a detected corruption if it is, wraps, or
+// is marked as pebble.ErrCorruption. Pebble marks corruption errors, for
+// example checksum mismatches, which can not be checked with the standard
+// library errors.Is. Record returns true if the error was recorded.
+func (c *Corruptions) Record(err error) bool {
+	if !errors.Is(err, pebble.ErrCorruption) {
+		return false
+	}
+	c.count.Add(1)
+	return true
+}
+
+// Count returns the number of corruptions detected since the database
+// was opened.
+func (c *Corruptions) Count() int64 {
+	return c.count.Load()
+}
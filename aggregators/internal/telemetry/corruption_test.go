@@ -0,0 +1,34 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package telemetry
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/pebble"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCorruptions(t *testing.T) {
+	var c Corruptions
+	assert.Equal(t, int64(0), c.Count())
+
+	assert.False(t, c.Record(errors.New("not a corruption")))
+	assert.Equal(t, int64(0), c.Count())
+
+	assert.True(t, c.Record(pebble.ErrCorruption))
+	assert.True(t, c.Record(fmt.Errorf("checksum mismatch: %w", pebble.ErrCorruption)))
+	assert.True(t, c.Record(errors.Mark(errors.New("checksum mismatch"), pebble.ErrCorruption)))
+	assert.Equal(t, int64(3), c.Count())
+
+	// Corruptions detected by background operations are recorded
+	// using the event listener.
+	el := c.EventListener()
+	el.BackgroundError(errors.New("compaction failed"))
+	el.BackgroundError(fmt.Errorf("compaction failed: %w", pebble.ErrCorruption))
+	assert.Equal(t, int64(4), c.Count())
+}
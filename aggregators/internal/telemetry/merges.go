@@ -0,0 +1,39 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package telemetry
+
+import "sync/atomic"
+
+// Merges tracks the merge operations of the pebble value merger of a
+// database, each merging a value into the merged value of its key, and
+// the merge operations which failed, for example, due to a value which
+// can not be decoded. Merges is safe for concurrent use and the zero
+// value is ready to be used.
+type Merges struct {
+	total  atomic.Int64
+	failed atomic.Int64
+}
+
+// Record records a merge operation, as failed if err is not nil. Record
+// returns err, allowing merge errors to be recorded where returned.
+func (m *Merges) Record(err error) error {
+	m.total.Add(1)
+	if err != nil {
+		m.failed.Add(1)
+	}
+	return err
+}
+
+// Total returns the number of merge operations, including the failed
+// merge operations, since the database was opened.
+func (m *Merges) Total() int64 {
+	return m.total.Load()
+}
+
+// Failed returns the number of failed merge operations since the
+// database was opened.
+func (m *Merges) Failed() int64 {
+	return m.failed.Load()
+}
@@ -0,0 +1,25 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package telemetry
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMerges(t *testing.T) {
+	var m Merges
+	assert.Equal(t, int64(0), m.Total())
+	assert.Equal(t, int64(0), m.Failed())
+
+	assert.NoError(t, m.Record(nil))
+	assert.NoError(t, m.Record(nil))
+	mergeErr := errors.New("failed to unmarshal")
+	assert.Equal(t, mergeErr, m.Record(mergeErr))
+	assert.Equal(t, int64(3), m.Total())
+	assert.Equal(t, int64(1), m.Failed())
+}
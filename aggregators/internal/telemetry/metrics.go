@@ -7,17 +7,105 @@ package telemetry
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/cockroachdb/pebble"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/aggregation"
 )
 
+// ErrNilPebbleMetrics is returned by the callback observing the pebble
+// metrics if the provider returns nil and WithErrorOnNilPebbleMetrics
+// is configured.
+var ErrNilPebbleMetrics = errors.New("pebble metrics provider returned nil")
+
 const (
-	bytesUnit = "by"
-	countUnit = "1"
+	bytesUnit   = "by"
+	countUnit   = "1"
+	nanosUnit   = "ns"
+	secondsUnit = "s"
 )
 
+const requestDurationName = "aggregator.requests.duration"
+
+// RequestDurationView returns a view configuring the bucket boundaries,
+// in seconds, of the histogram recording the duration of the aggregation
+// requests. The view must be registered with the SDK meter provider used
+// to create the metrics. The view applies irrespective of the configured
+// metric prefix.
+func RequestDurationView(boundaries []float64) sdkmetric.View {
+	return sdkmetric.NewView(
+		sdkmetric.Instrument{Name: "*" + requestDurationName},
+		sdkmetric.Stream{
+			Aggregation: aggregation.ExplicitBucketHistogram{
+				Boundaries: append([]float64(nil), boundaries...),
+			},
+		},
+	)
+}
+
+// AggregationIntervalKey is the attribute key used to identify the
+// aggregation interval of the recorded measurements. The value of the
+// attribute is the interval formatted as minutes, for example "10m",
+// or as seconds for intervals less than a minute, for example "10s".
+const AggregationIntervalKey = "aggregation_interval"
+
+// OverflowTypeKey is the attribute key used to identify the type of
+// the overflow bucket, for example "service" or "transaction", that
+// the events were aggregated into due to the limits being breached.
+const OverflowTypeKey = "overflow_type"
+
+// RejectReasonKey is the attribute key used to identify the reason for
+// rejecting events from aggregation, for example "missing_event".
+const RejectReasonKey = "reason"
+
+// EventTypeKey is the attribute key used to identify the type of the
+// aggregated events, for example "transaction" or "span", or
+// "combined_metrics" for aggregated partial combined metrics.
+const EventTypeKey = "event_type"
+
+// AttributesOverflowKey is the attribute key used to identify the
+// measurements recorded without their attributes, as the number of
+// distinct attribute sets exceeded the configured limit. The value of
+// the attribute is always true.
+const AttributesOverflowKey = "otel.metric.overflow"
+
+// levelKey is the attribute key used to identify the LSM level for
+// per level pebble metrics.
+const levelKey = "level"
+
+// DBKey is the attribute key used to identify the pebble database of
+// the pebble measurements when the metrics are collected for named
+// databases, see PebbleDB.
+const DBKey = "db"
+
+// AggregationIntervalAttr returns the attribute identifying the given
+// aggregation interval.
+func AggregationIntervalAttr(ivl time.Duration) attribute.KeyValue {
+	return attribute.String(AggregationIntervalKey, formatInterval(ivl))
+}
+
+// AggregationIntervalAttrSet returns the attribute set for recording
+// measurements for the given aggregation interval. Additional attributes
+// can be passed and are added to the returned set.
+func AggregationIntervalAttrSet(ivl time.Duration, attrs ...attribute.KeyValue) attribute.Set {
+	kvs := make([]attribute.KeyValue, 0, len(attrs)+1)
+	kvs = append(kvs, AggregationIntervalAttr(ivl))
+	kvs = append(kvs, attrs...)
+	return attribute.NewSet(kvs...)
+}
+
+func formatInterval(ivl time.Duration) string {
+	if d := ivl.Minutes(); d >= 1 {
+		return fmt.Sprintf("%.0fm", d)
+	}
+	return fmt.Sprintf("%.0fs", ivl.Seconds())
+}
+
 // Metrics are a collection of metric used to record all the
 // measurements for the aggregators. Sync metrics are exposed
 // and used by the calling code to record measurements whereas
@@ -25,51 +113,279 @@ const (
 // collected by the observer pattern by passing a metrics provider.
 type Metrics struct {
 	// Synchronous metrics used to record aggregation service
-	// measurements.
+	// measurements. Unless stated otherwise, the metrics are recorded
+	// per aggregation interval using the attributes built by
+	// AggregationIntervalAttrSet.
 
-	RequestsTotal   metric.Int64Counter
-	RequestsFailed  metric.Int64Counter
+	RequestsTotal  metric.Int64Counter
+	RequestsFailed metric.Int64Counter
+	// RequestDuration is recorded once per aggregation request, from the
+	// start of the request until all its aggregation intervals are
+	// aggregated, using the combined metrics ID attributes.
+	RequestDuration metric.Float64Histogram
 	EventsTotal     metric.Int64Counter
+	EventsWeighted  metric.Float64Counter
 	EventsProcessed metric.Int64Counter
-	BytesIngested   metric.Int64Counter
+	// EventsOverflowed is additionally recorded with the OverflowTypeKey
+	// attribute.
+	EventsOverflowed metric.Int64Counter
+	// EventsRejected is additionally recorded with the RejectReasonKey
+	// attribute for the events rejected due to data quality issues,
+	// unlike failures which are recorded by RequestsFailed.
+	EventsRejected metric.Int64Counter
+	// EventsFiltered is recorded for the events dropped by the event
+	// filter.
+	EventsFiltered metric.Int64Counter
+	// EventsTooLate is recorded for the events dropped as their timestamp
+	// precedes the oldest processing time still aggregated for the
+	// interval.
+	EventsTooLate metric.Int64Counter
+	// BytesIngested is recorded using the combined metrics ID attributes
+	// and the EventTypeKey attribute.
+	BytesIngested metric.Int64Counter
+	// HarvestsTotal only counts the harvests which successfully processed
+	// all the harvested combined metrics. HarvestsTotal and HarvestBytes
+	// are recorded without any additional attributes.
+	HarvestsTotal metric.Int64Counter
+	HarvestBytes  metric.Int64Counter
+	// HarvestLag is recorded without any additional attributes for every
+	// harvest, as the seconds elapsed between the end of the harvested
+	// interval and the start of its harvest, growing as the harvests fall
+	// behind.
+	HarvestLag metric.Float64Histogram
+	// HarvestErrors is recorded for each combined metrics which failed to
+	// be processed on harvest.
+	HarvestErrors metric.Int64Counter
+	// HarvestDropped is recorded for the combined metrics dropped on
+	// harvest as they can not be merged or exhausted their retries.
+	HarvestDropped metric.Int64Counter
+	// StaleDropped is recorded for the combined metrics dropped without
+	// being harvested.
+	StaleDropped metric.Int64Counter
+	// RequestsDiskFull is recorded without any attributes for the
+	// requests rejected as the disk usage limit is exceeded.
+	RequestsDiskFull metric.Int64Counter
+	// RequestsDeduplicated is recorded for the requests ignored as their
+	// idempotency token was already aggregated.
+	RequestsDeduplicated metric.Int64Counter
+	// MergeBatchForcedFlushes is recorded without any attributes for the
+	// merge batch flushes forced by the buffered bytes exceeding the limit
+	// before the merge batch window elapsed.
+	MergeBatchForcedFlushes metric.Int64Counter
 
 	// Asynchronous metrics used to get pebble metrics and
 	// record measurements. These are kept unexported as they are
 	// supposed to be updated via the registered callback.
 
-	pebbleFlushes                  metric.Int64ObservableCounter
-	pebbleFlushedBytes             metric.Int64ObservableCounter
-	pebbleCompactions              metric.Int64ObservableCounter
-	pebbleIngestedBytes            metric.Int64ObservableCounter
-	pebbleCompactedBytesRead       metric.Int64ObservableCounter
-	pebbleCompactedBytesWritten    metric.Int64ObservableCounter
-	pebbleMemtableTotalSize        metric.Int64ObservableGauge
-	pebbleTotalDiskUsage           metric.Int64ObservableGauge
-	pebbleReadAmplification        metric.Int64ObservableGauge
-	pebbleNumSSTables              metric.Int64ObservableGauge
-	pebbleTableReadersMemEstimate  metric.Int64ObservableGauge
-	pebblePendingCompaction        metric.Int64ObservableGauge
-	pebbleMarkedForCompactionFiles metric.Int64ObservableGauge
-	pebbleKeysTombstones           metric.Int64ObservableGauge
+	pebbleFlushes                    metric.Int64ObservableCounter
+	pebbleFlushedBytes               metric.Int64ObservableCounter
+	pebbleFlushDuration              metric.Int64ObservableGauge
+	pebbleCompactions                metric.Int64ObservableCounter
+	pebbleIngestedBytes              metric.Int64ObservableCounter
+	pebbleCompactedBytesRead         metric.Int64ObservableCounter
+	pebbleCompactedBytesWritten      metric.Int64ObservableCounter
+	pebbleMemtableTotalSize          metric.Int64ObservableGauge
+	pebbleTotalDiskUsage             metric.Int64ObservableGauge
+	pebbleReadAmplification          metric.Int64ObservableGauge
+	pebbleNumSSTables                metric.Int64ObservableGauge
+	pebbleTableReadersMemEstimate    metric.Int64ObservableGauge
+	pebblePendingCompaction          metric.Int64ObservableGauge
+	pebbleMarkedForCompactionFiles   metric.Int64ObservableGauge
+	pebbleKeysTombstones             metric.Int64ObservableGauge
+	pebbleWriteStallCount            metric.Int64ObservableCounter
+	pebbleWriteStallDuration         metric.Int64ObservableGauge
+	pebbleCorruptionDetected         metric.Int64ObservableCounter
+	pebbleLevelNumFiles              metric.Int64ObservableGauge
+	pebbleLevelScore                 metric.Float64ObservableGauge
+	pebbleBlockCacheHits             metric.Int64ObservableCounter
+	pebbleBlockCacheMisses           metric.Int64ObservableCounter
+	pebbleBlockCacheSize             metric.Int64ObservableGauge
+	pebbleObsoleteNumFiles           metric.Int64ObservableGauge
+	pebbleObsoleteSize               metric.Int64ObservableGauge
+	pebbleZombieNumFiles             metric.Int64ObservableGauge
+	pebbleZombieSize                 metric.Int64ObservableGauge
+	pebbleIteratorsOpen              metric.Int64ObservableGauge
+	pebbleSnapshotsOpen              metric.Int64ObservableGauge
+	pebbleCompactionsInProgress      metric.Int64ObservableGauge
+	pebbleCompactionsInProgressBytes metric.Int64ObservableGauge
+
+	// pebbleCompactionBytesRead and pebbleCompactionBytesWritten record
+	// the bytes per compaction computed by compactionDeltas, nil if the
+	// compaction histograms are disabled.
+	pebbleCompactionBytesRead    metric.Float64Histogram
+	pebbleCompactionBytesWritten metric.Float64Histogram
+	compactionDeltas             *compactionDeltas
+
+	// mergesTotal and mergesFailed report the merge operations of the
+	// pebble value merger of the databases tracking their Merges.
+	mergesTotal  metric.Int64ObservableCounter
+	mergesFailed metric.Int64ObservableCounter
+
+	// serviceEventsGauge reports the events per service tracked by
+	// serviceEvents, nil if service attribution is disabled.
+	serviceEventsGauge metric.Int64ObservableGauge
+	serviceEvents      *serviceEvents
+
+	// serviceEventsOverflowed records the events overflowed per service
+	// for the top serviceOverflowTopN services, nil if service overflow
+	// attribution is disabled.
+	serviceEventsOverflowed metric.Int64Counter
+	serviceOverflowTopN     int
+
+	// activeCombinedMetrics reports the combined metrics keys not yet
+	// harvested as provided by activeCombinedMetricsProvider, if any.
+	activeCombinedMetrics         metric.Int64ObservableGauge
+	activeCombinedMetricsProvider func() map[time.Duration]int64
+
+	// histogramsMemory reports the estimated memory held by the latency
+	// histograms as provided by histogramsMemoryProvider, if any.
+	histogramsMemory         metric.Int64ObservableGauge
+	histogramsMemoryProvider func() map[time.Duration]int64
+
+	// secondsSinceLastHarvest reports the seconds since the last
+	// successful harvest as provided by secondsSinceLastHarvestProvider,
+	// if any.
+	secondsSinceLastHarvest         metric.Int64ObservableGauge
+	secondsSinceLastHarvestProvider func() map[time.Duration]int64
+
+	// mergeBatchKeys and mergeBatchBytes report the contents of the
+	// merge batch as provided by mergeBatchProvider, if any.
+	mergeBatchKeys     metric.Int64ObservableGauge
+	mergeBatchBytes    metric.Int64ObservableGauge
+	mergeBatchProvider func() (keys, bytes int64)
+
+	// overflowEstimatedCardinality reports the estimated cardinality of
+	// the overflow buckets as provided by
+	// overflowEstimatedCardinalityProvider, if any.
+	overflowEstimatedCardinality         metric.Int64ObservableGauge
+	overflowEstimatedCardinalityProvider func() map[time.Duration]map[string]int64
+
+	// overflowActiveBuckets reports the overflow buckets of the combined
+	// metrics not yet harvested as provided by
+	// overflowActiveBucketsProvider, if any.
+	overflowActiveBuckets         metric.Int64ObservableGauge
+	overflowActiveBucketsProvider func() map[time.Duration]int64
+
+	// dbs are the pebble databases to observe the pebble metrics for.
+	dbs []pebbleDB
+	// errorOnNilPebbleMetrics configures the callback to return an
+	// error if the pebble metrics provider returns nil.
+	errorOnNilPebbleMetrics bool
 
 	// registration represents the token for a the configured callback.
 	registration metric.Registration
+
+	// descriptors describe all the instruments created for the metrics.
+	descriptors []InstrumentDescriptor
+}
+
+// InstrumentDescriptor describes an instrument created by NewMetrics.
+type InstrumentDescriptor struct {
+	Name        string
+	Description string
+	Unit        string
+	Kind        InstrumentKind
 }
 
-type pebbleProvider func() *pebble.Metrics
+// InstrumentKind is the kind of an instrument created by NewMetrics.
+type InstrumentKind string
+
+const (
+	// InstrumentKindCounter is a synchronous monotonic counter.
+	InstrumentKindCounter InstrumentKind = "counter"
+	// InstrumentKindHistogram is a synchronous histogram.
+	InstrumentKindHistogram InstrumentKind = "histogram"
+	// InstrumentKindObservableCounter is an asynchronous monotonic
+	// counter observed on collection.
+	InstrumentKindObservableCounter InstrumentKind = "observable_counter"
+	// InstrumentKindObservableGauge is an asynchronous gauge observed
+	// on collection.
+	InstrumentKindObservableGauge InstrumentKind = "observable_gauge"
+)
+
+// PebbleDB describes a pebble database to observe the pebble metrics for.
+type PebbleDB struct {
+	// Name identifies the database using the DBKey attribute. Name can
+	// only be empty if metrics are observed for a single database, in
+	// which case the attribute is omitted.
+	Name string
 
-// NewMetrics returns a new instance of the metrics.
-func NewMetrics(provider pebbleProvider, opts ...Option) (*Metrics, error) {
+	// Metrics returns the current metrics of the database.
+	Metrics func() *pebble.Metrics
+
+	// WriteStalls tracks the write stalls of the database. If nil then
+	// write stalls are not observed for the database.
+	WriteStalls *WriteStalls
+
+	// Corruptions tracks the data corruptions detected in the database.
+	// If nil then corruptions are not observed for the database.
+	Corruptions *Corruptions
+
+	// Merges tracks the merge operations of the value merger of the
+	// database. If nil then merges are not observed for the database.
+	Merges *Merges
+}
+
+type pebbleDB struct {
+	PebbleDB
+	attrs []attribute.KeyValue
+}
+
+// NewMetrics returns a new instance of the metrics observing the pebble
+// metrics for all the given databases. The names of the databases must
+// be unique and non-empty if more than one database is passed.
+//
+// The returned metrics own the lifecycle of the callback observing the
+// pebble metrics, which is registered once per metrics and unregistered
+// by CleanUp. Metrics created with the same meter are observed
+// independently of each other, CleanUp must be called to stop observing
+// the pebble metrics of metrics which are no longer used.
+func NewMetrics(dbs []PebbleDB, opts ...Option) (*Metrics, error) {
 	var err error
 	var i Metrics
 
+	i.dbs, err = newPebbleDBs(dbs)
+	if err != nil {
+		return nil, err
+	}
+
 	cfg := newConfig(opts...)
-	meter := cfg.Meter
+	meter := &describingMeter{Meter: cfg.Meter, prefix: cfg.MetricPrefix}
+	i.errorOnNilPebbleMetrics = cfg.ErrorOnNilPebbleMetrics
+	i.activeCombinedMetricsProvider = cfg.ActiveCombinedMetrics
+	i.histogramsMemoryProvider = cfg.HistogramsMemory
+	i.secondsSinceLastHarvestProvider = cfg.SecondsSinceLastHarvest
+	i.mergeBatchProvider = cfg.MergeBatch
+	i.overflowEstimatedCardinalityProvider = cfg.OverflowEstimatedCardinality
+	i.overflowActiveBucketsProvider = cfg.OverflowActiveBuckets
+	if cfg.ServiceAttributionTopN > 0 {
+		i.serviceEvents = newServiceEvents(cfg.ServiceAttributionTopN)
+	}
+
+	if cfg.PebbleCompactionHistograms {
+		i.compactionDeltas = newCompactionDeltas()
+		i.pebbleCompactionBytesRead, err = meter.Float64Histogram(
+			"pebble.compaction.bytes-read",
+			metric.WithDescription("Bytes read per compaction, averaged over the compactions completed between observations"),
+			metric.WithUnit(bytesUnit),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create metric for compaction bytes read: %w", err)
+		}
+		i.pebbleCompactionBytesWritten, err = meter.Float64Histogram(
+			"pebble.compaction.bytes-written",
+			metric.WithDescription("Bytes written per compaction, averaged over the compactions completed between observations"),
+			metric.WithUnit(bytesUnit),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create metric for compaction bytes written: %w", err)
+		}
+	}
 
 	// Aggregator metrics
 	i.RequestsTotal, err = meter.Int64Counter(
 		"aggregator.requests.total",
-		metric.WithDescription("Total number of aggregation requests"),
+		metric.WithDescription("Total number of aggregation requests per aggregation interval"),
 		metric.WithUnit(countUnit),
 	)
 	if err != nil {
@@ -77,12 +393,20 @@ func NewMetrics(provider pebbleProvider, opts ...Option) (*Metrics, error) {
 	}
 	i.RequestsFailed, err = meter.Int64Counter(
 		"aggregator.requests.failed",
-		metric.WithDescription("Total number of aggregation requests failed, including partial failures"),
+		metric.WithDescription("Total number of aggregation requests failed, including partial failures, per aggregation interval"),
 		metric.WithUnit(countUnit),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create metric for requests failed: %w", err)
 	}
+	i.RequestDuration, err = meter.Float64Histogram(
+		requestDurationName,
+		metric.WithDescription("Time taken to process aggregation requests"),
+		metric.WithUnit(secondsUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for request duration: %w", err)
+	}
 	i.EventsTotal, err = meter.Int64Counter(
 		"aggregator.events.total",
 		metric.WithDescription("Total number of APM Events requested for aggregation per aggregation interval"),
@@ -91,6 +415,14 @@ func NewMetrics(provider pebbleProvider, opts ...Option) (*Metrics, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to create metric for events total: %w", err)
 	}
+	i.EventsWeighted, err = meter.Float64Counter(
+		"aggregator.events.weighted",
+		metric.WithDescription("Total number of APM Events requested for aggregation, scaled by their representative count and weight, per aggregation interval"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for events weighted: %w", err)
+	}
 	i.EventsProcessed, err = meter.Int64Counter(
 		"aggregator.events.processed",
 		metric.WithDescription("APM Events successfully aggregated by the aggregator per aggregation interval"),
@@ -99,6 +431,49 @@ func NewMetrics(provider pebbleProvider, opts ...Option) (*Metrics, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to create metric for events processed: %w", err)
 	}
+	i.EventsOverflowed, err = meter.Int64Counter(
+		"aggregator.events.overflowed",
+		metric.WithDescription("APM Events aggregated into overflow buckets due to limits per aggregation interval and overflow type"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for events overflowed: %w", err)
+	}
+	i.EventsRejected, err = meter.Int64Counter(
+		"aggregator.events.rejected",
+		metric.WithDescription("APM Events rejected from aggregation due to data quality issues per aggregation interval and reason"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for events rejected: %w", err)
+	}
+	i.EventsFiltered, err = meter.Int64Counter(
+		"aggregator.events.filtered",
+		metric.WithDescription("APM Events dropped by the event filter before aggregation per aggregation interval"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for events filtered: %w", err)
+	}
+	i.EventsTooLate, err = meter.Int64Counter(
+		"aggregator.events.too-late",
+		metric.WithDescription("APM Events dropped as their timestamp precedes the oldest processing time still aggregated per aggregation interval"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for events too late: %w", err)
+	}
+	if cfg.ServiceOverflowTopN > 0 {
+		i.serviceOverflowTopN = cfg.ServiceOverflowTopN
+		i.serviceEventsOverflowed, err = meter.Int64Counter(
+			"aggregator.overflow.per-service",
+			metric.WithDescription("APM Events aggregated into the overflow buckets of the top services per overflow type"),
+			metric.WithUnit(countUnit),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create metric for events overflowed per service: %w", err)
+		}
+	}
 	i.BytesIngested, err = meter.Int64Counter(
 		"aggregator.bytes.ingested",
 		metric.WithDescription("Number of bytes ingested by the aggregators"),
@@ -107,6 +482,79 @@ func NewMetrics(provider pebbleProvider, opts ...Option) (*Metrics, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to create metric for bytes processed: %w", err)
 	}
+	i.HarvestsTotal, err = meter.Int64Counter(
+		"aggregator.harvests.total",
+		metric.WithDescription("Total number of successful harvests per aggregation interval"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for harvests total: %w", err)
+	}
+	i.HarvestBytes, err = meter.Int64Counter(
+		"aggregator.harvest.bytes",
+		metric.WithDescription("Number of bytes of combined metrics successfully harvested per aggregation interval"),
+		metric.WithUnit(bytesUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for harvest bytes: %w", err)
+	}
+	i.HarvestLag, err = meter.Float64Histogram(
+		"aggregator.harvest.lag",
+		metric.WithDescription("Time elapsed between the end of the harvested interval and the start of its harvest per aggregation interval"),
+		metric.WithUnit(secondsUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for harvest lag: %w", err)
+	}
+	i.HarvestErrors, err = meter.Int64Counter(
+		"aggregator.harvest.errors",
+		metric.WithDescription("Number of combined metrics which failed to be processed on harvest"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for harvest errors: %w", err)
+	}
+	i.HarvestDropped, err = meter.Int64Counter(
+		"aggregator.harvest.dropped",
+		metric.WithDescription("Number of combined metrics dropped on harvest as they could not be merged or exhausted their retries"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for harvest dropped: %w", err)
+	}
+	i.StaleDropped, err = meter.Int64Counter(
+		"aggregator.stale.dropped",
+		metric.WithDescription("Number of combined metrics dropped without being harvested as they were older than the stale key TTL"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for stale dropped: %w", err)
+	}
+
+	i.RequestsDiskFull, err = meter.Int64Counter(
+		"aggregator.requests.disk-full",
+		metric.WithDescription("Number of aggregation requests rejected as the disk usage exceeds the configured limit"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for requests disk full: %w", err)
+	}
+	i.RequestsDeduplicated, err = meter.Int64Counter(
+		"aggregator.requests.deduplicated",
+		metric.WithDescription("Number of aggregation requests ignored as their idempotency token was already aggregated within the deduplication window, per aggregation interval"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for requests deduplicated: %w", err)
+	}
+	i.MergeBatchForcedFlushes, err = meter.Int64Counter(
+		"aggregator.merge-batch.forced-flushes",
+		metric.WithDescription("Number of merge batch flushes forced by the buffered bytes exceeding the limit before the merge batch window elapsed"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for merge batch forced flushes: %w", err)
+	}
 
 	// Pebble metrics
 	i.pebbleFlushes, err = meter.Int64ObservableCounter(
@@ -125,6 +573,14 @@ func NewMetrics(provider pebbleProvider, opts ...Option) (*Metrics, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to create metric for flushed bytes: %w", err)
 	}
+	i.pebbleFlushDuration, err = meter.Int64ObservableGauge(
+		"pebble.flush.duration",
+		metric.WithDescription("Cumulative wall time spent flushing memtables to disk"),
+		metric.WithUnit(nanosUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for flush duration: %w", err)
+	}
 	i.pebbleCompactions, err = meter.Int64ObservableCounter(
 		"pebble.compactions",
 		metric.WithDescription("Number of table compactions"),
@@ -221,53 +677,307 @@ func NewMetrics(provider pebbleProvider, opts ...Option) (*Metrics, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to create metric for tombstones: %w", err)
 	}
+	i.pebbleWriteStallCount, err = meter.Int64ObservableCounter(
+		"pebble.write-stall.count",
+		metric.WithDescription("Number of times writes were stalled"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for write stall count: %w", err)
+	}
+	i.pebbleWriteStallDuration, err = meter.Int64ObservableGauge(
+		"pebble.write-stall.duration",
+		metric.WithDescription("Cumulative duration for which writes were stalled"),
+		metric.WithUnit(nanosUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for write stall duration: %w", err)
+	}
+	i.pebbleCorruptionDetected, err = meter.Int64ObservableCounter(
+		"pebble.corruption.detected",
+		metric.WithDescription("Number of data corruptions detected, such as checksum mismatches"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for corruption detected: %w", err)
+	}
+	i.pebbleLevelNumFiles, err = meter.Int64ObservableGauge(
+		"pebble.level.num-files",
+		metric.WithDescription("Current number of SSTables per level"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for level file count: %w", err)
+	}
+	i.pebbleLevelScore, err = meter.Float64ObservableGauge(
+		"pebble.level.score",
+		metric.WithDescription("Current compaction score per level"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for level score: %w", err)
+	}
+	i.pebbleBlockCacheHits, err = meter.Int64ObservableCounter(
+		"pebble.block-cache.hits",
+		metric.WithDescription("Number of block cache hits"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for block cache hits: %w", err)
+	}
+	i.pebbleBlockCacheMisses, err = meter.Int64ObservableCounter(
+		"pebble.block-cache.misses",
+		metric.WithDescription("Number of block cache misses"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for block cache misses: %w", err)
+	}
+	i.pebbleBlockCacheSize, err = meter.Int64ObservableGauge(
+		"pebble.block-cache.size",
+		metric.WithDescription("Current size of the block cache in bytes"),
+		metric.WithUnit(bytesUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for block cache size: %w", err)
+	}
+	i.pebbleObsoleteNumFiles, err = meter.Int64ObservableGauge(
+		"pebble.obsolete.num-files",
+		metric.WithDescription("Current number of obsolete SSTables pending deletion"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for obsolete file count: %w", err)
+	}
+	i.pebbleObsoleteSize, err = meter.Int64ObservableGauge(
+		"pebble.obsolete.size",
+		metric.WithDescription("Current size of obsolete SSTables pending deletion"),
+		metric.WithUnit(bytesUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for obsolete file size: %w", err)
+	}
+	i.pebbleZombieNumFiles, err = meter.Int64ObservableGauge(
+		"pebble.zombie.num-files",
+		metric.WithDescription("Current number of SSTables no longer referenced by the db but still in use by iterators"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for zombie file count: %w", err)
+	}
+	i.pebbleZombieSize, err = meter.Int64ObservableGauge(
+		"pebble.zombie.size",
+		metric.WithDescription("Current size of SSTables no longer referenced by the db but still in use by iterators"),
+		metric.WithUnit(bytesUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for zombie file size: %w", err)
+	}
+	i.pebbleIteratorsOpen, err = meter.Int64ObservableGauge(
+		"pebble.iterators.open",
+		metric.WithDescription("Current number of open SSTable iterators, rising values between harvests indicate leaked iterators"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for open iterators: %w", err)
+	}
+	i.pebbleSnapshotsOpen, err = meter.Int64ObservableGauge(
+		"pebble.snapshots.open",
+		metric.WithDescription("Current number of open snapshots, rising values between harvests indicate leaked snapshots pinning obsolete files"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for open snapshots: %w", err)
+	}
+	i.pebbleCompactionsInProgress, err = meter.Int64ObservableGauge(
+		"pebble.compactions.in-progress",
+		metric.WithDescription("Number of compactions in progress"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for compactions in progress: %w", err)
+	}
+	i.pebbleCompactionsInProgressBytes, err = meter.Int64ObservableGauge(
+		"pebble.compactions.in-progress-bytes",
+		metric.WithDescription("Bytes present in sstables being written by in progress compactions"),
+		metric.WithUnit(bytesUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for compactions in progress bytes: %w", err)
+	}
+	i.mergesTotal, err = meter.Int64ObservableCounter(
+		"aggregator.merges.total",
+		metric.WithDescription("Number of merge operations of the pebble value merger, including failed merge operations"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for merges total: %w", err)
+	}
+	i.mergesFailed, err = meter.Int64ObservableCounter(
+		"aggregator.merges.failed",
+		metric.WithDescription("Number of failed merge operations of the pebble value merger, such as values failing to be decoded"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for merges failed: %w", err)
+	}
+	i.serviceEventsGauge, err = meter.Int64ObservableGauge(
+		"aggregator.service.events",
+		metric.WithDescription("APM Events requested for aggregation since the last collection for the top services"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for service events: %w", err)
+	}
+	i.activeCombinedMetrics, err = meter.Int64ObservableGauge(
+		"aggregator.combined-metrics.active",
+		metric.WithDescription("Current number of distinct combined metrics aggregated but not yet harvested per aggregation interval"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for active combined metrics: %w", err)
+	}
+	i.histogramsMemory, err = meter.Int64ObservableGauge(
+		"aggregator.histograms.memory",
+		metric.WithDescription("Estimated memory held by the latency histograms of the combined metrics not yet harvested per aggregation interval"),
+		metric.WithUnit(bytesUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for histograms memory: %w", err)
+	}
+	i.secondsSinceLastHarvest, err = meter.Int64ObservableGauge(
+		"aggregator.harvest.seconds-since-last",
+		metric.WithDescription("Seconds since the last successful harvest per aggregation interval, rising values indicate stalled harvests"),
+		metric.WithUnit(secondsUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for seconds since last harvest: %w", err)
+	}
+	i.mergeBatchKeys, err = meter.Int64ObservableGauge(
+		"aggregator.merge-batch.keys",
+		metric.WithDescription("Number of combined metrics keys buffered by the merge batch"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for merge batch keys: %w", err)
+	}
+	i.mergeBatchBytes, err = meter.Int64ObservableGauge(
+		"aggregator.merge-batch.bytes",
+		metric.WithDescription("Encoded size of the aggregations buffered by the merge batch"),
+		metric.WithUnit(bytesUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for merge batch bytes: %w", err)
+	}
+	i.overflowEstimatedCardinality, err = meter.Int64ObservableGauge(
+		"aggregator.overflow.estimated-cardinality",
+		metric.WithDescription("Estimated number of distinct aggregation keys folded into the overflow buckets by the last harvest per aggregation interval and overflow type"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for overflow estimated cardinality: %w", err)
+	}
+	i.overflowActiveBuckets, err = meter.Int64ObservableGauge(
+		"aggregator.overflow.active-buckets",
+		metric.WithDescription("Current number of distinct overflow buckets across the services of the combined metrics not yet harvested per aggregation interval, rising values indicate widespread overflow"),
+		metric.WithUnit(countUnit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric for overflow active buckets: %w", err)
+	}
 
-	if err := i.registerCallback(meter, provider); err != nil {
+	if err := i.registerCallback(meter); err != nil {
 		return nil, fmt.Errorf("failed to register callback: %w", err)
 	}
+	i.descriptors = meter.descriptors
 	return &i, nil
 }
 
+// Descriptors returns the descriptors for all the instruments, both
+// synchronous and asynchronous, created for the metrics.
+func (i *Metrics) Descriptors() []InstrumentDescriptor {
+	return append([]InstrumentDescriptor(nil), i.descriptors...)
+}
+
+// AddServiceEvents tracks the number of events requested for aggregation
+// for the given service. The events are reported per service for the top
+// services on every collection if WithServiceAttribution is configured,
+// otherwise AddServiceEvents is a no-op.
+func (i *Metrics) AddServiceEvents(service string, n int64) {
+	if i.serviceEvents == nil {
+		return
+	}
+	i.serviceEvents.add(service, n)
+}
+
+// AddServiceOverflows records the number of events overflowed per service
+// with the given attributes, for example, the overflow type. Only the top
+// services, by number of overflowed events, are recorded with their service
+// name, the events of the remaining services are recorded under
+// OtherServiceName. AddServiceOverflows is a no-op unless
+// WithServiceOverflowAttribution is configured.
+func (i *Metrics) AddServiceOverflows(
+	ctx context.Context,
+	counts map[string]int64,
+	attrs ...attribute.KeyValue,
+) {
+	if i.serviceEventsOverflowed == nil {
+		return
+	}
+	for _, sc := range topServices(counts, i.serviceOverflowTopN) {
+		if sc.count <= 0 {
+			continue
+		}
+		i.serviceEventsOverflowed.Add(
+			ctx, sc.count,
+			metric.WithAttributes(attrs...),
+			metric.WithAttributes(attribute.String(ServiceNameKey, sc.service)),
+		)
+	}
+}
+
 // CleanUp unregisters any registered callback for collecting async
 // measurements.
 func (i *Metrics) CleanUp() error {
-	if i == nil || i.registration == nil {
+	if i == nil {
+		return nil
+	}
+	return i.unregisterCallback()
+}
+
+func (i *Metrics) unregisterCallback() error {
+	if i.registration == nil {
 		return nil
 	}
 	if err := i.registration.Unregister(); err != nil {
 		return fmt.Errorf("failed to unregister callback: %w", err)
 	}
+	i.registration = nil
 	return nil
 }
 
-func (i *Metrics) registerCallback(meter metric.Meter, provider pebbleProvider) (err error) {
-	i.registration, err = meter.RegisterCallback(func(ctx context.Context, obs metric.Observer) error {
-		pm := provider()
-		obs.ObserveInt64(i.pebbleMemtableTotalSize, int64(pm.MemTable.Size))
-		obs.ObserveInt64(i.pebbleTotalDiskUsage, int64(pm.DiskSpaceUsage()))
-
-		obs.ObserveInt64(i.pebbleFlushes, pm.Flush.Count)
-		obs.ObserveInt64(i.pebbleFlushedBytes, int64(pm.Levels[0].BytesFlushed))
-
-		obs.ObserveInt64(i.pebbleCompactions, pm.Compact.Count)
-		obs.ObserveInt64(i.pebblePendingCompaction, int64(pm.Compact.EstimatedDebt))
-		obs.ObserveInt64(i.pebbleMarkedForCompactionFiles, int64(pm.Compact.MarkedFiles))
-
-		obs.ObserveInt64(i.pebbleTableReadersMemEstimate, pm.TableCache.Size)
-		obs.ObserveInt64(i.pebbleKeysTombstones, int64(pm.Keys.TombstoneCount))
+// registerCallback registers the callback observing the metrics,
+// unregistering the callback previously registered by the metrics, if
+// any, so that the metrics are never observed more than once.
+func (i *Metrics) registerCallback(meter metric.Meter) error {
+	if err := i.unregisterCallback(); err != nil {
+		return err
+	}
+	registration, err := i.newCallback(meter)
+	if err != nil {
+		return err
+	}
+	i.registration = registration
+	return nil
+}
 
-		lm := pm.Total()
-		obs.ObserveInt64(i.pebbleNumSSTables, lm.NumFiles)
-		obs.ObserveInt64(i.pebbleIngestedBytes, int64(lm.BytesIngested))
-		obs.ObserveInt64(i.pebbleCompactedBytesRead, int64(lm.BytesRead))
-		obs.ObserveInt64(i.pebbleCompactedBytesWritten, int64(lm.BytesCompacted))
-		obs.ObserveInt64(i.pebbleReadAmplification, int64(lm.Sublevels))
-		return nil
-	},
+func (i *Metrics) newCallback(meter metric.Meter) (metric.Registration, error) {
+	return meter.RegisterCallback(i.observe,
 		i.pebbleMemtableTotalSize,
 		i.pebbleTotalDiskUsage,
 		i.pebbleFlushes,
 		i.pebbleFlushedBytes,
+		i.pebbleFlushDuration,
 		i.pebbleCompactions,
 		i.pebbleIngestedBytes,
 		i.pebbleCompactedBytesRead,
@@ -278,6 +988,291 @@ func (i *Metrics) registerCallback(meter metric.Meter, provider pebbleProvider)
 		i.pebblePendingCompaction,
 		i.pebbleMarkedForCompactionFiles,
 		i.pebbleKeysTombstones,
+		i.pebbleWriteStallCount,
+		i.pebbleWriteStallDuration,
+		i.pebbleCorruptionDetected,
+		i.pebbleLevelNumFiles,
+		i.pebbleLevelScore,
+		i.pebbleBlockCacheHits,
+		i.pebbleBlockCacheMisses,
+		i.pebbleBlockCacheSize,
+		i.pebbleObsoleteNumFiles,
+		i.pebbleObsoleteSize,
+		i.pebbleZombieNumFiles,
+		i.pebbleZombieSize,
+		i.pebbleIteratorsOpen,
+		i.pebbleSnapshotsOpen,
+		i.pebbleCompactionsInProgress,
+		i.pebbleCompactionsInProgressBytes,
+		i.mergesTotal,
+		i.mergesFailed,
+		i.serviceEventsGauge,
+		i.activeCombinedMetrics,
+		i.histogramsMemory,
+		i.secondsSinceLastHarvest,
+		i.mergeBatchKeys,
+		i.mergeBatchBytes,
+		i.overflowEstimatedCardinality,
+		i.overflowActiveBuckets,
 	)
-	return
+}
+
+func (i *Metrics) observe(ctx context.Context, obs metric.Observer) error {
+	if i.serviceEvents != nil {
+		for _, sc := range i.serviceEvents.collect() {
+			obs.ObserveInt64(
+				i.serviceEventsGauge, sc.count,
+				metric.WithAttributes(attribute.String(ServiceNameKey, sc.service)),
+			)
+		}
+	}
+
+	if i.activeCombinedMetricsProvider != nil {
+		for ivl, n := range i.activeCombinedMetricsProvider() {
+			obs.ObserveInt64(
+				i.activeCombinedMetrics, n,
+				metric.WithAttributeSet(AggregationIntervalAttrSet(ivl)),
+			)
+		}
+	}
+	if i.histogramsMemoryProvider != nil {
+		for ivl, n := range i.histogramsMemoryProvider() {
+			obs.ObserveInt64(
+				i.histogramsMemory, n,
+				metric.WithAttributeSet(AggregationIntervalAttrSet(ivl)),
+			)
+		}
+	}
+	if i.secondsSinceLastHarvestProvider != nil {
+		for ivl, n := range i.secondsSinceLastHarvestProvider() {
+			obs.ObserveInt64(
+				i.secondsSinceLastHarvest, n,
+				metric.WithAttributeSet(AggregationIntervalAttrSet(ivl)),
+			)
+		}
+	}
+	if i.mergeBatchProvider != nil {
+		keys, bytes := i.mergeBatchProvider()
+		obs.ObserveInt64(i.mergeBatchKeys, keys)
+		obs.ObserveInt64(i.mergeBatchBytes, bytes)
+	}
+	if i.overflowEstimatedCardinalityProvider != nil {
+		for ivl, byType := range i.overflowEstimatedCardinalityProvider() {
+			for typ, n := range byType {
+				obs.ObserveInt64(
+					i.overflowEstimatedCardinality, n,
+					metric.WithAttributeSet(AggregationIntervalAttrSet(
+						ivl, attribute.String(OverflowTypeKey, typ),
+					)),
+				)
+			}
+		}
+	}
+	if i.overflowActiveBucketsProvider != nil {
+		for ivl, n := range i.overflowActiveBucketsProvider() {
+			obs.ObserveInt64(
+				i.overflowActiveBuckets, n,
+				metric.WithAttributeSet(AggregationIntervalAttrSet(ivl)),
+			)
+		}
+	}
+
+	var errs []error
+	var ctxErr error
+	for _, db := range i.dbs {
+		pm := db.Metrics()
+		if pm == nil {
+			if i.errorOnNilPebbleMetrics {
+				errs = append(errs, db.nilMetricsError())
+			}
+			continue
+		}
+		// The other pebble metrics of the remaining dbs are cheap to
+		// observe, keep observing them once the context is done and
+		// only skip their disk usage.
+		if err := i.observePebbleMetrics(ctx, obs, db, pm); err != nil && ctxErr == nil {
+			ctxErr = err
+		}
+	}
+	return errors.Join(append(errs, ctxErr)...)
+}
+
+// observePebbleMetrics observes the given pebble metrics for the db. The
+// disk usage is observed last, and only if the context is not done, as
+// computing the disk usage can be slow. The context error is returned if
+// the disk usage is not observed.
+func (i *Metrics) observePebbleMetrics(
+	ctx context.Context,
+	obs metric.Observer,
+	db pebbleDB,
+	pm *pebble.Metrics,
+) error {
+	attrs := metric.WithAttributes(db.attrs...)
+	obs.ObserveInt64(i.pebbleMemtableTotalSize, int64(pm.MemTable.Size), attrs)
+
+	obs.ObserveInt64(i.pebbleFlushes, pm.Flush.Count, attrs)
+	obs.ObserveInt64(i.pebbleFlushedBytes, int64(pm.Levels[0].BytesFlushed), attrs)
+	obs.ObserveInt64(i.pebbleFlushDuration, int64(pm.Flush.WriteThroughput.WorkDuration), attrs)
+
+	obs.ObserveInt64(i.pebbleCompactions, pm.Compact.Count, attrs)
+	obs.ObserveInt64(i.pebblePendingCompaction, int64(pm.Compact.EstimatedDebt), attrs)
+	obs.ObserveInt64(i.pebbleMarkedForCompactionFiles, int64(pm.Compact.MarkedFiles), attrs)
+	obs.ObserveInt64(i.pebbleCompactionsInProgress, pm.Compact.NumInProgress, attrs)
+	obs.ObserveInt64(i.pebbleCompactionsInProgressBytes, pm.Compact.InProgressBytes, attrs)
+
+	obs.ObserveInt64(i.pebbleTableReadersMemEstimate, pm.TableCache.Size, attrs)
+	obs.ObserveInt64(i.pebbleBlockCacheHits, pm.BlockCache.Hits, attrs)
+	obs.ObserveInt64(i.pebbleBlockCacheMisses, pm.BlockCache.Misses, attrs)
+	obs.ObserveInt64(i.pebbleBlockCacheSize, pm.BlockCache.Size, attrs)
+	obs.ObserveInt64(i.pebbleKeysTombstones, int64(pm.Keys.TombstoneCount), attrs)
+
+	lm := pm.Total()
+	obs.ObserveInt64(i.pebbleNumSSTables, lm.NumFiles, attrs)
+	obs.ObserveInt64(i.pebbleIngestedBytes, int64(lm.BytesIngested), attrs)
+	obs.ObserveInt64(i.pebbleCompactedBytesRead, int64(lm.BytesRead), attrs)
+	obs.ObserveInt64(i.pebbleCompactedBytesWritten, int64(lm.BytesCompacted), attrs)
+	obs.ObserveInt64(i.pebbleReadAmplification, int64(lm.Sublevels), attrs)
+
+	for level, lm := range pm.Levels {
+		levelAttr := metric.WithAttributes(attribute.Int(levelKey, level))
+		obs.ObserveInt64(i.pebbleLevelNumFiles, lm.NumFiles, attrs, levelAttr)
+		obs.ObserveFloat64(i.pebbleLevelScore, lm.Score, attrs, levelAttr)
+	}
+
+	obs.ObserveInt64(i.pebbleObsoleteNumFiles, pm.Table.ObsoleteCount, attrs)
+	obs.ObserveInt64(i.pebbleObsoleteSize, int64(pm.Table.ObsoleteSize), attrs)
+	obs.ObserveInt64(i.pebbleZombieNumFiles, pm.Table.ZombieCount, attrs)
+	obs.ObserveInt64(i.pebbleZombieSize, int64(pm.Table.ZombieSize), attrs)
+	obs.ObserveInt64(i.pebbleIteratorsOpen, pm.TableIters, attrs)
+	obs.ObserveInt64(i.pebbleSnapshotsOpen, int64(pm.Snapshots.Count), attrs)
+
+	if db.WriteStalls != nil {
+		obs.ObserveInt64(i.pebbleWriteStallCount, db.WriteStalls.Count(), attrs)
+		obs.ObserveInt64(i.pebbleWriteStallDuration, int64(db.WriteStalls.Duration()), attrs)
+	}
+	if db.Corruptions != nil {
+		obs.ObserveInt64(i.pebbleCorruptionDetected, db.Corruptions.Count(), attrs)
+	}
+	if db.Merges != nil {
+		obs.ObserveInt64(i.mergesTotal, db.Merges.Total(), attrs)
+		obs.ObserveInt64(i.mergesFailed, db.Merges.Failed(), attrs)
+	}
+	if i.compactionDeltas != nil {
+		if d, ok := i.compactionDeltas.observe(db.Name, newCompactionTotals(pm)); ok {
+			read := float64(d.bytesRead) / float64(d.count)
+			written := float64(d.bytesWritten) / float64(d.count)
+			for n := int64(0); n < d.count; n++ {
+				i.pebbleCompactionBytesRead.Record(ctx, read, attrs)
+				i.pebbleCompactionBytesWritten.Record(ctx, written, attrs)
+			}
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	obs.ObserveInt64(i.pebbleTotalDiskUsage, int64(pm.DiskSpaceUsage()), attrs)
+	return nil
+}
+
+func newPebbleDBs(dbs []PebbleDB) ([]pebbleDB, error) {
+	names := make(map[string]struct{}, len(dbs))
+	result := make([]pebbleDB, 0, len(dbs))
+	for _, db := range dbs {
+		if db.Metrics == nil {
+			return nil, fmt.Errorf("metrics provider for db %q is nil", db.Name)
+		}
+		if db.Name == "" && len(dbs) > 1 {
+			return nil, errors.New("db name is required when observing multiple dbs")
+		}
+		if _, ok := names[db.Name]; ok {
+			return nil, fmt.Errorf("duplicate db name %q", db.Name)
+		}
+		names[db.Name] = struct{}{}
+
+		var attrs []attribute.KeyValue
+		if db.Name != "" {
+			attrs = append(attrs, attribute.String(DBKey, db.Name))
+		}
+		result = append(result, pebbleDB{PebbleDB: db, attrs: attrs})
+	}
+	return result, nil
+}
+
+func (db pebbleDB) nilMetricsError() error {
+	if db.Name == "" {
+		return ErrNilPebbleMetrics
+	}
+	return fmt.Errorf("db %q: %w", db.Name, ErrNilPebbleMetrics)
+}
+
+// describingMeter wraps a metric.Meter to prefix the names and record
+// the descriptors of all the instruments created using it.
+type describingMeter struct {
+	metric.Meter
+	prefix      string
+	descriptors []InstrumentDescriptor
+}
+
+func (m *describingMeter) Int64Counter(
+	name string, opts ...metric.Int64CounterOption,
+) (metric.Int64Counter, error) {
+	name = m.prefix + name
+	cfg := metric.NewInt64CounterConfig(opts...)
+	m.describe(name, cfg.Description(), cfg.Unit(), InstrumentKindCounter)
+	return m.Meter.Int64Counter(name, opts...)
+}
+
+func (m *describingMeter) Float64Counter(
+	name string, opts ...metric.Float64CounterOption,
+) (metric.Float64Counter, error) {
+	name = m.prefix + name
+	cfg := metric.NewFloat64CounterConfig(opts...)
+	m.describe(name, cfg.Description(), cfg.Unit(), InstrumentKindCounter)
+	return m.Meter.Float64Counter(name, opts...)
+}
+
+func (m *describingMeter) Float64Histogram(
+	name string, opts ...metric.Float64HistogramOption,
+) (metric.Float64Histogram, error) {
+	name = m.prefix + name
+	cfg := metric.NewFloat64HistogramConfig(opts...)
+	m.describe(name, cfg.Description(), cfg.Unit(), InstrumentKindHistogram)
+	return m.Meter.Float64Histogram(name, opts...)
+}
+
+func (m *describingMeter) Int64ObservableCounter(
+	name string, opts ...metric.Int64ObservableCounterOption,
+) (metric.Int64ObservableCounter, error) {
+	name = m.prefix + name
+	cfg := metric.NewInt64ObservableCounterConfig(opts...)
+	m.describe(name, cfg.Description(), cfg.Unit(), InstrumentKindObservableCounter)
+	return m.Meter.Int64ObservableCounter(name, opts...)
+}
+
+func (m *describingMeter) Int64ObservableGauge(
+	name string, opts ...metric.Int64ObservableGaugeOption,
+) (metric.Int64ObservableGauge, error) {
+	name = m.prefix + name
+	cfg := metric.NewInt64ObservableGaugeConfig(opts...)
+	m.describe(name, cfg.Description(), cfg.Unit(), InstrumentKindObservableGauge)
+	return m.Meter.Int64ObservableGauge(name, opts...)
+}
+
+func (m *describingMeter) Float64ObservableGauge(
+	name string, opts ...metric.Float64ObservableGaugeOption,
+) (metric.Float64ObservableGauge, error) {
+	name = m.prefix + name
+	cfg := metric.NewFloat64ObservableGaugeConfig(opts...)
+	m.describe(name, cfg.Description(), cfg.Unit(), InstrumentKindObservableGauge)
+	return m.Meter.Float64ObservableGauge(name, opts...)
+}
+
+func (m *describingMeter) describe(name, description, unit string, kind InstrumentKind) {
+	m.descriptors = append(m.descriptors, InstrumentDescriptor{
+		Name:        name,
+		Description: description,
+		Unit:        unit,
+		Kind:        kind,
+	})
 }
@@ -6,11 +6,17 @@ package telemetry
 
 import (
 	"context"
+	"errors"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/cockroachdb/pebble"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	otelmetric "go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/metric/metricdata"
 	"go.opentelemetry.io/otel/sdk/metric/metricdata/metricdatatest"
@@ -42,6 +48,16 @@ func TestNewInstruments(t *testing.T) {
 				IsMonotonic: true,
 			},
 		},
+		{
+			Name:        "pebble.flush.duration",
+			Description: "Cumulative wall time spent flushing memtables to disk",
+			Unit:        "ns",
+			Data: metricdata.Gauge[int64]{
+				DataPoints: []metricdata.DataPoint[int64]{
+					{Value: 0},
+				},
+			},
+		},
 		{
 			Name:        "pebble.compactions",
 			Description: "Number of table compactions",
@@ -170,12 +186,180 @@ func TestNewInstruments(t *testing.T) {
 				},
 			},
 		},
+		{
+			Name:        "pebble.write-stall.count",
+			Description: "Number of times writes were stalled",
+			Unit:        "1",
+			Data: metricdata.Sum[int64]{
+				DataPoints: []metricdata.DataPoint[int64]{
+					{Value: 0},
+				},
+				Temporality: metricdata.CumulativeTemporality,
+				IsMonotonic: true,
+			},
+		},
+		{
+			Name:        "pebble.write-stall.duration",
+			Description: "Cumulative duration for which writes were stalled",
+			Unit:        "ns",
+			Data: metricdata.Gauge[int64]{
+				DataPoints: []metricdata.DataPoint[int64]{
+					{Value: 0},
+				},
+			},
+		},
+		{
+			Name:        "pebble.corruption.detected",
+			Description: "Number of data corruptions detected, such as checksum mismatches",
+			Unit:        "1",
+			Data: metricdata.Sum[int64]{
+				DataPoints: []metricdata.DataPoint[int64]{
+					{Value: 0},
+				},
+				Temporality: metricdata.CumulativeTemporality,
+				IsMonotonic: true,
+			},
+		},
+		{
+			Name:        "pebble.level.num-files",
+			Description: "Current number of SSTables per level",
+			Unit:        "1",
+			Data: metricdata.Gauge[int64]{
+				DataPoints: levelDataPoints[int64](0, 0, 0, 0, 0, 0, 0),
+			},
+		},
+		{
+			Name:        "pebble.level.score",
+			Description: "Current compaction score per level",
+			Unit:        "1",
+			Data: metricdata.Gauge[float64]{
+				DataPoints: levelDataPoints[float64](0, 0, 0, 0, 0, 0, 0),
+			},
+		},
+		{
+			Name:        "pebble.block-cache.hits",
+			Description: "Number of block cache hits",
+			Unit:        "1",
+			Data: metricdata.Sum[int64]{
+				Temporality: metricdata.CumulativeTemporality,
+				IsMonotonic: true,
+				DataPoints: []metricdata.DataPoint[int64]{
+					{Value: 0},
+				},
+			},
+		},
+		{
+			Name:        "pebble.block-cache.misses",
+			Description: "Number of block cache misses",
+			Unit:        "1",
+			Data: metricdata.Sum[int64]{
+				Temporality: metricdata.CumulativeTemporality,
+				IsMonotonic: true,
+				DataPoints: []metricdata.DataPoint[int64]{
+					{Value: 0},
+				},
+			},
+		},
+		{
+			Name:        "pebble.block-cache.size",
+			Description: "Current size of the block cache in bytes",
+			Unit:        "by",
+			Data: metricdata.Gauge[int64]{
+				DataPoints: []metricdata.DataPoint[int64]{
+					{Value: 0},
+				},
+			},
+		},
+		{
+			Name:        "pebble.obsolete.num-files",
+			Description: "Current number of obsolete SSTables pending deletion",
+			Unit:        "1",
+			Data: metricdata.Gauge[int64]{
+				DataPoints: []metricdata.DataPoint[int64]{
+					{Value: 0},
+				},
+			},
+		},
+		{
+			Name:        "pebble.obsolete.size",
+			Description: "Current size of obsolete SSTables pending deletion",
+			Unit:        "by",
+			Data: metricdata.Gauge[int64]{
+				DataPoints: []metricdata.DataPoint[int64]{
+					{Value: 0},
+				},
+			},
+		},
+		{
+			Name:        "pebble.zombie.num-files",
+			Description: "Current number of SSTables no longer referenced by the db but still in use by iterators",
+			Unit:        "1",
+			Data: metricdata.Gauge[int64]{
+				DataPoints: []metricdata.DataPoint[int64]{
+					{Value: 0},
+				},
+			},
+		},
+		{
+			Name:        "pebble.zombie.size",
+			Description: "Current size of SSTables no longer referenced by the db but still in use by iterators",
+			Unit:        "by",
+			Data: metricdata.Gauge[int64]{
+				DataPoints: []metricdata.DataPoint[int64]{
+					{Value: 0},
+				},
+			},
+		},
+		{
+			Name:        "pebble.iterators.open",
+			Description: "Current number of open SSTable iterators, rising values between harvests indicate leaked iterators",
+			Unit:        "1",
+			Data: metricdata.Gauge[int64]{
+				DataPoints: []metricdata.DataPoint[int64]{
+					{Value: 0},
+				},
+			},
+		},
+		{
+			Name:        "pebble.snapshots.open",
+			Description: "Current number of open snapshots, rising values between harvests indicate leaked snapshots pinning obsolete files",
+			Unit:        "1",
+			Data: metricdata.Gauge[int64]{
+				DataPoints: []metricdata.DataPoint[int64]{
+					{Value: 0},
+				},
+			},
+		},
+		{
+			Name:        "pebble.compactions.in-progress",
+			Description: "Number of compactions in progress",
+			Unit:        "1",
+			Data: metricdata.Gauge[int64]{
+				DataPoints: []metricdata.DataPoint[int64]{
+					{Value: 0},
+				},
+			},
+		},
+		{
+			Name:        "pebble.compactions.in-progress-bytes",
+			Description: "Bytes present in sstables being written by in progress compactions",
+			Unit:        "by",
+			Data: metricdata.Gauge[int64]{
+				DataPoints: []metricdata.DataPoint[int64]{
+					{Value: 0},
+				},
+			},
+		},
 	}
 
 	rdr := metric.NewManualReader()
 	mp := metric.NewMeterProvider(metric.WithReader(rdr))
 	instruments, err := NewMetrics(
-		func() *pebble.Metrics { return &pebble.Metrics{} },
+		[]PebbleDB{{
+			Metrics:     func() *pebble.Metrics { return &pebble.Metrics{} },
+			WriteStalls: &WriteStalls{},
+			Corruptions: &Corruptions{},
+		}},
 		WithMeterProvider(mp),
 	)
 
@@ -191,3 +375,823 @@ func TestNewInstruments(t *testing.T) {
 		metricdatatest.AssertEqual(t, em, sm.Metrics[i], metricdatatest.IgnoreTimestamp())
 	}
 }
+
+func TestAggregationIntervalAttrSet(t *testing.T) {
+	for _, tc := range []struct {
+		ivl      time.Duration
+		attrs    []attribute.KeyValue
+		expected attribute.Set
+	}{
+		{
+			ivl:      time.Second,
+			expected: attribute.NewSet(attribute.String(AggregationIntervalKey, "1s")),
+		},
+		{
+			ivl:      10 * time.Minute,
+			expected: attribute.NewSet(attribute.String(AggregationIntervalKey, "10m")),
+		},
+		{
+			ivl:   time.Hour,
+			attrs: []attribute.KeyValue{attribute.String("id_key", "test")},
+			expected: attribute.NewSet(
+				attribute.String(AggregationIntervalKey, "60m"),
+				attribute.String("id_key", "test"),
+			),
+		},
+	} {
+		assert.Equal(t, tc.expected, AggregationIntervalAttrSet(tc.ivl, tc.attrs...))
+	}
+}
+
+func TestNilPebbleMetrics(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		options     []Option
+		expectedErr error
+	}{
+		{
+			name: "skip",
+		},
+		{
+			name:        "error",
+			options:     []Option{WithErrorOnNilPebbleMetrics()},
+			expectedErr: ErrNilPebbleMetrics,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rdr := metric.NewManualReader()
+			mp := metric.NewMeterProvider(metric.WithReader(rdr))
+			instruments, err := NewMetrics(
+				[]PebbleDB{{Metrics: func() *pebble.Metrics { return nil }}},
+				append(tc.options, WithMeterProvider(mp))...,
+			)
+			require.NoError(t, err)
+			require.NotNil(t, instruments)
+
+			var rm metricdata.ResourceMetrics
+			assert.NotPanics(t, func() {
+				err = rdr.Collect(context.Background(), &rm)
+			})
+			if tc.expectedErr != nil {
+				// The SDK doesn't wrap the errors returned by the callbacks
+				assert.ErrorContains(t, err, tc.expectedErr.Error())
+			} else {
+				assert.NoError(t, err)
+			}
+			// No pebble metrics should be observed
+			for _, sm := range rm.ScopeMetrics {
+				assert.Empty(t, sm.Metrics)
+			}
+		})
+	}
+}
+
+func TestPebbleLevelMetrics(t *testing.T) {
+	rdr := metric.NewManualReader()
+	mp := metric.NewMeterProvider(metric.WithReader(rdr))
+	_, err := NewMetrics(
+		[]PebbleDB{{
+			Metrics: func() *pebble.Metrics {
+				var pm pebble.Metrics
+				for level := range pm.Levels {
+					pm.Levels[level].NumFiles = int64(10 - level)
+					pm.Levels[level].Score = float64(level) / 2
+				}
+				return &pm
+			},
+		}},
+		WithMeterProvider(mp),
+	)
+	require.NoError(t, err)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, rdr.Collect(context.Background(), &rm))
+	require.Len(t, rm.ScopeMetrics, 1)
+	actual := make(map[string]metricdata.Metrics)
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		actual[m.Name] = m
+	}
+	metricdatatest.AssertEqual(t, metricdata.Metrics{
+		Name:        "pebble.level.num-files",
+		Description: "Current number of SSTables per level",
+		Unit:        "1",
+		Data: metricdata.Gauge[int64]{
+			DataPoints: levelDataPoints[int64](10, 9, 8, 7, 6, 5, 4),
+		},
+	}, actual["pebble.level.num-files"], metricdatatest.IgnoreTimestamp())
+	metricdatatest.AssertEqual(t, metricdata.Metrics{
+		Name:        "pebble.level.score",
+		Description: "Current compaction score per level",
+		Unit:        "1",
+		Data: metricdata.Gauge[float64]{
+			DataPoints: levelDataPoints[float64](0, 0.5, 1, 1.5, 2, 2.5, 3),
+		},
+	}, actual["pebble.level.score"], metricdatatest.IgnoreTimestamp())
+}
+
+func TestPebbleCompactionMetrics(t *testing.T) {
+	rdr := metric.NewManualReader()
+	mp := metric.NewMeterProvider(metric.WithReader(rdr))
+	_, err := NewMetrics(
+		[]PebbleDB{{
+			Metrics: func() *pebble.Metrics {
+				var pm pebble.Metrics
+				pm.Compact.NumInProgress = 2
+				pm.Compact.InProgressBytes = 1024
+				return &pm
+			},
+		}},
+		WithMeterProvider(mp),
+	)
+	require.NoError(t, err)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, rdr.Collect(context.Background(), &rm))
+	require.Len(t, rm.ScopeMetrics, 1)
+	actual := make(map[string]metricdata.Metrics)
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		actual[m.Name] = m
+	}
+	metricdatatest.AssertEqual(t, metricdata.Metrics{
+		Name:        "pebble.compactions.in-progress",
+		Description: "Number of compactions in progress",
+		Unit:        "1",
+		Data: metricdata.Gauge[int64]{
+			DataPoints: []metricdata.DataPoint[int64]{{Value: 2}},
+		},
+	}, actual["pebble.compactions.in-progress"], metricdatatest.IgnoreTimestamp())
+	metricdatatest.AssertEqual(t, metricdata.Metrics{
+		Name:        "pebble.compactions.in-progress-bytes",
+		Description: "Bytes present in sstables being written by in progress compactions",
+		Unit:        "by",
+		Data: metricdata.Gauge[int64]{
+			DataPoints: []metricdata.DataPoint[int64]{{Value: 1024}},
+		},
+	}, actual["pebble.compactions.in-progress-bytes"], metricdatatest.IgnoreTimestamp())
+}
+
+func TestPebbleIteratorsOpen(t *testing.T) {
+	rdr := metric.NewManualReader()
+	mp := metric.NewMeterProvider(metric.WithReader(rdr))
+	_, err := NewMetrics(
+		[]PebbleDB{{
+			Metrics: func() *pebble.Metrics {
+				var pm pebble.Metrics
+				pm.TableIters = 7
+				return &pm
+			},
+		}},
+		WithMeterProvider(mp),
+	)
+	require.NoError(t, err)
+
+	metricdatatest.AssertEqual(t, metricdata.Metrics{
+		Name:        "pebble.iterators.open",
+		Description: "Current number of open SSTable iterators, rising values between harvests indicate leaked iterators",
+		Unit:        "1",
+		Data: metricdata.Gauge[int64]{
+			DataPoints: []metricdata.DataPoint[int64]{{Value: 7}},
+		},
+	}, collectMetric(t, rdr, "pebble.iterators.open"), metricdatatest.IgnoreTimestamp())
+}
+
+func TestPebbleSnapshotsOpen(t *testing.T) {
+	rdr := metric.NewManualReader()
+	mp := metric.NewMeterProvider(metric.WithReader(rdr))
+	_, err := NewMetrics(
+		[]PebbleDB{{
+			Metrics: func() *pebble.Metrics {
+				var pm pebble.Metrics
+				pm.Snapshots.Count = 3
+				return &pm
+			},
+		}},
+		WithMeterProvider(mp),
+	)
+	require.NoError(t, err)
+
+	metricdatatest.AssertEqual(t, metricdata.Metrics{
+		Name:        "pebble.snapshots.open",
+		Description: "Current number of open snapshots, rising values between harvests indicate leaked snapshots pinning obsolete files",
+		Unit:        "1",
+		Data: metricdata.Gauge[int64]{
+			DataPoints: []metricdata.DataPoint[int64]{{Value: 3}},
+		},
+	}, collectMetric(t, rdr, "pebble.snapshots.open"), metricdatatest.IgnoreTimestamp())
+}
+
+func TestPebbleCompactionHistograms(t *testing.T) {
+	rdr := metric.NewManualReader()
+	mp := metric.NewMeterProvider(metric.WithReader(rdr))
+	var pm pebble.Metrics
+	_, err := NewMetrics(
+		[]PebbleDB{{Metrics: func() *pebble.Metrics { return &pm }}},
+		WithMeterProvider(mp),
+		WithPebbleCompactionHistograms(true),
+	)
+	require.NoError(t, err)
+
+	// The first observation is the baseline.
+	pm.Compact.Count = 2
+	pm.Levels[1].BytesRead = 200
+	pm.Levels[1].BytesCompacted = 100
+	assert.Empty(t, collectMetric(t, rdr, "pebble.compaction.bytes-read").Name)
+
+	// The average bytes of the compactions completed since the previous
+	// observation are recorded once per compaction.
+	pm.Compact.Count = 5
+	pm.Levels[1].BytesRead = 500
+	pm.Levels[2].BytesRead = 300
+	pm.Levels[1].BytesCompacted = 400
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, rdr.Collect(context.Background(), &rm))
+	histograms := make(map[string]metricdata.HistogramDataPoint[float64])
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if h, ok := m.Data.(metricdata.Histogram[float64]); ok {
+				require.Len(t, h.DataPoints, 1)
+				histograms[m.Name] = h.DataPoints[0]
+			}
+		}
+	}
+	require.Contains(t, histograms, "pebble.compaction.bytes-read")
+	require.Contains(t, histograms, "pebble.compaction.bytes-written")
+	read := histograms["pebble.compaction.bytes-read"]
+	assert.Equal(t, uint64(3), read.Count)
+	assert.Equal(t, float64(600), read.Sum)
+	assert.Equal(t, metricdata.NewExtrema(float64(200)), read.Max)
+	written := histograms["pebble.compaction.bytes-written"]
+	assert.Equal(t, uint64(3), written.Count)
+	assert.Equal(t, float64(300), written.Sum)
+	assert.Equal(t, metricdata.NewExtrema(float64(100)), written.Max)
+}
+
+func TestMergesObserved(t *testing.T) {
+	rdr := metric.NewManualReader()
+	mp := metric.NewMeterProvider(metric.WithReader(rdr))
+	merges := &Merges{}
+	_, err := NewMetrics(
+		[]PebbleDB{{
+			Metrics: func() *pebble.Metrics { return &pebble.Metrics{} },
+			Merges:  merges,
+		}},
+		WithMeterProvider(mp),
+	)
+	require.NoError(t, err)
+	merges.Record(nil)
+	merges.Record(errors.New("failed to unmarshal"))
+
+	metricdatatest.AssertEqual(t, metricdata.Metrics{
+		Name:        "aggregator.merges.total",
+		Description: "Number of merge operations of the pebble value merger, including failed merge operations",
+		Unit:        "1",
+		Data: metricdata.Sum[int64]{
+			DataPoints:  []metricdata.DataPoint[int64]{{Value: 2}},
+			Temporality: metricdata.CumulativeTemporality,
+			IsMonotonic: true,
+		},
+	}, collectMetric(t, rdr, "aggregator.merges.total"), metricdatatest.IgnoreTimestamp())
+	metricdatatest.AssertEqual(t, metricdata.Metrics{
+		Name:        "aggregator.merges.failed",
+		Description: "Number of failed merge operations of the pebble value merger, such as values failing to be decoded",
+		Unit:        "1",
+		Data: metricdata.Sum[int64]{
+			DataPoints:  []metricdata.DataPoint[int64]{{Value: 1}},
+			Temporality: metricdata.CumulativeTemporality,
+			IsMonotonic: true,
+		},
+	}, collectMetric(t, rdr, "aggregator.merges.failed"), metricdatatest.IgnoreTimestamp())
+}
+
+func TestPebbleFlushMetrics(t *testing.T) {
+	rdr := metric.NewManualReader()
+	mp := metric.NewMeterProvider(metric.WithReader(rdr))
+	_, err := NewMetrics(
+		[]PebbleDB{{
+			Metrics: func() *pebble.Metrics {
+				var pm pebble.Metrics
+				pm.Flush.Count = 3
+				pm.Flush.WriteThroughput.Bytes = 4096
+				pm.Flush.WriteThroughput.WorkDuration = 1500 * time.Millisecond
+				pm.Flush.WriteThroughput.IdleDuration = time.Minute
+				return &pm
+			},
+		}},
+		WithMeterProvider(mp),
+	)
+	require.NoError(t, err)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, rdr.Collect(context.Background(), &rm))
+	require.Len(t, rm.ScopeMetrics, 1)
+	actual := make(map[string]metricdata.Metrics)
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		actual[m.Name] = m
+	}
+	metricdatatest.AssertEqual(t, metricdata.Metrics{
+		Name:        "pebble.flush.duration",
+		Description: "Cumulative wall time spent flushing memtables to disk",
+		Unit:        "ns",
+		Data: metricdata.Gauge[int64]{
+			DataPoints: []metricdata.DataPoint[int64]{{Value: int64(1500 * time.Millisecond)}},
+		},
+	}, actual["pebble.flush.duration"], metricdatatest.IgnoreTimestamp())
+}
+
+func TestMultiplePebbleDBs(t *testing.T) {
+	rdr := metric.NewManualReader()
+	mp := metric.NewMeterProvider(metric.WithReader(rdr))
+	newProvider := func(flushes int64) func() *pebble.Metrics {
+		return func() *pebble.Metrics {
+			var pm pebble.Metrics
+			pm.Flush.Count = flushes
+			return &pm
+		}
+	}
+	_, err := NewMetrics(
+		[]PebbleDB{
+			{Name: "1m", Metrics: newProvider(1)},
+			{Name: "10m", Metrics: newProvider(10)},
+		},
+		WithMeterProvider(mp),
+	)
+	require.NoError(t, err)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, rdr.Collect(context.Background(), &rm))
+	require.Len(t, rm.ScopeMetrics, 1)
+	actual := make(map[string]metricdata.Metrics)
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		actual[m.Name] = m
+	}
+	metricdatatest.AssertEqual(t, metricdata.Metrics{
+		Name:        "pebble.flushes",
+		Description: "Number of memtable flushes to disk",
+		Unit:        "1",
+		Data: metricdata.Sum[int64]{
+			Temporality: metricdata.CumulativeTemporality,
+			IsMonotonic: true,
+			DataPoints: []metricdata.DataPoint[int64]{
+				{Attributes: attribute.NewSet(attribute.String(DBKey, "1m")), Value: 1},
+				{Attributes: attribute.NewSet(attribute.String(DBKey, "10m")), Value: 10},
+			},
+		},
+	}, actual["pebble.flushes"], metricdatatest.IgnoreTimestamp())
+	assert.Len(t, actual["pebble.level.num-files"].Data.(metricdata.Gauge[int64]).DataPoints, 14)
+}
+
+func TestNewMetricsInvalidPebbleDBs(t *testing.T) {
+	provider := func() *pebble.Metrics { return &pebble.Metrics{} }
+	for _, tc := range []struct {
+		name string
+		dbs  []PebbleDB
+	}{
+		{
+			name: "nil_provider",
+			dbs:  []PebbleDB{{Name: "1m"}},
+		},
+		{
+			name: "missing_name",
+			dbs:  []PebbleDB{{Name: "1m", Metrics: provider}, {Metrics: provider}},
+		},
+		{
+			name: "duplicate_name",
+			dbs:  []PebbleDB{{Name: "1m", Metrics: provider}, {Name: "1m", Metrics: provider}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewMetrics(tc.dbs, WithMeterProvider(metric.NewMeterProvider()))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func levelDataPoints[N int64 | float64](values ...N) []metricdata.DataPoint[N] {
+	dps := make([]metricdata.DataPoint[N], 0, len(values))
+	for level, v := range values {
+		dps = append(dps, metricdata.DataPoint[N]{
+			Attributes: attribute.NewSet(attribute.Int(levelKey, level)),
+			Value:      v,
+		})
+	}
+	return dps
+}
+
+func TestRequestDurationBuckets(t *testing.T) {
+	rdr := metric.NewManualReader()
+	mp := metric.NewMeterProvider(
+		metric.WithReader(rdr),
+		metric.WithView(RequestDurationView([]float64{0.1, 1})),
+	)
+	instruments, err := NewMetrics(
+		[]PebbleDB{{Metrics: func() *pebble.Metrics { return &pebble.Metrics{} }}},
+		WithMeterProvider(mp),
+	)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	attrs := otelmetric.WithAttributes(attribute.String("id_key", "id"))
+	for _, d := range []float64{0.05, 0.5, 0.6, 5} {
+		instruments.RequestDuration.Record(ctx, d, attrs)
+	}
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, rdr.Collect(ctx, &rm))
+	require.Len(t, rm.ScopeMetrics, 1)
+	var actual metricdata.Metrics
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		if m.Name == "aggregator.requests.duration" {
+			actual = m
+		}
+	}
+	metricdatatest.AssertEqual(t, metricdata.Metrics{
+		Name:        "aggregator.requests.duration",
+		Description: "Time taken to process aggregation requests",
+		Unit:        "s",
+		Data: metricdata.Histogram[float64]{
+			Temporality: metricdata.CumulativeTemporality,
+			DataPoints: []metricdata.HistogramDataPoint[float64]{
+				{
+					Attributes:   attribute.NewSet(attribute.String("id_key", "id")),
+					Count:        4,
+					Bounds:       []float64{0.1, 1},
+					BucketCounts: []uint64{1, 2, 1},
+					Min:          metricdata.NewExtrema(0.05),
+					Max:          metricdata.NewExtrema(5.0),
+					Sum:          6.15,
+				},
+			},
+		},
+	}, actual, metricdatatest.IgnoreTimestamp())
+}
+
+func TestMetricPrefix(t *testing.T) {
+	rdr := metric.NewManualReader()
+	mp := metric.NewMeterProvider(metric.WithReader(rdr))
+	instruments, err := NewMetrics(
+		[]PebbleDB{{Metrics: func() *pebble.Metrics { return &pebble.Metrics{} }}},
+		WithMeterProvider(mp),
+		WithMetricPrefix("hot."),
+	)
+	require.NoError(t, err)
+	instruments.RequestsTotal.Add(context.Background(), 1)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, rdr.Collect(context.Background(), &rm))
+	require.Len(t, rm.ScopeMetrics, 1)
+	var names []string
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		names = append(names, m.Name)
+	}
+	assert.Contains(t, names, "hot.aggregator.requests.total")
+	assert.Contains(t, names, "hot.pebble.flushes")
+	for _, name := range names {
+		assert.True(t, strings.HasPrefix(name, "hot."), name)
+	}
+	for _, d := range instruments.Descriptors() {
+		assert.True(t, strings.HasPrefix(d.Name, "hot."), d.Name)
+	}
+}
+
+func TestDescriptors(t *testing.T) {
+	rdr := metric.NewManualReader()
+	mp := metric.NewMeterProvider(metric.WithReader(rdr))
+	// Enable all the options creating optional instruments.
+	instruments, err := NewMetrics(
+		[]PebbleDB{{Metrics: func() *pebble.Metrics { return &pebble.Metrics{} }}},
+		WithMeterProvider(mp),
+		WithMetricPrefix("test."),
+		WithServiceAttribution(1),
+		WithServiceOverflowAttribution(1),
+		WithPebbleCompactionHistograms(true),
+	)
+	require.NoError(t, err)
+	descriptors := instruments.Descriptors()
+
+	// Cross-check the descriptors against the instrument fields so that
+	// instruments cannot be added without being described.
+	kinds := map[reflect.Type]InstrumentKind{
+		reflect.TypeOf((*otelmetric.Int64Counter)(nil)).Elem():           InstrumentKindCounter,
+		reflect.TypeOf((*otelmetric.Float64Counter)(nil)).Elem():         InstrumentKindCounter,
+		reflect.TypeOf((*otelmetric.Float64Histogram)(nil)).Elem():       InstrumentKindHistogram,
+		reflect.TypeOf((*otelmetric.Int64ObservableCounter)(nil)).Elem(): InstrumentKindObservableCounter,
+		reflect.TypeOf((*otelmetric.Int64ObservableGauge)(nil)).Elem():   InstrumentKindObservableGauge,
+		reflect.TypeOf((*otelmetric.Float64ObservableGauge)(nil)).Elem(): InstrumentKindObservableGauge,
+	}
+	registrationType := reflect.TypeOf((*otelmetric.Registration)(nil)).Elem()
+	expectedKinds := make(map[InstrumentKind]int)
+	v := reflect.ValueOf(instruments).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.Type.PkgPath() != registrationType.PkgPath() || field.Type == registrationType {
+			continue
+		}
+		kind, ok := kinds[field.Type]
+		if !assert.True(t, ok, "unknown instrument type %s of field %s", field.Type, field.Name) {
+			continue
+		}
+		assert.False(t, v.Field(i).IsNil(), "instrument field %s not created", field.Name)
+		expectedKinds[kind]++
+	}
+	actualKinds := make(map[InstrumentKind]int)
+	names := make(map[string]bool, len(descriptors))
+	for _, d := range descriptors {
+		actualKinds[d.Kind]++
+		assert.False(t, names[d.Name], "duplicate descriptor %s", d.Name)
+		names[d.Name] = true
+		assert.True(t, strings.HasPrefix(d.Name, "test."), d.Name)
+		assert.NotEmpty(t, d.Description, d.Name)
+		assert.NotEmpty(t, d.Unit, d.Name)
+	}
+	assert.Equal(t, expectedKinds, actualKinds)
+
+	// All the collected metrics are described.
+	ctx := context.Background()
+	instruments.EventsWeighted.Add(ctx, 1)
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, rdr.Collect(ctx, &rm))
+	require.Len(t, rm.ScopeMetrics, 1)
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		assert.True(t, names[m.Name], "metric %s not described", m.Name)
+	}
+	assert.True(t, names["test.aggregator.events.weighted"])
+}
+
+func TestNewMetricsIndependentCallbacks(t *testing.T) {
+	rdr := metric.NewManualReader()
+	mp := metric.NewMeterProvider(metric.WithReader(rdr))
+	calls := make(map[string]int)
+	newProvider := func(db string, flushes int64) func() *pebble.Metrics {
+		return func() *pebble.Metrics {
+			calls[db]++
+			var pm pebble.Metrics
+			pm.Flush.Count = flushes
+			return &pm
+		}
+	}
+	first, err := NewMetrics(
+		[]PebbleDB{{Name: "first", Metrics: newProvider("first", 1)}},
+		WithMeterProvider(mp),
+	)
+	require.NoError(t, err)
+	second, err := NewMetrics(
+		[]PebbleDB{{Name: "second", Metrics: newProvider("second", 2)}},
+		WithMeterProvider(mp),
+	)
+	require.NoError(t, err)
+
+	// Metrics created with the same meter are all observed.
+	metricdatatest.AssertEqual(t, metricdata.Metrics{
+		Name:        "pebble.flushes",
+		Description: "Number of memtable flushes to disk",
+		Unit:        "1",
+		Data: metricdata.Sum[int64]{
+			Temporality: metricdata.CumulativeTemporality,
+			IsMonotonic: true,
+			DataPoints: []metricdata.DataPoint[int64]{
+				{Attributes: attribute.NewSet(attribute.String(DBKey, "first")), Value: 1},
+				{Attributes: attribute.NewSet(attribute.String(DBKey, "second")), Value: 2},
+			},
+		},
+	}, collectMetric(t, rdr, "pebble.flushes"), metricdatatest.IgnoreTimestamp())
+	assert.Equal(t, map[string]int{"first": 1, "second": 1}, calls)
+
+	// Cleaning up metrics must not affect the other metrics.
+	require.NoError(t, first.CleanUp())
+	collectMetric(t, rdr, "pebble.flushes")
+	assert.Equal(t, map[string]int{"first": 1, "second": 2}, calls)
+	assert.NoError(t, second.CleanUp())
+}
+
+func TestRegisterCallbackReplacesOwnCallback(t *testing.T) {
+	rdr := metric.NewManualReader()
+	mp := metric.NewMeterProvider(metric.WithReader(rdr))
+	var calls int
+	m, err := NewMetrics(
+		[]PebbleDB{{Metrics: func() *pebble.Metrics {
+			calls++
+			return &pebble.Metrics{}
+		}}},
+		WithMeterProvider(mp),
+	)
+	require.NoError(t, err)
+	defer m.CleanUp()
+
+	// Registering the callback again replaces the previous callback of
+	// the metrics, observing the metrics once per collection.
+	require.NoError(t, m.registerCallback(newConfig(WithMeterProvider(mp)).Meter))
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, rdr.Collect(context.Background(), &rm))
+	assert.Equal(t, 1, calls)
+}
+
+func TestActiveCombinedMetrics(t *testing.T) {
+	rdr := metric.NewManualReader()
+	mp := metric.NewMeterProvider(metric.WithReader(rdr))
+	_, err := NewMetrics(
+		[]PebbleDB{{Metrics: func() *pebble.Metrics { return &pebble.Metrics{} }}},
+		WithMeterProvider(mp),
+		WithActiveCombinedMetrics(func() map[time.Duration]int64 {
+			return map[time.Duration]int64{time.Minute: 5, time.Hour: 2}
+		}),
+	)
+	require.NoError(t, err)
+
+	metricdatatest.AssertEqual(t, metricdata.Metrics{
+		Name:        "aggregator.combined-metrics.active",
+		Description: "Current number of distinct combined metrics aggregated but not yet harvested per aggregation interval",
+		Unit:        "1",
+		Data: metricdata.Gauge[int64]{
+			DataPoints: []metricdata.DataPoint[int64]{
+				{Attributes: AggregationIntervalAttrSet(time.Minute), Value: 5},
+				{Attributes: AggregationIntervalAttrSet(time.Hour), Value: 2},
+			},
+		},
+	}, collectMetric(t, rdr, "aggregator.combined-metrics.active"), metricdatatest.IgnoreTimestamp())
+}
+
+func TestHistogramsMemory(t *testing.T) {
+	rdr := metric.NewManualReader()
+	mp := metric.NewMeterProvider(metric.WithReader(rdr))
+	_, err := NewMetrics(
+		[]PebbleDB{{Metrics: func() *pebble.Metrics { return &pebble.Metrics{} }}},
+		WithMeterProvider(mp),
+		WithHistogramsMemory(func() map[time.Duration]int64 {
+			return map[time.Duration]int64{time.Minute: 1024, time.Hour: 512}
+		}),
+	)
+	require.NoError(t, err)
+
+	metricdatatest.AssertEqual(t, metricdata.Metrics{
+		Name:        "aggregator.histograms.memory",
+		Description: "Estimated memory held by the latency histograms of the combined metrics not yet harvested per aggregation interval",
+		Unit:        "by",
+		Data: metricdata.Gauge[int64]{
+			DataPoints: []metricdata.DataPoint[int64]{
+				{Attributes: AggregationIntervalAttrSet(time.Minute), Value: 1024},
+				{Attributes: AggregationIntervalAttrSet(time.Hour), Value: 512},
+			},
+		},
+	}, collectMetric(t, rdr, "aggregator.histograms.memory"), metricdatatest.IgnoreTimestamp())
+}
+
+func TestSecondsSinceLastHarvest(t *testing.T) {
+	rdr := metric.NewManualReader()
+	mp := metric.NewMeterProvider(metric.WithReader(rdr))
+	_, err := NewMetrics(
+		[]PebbleDB{{Metrics: func() *pebble.Metrics { return &pebble.Metrics{} }}},
+		WithMeterProvider(mp),
+		WithSecondsSinceLastHarvest(func() map[time.Duration]int64 {
+			return map[time.Duration]int64{time.Minute: 30, time.Hour: 1800}
+		}),
+	)
+	require.NoError(t, err)
+
+	metricdatatest.AssertEqual(t, metricdata.Metrics{
+		Name:        "aggregator.harvest.seconds-since-last",
+		Description: "Seconds since the last successful harvest per aggregation interval, rising values indicate stalled harvests",
+		Unit:        "s",
+		Data: metricdata.Gauge[int64]{
+			DataPoints: []metricdata.DataPoint[int64]{
+				{Attributes: AggregationIntervalAttrSet(time.Minute), Value: 30},
+				{Attributes: AggregationIntervalAttrSet(time.Hour), Value: 1800},
+			},
+		},
+	}, collectMetric(t, rdr, "aggregator.harvest.seconds-since-last"), metricdatatest.IgnoreTimestamp())
+}
+
+func TestMergeBatch(t *testing.T) {
+	rdr := metric.NewManualReader()
+	mp := metric.NewMeterProvider(metric.WithReader(rdr))
+	_, err := NewMetrics(
+		[]PebbleDB{{Metrics: func() *pebble.Metrics { return &pebble.Metrics{} }}},
+		WithMeterProvider(mp),
+		WithMergeBatch(func() (int64, int64) { return 3, 1024 }),
+	)
+	require.NoError(t, err)
+
+	metricdatatest.AssertEqual(t, metricdata.Metrics{
+		Name:        "aggregator.merge-batch.keys",
+		Description: "Number of combined metrics keys buffered by the merge batch",
+		Unit:        "1",
+		Data: metricdata.Gauge[int64]{
+			DataPoints: []metricdata.DataPoint[int64]{{Value: 3}},
+		},
+	}, collectMetric(t, rdr, "aggregator.merge-batch.keys"), metricdatatest.IgnoreTimestamp())
+	metricdatatest.AssertEqual(t, metricdata.Metrics{
+		Name:        "aggregator.merge-batch.bytes",
+		Description: "Encoded size of the aggregations buffered by the merge batch",
+		Unit:        "by",
+		Data: metricdata.Gauge[int64]{
+			DataPoints: []metricdata.DataPoint[int64]{{Value: 1024}},
+		},
+	}, collectMetric(t, rdr, "aggregator.merge-batch.bytes"), metricdatatest.IgnoreTimestamp())
+}
+
+func TestOverflowEstimatedCardinality(t *testing.T) {
+	rdr := metric.NewManualReader()
+	mp := metric.NewMeterProvider(metric.WithReader(rdr))
+	_, err := NewMetrics(
+		[]PebbleDB{{Metrics: func() *pebble.Metrics { return &pebble.Metrics{} }}},
+		WithMeterProvider(mp),
+		WithOverflowEstimatedCardinality(func() map[time.Duration]map[string]int64 {
+			return map[time.Duration]map[string]int64{
+				time.Minute: {"service": 3, "transaction": 100},
+				time.Hour:   {"service": 0},
+			}
+		}),
+	)
+	require.NoError(t, err)
+
+	attrs := func(ivl time.Duration, typ string) attribute.Set {
+		return AggregationIntervalAttrSet(ivl, attribute.String(OverflowTypeKey, typ))
+	}
+	metricdatatest.AssertEqual(t, metricdata.Metrics{
+		Name:        "aggregator.overflow.estimated-cardinality",
+		Description: "Estimated number of distinct aggregation keys folded into the overflow buckets by the last harvest per aggregation interval and overflow type",
+		Unit:        "1",
+		Data: metricdata.Gauge[int64]{
+			DataPoints: []metricdata.DataPoint[int64]{
+				{Attributes: attrs(time.Minute, "service"), Value: 3},
+				{Attributes: attrs(time.Minute, "transaction"), Value: 100},
+				{Attributes: attrs(time.Hour, "service"), Value: 0},
+			},
+		},
+	}, collectMetric(t, rdr, "aggregator.overflow.estimated-cardinality"), metricdatatest.IgnoreTimestamp())
+}
+
+func TestObserveCancelledContext(t *testing.T) {
+	provider := func() *pebble.Metrics { return &pebble.Metrics{} }
+	instruments, err := NewMetrics(
+		[]PebbleDB{
+			{Name: "db1", Metrics: provider},
+			{Name: "db2", Metrics: provider},
+		},
+		WithMeterProvider(metric.NewMeterProvider()),
+	)
+	require.NoError(t, err)
+
+	count := func(obs *recordingObserver, o otelmetric.Observable) int {
+		var n int
+		for _, observed := range obs.observed {
+			if observed == o {
+				n++
+			}
+		}
+		return n
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	obs := &recordingObserver{}
+	err = instruments.observe(ctx, obs)
+	// The context error is only returned once, and only the disk usage
+	// is skipped for all the dbs.
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.EqualError(t, err, context.Canceled.Error())
+	assert.Zero(t, count(obs, instruments.pebbleTotalDiskUsage))
+	assert.Equal(t, 2, count(obs, instruments.pebbleFlushes))
+	assert.Equal(t, 2, count(obs, instruments.pebbleBlockCacheSize))
+
+	obs = &recordingObserver{}
+	assert.NoError(t, instruments.observe(context.Background(), obs))
+	assert.Equal(t, 2, count(obs, instruments.pebbleTotalDiskUsage))
+}
+
+// recordingObserver records the instruments observed by a callback.
+type recordingObserver struct {
+	otelmetric.Observer
+	observed []otelmetric.Observable
+}
+
+func (o *recordingObserver) ObserveInt64(obsrv otelmetric.Int64Observable, _ int64, _ ...otelmetric.ObserveOption) {
+	o.observed = append(o.observed, obsrv)
+}
+
+func (o *recordingObserver) ObserveFloat64(obsrv otelmetric.Float64Observable, _ float64, _ ...otelmetric.ObserveOption) {
+	o.observed = append(o.observed, obsrv)
+}
+
+func TestOverflowActiveBuckets(t *testing.T) {
+	rdr := metric.NewManualReader()
+	mp := metric.NewMeterProvider(metric.WithReader(rdr))
+	_, err := NewMetrics(
+		[]PebbleDB{{Metrics: func() *pebble.Metrics { return &pebble.Metrics{} }}},
+		WithMeterProvider(mp),
+		WithOverflowActiveBuckets(func() map[time.Duration]int64 {
+			return map[time.Duration]int64{time.Minute: 4, time.Hour: 0}
+		}),
+	)
+	require.NoError(t, err)
+
+	metricdatatest.AssertEqual(t, metricdata.Metrics{
+		Name:        "aggregator.overflow.active-buckets",
+		Description: "Current number of distinct overflow buckets across the services of the combined metrics not yet harvested per aggregation interval, rising values indicate widespread overflow",
+		Unit:        "1",
+		Data: metricdata.Gauge[int64]{
+			DataPoints: []metricdata.DataPoint[int64]{
+				{Attributes: AggregationIntervalAttrSet(time.Minute), Value: 4},
+				{Attributes: AggregationIntervalAttrSet(time.Hour), Value: 0},
+			},
+		},
+	}, collectMetric(t, rdr, "aggregator.overflow.active-buckets"), metricdatatest.IgnoreTimestamp())
+}
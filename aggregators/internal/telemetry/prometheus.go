@@ -0,0 +1,79 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package telemetry
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	otelprom "go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+// PrometheusBridge exposes the measurements recorded using its meter
+// provider to a prometheus registry using the OpenTelemetry prometheus
+// exporter. Measurements are collected from the meter provider on every
+// scrape which also runs the callback observing the asynchronous pebble
+// measurements.
+//
+// Metric names and attributes are converted to prometheus metric and
+// label names by the exporter, monotonic counters are suffixed with
+// `_total`. The `.total` suffix of the counter names is trimmed so that
+// it is not repeated, for example, `aggregator.requests.total` is exposed
+// as `aggregator_requests_total`. The units are not appended to the metric names and the
+// instrumentation scope is not added as labels, so that the metric names
+// and labels match the aggregator telemetry.
+type PrometheusBridge struct {
+	meterProvider *sdkmetric.MeterProvider
+}
+
+// NewPrometheusBridge returns a new PrometheusBridge registered with the
+// given registerer. The meter provider returned by the MeterProvider
+// method must be used to create the metrics to be exposed, see
+// WithMeterProvider. The given options are used to configure the meter
+// provider, for example, to register views.
+func NewPrometheusBridge(reg prometheus.Registerer, opts ...sdkmetric.Option) (*PrometheusBridge, error) {
+	exporter, err := otelprom.New(
+		otelprom.WithRegisterer(reg),
+		otelprom.WithoutUnits(),
+		otelprom.WithoutScopeInfo(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create prometheus exporter: %w", err)
+	}
+	opts = append(opts,
+		sdkmetric.WithReader(exporter),
+		sdkmetric.WithView(trimTotalSuffixView),
+	)
+	return &PrometheusBridge{
+		meterProvider: sdkmetric.NewMeterProvider(opts...),
+	}, nil
+}
+
+// MeterProvider returns the meter provider backing the bridge.
+func (b *PrometheusBridge) MeterProvider() metric.MeterProvider {
+	return b.meterProvider
+}
+
+// trimTotalSuffixView renames the monotonic counters with a `.total` suffix
+// as the prometheus exporter adds the `_total` suffix to all of them.
+func trimTotalSuffixView(inst sdkmetric.Instrument) (sdkmetric.Stream, bool) {
+	switch inst.Kind {
+	case sdkmetric.InstrumentKindCounter, sdkmetric.InstrumentKindObservableCounter:
+	default:
+		return sdkmetric.Stream{}, false
+	}
+	name, ok := strings.CutSuffix(inst.Name, ".total")
+	if !ok {
+		return sdkmetric.Stream{}, false
+	}
+	return sdkmetric.Stream{
+		Name:        name,
+		Description: inst.Description,
+		Unit:        inst.Unit,
+	}, true
+}
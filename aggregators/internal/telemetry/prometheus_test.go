@@ -0,0 +1,107 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package telemetry
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+func TestPrometheusBridge(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	bridge, err := NewPrometheusBridge(registry)
+	require.NoError(t, err)
+
+	metrics, err := NewMetrics(
+		[]PebbleDB{{
+			Metrics: func() *pebble.Metrics {
+				var pm pebble.Metrics
+				pm.Flush.Count = 2
+				pm.Keys.TombstoneCount = 5
+				return &pm
+			},
+			WriteStalls: &WriteStalls{},
+			Corruptions: &Corruptions{},
+		}},
+		WithMeterProvider(bridge.MeterProvider()),
+	)
+	require.NoError(t, err)
+	metrics.RequestsTotal.Add(context.Background(), 3, metric.WithAttributes(
+		attribute.String(AggregationIntervalKey, "1m"),
+	))
+
+	mfs, err := registry.Gather()
+	require.NoError(t, err)
+	scraped := make(map[string]*dto.MetricFamily, len(mfs))
+	for _, mf := range mfs {
+		scraped[mf.GetName()] = mf
+	}
+
+	// The pebble series are observed on scrape.
+	for _, name := range []string{
+		"pebble_flushes_total",
+		"pebble_flushed_bytes_total",
+		"pebble_compactions_total",
+		"pebble_ingested_bytes_total",
+		"pebble_compacted_bytes_read_total",
+		"pebble_compacted_bytes_written_total",
+		"pebble_memtable_total_size",
+		"pebble_disk_usage",
+		"pebble_read_amplification",
+		"pebble_num_sstables",
+		"pebble_table_readers_mem_estimate",
+		"pebble_estimated_pending_compaction",
+		"pebble_marked_for_compaction_files",
+		"pebble_keys_tombstone_count",
+	} {
+		require.Contains(t, scraped, name)
+		assert.NotEmpty(t, scraped[name].GetMetric(), name)
+	}
+	assert.Equal(t, float64(2), scraped["pebble_flushes_total"].GetMetric()[0].GetCounter().GetValue())
+	assert.Equal(t, float64(5), scraped["pebble_keys_tombstone_count"].GetMetric()[0].GetGauge().GetValue())
+
+	requests := scraped["aggregator_requests_total"]
+	require.NotNil(t, requests)
+	require.Len(t, requests.GetMetric(), 1)
+	assert.Equal(t, dto.MetricType_COUNTER, requests.GetType())
+	assert.Equal(t, float64(3), requests.GetMetric()[0].GetCounter().GetValue())
+	require.Len(t, requests.GetMetric()[0].GetLabel(), 1)
+	assert.Equal(t, "aggregation_interval", requests.GetMetric()[0].GetLabel()[0].GetName())
+	assert.Equal(t, "1m", requests.GetMetric()[0].GetLabel()[0].GetValue())
+}
+
+func TestPrometheusBridgeInvalidNames(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	bridge, err := NewPrometheusBridge(registry)
+	require.NoError(t, err)
+
+	// Metric names starting with a digit, and attributes sanitized to the
+	// same label, do not fail the scrape.
+	counter, err := bridge.MeterProvider().Meter("test").Int64Counter("1m.requests")
+	require.NoError(t, err)
+	counter.Add(context.Background(), 1, metric.WithAttributes(
+		attribute.String("a.b", "1"),
+		attribute.String("a_b", "2"),
+	))
+	mfs, err := registry.Gather()
+	require.NoError(t, err)
+	var found bool
+	for _, mf := range mfs {
+		if mf.GetName() == "_1m_requests_total" {
+			found = true
+			require.Len(t, mf.GetMetric(), 1)
+			assert.Equal(t, float64(1), mf.GetMetric()[0].GetCounter().GetValue())
+		}
+	}
+	assert.True(t, found)
+}
@@ -0,0 +1,80 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package telemetry
+
+import (
+	"sort"
+	"sync"
+)
+
+// ServiceNameKey is the attribute key used to identify the service of
+// the per service measurements, see WithServiceAttribution.
+const ServiceNameKey = "service_name"
+
+// OtherServiceName is the service name used to report the events of all
+// the services which are not in the top N services.
+const OtherServiceName = "_other"
+
+// serviceEvents tracks the number of events per service between two
+// collections. Only the top N services are reported on collection, the
+// events of the remaining services are reported under OtherServiceName.
+type serviceEvents struct {
+	topN int
+
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+type serviceEventCount struct {
+	service string
+	count   int64
+}
+
+func newServiceEvents(topN int) *serviceEvents {
+	return &serviceEvents{
+		topN:   topN,
+		counts: make(map[string]int64),
+	}
+}
+
+func (s *serviceEvents) add(service string, n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts[service] += n
+}
+
+// collect returns the top N services along with the bucketed remaining
+// services and resets the tracked counts.
+func (s *serviceEvents) collect() []serviceEventCount {
+	s.mu.Lock()
+	counts := s.counts
+	s.counts = make(map[string]int64, len(counts))
+	s.mu.Unlock()
+	return topServices(counts, s.topN)
+}
+
+// topServices returns the n services with the highest counts, ordered by
+// count and then by name, followed by the sum of the counts of all the
+// remaining services reported as OtherServiceName, if any.
+func topServices(counts map[string]int64, n int) []serviceEventCount {
+	all := make([]serviceEventCount, 0, len(counts))
+	for service, count := range counts {
+		all = append(all, serviceEventCount{service: service, count: count})
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].count != all[j].count {
+			return all[i].count > all[j].count
+		}
+		return all[i].service < all[j].service
+	})
+	if len(all) <= n {
+		return all
+	}
+	other := serviceEventCount{service: OtherServiceName}
+	for _, sc := range all[n:] {
+		other.count += sc.count
+	}
+	return append(all[:n], other)
+}
@@ -0,0 +1,197 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package telemetry
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata/metricdatatest"
+)
+
+func TestTopServices(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		counts   map[string]int64
+		n        int
+		expected []serviceEventCount
+	}{
+		{
+			name:     "empty",
+			counts:   map[string]int64{},
+			n:        2,
+			expected: []serviceEventCount{},
+		},
+		{
+			name:   "less_than_n",
+			counts: map[string]int64{"svc1": 1, "svc2": 5},
+			n:      3,
+			expected: []serviceEventCount{
+				{service: "svc2", count: 5},
+				{service: "svc1", count: 1},
+			},
+		},
+		{
+			name:   "exactly_n",
+			counts: map[string]int64{"svc1": 1, "svc2": 5},
+			n:      2,
+			expected: []serviceEventCount{
+				{service: "svc2", count: 5},
+				{service: "svc1", count: 1},
+			},
+		},
+		{
+			name:   "overflow_to_other",
+			counts: map[string]int64{"svc1": 1, "svc2": 5, "svc3": 3, "svc4": 2},
+			n:      2,
+			expected: []serviceEventCount{
+				{service: "svc2", count: 5},
+				{service: "svc3", count: 3},
+				{service: OtherServiceName, count: 3},
+			},
+		},
+		{
+			name:   "ties_ordered_by_name",
+			counts: map[string]int64{"svc3": 2, "svc1": 2, "svc2": 2},
+			n:      2,
+			expected: []serviceEventCount{
+				{service: "svc1", count: 2},
+				{service: "svc2", count: 2},
+				{service: OtherServiceName, count: 2},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, topServices(tc.counts, tc.n))
+		})
+	}
+}
+
+func TestServiceAttribution(t *testing.T) {
+	rdr := metric.NewManualReader()
+	mp := metric.NewMeterProvider(metric.WithReader(rdr))
+	instruments, err := NewMetrics(
+		[]PebbleDB{{Metrics: func() *pebble.Metrics { return &pebble.Metrics{} }}},
+		WithMeterProvider(mp),
+		WithServiceAttribution(1),
+	)
+	require.NoError(t, err)
+
+	instruments.AddServiceEvents("svc1", 3)
+	instruments.AddServiceEvents("svc2", 10)
+	instruments.AddServiceEvents("svc3", 1)
+	instruments.AddServiceEvents("svc1", 2)
+
+	expected := metricdata.Metrics{
+		Name:        "aggregator.service.events",
+		Description: "APM Events requested for aggregation since the last collection for the top services",
+		Unit:        "1",
+		Data: metricdata.Gauge[int64]{
+			DataPoints: []metricdata.DataPoint[int64]{
+				{
+					Attributes: attribute.NewSet(attribute.String(ServiceNameKey, "svc2")),
+					Value:      10,
+				},
+				{
+					Attributes: attribute.NewSet(attribute.String(ServiceNameKey, OtherServiceName)),
+					Value:      6,
+				},
+			},
+		},
+	}
+	metricdatatest.AssertEqual(t, expected, collectMetric(t, rdr, expected.Name), metricdatatest.IgnoreTimestamp())
+
+	// Counts are reset on collection
+	assert.Equal(t, metricdata.Metrics{}, collectMetric(t, rdr, expected.Name))
+}
+
+func TestServiceAttributionDisabled(t *testing.T) {
+	rdr := metric.NewManualReader()
+	mp := metric.NewMeterProvider(metric.WithReader(rdr))
+	instruments, err := NewMetrics(
+		[]PebbleDB{{Metrics: func() *pebble.Metrics { return &pebble.Metrics{} }}},
+		WithMeterProvider(mp),
+	)
+	require.NoError(t, err)
+
+	instruments.AddServiceEvents("svc1", 3)
+	assert.Equal(t, metricdata.Metrics{}, collectMetric(t, rdr, "aggregator.service.events"))
+}
+
+func TestServiceOverflowAttribution(t *testing.T) {
+	rdr := metric.NewManualReader()
+	mp := metric.NewMeterProvider(metric.WithReader(rdr))
+	instruments, err := NewMetrics(
+		[]PebbleDB{{Metrics: func() *pebble.Metrics { return &pebble.Metrics{} }}},
+		WithMeterProvider(mp),
+		WithServiceOverflowAttribution(1),
+	)
+	require.NoError(t, err)
+
+	typeAttr := attribute.String(OverflowTypeKey, "transaction")
+	instruments.AddServiceOverflows(context.Background(), map[string]int64{
+		"svc1": 3,
+		"svc2": 10,
+		"svc3": 1,
+	}, typeAttr)
+	instruments.AddServiceOverflows(context.Background(), map[string]int64{
+		"svc2": 5,
+		"svc4": 0,
+	}, typeAttr)
+
+	expected := metricdata.Metrics{
+		Name:        "aggregator.overflow.per-service",
+		Description: "APM Events aggregated into the overflow buckets of the top services per overflow type",
+		Unit:        "1",
+		Data: metricdata.Sum[int64]{
+			Temporality: metricdata.CumulativeTemporality,
+			IsMonotonic: true,
+			DataPoints: []metricdata.DataPoint[int64]{
+				{
+					Attributes: attribute.NewSet(typeAttr, attribute.String(ServiceNameKey, "svc2")),
+					Value:      15,
+				},
+				{
+					Attributes: attribute.NewSet(typeAttr, attribute.String(ServiceNameKey, OtherServiceName)),
+					Value:      4,
+				},
+			},
+		},
+	}
+	metricdatatest.AssertEqual(t, expected, collectMetric(t, rdr, expected.Name), metricdatatest.IgnoreTimestamp())
+}
+
+func TestServiceOverflowAttributionDisabled(t *testing.T) {
+	rdr := metric.NewManualReader()
+	mp := metric.NewMeterProvider(metric.WithReader(rdr))
+	instruments, err := NewMetrics(
+		[]PebbleDB{{Metrics: func() *pebble.Metrics { return &pebble.Metrics{} }}},
+		WithMeterProvider(mp),
+	)
+	require.NoError(t, err)
+
+	instruments.AddServiceOverflows(context.Background(), map[string]int64{"svc1": 3})
+	assert.Equal(t, metricdata.Metrics{}, collectMetric(t, rdr, "aggregator.overflow.per-service"))
+}
+
+func collectMetric(t *testing.T, rdr metric.Reader, name string) metricdata.Metrics {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, rdr.Collect(context.Background(), &rm))
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name == name {
+				return m
+			}
+		}
+	}
+	return metricdata.Metrics{}
+}
@@ -0,0 +1,83 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package telemetry
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// WriteStalls tracks the write stalls of a pebble database. Write stalls
+// are not reported as part of pebble.Metrics, instead they are tracked
+// using the write stall events published to a pebble.EventListener.
+// WriteStalls is safe for concurrent use and the zero value is ready
+// to be used.
+type WriteStalls struct {
+	count    atomic.Int64
+	duration atomic.Int64
+	// stalledAt is the unix nano time at which the ongoing write
+	// stall started, 0 if writes are not stalled.
+	stalledAt atomic.Int64
+}
+
+// EventListener returns a pebble.EventListener which records write
+// stalls. The returned listener should be configured in the pebble
+// options used to open the database.
+func (w *WriteStalls) EventListener() *pebble.EventListener {
+	return &pebble.EventListener{
+		WriteStallBegin: func(pebble.WriteStallBeginInfo) {
+			w.begin(time.Now())
+		},
+		WriteStallEnd: func() {
+			w.end(time.Now())
+		},
+	}
+}
+
+// Count returns the number of write stalls since the database was opened.
+func (w *WriteStalls) Count() int64 {
+	return w.count.Load()
+}
+
+// Duration returns the cumulative duration of all the write stalls since
+// the database was opened, including the ongoing write stall, if any.
+func (w *WriteStalls) Duration() time.Duration {
+	return w.durationAt(time.Now())
+}
+
+// Current returns the duration of the ongoing write stall, 0 if writes
+// are not stalled.
+func (w *WriteStalls) Current() time.Duration {
+	return w.currentAt(time.Now())
+}
+
+func (w *WriteStalls) begin(now time.Time) {
+	if w.stalledAt.CompareAndSwap(0, now.UnixNano()) {
+		w.count.Add(1)
+	}
+}
+
+func (w *WriteStalls) end(now time.Time) {
+	if stalledAt := w.stalledAt.Swap(0); stalledAt > 0 {
+		w.duration.Add(now.UnixNano() - stalledAt)
+	}
+}
+
+func (w *WriteStalls) durationAt(now time.Time) time.Duration {
+	d := w.duration.Load()
+	if stalledAt := w.stalledAt.Load(); stalledAt > 0 {
+		d += now.UnixNano() - stalledAt
+	}
+	return time.Duration(d)
+}
+
+func (w *WriteStalls) currentAt(now time.Time) time.Duration {
+	if stalledAt := w.stalledAt.Load(); stalledAt > 0 {
+		return time.Duration(now.UnixNano() - stalledAt)
+	}
+	return 0
+}
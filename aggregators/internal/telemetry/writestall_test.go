@@ -0,0 +1,41 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package telemetry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteStalls(t *testing.T) {
+	var ws WriteStalls
+	now := time.Now()
+
+	assert.Equal(t, int64(0), ws.Count())
+	assert.Equal(t, time.Duration(0), ws.durationAt(now))
+	assert.Equal(t, time.Duration(0), ws.currentAt(now))
+
+	ws.begin(now)
+	// Duplicate begin events for an ongoing stall are ignored
+	ws.begin(now.Add(time.Second))
+	assert.Equal(t, int64(1), ws.Count())
+	// Ongoing stall is accounted in the duration
+	assert.Equal(t, 2*time.Second, ws.durationAt(now.Add(2*time.Second)))
+	assert.Equal(t, 2*time.Second, ws.currentAt(now.Add(2*time.Second)))
+
+	ws.end(now.Add(3 * time.Second))
+	// End events without a stall are ignored
+	ws.end(now.Add(4 * time.Second))
+	assert.Equal(t, int64(1), ws.Count())
+	assert.Equal(t, 3*time.Second, ws.durationAt(now.Add(5*time.Second)))
+	assert.Equal(t, time.Duration(0), ws.currentAt(now.Add(5*time.Second)))
+
+	ws.begin(now.Add(10 * time.Second))
+	ws.end(now.Add(12 * time.Second))
+	assert.Equal(t, int64(2), ws.Count())
+	assert.Equal(t, 5*time.Second, ws.durationAt(now.Add(20*time.Second)))
+}
@@ -0,0 +1,33 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// harvestJitter calculates the offset of the harvests to spread the
+// harvests of multiple aggregators over time. The offset for a harvest
+// is derived from the seed and the harvest time, thus, the offsets are
+// the same across restarts for aggregators using the same seed.
+type harvestJitter struct {
+	max  time.Duration
+	seed int64
+}
+
+// offset returns the jitter, in [0, max), for the harvest at the given
+// time. Returns 0 if jitter is disabled.
+func (j harvestJitter) offset(t time.Time) time.Duration {
+	if j.max <= 0 {
+		return 0
+	}
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(j.seed))
+	binary.BigEndian.PutUint64(buf[8:], uint64(t.UnixNano()))
+	return time.Duration(xxhash.Sum64(buf[:]) % uint64(j.max))
+}
@@ -0,0 +1,37 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHarvestJitter(t *testing.T) {
+	start := time.Unix(0, 0).Add(time.Hour)
+	t.Run("disabled", func(t *testing.T) {
+		j := harvestJitter{seed: 1}
+		assert.Zero(t, j.offset(start))
+	})
+	t.Run("within_window", func(t *testing.T) {
+		j := harvestJitter{max: 10 * time.Second, seed: 1}
+		offsets := make(map[time.Duration]struct{})
+		for i := 0; i < 1000; i++ {
+			offset := j.offset(start.Add(time.Duration(i) * time.Minute))
+			assert.GreaterOrEqual(t, offset, time.Duration(0))
+			assert.Less(t, offset, 10*time.Second)
+			offsets[offset] = struct{}{}
+		}
+		assert.Greater(t, len(offsets), 1)
+	})
+	t.Run("deterministic", func(t *testing.T) {
+		j1 := harvestJitter{max: time.Minute, seed: 1}
+		j2 := harvestJitter{max: time.Minute, seed: 2}
+		assert.Equal(t, j1.offset(start), harvestJitter{max: time.Minute, seed: 1}.offset(start))
+		assert.NotEqual(t, j1.offset(start), j2.offset(start))
+	})
+}
@@ -0,0 +1,401 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+)
+
+var errMapStoreClosed = errors.New("map store is closed")
+
+// mapStore is a Store keeping the keys in memory, in a map, for example,
+// for small deployments which do not need the aggregated metrics to
+// survive restarts. The values are merged when written, thus, merge
+// failures are returned by the writes rather than by the reads.
+//
+// Every committed batch is assigned a sequence number. The keys hold the
+// versions of their values written by the batches, so that the snapshots
+// read the versions as of the sequence number they were created at
+// without copying the keys.
+type mapStore struct {
+	merge MergeFunc
+
+	mu sync.RWMutex
+	// seq is the sequence number of the last committed batch.
+	seq uint64
+	// m holds the versions of the values of the keys ordered by their
+	// sequence number. The values are never modified once stored, thus,
+	// they are shared with the snapshots and the readers.
+	m map[string][]mapVersion
+	// snapshots counts the open snapshots by their sequence number.
+	snapshots map[uint64]int
+	// obsolete holds the keys retaining versions which are only visible
+	// to the open snapshots, which are dropped once the snapshots are
+	// closed.
+	obsolete map[string]struct{}
+}
+
+// mapVersion is a value of a key written by the batch with the sequence
+// number. The value is nil if the key was deleted by the batch.
+type mapVersion struct {
+	seq   uint64
+	value []byte
+}
+
+// NewMapStore returns a Store keeping the keys in a map in memory, merging
+// the values using merge when they are written. The keys do not survive
+// restarts. See AggregatorConfig.NewStore.
+//
+// NewSnapshot does not copy the keys, instead the overwritten and deleted
+// values are retained while they are visible to an open snapshot. The
+// keys are not ordered, thus, RangeScan and RangeDelete visit all of the
+// keys of the store, and RangeScan sorts the keys in the range, which
+// makes the store suitable for small numbers of aggregated metrics only.
+func NewMapStore(merge MergeFunc) Store {
+	return &mapStore{
+		merge:     merge,
+		m:         make(map[string][]mapVersion),
+		snapshots: make(map[uint64]int),
+		obsolete:  make(map[string]struct{}),
+	}
+}
+
+func (s *mapStore) Get(key []byte) ([]byte, error) {
+	return s.get(key, 0, false)
+}
+
+func (s *mapStore) RangeScan(lb, ub []byte, fn func(key, value []byte) error) error {
+	return s.rangeScan(lb, ub, 0, false, fn)
+}
+
+func (s *mapStore) Set(key, value []byte) error {
+	return s.write(mapOpSet, key, value)
+}
+
+func (s *mapStore) Merge(key, value []byte) error {
+	return s.write(mapOpMerge, key, value)
+}
+
+func (s *mapStore) Delete(key []byte) error {
+	return s.write(mapOpDelete, key, nil)
+}
+
+func (s *mapStore) RangeDelete(lb, ub []byte) error {
+	return s.write(mapOpRangeDelete, lb, ub)
+}
+
+// write commits a batch of a single write.
+func (s *mapStore) write(kind mapOpKind, key, value []byte) error {
+	b := mapBatch{s: s}
+	b.add(kind, key, value)
+	return b.Commit()
+}
+
+func (s *mapStore) NewBatch() StoreBatch {
+	return &mapBatch{s: s}
+}
+
+func (s *mapStore) NewSnapshot() StoreSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshots[s.seq]++
+	return &mapSnapshot{s: s, seq: s.seq}
+}
+
+func (s *mapStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m = nil
+	return nil
+}
+
+// get returns a copy of the value of the key as of the sequence number,
+// or as of now if snapshot is false.
+func (s *mapStore) get(key []byte, seq uint64, snapshot bool) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.m == nil {
+		return nil, errMapStoreClosed
+	}
+	if !snapshot {
+		seq = s.seq
+	}
+	v := visible(s.m[string(key)], seq)
+	if v == nil {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), v...), nil
+}
+
+// rangeScan calls fn with the keys between lb and ub as of the sequence
+// number, or as of now if snapshot is false, see StoreReader.RangeScan.
+// The matching keys are collected before calling fn, so that fn may
+// write to the store.
+func (s *mapStore) rangeScan(
+	lb, ub []byte,
+	seq uint64,
+	snapshot bool,
+	fn func(key, value []byte) error,
+) error {
+	type kv struct {
+		key   string
+		value []byte
+	}
+	s.mu.RLock()
+	if s.m == nil {
+		s.mu.RUnlock()
+		return errMapStoreClosed
+	}
+	if !snapshot {
+		seq = s.seq
+	}
+	var kvs []kv
+	for k, vs := range s.m {
+		if !inRange([]byte(k), lb, ub) {
+			continue
+		}
+		if v := visible(vs, seq); v != nil {
+			kvs = append(kvs, kv{key: k, value: v})
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].key < kvs[j].key })
+	for _, kv := range kvs {
+		if err := fn([]byte(kv.key), kv.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseSnapshot releases the snapshot with the sequence number, dropping
+// the versions which are no longer visible to any of the open snapshots.
+func (s *mapStore) releaseSnapshot(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.snapshots[seq]--; s.snapshots[seq] <= 0 {
+		delete(s.snapshots, seq)
+	}
+	if s.m == nil {
+		return
+	}
+	for k := range s.obsolete {
+		s.prune(k)
+	}
+}
+
+// prune drops the versions of the key which are neither the latest one
+// nor visible to any of the open snapshots. The caller must hold the
+// write lock.
+func (s *mapStore) prune(key string) {
+	vs := s.m[key]
+	if len(vs) == 1 && vs[0].value != nil {
+		delete(s.obsolete, key)
+		return
+	}
+	kept := make([]mapVersion, 0, len(vs))
+	for i, v := range vs {
+		if i < len(vs)-1 && !s.hasSnapshotBetween(v.seq, vs[i+1].seq) {
+			continue
+		}
+		if len(kept) == 0 && v.value == nil {
+			// A deletion is not distinguishable from the key not
+			// existing if none of its older versions are retained.
+			continue
+		}
+		kept = append(kept, v)
+	}
+	switch {
+	case len(kept) == 0:
+		delete(s.m, key)
+		delete(s.obsolete, key)
+	case len(kept) == 1 && kept[0].value != nil:
+		s.m[key] = kept
+		delete(s.obsolete, key)
+	default:
+		s.m[key] = kept
+		s.obsolete[key] = struct{}{}
+	}
+}
+
+// hasSnapshotBetween reports whether any of the open snapshots has a
+// sequence number between from, inclusive, and to, exclusive.
+func (s *mapStore) hasSnapshotBetween(from, to uint64) bool {
+	for seq := range s.snapshots {
+		if seq >= from && seq < to {
+			return true
+		}
+	}
+	return false
+}
+
+// visible returns the value of the latest of the versions written at or
+// before the sequence number, nil if the key did not exist or was deleted.
+func visible(vs []mapVersion, seq uint64) []byte {
+	for i := len(vs) - 1; i >= 0; i-- {
+		if vs[i].seq <= seq {
+			return vs[i].value
+		}
+	}
+	return nil
+}
+
+type mapOpKind uint8
+
+const (
+	mapOpSet mapOpKind = iota
+	mapOpMerge
+	mapOpDelete
+	mapOpRangeDelete
+)
+
+// mapOp is a write of a mapBatch. For range deletions, key and value are
+// the lower and upper bounds of the deleted keys.
+type mapOp struct {
+	kind  mapOpKind
+	key   []byte
+	value []byte
+}
+
+// mapBatch is a StoreBatch of a mapStore.
+type mapBatch struct {
+	s   *mapStore
+	ops []mapOp
+	len int
+}
+
+// add appends a copy of the write to the batch.
+func (b *mapBatch) add(kind mapOpKind, key, value []byte) {
+	b.ops = append(b.ops, mapOp{
+		kind:  kind,
+		key:   append([]byte(nil), key...),
+		value: append([]byte(nil), value...),
+	})
+	b.len += len(key) + len(value)
+}
+
+func (b *mapBatch) Set(key, value []byte) error {
+	b.add(mapOpSet, key, value)
+	return nil
+}
+
+func (b *mapBatch) Merge(key, value []byte) error {
+	b.add(mapOpMerge, key, value)
+	return nil
+}
+
+func (b *mapBatch) Delete(key []byte) error {
+	b.add(mapOpDelete, key, nil)
+	return nil
+}
+
+func (b *mapBatch) RangeDelete(lb, ub []byte) error {
+	b.add(mapOpRangeDelete, lb, ub)
+	return nil
+}
+
+func (b *mapBatch) Len() int {
+	return b.len
+}
+
+// Commit applies the writes of the batch in order as a new version of the
+// written keys. The merged values are computed before applying any of the
+// writes, so that none of them are applied if any of the merges fail.
+func (b *mapBatch) Commit() error {
+	s := b.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m == nil {
+		return errMapStoreClosed
+	}
+	// writes holds the values of the keys written by the batch, nil for
+	// the deleted keys.
+	writes := make(map[string][]byte)
+	for _, op := range b.ops {
+		switch op.kind {
+		case mapOpSet:
+			// The value must be non-nil to tell it apart from a
+			// deleted key.
+			value := op.value
+			if value == nil {
+				value = []byte{}
+			}
+			writes[string(op.key)] = value
+		case mapOpMerge:
+			existing, ok := writes[string(op.key)]
+			if !ok {
+				existing = visible(s.m[string(op.key)], s.seq)
+			}
+			merged, err := s.merge(op.key, existing, op.value)
+			if err != nil {
+				return err
+			}
+			if merged == nil {
+				merged = []byte{}
+			}
+			writes[string(op.key)] = merged
+		case mapOpDelete:
+			writes[string(op.key)] = nil
+		case mapOpRangeDelete:
+			for k, vs := range s.m {
+				if inRange([]byte(k), op.key, op.value) && visible(vs, s.seq) != nil {
+					writes[k] = nil
+				}
+			}
+			for k := range writes {
+				if inRange([]byte(k), op.key, op.value) {
+					writes[k] = nil
+				}
+			}
+		}
+	}
+	s.seq++
+	for k, v := range writes {
+		s.m[k] = append(s.m[k], mapVersion{seq: s.seq, value: v})
+		s.prune(k)
+	}
+	return nil
+}
+
+func (b *mapBatch) Close() error {
+	b.ops = nil
+	return nil
+}
+
+// mapSnapshot is a StoreSnapshot of a mapStore reading the versions of
+// the keys as of the sequence number of the last batch committed before
+// it was created.
+type mapSnapshot struct {
+	s      *mapStore
+	seq    uint64
+	closed bool
+}
+
+func (s *mapSnapshot) Get(key []byte) ([]byte, error) {
+	return s.s.get(key, s.seq, true)
+}
+
+func (s *mapSnapshot) RangeScan(lb, ub []byte, fn func(key, value []byte) error) error {
+	return s.s.rangeScan(lb, ub, s.seq, true, fn)
+}
+
+func (s *mapSnapshot) Close() error {
+	if !s.closed {
+		s.closed = true
+		s.s.releaseSnapshot(s.seq)
+	}
+	return nil
+}
+
+// inRange reports whether the key is between lb, inclusive, and ub,
+// exclusive. Nil bounds are unbounded.
+func inRange(key, lb, ub []byte) bool {
+	return (lb == nil || bytes.Compare(key, lb) >= 0) &&
+		(ub == nil || bytes.Compare(key, ub) < 0)
+}
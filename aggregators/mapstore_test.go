@@ -0,0 +1,96 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMapStoreMergeError(t *testing.T) {
+	mergeErr := errors.New("merge failed")
+	kv := NewMapStore(func(key, existing, value []byte) ([]byte, error) {
+		if string(value) == "bad" {
+			return nil, mergeErr
+		}
+		return append(append([]byte(nil), existing...), value...), nil
+	})
+	require.NoError(t, kv.Set([]byte("a"), []byte("1")))
+
+	// None of the writes of a batch are applied if any of the merges fail.
+	batch := kv.NewBatch()
+	require.NoError(t, batch.Merge([]byte("a"), []byte("2")))
+	require.NoError(t, batch.Set([]byte("b"), []byte("3")))
+	require.NoError(t, batch.Merge([]byte("a"), []byte("bad")))
+	assert.ErrorIs(t, batch.Commit(), mergeErr)
+	require.NoError(t, batch.Close())
+
+	v, err := kv.Get([]byte("a"))
+	require.NoError(t, err)
+	assert.Equal(t, "1", string(v))
+	_, err = kv.Get([]byte("b"))
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.ErrorIs(t, kv.Merge([]byte("a"), []byte("bad")), mergeErr)
+}
+
+func TestMapStoreSnapshotVersions(t *testing.T) {
+	kv := NewMapStore(nil).(*mapStore)
+	versions := func(key string) int {
+		kv.mu.RLock()
+		defer kv.mu.RUnlock()
+		return len(kv.m[key])
+	}
+	require.NoError(t, kv.Set([]byte("a"), []byte("1")))
+	require.NoError(t, kv.Set([]byte("a"), []byte("2")))
+	// Only the latest version is retained without snapshots.
+	assert.Equal(t, 1, versions("a"))
+
+	snap1 := kv.NewSnapshot()
+	require.NoError(t, kv.Set([]byte("a"), []byte("3")))
+	snap2 := kv.NewSnapshot()
+	require.NoError(t, kv.Set([]byte("a"), []byte("4")))
+	require.NoError(t, kv.Delete([]byte("a")))
+	require.NoError(t, kv.Set([]byte("b"), []byte("5")))
+	require.NoError(t, kv.Delete([]byte("b")))
+	// The versions visible to the snapshots are retained, along with the
+	// deletion of a, while b was never visible to the snapshots.
+	assert.Equal(t, 3, versions("a"))
+	assert.Equal(t, 0, versions("b"))
+	for snap, expected := range map[StoreSnapshot]string{snap1: "2", snap2: "3"} {
+		v, err := snap.Get([]byte("a"))
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(v))
+	}
+	_, err := kv.Get([]byte("a"))
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, snap1.Close())
+	assert.Equal(t, 2, versions("a"))
+	// Closing a snapshot more than once has no effect.
+	require.NoError(t, snap1.Close())
+	v, err := snap2.Get([]byte("a"))
+	require.NoError(t, err)
+	assert.Equal(t, "3", string(v))
+
+	require.NoError(t, snap2.Close())
+	assert.Equal(t, 0, versions("a"))
+	assert.Empty(t, kv.obsolete)
+}
+
+func TestMapStoreClosed(t *testing.T) {
+	kv := NewMapStore(nil)
+	snap := kv.NewSnapshot()
+	require.NoError(t, kv.Close())
+	_, err := kv.Get([]byte("a"))
+	assert.ErrorIs(t, err, errMapStoreClosed)
+	assert.ErrorIs(t, kv.Set([]byte("a"), []byte("1")), errMapStoreClosed)
+	assert.ErrorIs(t, kv.RangeScan(nil, nil, func(_, _ []byte) error { return nil }), errMapStoreClosed)
+	_, err = snap.Get([]byte("a"))
+	assert.ErrorIs(t, err, errMapStoreClosed)
+	require.NoError(t, snap.Close())
+}
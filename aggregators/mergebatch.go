@@ -0,0 +1,134 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/apm-aggregation/aggregationpb"
+)
+
+// mergeBatch coalesces the aggregations for the same combined metrics key
+// in memory before they are written to pebble as a single merge operand.
+//
+// Without coalescing, every aggregated event is written as a merge operand
+// which pebble merges when flushing, compacting or reading the key. At high
+// event rates for a small number of keys, coalescing the operands in memory
+// reduces the bytes written to pebble, and thus the write amplification, at
+// the cost of holding the decoded aggregations in memory for the window.
+//
+// mergeBatch is not safe for concurrent use, the aggregator's lock must be
+// held, except for size.
+type mergeBatch struct {
+	window time.Duration
+	// start is the time of the first pending aggregation.
+	start   time.Time
+	pending map[string]*pendingMerge
+
+	// keys and bytes are the number of pending keys and the encoded size
+	// of the pending aggregations as added, which is an upper bound of
+	// the size of the coalesced aggregations. They are updated atomically
+	// so that they can be observed without the lock.
+	keys  atomic.Int64
+	bytes atomic.Int64
+}
+
+type pendingMerge struct {
+	cmk     CombinedMetricsKey
+	metrics CombinedMetrics
+	// bytes is the encoded size of the aggregations added for the key.
+	bytes int64
+}
+
+func newMergeBatch(window time.Duration) *mergeBatch {
+	return &mergeBatch{
+		window:  window,
+		pending: make(map[string]*pendingMerge),
+	}
+}
+
+// add merges the aggregated metrics into the pending aggregations for the
+// key using the given limits and hasher, as the pebble merger does.
+func (b *mergeBatch) add(
+	now time.Time,
+	cmk CombinedMetricsKey,
+	cmproto *aggregationpb.CombinedMetrics,
+	limits Limits,
+	hasher Hasher,
+	ol *overflowLogger,
+) error {
+	buf := make([]byte, cmk.SizeBinary())
+	if err := cmk.MarshalBinaryToSizedBuffer(buf); err != nil {
+		return err
+	}
+	if len(b.pending) == 0 {
+		b.start = now
+	}
+	// The metrics are decoded from their protobuf representation, as
+	// pebble does when merging, so that the pending aggregations never
+	// share maps or histograms with the aggregated metrics.
+	var from CombinedMetrics
+	from.FromProto(cmproto)
+	size := int64(cmproto.SizeVT())
+	b.bytes.Add(size)
+	pm, ok := b.pending[string(buf)]
+	if !ok {
+		b.pending[string(buf)] = &pendingMerge{cmk: cmk, metrics: from, bytes: size}
+		b.keys.Store(int64(len(b.pending)))
+		return nil
+	}
+	merge(&pm.metrics, &from, limits, hasher, ol)
+	pm.bytes += size
+	return nil
+}
+
+// due returns true if the window elapsed since the first pending
+// aggregation.
+func (b *mergeBatch) due(now time.Time) bool {
+	return len(b.pending) > 0 && now.Sub(b.start) >= b.window
+}
+
+// untilDue returns the duration until the window elapses since the first
+// pending aggregation, or the window if there are no pending aggregations
+// or the window already elapsed, for example, as the pending aggregations
+// failed to be drained.
+func (b *mergeBatch) untilDue(now time.Time) time.Duration {
+	if d := b.start.Add(b.window).Sub(now); len(b.pending) > 0 && d > 0 {
+		return d
+	}
+	return b.window
+}
+
+// size returns the number of pending keys and the encoded size of the
+// pending aggregations. It is safe for concurrent use.
+func (b *mergeBatch) size() (keys, bytes int64) {
+	return b.keys.Load(), b.bytes.Load()
+}
+
+// drain calls f for each of the pending aggregations, removing each of
+// them from the batch once f succeeds for it. drain stops at the first
+// error returned by f, keeping the aggregation f failed for, and the ones
+// not yet drained, pending so that they are drained by the next call.
+func (b *mergeBatch) drain(f func(CombinedMetricsKey, *CombinedMetrics) error) error {
+	for k, pm := range b.pending {
+		if err := f(pm.cmk, &pm.metrics); err != nil {
+			return err
+		}
+		delete(b.pending, k)
+		b.keys.Store(int64(len(b.pending)))
+		b.bytes.Add(-pm.bytes)
+	}
+	b.start = time.Time{}
+	return nil
+}
+
+// reset drops all the pending aggregations.
+func (b *mergeBatch) reset() {
+	b.pending = make(map[string]*pendingMerge)
+	b.start = time.Time{}
+	b.keys.Store(0)
+	b.bytes.Store(0)
+}
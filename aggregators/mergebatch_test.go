@@ -0,0 +1,129 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeBatch(t *testing.T) {
+	ts := time.Unix(0, 0).UTC()
+	limits := Limits{
+		MaxSpanGroups:                         100,
+		MaxSpanGroupsPerService:               10,
+		MaxTransactionGroups:                  100,
+		MaxTransactionGroupsPerService:        10,
+		MaxServiceTransactionGroups:           100,
+		MaxServiceTransactionGroupsPerService: 10,
+		MaxServices:                           10,
+		MaxServiceInstanceGroupsPerService:    10,
+	}
+	cmk1 := CombinedMetricsKey{Interval: time.Minute, ProcessingTime: ts, ID: "1"}
+	cmk2 := CombinedMetricsKey{Interval: time.Minute, ProcessingTime: ts, ID: "2"}
+	txn := func(name string) *CombinedMetrics {
+		return (*CombinedMetrics)(createTestCombinedMetrics(1).
+			addTransaction(ts, "svc1", "", testTransaction{txnName: name, txnType: "type", count: 1}).
+			addServiceTransaction(ts, "svc1", "", testServiceTransaction{txnType: "type", count: 1}))
+	}
+
+	b := newMergeBatch(time.Second)
+	assert.False(t, b.due(ts))
+	assert.Equal(t, time.Second, b.untilDue(ts))
+	var expectedBytes int64
+	for i, add := range []struct {
+		cmk          CombinedMetricsKey
+		cm           *CombinedMetrics
+		expectedKeys int64
+	}{
+		{cmk: cmk1, cm: txn("txn1"), expectedKeys: 1},
+		{cmk: cmk2, cm: txn("txn1"), expectedKeys: 2},
+		{cmk: cmk1, cm: txn("txn1"), expectedKeys: 2},
+		{cmk: cmk1, cm: txn("txn2"), expectedKeys: 2},
+	} {
+		cmproto := add.cm.ToProto()
+		expectedBytes += int64(cmproto.SizeVT())
+		require.NoError(t, b.add(ts.Add(time.Duration(i)*100*time.Millisecond), add.cmk, cmproto, limits, Hasher{}, nil))
+		cmproto.ReturnToVTPool()
+		keys, bytes := b.size()
+		assert.Equal(t, add.expectedKeys, keys)
+		assert.Equal(t, expectedBytes, bytes)
+	}
+	assert.False(t, b.due(ts.Add(999*time.Millisecond)))
+	assert.True(t, b.due(ts.Add(time.Second)))
+	assert.Equal(t, 600*time.Millisecond, b.untilDue(ts.Add(400*time.Millisecond)))
+	assert.Equal(t, time.Second, b.untilDue(ts.Add(time.Second)))
+
+	// Coalesced aggregations are equal to the aggregations merged one by
+	// one, as done by pebble.
+	expected1 := *txn("txn1")
+	merge(&expected1, txn("txn1"), limits, Hasher{}, nil)
+	merge(&expected1, txn("txn2"), limits, Hasher{}, nil)
+	expected := map[CombinedMetricsKey]CombinedMetrics{
+		cmk1: expected1,
+		cmk2: *txn("txn1"),
+	}
+	actual := make(map[CombinedMetricsKey]CombinedMetrics)
+	require.NoError(t, b.drain(func(cmk CombinedMetricsKey, cm *CombinedMetrics) error {
+		actual[cmk] = *cm
+		return nil
+	}))
+	assert.Empty(t, cmp.Diff(expected, actual, cmp.Exporter(func(reflect.Type) bool { return true })))
+	assert.False(t, b.due(ts.Add(time.Hour)))
+	assert.Empty(t, b.pending)
+	keys, bytes := b.size()
+	assert.Zero(t, keys)
+	assert.Zero(t, bytes)
+}
+
+func TestMergeBatchDrainError(t *testing.T) {
+	ts := time.Unix(0, 0).UTC()
+	b := newMergeBatch(time.Second)
+	var expectedBytes int64
+	for _, id := range []string{"1", "2", "3"} {
+		cmproto := (*CombinedMetrics)(createTestCombinedMetrics(1).
+			addSpan(ts, "svc1", "", testSpan{spanName: "span1", count: 1})).ToProto()
+		expectedBytes += int64(cmproto.SizeVT())
+		cmk := CombinedMetricsKey{Interval: time.Minute, ProcessingTime: ts, ID: id}
+		require.NoError(t, b.add(ts, cmk, cmproto, Limits{}, Hasher{}, nil))
+		cmproto.ReturnToVTPool()
+	}
+
+	// The aggregations are only drained once written, the aggregation
+	// failing to be written and the ones not yet written are kept.
+	drained := make(map[string]bool)
+	err := b.drain(func(cmk CombinedMetricsKey, _ *CombinedMetrics) error {
+		if len(drained) == 1 {
+			return errors.New("write failure")
+		}
+		drained[cmk.ID] = true
+		return nil
+	})
+	assert.EqualError(t, err, "write failure")
+	require.Len(t, drained, 1)
+	keys, bytes := b.size()
+	assert.Equal(t, int64(2), keys)
+	assert.Equal(t, expectedBytes*2/3, bytes)
+	assert.True(t, b.due(ts.Add(time.Second)))
+
+	// The kept aggregations are drained by the next call.
+	require.NoError(t, b.drain(func(cmk CombinedMetricsKey, _ *CombinedMetrics) error {
+		assert.False(t, drained[cmk.ID], "aggregation drained twice")
+		drained[cmk.ID] = true
+		return nil
+	}))
+	assert.Len(t, drained, 3)
+	assert.Empty(t, b.pending)
+	keys, bytes = b.size()
+	assert.Zero(t, keys)
+	assert.Zero(t, bytes)
+	assert.False(t, b.due(ts.Add(time.Hour)))
+}
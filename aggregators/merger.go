@@ -5,41 +5,142 @@
 package aggregators
 
 import (
+	"errors"
+	"fmt"
 	"io"
 
 	"github.com/axiomhq/hyperloglog"
+	"github.com/cockroachdb/pebble"
 
+	"github.com/elastic/apm-aggregation/aggregationpb"
 	"github.com/elastic/apm-aggregation/aggregators/internal/hdrhistogram"
+	"github.com/elastic/apm-aggregation/aggregators/internal/telemetry"
 )
 
+// MergeCombinedMetrics merges the src partial combined metrics into dst
+// considering the limits, using the same logic as the aggregator uses to
+// merge the aggregated metrics. This allows merging the partial combined
+// metrics harvested by multiple aggregators, for example, in a two-tier
+// aggregation. The aggregation groups of src which do not fit within the
+// limits are merged into the overflow buckets of dst, and the cardinality
+// of the overflow buckets is estimated from the merged aggregation keys
+// rather than summed. src is not modified.
+func MergeCombinedMetrics(dst, src *aggregationpb.CombinedMetrics, limits Limits) error {
+	if dst == nil || src == nil {
+		return errors.New("combined metrics to merge must not be nil")
+	}
+	var to, from CombinedMetrics
+	to.FromProto(dst)
+	from.FromProto(src)
+	merge(&to, &from, limits, Hasher{}, nil)
+
+	pb := to.ToProto()
+	defer pb.ReturnToVTPool()
+	data, err := pb.MarshalVT()
+	if err != nil {
+		return fmt.Errorf("failed to marshal merged combined metrics: %w", err)
+	}
+	dst.Reset()
+	if err := dst.UnmarshalVT(data); err != nil {
+		return fmt.Errorf("failed to unmarshal merged combined metrics: %w", err)
+	}
+	return nil
+}
+
 type combinedMetricsMerger struct {
-	limits  Limits
+	limits         Limits
+	hasher         Hasher
+	overflowLogger *overflowLogger
+	// active, if set, is updated with the fully merged metrics for key.
+	active *activeCombinedMetrics
+	// merges records the merge operations and their failures.
+	merges  *telemetry.Merges
+	key     CombinedMetricsKey
 	metrics CombinedMetrics
 }
 
 func (m *combinedMetricsMerger) MergeNewer(value []byte) error {
-	var from CombinedMetrics
-	if err := from.UnmarshalBinary(value); err != nil {
-		return err
-	}
-	merge(&m.metrics, &from, m.limits)
-	return nil
+	return m.merges.Record(m.mergeValue(value))
 }
 
 func (m *combinedMetricsMerger) MergeOlder(value []byte) error {
+	return m.merges.Record(m.mergeValue(value))
+}
+
+func (m *combinedMetricsMerger) mergeValue(value []byte) error {
 	var from CombinedMetrics
 	if err := from.UnmarshalBinary(value); err != nil {
-		return err
+		return fmt.Errorf("failed to unmarshal combined metrics to merge: %w", err)
 	}
-	merge(&m.metrics, &from, m.limits)
+	merge(&m.metrics, &from, m.limits, m.hasher, m.overflowLogger)
 	return nil
 }
 
 func (m *combinedMetricsMerger) Finish(includesBase bool) ([]byte, io.Closer, error) {
+	if includesBase && m.active != nil {
+		m.active.merged(m.key, &m.metrics)
+	}
 	data, err := m.metrics.MarshalBinary()
 	return data, nil, err
 }
 
+// mergeKeyError is the error of merging the values of a key, identifying
+// the key which can not be merged, so that the harvest can skip it rather
+// than stopping at it.
+type mergeKeyError struct {
+	key []byte
+	err error
+}
+
+func (e *mergeKeyError) Error() string {
+	return e.err.Error()
+}
+
+func (e *mergeKeyError) Unwrap() error {
+	return e.err
+}
+
+// withMergeKeyErrors returns the merge operator wrapping the errors of
+// merge, and of the value mergers it creates, in a mergeKeyError.
+func withMergeKeyErrors(merge pebble.Merge) pebble.Merge {
+	return func(key, value []byte) (pebble.ValueMerger, error) {
+		// The key is only valid until merge returns.
+		key = append([]byte(nil), key...)
+		vm, err := merge(key, value)
+		if err != nil {
+			return nil, &mergeKeyError{key: key, err: err}
+		}
+		return &keyValueMerger{ValueMerger: vm, key: key}, nil
+	}
+}
+
+// keyValueMerger wraps the errors of the value merger of the key in a
+// mergeKeyError.
+type keyValueMerger struct {
+	pebble.ValueMerger
+	key []byte
+}
+
+func (m *keyValueMerger) MergeNewer(value []byte) error {
+	return m.wrap(m.ValueMerger.MergeNewer(value))
+}
+
+func (m *keyValueMerger) MergeOlder(value []byte) error {
+	return m.wrap(m.ValueMerger.MergeOlder(value))
+}
+
+func (m *keyValueMerger) Finish(includesBase bool) ([]byte, io.Closer, error) {
+	data, closer, err := m.ValueMerger.Finish(includesBase)
+	return data, closer, m.wrap(err)
+}
+
+func (m *keyValueMerger) wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &mergeKeyError{key: m.key, err: err}
+}
+
 type Constraint struct {
 	counter int
 	limit   int
@@ -65,7 +166,10 @@ func (c *Constraint) value() int {
 }
 
 // merge merges two combined metrics considering the configured limits.
-func merge(to, from *CombinedMetrics, limits Limits) {
+// The given hasher is used to hash the aggregation keys for estimating
+// the cardinality of the overflowed aggregation keys, and the overflowed
+// aggregation keys are recorded to the given overflow logger, if any.
+func merge(to, from *CombinedMetrics, limits Limits, hasher Hasher, ol *overflowLogger) {
 	// eventsTotal tracks the total number of events merged in a single combined metrics
 	// irrespective of overflows. We merge the events total irrespective
 	// of the services present because it is possible for services to be empty
@@ -105,45 +209,53 @@ func merge(to, from *CombinedMetrics, limits Limits) {
 	//    2.b. Else, merge the _from_ bucket to the overflow service bucket
 	//         of the _to_ combined metrics.
 	for svcKey, fromSvc := range from.Services {
-		hash := Hasher{}.Chain(svcKey)
+		hash := hasher.Chain(svcKey)
 		toSvc, svcOverflow := getServiceMetrics(to, svcKey, limits.MaxServices)
 		if svcOverflow {
+			ol.record(overflowTypeService, svcKey.ServiceName, "")
 			mergeOverflow(&to.OverflowServices, &fromSvc.OverflowGroups)
 
 			for sik, sim := range fromSvc.ServiceInstanceGroups {
 				sikHash := hash.Chain(sik)
-				mergeToOverflowFromSIM(&to.OverflowServices, &sim, sikHash)
-				insertHash(&to.OverflowServiceInstancesEstimator, sikHash.Sum())
+				mergeToOverflowFromSIM(&to.OverflowServices, &sim, sikHash, ol, svcKey.ServiceName)
+				insertHash(&to.OverflowServiceInstancesEstimator, sikHash)
 			}
 			continue
 		}
 		mergeOverflow(&toSvc.OverflowGroups, &fromSvc.OverflowGroups)
 		mergeServiceInstanceGroups(&toSvc, &fromSvc,
 			totalTransactionGroupsConstraint, totalServiceTransactionGroupsConstraint, totalSpanGroupsConstraint,
-			limits, hash, &to.OverflowServiceInstancesEstimator)
+			limits, hash, &to.OverflowServiceInstancesEstimator, ol, svcKey.ServiceName)
 		to.Services[svcKey] = toSvc
 	}
 }
 
-func mergeToOverflowFromSIM(to *Overflow, from *ServiceInstanceMetrics, hash Hasher) {
+func mergeToOverflowFromSIM(to *Overflow, from *ServiceInstanceMetrics, hash Hasher, ol *overflowLogger, svcName string) {
 	for tk, tm := range from.TransactionGroups {
-		to.OverflowTransaction.Merge(&tm, hash.Chain(tk).Sum())
+		ol.record(overflowTypeTransaction, svcName, tk.TransactionName)
+		to.OverflowTransaction.Merge(&tm, hash.Chain(tk))
 	}
 	for stk, stm := range from.ServiceTransactionGroups {
-		to.OverflowServiceTransaction.Merge(&stm, hash.Chain(stk).Sum())
+		ol.record(overflowTypeServiceTransaction, svcName, stk.TransactionType)
+		to.OverflowServiceTransaction.Merge(&stm, hash.Chain(stk))
 	}
 	for sk, sm := range from.SpanGroups {
-		to.OverflowSpan.Merge(&sm, hash.Chain(sk).Sum())
+		ol.record(overflowTypeSpan, svcName, sk.SpanName)
+		to.OverflowSpan.Merge(&sm, hash.Chain(sk))
+	}
+	for sdk, sdm := range from.SpanDestinationGroups {
+		ol.record(overflowTypeSpanDestination, svcName, sdk.Resource)
+		to.OverflowSpanDestination.Merge(&sdm, hash.Chain(sdk))
 	}
 }
 
-func mergeServiceInstanceGroups(to, from *ServiceMetrics, totalTransactionGroupsConstraint, totalServiceTransactionGroupsConstraint, totalSpanGroupsConstraint *Constraint, limits Limits, hash Hasher, overflowServiceInstancesEstimator **hyperloglog.Sketch) {
+func mergeServiceInstanceGroups(to, from *ServiceMetrics, totalTransactionGroupsConstraint, totalServiceTransactionGroupsConstraint, totalSpanGroupsConstraint *Constraint, limits Limits, hash Hasher, overflowServiceInstancesEstimator **hyperloglog.Sketch, ol *overflowLogger, svcName string) {
 	for siKey, fromSIM := range from.ServiceInstanceGroups {
 		toSIM, overflowed := getServiceInstanceMetrics(to, siKey, limits.MaxServiceInstanceGroupsPerService)
 		siKeyHash := hash.Chain(siKey)
 		if overflowed {
-			mergeToOverflowFromSIM(&to.OverflowGroups, &fromSIM, siKeyHash)
-			insertHash(overflowServiceInstancesEstimator, siKeyHash.Sum())
+			mergeToOverflowFromSIM(&to.OverflowGroups, &fromSIM, siKeyHash, ol, svcName)
+			insertHash(overflowServiceInstancesEstimator, siKeyHash)
 			continue
 		}
 
@@ -154,6 +266,7 @@ func mergeServiceInstanceGroups(to, from *ServiceMetrics, totalTransactionGroups
 			totalTransactionGroupsConstraint,
 			hash,
 			&to.OverflowGroups.OverflowTransaction,
+			ol, svcName,
 		)
 		mergeServiceTransactionGroups(
 			&toSIM,
@@ -162,6 +275,7 @@ func mergeServiceInstanceGroups(to, from *ServiceMetrics, totalTransactionGroups
 			totalServiceTransactionGroupsConstraint,
 			hash,
 			&to.OverflowGroups.OverflowServiceTransaction,
+			ol, svcName,
 		)
 		mergeSpanGroups(
 			&toSIM,
@@ -170,6 +284,15 @@ func mergeServiceInstanceGroups(to, from *ServiceMetrics, totalTransactionGroups
 			totalSpanGroupsConstraint,
 			hash,
 			&to.OverflowGroups.OverflowSpan,
+			ol, svcName,
+		)
+		mergeSpanDestinationGroups(
+			&toSIM,
+			&fromSIM,
+			newConstraint(len(toSIM.SpanDestinationGroups), limits.MaxSpanDestinationsPerService),
+			hash,
+			&to.OverflowGroups.OverflowSpanDestination,
+			ol, svcName,
 		)
 		to.ServiceInstanceGroups[siKey] = toSIM
 	}
@@ -177,13 +300,14 @@ func mergeServiceInstanceGroups(to, from *ServiceMetrics, totalTransactionGroups
 
 // mergeTransactionGroups merges transaction aggregation groups for two combined metrics
 // considering max transaction groups and max transaction groups per service limits.
-func mergeTransactionGroups(to, from *ServiceInstanceMetrics, perSvcConstraint, globalConstraint *Constraint, hash Hasher, overflowTo *OverflowTransaction) {
+func mergeTransactionGroups(to, from *ServiceInstanceMetrics, perSvcConstraint, globalConstraint *Constraint, hash Hasher, overflowTo *OverflowTransaction, ol *overflowLogger, svcName string) {
 	for txnKey, fromTxn := range from.TransactionGroups {
 		toTxn, ok := to.TransactionGroups[txnKey]
 		if !ok {
 			overflowed := perSvcConstraint.maxed() || globalConstraint.maxed()
 			if overflowed {
-				overflowTo.Merge(&fromTxn, hash.Chain(txnKey).Sum())
+				ol.record(overflowTypeTransaction, svcName, txnKey.TransactionName)
+				overflowTo.Merge(&fromTxn, hash.Chain(txnKey))
 				continue
 			}
 			toTxn = newTransactionMetrics()
@@ -197,13 +321,14 @@ func mergeTransactionGroups(to, from *ServiceInstanceMetrics, perSvcConstraint,
 
 // mergeServiceTransactionGroups merges service transaction aggregation groups for two combined metrics
 // considering max service transaction groups and max service transaction groups per service limits.
-func mergeServiceTransactionGroups(to, from *ServiceInstanceMetrics, perSvcConstraint, globalConstraint *Constraint, hash Hasher, overflowTo *OverflowServiceTransaction) {
+func mergeServiceTransactionGroups(to, from *ServiceInstanceMetrics, perSvcConstraint, globalConstraint *Constraint, hash Hasher, overflowTo *OverflowServiceTransaction, ol *overflowLogger, svcName string) {
 	for svcTxnKey, fromSvcTxn := range from.ServiceTransactionGroups {
 		toSvcTxn, ok := to.ServiceTransactionGroups[svcTxnKey]
 		if !ok {
 			overflowed := perSvcConstraint.maxed() || globalConstraint.maxed()
 			if overflowed {
-				overflowTo.Merge(&fromSvcTxn, hash.Chain(svcTxnKey).Sum())
+				ol.record(overflowTypeServiceTransaction, svcName, svcTxnKey.TransactionType)
+				overflowTo.Merge(&fromSvcTxn, hash.Chain(svcTxnKey))
 				continue
 			}
 			toSvcTxn = newServiceTransactionMetrics()
@@ -217,7 +342,7 @@ func mergeServiceTransactionGroups(to, from *ServiceInstanceMetrics, perSvcConst
 
 // mergeSpanGroups merges span aggregation groups for two combined metrics considering
 // max span groups and max span groups per service limits.
-func mergeSpanGroups(to, from *ServiceInstanceMetrics, perSvcConstraint, globalConstraint *Constraint, hash Hasher, overflowTo *OverflowSpan) {
+func mergeSpanGroups(to, from *ServiceInstanceMetrics, perSvcConstraint, globalConstraint *Constraint, hash Hasher, overflowTo *OverflowSpan, ol *overflowLogger, svcName string) {
 	for spanKey, fromSpan := range from.SpanGroups {
 		toSpan, ok := to.SpanGroups[spanKey]
 		if !ok {
@@ -231,7 +356,8 @@ func mergeSpanGroups(to, from *ServiceInstanceMetrics, perSvcConstraint, globalC
 			if !ok {
 				overflowed := perSvcConstraint.maxed() || globalConstraint.maxed()
 				if overflowed {
-					overflowTo.Merge(&fromSpan, hash.Chain(spanKey).Sum())
+					ol.record(overflowTypeSpan, svcName, spanKey.SpanName)
+					overflowTo.Merge(&fromSpan, hash.Chain(spanKey))
 					continue
 				}
 				perSvcConstraint.add(1)
@@ -243,12 +369,36 @@ func mergeSpanGroups(to, from *ServiceInstanceMetrics, perSvcConstraint, globalC
 	}
 }
 
+// mergeSpanDestinationGroups merges span destination aggregation groups for
+// two combined metrics considering max span destinations per service limit.
+// The limit is not enforced, rather than overflowing all the groups, if it
+// is not positive, as the span destination aggregation is disabled and no
+// new groups are aggregated. The groups aggregated while it was enabled,
+// or merged from partial combined metrics with zero limits, are kept.
+func mergeSpanDestinationGroups(to, from *ServiceInstanceMetrics, perSvcConstraint *Constraint, hash Hasher, overflowTo *OverflowSpan, ol *overflowLogger, svcName string) {
+	limited := perSvcConstraint.limit > 0
+	for spanDestKey, fromSpanDest := range from.SpanDestinationGroups {
+		toSpanDest, ok := to.SpanDestinationGroups[spanDestKey]
+		if !ok {
+			if limited && perSvcConstraint.maxed() {
+				ol.record(overflowTypeSpanDestination, svcName, spanDestKey.Resource)
+				overflowTo.Merge(&fromSpanDest, hash.Chain(spanDestKey))
+				continue
+			}
+			perSvcConstraint.add(1)
+		}
+		mergeSpanMetrics(&toSpanDest, &fromSpanDest)
+		to.SpanDestinationGroups[spanDestKey] = toSpanDest
+	}
+}
+
 // mergeOverflow merges overflowed aggregation groups for transaction,
-// service transaction, and span groups.
+// service transaction, span, and span destination groups.
 func mergeOverflow(to, from *Overflow) {
 	to.OverflowTransaction.MergeOverflow(&from.OverflowTransaction)
 	to.OverflowServiceTransaction.MergeOverflow(&from.OverflowServiceTransaction)
 	to.OverflowSpan.MergeOverflow(&from.OverflowSpan)
+	to.OverflowSpanDestination.MergeOverflow(&from.OverflowSpanDestination)
 }
 
 // mergeTransactionMetrics merges two transaction metrics.
@@ -257,6 +407,7 @@ func mergeTransactionMetrics(to, from *TransactionMetrics) {
 		to.Histogram = hdrhistogram.New()
 	}
 	to.Histogram.Merge(from.Histogram)
+	to.DroppedSpansCount += from.DroppedSpansCount
 }
 
 // mergeTransactionMetrics merges two transaction metrics.
@@ -321,6 +472,7 @@ func newServiceInstanceMetrics() ServiceInstanceMetrics {
 		TransactionGroups:        make(map[TransactionAggregationKey]TransactionMetrics),
 		ServiceTransactionGroups: make(map[ServiceTransactionAggregationKey]ServiceTransactionMetrics),
 		SpanGroups:               make(map[SpanAggregationKey]SpanMetrics),
+		SpanDestinationGroups:    make(map[SpanDestinationAggregationKey]SpanMetrics),
 	}
 }
 
@@ -11,6 +11,7 @@ import (
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/elastic/apm-data/model/modelpb"
 )
@@ -167,6 +168,64 @@ func TestMerge(t *testing.T) {
 				addPerServiceOverflowSpan(ts, "svc1", "", testSpan{spanName: "", count: 5}),                                    // all spans will overflow but span.name dropped
 			),
 		},
+		{
+			name: "span_groups_exhausted",
+			limits: Limits{
+				MaxSpanGroups:                         1,
+				MaxSpanGroupsPerService:               10,
+				MaxTransactionGroups:                  10,
+				MaxTransactionGroupsPerService:        10,
+				MaxServiceTransactionGroups:           10,
+				MaxServiceTransactionGroupsPerService: 10,
+				MaxServices:                           10,
+				MaxServiceInstanceGroupsPerService:    10,
+			},
+			to: CombinedMetrics(*createTestCombinedMetrics(2).
+				addTransaction(ts, "svc1", "", testTransaction{txnName: "txn1", txnType: "type1", count: 1}).
+				addSpan(ts, "svc1", "", testSpan{spanName: "span1", count: 1}),
+			),
+			from: CombinedMetrics(*createTestCombinedMetrics(4).
+				addTransaction(ts, "svc1", "", testTransaction{txnName: "txn2", txnType: "type1", count: 1}).
+				addSpan(ts, "svc1", "", testSpan{spanName: "span2", count: 1}).
+				addSpan(ts, "svc1", "", testSpan{spanName: "span3", count: 2}),
+			),
+			expected: CombinedMetrics(*createTestCombinedMetrics(6).
+				addTransaction(ts, "svc1", "", testTransaction{txnName: "txn1", txnType: "type1", count: 1}).
+				addTransaction(ts, "svc1", "", testTransaction{txnName: "txn2", txnType: "type1", count: 1}). // transactions do not share the span budget
+				addSpan(ts, "svc1", "", testSpan{spanName: "span1", count: 1}).
+				addPerServiceOverflowSpan(ts, "svc1", "", testSpan{spanName: "span2", count: 1}).
+				addPerServiceOverflowSpan(ts, "svc1", "", testSpan{spanName: "span3", count: 2}),
+			),
+		},
+		{
+			name: "transaction_groups_exhausted",
+			limits: Limits{
+				MaxSpanGroups:                         10,
+				MaxSpanGroupsPerService:               10,
+				MaxTransactionGroups:                  1,
+				MaxTransactionGroupsPerService:        10,
+				MaxServiceTransactionGroups:           10,
+				MaxServiceTransactionGroupsPerService: 10,
+				MaxServices:                           10,
+				MaxServiceInstanceGroupsPerService:    10,
+			},
+			to: CombinedMetrics(*createTestCombinedMetrics(2).
+				addTransaction(ts, "svc1", "", testTransaction{txnName: "txn1", txnType: "type1", count: 1}).
+				addSpan(ts, "svc1", "", testSpan{spanName: "span1", count: 1}),
+			),
+			from: CombinedMetrics(*createTestCombinedMetrics(4).
+				addTransaction(ts, "svc1", "", testTransaction{txnName: "txn2", txnType: "type1", count: 1}).
+				addTransaction(ts, "svc1", "", testTransaction{txnName: "txn3", txnType: "type1", count: 2}).
+				addSpan(ts, "svc1", "", testSpan{spanName: "span2", count: 1}),
+			),
+			expected: CombinedMetrics(*createTestCombinedMetrics(6).
+				addTransaction(ts, "svc1", "", testTransaction{txnName: "txn1", txnType: "type1", count: 1}).
+				addPerServiceOverflowTransaction(ts, "svc1", "", testTransaction{txnName: "txn2", txnType: "type1", count: 1}).
+				addPerServiceOverflowTransaction(ts, "svc1", "", testTransaction{txnName: "txn3", txnType: "type1", count: 2}).
+				addSpan(ts, "svc1", "", testSpan{spanName: "span1", count: 1}).
+				addSpan(ts, "svc1", "", testSpan{spanName: "span2", count: 1}), // spans do not share the transaction budget
+			),
+		},
 		{
 			name: "to_overflowed_before_merge",
 			limits: Limits{
@@ -468,9 +527,91 @@ func TestMerge(t *testing.T) {
 				addServiceTransaction(ts, "svc1", "", testServiceTransaction{txnType: "type1", count: 7}),
 			),
 		},
+		{
+			name: "span_destination_no_overflow",
+			limits: Limits{
+				MaxSpanGroups:                      2,
+				MaxSpanGroupsPerService:            2,
+				MaxServices:                        1,
+				MaxServiceInstanceGroupsPerService: 1,
+				MaxSpanDestinationsPerService:      2,
+			},
+			to: CombinedMetrics(*createTestCombinedMetrics(5).
+				addSpanDestination(ts, "svc1", "", testSpan{destinationResource: "dest1", count: 5}),
+			),
+			from: CombinedMetrics(*createTestCombinedMetrics(5).
+				addSpanDestination(ts, "svc1", "", testSpan{destinationResource: "dest1", count: 3}).
+				addSpanDestination(ts, "svc1", "", testSpan{destinationResource: "dest2", count: 2}),
+			),
+			expected: CombinedMetrics(*createTestCombinedMetrics(10).
+				addSpanDestination(ts, "svc1", "", testSpan{destinationResource: "dest1", count: 8}).
+				addSpanDestination(ts, "svc1", "", testSpan{destinationResource: "dest2", count: 2}),
+			),
+		},
+		{
+			name: "span_destination_overflow_per_svc",
+			limits: Limits{
+				MaxSpanGroups:                      2,
+				MaxSpanGroupsPerService:            2,
+				MaxServices:                        1,
+				MaxServiceInstanceGroupsPerService: 1,
+				MaxSpanDestinationsPerService:      1,
+			},
+			to: CombinedMetrics(*createTestCombinedMetrics(5).
+				addSpanDestination(ts, "svc1", "", testSpan{destinationResource: "dest1", count: 5}),
+			),
+			from: CombinedMetrics(*createTestCombinedMetrics(5).
+				addSpanDestination(ts, "svc1", "", testSpan{destinationResource: "dest1", count: 3}).
+				addSpanDestination(ts, "svc1", "", testSpan{destinationResource: "dest2", count: 2}),
+			),
+			expected: CombinedMetrics(*createTestCombinedMetrics(10).
+				addSpanDestination(ts, "svc1", "", testSpan{destinationResource: "dest1", count: 8}).
+				addPerServiceOverflowSpanDestination(ts, "svc1", "", testSpan{destinationResource: "dest2", count: 2}),
+			),
+		},
+		{
+			name: "span_destination_svc_overflow",
+			limits: Limits{
+				MaxSpanGroups:                      2,
+				MaxSpanGroupsPerService:            2,
+				MaxServices:                        1,
+				MaxServiceInstanceGroupsPerService: 1,
+				MaxSpanDestinationsPerService:      1,
+			},
+			to: CombinedMetrics(*createTestCombinedMetrics(5).
+				addSpanDestination(ts, "svc1", "", testSpan{destinationResource: "dest1", count: 5}),
+			),
+			from: CombinedMetrics(*createTestCombinedMetrics(2).
+				addSpanDestination(ts, "svc2", "", testSpan{destinationResource: "dest1", count: 2}),
+			),
+			expected: CombinedMetrics(*createTestCombinedMetrics(7).
+				addSpanDestination(ts, "svc1", "", testSpan{destinationResource: "dest1", count: 5}).
+				addGlobalServiceOverflowSpanDestination(ts, "svc2", "", testSpan{destinationResource: "dest1", count: 2}),
+			),
+		},
+		{
+			name: "span_destination_zero_limit",
+			limits: Limits{
+				MaxSpanGroups:                      2,
+				MaxSpanGroupsPerService:            2,
+				MaxServices:                        1,
+				MaxServiceInstanceGroupsPerService: 1,
+			},
+			to: CombinedMetrics(*createTestCombinedMetrics(5).
+				addSpan(ts, "svc1", "", testSpan{spanName: "span1", destinationResource: "dest1", count: 5}),
+			),
+			from: CombinedMetrics(*createTestCombinedMetrics(2).
+				addSpan(ts, "svc1", "", testSpan{spanName: "span1", destinationResource: "dest1", count: 2}).
+				addSpanDestination(ts, "svc1", "", testSpan{destinationResource: "dest1", count: 2}),
+			),
+			expected: CombinedMetrics(*createTestCombinedMetrics(7).
+				addSpan(ts, "svc1", "", testSpan{spanName: "span1", destinationResource: "dest1", count: 7}).
+				addSpanDestination(ts, "svc1", "", testSpan{destinationResource: "dest1", count: 2}),
+			),
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
-			merge(&tc.to, &tc.from, tc.limits)
+			merge(&tc.to, &tc.from, tc.limits, Hasher{}, nil)
 			assert.Empty(t, cmp.Diff(tc.expected, tc.to, cmp.Exporter(func(reflect.Type) bool { return true })))
 		})
 	}
@@ -488,6 +629,7 @@ type testTransaction struct {
 	eventOutcome string
 	faas         *modelpb.Faas
 	count        int
+	droppedSpans float64
 }
 
 type testServiceTransaction struct {
@@ -536,6 +678,7 @@ func (m *TestCombinedMetrics) addTransaction(timestamp time.Time, serviceName, g
 		for i := 0; i < txn.count; i++ {
 			tm.Histogram.RecordDuration(time.Second, 1)
 		}
+		tm.DroppedSpansCount += txn.droppedSpans
 		sim.TransactionGroups[tk] = tm
 	})
 	return m
@@ -553,7 +696,8 @@ func (m *TestCombinedMetrics) addPerServiceOverflowTransaction(timestamp time.Ti
 		for i := 0; i < txn.count; i++ {
 			tm.Histogram.RecordDuration(time.Second, 1)
 		}
-		overflow.OverflowTransaction.Merge(&tm, Hasher{}.Chain(sk).Chain(sik).Chain(tk).Sum())
+		tm.DroppedSpansCount = txn.droppedSpans
+		overflow.OverflowTransaction.Merge(&tm, Hasher{}.Chain(sk).Chain(sik).Chain(tk))
 	})
 	return m
 }
@@ -570,7 +714,7 @@ func (m *TestCombinedMetrics) addGlobalServiceOverflowTransaction(timestamp time
 		for i := 0; i < txn.count; i++ {
 			tm.Histogram.RecordDuration(time.Second, 1)
 		}
-		overflow.OverflowTransaction.Merge(&tm, Hasher{}.Chain(sk).Chain(sik).Chain(tk).Sum())
+		overflow.OverflowTransaction.Merge(&tm, Hasher{}.Chain(sk).Chain(sik).Chain(tk))
 	})
 	return m
 }
@@ -610,7 +754,7 @@ func (m *TestCombinedMetrics) addPerServiceOverflowServiceTransaction(timestamp
 			stm.FailureCount += 0.0
 			stm.SuccessCount += 1.0
 		}
-		overflow.OverflowServiceTransaction.Merge(&stm, Hasher{}.Chain(sk).Chain(sik).Chain(stk).Sum())
+		overflow.OverflowServiceTransaction.Merge(&stm, Hasher{}.Chain(sk).Chain(sik).Chain(stk))
 	})
 	return m
 }
@@ -631,7 +775,7 @@ func (m *TestCombinedMetrics) addGlobalServiceOverflowServiceTransaction(timesta
 			stm.FailureCount += 0.0
 			stm.SuccessCount += 1.0
 		}
-		overflow.OverflowServiceTransaction.Merge(&stm, Hasher{}.Chain(sk).Chain(sik).Chain(stk).Sum())
+		overflow.OverflowServiceTransaction.Merge(&stm, Hasher{}.Chain(sk).Chain(sik).Chain(stk))
 	})
 	return m
 }
@@ -662,7 +806,7 @@ func (m *TestCombinedMetrics) addPerServiceOverflowSpan(timestamp time.Time, ser
 			spm.Count++
 			spm.Sum++
 		}
-		overflow.OverflowSpan.Merge(&spm, Hasher{}.Chain(sk).Chain(sik).Chain(spk).Sum())
+		overflow.OverflowSpan.Merge(&spm, Hasher{}.Chain(sk).Chain(sik).Chain(spk))
 	})
 	return m
 }
@@ -680,7 +824,56 @@ func (m *TestCombinedMetrics) addGlobalServiceOverflowSpan(timestamp time.Time,
 			spm.Count++
 			spm.Sum++
 		}
-		overflow.OverflowSpan.Merge(&spm, Hasher{}.Chain(sk).Chain(sik).Chain(spk).Sum())
+		overflow.OverflowSpan.Merge(&spm, Hasher{}.Chain(sk).Chain(sik).Chain(spk))
+	})
+	return m
+}
+
+func (m *TestCombinedMetrics) addSpanDestination(timestamp time.Time, serviceName, globalLabelsStr string, span testSpan) *TestCombinedMetrics {
+	upsertSIM(m, timestamp, serviceName, globalLabelsStr, func(sim *ServiceInstanceMetrics) {
+		sdk := SpanDestinationAggregationKey{Resource: span.destinationResource}
+		sdm := sim.SpanDestinationGroups[sdk]
+		for i := 0; i < span.count; i++ {
+			sdm.Count++
+			sdm.Sum++
+		}
+		sim.SpanDestinationGroups[sdk] = sdm
+	})
+	return m
+}
+
+func (m *TestCombinedMetrics) addPerServiceOverflowSpanDestination(timestamp time.Time, serviceName, globalLabelsStr string, span testSpan) *TestCombinedMetrics {
+	sk := ServiceAggregationKey{
+		Timestamp:   timestamp,
+		ServiceName: serviceName,
+	}
+	upsertPerServiceOverflow(m, timestamp, serviceName, func(overflow *Overflow) {
+		sik := ServiceInstanceAggregationKey{GlobalLabelsStr: globalLabelsStr}
+		sdk := SpanDestinationAggregationKey{Resource: span.destinationResource}
+		sdm := SpanMetrics{}
+		for i := 0; i < span.count; i++ {
+			sdm.Count++
+			sdm.Sum++
+		}
+		overflow.OverflowSpanDestination.Merge(&sdm, Hasher{}.Chain(sk).Chain(sik).Chain(sdk))
+	})
+	return m
+}
+
+func (m *TestCombinedMetrics) addGlobalServiceOverflowSpanDestination(timestamp time.Time, serviceName, globalLabelsStr string, span testSpan) *TestCombinedMetrics {
+	upsertGlobalServiceOverflow(m, timestamp, serviceName, globalLabelsStr, func(overflow *Overflow) {
+		sk := ServiceAggregationKey{
+			Timestamp:   timestamp,
+			ServiceName: serviceName,
+		}
+		sik := ServiceInstanceAggregationKey{GlobalLabelsStr: globalLabelsStr}
+		sdk := SpanDestinationAggregationKey{Resource: span.destinationResource}
+		sdm := SpanMetrics{}
+		for i := 0; i < span.count; i++ {
+			sdm.Count++
+			sdm.Sum++
+		}
+		overflow.OverflowSpanDestination.Merge(&sdm, Hasher{}.Chain(sk).Chain(sik).Chain(sdk))
 	})
 	return m
 }
@@ -740,7 +933,7 @@ func upsertGlobalServiceOverflow(cm *TestCombinedMetrics, timestamp time.Time, s
 	}
 	sik := ServiceInstanceAggregationKey{GlobalLabelsStr: globalLabelsStr}
 	updater(&cm.OverflowServices)
-	insertHash(&cm.OverflowServiceInstancesEstimator, Hasher{}.Chain(sk).Chain(sik).Sum())
+	insertHash(&cm.OverflowServiceInstancesEstimator, Hasher{}.Chain(sk).Chain(sik))
 }
 
 func TestCardinalityEstimationOnSubKeyCollision(t *testing.T) {
@@ -766,9 +959,112 @@ func TestCardinalityEstimationOnSubKeyCollision(t *testing.T) {
 		addServiceTransaction(ts, "svc3", "", testServiceTransaction{txnType: "type1", count: 5}).
 		addSpan(ts, "svc3", "", testSpan{spanName: "", count: 5}),
 	)
-	merge(&to, &from1, limits)
-	merge(&to, &from2, limits)
+	merge(&to, &from1, limits, Hasher{}, nil)
+	merge(&to, &from2, limits, Hasher{}, nil)
 	assert.Equal(t, uint64(2), to.OverflowServices.OverflowTransaction.Estimator.Estimate())
 	assert.Equal(t, uint64(2), to.OverflowServices.OverflowServiceTransaction.Estimator.Estimate())
 	assert.Equal(t, uint64(2), to.OverflowServices.OverflowSpan.Estimator.Estimate())
 }
+
+func TestMergeCombinedMetrics(t *testing.T) {
+	limits := Limits{
+		MaxSpanGroups:                         100,
+		MaxSpanGroupsPerService:               100,
+		MaxTransactionGroups:                  100,
+		MaxTransactionGroupsPerService:        2,
+		MaxServiceTransactionGroups:           100,
+		MaxServiceTransactionGroupsPerService: 100,
+		MaxServices:                           2,
+		MaxServiceInstanceGroupsPerService:    10,
+	}
+	ts := time.Time{}
+	// Both partials are within the limits, and both overflowed txn4 of
+	// svc1 with their own limits.
+	partial1 := CombinedMetrics(*createTestCombinedMetrics(10).
+		addTransaction(ts, "svc1", "", testTransaction{txnName: "txn1", count: 1}).
+		addTransaction(ts, "svc1", "", testTransaction{txnName: "txn2", count: 1}).
+		addPerServiceOverflowTransaction(ts, "svc1", "", testTransaction{txnName: "txn4", count: 1}).
+		addSpanDestination(ts, "svc1", "", testSpan{destinationResource: "dest1", count: 1}).
+		addServiceInstance(ts, "svc2", ""),
+	)
+	partial2 := CombinedMetrics(*createTestCombinedMetrics(20).
+		addTransaction(ts, "svc1", "", testTransaction{txnName: "txn2", count: 2}).
+		addTransaction(ts, "svc1", "", testTransaction{txnName: "txn3", count: 2}).
+		addPerServiceOverflowTransaction(ts, "svc1", "", testTransaction{txnName: "txn4", count: 2}).
+		addSpanDestination(ts, "svc1", "", testSpan{destinationResource: "dest1", count: 2}).
+		addSpanDestination(ts, "svc1", "", testSpan{destinationResource: "dest2", count: 2}).
+		addServiceInstance(ts, "svc3", ""),
+	)
+	dst := partial1.ToProto()
+	src := partial2.ToProto()
+	require.NoError(t, MergeCombinedMetrics(dst, src, limits))
+
+	var merged CombinedMetrics
+	merged.FromProto(dst)
+	assert.Equal(t, int64(30), merged.eventsTotal)
+
+	// svc3 overflows the max services limit.
+	require.Len(t, merged.Services, 2)
+	assert.Equal(t, uint64(1), merged.OverflowServiceInstancesEstimator.Estimate())
+
+	// txn3 overflows the max transaction groups per service limit, and
+	// the overflow cardinality is estimated from the merged keys rather
+	// than summed: txn3 and txn4, which overflowed in both partials.
+	svc1 := merged.Services[ServiceAggregationKey{Timestamp: ts, ServiceName: "svc1"}]
+	sim := svc1.ServiceInstanceGroups[ServiceInstanceAggregationKey{}]
+	require.Len(t, sim.TransactionGroups, 2)
+	assert.Equal(t, float64(1), sim.TransactionGroups[TransactionAggregationKey{TransactionName: "txn1"}].Histogram.TotalCount())
+	assert.Equal(t, float64(3), sim.TransactionGroups[TransactionAggregationKey{TransactionName: "txn2"}].Histogram.TotalCount())
+	overflow := svc1.OverflowGroups.OverflowTransaction
+	assert.Equal(t, uint64(2), overflow.Estimator.Estimate())
+	assert.Equal(t, float64(5), overflow.Metrics.Histogram.TotalCount())
+
+	// The span destination groups are merged without limit, as the span
+	// destination aggregation is disabled by the zero limit.
+	assert.Equal(t, map[SpanDestinationAggregationKey]SpanMetrics{
+		{Resource: "dest1"}: {Count: 3, Sum: 3},
+		{Resource: "dest2"}: {Count: 2, Sum: 2},
+	}, sim.SpanDestinationGroups)
+	assert.Zero(t, svc1.OverflowGroups.OverflowSpanDestination.Metrics.Count)
+
+	// The source partial is not modified.
+	var unmodified CombinedMetrics
+	unmodified.FromProto(src)
+	assert.Equal(t, int64(20), unmodified.eventsTotal)
+	assert.Len(t, unmodified.Services, 2)
+
+	assert.EqualError(t, MergeCombinedMetrics(nil, src, limits), "combined metrics to merge must not be nil")
+}
+
+func TestMergeDroppedSpansCount(t *testing.T) {
+	limits := Limits{
+		MaxSpanGroups:                         100,
+		MaxSpanGroupsPerService:               100,
+		MaxTransactionGroups:                  100,
+		MaxTransactionGroupsPerService:        1,
+		MaxServiceTransactionGroups:           100,
+		MaxServiceTransactionGroupsPerService: 100,
+		MaxServices:                           10,
+		MaxServiceInstanceGroupsPerService:    10,
+	}
+	ts := time.Time{}
+	partial1 := CombinedMetrics(*createTestCombinedMetrics(10).
+		addTransaction(ts, "svc1", "", testTransaction{txnName: "txn1", count: 1, droppedSpans: 3}),
+	)
+	partial2 := CombinedMetrics(*createTestCombinedMetrics(20).
+		addTransaction(ts, "svc1", "", testTransaction{txnName: "txn1", count: 2, droppedSpans: 4}).
+		addTransaction(ts, "svc1", "", testTransaction{txnName: "txn2", count: 2, droppedSpans: 5}),
+	)
+	dst := partial1.ToProto()
+	require.NoError(t, MergeCombinedMetrics(dst, partial2.ToProto(), limits))
+
+	var merged CombinedMetrics
+	merged.FromProto(dst)
+	svc1 := merged.Services[ServiceAggregationKey{Timestamp: ts, ServiceName: "svc1"}]
+	sim := svc1.ServiceInstanceGroups[ServiceInstanceAggregationKey{}]
+	require.Len(t, sim.TransactionGroups, 1)
+	assert.Equal(t, float64(7), sim.TransactionGroups[TransactionAggregationKey{TransactionName: "txn1"}].DroppedSpansCount)
+	// txn2 overflows the max transaction groups per service limit, and
+	// its dropped spans are accounted for in the overflow bucket.
+	assert.Equal(t, float64(5), svc1.OverflowGroups.OverflowTransaction.Metrics.DroppedSpansCount)
+}
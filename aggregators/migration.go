@@ -0,0 +1,64 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"fmt"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// legacyKeysLowerBound and legacyKeysUpperBound bound the combined metrics
+// keys encoded by the previous, version-less, format. The legacy keys are
+// prefixed by their encoded aggregation interval, which is at least one
+// second, and sort before the versioned keys, see versionedKeyMarker.
+var (
+	legacyKeysLowerBound = []byte{0x00, 0x01}
+	legacyKeysUpperBound = []byte{versionedKeyMarker}
+)
+
+// migrateLegacyKeys rewrites the combined metrics keys encoded by the
+// previous, version-less, format, for example, written before upgrading
+// the aggregator, to the current version so that they are harvested. The
+// merged values are preserved. It returns the number of migrated keys.
+func migrateLegacyKeys(db *pebble.DB, wo *pebble.WriteOptions) (int, error) {
+	iter := db.NewIter(&pebble.IterOptions{
+		LowerBound: legacyKeysLowerBound,
+		UpperBound: legacyKeysUpperBound,
+		KeyTypes:   pebble.IterKeyTypePointsOnly,
+	})
+	defer iter.Close()
+
+	batch := db.NewBatch()
+	defer batch.Close()
+	var migrated int
+	for iter.First(); iter.Valid(); iter.Next() {
+		var cmk CombinedMetricsKey
+		if err := cmk.unmarshalLegacyBinary(iter.Key()); err != nil {
+			return 0, fmt.Errorf("failed to decode legacy combined metrics key: %w", err)
+		}
+		key := make([]byte, cmk.SizeBinary())
+		if err := cmk.MarshalBinaryToSizedBuffer(key); err != nil {
+			return 0, fmt.Errorf("failed to encode combined metrics key: %w", err)
+		}
+		if err := batch.Set(key, iter.Value(), nil); err != nil {
+			return 0, fmt.Errorf("failed to write migrated combined metrics: %w", err)
+		}
+		if err := batch.Delete(iter.Key(), nil); err != nil {
+			return 0, fmt.Errorf("failed to delete legacy combined metrics: %w", err)
+		}
+		migrated++
+	}
+	if err := iter.Error(); err != nil {
+		return 0, fmt.Errorf("failed to iterate legacy combined metrics: %w", err)
+	}
+	if batch.Empty() {
+		return 0, nil
+	}
+	if err := batch.Commit(wo); err != nil {
+		return 0, fmt.Errorf("failed to commit migrated combined metrics: %w", err)
+	}
+	return migrated, nil
+}
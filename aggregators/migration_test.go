@@ -0,0 +1,77 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestMigrateLegacyKeys(t *testing.T) {
+	dir := t.TempDir()
+	processingTime := time.Now().Truncate(time.Minute)
+	var harvested []CombinedMetricsKey
+	var eventsTotal int64
+	newAgg := func() *Aggregator {
+		agg, err := New(AggregatorConfig{
+			DataDir: dir,
+			Limits: Limits{
+				MaxSpanGroups:                         1000,
+				MaxSpanGroupsPerService:               100,
+				MaxTransactionGroups:                  100,
+				MaxTransactionGroupsPerService:        10,
+				MaxServiceTransactionGroups:           100,
+				MaxServiceTransactionGroupsPerService: 10,
+				MaxServices:                           10,
+				MaxServiceInstanceGroupsPerService:    10,
+			},
+			Processor: func(_ context.Context, cmk CombinedMetricsKey, cm CombinedMetrics, _ time.Duration) error {
+				harvested = append(harvested, cmk)
+				eventsTotal += cm.eventsTotal
+				return nil
+			},
+			AggregationIntervals: []time.Duration{time.Minute},
+			HarvestDelay:         time.Hour, // disable auto harvest
+		}, zap.NewNop())
+		require.NoError(t, err)
+		return agg
+	}
+
+	// Write combined metrics keyed by the previous, version-less, format
+	// as written before upgrading the aggregator.
+	agg := newAgg()
+	cmk := CombinedMetricsKey{Interval: time.Minute, ProcessingTime: processingTime, ID: "legacy"}
+	cm := CombinedMetrics(*createTestCombinedMetrics(5).
+		addTransaction(processingTime, "svc", "", testTransaction{txnName: "txn", txnType: "type", count: 5}))
+	value, err := cm.MarshalBinary()
+	require.NoError(t, err)
+	require.NoError(t, agg.stores[0].db.Set(legacyCombinedMetricsKey(cmk), value, pebble.Sync))
+	require.NoError(t, agg.stores[0].db.Merge(legacyCombinedMetricsKey(cmk), value, pebble.Sync))
+	require.NoError(t, agg.Stop(context.Background()))
+	assert.Empty(t, harvested)
+
+	agg = newAgg()
+	defer agg.Stop(context.Background())
+	iter := agg.stores[0].db.NewIter(&pebble.IterOptions{
+		LowerBound: legacyKeysLowerBound,
+		UpperBound: legacyKeysUpperBound,
+	})
+	assert.False(t, iter.First(), "legacy keys must be deleted")
+	require.NoError(t, iter.Close())
+
+	require.NoError(t, agg.Flush(context.Background()))
+	require.Len(t, harvested, 1)
+	assert.Equal(t, "legacy", harvested[0].ID)
+	assert.Equal(t, time.Minute, harvested[0].Interval)
+	assert.True(t, processingTime.Equal(harvested[0].ProcessingTime))
+	// The merged value of the legacy key is preserved.
+	assert.Equal(t, int64(10), eventsTotal)
+}
@@ -58,6 +58,14 @@ func (nb *NullableBool) ToBoolPtr() *bool {
 
 // Limits define the aggregation limits. Once the limits are reached
 // the metrics will overflow into dedicated overflow buckets.
+//
+// The limits on the aggregation groups are enforced independently for
+// each type of aggregation group, and the groups exceeding a limit
+// overflow into the overflow bucket of their type. For example, span
+// groups exceeding MaxSpanGroups never take up the capacity of
+// MaxTransactionGroups, and vice versa. The limits on the services and
+// service instance groups are shared by all the types of aggregation
+// groups of the services.
 type Limits struct {
 	// MaxServices is the limit on the total number of unique services.
 	// A unique service is identified by a unique ServiceAggregationKey.
@@ -67,7 +75,10 @@ type Limits struct {
 	// MaxServiceInstanceGroupsPerService is the limit on the total number
 	// of unique service instance groups within a service.
 	// A unique service instance group within a service is identified by a
-	// unique ServiceInstanceAggregationKey.
+	// unique ServiceInstanceAggregationKey. The metrics of the service
+	// instance groups exceeding the limit are aggregated into the overflow
+	// buckets of the service, and the overflowed service instance groups
+	// are counted by CombinedMetrics.OverflowServiceInstancesEstimator.
 	MaxServiceInstanceGroupsPerService int
 
 	// MaxSpanGroups is the limit on total number of unique span groups
@@ -82,6 +93,14 @@ type Limits struct {
 	// SpanAggregationKey.
 	MaxSpanGroupsPerService int
 
+	// MaxSpanDestinationsPerService is the limit on the total number of
+	// unique span destination groups within a service.
+	// A unique span destination group within a service is identified by
+	// a unique SpanDestinationAggregationKey.
+	// Span destination groups are only aggregated if the limit is positive,
+	// otherwise, the groups already aggregated are merged without limit.
+	MaxSpanDestinationsPerService int
+
 	// MaxTransactionGroups is the limit on total number of unique
 	// transaction groups across all services.
 	// A unique transaction group is identified by a unique
@@ -138,6 +157,13 @@ type CombinedMetrics struct {
 	// instance aggregation keys that overflowed due to max services limit or
 	// max service instances per service limit.
 	OverflowServiceInstancesEstimator *hyperloglog.Sketch
+
+	// Labels holds the static labels configured by
+	// AggregatorConfig.HarvestLabels, set on harvest. Labels are not
+	// encoded and are not part of any aggregation key, thus, they are
+	// only set for the harvested combined metrics passed to the
+	// Processor.
+	Labels map[string]string
 }
 
 // ServiceAggregationKey models the key used to store service specific
@@ -171,7 +197,9 @@ type ServiceMetrics struct {
 }
 
 // ServiceInstanceAggregationKey models the key used to store service instance specific
-// aggregation metrics.
+// aggregation metrics. Service instances are identified by the global labels of
+// the events, the events without global labels are aggregated into the service
+// instance with an empty GlobalLabelsStr.
 type ServiceInstanceAggregationKey struct {
 	GlobalLabelsStr string
 }
@@ -188,18 +216,35 @@ type ServiceInstanceMetrics struct {
 	TransactionGroups        map[TransactionAggregationKey]TransactionMetrics
 	ServiceTransactionGroups map[ServiceTransactionAggregationKey]ServiceTransactionMetrics
 	SpanGroups               map[SpanAggregationKey]SpanMetrics
+	SpanDestinationGroups    map[SpanDestinationAggregationKey]SpanMetrics
+}
+
+// newEstimator returns a new cardinality estimator with a precision of
+// 16 if requested, or the default precision of 14 otherwise.
+func newEstimator(precision uint8) *hyperloglog.Sketch {
+	if precision == 16 {
+		return hyperloglog.New16()
+	}
+	return hyperloglog.New14()
 }
 
-func insertHash(estimator **hyperloglog.Sketch, hash uint64) {
+// insertHash inserts the sum of the hash into the estimator, creating
+// the estimator with the precision of the hash if nil.
+func insertHash(estimator **hyperloglog.Sketch, hash Hasher) {
 	if *estimator == nil {
-		*estimator = hyperloglog.New14()
+		*estimator = newEstimator(hash.precision)
 	}
-	(*estimator).InsertHash(hash)
+	(*estimator).InsertHash(hash.Sum())
 }
 
+// mergeEstimator merges from into the estimator to, creating to with the
+// precision of from if nil. Estimators with different precisions can not
+// be merged, in which case from is ignored and the estimate of to is
+// kept as is.
 func mergeEstimator(to **hyperloglog.Sketch, from *hyperloglog.Sketch) {
 	if *to == nil {
-		*to = hyperloglog.New14()
+		*to = from.Clone()
+		return
 	}
 	(*to).Merge(from)
 }
@@ -209,7 +254,7 @@ type OverflowTransaction struct {
 	Estimator *hyperloglog.Sketch
 }
 
-func (o *OverflowTransaction) Merge(from *TransactionMetrics, hash uint64) {
+func (o *OverflowTransaction) Merge(from *TransactionMetrics, hash Hasher) {
 	o.Metrics.Merge(from)
 	insertHash(&o.Estimator, hash)
 }
@@ -230,7 +275,7 @@ type OverflowServiceTransaction struct {
 	Estimator *hyperloglog.Sketch
 }
 
-func (o *OverflowServiceTransaction) Merge(from *ServiceTransactionMetrics, hash uint64) {
+func (o *OverflowServiceTransaction) Merge(from *ServiceTransactionMetrics, hash Hasher) {
 	o.Metrics.Merge(from)
 	insertHash(&o.Estimator, hash)
 }
@@ -251,7 +296,7 @@ type OverflowSpan struct {
 	Estimator *hyperloglog.Sketch
 }
 
-func (o *OverflowSpan) Merge(from *SpanMetrics, hash uint64) {
+func (o *OverflowSpan) Merge(from *SpanMetrics, hash Hasher) {
 	o.Metrics.Merge(from)
 	insertHash(&o.Estimator, hash)
 }
@@ -273,6 +318,7 @@ type Overflow struct {
 	OverflowTransaction        OverflowTransaction
 	OverflowServiceTransaction OverflowServiceTransaction
 	OverflowSpan               OverflowSpan
+	OverflowSpanDestination    OverflowSpan
 }
 
 // TransactionAggregationKey models the key used to store transaction
@@ -371,6 +417,27 @@ func (k TransactionAggregationKey) Hash(h xxhash.Digest) xxhash.Digest {
 // exceed the limit for the slice data structure.
 type TransactionMetrics struct {
 	Histogram *hdrhistogram.HistogramRepresentation
+	// DroppedSpansCount is the number of spans dropped by the aggregated
+	// transactions, as reported by their span count, scaled by their
+	// representative count. The average number of dropped spans per
+	// transaction is DroppedSpansCount divided by the total count of the
+	// histogram.
+	DroppedSpansCount float64
+	// Percentiles holds the durations at the percentiles configured by
+	// AggregatorConfig.Percentiles, computed from the histogram on
+	// harvest. Percentiles are not encoded, thus, they are only set for
+	// the harvested combined metrics passed to the Processor.
+	Percentiles []Percentile
+}
+
+// Percentile is the duration at a percentile of the durations recorded
+// by a histogram.
+type Percentile struct {
+	// Percentile is the percentile, between 0 and 100.
+	Percentile float64
+	// Duration is the highest duration equivalent, within the precision
+	// of the histogram, to the recorded duration at the percentile.
+	Duration time.Duration
 }
 
 func (m *TransactionMetrics) Merge(from *TransactionMetrics) {
@@ -410,6 +477,21 @@ func (m *SpanMetrics) Merge(from *SpanMetrics) {
 	mergeSpanMetrics(m, from)
 }
 
+// SpanDestinationAggregationKey models the key used to store span
+// destination aggregation metrics. Unlike SpanAggregationKey, which
+// also includes the span name, outcome and target, the key only
+// identifies the destination resource of the spans, aggregating the
+// spans of a service per dependency.
+type SpanDestinationAggregationKey struct {
+	Resource string
+}
+
+// Hash returns a xxhash.Digest after hashing the aggregation key on top of h.
+func (k SpanDestinationAggregationKey) Hash(h xxhash.Digest) xxhash.Digest {
+	h.WriteString(k.Resource)
+	return h
+}
+
 // ServiceTransactionAggregationKey models the key used to store
 // service transaction aggregation metrics.
 type ServiceTransactionAggregationKey struct {
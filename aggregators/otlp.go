@@ -0,0 +1,200 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/elastic/apm-data/model/modelpb"
+)
+
+// OTLPTransactionDurationMetric is the name of the OTLP histogram metric
+// which is mapped onto the aggregated transaction metrics.
+const OTLPTransactionDurationMetric = "transaction.duration"
+
+// ErrUnsupportedOTLPMetric is returned when aggregating OTLP metrics which
+// can not be mapped onto the aggregated metrics.
+var ErrUnsupportedOTLPMetric = errors.New("unsupported OTLP metric")
+
+// otlpDurationUnits maps the supported OTLP units of the transaction
+// duration histogram to the duration of one unit.
+var otlpDurationUnits = map[string]time.Duration{
+	"s":  time.Second,
+	"ms": time.Millisecond,
+	"us": time.Microsecond,
+	"ns": time.Nanosecond,
+}
+
+// AggregateOTLPMetrics aggregates OTLP metrics into the same aggregated
+// metrics as the APM events aggregated by AggregateBatch, including the
+// limits and overflows.
+//
+// Only delta temporality histograms named OTLPTransactionDurationMetric,
+// with one of the units s, ms, us or ns, are supported. Each data point is
+// mapped onto transaction events using the following attributes:
+//
+//   - service.name, service.version, deployment.environment and
+//     telemetry.sdk.language resource attributes for the service.
+//   - service.instance.id resource attribute for the service node name.
+//   - transaction.name, transaction.type, transaction.result and
+//     event.outcome data point attributes for the transaction.
+//
+// Each non-empty histogram bucket is aggregated as a transaction event
+// with the bucket count as its representative count and the midpoint of
+// the bucket bounds as its duration. The overflow bucket, which has no
+// upper bound, uses its lower bound as the duration. The data point
+// timestamp is used as the event timestamp.
+//
+// ErrUnsupportedOTLPMetric is returned, without aggregating any of the
+// metrics, if any of the metrics can not be mapped.
+func (a *Aggregator) AggregateOTLPMetrics(
+	ctx context.Context,
+	id string,
+	md pmetric.Metrics,
+) error {
+	b, err := otlpMetricsToBatch(md)
+	if err != nil {
+		return err
+	}
+	return a.AggregateBatch(ctx, id, &b)
+}
+
+func otlpMetricsToBatch(md pmetric.Metrics) (modelpb.Batch, error) {
+	var b modelpb.Batch
+	rms := md.ResourceMetrics()
+	for i := 0; i < rms.Len(); i++ {
+		rm := rms.At(i)
+		base := otlpResourceToAPMEvent(rm.Resource())
+		sms := rm.ScopeMetrics()
+		for j := 0; j < sms.Len(); j++ {
+			ms := sms.At(j).Metrics()
+			for k := 0; k < ms.Len(); k++ {
+				var err error
+				if b, err = appendOTLPMetric(b, base, ms.At(k)); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return b, nil
+}
+
+func appendOTLPMetric(b modelpb.Batch, base *modelpb.APMEvent, m pmetric.Metric) (modelpb.Batch, error) {
+	if m.Name() != OTLPTransactionDurationMetric {
+		return nil, fmt.Errorf("%w: metric %q", ErrUnsupportedOTLPMetric, m.Name())
+	}
+	if m.Type() != pmetric.MetricTypeHistogram {
+		return nil, fmt.Errorf(
+			"%w: metric %q of type %s, expected %s",
+			ErrUnsupportedOTLPMetric, m.Name(), m.Type(), pmetric.MetricTypeHistogram,
+		)
+	}
+	h := m.Histogram()
+	if h.AggregationTemporality() != pmetric.AggregationTemporalityDelta {
+		return nil, fmt.Errorf(
+			"%w: metric %q with %s temporality, expected %s",
+			ErrUnsupportedOTLPMetric, m.Name(), h.AggregationTemporality(), pmetric.AggregationTemporalityDelta,
+		)
+	}
+	unit, ok := otlpDurationUnits[m.Unit()]
+	if !ok {
+		return nil, fmt.Errorf("%w: metric %q with unit %q", ErrUnsupportedOTLPMetric, m.Name(), m.Unit())
+	}
+	dps := h.DataPoints()
+	for i := 0; i < dps.Len(); i++ {
+		dp := dps.At(i)
+		counts := dp.BucketCounts()
+		bounds := dp.ExplicitBounds()
+		if counts.Len() != bounds.Len()+1 {
+			return nil, fmt.Errorf(
+				"%w: metric %q with %d bucket counts for %d explicit bounds",
+				ErrUnsupportedOTLPMetric, m.Name(), counts.Len(), bounds.Len(),
+			)
+		}
+		for j := 0; j < counts.Len(); j++ {
+			count := counts.At(j)
+			if count == 0 {
+				continue
+			}
+			var value float64
+			switch {
+			case bounds.Len() == 0:
+				if dp.HasSum() {
+					value = dp.Sum() / float64(count)
+				}
+			case j == 0:
+				value = bounds.At(0) / 2
+			case j == bounds.Len():
+				value = bounds.At(j - 1)
+			default:
+				value = (bounds.At(j-1) + bounds.At(j)) / 2
+			}
+			if value < 0 {
+				value = 0
+			}
+			b = append(b, otlpDataPointToAPMEvent(base, dp, time.Duration(value*float64(unit)), count))
+		}
+	}
+	return b, nil
+}
+
+func otlpResourceToAPMEvent(r pcommon.Resource) *modelpb.APMEvent {
+	attrs := r.Attributes()
+	language := otlpStr(attrs, "telemetry.sdk.language")
+	agentName := "opentelemetry"
+	if language != "" {
+		agentName += "/" + language
+	}
+	return &modelpb.APMEvent{
+		Agent: &modelpb.Agent{Name: agentName},
+		Service: &modelpb.Service{
+			Name:        otlpStr(attrs, "service.name"),
+			Version:     otlpStr(attrs, "service.version"),
+			Environment: otlpStr(attrs, "deployment.environment"),
+			Language:    &modelpb.Language{Name: language},
+			Node:        &modelpb.ServiceNode{Name: otlpStr(attrs, "service.instance.id")},
+		},
+	}
+}
+
+func otlpDataPointToAPMEvent(
+	base *modelpb.APMEvent,
+	dp pmetric.HistogramDataPoint,
+	duration time.Duration,
+	count uint64,
+) *modelpb.APMEvent {
+	attrs := dp.Attributes()
+	return &modelpb.APMEvent{
+		Timestamp: timestamppb.New(dp.Timestamp().AsTime()),
+		Processor: modelpb.TransactionProcessor(),
+		Agent:     base.Agent,
+		Service:   base.Service,
+		Event: &modelpb.Event{
+			Outcome:  otlpStr(attrs, "event.outcome"),
+			Duration: durationpb.New(duration),
+		},
+		Transaction: &modelpb.Transaction{
+			Name:                otlpStr(attrs, "transaction.name"),
+			Type:                otlpStr(attrs, "transaction.type"),
+			Result:              otlpStr(attrs, "transaction.result"),
+			RepresentativeCount: float64(count),
+		},
+	}
+}
+
+func otlpStr(attrs pcommon.Map, key string) string {
+	if v, ok := attrs.Get(key); ok {
+		return v.AsString()
+	}
+	return ""
+}
@@ -0,0 +1,164 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+)
+
+func TestAggregateOTLPMetrics(t *testing.T) {
+	forEachStore(t, testAggregateOTLPMetrics)
+}
+
+func testAggregateOTLPMetrics(t *testing.T, newStore newStoreFunc) {
+	var harvested []CombinedMetrics
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore: newStore,
+		Processor: func(_ context.Context, _ CombinedMetricsKey, cm CombinedMetrics, _ time.Duration) error {
+			harvested = append(harvested, cm)
+			return nil
+		},
+		AggregationIntervals: []time.Duration{time.Minute},
+	})
+
+	ts := time.Unix(0, 0).UTC()
+	md := pmetric.NewMetrics()
+	rm := md.ResourceMetrics().AppendEmpty()
+	rm.Resource().Attributes().PutStr("service.name", "svc1")
+	rm.Resource().Attributes().PutStr("deployment.environment", "production")
+	rm.Resource().Attributes().PutStr("telemetry.sdk.language", "go")
+	m := rm.ScopeMetrics().AppendEmpty().Metrics().AppendEmpty()
+	m.SetName(OTLPTransactionDurationMetric)
+	m.SetUnit("ms")
+	h := m.SetEmptyHistogram()
+	h.SetAggregationTemporality(pmetric.AggregationTemporalityDelta)
+	for _, outcome := range []string{"success", "failure"} {
+		dp := h.DataPoints().AppendEmpty()
+		dp.SetTimestamp(pcommon.NewTimestampFromTime(ts))
+		dp.Attributes().PutStr("transaction.name", "GET /")
+		dp.Attributes().PutStr("transaction.type", "request")
+		dp.Attributes().PutStr("event.outcome", outcome)
+		dp.ExplicitBounds().FromRaw([]float64{10, 100, 1000})
+		dp.BucketCounts().FromRaw([]uint64{1, 0, 3, 1})
+		dp.SetCount(5)
+	}
+
+	require.NoError(t, agg.AggregateOTLPMetrics(context.Background(), "id", md))
+	require.NoError(t, agg.Stop(context.Background()))
+
+	require.Len(t, harvested, 1)
+	require.Len(t, harvested[0].Services, 1)
+	for sk, sm := range harvested[0].Services {
+		assert.Equal(t, ServiceAggregationKey{
+			Timestamp:           ts,
+			ServiceName:         "svc1",
+			ServiceEnvironment:  "production",
+			ServiceLanguageName: "go",
+			AgentName:           "opentelemetry/go",
+		}, sk)
+		require.Len(t, sm.ServiceInstanceGroups, 1)
+		for _, sim := range sm.ServiceInstanceGroups {
+			require.Len(t, sim.TransactionGroups, 2)
+			for tk, tm := range sim.TransactionGroups {
+				assert.Equal(t, "GET /", tk.TransactionName)
+				assert.Equal(t, "request", tk.TransactionType)
+				total, counts, values := tm.Histogram.Buckets()
+				assert.Equal(t, int64(5), total)
+				require.Len(t, counts, 3)
+				assert.Equal(t, []int64{1, 3, 1}, counts)
+				// Histogram values are in microseconds and subject to the
+				// histogram precision.
+				assert.InEpsilon(t, float64(5*time.Millisecond.Microseconds()), values[0], 0.01)
+				assert.InEpsilon(t, float64(550*time.Millisecond.Microseconds()), values[1], 0.01)
+				assert.InEpsilon(t, float64(time.Second.Microseconds()), values[2], 0.01)
+			}
+			require.Len(t, sim.ServiceTransactionGroups, 1)
+			for _, stm := range sim.ServiceTransactionGroups {
+				assert.Equal(t, float64(5), stm.SuccessCount)
+				assert.Equal(t, float64(5), stm.FailureCount)
+			}
+		}
+	}
+}
+
+func TestAggregateOTLPMetricsUnsupported(t *testing.T) {
+	forEachStore(t, testAggregateOTLPMetricsUnsupported)
+}
+
+func testAggregateOTLPMetricsUnsupported(t *testing.T, newStore newStoreFunc) {
+	for _, tc := range []struct {
+		name     string
+		metric   func(pmetric.Metric)
+		expected string
+	}{
+		{
+			name: "name",
+			metric: func(m pmetric.Metric) {
+				m.SetName("http.server.duration")
+				m.SetEmptyHistogram()
+			},
+			expected: `unsupported OTLP metric: metric "http.server.duration"`,
+		},
+		{
+			name: "type",
+			metric: func(m pmetric.Metric) {
+				m.SetName(OTLPTransactionDurationMetric)
+				m.SetEmptyGauge()
+			},
+			expected: `unsupported OTLP metric: metric "transaction.duration" of type Gauge, expected Histogram`,
+		},
+		{
+			name: "temporality",
+			metric: func(m pmetric.Metric) {
+				m.SetName(OTLPTransactionDurationMetric)
+				m.SetUnit("ms")
+				m.SetEmptyHistogram().SetAggregationTemporality(pmetric.AggregationTemporalityCumulative)
+			},
+			expected: `unsupported OTLP metric: metric "transaction.duration" with Cumulative temporality, expected Delta`,
+		},
+		{
+			name: "unit",
+			metric: func(m pmetric.Metric) {
+				m.SetName(OTLPTransactionDurationMetric)
+				m.SetUnit("By")
+				m.SetEmptyHistogram().SetAggregationTemporality(pmetric.AggregationTemporalityDelta)
+			},
+			expected: `unsupported OTLP metric: metric "transaction.duration" with unit "By"`,
+		},
+		{
+			name: "buckets",
+			metric: func(m pmetric.Metric) {
+				m.SetName(OTLPTransactionDurationMetric)
+				m.SetUnit("s")
+				h := m.SetEmptyHistogram()
+				h.SetAggregationTemporality(pmetric.AggregationTemporalityDelta)
+				dp := h.DataPoints().AppendEmpty()
+				dp.ExplicitBounds().FromRaw([]float64{1})
+				dp.BucketCounts().FromRaw([]uint64{1})
+			},
+			expected: `unsupported OTLP metric: metric "transaction.duration" with 1 bucket counts for 1 explicit bounds`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			agg := newTestAggregator(t, AggregatorConfig{
+				NewStore:             newStore,
+				AggregationIntervals: []time.Duration{time.Minute},
+			})
+
+			md := pmetric.NewMetrics()
+			tc.metric(md.ResourceMetrics().AppendEmpty().ScopeMetrics().AppendEmpty().Metrics().AppendEmpty())
+			err := agg.AggregateOTLPMetrics(context.Background(), "id", md)
+			assert.ErrorIs(t, err, ErrUnsupportedOTLPMetric)
+			assert.EqualError(t, err, tc.expected)
+		})
+	}
+}
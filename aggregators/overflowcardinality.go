@@ -0,0 +1,92 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"sync"
+	"time"
+
+	"github.com/axiomhq/hyperloglog"
+)
+
+// overflowCardinality holds the estimated cardinality of the overflow
+// buckets of the combined metrics harvested by the last harvest of each
+// aggregation interval, by overflow type.
+type overflowCardinality struct {
+	mu   sync.Mutex
+	last map[time.Duration]map[string]int64
+}
+
+func newOverflowCardinality() *overflowCardinality {
+	return &overflowCardinality{
+		last: make(map[time.Duration]map[string]int64),
+	}
+}
+
+// harvested replaces the estimated cardinality of the aggregation interval
+// with the estimated cardinality of the harvested combined metrics.
+func (o *overflowCardinality) harvested(ivl time.Duration, cardinality map[string]int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.last[ivl] = cardinality
+}
+
+// reset clears the estimated cardinality of all the aggregation intervals.
+func (o *overflowCardinality) reset() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.last = make(map[time.Duration]map[string]int64)
+}
+
+// get returns a copy of the estimated cardinality per aggregation interval
+// and overflow type.
+func (o *overflowCardinality) get() map[time.Duration]map[string]int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	m := make(map[time.Duration]map[string]int64, len(o.last))
+	for ivl, byType := range o.last {
+		m[ivl] = make(map[string]int64, len(byType))
+		for typ, n := range byType {
+			m[ivl][typ] = n
+		}
+	}
+	return m
+}
+
+// newOverflowCardinalities returns the estimated cardinality by overflow
+// type with zero estimates for all the overflow types.
+func newOverflowCardinalities() map[string]int64 {
+	return map[string]int64{
+		overflowTypeService:            0,
+		overflowTypeTransaction:        0,
+		overflowTypeServiceTransaction: 0,
+		overflowTypeSpan:               0,
+		overflowTypeSpanDestination:    0,
+	}
+}
+
+// addOverflowCardinalities adds the estimated cardinality of the overflow
+// buckets of the combined metrics, as estimated by their HyperLogLog
+// sketches, to the given estimates by overflow type. The service overflow
+// type is estimated by the number of distinct overflowed service instances,
+// other overflow types by the number of distinct overflowed aggregation
+// groups of the type within each service.
+func addOverflowCardinalities(cardinality map[string]int64, cm *CombinedMetrics) {
+	cardinality[overflowTypeService] += estimate(cm.OverflowServiceInstancesEstimator)
+	for _, sm := range cm.Services {
+		o := &sm.OverflowGroups
+		cardinality[overflowTypeTransaction] += estimate(o.OverflowTransaction.Estimator)
+		cardinality[overflowTypeServiceTransaction] += estimate(o.OverflowServiceTransaction.Estimator)
+		cardinality[overflowTypeSpan] += estimate(o.OverflowSpan.Estimator)
+		cardinality[overflowTypeSpanDestination] += estimate(o.OverflowSpanDestination.Estimator)
+	}
+}
+
+func estimate(estimator *hyperloglog.Sketch) int64 {
+	if estimator == nil {
+		return 0
+	}
+	return int64(estimator.Estimate())
+}
@@ -0,0 +1,93 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// overflowLogger logs, at debug level, a sample of the aggregation keys
+// merged into the overflow buckets for identifying the entities causing
+// the overflows. At most one record is logged per overflow type every
+// interval, with at most sampleSize keys. A nil overflowLogger discards
+// all the overflowed keys.
+type overflowLogger struct {
+	logger     *zap.Logger
+	sampleSize int
+	interval   time.Duration
+	now        func() time.Time
+
+	mu      sync.Mutex
+	samples map[string]*overflowSample
+}
+
+// overflowSample holds the aggregation keys overflowed for an overflow
+// type since the last logged record.
+type overflowSample struct {
+	keys     []string
+	count    int
+	loggedAt time.Time
+}
+
+// newOverflowLogger returns a new overflowLogger, or nil if sampleSize is
+// not positive.
+func newOverflowLogger(
+	logger *zap.Logger,
+	sampleSize int,
+	interval time.Duration,
+) *overflowLogger {
+	if sampleSize <= 0 || !logger.Core().Enabled(zap.DebugLevel) {
+		return nil
+	}
+	return &overflowLogger{
+		logger:     logger,
+		sampleSize: sampleSize,
+		interval:   interval,
+		now:        time.Now,
+		samples:    make(map[string]*overflowSample),
+	}
+}
+
+// record records an aggregation key of the given overflow type, identified
+// by the service name and the name of the aggregation group, which was
+// merged into an overflow bucket. The name is empty for services merged
+// into the overflow service.
+func (l *overflowLogger) record(overflowType, service, name string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s, ok := l.samples[overflowType]
+	if !ok {
+		s = &overflowSample{}
+		l.samples[overflowType] = s
+	}
+	s.count++
+	if len(s.keys) < l.sampleSize {
+		key := service
+		if name != "" {
+			key += "/" + name
+		}
+		s.keys = append(s.keys, key)
+	}
+	now := l.now()
+	if !s.loggedAt.IsZero() && now.Sub(s.loggedAt) < l.interval {
+		return
+	}
+	l.logger.Debug(
+		"aggregation groups merged into overflow buckets",
+		zap.String("overflow_type", overflowType),
+		zap.Int("overflowed", s.count),
+		zap.Strings("sampled_keys", s.keys),
+	)
+	s.keys = nil
+	s.count = 0
+	s.loggedAt = now
+}
@@ -0,0 +1,97 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestOverflowLogger(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	ol := newOverflowLogger(zap.New(core), 2, time.Minute)
+	require.NotNil(t, ol)
+	now := time.Unix(0, 0)
+	ol.now = func() time.Time { return now }
+
+	// The first overflow is logged immediately.
+	ol.record(overflowTypeService, "svc0", "")
+	for i := 1; i < 5; i++ {
+		ol.record(overflowTypeTransaction, "svc1", fmt.Sprintf("txn%d", i))
+	}
+	for i := 1; i < 5; i++ {
+		now = now.Add(10 * time.Second)
+		ol.record(overflowTypeService, fmt.Sprintf("svc%d", i), "")
+	}
+	// The records are rate limited per overflow type and capped to the
+	// sample size.
+	now = now.Add(time.Minute)
+	ol.record(overflowTypeService, "svc5", "")
+
+	entries := logs.AllUntimed()
+	require.Len(t, entries, 3)
+	for _, e := range entries {
+		assert.Equal(t, zapcore.DebugLevel, e.Level)
+		assert.Equal(t, "aggregation groups merged into overflow buckets", e.Message)
+	}
+	assert.Equal(t, map[string]interface{}{
+		"overflow_type": overflowTypeService,
+		"overflowed":    int64(1),
+		"sampled_keys":  []interface{}{"svc0"},
+	}, entries[0].ContextMap())
+	assert.Equal(t, map[string]interface{}{
+		"overflow_type": overflowTypeTransaction,
+		"overflowed":    int64(1),
+		"sampled_keys":  []interface{}{"svc1/txn1"},
+	}, entries[1].ContextMap())
+	assert.Equal(t, map[string]interface{}{
+		"overflow_type": overflowTypeService,
+		"overflowed":    int64(5),
+		"sampled_keys":  []interface{}{"svc1", "svc2"},
+	}, entries[2].ContextMap())
+}
+
+func TestOverflowLoggerDisabled(t *testing.T) {
+	core, _ := observer.New(zapcore.DebugLevel)
+	assert.Nil(t, newOverflowLogger(zap.New(core), 0, time.Minute))
+	infoCore, _ := observer.New(zapcore.InfoLevel)
+	assert.Nil(t, newOverflowLogger(zap.New(infoCore), 10, time.Minute))
+
+	// A nil overflow logger discards the overflowed keys.
+	var ol *overflowLogger
+	ol.record(overflowTypeService, "svc", "")
+}
+
+func TestMergeOverflowLogging(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	ol := newOverflowLogger(zap.New(core), 10, time.Minute)
+	ts := time.Unix(0, 0).UTC()
+	to := CombinedMetrics(*createTestCombinedMetrics(1).
+		addTransaction(ts, "svc1", "", testTransaction{txnName: "txn1", txnType: "type1", count: 1}))
+	from := CombinedMetrics(*createTestCombinedMetrics(1).
+		addTransaction(ts, "svc2", "", testTransaction{txnName: "txn2", txnType: "type1", count: 1}))
+	merge(&to, &from, Limits{
+		MaxTransactionGroups:           100,
+		MaxTransactionGroupsPerService: 100,
+		MaxServices:                    1,
+	}, Hasher{}, ol)
+
+	overflowTypes := make(map[string][]interface{})
+	for _, e := range logs.AllUntimed() {
+		fields := e.ContextMap()
+		overflowTypes[fields["overflow_type"].(string)] = fields["sampled_keys"].([]interface{})
+	}
+	assert.Equal(t, map[string][]interface{}{
+		overflowTypeService:     {"svc2"},
+		overflowTypeTransaction: {"svc2/txn2"},
+	}, overflowTypes)
+}
@@ -0,0 +1,106 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"errors"
+	"fmt"
+)
+
+// overflowTracker reports the events of a batch which are aggregated into
+// overflow buckets. The limits are only enforced when the store merges the
+// aggregated metrics, so the tracker merges the combined metrics of the
+// events into a copy of the aggregated metrics of their combined metrics
+// key, using the same limits as the store, and reports the events which
+// increase the number of overflowed events of the copy.
+//
+// The aggregated metrics of a key are read at most once per batch, the
+// caller must commit the pending aggregations before tracking a batch
+// and hold the aggregator's lock while tracking it.
+type overflowTracker struct {
+	a       *Aggregator
+	metrics map[CombinedMetricsKey]*trackedMetrics
+}
+
+// trackedMetrics is the copy of the aggregated metrics of a combined
+// metrics key along with their number of overflowed events. It is nil
+// for the keys whose aggregated metrics failed to be read.
+type trackedMetrics struct {
+	cm         CombinedMetrics
+	overflowed float64
+}
+
+func newOverflowTracker(a *Aggregator) *overflowTracker {
+	return &overflowTracker{
+		a:       a,
+		metrics: make(map[CombinedMetricsKey]*trackedMetrics),
+	}
+}
+
+// track merges the combined metrics of an event aggregated for the key and
+// returns true if any of them was merged into an overflow bucket. The
+// combined metrics must not be used after calling track. The error is
+// non-nil if the aggregated metrics of the key could not be read, in
+// which case the events of the key are never reported as overflowed.
+func (t *overflowTracker) track(cmk CombinedMetricsKey, cm *CombinedMetrics) (bool, error) {
+	tm, ok := t.metrics[cmk]
+	if !ok {
+		var err error
+		tm, err = t.load(cmk)
+		t.metrics[cmk] = tm
+		if err != nil {
+			return false, err
+		}
+	}
+	if tm == nil {
+		return false, nil
+	}
+	merge(
+		&tm.cm, cm, t.a.intervalLimits(cmk.Interval),
+		newHasher(t.a.overflowSalt, cmk.ID, t.a.overflowEstimatorPrecision), nil,
+	)
+	overflowed := totalOverflowedEvents(&tm.cm)
+	if overflowed <= tm.overflowed {
+		return false, nil
+	}
+	tm.overflowed = overflowed
+	return true, nil
+}
+
+// load reads the aggregated metrics of the key, merged by the store.
+func (t *overflowTracker) load(cmk CombinedMetricsKey) (*trackedMetrics, error) {
+	key := make([]byte, cmk.SizeBinary())
+	if err := cmk.MarshalBinaryToSizedBuffer(key); err != nil {
+		return nil, fmt.Errorf("failed to marshal combined metrics key: %w", err)
+	}
+	tm := &trackedMetrics{
+		cm: CombinedMetrics{Services: make(map[ServiceAggregationKey]ServiceMetrics)},
+	}
+	value, err := t.a.storeFor(cmk.Interval).kv.Get(key)
+	if errors.Is(err, ErrNotFound) {
+		return tm, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read aggregated metrics: %w", err)
+	}
+	if err := tm.cm.UnmarshalBinary(value); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal aggregated metrics: %w", err)
+	}
+	if tm.cm.Services == nil {
+		tm.cm.Services = make(map[ServiceAggregationKey]ServiceMetrics)
+	}
+	tm.overflowed = totalOverflowedEvents(&tm.cm)
+	return tm, nil
+}
+
+// totalOverflowedEvents returns the representative count of the events
+// aggregated into all the overflow buckets of the combined metrics.
+func totalOverflowedEvents(cm *CombinedMetrics) float64 {
+	var total float64
+	for _, n := range overflowEventCounts(cm) {
+		total += n
+	}
+	return total
+}
@@ -0,0 +1,53 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverflowTracker(t *testing.T) {
+	start := time.Unix(1686000000, 0).Truncate(time.Minute)
+	limits := testLimits()
+	limits.MaxTransactionGroupsPerService = 1
+	agg := newTestAggregator(t, AggregatorConfig{
+		Limits:               limits,
+		AggregationIntervals: []time.Duration{time.Minute},
+		clock:                newFakeClock(start),
+	})
+
+	txn := func(name string) *CombinedMetrics {
+		cm := CombinedMetrics(*createTestCombinedMetrics(1).
+			addTransaction(start, "svc1", "", testTransaction{txnName: name, txnType: "type", count: 1}))
+		return &cm
+	}
+	cmk := CombinedMetricsKey{Interval: time.Minute, ProcessingTime: start, ID: "testid"}
+	require.NoError(t, agg.AggregateCombinedMetrics(context.Background(), cmk, *txn("txn1")))
+	require.NoError(t, agg.commitBatches())
+
+	// The previously aggregated metrics are read on first use of a key.
+	tracker := newOverflowTracker(agg)
+	overflowed, err := tracker.track(cmk, txn("txn1"))
+	require.NoError(t, err)
+	assert.False(t, overflowed)
+	overflowed, err = tracker.track(cmk, txn("txn2"))
+	require.NoError(t, err)
+	assert.True(t, overflowed)
+	overflowed, err = tracker.track(cmk, txn("txn1"))
+	require.NoError(t, err)
+	assert.False(t, overflowed)
+
+	// Keys without aggregated metrics start empty.
+	other := cmk
+	other.ID = "other"
+	overflowed, err = tracker.track(other, txn("txn2"))
+	require.NoError(t, err)
+	assert.False(t, overflowed)
+}
@@ -0,0 +1,157 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"bytes"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// pebbleStore is the default Store, a pebble database merging the values
+// with the merger of the database's options. The writes are applied with
+// the given write options.
+type pebbleStore struct {
+	db *pebble.DB
+	wo *pebble.WriteOptions
+}
+
+func newPebbleStore(db *pebble.DB, wo *pebble.WriteOptions) *pebbleStore {
+	return &pebbleStore{db: db, wo: wo}
+}
+
+func (s *pebbleStore) Get(key []byte) ([]byte, error) {
+	return pebbleGet(s.db, key)
+}
+
+func (s *pebbleStore) RangeScan(lb, ub []byte, fn func(key, value []byte) error) error {
+	return pebbleRangeScan(s.db, lb, ub, fn)
+}
+
+func (s *pebbleStore) Set(key, value []byte) error {
+	return s.db.Set(key, value, s.wo)
+}
+
+func (s *pebbleStore) Merge(key, value []byte) error {
+	return s.db.Merge(key, value, s.wo)
+}
+
+func (s *pebbleStore) Delete(key []byte) error {
+	return s.db.Delete(key, s.wo)
+}
+
+func (s *pebbleStore) RangeDelete(lb, ub []byte) error {
+	return s.db.DeleteRange(lb, ub, s.wo)
+}
+
+func (s *pebbleStore) NewBatch() StoreBatch {
+	// Batch is backed by a sync pool, closing the batch releases it back
+	// to the pool.
+	return &pebbleBatch{batch: s.db.NewBatch(), wo: s.wo}
+}
+
+func (s *pebbleStore) NewSnapshot() StoreSnapshot {
+	return &pebbleSnapshot{snap: s.db.NewSnapshot()}
+}
+
+func (s *pebbleStore) Close() error {
+	return s.db.Close()
+}
+
+// pebbleBatch is a StoreBatch of a pebbleStore.
+type pebbleBatch struct {
+	batch *pebble.Batch
+	wo    *pebble.WriteOptions
+}
+
+func (b *pebbleBatch) Set(key, value []byte) error {
+	return b.batch.Set(key, value, nil)
+}
+
+// Merge writes the merge operation to the batch. The key and value are
+// copied to the batch.
+func (b *pebbleBatch) Merge(key, value []byte) error {
+	return b.batch.Merge(key, value, nil)
+}
+
+func (b *pebbleBatch) Delete(key []byte) error {
+	return b.batch.Delete(key, nil)
+}
+
+func (b *pebbleBatch) RangeDelete(lb, ub []byte) error {
+	return b.batch.DeleteRange(lb, ub, nil)
+}
+
+// mergeDeferred returns a deferred merge operation of the given key and
+// value sizes, avoiding copying the key and value to the batch, see
+// pebble.Batch.MergeDeferred.
+func (b *pebbleBatch) mergeDeferred(keyLen, valueLen int) *pebble.DeferredBatchOp {
+	return b.batch.MergeDeferred(keyLen, valueLen)
+}
+
+func (b *pebbleBatch) Len() int {
+	return b.batch.Len()
+}
+
+func (b *pebbleBatch) Commit() error {
+	return b.batch.Commit(b.wo)
+}
+
+func (b *pebbleBatch) Close() error {
+	return b.batch.Close()
+}
+
+// pebbleSnapshot is a StoreSnapshot of a pebbleStore.
+type pebbleSnapshot struct {
+	snap *pebble.Snapshot
+}
+
+func (s *pebbleSnapshot) Get(key []byte) ([]byte, error) {
+	return pebbleGet(s.snap, key)
+}
+
+func (s *pebbleSnapshot) RangeScan(lb, ub []byte, fn func(key, value []byte) error) error {
+	return pebbleRangeScan(s.snap, lb, ub, fn)
+}
+
+func (s *pebbleSnapshot) Close() error {
+	return s.snap.Close()
+}
+
+// pebbleGet returns a copy of the value of the key read from r. The key
+// is read by a prefix seek, as the key is a prefix on its own, see
+// comparer, so that the sstables are skipped by their bloom filters.
+// Unlike the prefix seeks, Get does not consult the bloom filters.
+func pebbleGet(r pebble.Reader, key []byte) ([]byte, error) {
+	iter := r.NewIter(&pebble.IterOptions{KeyTypes: pebble.IterKeyTypePointsOnly})
+	if !iter.SeekPrefixGE(key) || !bytes.Equal(iter.Key(), key) {
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+		return nil, pebble.ErrNotFound
+	}
+	v := append([]byte(nil), iter.Value()...)
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// pebbleRangeScan iterates the point keys of r between lb and ub, see
+// StoreReader.RangeScan.
+func pebbleRangeScan(r pebble.Reader, lb, ub []byte, fn func(key, value []byte) error) error {
+	iter := r.NewIter(&pebble.IterOptions{
+		LowerBound: lb,
+		UpperBound: ub,
+		KeyTypes:   pebble.IterKeyTypePointsOnly,
+	})
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err := fn(iter.Key(), iter.Value()); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
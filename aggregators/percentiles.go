@@ -0,0 +1,45 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+// setPercentiles sets the durations at the given percentiles of all the
+// transaction metrics of the combined metrics, including the overflow
+// buckets.
+func setPercentiles(cm *CombinedMetrics, percentiles []float64) {
+	if len(percentiles) == 0 {
+		return
+	}
+	setOverflowPercentiles(&cm.OverflowServices, percentiles)
+	for sk, sm := range cm.Services {
+		for _, sim := range sm.ServiceInstanceGroups {
+			for tk, tm := range sim.TransactionGroups {
+				tm.Percentiles = transactionPercentiles(&tm, percentiles)
+				sim.TransactionGroups[tk] = tm
+			}
+		}
+		setOverflowPercentiles(&sm.OverflowGroups, percentiles)
+		cm.Services[sk] = sm
+	}
+}
+
+func setOverflowPercentiles(o *Overflow, percentiles []float64) {
+	tm := &o.OverflowTransaction.Metrics
+	if tm.Histogram.TotalCount() == 0 {
+		return
+	}
+	tm.Percentiles = transactionPercentiles(tm, percentiles)
+}
+
+func transactionPercentiles(tm *TransactionMetrics, percentiles []float64) []Percentile {
+	if tm.Histogram == nil {
+		return nil
+	}
+	durations := tm.Histogram.DurationsAtPercentiles(percentiles)
+	result := make([]Percentile, len(percentiles))
+	for i, p := range percentiles {
+		result[i] = Percentile{Percentile: p, Duration: durations[i]}
+	}
+	return result
+}
@@ -0,0 +1,104 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/elastic/apm-data/model/modelpb"
+)
+
+func TestHarvestPercentiles(t *testing.T) {
+	forEachStore(t, testHarvestPercentiles)
+}
+
+func testHarvestPercentiles(t *testing.T, newStore newStoreFunc) {
+	percentiles := []float64{50, 90, 95, 99}
+	var harvested []CombinedMetrics
+	limits := testLimits()
+	limits.MaxTransactionGroupsPerService = 1
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore: newStore,
+		Limits:   limits,
+		Processor: func(_ context.Context, _ CombinedMetricsKey, cm CombinedMetrics, _ time.Duration) error {
+			harvested = append(harvested, cm)
+			return nil
+		},
+		AggregationIntervals: []time.Duration{time.Minute},
+		Percentiles:          percentiles,
+	})
+
+	// txn1 durations are uniformly distributed from 1ms to 100ms, and
+	// txn2 has 90% of its durations at 10ms and 10% at 1s.
+	ts := time.Now()
+	txn := func(name string, d time.Duration) *modelpb.APMEvent {
+		return &modelpb.APMEvent{
+			Processor: modelpb.TransactionProcessor(),
+			Timestamp: timestamppb.New(ts),
+			Service:   &modelpb.Service{Name: "svc"},
+			Event:     &modelpb.Event{Duration: durationpb.New(d), Outcome: "success"},
+			Transaction: &modelpb.Transaction{
+				RepresentativeCount: 1,
+				Name:                name,
+				Type:                "type",
+			},
+		}
+	}
+	var batch modelpb.Batch
+	for i := 1; i <= 100; i++ {
+		batch = append(batch, txn("txn1", time.Duration(i)*time.Millisecond))
+	}
+	for i := 0; i < 100; i++ {
+		d := 10 * time.Millisecond
+		if i%10 == 0 {
+			d = time.Second
+		}
+		batch = append(batch, txn("txn2", d))
+	}
+	require.NoError(t, agg.AggregateBatch(context.Background(), "id", &batch))
+	require.NoError(t, agg.Flush(context.Background()))
+	require.Len(t, harvested, 1)
+
+	assertPercentiles := func(t *testing.T, expected []time.Duration, actual []Percentile) {
+		t.Helper()
+		require.Len(t, actual, len(expected))
+		for i, p := range actual {
+			assert.Equal(t, percentiles[i], p.Percentile)
+			// The histograms have 2 significant figures.
+			assert.InEpsilon(t, float64(expected[i]), float64(p.Duration), 0.01, "p%v", p.Percentile)
+		}
+	}
+	expected := map[string][]time.Duration{
+		"txn1": {50 * time.Millisecond, 90 * time.Millisecond, 95 * time.Millisecond, 99 * time.Millisecond},
+		"txn2": {10 * time.Millisecond, 10 * time.Millisecond, time.Second, time.Second},
+	}
+	require.Len(t, harvested[0].Services, 1)
+	for _, sm := range harvested[0].Services {
+		require.Len(t, sm.ServiceInstanceGroups, 1)
+		for _, sim := range sm.ServiceInstanceGroups {
+			// Either of the transactions may overflow depending on the
+			// order of the merges.
+			require.Len(t, sim.TransactionGroups, 1)
+			for tk, tm := range sim.TransactionGroups {
+				assertPercentiles(t, expected[tk.TransactionName], tm.Percentiles)
+				// The histograms are kept.
+				assert.Equal(t, float64(100), tm.Histogram.TotalCount())
+				delete(expected, tk.TransactionName)
+			}
+		}
+		require.Len(t, expected, 1)
+		for _, overflowExpected := range expected {
+			assertPercentiles(t, overflowExpected, sm.OverflowGroups.OverflowTransaction.Metrics.Percentiles)
+		}
+	}
+	assert.Empty(t, harvested[0].OverflowServices.OverflowTransaction.Metrics.Percentiles)
+}
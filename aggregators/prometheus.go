@@ -0,0 +1,53 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+
+	"github.com/elastic/apm-aggregation/aggregators/internal/telemetry"
+)
+
+// NewPrometheusMeterProvider returns a meter provider exposing the
+// aggregator telemetry, including the pebble metrics, to the given
+// prometheus registerer using the OpenTelemetry prometheus exporter. The
+// returned meter provider must be configured as the
+// AggregatorConfig.MeterProvider for the aggregator telemetry to be
+// exposed. Measurements are collected on every scrape of the registry.
+// The given options are used to configure the meter provider, see
+// WithRequestDurationBuckets.
+//
+// For example, to expose the aggregator telemetry on an existing
+// prometheus registry:
+//
+//	mp, err := aggregators.NewPrometheusMeterProvider(
+//		registry,
+//		aggregators.WithRequestDurationBuckets([]float64{0.01, 0.1, 1, 10}),
+//	)
+//	if err != nil {
+//		return err
+//	}
+//	agg, err := aggregators.New(aggregators.AggregatorConfig{
+//		// ...
+//		MeterProvider: mp,
+//	}, logger)
+func NewPrometheusMeterProvider(reg prometheus.Registerer, opts ...sdkmetric.Option) (metric.MeterProvider, error) {
+	bridge, err := telemetry.NewPrometheusBridge(reg, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return bridge.MeterProvider(), nil
+}
+
+// WithRequestDurationBuckets returns a meter provider option configuring
+// the bucket boundaries, in seconds, of the histogram recording the time
+// taken to process the aggregation requests. The option can be used with
+// NewPrometheusMeterProvider or sdkmetric.NewMeterProvider. If not configured
+// then the default boundaries of the meter provider are used.
+func WithRequestDurationBuckets(boundaries []float64) sdkmetric.Option {
+	return sdkmetric.WithView(telemetry.RequestDurationView(boundaries))
+}
@@ -0,0 +1,109 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/elastic/apm-aggregation/aggregationpb"
+	"github.com/elastic/apm-aggregation/aggregators/internal/telemetry"
+)
+
+// ErrServiceNotFound means that no aggregated metrics exist for the
+// queried service, see QueryService.
+var ErrServiceNotFound = errors.New("service not found")
+
+// QueryService returns the current aggregated metrics of the service for
+// the aggregation interval, without harvesting them. The aggregated metrics
+// of all the service's aggregation keys, for example, for different
+// environments or processing times, and of all the combined metrics IDs
+// are merged into a single ServiceMetrics using the limits of the
+// aggregation interval. As the combined metrics keys do not include the
+// service, QueryService decodes all the aggregated metrics of the
+// aggregation interval, which can be expensive for aggregators with a
+// large aggregation state. ErrServiceNotFound is returned if there are no
+// aggregated metrics for the service.
+func (a *Aggregator) QueryService(
+	ctx context.Context,
+	ivl time.Duration,
+	serviceName string,
+) (*aggregationpb.ServiceMetrics, error) {
+	ctx, span := a.tracer.Start(ctx, "QueryService", trace.WithAttributes(
+		telemetry.AggregationIntervalAttr(ivl),
+		attribute.String("service.name", serviceName),
+	))
+	defer span.End()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	if a.closed {
+		return nil, ErrAggregatorStopped
+	}
+
+	if err := a.flushMergeBatch(); err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	s := a.storeFor(ivl)
+	if err := s.commitBatch(); err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to prepare query: %w", err)
+	}
+
+	snap := s.kv.NewSnapshot()
+	defer snap.Close()
+
+	// The service's aggregation keys are merged into a single key.
+	key := ServiceAggregationKey{ServiceName: serviceName}
+	limits := a.limits.Load().forInterval(ivl)
+	result := CombinedMetrics{Services: make(map[ServiceAggregationKey]ServiceMetrics, 1)}
+	var found bool
+	var decodeErr error
+	if err := snap.RangeScan(intervalKeyPrefix(ivl), intervalKeyPrefix(ivl+time.Second), func(_, value []byte) error {
+		if err := ctx.Err(); err != nil {
+			decodeErr = err
+			return err
+		}
+		var cm CombinedMetrics
+		if err := cm.UnmarshalBinary(value); err != nil {
+			decodeErr = fmt.Errorf("failed to unmarshal metrics: %w", err)
+			return decodeErr
+		}
+		for sk, sm := range cm.Services {
+			if sk.ServiceName != serviceName {
+				continue
+			}
+			found = true
+			from := CombinedMetrics{Services: map[ServiceAggregationKey]ServiceMetrics{key: sm}}
+			merge(&result, &from, limits, Hasher{}, nil)
+		}
+		return nil
+	}); err != nil {
+		if decodeErr != nil {
+			err = decodeErr
+		} else {
+			err = fmt.Errorf("failed to iterate aggregated metrics: %w", err)
+		}
+		span.RecordError(err)
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrServiceNotFound, serviceName)
+	}
+	sm := result.Services[key]
+	return sm.ToProto(), nil
+}
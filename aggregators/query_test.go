@@ -0,0 +1,72 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryService(t *testing.T) {
+	forEachStore(t, testQueryService)
+}
+
+func testQueryService(t *testing.T, newStore newStoreFunc) {
+	start := time.Unix(1686000000, 0).Truncate(time.Minute)
+	agg := newTestAggregator(t, AggregatorConfig{
+		NewStore: newStore,
+		Processor: func(context.Context, CombinedMetricsKey, CombinedMetrics, time.Duration) error {
+			return nil
+		},
+		AggregationIntervals: []time.Duration{time.Minute, time.Hour},
+		clock:                newFakeClock(start),
+	})
+
+	aggregate := func(id string, cm *TestCombinedMetrics) {
+		require.NoError(t, agg.AggregateCombinedMetrics(
+			context.Background(),
+			CombinedMetricsKey{Interval: time.Minute, ProcessingTime: start, ID: id},
+			CombinedMetrics(*cm),
+		))
+	}
+	aggregate("id1", createTestCombinedMetrics(5).
+		addTransaction(start, "svc1", "", testTransaction{txnName: "txn1", txnType: "type", count: 2}).
+		addTransaction(start, "svc2", "", testTransaction{txnName: "txn1", txnType: "type", count: 3}))
+	aggregate("id2", createTestCombinedMetrics(4).
+		addTransaction(start, "svc1", "", testTransaction{txnName: "txn1", txnType: "type", count: 4}))
+	aggregate("id2", createTestCombinedMetrics(1).
+		addTransaction(start, "svc3", "", testTransaction{txnName: "txn2", txnType: "type", count: 1}))
+
+	// The metrics of the service are merged across the combined metrics IDs.
+	pb, err := agg.QueryService(context.Background(), time.Minute, "svc1")
+	require.NoError(t, err)
+	var sm ServiceMetrics
+	sm.FromProto(pb)
+	require.Len(t, sm.ServiceInstanceGroups, 1)
+	for _, sim := range sm.ServiceInstanceGroups {
+		require.Len(t, sim.TransactionGroups, 1)
+		tm, ok := sim.TransactionGroups[TransactionAggregationKey{TransactionName: "txn1", TransactionType: "type"}]
+		require.True(t, ok)
+		assert.Equal(t, float64(6), tm.Histogram.TotalCount())
+	}
+
+	pb, err = agg.QueryService(context.Background(), time.Minute, "svc3")
+	require.NoError(t, err)
+	sm.FromProto(pb)
+	require.Len(t, sm.ServiceInstanceGroups, 1)
+
+	_, err = agg.QueryService(context.Background(), time.Minute, "svc4")
+	assert.ErrorIs(t, err, ErrServiceNotFound)
+	_, err = agg.QueryService(context.Background(), time.Hour, "svc1")
+	assert.ErrorIs(t, err, ErrServiceNotFound)
+
+	require.NoError(t, agg.Stop(context.Background()))
+	_, err = agg.QueryService(context.Background(), time.Minute, "svc1")
+	assert.ErrorIs(t, err, ErrAggregatorStopped)
+}
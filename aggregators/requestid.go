@@ -0,0 +1,55 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// requestIDField is the name of the trace attribute and of the log field
+// holding the request ID of the aggregation requests.
+const requestIDField = "request_id"
+
+// requestID returns the request ID held by the context under the key
+// configured by AggregatorConfig.RequestIDKey, if any. Only non-empty
+// string and fmt.Stringer values are request IDs.
+func (a *Aggregator) requestID(ctx context.Context) (string, bool) {
+	if a.requestIDKey == nil {
+		return "", false
+	}
+	switch v := ctx.Value(a.requestIDKey).(type) {
+	case string:
+		return v, v != ""
+	case fmt.Stringer:
+		s := v.String()
+		return s, s != ""
+	}
+	return "", false
+}
+
+// traceRequestID sets the request ID of the context, if any, as an
+// attribute of the span of the aggregation request. The request durations
+// are recorded with the context of the span, allowing the metrics SDKs
+// sampling exemplars to link them to the span.
+func (a *Aggregator) traceRequestID(ctx context.Context, span trace.Span) {
+	if id, ok := a.requestID(ctx); ok {
+		span.SetAttributes(attribute.String(requestIDField, id))
+	}
+}
+
+// logRequestFailed logs the failure of an aggregation request counted by
+// RequestsFailed, with the request ID of the context, if any, correlating
+// the log with the failed request.
+func (a *Aggregator) logRequestFailed(ctx context.Context, msg string, err error, fields ...zap.Field) {
+	if id, ok := a.requestID(ctx); ok {
+		fields = append(fields, zap.String(requestIDField, id))
+	}
+	a.logger.Warn(msg, append(fields, zap.Error(err))...)
+}
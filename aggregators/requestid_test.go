@@ -0,0 +1,121 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/elastic/apm-data/model/modelpb"
+)
+
+type testRequestIDKey struct{}
+
+type testRequestID string
+
+func (id testRequestID) String() string { return "stringer-" + string(id) }
+
+func TestRequestID(t *testing.T) {
+	start := time.Unix(1686000000, 0).Truncate(time.Minute)
+	core, logs := observer.New(zapcore.WarnLevel)
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	agg, err := New(testConfig(t, AggregatorConfig{
+		AggregationIntervals: []time.Duration{time.Minute},
+		Tracer:               tp.Tracer("test"),
+		RequestIDKey:         testRequestIDKey{},
+		clock:                newFakeClock(start),
+	}), zap.New(core))
+	require.NoError(t, err)
+	defer agg.Stop(context.Background())
+	// Fail all the aggregations.
+	agg.unavailableIntervals[time.Minute] = errors.New("unavailable")
+
+	withID := func(id any) context.Context {
+		return context.WithValue(context.Background(), testRequestIDKey{}, id)
+	}
+	cmk := CombinedMetricsKey{Interval: time.Minute, ProcessingTime: start, ID: "testid"}
+	cm := CombinedMetrics(*createTestCombinedMetrics(1).
+		addTransaction(start, "svc1", "", testTransaction{txnName: "txn1", txnType: "type", count: 1}))
+
+	batch := modelpb.Batch{
+		makeSpan(start, "svc1", "java", "dest1", "", "", "success", time.Second, 1, nil, nil),
+	}
+	assert.ErrorIs(t, agg.AggregateBatch(withID("req-1"), "testid", &batch), ErrIntervalUnavailable)
+	assert.ErrorIs(t, agg.AggregateCombinedMetrics(withID(testRequestID("req-2")), cmk, cm), ErrIntervalUnavailable)
+	assert.ErrorIs(t, agg.AggregateCombinedMetricsBatch(withID("req-3"), []KeyedCombinedMetrics{
+		{Key: cmk, Metrics: cm},
+	}), ErrIntervalUnavailable)
+	// Contexts without a request ID, or with an invalid one, are logged
+	// without a request ID.
+	assert.Error(t, agg.AggregateCombinedMetrics(context.Background(), cmk, cm))
+	assert.Error(t, agg.AggregateCombinedMetrics(withID(42), cmk, cm))
+
+	entries := logs.AllUntimed()
+	require.Len(t, entries, 5)
+	for i, expected := range []struct {
+		message   string
+		requestID string
+	}{
+		{message: "failed to aggregate batch", requestID: "req-1"},
+		{message: "failed to aggregate combined metrics", requestID: "stringer-req-2"},
+		{message: "failed to aggregate combined metrics batch", requestID: "req-3"},
+		{message: "failed to aggregate combined metrics"},
+		{message: "failed to aggregate combined metrics"},
+	} {
+		entry := entries[i]
+		assert.Equal(t, expected.message, entry.Message)
+		assert.Contains(t, entry.ContextMap()["error"], ErrIntervalUnavailable.Error())
+		requestID, ok := entry.ContextMap()["request_id"]
+		if expected.requestID == "" {
+			assert.False(t, ok, "unexpected request ID %v", requestID)
+		} else {
+			assert.Equal(t, expected.requestID, requestID)
+		}
+	}
+	assert.Equal(t, int64(1), entries[0].ContextMap()["failed_events"])
+	assert.Equal(t, "testid", entries[0].ContextMap()["combined_metrics_id"])
+
+	// The request IDs are set on the spans of the requests.
+	var requestIDs []string
+	for _, span := range exp.GetSpans() {
+		for _, attr := range span.Attributes {
+			if attr.Key == "request_id" {
+				requestIDs = append(requestIDs, span.Name+":"+attr.Value.AsString())
+			}
+		}
+	}
+	assert.ElementsMatch(t, []string{
+		"AggregateBatch:req-1",
+		"AggregateCombinedMetrics:stringer-req-2",
+		"AggregateCombinedMetricsBatch:req-3",
+	}, requestIDs)
+}
+
+func TestRequestIDDisabled(t *testing.T) {
+	agg := &Aggregator{}
+	ctx := context.WithValue(context.Background(), testRequestIDKey{}, "req-1")
+	_, ok := agg.requestID(ctx)
+	assert.False(t, ok)
+
+	agg.requestIDKey = testRequestIDKey{}
+	id, ok := agg.requestID(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "req-1", id)
+	_, ok = agg.requestID(context.WithValue(context.Background(), testRequestIDKey{}, ""))
+	assert.False(t, ok)
+	_, ok = agg.requestID(context.Background())
+	assert.False(t, ok)
+}
@@ -0,0 +1,338 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+
+	"github.com/elastic/apm-aggregation/aggregators/internal/telemetry"
+)
+
+// ErrNotFound is returned by StoreReader.Get if the key is not found.
+var ErrNotFound = pebble.ErrNotFound
+
+// MergeFunc merges the value written by Store.Merge into the existing
+// value of the key, returning the merged value. existing is nil if the
+// key has no value, in which case the returned value is the value merged
+// on its own. The merge function of the aggregated metrics applies the
+// configured limits, see AggregatorConfig.NewStore.
+type MergeFunc func(key, existing, value []byte) ([]byte, error)
+
+// StoreReader reads the keys of a Store or of a snapshot of it.
+type StoreReader interface {
+	// Get returns the merged value of the key, or ErrNotFound if the key
+	// does not exist. The returned value is owned by the caller.
+	Get(key []byte) ([]byte, error)
+	// RangeScan calls fn with the keys between lb, inclusive, and ub,
+	// exclusive, in bytewise order, along with their merged values. The
+	// key and value are only valid until fn returns. RangeScan stops at
+	// the first error returned by fn, or failing to read or merge the
+	// values, and returns it.
+	RangeScan(lb, ub []byte, fn func(key, value []byte) error) error
+}
+
+// StoreWriter writes the keys of a Store or of a batch of writes to it.
+type StoreWriter interface {
+	// Set sets the value of the key, replacing its existing value.
+	Set(key, value []byte) error
+	// Merge merges the value into the existing value of the key using
+	// the store's MergeFunc. The values may be merged when the key is
+	// read rather than when it is written.
+	Merge(key, value []byte) error
+	// Delete deletes the key.
+	Delete(key []byte) error
+	// RangeDelete deletes the keys between lb, inclusive, and ub,
+	// exclusive.
+	RangeDelete(lb, ub []byte) error
+}
+
+// Store is the key-value storage of the aggregated metrics of one or more
+// aggregation intervals. The stores are safe for concurrent use, their
+// batches and snapshots are not. A pebble database is the default store,
+// see AggregatorConfig.NewStore and NewMapStore for alternate stores.
+type Store interface {
+	StoreReader
+	StoreWriter
+	// NewBatch returns an empty batch of writes to the store.
+	NewBatch() StoreBatch
+	// NewSnapshot returns a read-only view of the keys of the store as of
+	// now, unaffected by later writes. The snapshot must be closed.
+	NewSnapshot() StoreSnapshot
+	// Close closes the store, the store must not be used afterwards.
+	Close() error
+}
+
+// StoreBatch is a batch of writes to a Store, applied atomically and in
+// order by Commit. The writes are not readable until committed.
+type StoreBatch interface {
+	StoreWriter
+	// Len returns the size of the batched writes in bytes.
+	Len() int
+	// Commit applies the batched writes to the store.
+	Commit() error
+	// Close releases the batch, the batch must not be used afterwards.
+	Close() error
+}
+
+// StoreSnapshot is a read-only view of a Store, see Store.NewSnapshot.
+type StoreSnapshot interface {
+	StoreReader
+	// Close releases the snapshot.
+	Close() error
+}
+
+// store holds the aggregated metrics of one or more aggregation intervals,
+// see AggregatorConfig.DataDirPerInterval, in a pebble database unless a
+// custom store is configured, see AggregatorConfig.NewStore.
+type store struct {
+	// name identifies the database in the pebble metrics, it is empty if
+	// the aggregator has a single database.
+	name      string
+	dataDir   string
+	intervals []time.Duration
+	// kv holds the aggregated metrics of the store's aggregation intervals.
+	kv Store
+	// opts are the options used to open db in dataDir. The options and
+	// the database are nil for custom stores.
+	opts *pebble.Options
+	db   *pebble.DB
+	// batch is the pending batch of the aggregations to the aggregation
+	// intervals of the store, if any.
+	batch StoreBatch
+	// metrics returns the current metrics of db, nil for custom stores.
+	metrics     func() *pebble.Metrics
+	writeStalls *telemetry.WriteStalls
+	corruptions *telemetry.Corruptions
+	merges      *telemetry.Merges
+}
+
+// storeDirs groups the aggregation intervals by the directory of their
+// pebble database. The aggregation intervals without a directory in
+// perInterval use dataDir. The groups are ordered by their lowest
+// aggregation interval.
+func storeDirs(
+	dataDir string,
+	perInterval map[time.Duration]string,
+	ivls []time.Duration,
+) (dirs []string, intervals [][]time.Duration) {
+	for _, ivl := range ivls {
+		dir, ok := perInterval[ivl]
+		if !ok {
+			dir = dataDir
+		}
+		idx := 0
+		for idx < len(dirs) && dirs[idx] != dir {
+			idx++
+		}
+		if idx == len(dirs) {
+			dirs = append(dirs, dir)
+			intervals = append(intervals, nil)
+		}
+		intervals[idx] = append(intervals[idx], ivl)
+	}
+	return dirs, intervals
+}
+
+func newStore(dataDir string, intervals []time.Duration) *store {
+	return &store{
+		dataDir:     dataDir,
+		intervals:   intervals,
+		metrics:     func() *pebble.Metrics { return nil },
+		writeStalls: &telemetry.WriteStalls{},
+		corruptions: &telemetry.Corruptions{},
+		merges:      &telemetry.Merges{},
+	}
+}
+
+// openStore opens the pebble database in dataDir with the options returned
+// by newOpts for the store, verifying the checksums of all the sstables if
+// strictChecksums is true and migrating the legacy combined metrics keys.
+func openStore(
+	dataDir string,
+	intervals []time.Duration,
+	newOpts func(*store) *pebble.Options,
+	strictChecksums bool,
+	wo *pebble.WriteOptions,
+) (*store, int, error) {
+	s := newStore(dataDir, intervals)
+	s.opts = newOpts(s)
+	db, err := pebble.Open(dataDir, s.opts)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create pebble db: %w", err)
+	}
+	if strictChecksums {
+		if err := db.CheckLevels(nil); err != nil {
+			if s.corruptions.Record(err) {
+				// Allow checking for corruption using errors.Is.
+				err = fmt.Errorf("%w: %w", pebble.ErrCorruption, err)
+			}
+			db.Close()
+			return nil, 0, fmt.Errorf("failed to verify pebble db: %w", err)
+		}
+	}
+	migrated, err := migrateLegacyKeys(db, wo)
+	if err != nil {
+		db.Close()
+		return nil, 0, fmt.Errorf("failed to migrate legacy combined metrics keys: %w", err)
+	}
+	s.db = db
+	s.kv = newPebbleStore(db, wo)
+	s.metrics = db.Metrics
+	return s, migrated, nil
+}
+
+// openCustomStore creates the store of the aggregation intervals using
+// the configured NewStore, with the merge function returned by newMerge
+// for the store.
+func openCustomStore(
+	dataDir string,
+	intervals []time.Duration,
+	newStoreFn func(string, []time.Duration, MergeFunc) (Store, error),
+	newMerge func(*store) MergeFunc,
+) (*store, error) {
+	s := newStore(dataDir, intervals)
+	kv, err := newStoreFn(dataDir, intervals, newMerge(s))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create store: %w", err)
+	}
+	s.kv = kv
+	return s, nil
+}
+
+// newMergeFunc returns the MergeFunc of a custom store merging the values
+// with the value mergers created by merge, as pebble does, see
+// pebble.Merger. The merged values are always complete.
+func newMergeFunc(merge pebble.Merge) MergeFunc {
+	return func(key, existing, value []byte) ([]byte, error) {
+		base := existing
+		if base == nil {
+			base = value
+		}
+		vm, err := merge(key, base)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			if err := vm.MergeNewer(value); err != nil {
+				return nil, err
+			}
+		}
+		merged, closer, err := vm.Finish(true)
+		if err != nil {
+			return nil, err
+		}
+		if closer != nil {
+			// The merged value is only valid until closed.
+			defer closer.Close()
+			merged = append([]byte(nil), merged...)
+		}
+		return merged, nil
+	}
+}
+
+// storeName returns the name of the store of the aggregation intervals,
+// identifying the database in the pebble metrics.
+func storeName(intervals []time.Duration) string {
+	names := make([]string, len(intervals))
+	for i, ivl := range intervals {
+		names[i] = telemetry.AggregationIntervalAttr(ivl).Value.AsString()
+	}
+	return strings.Join(names, ",")
+}
+
+// commitBatch commits and closes the pending batch, if any.
+func (s *store) commitBatch() error {
+	if s.batch == nil {
+		return nil
+	}
+	if err := s.batch.Commit(); err != nil {
+		return fmt.Errorf("failed to commit batch: %w", err)
+	}
+	if err := s.batch.Close(); err != nil {
+		return fmt.Errorf("failed to close batch: %w", err)
+	}
+	s.batch = nil
+	return nil
+}
+
+// telemetryDB returns the description of the database for observing its
+// pebble metrics.
+func (s *store) telemetryDB() telemetry.PebbleDB {
+	return telemetry.PebbleDB{
+		Name:        s.name,
+		Metrics:     func() *pebble.Metrics { return s.metrics() },
+		WriteStalls: s.writeStalls,
+		Corruptions: s.corruptions,
+		Merges:      s.merges,
+	}
+}
+
+// PebbleOptions returns a readable summary of the effective options, with
+// pebble's defaults applied, of the pebble databases of the aggregator,
+// reflecting the options configured by AggregatorConfig, for example,
+// the cache size, the memtable size, or the sstable compression. The
+// options of each database are preceded by comments identifying its data
+// directory and aggregation intervals, followed by the options formatted
+// as pebble's OPTIONS file. Custom stores are not included.
+func (a *Aggregator) PebbleOptions() string {
+	var sb strings.Builder
+	for _, s := range a.stores {
+		if s.db == nil {
+			continue
+		}
+		if sb.Len() > 0 {
+			sb.WriteString("\n")
+		}
+		fmt.Fprintf(&sb, "# data_dir=%s\n", s.dataDir)
+		fmt.Fprintf(&sb, "# aggregation_intervals=%s\n", storeName(s.intervals))
+		// The options are cloned as EnsureDefaults modifies them in place.
+		sb.WriteString(s.opts.Clone().EnsureDefaults().String())
+	}
+	return sb.String()
+}
+
+// storeFor returns the store of the aggregation interval. The lowest
+// aggregation interval's store is returned for unknown intervals.
+func (a *Aggregator) storeFor(ivl time.Duration) *store {
+	for _, s := range a.stores {
+		for _, sivl := range s.intervals {
+			if sivl == ivl {
+				return s
+			}
+		}
+	}
+	return a.stores[0]
+}
+
+// commitBatches commits the pending batches of all the stores. The caller
+// must hold the aggregator's lock.
+func (a *Aggregator) commitBatches() error {
+	for _, s := range a.stores {
+		if err := s.commitBatch(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshots returns a snapshot of each store, which must be closed by the
+// caller, see closeSnapshots.
+func (a *Aggregator) snapshots() map[*store]StoreSnapshot {
+	snaps := make(map[*store]StoreSnapshot, len(a.stores))
+	for _, s := range a.stores {
+		snaps[s] = s.kv.NewSnapshot()
+	}
+	return snaps
+}
+
+func closeSnapshots(snaps map[*store]StoreSnapshot) {
+	for _, snap := range snaps {
+		snap.Close()
+	}
+}
@@ -0,0 +1,420 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package aggregators
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-aggregation/aggregators/internal/telemetry"
+)
+
+func TestStore(t *testing.T) {
+	// Both stores merge the values by concatenating them.
+	concat := func(_, existing, value []byte) ([]byte, error) {
+		return append(append([]byte(nil), existing...), value...), nil
+	}
+	for name, newStore := range map[string]func(t *testing.T) Store{
+		"pebble": func(t *testing.T) Store {
+			db, err := pebble.Open("", &pebble.Options{FS: vfs.NewMem(), Comparer: comparer, Merger: pebble.DefaultMerger})
+			require.NoError(t, err)
+			return newPebbleStore(db, pebble.Sync)
+		},
+		"map": func(t *testing.T) Store {
+			return NewMapStore(concat)
+		},
+	} {
+		newStore := newStore
+		t.Run(name, func(t *testing.T) {
+			kv := newStore(t)
+			get := func(r StoreReader, key string) string {
+				v, err := r.Get([]byte(key))
+				if errors.Is(err, ErrNotFound) {
+					return "<not found>"
+				}
+				require.NoError(t, err)
+				return string(v)
+			}
+			scan := func(r StoreReader, lb, ub string) []string {
+				var kvs []string
+				require.NoError(t, r.RangeScan([]byte(lb), []byte(ub), func(key, value []byte) error {
+					kvs = append(kvs, string(key)+"="+string(value))
+					return nil
+				}))
+				return kvs
+			}
+
+			require.NoError(t, kv.Set([]byte("b"), []byte("1")))
+			require.NoError(t, kv.Merge([]byte("b"), []byte("2")))
+			require.NoError(t, kv.Merge([]byte("c"), []byte("3")))
+			require.NoError(t, kv.Set([]byte("a"), []byte("4")))
+			require.NoError(t, kv.Set([]byte("d"), []byte("5")))
+			assert.Equal(t, "12", get(kv, "b"))
+			assert.Equal(t, "3", get(kv, "c"))
+			assert.Equal(t, "<not found>", get(kv, "e"))
+			assert.Equal(t, []string{"b=12", "c=3"}, scan(kv, "b", "d"))
+
+			// The errors returned by fn stop the scan.
+			fnErr := errors.New("stop")
+			var scanned int
+			assert.ErrorIs(t, kv.RangeScan([]byte("a"), []byte("e"), func(_, _ []byte) error {
+				scanned++
+				return fnErr
+			}), fnErr)
+			assert.Equal(t, 1, scanned)
+
+			// The batched writes are applied on commit, the snapshots are
+			// unaffected by later writes.
+			snap := kv.NewSnapshot()
+			batch := kv.NewBatch()
+			require.NoError(t, batch.Merge([]byte("a"), []byte("6")))
+			require.NoError(t, batch.Delete([]byte("d")))
+			assert.Positive(t, batch.Len())
+			assert.Equal(t, []string{"a=4", "b=12", "c=3", "d=5"}, scan(kv, "a", "e"))
+			require.NoError(t, batch.Commit())
+			require.NoError(t, batch.Close())
+			assert.Equal(t, []string{"a=46", "b=12", "c=3"}, scan(kv, "a", "e"))
+			assert.Equal(t, []string{"a=4", "b=12", "c=3", "d=5"}, scan(snap, "a", "e"))
+			assert.Equal(t, "5", get(snap, "d"))
+
+			require.NoError(t, kv.RangeDelete([]byte("a"), []byte("c")))
+			assert.Equal(t, []string{"c=3"}, scan(kv, "a", "e"))
+			require.NoError(t, kv.Delete([]byte("c")))
+			assert.Empty(t, scan(kv, "a", "e"))
+			assert.Equal(t, []string{"a=4", "b=12", "c=3", "d=5"}, scan(snap, "a", "e"))
+			require.NoError(t, snap.Close())
+			require.NoError(t, kv.Close())
+		})
+	}
+}
+
+func TestNewStore(t *testing.T) {
+	ivls := []time.Duration{time.Minute, time.Hour}
+	var dataDir string
+	var intervals []time.Duration
+	cfg := testConfig(t, AggregatorConfig{
+		NewStore: func(dir string, ivls []time.Duration, merge MergeFunc) (Store, error) {
+			dataDir, intervals = dir, ivls
+			return NewMapStore(merge), nil
+		},
+		AggregationIntervals: ivls,
+	})
+	// DataDir is not required with a custom store.
+	cfg.DataDir = ""
+	agg, err := New(cfg, zap.NewNop())
+	require.NoError(t, err)
+	defer agg.Stop(context.Background())
+	assert.Empty(t, dataDir)
+	assert.Equal(t, ivls, intervals)
+	require.Len(t, agg.stores, 1)
+	assert.Nil(t, agg.stores[0].db)
+
+	// NewStore is called once per data directory.
+	created := make(map[string][]time.Duration)
+	perIntervalCfg := cfg
+	perIntervalCfg.DataDirPerInterval = map[time.Duration]string{time.Hour: "hour"}
+	perIntervalCfg.NewStore = func(dir string, ivls []time.Duration, merge MergeFunc) (Store, error) {
+		created[dir] = ivls
+		return NewMapStore(merge), nil
+	}
+	perIntervalAgg, err := New(perIntervalCfg, zap.NewNop())
+	require.NoError(t, err)
+	defer perIntervalAgg.Stop(context.Background())
+	assert.Equal(t, map[string][]time.Duration{
+		"":     {time.Minute},
+		"hour": {time.Hour},
+	}, created)
+
+	storeErr := errors.New("store failed")
+	cfg.NewStore = func(string, []time.Duration, MergeFunc) (Store, error) {
+		return nil, storeErr
+	}
+	_, err = New(cfg, zap.NewNop())
+	assert.ErrorIs(t, err, storeErr)
+}
+
+func TestStoreDirs(t *testing.T) {
+	dirs, intervals := storeDirs(
+		"default",
+		map[time.Duration]string{10 * time.Minute: "long", time.Hour: "long", 5 * time.Minute: "default"},
+		[]time.Duration{time.Minute, 5 * time.Minute, 10 * time.Minute, time.Hour},
+	)
+	assert.Equal(t, []string{"default", "long"}, dirs)
+	assert.Equal(t, [][]time.Duration{
+		{time.Minute, 5 * time.Minute},
+		{10 * time.Minute, time.Hour},
+	}, intervals)
+
+	dirs, intervals = storeDirs("default", nil, []time.Duration{time.Minute, time.Hour})
+	assert.Equal(t, []string{"default"}, dirs)
+	assert.Equal(t, [][]time.Duration{{time.Minute, time.Hour}}, intervals)
+}
+
+func TestDataDirPerInterval(t *testing.T) {
+	start := time.Unix(1686000000, 0).Truncate(time.Hour)
+	dataDir, hourDir := t.TempDir(), t.TempDir()
+	var mu sync.Mutex
+	harvested := make(map[time.Duration]int64)
+	rdr := metric.NewManualReader()
+	agg := newTestAggregator(t, AggregatorConfig{
+		DataDir:            dataDir,
+		DataDirPerInterval: map[time.Duration]string{time.Hour: hourDir},
+		Processor: func(_ context.Context, cmk CombinedMetricsKey, cm CombinedMetrics, _ time.Duration) error {
+			mu.Lock()
+			defer mu.Unlock()
+			harvested[cmk.Interval] += cm.eventsTotal
+			return nil
+		},
+		AggregationIntervals: []time.Duration{time.Minute, 10 * time.Minute, time.Hour},
+		MeterProvider:        metric.NewMeterProvider(metric.WithReader(rdr)),
+		clock:                newFakeClock(start),
+	})
+
+	// Each directory holds a separate pebble database.
+	for _, dir := range []string{dataDir, hourDir} {
+		manifests, err := filepath.Glob(filepath.Join(dir, "MANIFEST-*"))
+		require.NoError(t, err)
+		assert.NotEmpty(t, manifests, dir)
+	}
+	require.Len(t, agg.stores, 2)
+	assert.Equal(t, dataDir, agg.storeFor(time.Minute).dataDir)
+	assert.Equal(t, dataDir, agg.storeFor(10*time.Minute).dataDir)
+	assert.Equal(t, hourDir, agg.storeFor(time.Hour).dataDir)
+
+	for i, ivl := range []time.Duration{time.Minute, time.Hour} {
+		require.NoError(t, agg.AggregateCombinedMetrics(
+			context.Background(),
+			CombinedMetricsKey{Interval: ivl, ProcessingTime: start, ID: "testid"},
+			CombinedMetrics(*createTestCombinedMetrics(int64(i+1)).
+				addTransaction(start, "svc", "", testTransaction{txnName: "txn", txnType: "type", count: i + 1})),
+		))
+	}
+	// The aggregated metrics are only written to the database of their
+	// aggregation interval.
+	keys := func(db *pebble.DB, ivl time.Duration) int {
+		iter := db.NewIter(&pebble.IterOptions{
+			LowerBound: intervalKeyPrefix(ivl),
+			UpperBound: intervalKeyPrefix(ivl + time.Second),
+		})
+		defer iter.Close()
+		var n int
+		for iter.First(); iter.Valid(); iter.Next() {
+			n++
+		}
+		return n
+	}
+	for _, ivl := range []time.Duration{time.Minute, time.Hour} {
+		snap, err := agg.Snapshot(context.Background(), ivl)
+		require.NoError(t, err)
+		assert.Len(t, snap, 1)
+	}
+	assert.Equal(t, 1, keys(agg.stores[0].db, time.Minute))
+	assert.Zero(t, keys(agg.stores[0].db, time.Hour))
+	assert.Zero(t, keys(agg.stores[1].db, time.Minute))
+	assert.Equal(t, 1, keys(agg.stores[1].db, time.Hour))
+
+	require.NoError(t, agg.Flush(context.Background()))
+	assert.Equal(t, map[time.Duration]int64{time.Minute: 1, time.Hour: 2}, harvested)
+	assert.Zero(t, keys(agg.stores[1].db, time.Hour))
+
+	// The pebble metrics identify the database by its aggregation intervals.
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, rdr.Collect(context.Background(), &rm))
+	var dbs []string
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name == "pebble.disk.usage" {
+				for _, dp := range m.Data.(metricdata.Gauge[int64]).DataPoints {
+					db, _ := dp.Attributes.Value(telemetry.DBKey)
+					dbs = append(dbs, db.AsString())
+				}
+			}
+		}
+	}
+	assert.ElementsMatch(t, []string{"1m,10m", "60m"}, dbs)
+}
+
+func TestPebbleMetricsSharedMeterProvider(t *testing.T) {
+	rdr := metric.NewManualReader()
+	mp := metric.NewMeterProvider(metric.WithReader(rdr))
+	newAggregator := func(ivls []time.Duration) *Aggregator {
+		return newTestAggregator(t, AggregatorConfig{
+			DataDirPerInterval:   map[time.Duration]string{ivls[1]: t.TempDir()},
+			AggregationIntervals: ivls,
+			MeterProvider:        mp,
+		})
+	}
+	// Aggregators sharing a meter provider, for example, chained
+	// aggregators in the same process, observe their own databases.
+	l1 := newAggregator([]time.Duration{time.Minute, time.Hour})
+	defer l1.Stop(context.Background())
+	l2 := newAggregator([]time.Duration{5 * time.Minute, 10 * time.Minute})
+	defer l2.Stop(context.Background())
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, rdr.Collect(context.Background(), &rm))
+	var dbs []string
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name == "pebble.disk.usage" {
+				for _, dp := range m.Data.(metricdata.Gauge[int64]).DataPoints {
+					db, _ := dp.Attributes.Value(telemetry.DBKey)
+					dbs = append(dbs, db.AsString())
+				}
+			}
+		}
+	}
+	assert.ElementsMatch(t, []string{"1m", "60m", "5m", "10m"}, dbs)
+}
+
+func TestPebbleOptions(t *testing.T) {
+	dataDir, hourDir := t.TempDir(), t.TempDir()
+	agg := newTestAggregator(t, AggregatorConfig{
+		DataDir:                  dataDir,
+		DataDirPerInterval:       map[time.Duration]string{time.Hour: hourDir},
+		AggregationIntervals:     []time.Duration{time.Minute, time.Hour},
+		PebbleCacheSize:          16 << 20,
+		MemtableSize:             32 << 20,
+		L0CompactionThreshold:    7,
+		MaxConcurrentCompactions: 3,
+		SSTableCompression:       SSTableCompressionZstd,
+	})
+
+	opts := agg.PebbleOptions()
+	for _, expected := range []string{
+		"# data_dir=" + dataDir + "\n# aggregation_intervals=1m\n",
+		"# data_dir=" + hourDir + "\n# aggregation_intervals=60m\n",
+		"cache_size=16777216\n",
+		"mem_table_size=33554432\n",
+		"l0_compaction_threshold=7\n",
+		"max_concurrent_compactions=3\n",
+		"merger=combined_metrics_merger\n",
+		"compression=ZSTD\n",
+	} {
+		assert.Contains(t, opts, expected)
+	}
+	// The options of both databases are included.
+	assert.Equal(t, 2, strings.Count(opts, "[Options]\n"))
+
+	// The options include pebble's defaults for the options not
+	// configured.
+	agg = newTestAggregator(t, AggregatorConfig{
+		AggregationIntervals: []time.Duration{time.Minute},
+	})
+	opts = agg.PebbleOptions()
+	assert.Contains(t, opts, "mem_table_size=4194304\n")
+	assert.Contains(t, opts, "compression=Snappy\n")
+	// The sstables have bloom filters, see comparer.
+	assert.Contains(t, opts, "filter_policy=rocksdb.BuiltinBloomFilter\n")
+	assert.Contains(t, opts, "filter_type=table\n")
+
+	// Custom stores are not included.
+	agg = newTestAggregator(t, AggregatorConfig{
+		AggregationIntervals: []time.Duration{time.Minute},
+		NewStore: func(_ string, _ []time.Duration, merge MergeFunc) (Store, error) {
+			return NewMapStore(merge), nil
+		},
+	})
+	assert.Empty(t, agg.PebbleOptions())
+}
+
+func TestContinueOnIntervalOpenError(t *testing.T) {
+	start := time.Unix(1686000000, 0).Truncate(time.Hour)
+	dataDir, hourDir := t.TempDir(), t.TempDir()
+	var harvested []CombinedMetricsKey
+	cfg := AggregatorConfig{
+		DataDir:            dataDir,
+		DataDirPerInterval: map[time.Duration]string{time.Hour: hourDir},
+		Limits: Limits{
+			MaxSpanGroups:                         1000,
+			MaxSpanGroupsPerService:               100,
+			MaxTransactionGroups:                  100,
+			MaxTransactionGroupsPerService:        10,
+			MaxServiceTransactionGroups:           100,
+			MaxServiceTransactionGroupsPerService: 10,
+			MaxServices:                           10,
+			MaxServiceInstanceGroupsPerService:    10,
+		},
+		Processor: func(_ context.Context, cmk CombinedMetricsKey, _ CombinedMetrics, _ time.Duration) error {
+			harvested = append(harvested, cmk)
+			return nil
+		},
+		AggregationIntervals: []time.Duration{time.Minute, time.Hour},
+		HarvestDelay:         time.Hour, // disable auto harvest
+		StrictChecksums:      true,
+		clock:                newFakeClock(start),
+	}
+	aggregate := func(agg *Aggregator, ivl time.Duration) error {
+		return agg.AggregateCombinedMetrics(
+			context.Background(),
+			CombinedMetricsKey{Interval: ivl, ProcessingTime: start, ID: "testid"},
+			CombinedMetrics(*createTestCombinedMetrics(1).
+				addTransaction(start, "svc", "", testTransaction{txnName: "txn", txnType: "type", count: 1})),
+		)
+	}
+
+	// Leave the aggregated metrics of the hour interval in an sstable
+	// and corrupt it.
+	agg, err := New(cfg, zap.NewNop())
+	require.NoError(t, err)
+	require.NoError(t, aggregate(agg, time.Hour))
+	_, err = agg.Snapshot(context.Background(), time.Hour)
+	require.NoError(t, err)
+	for _, s := range agg.stores {
+		require.NoError(t, s.db.Flush())
+		require.NoError(t, s.db.Close())
+	}
+	ssts, err := filepath.Glob(filepath.Join(hourDir, "*.sst"))
+	require.NoError(t, err)
+	require.Len(t, ssts, 1)
+	data, err := os.ReadFile(ssts[0])
+	require.NoError(t, err)
+	for i := 0; i < 8; i++ {
+		data[i] ^= 0xff
+	}
+	require.NoError(t, os.WriteFile(ssts[0], data, 0644))
+
+	_, err = New(cfg, zap.NewNop())
+	assert.ErrorIs(t, err, pebble.ErrCorruption)
+
+	// The minute interval keeps operating without the hour interval.
+	cfg.ContinueOnIntervalOpenError = true
+	agg, err = New(cfg, zap.NewNop())
+	require.NoError(t, err)
+	defer agg.Stop(context.Background())
+	assert.Equal(t, []time.Duration{time.Minute}, agg.aggregationIntervals)
+
+	health := agg.Health()
+	assert.False(t, health.Healthy)
+	assert.Equal(t, []time.Duration{time.Hour}, health.UnavailableIntervals)
+	require.Len(t, health.Problems, 1)
+	assert.Contains(t, health.Problems[0], "aggregation interval 1h0m0s is unavailable")
+
+	assert.ErrorIs(t, aggregate(agg, time.Hour), ErrIntervalUnavailable)
+	require.NoError(t, aggregate(agg, time.Minute))
+	require.NoError(t, agg.Flush(context.Background()))
+	assert.Equal(t, []CombinedMetricsKey{
+		{Interval: time.Minute, ProcessingTime: start, ID: "testid"},
+	}, harvested)
+
+	// New fails if none of the databases open.
+	cfg.DataDirPerInterval = map[time.Duration]string{time.Minute: hourDir, time.Hour: hourDir}
+	_, err = New(cfg, zap.NewNop())
+	assert.ErrorIs(t, err, pebble.ErrCorruption)
+}